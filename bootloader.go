@@ -12,6 +12,8 @@ import (
 	"os"
 
 	"github.com/Code-Hex/vz/v3/internal/objc"
+	"github.com/Code-Hex/vz/v3/kernel"
+	"github.com/Code-Hex/vz/v3/uki"
 )
 
 // BootLoader is the interface of boot loader definitions.
@@ -47,6 +49,11 @@ func (b *LinuxBootLoader) String() string {
 	)
 }
 
+// CommandLine returns the command-line parameters parsed as kernel.CommandLine.
+func (b *LinuxBootLoader) CommandLine() (*kernel.CommandLine, error) {
+	return kernel.ParseCommandLine(b.cmdLine)
+}
+
 // LinuxBootLoaderOption is an option for LinuxBootLoader.
 type LinuxBootLoaderOption func(b *LinuxBootLoader) error
 
@@ -62,6 +69,17 @@ func WithCommandLine(cmdLine string) LinuxBootLoaderOption {
 	}
 }
 
+// WithKernelCommandLine sets the command-line parameters built with kernel.CommandLine.
+// An error is returned if the command line can not be represented as a string.
+func WithKernelCommandLine(cmdLine *kernel.CommandLine) LinuxBootLoaderOption {
+	return func(b *LinuxBootLoader) error {
+		if err := cmdLine.Validate(); err != nil {
+			return err
+		}
+		return WithCommandLine(cmdLine.String())(b)
+	}
+}
+
 // WithInitrd sets the optional initial RAM disk.
 func WithInitrd(initrdPath string) LinuxBootLoaderOption {
 	return func(b *LinuxBootLoader) error {
@@ -76,6 +94,29 @@ func WithInitrd(initrdPath string) LinuxBootLoaderOption {
 	}
 }
 
+// WithAutoDecompress decompresses the Linux kernel before booting if it is compressed
+// by gzip, zstd or lz4, or wrapped in an EFI zboot image. Virtualization.framework can
+// not boot a compressed kernel on arm64.
+//
+// The decompressed kernel is stored in cacheDir and reused while the compressed kernel
+// is not changed. If cacheDir is empty, kernel.DefaultCacheDir is used.
+func WithAutoDecompress(cacheDir string) LinuxBootLoaderOption {
+	return func(b *LinuxBootLoader) error {
+		vmlinuz, err := kernel.DecompressToCache(b.vmlinuzPath, cacheDir)
+		if err != nil {
+			return fmt.Errorf("failed to decompress linux kernel: %w", err)
+		}
+		if vmlinuz == b.vmlinuzPath {
+			return nil
+		}
+		b.vmlinuzPath = vmlinuz
+		cs := charWithGoString(vmlinuz)
+		defer cs.Free()
+		C.setKernelURLVZLinuxBootLoader(objc.Ptr(b), cs.CString())
+		return nil
+	}
+}
+
 // NewLinuxBootLoader creates a LinuxBootLoader with the Linux kernel passed as Path.
 //
 // This is only supported on macOS 11 and newer, error will
@@ -107,6 +148,26 @@ func NewLinuxBootLoader(vmlinuz string, opts ...LinuxBootLoaderOption) (*LinuxBo
 	return bootLoader, nil
 }
 
+// NewLinuxBootLoaderFromUKI creates a LinuxBootLoader which boots the kernel of the
+// unified kernel image at path directly with its initial RAM disk and command line.
+// The contents are extracted into cacheDir by uki.ExtractToCache, and the kernel is
+// decompressed like WithAutoDecompress. The options are applied after them, so that
+// WithCommandLine replaces the command line of the image.
+func NewLinuxBootLoaderFromUKI(path, cacheDir string, opts ...LinuxBootLoaderOption) (*LinuxBootLoader, error) {
+	files, err := uki.ExtractToCache(path, cacheDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract the unified kernel image: %w", err)
+	}
+	ukiOpts := []LinuxBootLoaderOption{WithAutoDecompress(cacheDir)}
+	if files.Initrd != "" {
+		ukiOpts = append(ukiOpts, WithInitrd(files.Initrd))
+	}
+	if files.CommandLine != "" {
+		ukiOpts = append(ukiOpts, WithCommandLine(files.CommandLine))
+	}
+	return NewLinuxBootLoader(files.Linux, append(ukiOpts, opts...)...)
+}
+
 var _ BootLoader = (*LinuxBootLoader)(nil)
 
 // EFIBootLoader Boot loader configuration for booting guest operating systems expecting an EFI ROM.
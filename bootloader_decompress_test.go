@@ -0,0 +1,23 @@
+package vz_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3"
+)
+
+func TestLinuxBootLoaderAutoDecompress(t *testing.T) {
+	cacheDir := t.TempDir()
+	bootLoader, err := vz.NewLinuxBootLoader(
+		filepath.Join("kernel", "testdata", "Image.gz"),
+		vz.WithAutoDecompress(cacheDir),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(bootLoader.String(), cacheDir) {
+		t.Fatalf("want the decompressed kernel in %q but got %q", cacheDir, bootLoader.String())
+	}
+}
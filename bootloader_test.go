@@ -0,0 +1,46 @@
+package vz_test
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3"
+	"github.com/Code-Hex/vz/v3/kernel"
+)
+
+func TestLinuxBootLoaderCommandLine(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "vmlinuz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	cmdLine := kernel.NewCommandLine().
+		SetConsole(kernel.ConsoleHVC0).
+		SetRoot("/dev/vda", "").
+		Add("dyndbg", "file drivers/virtio/* +p").
+		SetInitArgs("single")
+	bootLoader, err := vz.NewLinuxBootLoader(f.Name(), vz.WithKernelCommandLine(cmdLine))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf("command-line: %q", cmdLine.String())
+	if got := bootLoader.String(); !strings.Contains(got, want) {
+		t.Fatalf("want %q in %q", want, got)
+	}
+	got, err := bootLoader.CommandLine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != cmdLine.String() {
+		t.Fatalf("want %q but got %q", cmdLine.String(), got.String())
+	}
+
+	_, err = vz.NewLinuxBootLoader(f.Name(), vz.WithKernelCommandLine(kernel.NewCommandLine().Add("a", `"`)))
+	if err == nil {
+		t.Fatal("want error for the invalid command line")
+	}
+}
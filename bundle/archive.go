@@ -0,0 +1,561 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package bundle
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Code-Hex/vz/v3/internal/zstd"
+	"golang.org/x/sys/unix"
+)
+
+// checksumFile is the last entry of an archive which has the SHA-256 digests of the
+// other entries in the format of sha256sum(1).
+const checksumFile = "SHA256SUMS"
+
+// paxSparseSize is the PAX record of the size of a sparse file.
+//
+// archive/tar cannot write the GNU sparse format, so that the sparse files are
+// written in the layout of the GNU sparse format 1.0 with this record instead of
+// GNU.sparse.realsize: the content of the entry is the sparse map padded to 512
+// bytes followed by the data of the extents.
+const paxSparseSize = "VZ.sparse.size"
+
+// maxSparseMap is the maximum size of a sparse map to read.
+const maxSparseMap = 64 << 20
+
+// ErrCorruptArchive is returned when an archive is malformed or its content does not
+// match the SHA-256 digests.
+var ErrCorruptArchive = errors.New("bundle: corrupt archive")
+
+// Export writes the bundle to w as a tar archive compressed with zstd. The archive
+// has the manifest, which includes the hardware model and the machine identifier,
+// the disk images, the EFI variable store, the auxiliary storage, the kernel and the
+// initial RAM disk in the bundle, and the SHA-256 digests of them.
+//
+// The holes of the disk images are not read and written, so that a large disk image
+// which is mostly unused is exported quickly.
+//
+// Export locks the bundle while it reads the files unless the bundle is already
+// locked by b. It returns ErrLocked if the virtual machine is running.
+func (b *Bundle) Export(w io.Writer) error {
+	if b.lock == nil {
+		if err := b.Lock(); err != nil {
+			return err
+		}
+		defer b.Unlock()
+	}
+
+	zw := zstd.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	var sums bytes.Buffer
+	add := func(hdr *tar.Header, write func(w io.Writer) error) error {
+		h := sha256.New()
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if err := write(io.MultiWriter(tw, h)); err != nil {
+			return fmt.Errorf("failed to export %s: %w", hdr.Name, err)
+		}
+		fmt.Fprintf(&sums, "%x  %s\n", h.Sum(nil), hdr.Name)
+		return nil
+	}
+
+	raw, err := os.ReadFile(filepath.Join(b.dir, manifestFile))
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: manifestFile, Mode: 0o644, Size: int64(len(raw)), ModTime: b.manifest.CreatedAt}
+	if err := add(hdr, func(w io.Writer) error {
+		_, err := w.Write(raw)
+		return err
+	}); err != nil {
+		return err
+	}
+	for _, f := range b.manifest.files() {
+		if err := b.exportFile(f.path, f.sparse, add); err != nil {
+			return err
+		}
+	}
+	hdr = &tar.Header{Name: checksumFile, Mode: 0o644, Size: int64(sums.Len()), ModTime: b.manifest.CreatedAt}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(sums.Bytes()); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ExportFile writes the archive of the bundle to path atomically.
+func (b *Bundle) ExportFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	bw := bufio.NewWriterSize(tmp, 1<<20)
+	if err := b.Export(bw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// bundleFile is a file in a bundle which is referred to by the manifest.
+type bundleFile struct {
+	path   string
+	sparse bool
+}
+
+// files returns the files of the bundle which are exported.
+func (m *Manifest) files() []bundleFile {
+	var files []bundleFile
+	for _, d := range m.Disks {
+		files = append(files, bundleFile{path: d.Path, sparse: true})
+	}
+	for _, p := range []string{m.EFIVariableStore, m.AuxiliaryStorage, m.Config.Kernel, m.Config.Initrd} {
+		if p != "" {
+			files = append(files, bundleFile{path: p})
+		}
+	}
+	return files
+}
+
+func (b *Bundle) exportFile(name string, sparse bool, add func(*tar.Header, func(io.Writer) error) error) error {
+	f, err := os.Open(filepath.Join(b.dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:    filepath.ToSlash(name),
+		Mode:    0o644,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+	if !sparse {
+		return add(hdr, func(w io.Writer) error {
+			_, err := io.Copy(w, f)
+			return err
+		})
+	}
+
+	extents, err := dataExtents(f, fi.Size())
+	if err != nil {
+		return fmt.Errorf("failed to find the data of %s: %w", name, err)
+	}
+	sparseMap := appendSparseMap(nil, extents)
+	hdr.Size = int64(len(sparseMap))
+	for _, e := range extents {
+		hdr.Size += e.length
+	}
+	hdr.Format = tar.FormatPAX
+	hdr.PAXRecords = map[string]string{paxSparseSize: strconv.FormatInt(fi.Size(), 10)}
+	return add(hdr, func(w io.Writer) error {
+		if _, err := w.Write(sparseMap); err != nil {
+			return err
+		}
+		for _, e := range extents {
+			if _, err := io.Copy(w, io.NewSectionReader(f, e.offset, e.length)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// extent is a range of a sparse file which has data.
+type extent struct {
+	offset, length int64
+}
+
+// dataExtents returns the extents of f which have data with SEEK_DATA and SEEK_HOLE.
+// The whole file is one extent if the file system does not support them.
+func dataExtents(f *os.File, size int64) ([]extent, error) {
+	var extents []extent
+	for off := int64(0); off < size; {
+		data, err := f.Seek(off, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// There is no data after off.
+			break
+		}
+		if err != nil {
+			return []extent{{offset: 0, length: size}}, nil
+		}
+		hole, err := f.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		hole = min(hole, size)
+		if hole > data {
+			extents = append(extents, extent{offset: data, length: hole - data})
+		}
+		off = hole
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
+
+// appendSparseMap appends the sparse map in the format of the GNU sparse format 1.0,
+// which is the decimal numbers of the number of the extents and their offsets and
+// lengths separated by newlines, padded to 512 bytes.
+func appendSparseMap(b []byte, extents []extent) []byte {
+	b = strconv.AppendInt(b, int64(len(extents)), 10)
+	b = append(b, '\n')
+	for _, e := range extents {
+		b = strconv.AppendInt(b, e.offset, 10)
+		b = append(b, '\n')
+		b = strconv.AppendInt(b, e.length, 10)
+		b = append(b, '\n')
+	}
+	if n := len(b) % 512; n != 0 {
+		b = append(b, make([]byte, 512-n)...)
+	}
+	return b
+}
+
+// readSparseMap reads the sparse map written by appendSparseMap. It validates that
+// the extents are sorted and in the file of size bytes.
+func readSparseMap(r io.Reader, size int64) ([]extent, error) {
+	var (
+		buf    []byte
+		fields []int64
+		block  [512]byte
+	)
+	need := 1
+	for read := 0; ; read += len(block) {
+		for len(fields) < need {
+			i := bytes.IndexByte(buf, '\n')
+			if i < 0 {
+				break
+			}
+			v, err := strconv.ParseInt(string(buf[:i]), 10, 64)
+			if err != nil || v < 0 {
+				return nil, fmt.Errorf("%w: invalid sparse map", ErrCorruptArchive)
+			}
+			buf = buf[i+1:]
+			fields = append(fields, v)
+			if len(fields) == 1 {
+				// Each extent has 2 numbers which have at least 2 bytes.
+				if v > maxSparseMap/4 {
+					return nil, fmt.Errorf("%w: too large sparse map", ErrCorruptArchive)
+				}
+				need += 2 * int(v)
+			}
+		}
+		if len(fields) == need {
+			break
+		}
+		if read >= maxSparseMap {
+			return nil, fmt.Errorf("%w: too large sparse map", ErrCorruptArchive)
+		}
+		if _, err := io.ReadFull(r, block[:]); err != nil {
+			return nil, fmt.Errorf("%w: failed to read the sparse map: %v", ErrCorruptArchive, err)
+		}
+		buf = append(buf, block[:]...)
+	}
+
+	extents := make([]extent, 0, fields[0])
+	end := int64(0)
+	for i := 1; i < len(fields); i += 2 {
+		e := extent{offset: fields[i], length: fields[i+1]}
+		if e.offset < end || e.length > size-e.offset {
+			return nil, fmt.Errorf("%w: invalid extent at %d", ErrCorruptArchive, e.offset)
+		}
+		end = e.offset + e.length
+		extents = append(extents, e)
+	}
+	return extents, nil
+}
+
+// ImportOption is an option of Import.
+type ImportOption func(*importOptions)
+
+type importOptions struct {
+	newIdentity          bool
+	newMachineIdentifier func() ([]byte, error)
+}
+
+// WithNewIdentity regenerates the identity of the imported virtual machine to run it
+// alongside the original one. The MAC addresses are replaced with random locally
+// administered addresses, and the machine identifier is replaced with the data
+// returned by newMachineIdentifier, such as the data representation of
+// vz.NewGenericMachineIdentifier. The machine identifier is removed if
+// newMachineIdentifier is nil, so that the caller creates a new one when the virtual
+// machine boots.
+func WithNewIdentity(newMachineIdentifier func() ([]byte, error)) ImportOption {
+	return func(o *importOptions) {
+		o.newIdentity = true
+		o.newMachineIdentifier = newMachineIdentifier
+	}
+}
+
+// Import creates a bundle at dir from the archive written by Export. The content of
+// the archive is verified with the SHA-256 digests, and ErrCorruptArchive is returned
+// if they do not match.
+//
+// The bundle is extracted in a temporary directory and renamed to dir, so that a
+// partial bundle is never seen. fs.ErrExist is returned if dir already exists.
+func Import(r io.Reader, dir string, opts ...ImportOption) (*Bundle, error) {
+	o := &importOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if _, err := os.Lstat(dir); err == nil {
+		return nil, fmt.Errorf("failed to import bundle %q: %w", dir, fs.ErrExist)
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), "."+filepath.Base(dir)+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to import bundle: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Chmod(tmp, 0o755); err != nil {
+		return nil, err
+	}
+	if err := extract(r, tmp); err != nil {
+		return nil, err
+	}
+
+	b, err := Open(tmp)
+	if err != nil {
+		return nil, err
+	}
+	if o.newIdentity {
+		if err := b.Update(func(m *Manifest) error {
+			return o.regenerate(m)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if err := renameNoReplace(tmp, dir); err != nil {
+		return nil, fmt.Errorf("failed to import bundle %q: %w", dir, err)
+	}
+	b.dir = dir
+	return b, nil
+}
+
+// extract extracts the archive into dir and verifies the digests.
+func extract(r io.Reader, dir string) error {
+	tr := tar.NewReader(zstd.NewReader(r))
+	var (
+		m       *Manifest
+		sums    map[string]string
+		digests = make(map[string]string)
+		files   = make(map[string]bool)
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrCorruptArchive, err)
+		}
+		if sums != nil {
+			return fmt.Errorf("%w: %s after %s", ErrCorruptArchive, hdr.Name, checksumFile)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("%w: %s is not a regular file", ErrCorruptArchive, hdr.Name)
+		}
+		name := filepath.FromSlash(hdr.Name)
+		if _, ok := digests[name]; ok {
+			return fmt.Errorf("%w: duplicated %s", ErrCorruptArchive, hdr.Name)
+		}
+
+		h := sha256.New()
+		tee := io.TeeReader(tr, h)
+		switch {
+		case name == checksumFile:
+			if sums, err = readChecksums(tr); err != nil {
+				return err
+			}
+			continue
+		case m == nil:
+			if name != manifestFile {
+				return fmt.Errorf("%w: %s is not the first entry", ErrCorruptArchive, manifestFile)
+			}
+			if m, err = extractManifest(tee, dir); err != nil {
+				return err
+			}
+			for _, f := range m.files() {
+				files[f.path] = f.sparse
+			}
+		default:
+			sparse, ok := files[name]
+			if !ok {
+				return fmt.Errorf("%w: %s is not in the manifest", ErrCorruptArchive, hdr.Name)
+			}
+			if err := extractFile(tee, hdr, filepath.Join(dir, name), sparse); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+			}
+		}
+		// The rest of the entry is read to verify the digest.
+		if _, err := io.Copy(io.Discard, tee); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorruptArchive, err)
+		}
+		digests[name] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	if m == nil || sums == nil {
+		return fmt.Errorf("%w: no %s or %s", ErrCorruptArchive, manifestFile, checksumFile)
+	}
+	for name := range files {
+		if _, ok := digests[name]; !ok {
+			return fmt.Errorf("%w: no %s", ErrCorruptArchive, name)
+		}
+	}
+	if err := verifyChecksums(digests, sums); err != nil {
+		return err
+	}
+	return nil
+}
+
+func extractManifest(r io.Reader, dir string) (*Manifest, error) {
+	raw, err := io.ReadAll(io.LimitReader(r, maxSparseMap))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptArchive, err)
+	}
+	// The manifest is validated by Open after the extraction, but the paths are
+	// needed here to extract the files.
+	m := &Manifest{}
+	if err := json.Unmarshal(raw, m); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestFile), raw, 0o644); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func extractFile(r io.Reader, hdr *tar.Header, path string, sparse bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if !sparse {
+		if _, err := io.Copy(f, r); err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	size, err := strconv.ParseInt(hdr.PAXRecords[paxSparseSize], 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("%w: invalid size of the sparse file", ErrCorruptArchive)
+	}
+	extents, err := readSparseMap(r, size)
+	if err != nil {
+		return err
+	}
+	for _, e := range extents {
+		if _, err := io.CopyN(io.NewOffsetWriter(f, e.offset), r, e.length); err != nil {
+			return fmt.Errorf("%w: %v", ErrCorruptArchive, err)
+		}
+	}
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func readChecksums(r io.Reader) (map[string]string, error) {
+	sums := make(map[string]string)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		sum, name, ok := strings.Cut(sc.Text(), "  ")
+		if !ok || len(sum) != sha256.Size*2 {
+			return nil, fmt.Errorf("%w: invalid line in %s", ErrCorruptArchive, checksumFile)
+		}
+		sums[filepath.FromSlash(name)] = sum
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptArchive, err)
+	}
+	return sums, nil
+}
+
+func verifyChecksums(digests, sums map[string]string) error {
+	if len(digests) != len(sums) {
+		return fmt.Errorf("%w: %s has %d entries but the archive has %d", ErrCorruptArchive, checksumFile, len(sums), len(digests))
+	}
+	for name, digest := range digests {
+		if sums[name] != digest {
+			return fmt.Errorf("%w: the SHA-256 digest of %s does not match", ErrCorruptArchive, name)
+		}
+	}
+	return nil
+}
+
+// regenerate replaces the MAC addresses and the machine identifier of m.
+func (o *importOptions) regenerate(m *Manifest) error {
+	for i := range m.MACAddresses {
+		mac, err := newMACAddress()
+		if err != nil {
+			return err
+		}
+		m.MACAddresses[i] = mac
+	}
+	m.MachineIdentifier = nil
+	if o.newMachineIdentifier != nil {
+		id, err := o.newMachineIdentifier()
+		if err != nil {
+			return fmt.Errorf("failed to create a new machine identifier: %w", err)
+		}
+		m.MachineIdentifier = id
+	}
+	return nil
+}
+
+// newMACAddress returns a random locally administered unicast MAC address like
+// vz.NewRandomLocallyAdministeredMACAddress.
+func newMACAddress() (string, error) {
+	mac := make(net.HardwareAddr, 6)
+	if _, err := rand.Read(mac); err != nil {
+		return "", err
+	}
+	mac[0] = mac[0]&^0x01 | 0x02
+	return mac.String(), nil
+}
@@ -0,0 +1,271 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package bundle_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/bundle"
+	"github.com/Code-Hex/vz/v3/internal/zstd"
+)
+
+// createBundle creates a bundle which has a sparse disk image with some data and an
+// EFI variable store.
+func createBundle(t *testing.T) *bundle.Bundle {
+	t.Helper()
+	m := newManifest()
+	m.Config.Kernel = ""
+	b, err := bundle.Create(filepath.Join(t.TempDir(), "debian.bundle"), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk, err := os.OpenFile(b.DiskPaths()[0], os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, off := range []int64{0, 40 << 20, 64<<20 - 4096} {
+		if _, err := disk.WriteAt(data[:min(len(data), int(64<<20-off))], off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(b.EFIVariableStorePath(), []byte("nvram"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func export(t *testing.T, b *bundle.Bundle) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := b.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExportImport(t *testing.T) {
+	src := createBundle(t)
+	archive := export(t, src)
+	// The disk image has 2 MiB and 4 KiB of the random data.
+	if len(archive) > 3<<20 {
+		t.Fatalf("want the archive without the holes but got %d bytes", len(archive))
+	}
+
+	dir := filepath.Join(t.TempDir(), "imported.bundle")
+	dst, err := bundle.Import(bytes.NewReader(archive), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.Dir() != dir {
+		t.Fatalf("want %q but got %q", dir, dst.Dir())
+	}
+	if want, got := src.Manifest(), dst.Manifest(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %+v but got %+v", want, got)
+	}
+	for i, path := range src.DiskPaths() {
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(dst.DiskPaths()[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Fatalf("want the same content of %s", path)
+		}
+	}
+	fi, err := os.Stat(dst.DiskPaths()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Blocks*512 >= fi.Size() {
+		t.Fatalf("want the sparse disk image but got %d blocks", st.Blocks)
+	}
+	if b, err := os.ReadFile(dst.EFIVariableStorePath()); err != nil || string(b) != "nvram" {
+		t.Fatalf("want the EFI variable store but got %q (%v)", b, err)
+	}
+
+	if _, err := bundle.Import(bytes.NewReader(archive), dir); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("want %v but got %v", fs.ErrExist, err)
+	}
+}
+
+func TestImportNewIdentity(t *testing.T) {
+	src := createBundle(t)
+	archive := export(t, src)
+
+	dir := filepath.Join(t.TempDir(), "clone.bundle")
+	dst, err := bundle.Import(bytes.NewReader(archive), dir, bundle.WithNewIdentity(func() ([]byte, error) {
+		return []byte("new identifier"), nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := dst.Manifest()
+	if string(m.MachineIdentifier) != "new identifier" {
+		t.Fatalf("want the new machine identifier but got %q", m.MachineIdentifier)
+	}
+	if len(m.MACAddresses) != 1 || m.MACAddresses[0] == src.Manifest().MACAddresses[0] {
+		t.Fatalf("want the new MAC address but got %q", m.MACAddresses)
+	}
+	mac, err := net.ParseMAC(m.MACAddresses[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mac[0]&0x03 != 0x02 {
+		t.Fatalf("want a locally administered unicast address but got %s", mac)
+	}
+	// The manifest in the bundle is updated.
+	opened, err := bundle.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, opened.Manifest()) {
+		t.Fatalf("want %+v but got %+v", m, opened.Manifest())
+	}
+}
+
+// rewrite rewrites the entries of the archive with fn.
+func rewrite(t *testing.T, archive []byte, fn func(hdr *tar.Header, data []byte) []byte) []byte {
+	t.Helper()
+	tr := tar.NewReader(zstd.NewReader(bytes.NewReader(archive)))
+	var buf bytes.Buffer
+	zw := zstd.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data = fn(hdr, data); data == nil {
+			continue
+		}
+		hdr.Size = int64(len(data))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImportCorrupt(t *testing.T) {
+	archive := export(t, createBundle(t))
+	cases := []struct {
+		name string
+		fn   func(hdr *tar.Header, data []byte) []byte
+	}{
+		{
+			name: "modified disk",
+			fn: func(hdr *tar.Header, data []byte) []byte {
+				if hdr.Name == "Disk.img" {
+					data[len(data)-1]++
+				}
+				return data
+			},
+		},
+		{
+			name: "no checksums",
+			fn: func(hdr *tar.Header, data []byte) []byte {
+				if hdr.Name == "SHA256SUMS" {
+					return nil
+				}
+				return data
+			},
+		},
+		{
+			name: "missing file",
+			fn: func(hdr *tar.Header, data []byte) []byte {
+				if hdr.Name == "NVRAM" {
+					return nil
+				}
+				return data
+			},
+		},
+		{
+			name: "outside of bundle",
+			fn: func(hdr *tar.Header, data []byte) []byte {
+				if hdr.Name == "NVRAM" {
+					hdr.Name = "../NVRAM"
+				}
+				return data
+			},
+		},
+		{
+			name: "truncated sparse map",
+			fn: func(hdr *tar.Header, data []byte) []byte {
+				if hdr.Name == "Disk.img" {
+					return data[:100]
+				}
+				return data
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "corrupt.bundle")
+			_, err := bundle.Import(bytes.NewReader(rewrite(t, archive, tc.fn)), dir)
+			if !errors.Is(err, bundle.ErrCorruptArchive) {
+				t.Fatalf("want %v but got %v", bundle.ErrCorruptArchive, err)
+			}
+			entries, err := os.ReadDir(parent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Fatalf("want no partial bundle but got %d entries", len(entries))
+			}
+		})
+	}
+}
+
+func TestExportLocked(t *testing.T) {
+	b := createBundle(t)
+	running, err := bundle.Open(b.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := running.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	defer running.Close()
+	if err := b.Export(io.Discard); !errors.Is(err, bundle.ErrLocked) {
+		t.Fatalf("want %v but got %v", bundle.ErrLocked, err)
+	}
+	// The holder of the lock can export the bundle.
+	if err := running.Export(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
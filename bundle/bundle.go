@@ -0,0 +1,295 @@
+//go:build darwin || linux
+// +build darwin linux
+
+// Package bundle manages virtual machine bundles, which are directories that have
+// the manifest of a virtual machine and its files such as disk images, the EFI
+// variable store and the auxiliary storage of macOS guests.
+//
+// A bundle is created atomically, migrated from the older versions of the manifest
+// when it is opened, and locked with flock(2) so that two processes do not boot the
+// same virtual machine.
+package bundle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// ErrNotBundle is returned when a directory is not a bundle.
+	ErrNotBundle = errors.New("bundle: not a bundle")
+
+	// ErrUnsupportedVersion is returned when the version of a manifest is newer than
+	// ManifestVersion.
+	ErrUnsupportedVersion = errors.New("bundle: unsupported manifest version")
+
+	// ErrLocked is returned when a bundle is locked by another process or another
+	// Bundle.
+	ErrLocked = errors.New("bundle: locked by another process")
+)
+
+// Bundle is an opened bundle.
+type Bundle struct {
+	dir      string
+	manifest *Manifest
+	lock     *os.File
+}
+
+// Create creates a new bundle at dir which is described by m. The disk images of the
+// manifest are created as empty sparse files of their sizes, and the other files are
+// created by the caller, such as vz.NewEFIVariableStore.
+//
+// The bundle is created in a temporary directory and renamed to dir, so that a
+// partial bundle is never seen. fs.ErrExist is returned if dir already exists.
+func Create(dir string, m *Manifest) (*Bundle, error) {
+	m = m.clone()
+	m.Version = ManifestVersion
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(dir); err == nil {
+		return nil, fmt.Errorf("failed to create bundle %q: %w", dir, fs.ErrExist)
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), "."+filepath.Base(dir)+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bundle: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	// MkdirTemp creates the directory with 0700.
+	if err := os.Chmod(tmp, 0o755); err != nil {
+		return nil, err
+	}
+	for _, d := range m.Disks {
+		if err := createDisk(filepath.Join(tmp, d.Path), d.Size); err != nil {
+			return nil, fmt.Errorf("failed to create disk %q: %w", d.Path, err)
+		}
+	}
+	if err := writeManifest(tmp, m); err != nil {
+		return nil, err
+	}
+	if err := renameNoReplace(tmp, dir); err != nil {
+		return nil, fmt.Errorf("failed to create bundle %q: %w", dir, err)
+	}
+	return &Bundle{dir: dir, manifest: m}, nil
+}
+
+// createDisk creates a sparse file of size bytes like vz.CreateDiskImage.
+func createDisk(path string, size int64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Open opens the bundle at dir. The manifest of an older version, including the
+// bundles created by the examples of this module, is migrated to ManifestVersion and
+// written back.
+func Open(dir string) (*Bundle, error) {
+	path := filepath.Join(dir, manifestFile)
+	raw, err := os.ReadFile(path)
+	version := 0
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if !isLegacy(dir) {
+			return nil, fmt.Errorf("%w: %s", ErrNotBundle, dir)
+		}
+	case err != nil:
+		return nil, err
+	default:
+		var v struct {
+			Version int `json:"version"`
+		}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+		}
+		version = v.Version
+	}
+	if version > ManifestVersion || version < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	migrated := version < ManifestVersion
+	for ; version < ManifestVersion; version++ {
+		if raw, err = migrations[version](dir, raw); err != nil {
+			return nil, fmt.Errorf("failed to migrate the manifest from version %d: %w", version, err)
+		}
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(raw, m); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	if migrated {
+		if err := writeManifest(dir, m); err != nil {
+			return nil, err
+		}
+	}
+	return &Bundle{dir: dir, manifest: m}, nil
+}
+
+// writeManifest writes the manifest to the bundle at dir atomically.
+func writeManifest(dir string, m *Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+manifestFile+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write the manifest: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write the manifest: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, manifestFile))
+}
+
+// Dir returns the directory of the bundle.
+func (b *Bundle) Dir() string {
+	return b.dir
+}
+
+// Manifest returns a copy of the manifest.
+func (b *Bundle) Manifest() *Manifest {
+	return b.manifest.clone()
+}
+
+// Update changes the manifest with fn and writes it atomically. The manifest is not
+// changed if fn or the validation returns an error.
+func (b *Bundle) Update(fn func(m *Manifest) error) error {
+	m := b.manifest.clone()
+	if err := fn(m); err != nil {
+		return err
+	}
+	m.Version = ManifestVersion
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	if err := writeManifest(b.dir, m); err != nil {
+		return err
+	}
+	b.manifest = m
+	return nil
+}
+
+// Path returns the absolute path of a file in the bundle such as a path of the
+// manifest. It returns "" if name is empty.
+func (b *Bundle) Path(name string) string {
+	if name == "" {
+		return ""
+	}
+	dir, err := filepath.Abs(b.dir)
+	if err != nil {
+		dir = b.dir
+	}
+	return filepath.Join(dir, name)
+}
+
+// DiskPaths returns the paths of the disk images in order.
+func (b *Bundle) DiskPaths() []string {
+	paths := make([]string, len(b.manifest.Disks))
+	for i, d := range b.manifest.Disks {
+		paths[i] = b.Path(d.Path)
+	}
+	return paths
+}
+
+// EFIVariableStorePath returns the path of the EFI variable store, or "" if the
+// manifest has no EFI variable store.
+func (b *Bundle) EFIVariableStorePath() string {
+	return b.Path(b.manifest.EFIVariableStore)
+}
+
+// AuxiliaryStoragePath returns the path of the auxiliary storage, or "" if the
+// manifest has no auxiliary storage.
+func (b *Bundle) AuxiliaryStoragePath() string {
+	return b.Path(b.manifest.AuxiliaryStorage)
+}
+
+// Lock acquires the exclusive lock of the bundle. It returns ErrLocked without
+// waiting if the bundle is locked by another process or another Bundle of the same
+// bundle. The lock is released by Unlock or Close, or when the process exits.
+func (b *Bundle) Lock() error {
+	if b.lock != nil {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(b.dir, lockFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open the lock file: %w", err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			if pid := readPID(f); pid != 0 {
+				return fmt.Errorf("%w: pid %d", ErrLocked, pid)
+			}
+			return ErrLocked
+		}
+		return fmt.Errorf("failed to lock the bundle: %w", err)
+	}
+	// The process ID is recorded to report the holder of the lock.
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	b.lock = f
+	return nil
+}
+
+func readPID(f *os.File) int {
+	b := make([]byte, 32)
+	n, _ := f.ReadAt(b, 0)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b[:n])))
+	return pid
+}
+
+// Unlock releases the lock acquired by Lock.
+func (b *Bundle) Unlock() error {
+	if b.lock == nil {
+		return nil
+	}
+	f := b.lock
+	b.lock = nil
+	// The lock file is left to avoid the race with the other processes which
+	// have opened it.
+	f.Truncate(0)
+	return f.Close()
+}
+
+// Close releases the lock of the bundle.
+func (b *Bundle) Close() error {
+	return b.Unlock()
+}
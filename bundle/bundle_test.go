@@ -0,0 +1,270 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package bundle_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/bundle"
+)
+
+func newManifest() *bundle.Manifest {
+	return &bundle.Manifest{
+		Name: "debian",
+		OS:   bundle.OSLinux,
+		Config: bundle.Config{
+			CPUCount:    2,
+			MemorySize:  2 << 30,
+			Kernel:      "vmlinuz",
+			CommandLine: "console=hvc0",
+		},
+		MachineIdentifier: []byte("identifier"),
+		Disks: []bundle.Disk{
+			{Path: "Disk.img", Size: 64 << 20},
+			{Path: "data/seed.img", Size: 1 << 20, ReadOnly: true},
+		},
+		MACAddresses:     []string{"52:54:00:12:34:56"},
+		EFIVariableStore: "NVRAM",
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "debian.bundle")
+	b, err := bundle.Create(dir, newManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := b.Manifest()
+	if m.Version != bundle.ManifestVersion || m.CreatedAt.IsZero() {
+		t.Fatalf("want the version and the creation time but got %d %v", m.Version, m.CreatedAt)
+	}
+	for i, path := range b.DiskPaths() {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := m.Disks[i].Size; fi.Size() != want {
+			t.Fatalf("want %d but got %d", want, fi.Size())
+		}
+	}
+	if want := filepath.Join(dir, "NVRAM"); !strings.HasSuffix(b.EFIVariableStorePath(), want) {
+		t.Fatalf("want %q but got %q", want, b.EFIVariableStorePath())
+	}
+	if path := b.AuxiliaryStoragePath(); path != "" {
+		t.Fatalf("want no auxiliary storage but got %q", path)
+	}
+
+	opened, err := bundle.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := opened.Manifest(); !reflect.DeepEqual(m, got) {
+		t.Fatalf("want %+v but got %+v", m, got)
+	}
+
+	if _, err := bundle.Create(dir, newManifest()); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("want %v but got %v", fs.ErrExist, err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("want no temporary directory but got %d entries", len(entries))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(m *bundle.Manifest)
+	}{
+		{name: "unknown OS", modify: func(m *bundle.Manifest) { m.OS = "windows" }},
+		{name: "Linux with hardware model", modify: func(m *bundle.Manifest) { m.HardwareModel = []byte("model") }},
+		{name: "macOS with kernel", modify: func(m *bundle.Manifest) { m.OS = bundle.OSMacOS; m.EFIVariableStore = "" }},
+		{name: "negative size", modify: func(m *bundle.Manifest) { m.Disks[0].Size = -1 }},
+		{name: "duplicated disk", modify: func(m *bundle.Manifest) { m.Disks[1].Path = m.Disks[0].Path }},
+		{name: "absolute path", modify: func(m *bundle.Manifest) { m.Disks[0].Path = "/etc/passwd" }},
+		{name: "outside of bundle", modify: func(m *bundle.Manifest) { m.Config.Initrd = "../initrd" }},
+		{name: "manifest", modify: func(m *bundle.Manifest) { m.EFIVariableStore = "manifest.json" }},
+		{name: "invalid MAC address", modify: func(m *bundle.Manifest) { m.MACAddresses = []string{"00:00:5e:00:53:00:00:01"} }},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newManifest()
+			tc.modify(m)
+			if err := m.Validate(); !errors.Is(err, bundle.ErrInvalidManifest) {
+				t.Fatalf("want %v but got %v", bundle.ErrInvalidManifest, err)
+			}
+			dir := filepath.Join(t.TempDir(), "invalid.bundle")
+			if _, err := bundle.Create(dir, m); !errors.Is(err, bundle.ErrInvalidManifest) {
+				t.Fatalf("want %v but got %v", bundle.ErrInvalidManifest, err)
+			}
+		})
+	}
+}
+
+func TestOpenLegacy(t *testing.T) {
+	cases := []struct {
+		name  string
+		files map[string]string
+		want  bundle.Manifest
+	}{
+		{
+			name: "gui-linux",
+			files: map[string]string{
+				"Disk.img":          "disk",
+				"MachineIdentifier": "identifier",
+				"NVRAM":             "nvram",
+			},
+			want: bundle.Manifest{
+				OS:                bundle.OSLinux,
+				MachineIdentifier: []byte("identifier"),
+				Disks:             []bundle.Disk{{Path: "Disk.img", Size: 4}},
+				EFIVariableStore:  "NVRAM",
+			},
+		},
+		{
+			name: "macOS",
+			files: map[string]string{
+				"Disk.img":          "disk image",
+				"MachineIdentifier": "identifier",
+				"HardwareModel":     "model",
+				"AuxiliaryStorage":  "aux",
+			},
+			want: bundle.Manifest{
+				OS:                bundle.OSMacOS,
+				HardwareModel:     []byte("model"),
+				MachineIdentifier: []byte("identifier"),
+				Disks:             []bundle.Disk{{Path: "Disk.img", Size: 10}},
+				AuxiliaryStorage:  "AuxiliaryStorage",
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range tc.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			modTime := time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+			if err := os.Chtimes(filepath.Join(dir, "MachineIdentifier"), modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+			b, err := bundle.Open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tc.want
+			want.Version = bundle.ManifestVersion
+			want.CreatedAt = modTime
+			if got := b.Manifest(); !reflect.DeepEqual(&want, got) {
+				t.Fatalf("want %+v but got %+v", &want, got)
+			}
+			// The migrated manifest is written back.
+			if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err != nil {
+				t.Fatal(err)
+			}
+			for name := range tc.files {
+				if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+					t.Fatalf("want the legacy file %s to be left: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenError(t *testing.T) {
+	if _, err := bundle.Open(t.TempDir()); !errors.Is(err, bundle.ErrNotBundle) {
+		t.Fatalf("want %v but got %v", bundle.ErrNotBundle, err)
+	}
+
+	dir := t.TempDir()
+	raw, err := json.Marshal(map[string]any{"version": bundle.ManifestVersion + 1, "os": "linux"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "manifest.json"), raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bundle.Open(dir); !errors.Is(err, bundle.ErrUnsupportedVersion) {
+		t.Fatalf("want %v but got %v", bundle.ErrUnsupportedVersion, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "manifest.json"), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bundle.Open(dir); !errors.Is(err, bundle.ErrInvalidManifest) {
+		t.Fatalf("want %v but got %v", bundle.ErrInvalidManifest, err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "debian.bundle")
+	b, err := bundle.Create(dir, newManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Update(func(m *bundle.Manifest) error {
+		m.Config.CPUCount = 4
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Update(func(m *bundle.Manifest) error {
+		m.MACAddresses = []string{"invalid"}
+		return nil
+	}); !errors.Is(err, bundle.ErrInvalidManifest) {
+		t.Fatalf("want %v but got %v", bundle.ErrInvalidManifest, err)
+	}
+	opened, err := bundle.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := opened.Manifest(); got.Config.CPUCount != 4 || got.MACAddresses[0] != "52:54:00:12:34:56" {
+		t.Fatalf("want the updated manifest but got %+v", got)
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "debian.bundle")
+	b1, err := bundle.Create(dir, newManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := bundle.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b1.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	err = b2.Lock()
+	if !errors.Is(err, bundle.ErrLocked) {
+		t.Fatalf("want %v but got %v", bundle.ErrLocked, err)
+	}
+	if want := "pid " + strconv.Itoa(os.Getpid()); !strings.Contains(err.Error(), want) {
+		t.Fatalf("want %q in the error but got %q", want, err)
+	}
+	if err := b1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b2.Lock(); err != nil {
+		t.Fatalf("want the lock after unlock but got %v", err)
+	}
+	if err := b2.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
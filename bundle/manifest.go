@@ -0,0 +1,206 @@
+package bundle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ManifestVersion is the version of the manifest which this package writes. The
+// bundles of the older versions are migrated when they are opened.
+const ManifestVersion = 1
+
+const (
+	manifestFile = "manifest.json"
+	lockFile     = ".lock"
+)
+
+// ErrInvalidManifest is returned when a manifest is invalid.
+var ErrInvalidManifest = errors.New("bundle: invalid manifest")
+
+// OS is the guest operating system of a bundle.
+type OS string
+
+const (
+	// OSLinux is a Linux guest which boots with LinuxBootLoader or EFIBootLoader.
+	OSLinux OS = "linux"
+	// OSMacOS is a macOS guest which boots with MacOSBootLoader.
+	OSMacOS OS = "macOS"
+)
+
+// Manifest describes a virtual machine in a bundle. The paths in the manifest are
+// relative to the bundle directory, so that the bundle can be moved.
+type Manifest struct {
+	// Version is the version of the manifest. It is set to ManifestVersion when the
+	// manifest is written.
+	Version int `json:"version"`
+	// Name is the name of the virtual machine.
+	Name string `json:"name,omitempty"`
+	// OS is the guest operating system.
+	OS OS `json:"os"`
+	// CreatedAt is the time when the bundle is created.
+	CreatedAt time.Time `json:"createdAt"`
+	// Config is the configuration of the virtual machine.
+	Config Config `json:"config"`
+	// HardwareModel is the data representation of MacHardwareModel of macOS guests.
+	HardwareModel []byte `json:"hardwareModel,omitempty"`
+	// MachineIdentifier is the data representation of GenericMachineIdentifier or
+	// MacMachineIdentifier.
+	MachineIdentifier []byte `json:"machineIdentifier,omitempty"`
+	// Disks are the disk images in the order of the storage devices.
+	Disks []Disk `json:"disks,omitempty"`
+	// MACAddresses are the MAC addresses of the network devices such as
+	// "52:54:00:12:34:56".
+	MACAddresses []string `json:"macAddresses,omitempty"`
+	// EFIVariableStore is the path of the EFIVariableStore file.
+	EFIVariableStore string `json:"efiVariableStore,omitempty"`
+	// AuxiliaryStorage is the path of the MacAuxiliaryStorage file of macOS guests.
+	AuxiliaryStorage string `json:"auxiliaryStorage,omitempty"`
+}
+
+// Config is the configuration of a virtual machine. The zero values mean that the
+// caller chooses the values.
+type Config struct {
+	// CPUCount is the number of the virtual CPUs.
+	CPUCount uint `json:"cpuCount,omitempty"`
+	// MemorySize is the size of the memory in bytes.
+	MemorySize uint64 `json:"memorySize,omitempty"`
+	// Kernel is the path of the Linux kernel to boot with LinuxBootLoader. The guest
+	// boots with EFIBootLoader if it is empty.
+	Kernel string `json:"kernel,omitempty"`
+	// Initrd is the path of the initial RAM disk.
+	Initrd string `json:"initrd,omitempty"`
+	// CommandLine is the kernel command line.
+	CommandLine string `json:"commandLine,omitempty"`
+}
+
+// Disk is a disk image in a bundle.
+type Disk struct {
+	// Path is the path of the disk image such as "Disk.img".
+	Path string `json:"path"`
+	// Size is the size of the disk image in bytes, which is used when the bundle is
+	// created.
+	Size int64 `json:"size"`
+	// ReadOnly reports whether the disk is attached read-only.
+	ReadOnly bool `json:"readOnly,omitempty"`
+}
+
+// Validate reports an error if the manifest is invalid.
+func (m *Manifest) Validate() error {
+	switch m.OS {
+	case OSLinux:
+		if len(m.HardwareModel) > 0 || m.AuxiliaryStorage != "" {
+			return fmt.Errorf("%w: Linux guests have no hardware model and auxiliary storage", ErrInvalidManifest)
+		}
+	case OSMacOS:
+		if m.Config.Kernel != "" || m.EFIVariableStore != "" {
+			return fmt.Errorf("%w: macOS guests have no Linux kernel and EFI variable store", ErrInvalidManifest)
+		}
+	default:
+		return fmt.Errorf("%w: unknown OS %q", ErrInvalidManifest, m.OS)
+	}
+	seen := make(map[string]bool)
+	paths := []string{m.Config.Kernel, m.Config.Initrd, m.EFIVariableStore, m.AuxiliaryStorage}
+	for _, d := range m.Disks {
+		if d.Size < 0 {
+			return fmt.Errorf("%w: the size of %q is negative", ErrInvalidManifest, d.Path)
+		}
+		if d.Path == "" || seen[d.Path] {
+			return fmt.Errorf("%w: the disk path %q is empty or duplicated", ErrInvalidManifest, d.Path)
+		}
+		seen[d.Path] = true
+		paths = append(paths, d.Path)
+	}
+	for _, p := range paths {
+		if p != "" && (!filepath.IsLocal(p) || filepath.Clean(p) == manifestFile || filepath.Clean(p) == lockFile) {
+			return fmt.Errorf("%w: %q is not a path in the bundle", ErrInvalidManifest, p)
+		}
+	}
+	for _, mac := range m.MACAddresses {
+		if hw, err := net.ParseMAC(mac); err != nil || len(hw) != 6 {
+			return fmt.Errorf("%w: invalid MAC address %q", ErrInvalidManifest, mac)
+		}
+	}
+	return nil
+}
+
+// clone returns a deep copy of the manifest.
+func (m *Manifest) clone() *Manifest {
+	c := *m
+	c.HardwareModel = append([]byte(nil), m.HardwareModel...)
+	c.MachineIdentifier = append([]byte(nil), m.MachineIdentifier...)
+	c.Disks = append([]Disk(nil), m.Disks...)
+	c.MACAddresses = append([]string(nil), m.MACAddresses...)
+	return &c
+}
+
+// migrations[i] converts the manifest of the version i in the bundle at dir into the
+// version i+1. The version 0 is the layout of the bundles of the examples, which have
+// no manifest.
+var migrations = []func(dir string, raw []byte) ([]byte, error){
+	0: migrateLegacy,
+}
+
+// Files of the bundles of the examples.
+const (
+	legacyDisk              = "Disk.img"
+	legacyMachineIdentifier = "MachineIdentifier"
+	legacyHardwareModel     = "HardwareModel"
+	legacyAuxiliaryStorage  = "AuxiliaryStorage"
+	legacyEFIVariableStore  = "NVRAM"
+)
+
+// isLegacy reports whether dir is a bundle created by the examples.
+func isLegacy(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, legacyMachineIdentifier))
+	return err == nil
+}
+
+// migrateLegacy creates the manifest of a bundle created by the examples. The files
+// of the hardware model and the machine identifier are left as they are.
+func migrateLegacy(dir string, _ []byte) ([]byte, error) {
+	m := &Manifest{Version: 1, OS: OSLinux}
+	read := func(name string) ([]byte, error) {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return b, err
+	}
+	var err error
+	if m.MachineIdentifier, err = read(legacyMachineIdentifier); err != nil {
+		return nil, err
+	}
+	if m.HardwareModel, err = read(legacyHardwareModel); err != nil {
+		return nil, err
+	}
+	if len(m.HardwareModel) > 0 {
+		m.OS = OSMacOS
+	}
+	fi, err := os.Stat(filepath.Join(dir, legacyMachineIdentifier))
+	if err != nil {
+		return nil, err
+	}
+	m.CreatedAt = fi.ModTime().UTC()
+	if fi, err := os.Stat(filepath.Join(dir, legacyDisk)); err == nil {
+		m.Disks = []Disk{{Path: legacyDisk, Size: fi.Size()}}
+	}
+	for _, f := range []struct {
+		name string
+		dst  *string
+		os   OS
+	}{
+		{name: legacyAuxiliaryStorage, dst: &m.AuxiliaryStorage, os: OSMacOS},
+		{name: legacyEFIVariableStore, dst: &m.EFIVariableStore, os: OSLinux},
+	} {
+		if _, err := os.Stat(filepath.Join(dir, f.name)); err == nil && m.OS == f.os {
+			*f.dst = f.name
+		}
+	}
+	return json.MarshalIndent(m, "", "  ")
+}
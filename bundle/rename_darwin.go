@@ -0,0 +1,8 @@
+package bundle
+
+import "golang.org/x/sys/unix"
+
+// renameNoReplace renames oldpath to newpath unless newpath exists.
+func renameNoReplace(oldpath, newpath string) error {
+	return unix.RenamexNp(oldpath, newpath, unix.RENAME_EXCL)
+}
@@ -0,0 +1,164 @@
+// Package cloudinit creates seed images of the cloud-init NoCloud data source.
+//
+// The seed image is attached to the virtual machine as a read-only disk, for example:
+//
+//	attachment, err := vz.NewDiskImageStorageDeviceAttachment("seed.iso", true)
+//	...
+//	config, err := vz.NewVirtioBlockDeviceConfiguration(attachment)
+//
+// or with vz.NewUSBMassStorageDeviceConfiguration. cloud-init in the guest finds the
+// disk by the volume label "cidata".
+//
+// see: https://cloudinit.readthedocs.io/en/latest/reference/datasources/nocloud.html
+package cloudinit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Code-Hex/vz/v3/fat"
+	"github.com/Code-Hex/vz/v3/iso9660"
+)
+
+// VolumeLabel is the volume label of the NoCloud seed image.
+const VolumeLabel = "cidata"
+
+// Names of the files in the seed image.
+const (
+	UserDataFile      = "user-data"
+	MetaDataFile      = "meta-data"
+	NetworkConfigFile = "network-config"
+	VendorDataFile    = "vendor-data"
+)
+
+// Format is the file system format of the seed image.
+type Format int
+
+const (
+	// FormatISO9660 is the ISO 9660 file system with the Joliet and Rock Ridge
+	// extensions, which is the same as "genisoimage -joliet -rock -volid cidata".
+	FormatISO9660 Format = iota
+	// FormatFAT is the FAT (vfat) file system whose label is "CIDATA".
+	FormatFAT
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatISO9660:
+		return "iso9660"
+	case FormatFAT:
+		return "vfat"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// Seed is the data of the NoCloud data source.
+type Seed struct {
+	// UserData is the content of "user-data", such as "#cloud-config\n...".
+	// An empty file is written if it is nil.
+	UserData []byte
+
+	// MetaData is the content of "meta-data". NewMetaData creates it from the
+	// instance ID and the host name. An empty file is written if it is nil.
+	MetaData []byte
+
+	// NetworkConfig is the content of "network-config". The file is written only
+	// if it is not nil.
+	NetworkConfig []byte
+
+	// VendorData is the content of "vendor-data". The file is written only if it
+	// is not nil.
+	VendorData []byte
+}
+
+// NewMetaData returns the meta-data which has the instance ID and the local host name.
+// cloud-init runs the per-instance modules again when the instance ID is changed.
+// The local host name is omitted if it is empty.
+func NewMetaData(instanceID, localHostname string) []byte {
+	// A JSON string is a valid YAML string.
+	quote := func(s string) string {
+		b, _ := json.Marshal(s)
+		return string(b)
+	}
+	metaData := "instance-id: " + quote(instanceID) + "\n"
+	if localHostname != "" {
+		metaData += "local-hostname: " + quote(localHostname) + "\n"
+	}
+	return []byte(metaData)
+}
+
+type seedFile struct {
+	name string
+	data []byte
+}
+
+func (s *Seed) files() []seedFile {
+	files := []seedFile{
+		{name: UserDataFile, data: s.UserData},
+		{name: MetaDataFile, data: s.MetaData},
+	}
+	if s.NetworkConfig != nil {
+		files = append(files, seedFile{name: NetworkConfigFile, data: s.NetworkConfig})
+	}
+	if s.VendorData != nil {
+		files = append(files, seedFile{name: VendorDataFile, data: s.VendorData})
+	}
+	return files
+}
+
+// WriteImage writes the seed image in the format to w.
+func (s *Seed) WriteImage(w io.Writer, format Format) error {
+	switch format {
+	case FormatISO9660:
+		img := iso9660.NewImage(iso9660.WithVolumeID(VolumeLabel))
+		for _, f := range s.files() {
+			if err := img.AddFile(f.name, f.data, 0o644); err != nil {
+				return err
+			}
+		}
+		_, err := img.WriteTo(w)
+		return err
+	case FormatFAT:
+		img := fat.NewImage(fat.WithLabel(VolumeLabel))
+		for _, f := range s.files() {
+			if err := img.AddFile(f.name, f.data, 0o644); err != nil {
+				return err
+			}
+		}
+		_, err := img.WriteTo(w)
+		return err
+	}
+	return fmt.Errorf("unsupported seed image format: %v", format)
+}
+
+// CreateImage creates the seed image in the format at path. The file is replaced
+// atomically.
+func (s *Seed) CreateImage(path string, format Format) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	bw := bufio.NewWriter(tmp)
+	if err := s.WriteImage(bw, format); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,161 @@
+package cloudinit_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/cloudinit"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func testSeed() *cloudinit.Seed {
+	return &cloudinit.Seed{
+		UserData: []byte("#cloud-config\n" +
+			"password: passw0rd\n" +
+			"chpasswd: { expire: False }\n" +
+			"ssh_pwauth: True\n"),
+		MetaData: cloudinit.NewMetaData("iid-vz-test", "vz-test"),
+		NetworkConfig: []byte("version: 2\n" +
+			"ethernets:\n" +
+			"  enp0s1:\n" +
+			"    dhcp4: true\n"),
+	}
+}
+
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func writeGolden(t *testing.T, name string, b []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeedGolden(t *testing.T) {
+	cases := []struct {
+		format cloudinit.Format
+		golden string
+		// label is the volume label at the offset of the image.
+		label       string
+		labelOffset int
+	}{
+		{
+			format:      cloudinit.FormatISO9660,
+			golden:      "seed.iso.gz",
+			label:       "cidata",
+			labelOffset: 16*2048 + 40,
+		},
+		{
+			format:      cloudinit.FormatFAT,
+			golden:      "seed.vfat.gz",
+			label:       "CIDATA     FAT12",
+			labelOffset: 43,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.format.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := testSeed().WriteImage(&buf, tc.format); err != nil {
+				t.Fatal(err)
+			}
+			got := buf.Bytes()
+			if len(got)%512 != 0 {
+				t.Fatalf("want the image size to be a multiple of 512 but got %d", len(got))
+			}
+			if label := string(got[tc.labelOffset : tc.labelOffset+len(tc.label)]); label != tc.label {
+				t.Fatalf("want label %q but got %q", tc.label, label)
+			}
+
+			golden := filepath.Join("testdata", tc.golden)
+			if *update {
+				writeGolden(t, golden, got)
+			}
+			if want := readGolden(t, golden); !bytes.Equal(want, got) {
+				t.Fatalf("the image differs from %s; run the test with -update if it is intended", golden)
+			}
+		})
+	}
+}
+
+func TestCreateImage(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "seed.iso")
+	if err := os.WriteFile(path, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	seed := testSeed()
+	if err := seed.CreateImage(path, cloudinit.FormatISO9660); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	if err := seed.WriteImage(&want, cloudinit.FormatISO9660); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want.Bytes(), got) {
+		t.Fatal("want the created image to be the same as the written image")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("want only the image in the directory but got %d entries", len(entries))
+	}
+}
+
+func TestNewMetaData(t *testing.T) {
+	cases := []struct {
+		instanceID string
+		hostname   string
+		want       string
+	}{
+		{
+			instanceID: "iid-local01",
+			hostname:   "vm",
+			want:       "instance-id: \"iid-local01\"\nlocal-hostname: \"vm\"\n",
+		},
+		{
+			instanceID: "id: with # special",
+			want:       "instance-id: \"id: with # special\"\n",
+		},
+	}
+	for _, tc := range cases {
+		if got := string(cloudinit.NewMetaData(tc.instanceID, tc.hostname)); got != tc.want {
+			t.Fatalf("want %q but got %q", tc.want, got)
+		}
+	}
+}
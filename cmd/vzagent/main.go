@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+// Command vzagent is the guest agent for Linux guests. It listens on a
+// virtio-vsock port and serves the requests of the host described in the
+// machine/agent package, such as powering off the guest and running commands.
+//
+//	vzagent [--port PORT]
+//
+// It is usually started by the init system of the guest, and must run as root to
+// power off the guest.
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/Code-Hex/vz/v3/machine/agent"
+	"golang.org/x/sys/unix"
+)
+
+func main() {
+	port := flag.Uint("port", uint(agent.DefaultPort), "virtio-vsock port to listen on")
+	flag.Parse()
+
+	ln, err := listenVsock(uint32(*port))
+	if err != nil {
+		log.Fatalf("vzagent: %v", err)
+	}
+	s := &agent.Server{
+		PowerOff: powerOff,
+		Exec:     agent.ExecCommand,
+		ErrorLog: func(err error) { log.Printf("vzagent: %v", err) },
+	}
+	log.Fatalf("vzagent: %v", s.Serve(ln))
+}
+
+// powerOff flushes the file systems and powers off the guest.
+func powerOff() error {
+	unix.Sync()
+	return unix.Reboot(unix.LINUX_REBOOT_CMD_POWER_OFF)
+}
@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// vsockListener is a net.Listener of virtio-vsock. net.FileListener cannot be
+// used because the net package does not know AF_VSOCK.
+type vsockListener struct {
+	fd   int
+	addr vsockAddr
+}
+
+type vsockAddr struct {
+	cid  uint32
+	port uint32
+}
+
+func (a vsockAddr) Network() string { return "vsock" }
+func (a vsockAddr) String() string  { return fmt.Sprintf("%d:%d", a.cid, a.port) }
+
+func listenVsock(port uint32) (net.Listener, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+	return &vsockListener{fd: fd, addr: vsockAddr{cid: unix.VMADDR_CID_ANY, port: port}}, nil
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	for {
+		fd, sa, err := unix.Accept4(l.fd, unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, os.NewSyscallError("accept", err)
+		}
+		remote := vsockAddr{}
+		if vm, ok := sa.(*unix.SockaddrVM); ok {
+			remote = vsockAddr{cid: vm.CID, port: vm.Port}
+		}
+		// The non-blocking file is registered to the poller of the runtime, so
+		// that the deadlines work.
+		return &vsockConn{File: os.NewFile(uintptr(fd), "vsock"), local: l.addr, remote: remote}, nil
+	}
+}
+
+func (l *vsockListener) Close() error {
+	unix.Shutdown(l.fd, unix.SHUT_RDWR)
+	return unix.Close(l.fd)
+}
+
+func (l *vsockListener) Addr() net.Addr { return l.addr }
+
+// vsockConn is a net.Conn of virtio-vsock.
+type vsockConn struct {
+	*os.File
+	local  vsockAddr
+	remote vsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr  { return c.local }
+func (c *vsockConn) RemoteAddr() net.Addr { return c.remote }
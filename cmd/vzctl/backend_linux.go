@@ -0,0 +1,7 @@
+package main
+
+import "github.com/Code-Hex/vz/v3/machine"
+
+// backend is nil because Virtualization.framework is not available. The commands
+// which do not boot machines still work for the bundles.
+var backend machine.Backend
@@ -0,0 +1,705 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/bundle"
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/agent"
+	"github.com/Code-Hex/vz/v3/machine/api"
+	"github.com/Code-Hex/vz/v3/machine/shutdown"
+	"github.com/Code-Hex/vz/v3/machine/snapshot"
+	"github.com/Code-Hex/vz/v3/machine/suspend"
+	"golang.org/x/term"
+)
+
+// controlSocket is the name of the Unix socket in the bundle of a running machine
+// which serves the API.
+const controlSocket = "control.sock"
+
+// suspendedState is the name of the file in the bundle which has the state of the
+// machine suspended by "start --suspend". The machine is resumed from it on the
+// next start.
+const suspendedState = "suspended.vzvmsave"
+
+// detachKey is Ctrl-] which detaches the terminal from the console like telnet(1).
+const detachKey = 0x1d
+
+func (a *app) bundleDir(name string) string {
+	return filepath.Join(a.home, name)
+}
+
+func (a *app) openBundle(name string) (*bundle.Bundle, error) {
+	if err := machine.ValidateName(name); err != nil {
+		return nil, err
+	}
+	b, err := bundle.Open(a.bundleDir(name))
+	if errors.Is(err, bundle.ErrNotBundle) || errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", machine.ErrNotFound, name)
+	}
+	return b, err
+}
+
+// client returns the client of the API of the running machine.
+func (a *app) client(name string) (*api.Client, error) {
+	b, err := a.openBundle(name)
+	if err != nil {
+		return nil, err
+	}
+	sock := b.Path(controlSocket)
+	if _, err := os.Stat(sock); err != nil {
+		return nil, fmt.Errorf("%w: %s is not running", machine.ErrInvalidState, name)
+	}
+	return api.NewClient(sock), nil
+}
+
+// notRunning converts the errors to connect to the API of a machine which has
+// exited without removing its socket.
+func notRunning(name string, err error) error {
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s is not running", machine.ErrInvalidState, name)
+	}
+	return err
+}
+
+// diskFlag is the --disk flag which is repeatable.
+type diskFlag []string
+
+func (d *diskFlag) String() string     { return strings.Join(*d, ",") }
+func (d *diskFlag) Set(v string) error { *d = append(*d, v); return nil }
+
+func (a *app) create(ctx context.Context, args []string) error {
+	var (
+		output, specFile            string
+		kernel, initrd, commandLine string
+		cpus                        uint
+		memory                      machine.Size
+		disks                       diskFlag
+		networks                    int
+	)
+	flags := a.flagSet("create", &output)
+	flags.StringVar(&specFile, "f", "", "spec file in JSON")
+	flags.UintVar(&cpus, "cpus", 0, "number of CPUs (default 2)")
+	flags.Var(&memory, "memory", "memory size such as 4GiB (default 2GiB)")
+	flags.StringVar(&kernel, "kernel", "", "Linux kernel to boot instead of EFI")
+	flags.StringVar(&initrd, "initrd", "", "initial RAM disk")
+	flags.StringVar(&commandLine, "cmdline", "", "kernel command line")
+	flags.Var(&disks, "disk", "size of a new disk image such as 16GiB, or a disk image to copy (repeatable)")
+	flags.IntVar(&networks, "networks", -1, "number of NAT network devices (default 1 without spec)")
+	pos, err := parse(flags, args, "NAME")
+	if err != nil {
+		return err
+	}
+	if err := checkOutput(output); err != nil {
+		return err
+	}
+	name := pos[0]
+	if err := machine.ValidateName(name); err != nil {
+		return err
+	}
+
+	spec := &machine.Spec{}
+	if specFile != "" {
+		if spec, err = machine.LoadSpec(specFile); err != nil {
+			return err
+		}
+	} else if networks < 0 {
+		networks = 1
+	}
+	spec.Name = name
+	if cpus != 0 {
+		spec.CPUs = cpus
+	}
+	if memory != 0 {
+		spec.Memory = memory
+	}
+	if kernel != "" {
+		spec.Kernel = kernel
+	}
+	if initrd != "" {
+		spec.Initrd = initrd
+	}
+	if commandLine != "" {
+		spec.CommandLine = commandLine
+	}
+	for _, d := range disks {
+		if size, err := machine.ParseSize(d); err == nil {
+			// CreateBundle creates the disk images which do not exist.
+			path := filepath.Join(a.bundleDir(name), fmt.Sprintf("new%d.img", len(spec.Disks)))
+			spec.Disks = append(spec.Disks, machine.Disk{Path: path, Size: size})
+			continue
+		}
+		path, err := filepath.Abs(d)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("--disk must be a size or an existing disk image: %w", err)
+		}
+		spec.Disks = append(spec.Disks, machine.Disk{Path: path})
+	}
+	if networks >= 0 {
+		spec.Networks = make([]machine.Network, networks)
+	}
+
+	if err := os.MkdirAll(a.home, 0o755); err != nil {
+		return err
+	}
+	b, err := machine.CreateBundle(a.bundleDir(name), spec)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%w: %s", machine.ErrExists, name)
+	}
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		return writeJSON(a.stdout, a.machineInfo(ctx, name, b))
+	}
+	fmt.Fprintf(a.stdout, "created %s\n", name)
+	return nil
+}
+
+func (a *app) start(ctx context.Context, args []string) error {
+	var opts bootOptions
+	flags := a.flagSet("start", nil)
+	flags.BoolVar(&opts.attach, "console", false, "attach the terminal to the serial console")
+	flags.StringVar(&opts.restorePath, "restore", "", "restore the state saved by save instead of booting")
+	flags.StringVar(&opts.snapshot, "snapshot", "", "restore the snapshot created by snapshot create instead of booting")
+	flags.BoolVar(&opts.suspend, "suspend", false, "suspend the machine to disk on SIGINT or SIGTERM instead of stopping it")
+	pos, err := parse(flags, args, "NAME")
+	if err != nil {
+		return err
+	}
+	if opts.restorePath != "" && opts.snapshot != "" {
+		return errors.New("--restore and --snapshot cannot be used together")
+	}
+	return a.boot(ctx, pos[0], opts)
+}
+
+func (a *app) restore(ctx context.Context, args []string) error {
+	var opts bootOptions
+	flags := a.flagSet("restore", nil)
+	flags.BoolVar(&opts.attach, "console", false, "attach the terminal to the serial console")
+	pos, err := parse(flags, args, "NAME", "PATH")
+	if err != nil {
+		return err
+	}
+	opts.restorePath = pos[1]
+	return a.boot(ctx, pos[0], opts)
+}
+
+type bootOptions struct {
+	// restorePath is the path of the state to restore instead of booting.
+	restorePath string
+	// snapshot is the name of the snapshot in the bundle to restore instead of
+	// booting.
+	snapshot string
+	// attach attaches the terminal to the serial console.
+	attach bool
+	// suspend suspends the machine to disk instead of stopping it when ctx is
+	// done.
+	suspend bool
+}
+
+// boot runs the machine in the foreground until it stops. When ctx is done, the
+// machine is suspended to disk with opts.suspend, or stopped by shutdown.Stop.
+//
+// The machine suspended last time is resumed unless a state or a snapshot to
+// restore is given, and it is booted cold if it cannot be resumed.
+func (a *app) boot(ctx context.Context, name string, opts bootOptions) error {
+	b, err := a.openBundle(name)
+	if err != nil {
+		return err
+	}
+	if err := b.Lock(); err != nil {
+		if errors.Is(err, bundle.ErrLocked) {
+			return fmt.Errorf("%w: %s is already running (%v)", machine.ErrInvalidState, name, err)
+		}
+		return err
+	}
+	defer b.Close()
+	if a.backend == nil {
+		return fmt.Errorf("%w: running machines requires macOS", machine.ErrUnsupported)
+	}
+
+	spec := machine.SpecFromBundle(b)
+	spec.Name = name
+	manager := machine.NewManager(a.backend)
+	var vm machine.Machine
+	if opts.snapshot != "" {
+		// The disks are replaced with the checkpoints of the snapshot before the
+		// machine is created.
+		vm, _, err = snapshot.Open(b).Restore(opts.snapshot, a.backend, spec)
+		if err != nil {
+			return fmt.Errorf("failed to restore %s from snapshot %s: %w", name, opts.snapshot, err)
+		}
+		if err := manager.Add(spec, vm); err != nil {
+			return err
+		}
+	} else {
+		vm, err = manager.Create(spec)
+		if err != nil {
+			return err
+		}
+	}
+	// The new machine identifier is stored to boot the same machine next time.
+	if idm, ok := vm.(interface{ MachineIdentifier() []byte }); ok && len(spec.MachineIdentifier) == 0 {
+		if id := idm.MachineIdentifier(); len(id) > 0 {
+			err := b.Update(func(m *bundle.Manifest) error {
+				m.MachineIdentifier = id
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	sock := b.Path(controlSocket)
+	os.Remove(sock)
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		return err
+	}
+	server := api.NewServer(manager)
+	srv := &http.Server{Handler: server}
+	go srv.Serve(ln)
+	defer func() {
+		server.Close()
+		srv.Close()
+		os.Remove(sock)
+	}()
+
+	suspended := b.Path(suspendedState)
+	if opts.restorePath != "" || opts.snapshot != "" {
+		if opts.restorePath != "" {
+			restorePath, err := filepath.Abs(opts.restorePath)
+			if err != nil {
+				return err
+			}
+			if err := manager.Restore(name, restorePath); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", name, err)
+			}
+		}
+		// The suspended state does not match the disks after the guest runs.
+		os.Remove(suspended)
+		err = manager.Resume(name)
+	} else {
+		var r *suspend.Result
+		r, err = suspend.Start(manager, name, suspended)
+		switch {
+		case r.Restored:
+			fmt.Fprintf(a.stderr, "%s is resumed from the suspended state\n", name)
+		case r.RestoreError != nil:
+			fmt.Fprintf(a.stderr, "failed to resume %s, booting: %v\n", name, r.RestoreError)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to start %s: %w", name, err)
+	}
+	fmt.Fprintf(a.stderr, "%s is running\n", name)
+	if opts.suspend {
+		if err := suspend.Validate(manager, name); err != nil {
+			fmt.Fprintf(a.stderr, "%s will be stopped instead of suspended: %v\n", name, err)
+			opts.suspend = false
+		}
+	}
+
+	if opts.attach {
+		conn, err := api.NewClient(sock).Console(ctx, name)
+		if err != nil {
+			return err
+		}
+		// The console is detached before returning, so that the terminal is
+		// restored before the process exits.
+		attachCtx, detach := context.WithCancel(ctx)
+		attached := make(chan struct{})
+		go func() {
+			defer close(attached)
+			a.attach(attachCtx, conn)
+		}()
+		defer func() {
+			detach()
+			<-attached
+		}()
+	}
+	if !opts.suspend {
+		suspended = ""
+	}
+	return a.wait(ctx, manager, name, suspended)
+}
+
+// wait waits until the machine stops. When ctx is done, the machine is suspended
+// to suspended if it is not empty, or stopped by shutdown.Stop.
+func (a *app) wait(ctx context.Context, manager *machine.Manager, name, suspended string) error {
+	type result struct {
+		state machine.State
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		state, err := manager.Wait(context.Background(), name)
+		done <- result{state: state, err: err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		if suspended != "" {
+			fmt.Fprintf(a.stderr, "suspending %s\n", name)
+			err := suspend.Suspend(manager, name, suspended)
+			if err == nil {
+				<-done
+				fmt.Fprintf(a.stderr, "%s is suspended\n", name)
+				return nil
+			}
+			fmt.Fprintf(a.stderr, "failed to suspend %s: %v\n", name, err)
+		}
+		fmt.Fprintf(a.stderr, "stopping %s\n", name)
+		vm, err := manager.Get(name)
+		if err != nil {
+			return err
+		}
+		report, err := shutdown.Stop(a.forceContext(), vm, a.shutdownOptions(vm)...)
+		fmt.Fprintf(a.stderr, "%s: %s\n", name, report)
+		if err != nil {
+			return err
+		}
+		r = <-done
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if r.state == machine.StateError {
+		return fmt.Errorf("%s stopped with an error", name)
+	}
+	fmt.Fprintf(a.stderr, "%s is stopped\n", name)
+	return nil
+}
+
+// forceContext returns the context which is done when the machine should be
+// stopped without waiting for the guest.
+func (a *app) forceContext() context.Context {
+	if a.force == nil {
+		return context.Background()
+	}
+	return a.force
+}
+
+// shutdownOptions returns the options of shutdown.Stop for vm. The guest agent is
+// asked to power off if the guest ignores the request.
+func (a *app) shutdownOptions(vm machine.Machine) []shutdown.Option {
+	opts := []shutdown.Option{shutdown.WithRequestTimeout(a.stopTimeout)}
+	if d, ok := vm.(machine.VsockDialer); ok {
+		opts = append(opts, shutdown.WithAgent(agent.NewMachineClient(d, agent.DefaultPort), a.stopTimeout/2))
+	}
+	return opts
+}
+
+// operation runs a command which calls the API of a running machine.
+func (a *app) operation(ctx context.Context, cmd string, args []string, setup func(flags *flag.FlagSet), fn func(c *api.Client, name string) (*machine.Info, error)) error {
+	var output string
+	flags := a.flagSet(cmd, &output)
+	if setup != nil {
+		setup(flags)
+	}
+	pos, err := parse(flags, args, "NAME")
+	if err != nil {
+		return err
+	}
+	if err := checkOutput(output); err != nil {
+		return err
+	}
+	name := pos[0]
+	c, err := a.client(name)
+	if err != nil {
+		return err
+	}
+	info, err := fn(c, name)
+	if err != nil {
+		return notRunning(name, err)
+	}
+	return writeState(a.stdout, output, info)
+}
+
+func (a *app) stop(ctx context.Context, args []string) error {
+	var force bool
+	setup := func(flags *flag.FlagSet) {
+		flags.BoolVar(&force, "force", false, "stop immediately without the cooperation of the guest")
+	}
+	return a.operation(ctx, "stop", args, setup, func(c *api.Client, name string) (*machine.Info, error) {
+		return c.Stop(ctx, name, force)
+	})
+}
+
+func (a *app) pause(ctx context.Context, args []string) error {
+	return a.operation(ctx, "pause", args, nil, func(c *api.Client, name string) (*machine.Info, error) {
+		return c.Pause(ctx, name)
+	})
+}
+
+func (a *app) resume(ctx context.Context, args []string) error {
+	return a.operation(ctx, "resume", args, nil, func(c *api.Client, name string) (*machine.Info, error) {
+		return c.Resume(ctx, name)
+	})
+}
+
+func (a *app) save(ctx context.Context, args []string) error {
+	var (
+		output string
+		stop   bool
+	)
+	flags := a.flagSet("save", &output)
+	flags.BoolVar(&stop, "stop", false, "stop the machine after saving instead of resuming it")
+	pos, err := parse(flags, args, "NAME", "PATH")
+	if err != nil {
+		return err
+	}
+	if err := checkOutput(output); err != nil {
+		return err
+	}
+	name := pos[0]
+	path, err := filepath.Abs(pos[1])
+	if err != nil {
+		return err
+	}
+	c, err := a.client(name)
+	if err != nil {
+		return err
+	}
+	info, err := c.Get(ctx, name)
+	if err != nil {
+		return notRunning(name, err)
+	}
+	running := info.State == machine.StateRunning
+	if running {
+		if _, err := c.Pause(ctx, name); err != nil {
+			return err
+		}
+	}
+	if info, err = c.Save(ctx, name, path); err != nil {
+		if running {
+			c.Resume(ctx, name)
+		}
+		return err
+	}
+	switch {
+	case stop:
+		info, err = c.Stop(ctx, name, true)
+	case running:
+		info, err = c.Resume(ctx, name)
+	}
+	if err != nil {
+		return err
+	}
+	return writeState(a.stdout, output, info)
+}
+
+func (a *app) console(ctx context.Context, args []string) error {
+	flags := a.flagSet("console", nil)
+	pos, err := parse(flags, args, "NAME")
+	if err != nil {
+		return err
+	}
+	name := pos[0]
+	c, err := a.client(name)
+	if err != nil {
+		return err
+	}
+	conn, err := c.Console(ctx, name)
+	if err != nil {
+		return notRunning(name, err)
+	}
+	return a.attach(ctx, conn)
+}
+
+// attach connects stdin and stdout to the console until Ctrl-] is typed, stdin
+// reaches EOF, the console is closed or ctx is done.
+func (a *app) attach(ctx context.Context, conn io.ReadWriteCloser) error {
+	defer conn.Close()
+	if f, ok := a.stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		state, err := term.MakeRaw(int(f.Fd()))
+		if err != nil {
+			return err
+		}
+		defer term.Restore(int(f.Fd()), state)
+	}
+	fmt.Fprint(a.stderr, "attached to the console, type Ctrl-] to detach\r\n")
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(a.stdout, conn)
+		errc <- err
+	}()
+	go func() {
+		errc <- copyInput(conn, a.stdin)
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// copyInput copies the input to the console until the detach key or EOF.
+func copyInput(w io.Writer, r io.Reader) error {
+	buf := make([]byte, 1024)
+	for {
+		n, err := r.Read(buf)
+		if i := bytes.IndexByte(buf[:n], detachKey); i >= 0 {
+			if i > 0 {
+				if _, err := w.Write(buf[:i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// machineInfo returns the information of the machine in the bundle. The state is
+// asked to the running machine.
+func (a *app) machineInfo(ctx context.Context, name string, b *bundle.Bundle) *machineInfo {
+	spec := machine.SpecFromBundle(b)
+	spec.Name = name
+	info := &machineInfo{Name: name, State: machine.StateStopped, Dir: b.Dir(), Spec: spec}
+	sock := b.Path(controlSocket)
+	if _, err := os.Stat(sock); err != nil {
+		return info
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if running, err := api.NewClient(sock).Get(ctx, name); err == nil {
+		info.State = running.State
+		info.StartedAt = running.StartedAt
+	}
+	return info
+}
+
+func (a *app) list(ctx context.Context, args []string) error {
+	var output string
+	flags := a.flagSet("list", &output)
+	if _, err := parse(flags, args); err != nil {
+		return err
+	}
+	if err := checkOutput(output); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(a.home)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	var infos []*machineInfo
+	for _, e := range entries {
+		if !e.IsDir() || machine.ValidateName(e.Name()) != nil {
+			continue
+		}
+		b, err := bundle.Open(a.bundleDir(e.Name()))
+		if err != nil {
+			continue
+		}
+		infos = append(infos, a.machineInfo(ctx, e.Name(), b))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return writeList(a.stdout, output, infos)
+}
+
+func (a *app) inspect(ctx context.Context, args []string) error {
+	var output string
+	flags := a.flagSet("inspect", &output)
+	pos, err := parse(flags, args, "NAME")
+	if err != nil {
+		return err
+	}
+	if err := checkOutput(output); err != nil {
+		return err
+	}
+	b, err := a.openBundle(pos[0])
+	if err != nil {
+		return err
+	}
+	return writeInspect(a.stdout, output, a.machineInfo(ctx, pos[0], b))
+}
+
+func (a *app) remove(ctx context.Context, args []string) error {
+	var force bool
+	flags := a.flagSet("rm", nil)
+	flags.BoolVar(&force, "force", false, "stop the running machine before removing it")
+	pos, err := parse(flags, args, "NAME")
+	if err != nil {
+		return err
+	}
+	name := pos[0]
+	b, err := a.openBundle(name)
+	if err != nil {
+		return err
+	}
+	err = b.Lock()
+	if errors.Is(err, bundle.ErrLocked) {
+		if !force {
+			return fmt.Errorf("%w: %s is running, stop it first or use --force", machine.ErrInvalidState, name)
+		}
+		if c, cerr := a.client(name); cerr == nil {
+			c.Stop(ctx, name, true)
+		}
+		err = a.waitLock(ctx, b)
+	}
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	if err := os.RemoveAll(b.Dir()); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "removed %s\n", name)
+	return nil
+}
+
+// waitLock waits until the lock of the bundle is released by the stopped machine.
+func (a *app) waitLock(ctx context.Context, b *bundle.Bundle) error {
+	ctx, cancel := context.WithTimeout(ctx, a.stopTimeout)
+	defer cancel()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		err := b.Lock()
+		if !errors.Is(err, bundle.ErrLocked) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-ticker.C:
+		}
+	}
+}
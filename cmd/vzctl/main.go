@@ -0,0 +1,208 @@
+//go:build darwin || linux
+// +build darwin linux
+
+// Command vzctl manages virtual machines stored as bundles.
+//
+//	vzctl create NAME [-f spec.json] [flags]   create a machine from a spec and flags
+//	vzctl start NAME [--console] [--restore PATH] [--snapshot SNAPSHOT] [--suspend]
+//	                                            boot the machine in the foreground
+//	vzctl stop NAME [--force]                  request the guest to stop
+//	vzctl pause NAME                           pause the machine
+//	vzctl resume NAME                          resume the machine
+//	vzctl save NAME PATH [--stop]              save the state of the machine
+//	vzctl restore NAME PATH [--console]        boot the machine from the saved state
+//	vzctl snapshot create NAME SNAPSHOT        create a snapshot of the running machine
+//	vzctl snapshot list NAME                   list the snapshots of the machine
+//	vzctl snapshot rm NAME SNAPSHOT            remove the snapshot
+//	vzctl console NAME                         attach to the serial console (Ctrl-] to detach)
+//	vzctl list                                 list the machines
+//	vzctl inspect NAME                         show the details of the machine
+//	vzctl rm NAME [--force]                    remove the machine
+//
+// The machines are stored under $VZCTL_HOME, or ~/.vzctl by default. Each machine is
+// a bundle which is locked while it is running, and the running machine is
+// controlled through the API served on the control.sock of the bundle.
+//
+// Most commands accept "-o json" to print JSON instead of the human-readable output.
+//
+// On SIGINT or SIGTERM, start and restore request the guest to stop, ask the guest
+// agent to power off if the guest ignores the request, and stop the machine
+// forcibly at last. The second signal stops it forcibly without waiting.
+//
+// A snapshot is the saved state of the machine together with the copies of its
+// disks, and is stored in the bundle. "start --snapshot" puts the disks of the
+// snapshot back and restores the state.
+//
+// With --suspend, start suspends the machine to disk on the signal instead, and
+// the next start resumes the machine from the saved state. The machine boots cold
+// if the state cannot be restored.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/shutdown"
+)
+
+// defaultStopTimeout is the time to wait for the guest to stop before it is stopped
+// forcibly.
+const defaultStopTimeout = 30 * time.Second
+
+// app is the state of vzctl. The fields are replaced in the tests.
+type app struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	home        string
+	backend     machine.Backend
+	stopTimeout time.Duration
+	// force is done on the second signal to stop the machine without waiting for
+	// the guest. It may be nil.
+	force context.Context
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(a *app, ctx context.Context, args []string) error
+}
+
+var commands = []command{
+	{name: "create", usage: "NAME [-f spec.json] [flags]", run: (*app).create},
+	{name: "start", usage: "NAME [--console] [--restore PATH] [--snapshot SNAPSHOT] [--suspend]", run: (*app).start},
+	{name: "stop", usage: "NAME [--force]", run: (*app).stop},
+	{name: "pause", usage: "NAME", run: (*app).pause},
+	{name: "resume", usage: "NAME", run: (*app).resume},
+	{name: "save", usage: "NAME PATH [--stop]", run: (*app).save},
+	{name: "restore", usage: "NAME PATH [--console]", run: (*app).restore},
+	{name: "snapshot", usage: "create|list|rm NAME [SNAPSHOT]", run: (*app).snapshot},
+	{name: "console", usage: "NAME", run: (*app).console},
+	{name: "list", usage: "", run: (*app).list},
+	{name: "inspect", usage: "NAME", run: (*app).inspect},
+	{name: "rm", usage: "NAME [--force]", run: (*app).remove},
+}
+
+func main() {
+	home := os.Getenv("VZCTL_HOME")
+	if home == "" {
+		dir, err := os.UserHomeDir()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "vzctl:", err)
+			os.Exit(1)
+		}
+		home = filepath.Join(dir, ".vzctl")
+	}
+	a := &app{
+		stdin:       os.Stdin,
+		stdout:      os.Stdout,
+		stderr:      os.Stderr,
+		home:        home,
+		backend:     backend,
+		stopTimeout: defaultStopTimeout,
+	}
+	ctx, force, stop := shutdown.NotifyContext(context.Background())
+	defer stop()
+	a.force = force
+	os.Exit(a.main(ctx, os.Args[1:]))
+}
+
+// main runs the command of args and returns the exit code.
+func (a *app) main(ctx context.Context, args []string) int {
+	err := a.run(ctx, args)
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errUsage):
+		return 2
+	default:
+		fmt.Fprintln(a.stderr, "vzctl:", err)
+		return 1
+	}
+}
+
+// errUsage is returned when the usage has been printed for invalid arguments.
+var errUsage = errors.New("invalid usage")
+
+func (a *app) run(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("vzctl", flag.ContinueOnError)
+	flags.SetOutput(a.stderr)
+	flags.StringVar(&a.home, "home", a.home, "directory of the machines")
+	flags.Usage = a.usage
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if flags.NArg() == 0 {
+		a.usage()
+		return errUsage
+	}
+	name, args := flags.Arg(0), flags.Args()[1:]
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(a, ctx, args)
+		}
+	}
+	fmt.Fprintf(a.stderr, "vzctl: unknown command %q\n", name)
+	a.usage()
+	return errUsage
+}
+
+func (a *app) usage() {
+	fmt.Fprintln(a.stderr, "usage: vzctl [--home DIR] COMMAND [ARGS]")
+	fmt.Fprintln(a.stderr, "\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(a.stderr, "  %-8s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+// flagSet creates the FlagSet of the command which has the output flag.
+func (a *app) flagSet(name string, output *string) *flag.FlagSet {
+	flags := flag.NewFlagSet("vzctl "+name, flag.ContinueOnError)
+	flags.SetOutput(a.stderr)
+	if output != nil {
+		flags.StringVar(output, "o", "text", "output format: text or json")
+	}
+	return flags
+}
+
+// parse parses args and checks the number of the positional arguments.
+func parse(flags *flag.FlagSet, args []string, names ...string) ([]string, error) {
+	// The flags are allowed after the positional arguments like "vzctl rm NAME --force".
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
+			}
+			return nil, errUsage
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(positional) != len(names) {
+		fmt.Fprintf(flags.Output(), "usage: %s", flags.Name())
+		for _, name := range names {
+			fmt.Fprintf(flags.Output(), " %s", name)
+		}
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+		return nil, errUsage
+	}
+	return positional, nil
+}
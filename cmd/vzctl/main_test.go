@@ -0,0 +1,452 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/fake"
+)
+
+// syncBuffer is a bytes.Buffer which can be written by the running commands while
+// the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type testApp struct {
+	*app
+	t       *testing.T
+	backend *fake.Backend
+}
+
+func newTestApp(t *testing.T) *testApp {
+	// The path of a Unix socket is limited to about 100 bytes.
+	home, err := os.MkdirTemp("", "vzctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(home) })
+	backend := fake.NewBackend()
+	return &testApp{
+		app: &app{
+			stdin:       strings.NewReader(""),
+			home:        home,
+			backend:     backend,
+			stopTimeout: time.Second,
+		},
+		t:       t,
+		backend: backend,
+	}
+}
+
+// exec runs vzctl with args and returns the exit code, stdout and stderr.
+func (a *testApp) exec(args ...string) (int, string, string) {
+	a.t.Helper()
+	var stdout, stderr bytes.Buffer
+	a.stdout, a.stderr = &stdout, &stderr
+	code := a.main(context.Background(), args)
+	return code, stdout.String(), stderr.String()
+}
+
+// mustExec runs vzctl with args and returns stdout. The test fails if it fails.
+func (a *testApp) mustExec(args ...string) string {
+	a.t.Helper()
+	code, stdout, stderr := a.exec(args...)
+	if code != 0 {
+		a.t.Fatalf("vzctl %s: exit %d: %s", strings.Join(args, " "), code, stderr)
+	}
+	return stdout
+}
+
+// boot starts the machine in the background like "vzctl start NAME" and returns the
+// function which sends the signal to stop it and waits for it to exit.
+func (a *testApp) boot(args ...string) (stop func() error) {
+	a.t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &app{
+		stdin:       a.stdin,
+		stdout:      &syncBuffer{},
+		stderr:      &syncBuffer{},
+		home:        a.home,
+		backend:     a.backend,
+		stopTimeout: a.stopTimeout,
+	}
+	done := make(chan error, 1)
+	go func() { done <- b.run(ctx, args) }()
+
+	name := args[1]
+	for !strings.Contains(b.stderr.(*syncBuffer).String(), name+" is running") {
+		select {
+		case err := <-done:
+			cancel()
+			a.t.Fatalf("vzctl %s: %v", strings.Join(args, " "), err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	stopped := false
+	stop = func() error {
+		if stopped {
+			return nil
+		}
+		stopped = true
+		cancel()
+		return <-done
+	}
+	a.t.Cleanup(func() { stop() })
+	return stop
+}
+
+func TestUsage(t *testing.T) {
+	a := newTestApp(t)
+	cases := [][]string{
+		{},
+		{"unknown"},
+		{"start"},
+		{"save", "vm"},
+		{"snapshot"},
+		{"snapshot", "create", "vm"},
+		{"list", "extra"},
+		{"stop", "--unknown", "vm"},
+	}
+	for _, args := range cases {
+		if code, _, stderr := a.exec(args...); code != 2 || !strings.Contains(strings.ToLower(stderr), "usage") {
+			t.Fatalf("vzctl %v: want exit 2 with the usage but got %d: %s", args, code, stderr)
+		}
+	}
+	if code, _, stderr := a.exec("list", "-o", "yaml"); code != 1 || !strings.Contains(stderr, "unknown output format") {
+		t.Fatalf("want an error of the output format but got %d: %s", code, stderr)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	a := newTestApp(t)
+	dir := t.TempDir()
+	kernel := filepath.Join(dir, "vmlinuz")
+	if err := os.WriteFile(kernel, []byte("kernel"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	spec := filepath.Join(dir, "spec.json")
+	if err := os.WriteFile(spec, []byte(`{"name": "ignored", "cpus": 4, "kernel": "vmlinuz", "commandLine": "console=hvc0"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := a.mustExec("create", "-f", spec, "--memory", "1GiB", "--disk", "16MiB", "debian"); got != "created debian\n" {
+		t.Fatalf("unexpected output %q", got)
+	}
+	a.mustExec("create", "alpine", "--cpus", "1", "--networks", "2")
+	if code, _, stderr := a.exec("create", "debian"); code != 1 || !strings.Contains(stderr, "already exists") {
+		t.Fatalf("want an error for the existing machine but got %d: %s", code, stderr)
+	}
+
+	var infos []*machineInfo
+	if err := json.Unmarshal([]byte(a.mustExec("list", "-o", "json")), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name != "alpine" || infos[1].Name != "debian" {
+		t.Fatalf("unexpected list %+v", infos)
+	}
+	debian := infos[1].Spec
+	if debian.CPUs != 4 || debian.Memory != machine.GiB || debian.CommandLine != "console=hvc0" || len(debian.Disks) != 1 || len(debian.Networks) != 0 {
+		t.Fatalf("unexpected spec %+v", debian)
+	}
+	if b, err := os.ReadFile(debian.Kernel); err != nil || string(b) != "kernel" {
+		t.Fatalf("want the copied kernel but got %q, %v", b, err)
+	}
+	if alpine := infos[0].Spec; alpine.CPUs != 1 || len(alpine.Networks) != 2 || alpine.EFIVariableStore == "" {
+		t.Fatalf("unexpected spec %+v", alpine)
+	}
+
+	list := a.mustExec("list")
+	for _, want := range []string{"NAME", "alpine", "debian", "stopped", "1GiB"} {
+		if !strings.Contains(list, want) {
+			t.Fatalf("want %q in the list but got:\n%s", want, list)
+		}
+	}
+	inspect := a.mustExec("inspect", "debian")
+	for _, want := range []string{"State:", "stopped", "console=hvc0", "16MiB"} {
+		if !strings.Contains(inspect, want) {
+			t.Fatalf("want %q in inspect but got:\n%s", want, inspect)
+		}
+	}
+
+	a.mustExec("rm", "alpine")
+	if code, _, stderr := a.exec("inspect", "alpine"); code != 1 || !strings.Contains(stderr, "not found") {
+		t.Fatalf("want not found but got %d: %s", code, stderr)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	a := newTestApp(t)
+	a.mustExec("create", "vm")
+	stop := a.boot("start", "vm")
+
+	steps := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"pause", "vm"}, want: "vm is paused\n"},
+		{args: []string{"resume", "vm"}, want: "vm is running\n"},
+		{args: []string{"save", "vm", filepath.Join(a.home, "vm.state")}, want: "vm is running\n"},
+	}
+	for _, step := range steps {
+		if got := a.mustExec(step.args...); got != step.want {
+			t.Fatalf("vzctl %v: want %q but got %q", step.args, step.want, got)
+		}
+	}
+	var info machineInfo
+	if err := json.Unmarshal([]byte(a.mustExec("inspect", "-o", "json", "vm")), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.State != machine.StateRunning || info.StartedAt == nil {
+		t.Fatalf("want running but got %+v", info)
+	}
+	if code, _, stderr := a.exec("start", "vm"); code != 1 || !strings.Contains(stderr, "already running") {
+		t.Fatalf("want an error for the running machine but got %d: %s", code, stderr)
+	}
+	if code, _, stderr := a.exec("rm", "vm"); code != 1 || !strings.Contains(stderr, "is running") {
+		t.Fatalf("want an error for the running machine but got %d: %s", code, stderr)
+	}
+
+	if got := a.mustExec("stop", "vm"); got != "vm is stopped\n" {
+		t.Fatalf("unexpected output %q", got)
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if code, _, stderr := a.exec("pause", "vm"); code != 1 || !strings.Contains(stderr, "not running") {
+		t.Fatalf("want an error for the stopped machine but got %d: %s", code, stderr)
+	}
+
+	// The machine is restored from the state saved above.
+	a.boot("restore", "vm", filepath.Join(a.home, "vm.state"))
+	if m := a.backend.Machine("vm"); m.State() != machine.StateRunning {
+		t.Fatalf("want the restored machine running but got %s", m.State())
+	}
+	a.mustExec("rm", "--force", "vm")
+	if _, err := os.Stat(filepath.Join(a.home, "vm")); !os.IsNotExist(err) {
+		t.Fatalf("want the removed bundle but got %v", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	a := newTestApp(t)
+	kernel := filepath.Join(t.TempDir(), "vmlinuz")
+	if err := os.WriteFile(kernel, []byte("kernel"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a.mustExec("create", "vm", "--kernel", kernel, "--disk", "1MiB")
+	var info machineInfo
+	if err := json.Unmarshal([]byte(a.mustExec("inspect", "-o", "json", "vm")), &info); err != nil {
+		t.Fatal(err)
+	}
+	disk := info.Spec.Disks[0].Path
+	writeDisk := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(disk, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if code, _, stderr := a.exec("snapshot", "create", "vm", "first"); code != 1 || !strings.Contains(stderr, "not running") {
+		t.Fatalf("want an error for the stopped machine but got %d: %s", code, stderr)
+	}
+
+	writeDisk("before")
+	stop := a.boot("start", "vm")
+	if got := a.mustExec("snapshot", "create", "vm", "first"); got != "created snapshot first of vm\n" {
+		t.Fatalf("unexpected output %q", got)
+	}
+	if s := a.backend.Machine("vm").State(); s != machine.StateRunning {
+		t.Fatalf("want the machine resumed but got %s", s)
+	}
+	writeDisk("after")
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _, stderr := a.exec("start", "vm", "--snapshot", "missing"); code != 1 || !strings.Contains(stderr, "not found") {
+		t.Fatalf("want an error for the missing snapshot but got %d: %s", code, stderr)
+	}
+	stop = a.boot("start", "vm", "--snapshot", "first")
+	if s := a.backend.Machine("vm").State(); s != machine.StateRunning {
+		t.Fatalf("want the restored machine running but got %s", s)
+	}
+	if b, err := os.ReadFile(disk); err != nil || string(b) != "before" {
+		t.Fatalf("want the disk of the snapshot but got %q, %v", b, err)
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	var list []struct {
+		Name       string     `json:"name"`
+		RestoredAt *time.Time `json:"restoredAt"`
+	}
+	if err := json.Unmarshal([]byte(a.mustExec("snapshot", "list", "-o", "json", "vm")), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "first" || list[0].RestoredAt == nil {
+		t.Fatalf("unexpected snapshots %+v", list)
+	}
+	if got := a.mustExec("snapshot", "list", "vm"); !strings.Contains(got, "first") {
+		t.Fatalf("want the snapshot in the list but got:\n%s", got)
+	}
+	a.mustExec("snapshot", "rm", "vm", "first")
+	if got := a.mustExec("snapshot", "list", "-o", "json", "vm"); got != "[]\n" {
+		t.Fatalf("want no snapshots but got %q", got)
+	}
+}
+
+func TestSignal(t *testing.T) {
+	a := newTestApp(t)
+	a.mustExec("create", "vm")
+
+	stop := a.boot("start", "vm")
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if n := a.backend.Machine("vm").StopRequests(); n != 1 {
+		t.Fatalf("want a stop request but got %d", n)
+	}
+
+	// The guest which ignores the stop request is stopped after the timeout.
+	a.stopTimeout = 10 * time.Millisecond
+	stop = a.boot("start", "vm")
+	a.backend.Machine("vm").IgnoreStopRequests(true)
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if s := a.backend.Machine("vm").State(); s != machine.StateStopped {
+		t.Fatalf("want stopped but got %s", s)
+	}
+}
+
+func TestSuspend(t *testing.T) {
+	a := newTestApp(t)
+	a.mustExec("create", "vm")
+	state := filepath.Join(a.home, "vm", suspendedState)
+
+	stop := a.boot("start", "vm", "--suspend")
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	m := a.backend.Machine("vm")
+	if s := m.State(); s != machine.StateStopped {
+		t.Fatalf("want stopped but got %s", s)
+	}
+	if n := m.StopRequests(); n != 0 {
+		t.Fatalf("want no stop requests but got %d", n)
+	}
+	if _, err := os.Stat(state); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next start resumes the machine and consumes the state.
+	stop = a.boot("start", "vm")
+	if s := a.backend.Machine("vm").State(); s != machine.StateRunning {
+		t.Fatalf("want running but got %s", s)
+	}
+	if _, err := os.Stat(state); !os.IsNotExist(err) {
+		t.Fatalf("want the state removed but got %v", err)
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The corrupted state falls back to a cold boot.
+	if err := os.WriteFile(state, []byte("corrupted"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stop = a.boot("start", "vm")
+	if s := a.backend.Machine("vm").State(); s != machine.StateRunning {
+		t.Fatalf("want running but got %s", s)
+	}
+	if _, err := os.Stat(state); !os.IsNotExist(err) {
+		t.Fatalf("want the state removed but got %v", err)
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsole(t *testing.T) {
+	a := newTestApp(t)
+	a.mustExec("create", "vm")
+	a.boot("start", "vm")
+	guest := a.backend.Machine("vm").Guest()
+
+	stdin, input := io.Pipe()
+	stdout := &syncBuffer{}
+	c := &app{stdin: stdin, stdout: stdout, stderr: io.Discard, home: a.home}
+	done := make(chan error, 1)
+	go func() { done <- c.run(context.Background(), []string{"console", "vm"}) }()
+
+	go input.Write([]byte("ls\r"))
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(guest, buf); err != nil || string(buf) != "ls\r" {
+		t.Fatalf("want the input but got %q, %v", buf, err)
+	}
+	go guest.Write([]byte("hello\r\n"))
+	deadline := time.Now().Add(5 * time.Second)
+	for stdout.String() != "hello\r\n" {
+		if time.Now().After(deadline) {
+			t.Fatalf("want the output but got %q", stdout.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Ctrl-] detaches without sending it to the guest.
+	go input.Write([]byte{detachKey})
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("console did not detach")
+	}
+}
+
+func TestCopyInput(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{in: "abc", want: "abc"},
+		{in: "ab\x1dcd", want: "ab"},
+		{in: "\x1d", want: ""},
+	}
+	for _, tc := range cases {
+		var out bytes.Buffer
+		if err := copyInput(&out, strings.NewReader(tc.in)); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tc.want {
+			t.Fatalf("want %q but got %q", tc.want, out.String())
+		}
+	}
+}
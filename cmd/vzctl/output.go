@@ -0,0 +1,127 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/snapshot"
+)
+
+// machineInfo is the output of list and inspect.
+type machineInfo struct {
+	Name      string        `json:"name"`
+	State     machine.State `json:"state"`
+	Dir       string        `json:"dir"`
+	StartedAt *time.Time    `json:"startedAt,omitempty"`
+	Spec      *machine.Spec `json:"spec"`
+}
+
+func checkOutput(output string) error {
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unknown output format %q: must be text or json", output)
+	}
+	return nil
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// writeState writes the state of the machine after an operation.
+func writeState(w io.Writer, output string, info *machine.Info) error {
+	if output == "json" {
+		return writeJSON(w, struct {
+			Name  string        `json:"name"`
+			State machine.State `json:"state"`
+		}{Name: info.Name, State: info.State})
+	}
+	_, err := fmt.Fprintf(w, "%s is %s\n", info.Name, info.State)
+	return err
+}
+
+func writeList(w io.Writer, output string, infos []*machineInfo) error {
+	if output == "json" {
+		if infos == nil {
+			infos = []*machineInfo{}
+		}
+		return writeJSON(w, infos)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATE\tOS\tCPUS\tMEMORY\tDISKS")
+	for _, info := range infos {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%d\n",
+			info.Name, info.State, info.Spec.OS, info.Spec.CPUs, info.Spec.Memory, len(info.Spec.Disks))
+	}
+	return tw.Flush()
+}
+
+func writeInspect(w io.Writer, output string, info *machineInfo) error {
+	if output == "json" {
+		return writeJSON(w, info)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	spec := info.Spec
+	fmt.Fprintf(tw, "Name:\t%s\n", info.Name)
+	fmt.Fprintf(tw, "State:\t%s\n", info.State)
+	if info.StartedAt != nil {
+		fmt.Fprintf(tw, "Started:\t%s\n", info.StartedAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(tw, "Bundle:\t%s\n", info.Dir)
+	fmt.Fprintf(tw, "OS:\t%s\n", spec.OS)
+	fmt.Fprintf(tw, "CPUs:\t%d\n", spec.CPUs)
+	fmt.Fprintf(tw, "Memory:\t%s\n", spec.Memory)
+	if spec.Kernel != "" {
+		fmt.Fprintf(tw, "Kernel:\t%s\n", spec.Kernel)
+	}
+	if spec.Initrd != "" {
+		fmt.Fprintf(tw, "Initrd:\t%s\n", spec.Initrd)
+	}
+	if spec.CommandLine != "" {
+		fmt.Fprintf(tw, "Command line:\t%s\n", spec.CommandLine)
+	}
+	for i, d := range spec.Disks {
+		var ro string
+		if d.ReadOnly {
+			ro = " (read-only)"
+		}
+		fmt.Fprintf(tw, "Disk %d:\t%s %s%s\n", i, d.Path, d.Size, ro)
+	}
+	macs := make([]string, len(spec.Networks))
+	for i, n := range spec.Networks {
+		macs[i] = n.MACAddress
+	}
+	if len(macs) > 0 {
+		fmt.Fprintf(tw, "Networks:\t%s\n", strings.Join(macs, ", "))
+	}
+	return tw.Flush()
+}
+
+func writeSnapshots(w io.Writer, output string, list []*snapshot.Snapshot) error {
+	if output == "json" {
+		if list == nil {
+			list = []*snapshot.Snapshot{}
+		}
+		return writeJSON(w, list)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SNAPSHOT\tCREATED\tRESTORED\tHOST\tSTATE SIZE")
+	for _, s := range list {
+		restored := "-"
+		if s.RestoredAt != nil {
+			restored = s.RestoredAt.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			s.Name, s.CreatedAt.Local().Format(time.RFC3339), restored, s.Host, machine.Size(s.StateSize))
+	}
+	return tw.Flush()
+}
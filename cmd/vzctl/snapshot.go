@@ -0,0 +1,164 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/api"
+	"github.com/Code-Hex/vz/v3/machine/snapshot"
+)
+
+// snapshot runs the subcommands which manage the snapshots stored in the bundle of
+// a machine. A snapshot is restored by "start NAME --snapshot SNAPSHOT".
+func (a *app) snapshot(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "create":
+			return a.snapshotCreate(ctx, args[1:])
+		case "list":
+			return a.snapshotList(ctx, args[1:])
+		case "rm":
+			return a.snapshotRemove(ctx, args[1:])
+		}
+		fmt.Fprintf(a.stderr, "vzctl: unknown snapshot command %q\n", args[0])
+	}
+	fmt.Fprintln(a.stderr, "usage: vzctl snapshot create|list|rm NAME [SNAPSHOT]")
+	return errUsage
+}
+
+// snapshotCreate creates a snapshot of the running machine. The machine is paused
+// while the snapshot is created through the API of the machine.
+func (a *app) snapshotCreate(ctx context.Context, args []string) error {
+	var output string
+	flags := a.flagSet("snapshot create", &output)
+	pos, err := parse(flags, args, "NAME", "SNAPSHOT")
+	if err != nil {
+		return err
+	}
+	if err := checkOutput(output); err != nil {
+		return err
+	}
+	name := pos[0]
+	b, err := a.openBundle(name)
+	if err != nil {
+		return err
+	}
+	c, err := a.client(name)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Get(ctx, name); err != nil {
+		return notRunning(name, err)
+	}
+	spec := machine.SpecFromBundle(b)
+	spec.Name = name
+	s, err := snapshot.Open(b).Create(pos[1], &remoteMachine{ctx: ctx, c: c, name: name}, spec)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		return writeJSON(a.stdout, s)
+	}
+	_, err = fmt.Fprintf(a.stdout, "created snapshot %s of %s\n", s.Name, name)
+	return err
+}
+
+func (a *app) snapshotList(ctx context.Context, args []string) error {
+	var output string
+	flags := a.flagSet("snapshot list", &output)
+	pos, err := parse(flags, args, "NAME")
+	if err != nil {
+		return err
+	}
+	if err := checkOutput(output); err != nil {
+		return err
+	}
+	b, err := a.openBundle(pos[0])
+	if err != nil {
+		return err
+	}
+	list, err := snapshot.Open(b).List()
+	if err != nil {
+		return err
+	}
+	return writeSnapshots(a.stdout, output, list)
+}
+
+func (a *app) snapshotRemove(ctx context.Context, args []string) error {
+	flags := a.flagSet("snapshot rm", nil)
+	pos, err := parse(flags, args, "NAME", "SNAPSHOT")
+	if err != nil {
+		return err
+	}
+	b, err := a.openBundle(pos[0])
+	if err != nil {
+		return err
+	}
+	if err := snapshot.Open(b).Delete(pos[1]); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stdout, "removed snapshot %s of %s\n", pos[1], pos[0])
+	return nil
+}
+
+// remoteMachine is a machine.StateSaver which controls the running machine through
+// its API, so that a snapshot can be created by another process than the one
+// running the machine. The state is saved to a path on the same host.
+type remoteMachine struct {
+	ctx  context.Context
+	c    *api.Client
+	name string
+}
+
+var _ machine.StateSaver = (*remoteMachine)(nil)
+
+// State returns StateError if the state cannot be asked to the machine.
+func (m *remoteMachine) State() machine.State {
+	info, err := m.c.Get(m.ctx, m.name)
+	if err != nil {
+		return machine.StateError
+	}
+	return info.State
+}
+
+// StateChangedNotify returns nil because the changes are not watched.
+func (m *remoteMachine) StateChangedNotify() <-chan machine.State { return nil }
+
+func (m *remoteMachine) Start() error {
+	_, err := m.c.Start(m.ctx, m.name)
+	return err
+}
+
+func (m *remoteMachine) Pause() error {
+	_, err := m.c.Pause(m.ctx, m.name)
+	return err
+}
+
+func (m *remoteMachine) Resume() error {
+	_, err := m.c.Resume(m.ctx, m.name)
+	return err
+}
+
+func (m *remoteMachine) RequestStop() (bool, error) {
+	_, err := m.c.Stop(m.ctx, m.name, false)
+	return err == nil, err
+}
+
+func (m *remoteMachine) Stop() error {
+	_, err := m.c.Stop(m.ctx, m.name, true)
+	return err
+}
+
+func (m *remoteMachine) SaveMachineStateToPath(path string) error {
+	_, err := m.c.Save(m.ctx, m.name, path)
+	return err
+}
+
+func (m *remoteMachine) RestoreMachineStateFromURL(path string) error {
+	_, err := m.c.Restore(m.ctx, m.name, path)
+	return err
+}
@@ -0,0 +1,8 @@
+package main
+
+import (
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/vzmachine"
+)
+
+var backend machine.Backend = vzmachine.Backend
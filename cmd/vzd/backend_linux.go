@@ -0,0 +1,7 @@
+package main
+
+import "github.com/Code-Hex/vz/v3/machine"
+
+// backend is nil because Virtualization.framework is not available, so the daemon
+// runs only in the tests which replace it.
+var backend machine.Backend
@@ -0,0 +1,317 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/agent"
+	"github.com/Code-Hex/vz/v3/machine/api"
+	"github.com/Code-Hex/vz/v3/machine/metrics"
+	"github.com/Code-Hex/vz/v3/machine/shutdown"
+	"github.com/Code-Hex/vz/v3/machine/suspend"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	lockFile    = "vzd.lock"
+	machinesDir = "machines"
+	// suspendedExt is the extension of the states of the suspended machines in
+	// machinesDir.
+	suspendedExt = ".vzvmsave"
+)
+
+// daemon owns the machines and serves the API until its context is done.
+type daemon struct {
+	dir         string
+	socket      string
+	backend     machine.Backend
+	stopTimeout time.Duration
+	// suspend suspends the active machines to disk instead of stopping them, so
+	// that they are resumed when the daemon starts again.
+	suspend bool
+	logger  *log.Logger
+	// force is done when the machines should be stopped without waiting for the
+	// guests. It may be nil.
+	force context.Context
+	// metrics is the TCP address to serve the metrics of the machines on. The
+	// metrics are not served if it is empty.
+	metrics string
+
+	store   *store
+	manager *machine.Manager
+
+	// ready is closed when the API is served. It is used by the tests.
+	ready chan struct{}
+	// metricsAddr is the address the metrics are served on. It is used by the
+	// tests.
+	metricsAddr net.Addr
+}
+
+var _ api.Store = (*daemon)(nil)
+
+// run runs the daemon until ctx is done. The machines which were active when the
+// daemon exited last time are started again, and the active machines are stopped
+// when ctx is done, keeping their states so that they are started next time.
+func (d *daemon) run(ctx context.Context) error {
+	if d.backend == nil {
+		return fmt.Errorf("%w: running machines requires macOS", machine.ErrUnsupported)
+	}
+	if err := os.MkdirAll(d.dir, 0o755); err != nil {
+		return err
+	}
+	unlock, err := lock(filepath.Join(d.dir, lockFile))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	d.store, err = openStore(filepath.Join(d.dir, machinesDir))
+	if err != nil {
+		return err
+	}
+	d.manager = machine.NewManager(d.backend)
+
+	// The states are recorded until the machines are stopped by the shutdown.
+	recordCtx, stopRecording := context.WithCancel(context.Background())
+	recorded := make(chan struct{})
+	go func() {
+		defer close(recorded)
+		d.record(d.manager.Subscribe(recordCtx))
+	}()
+	defer func() {
+		stopRecording()
+		<-recorded
+		d.stopAll()
+	}()
+
+	if d.metrics != "" {
+		stopMetrics, err := d.serveMetrics()
+		if err != nil {
+			return err
+		}
+		defer stopMetrics()
+	}
+
+	d.recover()
+
+	os.Remove(d.socket)
+	ln, err := net.Listen("unix", d.socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(d.socket)
+	if err := os.Chmod(d.socket, 0o600); err != nil {
+		ln.Close()
+		return err
+	}
+	server := api.NewServer(d.manager, api.WithStore(d))
+	srv := &http.Server{Handler: server}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(ln) }()
+	d.logger.Printf("serving on %s", d.socket)
+	if d.ready != nil {
+		close(d.ready)
+	}
+
+	select {
+	case err = <-serveErr:
+	case <-ctx.Done():
+	}
+	server.Close()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if serr := srv.Shutdown(shutdownCtx); serr != nil {
+		srv.Close()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return err
+}
+
+// serveMetrics serves the metrics of the machines on d.metrics until stop is
+// called.
+func (d *daemon) serveMetrics() (stop func(), err error) {
+	ln, err := net.Listen("tcp", d.metrics)
+	if err != nil {
+		return nil, err
+	}
+	d.metricsAddr = ln.Addr()
+	ctx, cancel := context.WithCancel(context.Background())
+	collector := metrics.New(d.manager)
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		collector.Run(ctx)
+	}()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", collector)
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	d.logger.Printf("serving the metrics on http://%s/metrics", d.metricsAddr)
+	return func() {
+		srv.Close()
+		cancel()
+		<-collected
+	}, nil
+}
+
+// lock acquires the lock file so that only one daemon uses the directory.
+func lock(path string) (unlock func(), err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, fmt.Errorf("another daemon is running on %s", filepath.Dir(path))
+		}
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// recover creates the machines of the store, and starts the ones which were
+// active. The suspended machines are resumed, and the others are booted again
+// because their memory is lost.
+func (d *daemon) recover() {
+	records, err := d.store.load()
+	if err != nil {
+		d.logger.Printf("some machines are not recovered: %v", err)
+	}
+	for _, r := range records {
+		name := r.Spec.Name
+		vm, err := d.manager.Create(r.Spec)
+		if err != nil {
+			d.logger.Printf("failed to recover %s: %v", name, err)
+			continue
+		}
+		if spec := r.Spec.Clone(); identify(vm, spec) {
+			if err := d.store.update(spec); err != nil {
+				d.logger.Printf("failed to store %s: %v", name, err)
+			}
+		}
+		if !r.State.Active() {
+			os.Remove(d.suspendedState(name))
+			continue
+		}
+		result, err := suspend.Start(d.manager, name, d.suspendedState(name))
+		if result.RestoreError != nil {
+			d.logger.Printf("failed to resume %s, booting: %v", name, result.RestoreError)
+		}
+		if err != nil {
+			d.logger.Printf("failed to start %s: %v", name, err)
+			continue
+		}
+		if result.Restored {
+			d.logger.Printf("resumed %s", name)
+			continue
+		}
+		d.logger.Printf("started %s which was %s", name, r.State)
+	}
+}
+
+// suspendedState returns the path of the state of the suspended machine.
+func (d *daemon) suspendedState(name string) string {
+	return filepath.Join(d.dir, machinesDir, name+suspendedExt)
+}
+
+// identify sets the machine identifier of vm to spec if spec has none, so that the
+// same machine is booted next time. It reports whether spec has been changed.
+func identify(vm machine.Machine, spec *machine.Spec) bool {
+	idm, ok := vm.(interface{ MachineIdentifier() []byte })
+	if !ok || len(spec.MachineIdentifier) > 0 {
+		return false
+	}
+	id := idm.MachineIdentifier()
+	if len(id) == 0 {
+		return false
+	}
+	spec.MachineIdentifier = id
+	return true
+}
+
+// record records the states of the events to the store.
+func (d *daemon) record(events <-chan machine.Event) {
+	for ev := range events {
+		if err := d.store.setState(ev.Name, ev.State); err != nil {
+			d.logger.Printf("failed to record the state of %s: %v", ev.Name, err)
+		}
+	}
+}
+
+// stopAll stops the active machines in parallel.
+func (d *daemon) stopAll() {
+	var wg sync.WaitGroup
+	for _, info := range d.manager.List() {
+		if !info.State.Active() {
+			continue
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			d.stop(name)
+		}(info.Name)
+	}
+	wg.Wait()
+}
+
+// stop suspends the machine with d.suspend, or stops it with shutdown.Stop.
+func (d *daemon) stop(name string) {
+	vm, err := d.manager.Get(name)
+	if err != nil {
+		return
+	}
+	if d.suspend {
+		err := suspend.Suspend(d.manager, name, d.suspendedState(name))
+		if err == nil {
+			d.logger.Printf("suspended %s", name)
+			return
+		}
+		d.logger.Printf("failed to suspend %s, stopping: %v", name, err)
+	}
+	opts := []shutdown.Option{shutdown.WithRequestTimeout(d.stopTimeout)}
+	if dialer, ok := vm.(machine.VsockDialer); ok {
+		opts = append(opts, shutdown.WithAgent(agent.NewMachineClient(dialer, agent.DefaultPort), d.stopTimeout/2))
+	}
+	force := d.force
+	if force == nil {
+		force = context.Background()
+	}
+	report, err := shutdown.Stop(force, vm, opts...)
+	if err != nil {
+		d.logger.Printf("failed to stop %s: %v", name, err)
+		return
+	}
+	d.logger.Printf("%s: %s", name, report)
+}
+
+// Put implements api.Store. The new machine identifier is stored together.
+func (d *daemon) Put(spec *machine.Spec) error {
+	if vm, err := d.manager.Get(spec.Name); err == nil {
+		identify(vm, spec)
+	}
+	return d.store.put(spec)
+}
+
+// Delete implements api.Store. The suspended state is deleted together.
+func (d *daemon) Delete(name string) error {
+	if err := os.Remove(d.suspendedState(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return d.store.delete(name)
+}
@@ -0,0 +1,256 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/api"
+	"github.com/Code-Hex/vz/v3/machine/fake"
+	"github.com/Code-Hex/vz/v3/machine/metrics"
+)
+
+func tempDir(t *testing.T) string {
+	// The path of a Unix socket is limited to about 100 bytes.
+	dir, err := os.MkdirTemp("", "vzd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// startDaemon runs the daemon in the background and returns its client and the
+// function which stops it. opts change the daemon before it runs.
+func startDaemon(t *testing.T, dir string, backend machine.Backend, opts ...func(d *daemon)) (*api.Client, func() error) {
+	t.Helper()
+	d := &daemon{
+		dir:         dir,
+		socket:      filepath.Join(dir, "vzd.sock"),
+		backend:     backend,
+		stopTimeout: time.Second,
+		logger:      log.New(io.Discard, "", 0),
+		ready:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- d.run(ctx) }()
+	select {
+	case <-d.ready:
+	case err := <-done:
+		cancel()
+		t.Fatalf("daemon exited: %v", err)
+	}
+	stopped := false
+	stop := func() error {
+		if stopped {
+			return nil
+		}
+		stopped = true
+		cancel()
+		return <-done
+	}
+	t.Cleanup(func() { stop() })
+	return api.NewClient(d.socket), stop
+}
+
+func TestDaemonRecover(t *testing.T) {
+	dir := tempDir(t)
+	ctx := context.Background()
+	backend := fake.NewBackend()
+	client, stop := startDaemon(t, dir, backend)
+
+	for _, name := range []string{"web", "db"} {
+		if _, err := client.Create(ctx, &machine.Spec{Name: name, CPUs: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.Start(ctx, "web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	web := backend.Machine("web")
+	if s := web.State(); s != machine.StateStopped || web.StopRequests() != 1 {
+		t.Fatalf("want web stopped by the request but got %s with %d requests", s, web.StopRequests())
+	}
+
+	// The daemon recovers the machines and boots the one which was running.
+	backend = fake.NewBackend()
+	client, stop = startDaemon(t, dir, backend)
+	infos, err := client.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name != "db" || infos[1].Name != "web" {
+		t.Fatalf("unexpected machines %+v", infos)
+	}
+	if infos[0].State != machine.StateStopped || infos[1].State != machine.StateRunning || infos[1].Spec.CPUs != 2 {
+		t.Fatalf("unexpected machines %+v", infos)
+	}
+
+	if err := client.Delete(ctx, "db"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, machinesDir, "db.json")); !os.IsNotExist(err) {
+		t.Fatalf("want the record deleted but got %v", err)
+	}
+	// The machine stopped through the API stays stopped.
+	if _, err := client.Stop(ctx, "web", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ = startDaemon(t, dir, fake.NewBackend())
+	infos, err = client.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name != "web" || infos[0].State != machine.StateStopped {
+		t.Fatalf("unexpected machines %+v", infos)
+	}
+}
+
+func TestDaemonSuspend(t *testing.T) {
+	dir := tempDir(t)
+	ctx := context.Background()
+	backend := fake.NewBackend()
+	client, stop := startDaemon(t, dir, backend, func(d *daemon) { d.suspend = true })
+	for _, name := range []string{"web", "db"} {
+		if _, err := client.Create(ctx, &machine.Spec{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Start(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The machine which cannot be saved is stopped instead.
+	backend.Machine("db").SetSaveRestoreSupport(fmt.Errorf("%w: not savable", machine.ErrUnsupported))
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"web", "db"} {
+		if s := backend.Machine(name).State(); s != machine.StateStopped {
+			t.Fatalf("want %s stopped but got %s", name, s)
+		}
+	}
+	if n := backend.Machine("web").StopRequests(); n != 0 {
+		t.Fatalf("want web suspended without stop requests but got %d", n)
+	}
+	web := filepath.Join(dir, machinesDir, "web"+suspendedExt)
+	if _, err := os.Stat(web); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, machinesDir, "db"+suspendedExt)); !os.IsNotExist(err) {
+		t.Fatalf("want no state of db but got %v", err)
+	}
+
+	// Both are running again, and the state of web is consumed.
+	client, _ = startDaemon(t, dir, fake.NewBackend())
+	infos, err := client.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].State != machine.StateRunning || infos[1].State != machine.StateRunning {
+		t.Fatalf("unexpected machines %+v", infos)
+	}
+	if _, err := os.Stat(web); !os.IsNotExist(err) {
+		t.Fatalf("want the state removed but got %v", err)
+	}
+}
+
+func TestDaemonStopTimeout(t *testing.T) {
+	dir := tempDir(t)
+	ctx := context.Background()
+	backend := fake.NewBackend()
+	client, stop := startDaemon(t, dir, backend)
+	if _, err := client.Create(ctx, &machine.Spec{Name: "vm"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Start(ctx, "vm"); err != nil {
+		t.Fatal(err)
+	}
+	backend.Machine("vm").IgnoreStopRequests(true)
+
+	start := time.Now()
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if s := backend.Machine("vm").State(); s != machine.StateStopped {
+		t.Fatalf("want stopped but got %s", s)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Fatalf("want the stop timeout before stopping forcibly but stopped in %s", d)
+	}
+}
+
+func TestDaemonLock(t *testing.T) {
+	dir := tempDir(t)
+	startDaemon(t, dir, fake.NewBackend())
+	d := &daemon{
+		dir:     dir,
+		socket:  filepath.Join(dir, "other.sock"),
+		backend: fake.NewBackend(),
+		logger:  log.New(io.Discard, "", 0),
+	}
+	err := d.run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "another daemon") {
+		t.Fatalf("want an error for another daemon but got %v", err)
+	}
+}
+
+func TestDaemonUnsupported(t *testing.T) {
+	d := &daemon{dir: tempDir(t), logger: log.New(io.Discard, "", 0)}
+	if err := d.run(context.Background()); !errors.Is(err, machine.ErrUnsupported) {
+		t.Fatalf("want ErrUnsupported but got %v", err)
+	}
+}
+
+func TestDaemonMetrics(t *testing.T) {
+	ctx := context.Background()
+	var d *daemon
+	client, _ := startDaemon(t, tempDir(t), fake.NewBackend(), func(dd *daemon) {
+		dd.metrics = "127.0.0.1:0"
+		d = dd
+	})
+	if _, err := client.Create(ctx, &machine.Spec{Name: "vm"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Start(ctx, "vm"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get("http://" + d.metricsAddr.String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != metrics.ContentType {
+		t.Fatalf("want the metrics but got %s of %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	if want := `vz_machine_state{machine="vm",state="running"} 1`; !strings.Contains(string(body), want+"\n") {
+		t.Fatalf("want %q in\n%s", want, body)
+	}
+}
@@ -0,0 +1,73 @@
+//go:build darwin || linux
+// +build darwin linux
+
+// Command vzd is a daemon which owns virtual machines, so that they keep running
+// after the clients exit. It serves the API of the machine/api package on a Unix
+// socket to create, delete, start and stop the machines, to attach to their
+// consoles, and to stream their state changes.
+//
+//	vzd [--dir DIR] [--socket PATH] [--stop-timeout DURATION] [--suspend] [--metrics ADDR]
+//
+// The definitions of the machines are stored under DIR, $VZD_HOME or ~/.vzd by
+// default, together with their last states. The machines which were running when
+// the daemon exited are booted again when it starts. On SIGINT or SIGTERM, the
+// guests are requested to stop, the guest agents are asked to power off if the
+// guests ignore the request, and the machines are stopped forcibly at last. The
+// second signal stops them forcibly without waiting.
+//
+// With --suspend, the machines are suspended to disk on the signal instead, and
+// resumed from the saved states when the daemon starts again. The machines which
+// cannot be suspended are stopped, and the ones which cannot be resumed are booted.
+//
+// With --metrics, the metrics of the machines and their devices are served in the
+// Prometheus text format on http://ADDR/metrics.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine/shutdown"
+)
+
+func main() {
+	home := os.Getenv("VZD_HOME")
+	if home == "" {
+		dir, err := os.UserHomeDir()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "vzd:", err)
+			os.Exit(1)
+		}
+		home = filepath.Join(dir, ".vzd")
+	}
+	d := &daemon{
+		backend: backend,
+		logger:  log.New(os.Stderr, "vzd: ", log.LstdFlags),
+	}
+	flag.StringVar(&d.dir, "dir", home, "directory of the machines")
+	flag.StringVar(&d.socket, "socket", "", "path of the API socket (default DIR/vzd.sock)")
+	flag.DurationVar(&d.stopTimeout, "stop-timeout", 30*time.Second, "time to wait for the guests to stop")
+	flag.BoolVar(&d.suspend, "suspend", false, "suspend the machines to disk on exit instead of stopping them")
+	flag.StringVar(&d.metrics, "metrics", "", "TCP address to serve the Prometheus metrics on, such as localhost:9100")
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if d.socket == "" {
+		d.socket = filepath.Join(d.dir, "vzd.sock")
+	}
+
+	ctx, force, stop := shutdown.NotifyContext(context.Background())
+	defer stop()
+	d.force = force
+	if err := d.run(ctx); err != nil {
+		d.logger.Print(err)
+		os.Exit(1)
+	}
+}
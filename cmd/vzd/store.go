@@ -0,0 +1,162 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+// record is the persisted definition of a machine.
+type record struct {
+	Spec *machine.Spec `json:"spec"`
+	// State is the last known state of the machine. The machines which were
+	// active when the daemon exited are started again at startup.
+	State machine.State `json:"state"`
+}
+
+// store persists the records as JSON files in a directory, one file per machine.
+type store struct {
+	dir string
+
+	mu sync.Mutex
+}
+
+const recordExt = ".json"
+
+func openStore(dir string) (*store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &store{dir: dir}, nil
+}
+
+func (s *store) path(name string) string {
+	return filepath.Join(s.dir, name+recordExt)
+}
+
+// load returns the records sorted by name. The files which cannot be read are
+// skipped and reported in the error.
+func (s *store) load() ([]*record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		records []*record
+		errs    []error
+	)
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), recordExt)
+		if !ok || strings.HasPrefix(name, ".") || !e.Type().IsRegular() {
+			continue
+		}
+		r, err := s.read(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Spec.Name < records[j].Spec.Name })
+	return records, errors.Join(errs...)
+}
+
+func (s *store) read(name string) (*record, error) {
+	b, err := os.ReadFile(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	r := &record{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("invalid record of %s: %w", name, err)
+	}
+	if r.Spec == nil || r.Spec.Name != name {
+		return nil, fmt.Errorf("invalid record of %s: the name does not match", name)
+	}
+	return r, nil
+}
+
+// write writes the record atomically.
+func (s *store) write(r *record) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, "."+r.Spec.Name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(r.Spec.Name))
+}
+
+// put stores the spec of a new stopped machine.
+func (s *store) put(spec *machine.Spec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(&record{Spec: spec, State: machine.StateStopped})
+}
+
+// update updates the spec of the stored machine.
+func (s *store) update(spec *machine.Spec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.read(spec.Name)
+	if err != nil {
+		return err
+	}
+	r.Spec = spec
+	return s.write(r)
+}
+
+// setState records the state of the machine. It does nothing if the machine has
+// been deleted.
+func (s *store) setState(name string, state machine.State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.read(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if r.State == state {
+		return nil
+	}
+	r.State = state
+	return s.write(r)
+}
+
+func (s *store) delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.path(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b", "a"} {
+		if err := s.put(&machine.Spec{Name: name, CPUs: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.setState("a", machine.StateRunning); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.update(&machine.Spec{Name: "a", CPUs: 4}); err != nil {
+		t.Fatal(err)
+	}
+	// The state of the deleted machine is not recorded.
+	if err := s.setState("deleted", machine.StateRunning); err != nil {
+		t.Fatal(err)
+	}
+
+	// The invalid records are skipped.
+	if err := os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "renamed.json"), []byte(`{"spec": {"name": "other"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	records, err := s.load()
+	if err == nil {
+		t.Fatal("want errors of the invalid records")
+	}
+	if len(records) != 2 {
+		t.Fatalf("want 2 records but got %d", len(records))
+	}
+	if r := records[0]; r.Spec.Name != "a" || r.Spec.CPUs != 4 || r.State != machine.StateRunning {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	if r := records[1]; r.Spec.Name != "b" || r.State != machine.StateStopped {
+		t.Fatalf("unexpected record %+v", r)
+	}
+
+	if err := s.delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.json")); !os.IsNotExist(err) {
+		t.Fatalf("want deleted but got %v", err)
+	}
+}
@@ -7,8 +7,10 @@ package vz
 */
 import "C"
 import (
+	"fmt"
 	"unsafe"
 
+	"github.com/Code-Hex/vz/v3/console"
 	"github.com/Code-Hex/vz/v3/internal/objc"
 )
 
@@ -171,3 +173,77 @@ func (v *VirtioConsolePortConfiguration) IsConsole() bool { return v.isConsole }
 func (v *VirtioConsolePortConfiguration) Attachment() SerialPortAttachment {
 	return v.attachment
 }
+
+// NewVirtioConsolePortConfigurationWithStream creates a new VirtioConsolePortConfiguration which has the name
+// and is attached to a pipe backed console.Stream. The returned stream is the host side of the port.
+//
+// In a Linux guest, the port appears as /dev/virtio-ports/<name>. This is useful to use a named
+// port as a data channel, e.g. for a guest agent. The options are applied after the name and the
+// attachment are set, so do not pass WithVirtioConsolePortConfigurationAttachment.
+//
+// The caller is responsible for closing the stream after the virtual machine has been stopped.
+//
+// This is only supported on macOS 13 and newer, error will
+// be returned on older versions.
+func NewVirtioConsolePortConfigurationWithStream(name string, opts ...NewVirtioConsolePortConfigurationOption) (*VirtioConsolePortConfiguration, *console.Stream, error) {
+	if err := macOSAvailable(13); err != nil {
+		return nil, nil, err
+	}
+	stream, err := console.NewStream(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	read, write := stream.AttachmentFiles()
+	attachment, err := NewFileHandleSerialPortAttachment(read, write)
+	if err != nil {
+		stream.Close()
+		return nil, nil, err
+	}
+	portOpts := append([]NewVirtioConsolePortConfigurationOption{
+		WithVirtioConsolePortConfigurationName(name),
+		WithVirtioConsolePortConfigurationAttachment(attachment),
+	}, opts...)
+	config, err := NewVirtioConsolePortConfiguration(portOpts...)
+	if err != nil {
+		stream.Close()
+		return nil, nil, err
+	}
+	return config, stream, nil
+}
+
+// NewVirtioConsoleDeviceConfigurationWithRegistry creates a new VirtioConsoleDeviceConfiguration which has
+// a named port for each of names. The ports are set in the order of names and the stream of each port
+// is registered to the registry. If it fails, none of the streams is left
+// registered.
+//
+// This is only supported on macOS 13 and newer, error will
+// be returned on older versions.
+func NewVirtioConsoleDeviceConfigurationWithRegistry(registry *console.Registry, names ...string) (*VirtioConsoleDeviceConfiguration, error) {
+	config, err := NewVirtioConsoleDeviceConfiguration()
+	if err != nil {
+		return nil, err
+	}
+	// The ports registered before an error are removed, so that the registry is
+	// left as it was.
+	registered := make([]string, 0, len(names))
+	rollback := func() {
+		for _, name := range registered {
+			registry.Remove(name)
+		}
+	}
+	for i, name := range names {
+		portConfig, stream, err := NewVirtioConsolePortConfigurationWithStream(name)
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("failed to create console port %q: %w", name, err)
+		}
+		if err := registry.Register(stream); err != nil {
+			stream.Close()
+			rollback()
+			return nil, err
+		}
+		registered = append(registered, name)
+		config.SetVirtioConsolePortConfiguration(i, portConfig)
+	}
+	return config, nil
+}
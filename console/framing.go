@@ -0,0 +1,183 @@
+package console
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Frame layout used by MessageReader and MessageWriter.
+//
+//	+------+------+------------------------+------------------+
+//	| 'v'  | 'z'  | length (uint32, BE)    | payload ...      |
+//	+------+------+------------------------+------------------+
+//
+// The magic bytes allow the reader to resynchronize when the peer reopened the port
+// in the middle of a frame. A frame which has zero length is a reset frame. A peer
+// sends it when it (re)opens the port so that the other side can discard the state
+// of the previous session.
+const (
+	frameMagic0     = 'v'
+	frameMagic1     = 'z'
+	frameHeaderSize = 6
+)
+
+// DefaultMaxMessageSize is the default maximum size of a message read by MessageReader.
+const DefaultMaxMessageSize = 1 << 20
+
+var (
+	// ErrPeerReset is returned by (*MessageReader).ReadMessage when the peer sent a reset frame.
+	// It is typically sent when the process in the guest reopened the console port.
+	ErrPeerReset = errors.New("console peer reset the session")
+
+	// ErrMessageTooLarge is returned when a message exceeds the maximum message size.
+	ErrMessageTooLarge = errors.New("console message too large")
+
+	// ErrEmptyMessage is returned when writing an empty message.
+	// An empty frame is reserved for the reset frame.
+	ErrEmptyMessage = errors.New("console message is empty")
+)
+
+// MessageReader reads length-prefixed messages written by MessageWriter.
+type MessageReader struct {
+	r       *bufio.Reader
+	max     int
+	skipped int64
+}
+
+// MessageReaderOption is an option for NewMessageReader.
+type MessageReaderOption func(*MessageReader)
+
+// WithMaxMessageSize sets the maximum size of a message in bytes.
+// The default is DefaultMaxMessageSize.
+func WithMaxMessageSize(size int) MessageReaderOption {
+	return func(mr *MessageReader) {
+		mr.max = size
+	}
+}
+
+// NewMessageReader creates a new MessageReader which reads messages from r.
+func NewMessageReader(r io.Reader, opts ...MessageReaderOption) *MessageReader {
+	mr := &MessageReader{
+		r:   bufio.NewReader(r),
+		max: DefaultMaxMessageSize,
+	}
+	for _, opt := range opts {
+		opt(mr)
+	}
+	return mr
+}
+
+// ReadMessage reads the next message.
+//
+// Bytes which are not part of a frame are skipped until the next frame header.
+// It returns io.EOF only if the stream ended at a frame boundary, and io.ErrUnexpectedEOF
+// if the stream ended in the middle of a frame.
+//
+// If the peer sent a reset frame, ErrPeerReset is returned. If the message exceeds the
+// maximum message size, the message is discarded and ErrMessageTooLarge is returned.
+// In both cases the reader can continue to be used.
+func (mr *MessageReader) ReadMessage() ([]byte, error) {
+	length, err := mr.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, ErrPeerReset
+	}
+	if uint64(length) > uint64(mr.max) {
+		if _, err := io.CopyN(io.Discard, mr.r, int64(length)); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return nil, fmt.Errorf("%w: %d bytes", ErrMessageTooLarge, length)
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(mr.r, msg); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return msg, nil
+}
+
+// Skipped returns the number of bytes skipped so far while looking for a frame header.
+func (mr *MessageReader) Skipped() int64 { return mr.skipped }
+
+func (mr *MessageReader) readHeader() (uint32, error) {
+	atBoundary := true
+	for {
+		b, err := mr.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && !atBoundary {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if b != frameMagic0 {
+			mr.skipped++
+			atBoundary = false
+			continue
+		}
+		next, err := mr.r.Peek(1)
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if next[0] != frameMagic1 {
+			mr.skipped++
+			atBoundary = false
+			continue
+		}
+		var hdr [frameHeaderSize - 1]byte
+		if _, err := io.ReadFull(mr.r, hdr[:]); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		return binary.BigEndian.Uint32(hdr[1:]), nil
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// MessageWriter writes length-prefixed messages. It is safe for concurrent use.
+type MessageWriter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// NewMessageWriter creates a new MessageWriter which writes messages to w.
+func NewMessageWriter(w io.Writer) *MessageWriter {
+	return &MessageWriter{w: w}
+}
+
+// WriteMessage writes p as a single message.
+func (mw *MessageWriter) WriteMessage(p []byte) error {
+	if len(p) == 0 {
+		return ErrEmptyMessage
+	}
+	if uint64(len(p)) > uint64(^uint32(0)) {
+		return fmt.Errorf("%w: %d bytes", ErrMessageTooLarge, len(p))
+	}
+	return mw.writeFrame(p)
+}
+
+// WriteReset writes a reset frame. The reader of the peer returns ErrPeerReset.
+func (mw *MessageWriter) WriteReset() error {
+	return mw.writeFrame(nil)
+}
+
+func (mw *MessageWriter) writeFrame(p []byte) error {
+	buf := make([]byte, frameHeaderSize+len(p))
+	buf[0], buf[1] = frameMagic0, frameMagic1
+	binary.BigEndian.PutUint32(buf[2:], uint32(len(p)))
+	copy(buf[frameHeaderSize:], p)
+
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	_, err := mw.w.Write(buf)
+	return err
+}
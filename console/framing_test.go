@@ -0,0 +1,122 @@
+package console_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/console"
+)
+
+func TestMessageReadWrite(t *testing.T) {
+	var buf bytes.Buffer
+	w := console.NewMessageWriter(&buf)
+	messages := []string{"hello", "world", string(bytes.Repeat([]byte("a"), 4096))}
+	for _, msg := range messages {
+		if err := w.WriteMessage([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := console.NewMessageReader(&buf)
+	for _, want := range messages {
+		got, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != string(got) {
+			t.Fatalf("want %q but got %q", want, got)
+		}
+	}
+	if _, err := r.ReadMessage(); err != io.EOF {
+		t.Fatalf("want io.EOF but got %v", err)
+	}
+}
+
+func TestMessageReaderErrors(t *testing.T) {
+	frame := func(msg string) []byte {
+		var buf bytes.Buffer
+		if err := console.NewMessageWriter(&buf).WriteMessage([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	reset := func() []byte {
+		var buf bytes.Buffer
+		if err := console.NewMessageWriter(&buf).WriteReset(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	join := func(bs ...[]byte) []byte { return bytes.Join(bs, nil) }
+
+	cases := []struct {
+		name        string
+		input       []byte
+		opts        []console.MessageReaderOption
+		wantErrs    []error
+		wantSkipped int64
+	}{
+		{
+			name:     "truncated payload",
+			input:    frame("hello")[:8],
+			wantErrs: []error{io.ErrUnexpectedEOF},
+		},
+		{
+			name:     "truncated header",
+			input:    frame("hello")[:3],
+			wantErrs: []error{io.ErrUnexpectedEOF},
+		},
+		{
+			name:     "reset frame",
+			input:    join(reset(), frame("hello")),
+			wantErrs: []error{console.ErrPeerReset, nil, io.EOF},
+		},
+		{
+			name:        "resync after garbage",
+			input:       join([]byte("garbage"), frame("hello")),
+			wantErrs:    []error{nil, io.EOF},
+			wantSkipped: 7,
+		},
+		{
+			name:     "too large message",
+			input:    join(frame("too large"), frame("ok")),
+			opts:     []console.MessageReaderOption{console.WithMaxMessageSize(4)},
+			wantErrs: []error{console.ErrMessageTooLarge, nil, io.EOF},
+		},
+		{
+			name:     "truncated too large message",
+			input:    frame("too large")[:10],
+			opts:     []console.MessageReaderOption{console.WithMaxMessageSize(4)},
+			wantErrs: []error{io.ErrUnexpectedEOF},
+		},
+		{
+			name:        "garbage only",
+			input:       []byte("garbage"),
+			wantErrs:    []error{io.ErrUnexpectedEOF},
+			wantSkipped: 7,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := console.NewMessageReader(bytes.NewReader(tc.input), tc.opts...)
+			for i, want := range tc.wantErrs {
+				_, err := r.ReadMessage()
+				if !errors.Is(err, want) {
+					t.Fatalf("#%d: want error %v but got %v", i, want, err)
+				}
+			}
+			if got := r.Skipped(); tc.wantSkipped != got {
+				t.Fatalf("want skipped %d but got %d", tc.wantSkipped, got)
+			}
+		})
+	}
+}
+
+func TestWriteEmptyMessage(t *testing.T) {
+	w := console.NewMessageWriter(io.Discard)
+	if err := w.WriteMessage(nil); !errors.Is(err, console.ErrEmptyMessage) {
+		t.Fatalf("want %v but got %v", console.ErrEmptyMessage, err)
+	}
+}
@@ -0,0 +1,28 @@
+package console_test
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// readN reads n bytes from r, or fails the test if they are not read in time.
+func readN(t *testing.T, r io.Reader, n int) string {
+	t.Helper()
+	done := make(chan struct{})
+	buf := make([]byte, n)
+	var err error
+	go func() {
+		defer close(done)
+		_, err = io.ReadFull(r, buf)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for read")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
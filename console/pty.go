@@ -0,0 +1,87 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package console
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// PTY is a pseudo-terminal pair.
+//
+// The master side is intended to be attached to the virtual machine, and the slave side
+// is the terminal device which is used by the user, for example with screen(1) or
+// (*PTY).Attach method. The slave side is put in raw mode so that the line discipline
+// of the host does not interfere with the one of the guest.
+type PTY struct {
+	master *os.File
+	slave  *os.File
+	name   string
+}
+
+// OpenPTY allocates a new pseudo-terminal.
+func OpenPTY() (*PTY, error) {
+	master, name, err := openPTMX()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pseudo-terminal master: %w", err)
+	}
+	slave, err := os.OpenFile(name, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("failed to open pseudo-terminal slave %q: %w", name, err)
+	}
+	if _, err := term.MakeRaw(int(slave.Fd())); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, fmt.Errorf("failed to make pseudo-terminal raw: %w", err)
+	}
+	return &PTY{
+		master: master,
+		slave:  slave,
+		name:   name,
+	}, nil
+}
+
+// Master returns the master side of the pseudo-terminal.
+func (p *PTY) Master() *os.File { return p.master }
+
+// Slave returns the slave side of the pseudo-terminal.
+func (p *PTY) Slave() *os.File { return p.slave }
+
+// Name returns the path of the slave device (e.g. /dev/ttys003 or /dev/pts/3).
+func (p *PTY) Name() string { return p.name }
+
+// SetSize sets the window size of the pseudo-terminal.
+func (p *PTY) SetSize(ws Winsize) error {
+	return unix.IoctlSetWinsize(int(p.master.Fd()), unix.TIOCSWINSZ, &unix.Winsize{
+		Row: ws.Rows,
+		Col: ws.Cols,
+	})
+}
+
+// Size returns the window size of the pseudo-terminal.
+func (p *PTY) Size() (Winsize, error) {
+	return GetWinsize(p.master)
+}
+
+// Close closes both sides of the pseudo-terminal.
+func (p *PTY) Close() error {
+	return errors.Join(
+		closeFile(p.slave),
+		closeFile(p.master),
+	)
+}
+
+// GetWinsize returns the window size of the terminal f.
+func GetWinsize(f *os.File) (Winsize, error) {
+	ws, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return Winsize{}, err
+	}
+	return Winsize{Rows: ws.Row, Cols: ws.Col}, nil
+}
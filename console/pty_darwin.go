@@ -0,0 +1,47 @@
+package console
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func openPTMX() (*os.File, string, error) {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	master := os.NewFile(uintptr(fd), "/dev/ptmx")
+	// grantpt(3)
+	if err := ioctl(fd, unix.TIOCPTYGRANT, nil); err != nil {
+		master.Close()
+		return nil, "", fmt.Errorf("grantpt: %w", err)
+	}
+	// unlockpt(3)
+	if err := ioctl(fd, unix.TIOCPTYUNLK, nil); err != nil {
+		master.Close()
+		return nil, "", fmt.Errorf("unlockpt: %w", err)
+	}
+	// ptsname(3)
+	// see: https://opensource.apple.com/source/Libc/Libc-1439.40.11/stdlib/FreeBSD/grantpt.c.auto.html
+	var name [128]byte
+	if err := ioctl(fd, unix.TIOCPTYGNAME, unsafe.Pointer(&name[0])); err != nil {
+		master.Close()
+		return nil, "", fmt.Errorf("ptsname: %w", err)
+	}
+	if i := bytes.IndexByte(name[:], 0); i >= 0 {
+		return master, string(name[:i]), nil
+	}
+	return master, string(name[:]), nil
+}
+
+func ioctl(fd int, req uint, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package console
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func openPTMX() (*os.File, string, error) {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	master := os.NewFile(uintptr(fd), "/dev/ptmx")
+	// unlockpt(3)
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, "", fmt.Errorf("unlockpt: %w", err)
+	}
+	// ptsname(3)
+	n, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, "", fmt.Errorf("ptsname: %w", err)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n), nil
+}
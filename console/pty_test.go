@@ -0,0 +1,180 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package console_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/console"
+)
+
+func openPTY(t *testing.T) *console.PTY {
+	t.Helper()
+	pty, err := console.OpenPTY()
+	if err != nil {
+		t.Skipf("pseudo-terminal is not available: %v", err)
+	}
+	t.Cleanup(func() { pty.Close() })
+	return pty
+}
+
+func TestPTY(t *testing.T) {
+	pty := openPTY(t)
+
+	if !strings.HasPrefix(pty.Name(), "/dev/") {
+		t.Fatalf("unexpected slave name: %q", pty.Name())
+	}
+
+	// The slave is in raw mode, so neither echo nor CR-NL mapping happen.
+	if _, err := pty.Master().Write([]byte("guest\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readN(t, pty.Slave(), 6); got != "guest\n" {
+		t.Fatalf("want %q but got %q", "guest\n", got)
+	}
+	if _, err := pty.Slave().Write([]byte("host\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readN(t, pty.Master(), 5); got != "host\n" {
+		t.Fatalf("want %q but got %q", "host\n", got)
+	}
+
+	want := console.Winsize{Rows: 40, Cols: 120}
+	if err := pty.SetSize(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := pty.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Fatalf("want %v but got %v", want, got)
+	}
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestPTYAttach(t *testing.T) {
+	pty := openPTY(t)
+
+	inRead, inWrite, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inRead.Close()
+	defer inWrite.Close()
+
+	var out syncBuffer
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- pty.Attach(ctx, inRead, &out)
+	}()
+
+	if _, err := inWrite.Write([]byte("ls\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readN(t, pty.Master(), 3); got != "ls\n" {
+		t.Fatalf("want %q but got %q", "ls\n", got)
+	}
+
+	if _, err := pty.Master().Write([]byte("bin etc\n")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for out.String() != "bin etc\n" {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %q but got %q", "bin etc\n", out.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Fatalf("want %v but got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Attach to return")
+	}
+
+	// in is not read after Attach returns.
+	if _, err := inWrite.Write([]byte("pwd\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readN(t, inRead, 4); got != "pwd\n" {
+		t.Fatalf("want %q but got %q", "pwd\n", got)
+	}
+}
+
+func TestNotifyResize(t *testing.T) {
+	pty := openPTY(t)
+	want := console.Winsize{Rows: 24, Cols: 80}
+	if err := pty.SetSize(want); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu    sync.Mutex
+		sizes []console.Winsize
+	)
+	stop := console.NotifyResize(context.Background(), pty.Slave(), func(ws console.Winsize) {
+		mu.Lock()
+		defer mu.Unlock()
+		sizes = append(sizes, ws)
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(sizes)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("want the initial size notified")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+
+	// fn is not called after stop returns.
+	mu.Lock()
+	n := len(sizes)
+	mu.Unlock()
+	if err := pty.SetSize(console.Winsize{Rows: 40, Cols: 120}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGWINCH); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sizes) != n || sizes[0] != want {
+		t.Fatalf("want only the initial size %v but got %v", want, sizes)
+	}
+}
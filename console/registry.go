@@ -0,0 +1,107 @@
+package console
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrPortAlreadyRegistered is returned when registering a port name which is already in use.
+	ErrPortAlreadyRegistered = errors.New("console port is already registered")
+
+	// ErrPortNotFound is returned when the port name is not registered.
+	ErrPortNotFound = errors.New("console port is not found")
+)
+
+// Registry maps the names of console ports to their streams.
+//
+// The name should be same as the name of the Virtio console port configuration, which
+// appears as /dev/virtio-ports/<name> in a Linux guest. It is safe for concurrent use.
+type Registry struct {
+	streams map[string]*Stream
+	mu      sync.RWMutex
+}
+
+// NewRegistry creates a new empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		streams: make(map[string]*Stream),
+	}
+}
+
+// Open creates a new Stream which has the name and registers it.
+func (r *Registry) Open(name string) (*Stream, error) {
+	stream, err := NewStream(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Register(stream); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Register registers the stream with its name.
+func (r *Registry) Register(stream *Stream) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.streams[stream.Name()]; ok {
+		return fmt.Errorf("%w: %q", ErrPortAlreadyRegistered, stream.Name())
+	}
+	r.streams[stream.Name()] = stream
+	return nil
+}
+
+// Lookup returns the stream registered with the name.
+func (r *Registry) Lookup(name string) (*Stream, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	stream, ok := r.streams[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrPortNotFound, name)
+	}
+	return stream, nil
+}
+
+// Names returns the sorted names of the registered ports.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.streams))
+	for name := range r.streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Remove unregisters the port and closes its stream.
+func (r *Registry) Remove(name string) error {
+	r.mu.Lock()
+	stream, ok := r.streams[name]
+	delete(r.streams, name)
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrPortNotFound, name)
+	}
+	return stream.Close()
+}
+
+// Close closes all registered streams and empties the registry.
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	streams := r.streams
+	r.streams = make(map[string]*Stream)
+	r.mu.Unlock()
+
+	var errs []error
+	for _, stream := range streams {
+		if err := stream.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,55 @@
+package console_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/console"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := console.NewRegistry()
+	defer registry.Close()
+
+	for _, name := range []string{"org.example.b", "org.example.a"} {
+		if _, err := registry.Open(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := registry.Open("org.example.a"); !errors.Is(err, console.ErrPortAlreadyRegistered) {
+		t.Fatalf("want %v but got %v", console.ErrPortAlreadyRegistered, err)
+	}
+
+	want := []string{"org.example.a", "org.example.b"}
+	if got := registry.Names(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v but got %v", want, got)
+	}
+
+	stream, err := registry.Lookup("org.example.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stream.Name(); got != "org.example.a" {
+		t.Fatalf("want %q but got %q", "org.example.a", got)
+	}
+
+	if err := registry.Remove("org.example.a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registry.Lookup("org.example.a"); !errors.Is(err, console.ErrPortNotFound) {
+		t.Fatalf("want %v but got %v", console.ErrPortNotFound, err)
+	}
+	select {
+	case <-stream.Done():
+	default:
+		t.Fatal("want the removed stream is closed")
+	}
+
+	if err := registry.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := registry.Names(); len(got) != 0 {
+		t.Fatalf("want empty registry but got %v", got)
+	}
+}
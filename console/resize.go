@@ -0,0 +1,74 @@
+package console
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ResizePortName is the conventional name of the console port which is used as
+// the side channel to propagate window size changes to a guest agent.
+const ResizePortName = "io.github.code-hex.vz.resize"
+
+// Winsize is the size of a terminal window in characters.
+type Winsize struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+func (ws Winsize) String() string {
+	return fmt.Sprintf("%dx%d", ws.Cols, ws.Rows)
+}
+
+// ResizeWriter sends window size changes over a side channel such as a named
+// console port or a vsock connection.
+//
+// Each change is sent as a message of MessageWriter which contains a JSON object
+// like {"rows":24,"cols":80}. The virtio console does not carry the window size, so
+// an agent in the guest is expected to apply it (e.g. with "stty rows 24 cols 80").
+type ResizeWriter struct {
+	mw *MessageWriter
+}
+
+// NewResizeWriter creates a new ResizeWriter which writes to w.
+func NewResizeWriter(w io.Writer) *ResizeWriter {
+	return &ResizeWriter{mw: NewMessageWriter(w)}
+}
+
+// WriteResize sends the window size.
+func (rw *ResizeWriter) WriteResize(ws Winsize) error {
+	b, err := json.Marshal(ws)
+	if err != nil {
+		return err
+	}
+	return rw.mw.WriteMessage(b)
+}
+
+// ResizeReader receives window size changes sent by ResizeWriter.
+type ResizeReader struct {
+	mr *MessageReader
+}
+
+// NewResizeReader creates a new ResizeReader which reads from r.
+func NewResizeReader(r io.Reader) *ResizeReader {
+	return &ResizeReader{mr: NewMessageReader(r, WithMaxMessageSize(1024))}
+}
+
+// ReadResize receives the next window size.
+// Reset frames sent by the peer are skipped.
+func (rr *ResizeReader) ReadResize() (Winsize, error) {
+	for {
+		msg, err := rr.mr.ReadMessage()
+		if err == ErrPeerReset {
+			continue
+		}
+		if err != nil {
+			return Winsize{}, err
+		}
+		var ws Winsize
+		if err := json.Unmarshal(msg, &ws); err != nil {
+			return Winsize{}, fmt.Errorf("invalid resize message %q: %w", msg, err)
+		}
+		return ws, nil
+	}
+}
@@ -0,0 +1,50 @@
+package console_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/console"
+)
+
+func TestResizeReadWrite(t *testing.T) {
+	var buf bytes.Buffer
+	w := console.NewResizeWriter(&buf)
+	sizes := []console.Winsize{
+		{Rows: 24, Cols: 80},
+		{Rows: 50, Cols: 200},
+	}
+	if err := console.NewMessageWriter(&buf).WriteReset(); err != nil {
+		t.Fatal(err)
+	}
+	for _, ws := range sizes {
+		if err := w.WriteResize(ws); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := console.NewResizeReader(&buf)
+	for _, want := range sizes {
+		got, err := r.ReadResize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != got {
+			t.Fatalf("want %v but got %v", want, got)
+		}
+	}
+	if _, err := r.ReadResize(); err != io.EOF {
+		t.Fatalf("want io.EOF but got %v", err)
+	}
+}
+
+func TestResizeReaderInvalidMessage(t *testing.T) {
+	var buf bytes.Buffer
+	if err := console.NewMessageWriter(&buf).WriteMessage([]byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := console.NewResizeReader(&buf).ReadResize(); err == nil {
+		t.Fatal("want error but got nil")
+	}
+}
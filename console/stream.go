@@ -0,0 +1,171 @@
+// Package console provides host side helpers for the serial and Virtio console
+// ports of a virtual machine which are not tied to Virtualization.framework.
+package console
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrStreamClosed is returned when using a Stream which is already closed.
+var ErrStreamClosed = errors.New("console stream is closed")
+
+// Stream is the host side of a console port which is backed by a pair of pipes.
+//
+// Data written to the Stream goes to the guest, and data sent from the guest
+// can be read from the Stream. The other ends of the pipes are handed to
+// the serial port attachment with AttachmentFiles method.
+//
+// Virtualization.framework keeps the guest side of the pipes open while the virtual
+// machine is alive, even if the process in the guest closes and reopens the port
+// (e.g. /dev/vport0p1 or /dev/virtio-ports/<name>). So closing the port in the guest
+// does not cause io.EOF on the host side. Read returns io.EOF only after the Stream
+// has been closed by Close method or the attachment files have been closed by
+// CloseAttachmentFiles method. Use the reset frame of the MessageWriter to let the
+// host know that the guest has reopened the port.
+type Stream struct {
+	name string
+
+	// hostRead reads what the guest has written.
+	hostRead *os.File
+	// hostWrite writes what the guest will read.
+	hostWrite *os.File
+
+	// guestRead is the attachment side of hostWrite.
+	guestRead *os.File
+	// guestWrite is the attachment side of hostRead.
+	guestWrite *os.File
+
+	closeOnce           sync.Once
+	closeAttachmentOnce sync.Once
+	closed              chan struct{}
+}
+
+var _ io.ReadWriteCloser = (*Stream)(nil)
+
+// NewStream creates a new Stream with the name of the console port.
+// The name is only used for descriptive purposes such as errors and Registry.
+func NewStream(name string) (*Stream, error) {
+	hostRead, guestWrite, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pipe for guest output: %w", err)
+	}
+	guestRead, hostWrite, err := os.Pipe()
+	if err != nil {
+		hostRead.Close()
+		guestWrite.Close()
+		return nil, fmt.Errorf("failed to create pipe for guest input: %w", err)
+	}
+	return &Stream{
+		name:       name,
+		hostRead:   hostRead,
+		hostWrite:  hostWrite,
+		guestRead:  guestRead,
+		guestWrite: guestWrite,
+		closed:     make(chan struct{}),
+	}, nil
+}
+
+// Name returns the name of the console port.
+func (s *Stream) Name() string { return s.name }
+
+// AttachmentFiles returns the files which should be passed to
+// vz.NewFileHandleSerialPortAttachment.
+//
+// read is the file the virtual machine reads the guest input from, and write is
+// the file the virtual machine writes the guest output to.
+//
+// The Stream owns these files. Do not close them directly; use Close method or
+// CloseAttachmentFiles method instead.
+func (s *Stream) AttachmentFiles() (read, write *os.File) {
+	return s.guestRead, s.guestWrite
+}
+
+// Read reads data sent from the guest.
+func (s *Stream) Read(p []byte) (int, error) {
+	n, err := s.hostRead.Read(p)
+	if err != nil && s.isClosed() {
+		// reading from a closed *os.File returns os.ErrClosed.
+		// A closed stream should behave like the end of the stream.
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// SetReadDeadline sets the deadline of Read. A blocked Read returns an error which
+// wraps os.ErrDeadlineExceeded when the deadline is exceeded. The zero value clears
+// the deadline.
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	return s.hostRead.SetReadDeadline(t)
+}
+
+// Write writes data which will be sent to the guest.
+func (s *Stream) Write(p []byte) (int, error) {
+	if s.isClosed() {
+		return 0, ErrStreamClosed
+	}
+	n, err := s.hostWrite.Write(p)
+	if err != nil && s.isClosed() {
+		return n, ErrStreamClosed
+	}
+	return n, err
+}
+
+// CloseWrite closes the host to guest direction of the stream.
+// The guest keeps being able to send data to the host.
+func (s *Stream) CloseWrite() error {
+	return closeFile(s.hostWrite)
+}
+
+// CloseAttachmentFiles closes the attachment side of the pipes.
+//
+// This should be called after the virtual machine which uses the files has been stopped.
+// After calling this, Read returns io.EOF once all data sent from the guest has been consumed.
+func (s *Stream) CloseAttachmentFiles() error {
+	var err error
+	s.closeAttachmentOnce.Do(func() {
+		err = errors.Join(
+			closeFile(s.guestRead),
+			closeFile(s.guestWrite),
+		)
+	})
+	return err
+}
+
+// Close closes the stream and the attachment files.
+func (s *Stream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = errors.Join(
+			closeFile(s.hostRead),
+			closeFile(s.hostWrite),
+			s.CloseAttachmentFiles(),
+		)
+	})
+	return err
+}
+
+// Done returns a channel that's closed when the stream is closed.
+func (s *Stream) Done() <-chan struct{} { return s.closed }
+
+func (s *Stream) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeFile closes f. It is not an error if f has already been closed.
+func closeFile(f *os.File) error {
+	if err := f.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package console_test
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/console"
+)
+
+func TestStream(t *testing.T) {
+	stream, err := console.NewStream("org.example.agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	guestRead, guestWrite := stream.AttachmentFiles()
+
+	// host -> guest
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(guestRead, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != "ping" {
+		t.Fatalf("want %q but got %q", "ping", got)
+	}
+
+	// guest -> host
+	if _, err := guestWrite.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != "pong" {
+		t.Fatalf("want %q but got %q", "pong", got)
+	}
+}
+
+func TestStreamEOF(t *testing.T) {
+	t.Run("attachment files closed", func(t *testing.T) {
+		stream, err := console.NewStream("eof")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.Close()
+
+		_, guestWrite := stream.AttachmentFiles()
+		if _, err := guestWrite.Write([]byte("bye")); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.CloseAttachmentFiles(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "bye" {
+			t.Fatalf("want %q but got %q", "bye", got)
+		}
+	})
+	t.Run("stream closed", func(t *testing.T) {
+		stream, err := console.NewStream("closed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stream.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("want io.EOF but got %v", err)
+		}
+		if _, err := stream.Write([]byte("x")); !errors.Is(err, console.ErrStreamClosed) {
+			t.Fatalf("want %v but got %v", console.ErrStreamClosed, err)
+		}
+		if err := stream.Close(); err != nil {
+			t.Fatalf("want nil for the second close but got %v", err)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package console
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// NotifyResize calls fn with the window size of the terminal f, and then each time
+// the process receives SIGWINCH until ctx is done or the returned stop function is
+// called. stop waits until fn is no longer called.
+//
+// Nothing happens if f is not a terminal.
+func NotifyResize(ctx context.Context, f *os.File, fn func(Winsize)) (stop func()) {
+	if !term.IsTerminal(int(f.Fd())) {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGWINCH)
+	go func() {
+		defer close(done)
+		defer signal.Stop(sigCh)
+		for {
+			if ws, err := GetWinsize(f); err == nil {
+				fn(ws)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigCh:
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+type attachOptions struct {
+	resizeFunc func(Winsize)
+}
+
+// AttachOption is an option for (*PTY).Attach.
+type AttachOption func(*attachOptions)
+
+// WithResizeFunc sets the function which is called when the window size of the
+// terminal has been changed. Use it to propagate the size over a side channel
+// with ResizeWriter.
+func WithResizeFunc(fn func(Winsize)) AttachOption {
+	return func(o *attachOptions) {
+		o.resizeFunc = fn
+	}
+}
+
+// Attach connects in and out to the slave side of the pseudo-terminal until ctx is done,
+// in reaches EOF or the pseudo-terminal is closed.
+//
+// If in is a terminal, it is put in raw mode and its state is always restored before
+// returning, and its window size is propagated to the pseudo-terminal.
+// If in is not a terminal (e.g. a pipe or a file), the data is copied as is.
+//
+// Attach returns after the goroutines which copy the data and propagate the window
+// size have finished, so in and out are not used after it returns.
+func (p *PTY) Attach(ctx context.Context, in *os.File, out io.Writer, opts ...AttachOption) error {
+	o := &attachOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if fd := int(in.Fd()); term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, state)
+
+		stop := NotifyResize(ctx, in, func(ws Winsize) {
+			p.SetSize(ws)
+			if o.resizeFunc != nil {
+				o.resizeFunc(ws)
+			}
+		})
+		defer stop()
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	errCh := make(chan error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errCh <- copyFile(ctx, p.slave, in)
+	}()
+	go func() {
+		defer wg.Done()
+		errCh <- copyFile(ctx, out, p.slave)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-errCh:
+		if errors.Is(err, os.ErrClosed) || errors.Is(err, syscall.EIO) {
+			// EIO is returned when reading from the slave side after the master side is closed.
+			return nil
+		}
+		return err
+	}
+}
+
+// pollInterval is the interval to check if the copy is cancelled while src has no
+// data.
+const pollInterval = 100 * time.Millisecond
+
+// copyFile copies from src to dst until src reaches EOF or ctx is done. Unlike
+// io.Copy, it does not block in a read from src after ctx is done, so the caller
+// can wait for it to return.
+func copyFile(ctx context.Context, dst io.Writer, src *os.File) error {
+	fd := int(src.Fd())
+	buf := make([]byte, 32*1024)
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, int(pollInterval/time.Millisecond))
+		if errors.Is(err, unix.EINTR) || (err == nil && n == 0) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if fds[0].Revents&unix.POLLNVAL != 0 {
+			return os.ErrClosed
+		}
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			if _, werr := dst.Write(buf[:nr]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
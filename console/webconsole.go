@@ -0,0 +1,313 @@
+package console
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/internal/websocket"
+)
+
+// DefaultScrollbackSize is the default size of the console output which is replayed
+// to a newly connected viewer of WebHandler.
+const DefaultScrollbackSize = 64 * 1024
+
+// ErrWebHandlerClosed is returned when the WebHandler has been closed.
+var ErrWebHandlerClosed = errors.New("web console is closed")
+
+// WebControlMessage is a control message sent by a viewer of WebHandler as a WebSocket
+// text message. It is compatible with the events of xterm.js.
+//
+//	{"type":"input","data":"ls\r"}       // Terminal.onData
+//	{"type":"resize","cols":80,"rows":24} // Terminal.onResize
+type WebControlMessage struct {
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+}
+
+// WebHandler is an http.Handler which bridges a console stream to WebSocket connections.
+//
+// The console output is broadcast to every connected viewer as WebSocket binary messages.
+// A viewer sends the input as binary messages, or as WebControlMessage in text messages.
+// The input of read-only viewers is ignored.
+//
+// The stream is typically a *Stream or the slave side of a *PTY which is attached to
+// the virtual machine.
+type WebHandler struct {
+	stream     io.ReadWriter
+	upgrader   websocket.Upgrader
+	readOnly   func(*http.Request) bool
+	resizeFunc func(Winsize)
+	scrollback int
+
+	mu      sync.Mutex
+	clients map[*webClient]struct{}
+	history []byte
+	closed  bool
+
+	writeMu sync.Mutex
+	done    chan struct{}
+	once    sync.Once
+	// pumped is closed when pump returns.
+	pumped chan struct{}
+}
+
+var _ http.Handler = (*WebHandler)(nil)
+
+// WebHandlerOption is an option for NewWebHandler.
+type WebHandlerOption func(*WebHandler)
+
+// WithReadOnly makes all viewers read-only.
+func WithReadOnly() WebHandlerOption {
+	return WithReadOnlyFunc(func(*http.Request) bool { return true })
+}
+
+// WithReadOnlyFunc sets the function which reports whether the viewer of the request
+// is read-only. For example, it can be decided by authentication or a query parameter.
+func WithReadOnlyFunc(fn func(*http.Request) bool) WebHandlerOption {
+	return func(h *WebHandler) {
+		h.readOnly = fn
+	}
+}
+
+// WithWebResizeFunc sets the function which is called when a viewer which is not
+// read-only resized its terminal. Use it to propagate the size with ResizeWriter.
+func WithWebResizeFunc(fn func(Winsize)) WebHandlerOption {
+	return func(h *WebHandler) {
+		h.resizeFunc = fn
+	}
+}
+
+// WithScrollbackSize sets the size of the console output which is replayed to a newly
+// connected viewer. The default is DefaultScrollbackSize. Zero disables it.
+func WithScrollbackSize(size int) WebHandlerOption {
+	return func(h *WebHandler) {
+		h.scrollback = size
+	}
+}
+
+// WithCheckOrigin sets the function which reports whether the Origin header of the
+// request is acceptable. By default only the same origin is allowed.
+func WithCheckOrigin(fn func(*http.Request) bool) WebHandlerOption {
+	return func(h *WebHandler) {
+		h.upgrader.CheckOrigin = fn
+	}
+}
+
+// readDeadliner is a stream whose blocked Read can be interrupted, such as *Stream
+// and *os.File.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// NewWebHandler creates a new WebHandler and starts reading the console output from stream.
+//
+// The handler stops when the stream returns an error (including io.EOF) or Close method is called.
+// The stream is not closed by the handler, so that another handler can read it after
+// this one is closed.
+func NewWebHandler(stream io.ReadWriter, opts ...WebHandlerOption) *WebHandler {
+	h := &WebHandler{
+		stream:     stream,
+		readOnly:   func(*http.Request) bool { return false },
+		scrollback: DefaultScrollbackSize,
+		clients:    make(map[*webClient]struct{}),
+		done:       make(chan struct{}),
+		pumped:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	go h.pump()
+	return h
+}
+
+type webClient struct {
+	conn     *websocket.Conn
+	send     chan []byte
+	readOnly bool
+}
+
+// webClientQueueSize is the number of pending output chunks per viewer.
+// A viewer which can not keep up with the output is disconnected.
+const webClientQueueSize = 256
+
+// ServeHTTP upgrades the request to a WebSocket connection and serves the console.
+func (h *WebHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-h.done:
+		http.Error(w, ErrWebHandlerClosed.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	client := &webClient{
+		conn:     conn,
+		send:     make(chan []byte, webClientQueueSize),
+		readOnly: h.readOnly(r),
+	}
+	if !h.addClient(client) {
+		conn.Close(websocket.CloseGoingAway, ErrWebHandlerClosed.Error())
+		return
+	}
+	defer h.removeClient(client)
+
+	go client.writeLoop()
+	h.readLoop(client)
+}
+
+// addClient registers the client and queues the scrollback for it.
+func (h *WebHandler) addClient(c *webClient) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return false
+	}
+	if len(h.history) > 0 {
+		c.send <- append([]byte(nil), h.history...)
+	}
+	h.clients[c] = struct{}{}
+	return true
+}
+
+func (h *WebHandler) removeClient(c *webClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+func (c *webClient) writeLoop() {
+	for data := range c.send {
+		if err := c.conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			c.conn.Close(websocket.CloseGoingAway, "")
+			return
+		}
+	}
+	// send channel is closed when the client is removed.
+	c.conn.Close(websocket.CloseNormalClosure, "")
+}
+
+func (h *WebHandler) readLoop(c *webClient) {
+	for {
+		msgType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if c.readOnly {
+			continue
+		}
+		switch msgType {
+		case websocket.BinaryMessage:
+			h.input(data)
+		case websocket.TextMessage:
+			var msg WebControlMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				continue
+			}
+			switch msg.Type {
+			case "input":
+				h.input([]byte(msg.Data))
+			case "resize":
+				if h.resizeFunc != nil && msg.Cols > 0 && msg.Rows > 0 {
+					h.resizeFunc(Winsize{Rows: msg.Rows, Cols: msg.Cols})
+				}
+			}
+		}
+	}
+}
+
+func (h *WebHandler) input(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+	h.stream.Write(data)
+}
+
+// pump reads the console output and broadcasts it to the viewers.
+func (h *WebHandler) pump() {
+	defer close(h.pumped)
+	defer h.stop()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := h.stream.Read(buf)
+		if n > 0 {
+			h.broadcast(append([]byte(nil), buf[:n]...))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (h *WebHandler) broadcast(data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.scrollback > 0 {
+		h.history = append(h.history, data...)
+		if over := len(h.history) - h.scrollback; over > 0 {
+			h.history = append(h.history[:0], h.history[over:]...)
+		}
+	}
+	for c := range h.clients {
+		select {
+		case c.send <- data:
+		default:
+			// too slow viewer.
+			delete(h.clients, c)
+			close(c.send)
+		}
+	}
+}
+
+// Viewers returns the number of connected viewers.
+func (h *WebHandler) Viewers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// Done returns a channel that's closed when the handler has been stopped.
+func (h *WebHandler) Done() <-chan struct{} { return h.done }
+
+// Close disconnects all viewers and stops accepting new ones.
+//
+// If the stream has SetReadDeadline method like *Stream and *os.File, Close
+// interrupts the read of the console output and waits for it to return, and then
+// clears the deadline. Otherwise the reading goroutine returns after the next read
+// from the stream.
+func (h *WebHandler) Close() error {
+	h.stop()
+	d, ok := h.stream.(readDeadliner)
+	if !ok || d.SetReadDeadline(time.Now()) != nil {
+		return nil
+	}
+	<-h.pumped
+	return d.SetReadDeadline(time.Time{})
+}
+
+// stop disconnects all viewers and stops accepting new ones.
+func (h *WebHandler) stop() {
+	h.once.Do(func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.closed = true
+		for c := range h.clients {
+			delete(h.clients, c)
+			close(c.send)
+		}
+		close(h.done)
+	})
+}
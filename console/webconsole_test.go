@@ -0,0 +1,203 @@
+package console_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/console"
+	"github.com/Code-Hex/vz/v3/internal/websocket"
+)
+
+func newWebConsole(t *testing.T, opts ...console.WebHandlerOption) (*console.Stream, *console.WebHandler, string) {
+	t.Helper()
+	stream, err := console.NewStream("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stream.Close() })
+	h := console.NewWebHandler(stream, opts...)
+	t.Cleanup(func() { h.Close() })
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return stream, h, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dialWebConsole(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, err := websocket.Dial(context.Background(), url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close(websocket.CloseNormalClosure, "") })
+	return conn
+}
+
+func waitViewers(t *testing.T, h *console.WebHandler, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Viewers() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %d viewers but got %d", want, h.Viewers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func readOutput(t *testing.T, conn *websocket.Conn, want string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got string
+	for len(got) < len(want) {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read %q (got %q): %v", want, got, err)
+		}
+		if msgType != websocket.BinaryMessage {
+			t.Fatalf("want binary message but got %d", msgType)
+		}
+		got += string(data)
+	}
+	if want != got {
+		t.Fatalf("want %q but got %q", want, got)
+	}
+}
+
+func TestWebHandler(t *testing.T) {
+	resized := make(chan console.Winsize, 1)
+	stream, h, url := newWebConsole(t,
+		console.WithWebResizeFunc(func(ws console.Winsize) { resized <- ws }),
+	)
+	guestRead, guestWrite := stream.AttachmentFiles()
+
+	// output before connecting is replayed from the scrollback.
+	if _, err := guestWrite.Write([]byte("login: ")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	conn := dialWebConsole(t, url)
+	readOutput(t, conn, "login: ")
+
+	if _, err := guestWrite.Write([]byte("root\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	readOutput(t, conn, "root\r\n")
+
+	// input as a binary message and as a control message.
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("ls")); err != nil {
+		t.Fatal(err)
+	}
+	control, _ := json.Marshal(console.WebControlMessage{Type: "input", Data: "\r"})
+	if err := conn.WriteMessage(websocket.TextMessage, control); err != nil {
+		t.Fatal(err)
+	}
+	if got := readN(t, guestRead, 3); got != "ls\r" {
+		t.Fatalf("want %q but got %q", "ls\r", got)
+	}
+
+	resize, _ := json.Marshal(console.WebControlMessage{Type: "resize", Cols: 132, Rows: 43})
+	if err := conn.WriteMessage(websocket.TextMessage, resize); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ws := <-resized:
+		if want := (console.Winsize{Rows: 43, Cols: 132}); want != ws {
+			t.Fatalf("want %v but got %v", want, ws)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for resize")
+	}
+	waitViewers(t, h, 1)
+}
+
+func TestWebHandlerReadOnly(t *testing.T) {
+	stream, h, url := newWebConsole(t,
+		console.WithReadOnlyFunc(func(r *http.Request) bool {
+			return r.URL.Query().Get("mode") == "view"
+		}),
+	)
+	guestRead, guestWrite := stream.AttachmentFiles()
+
+	viewer := dialWebConsole(t, url+"?mode=view")
+	operator := dialWebConsole(t, url)
+	waitViewers(t, h, 2)
+
+	if err := viewer.WriteMessage(websocket.BinaryMessage, []byte("ignored")); err != nil {
+		t.Fatal(err)
+	}
+	if err := operator.WriteMessage(websocket.BinaryMessage, []byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readN(t, guestRead, 2); got != "ok" {
+		t.Fatalf("want %q but got %q", "ok", got)
+	}
+
+	if _, err := guestWrite.Write([]byte("broadcast")); err != nil {
+		t.Fatal(err)
+	}
+	readOutput(t, viewer, "broadcast")
+	readOutput(t, operator, "broadcast")
+}
+
+func TestWebHandlerStreamClosed(t *testing.T) {
+	stream, h, url := newWebConsole(t)
+	conn := dialWebConsole(t, url)
+	waitViewers(t, h, 1)
+
+	if err := stream.CloseAttachmentFiles(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-h.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the handler to stop")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("want *websocket.CloseError but got %v", err)
+	}
+
+	resp, err := http.Get("http" + strings.TrimPrefix(url, "ws"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("want status %d but got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+func TestWebHandlerClose(t *testing.T) {
+	stream, h, _ := newWebConsole(t)
+	_, guestWrite := stream.AttachmentFiles()
+
+	closed := make(chan error, 1)
+	go func() { closed <- h.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Close")
+	}
+
+	// The stream is not read by the closed handler, so that it can be read again.
+	if _, err := guestWrite.Write([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readN(t, stream, 5); got != "after" {
+		t.Fatalf("want %q but got %q", "after", got)
+	}
+}
@@ -0,0 +1,133 @@
+// Package esp creates EFI System Partition images for the guests which boot with
+// vz.NewEFIBootLoader, without mtools or the other tools of the host.
+//
+// The image is a FAT32 file system. It can be written to a file as a disk image by
+// itself, or to a partition of a disk image which has the partition table written by
+// the gpt package.
+//
+// see: https://uefi.org/specs/UEFI/2.10/13_Protocols_Media_Access.html#efi-file-system-format
+package esp
+
+import (
+	"bytes"
+	"debug/pe"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Code-Hex/vz/v3/fat"
+	"github.com/Code-Hex/vz/v3/kernel"
+)
+
+// DefaultLabel is the volume label of the images.
+const DefaultLabel = "ESP"
+
+// ErrInvalidBootLoader is returned when the boot loader is not an EFI application for
+// the architecture of the guest.
+var ErrInvalidBootLoader = errors.New("esp: invalid boot loader")
+
+// subsystemEFIApplication is the subsystem of the EFI applications in the PE optional
+// header.
+const subsystemEFIApplication = 10
+
+// BootLoaderPath returns the path of the default boot loader of the removable media,
+// which the firmware boots when there are no boot options, such as
+// "EFI/BOOT/BOOTAA64.EFI" for arm64.
+func BootLoaderPath(arch kernel.Arch) (string, error) {
+	switch arch {
+	case kernel.ArchARM64:
+		return "EFI/BOOT/BOOTAA64.EFI", nil
+	case kernel.ArchX86_64:
+		return "EFI/BOOT/BOOTX64.EFI", nil
+	}
+	return "", fmt.Errorf("esp: unsupported architecture %s", arch)
+}
+
+func peMachine(arch kernel.Arch) uint16 {
+	if arch == kernel.ArchARM64 {
+		return pe.IMAGE_FILE_MACHINE_ARM64
+	}
+	return pe.IMAGE_FILE_MACHINE_AMD64
+}
+
+// Image is an EFI System Partition image. The other files, such as the configurations
+// of the boot loader, can be added with the methods of fat.Image.
+type Image struct {
+	*fat.Image
+	arch kernel.Arch
+}
+
+// NewImage creates a new empty Image for the guest of arch. The options are applied
+// after the defaults, which are FAT32 and the label DefaultLabel. The size of the
+// image is at least 33 MiB, and use fat.WithSize to specify the size of the partition.
+func NewImage(arch kernel.Arch, opts ...fat.ImageOption) (*Image, error) {
+	if _, err := BootLoaderPath(arch); err != nil {
+		return nil, err
+	}
+	opts = append([]fat.ImageOption{fat.WithType(fat.FAT32), fat.WithLabel(DefaultLabel)}, opts...)
+	return &Image{Image: fat.NewImage(opts...), arch: arch}, nil
+}
+
+// AddBootLoader adds the EFI application, such as systemd-boot, GRUB or a unified
+// kernel image, as the default boot loader of the architecture of the guest. It
+// returns ErrInvalidBootLoader if data is not an EFI application for the architecture.
+func (img *Image) AddBootLoader(data []byte) error {
+	if err := checkEFIApplication(bytes.NewReader(data), img.arch); err != nil {
+		return err
+	}
+	name, _ := BootLoaderPath(img.arch)
+	return img.AddFile(name, data, 0o644)
+}
+
+// AddBootLoaderFromPath is like AddBootLoader but the boot loader is read from the
+// file at src on the host when the image is written.
+func (img *Image) AddBootLoaderFromPath(src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := checkEFIApplication(f, img.arch); err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	name, _ := BootLoaderPath(img.arch)
+	return img.AddFileFromPath(name, src, 0o644)
+}
+
+func checkEFIApplication(r io.ReaderAt, arch kernel.Arch) error {
+	f, err := pe.NewFile(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBootLoader, err)
+	}
+	defer f.Close()
+	if want := peMachine(arch); f.Machine != want {
+		return fmt.Errorf("%w: the machine type is %#x but want %#x for %s", ErrInvalidBootLoader, f.Machine, want, arch)
+	}
+	var subsystem uint16
+	switch h := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader64:
+		subsystem = h.Subsystem
+	case *pe.OptionalHeader32:
+		subsystem = h.Subsystem
+	}
+	if subsystem != subsystemEFIApplication {
+		return fmt.Errorf("%w: the subsystem is %d but want an EFI application", ErrInvalidBootLoader, subsystem)
+	}
+	return nil
+}
+
+// WriteFile writes the image to a new sparse file at path. The file is replaced if
+// it exists.
+func (img *Image) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := img.WriteImage(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to write the EFI System Partition: %w", err)
+	}
+	return f.Close()
+}
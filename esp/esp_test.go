@@ -0,0 +1,124 @@
+package esp_test
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/esp"
+	"github.com/Code-Hex/vz/v3/fat"
+	"github.com/Code-Hex/vz/v3/kernel"
+)
+
+// efiApplication returns a minimal PE32+ image which has no sections.
+func efiApplication(machine, subsystem uint16) []byte {
+	le := binary.LittleEndian
+	b := make([]byte, 64+4+20+112)
+	copy(b, "MZ")
+	le.PutUint32(b[0x3c:], 64)
+	copy(b[64:], "PE\x00\x00")
+	fh := b[68:]
+	le.PutUint16(fh[0:], machine)
+	le.PutUint16(fh[16:], 112) // size of the optional header
+	le.PutUint16(fh[18:], 0x22)
+	oh := b[88:]
+	le.PutUint16(oh[0:], 0x20b) // PE32+
+	le.PutUint16(oh[68:], subsystem)
+	return b
+}
+
+func TestImage(t *testing.T) {
+	cases := []struct {
+		arch    kernel.Arch
+		machine uint16
+		name    string
+	}{
+		{arch: kernel.ArchARM64, machine: pe.IMAGE_FILE_MACHINE_ARM64, name: "BOOTAA64EFI"},
+		{arch: kernel.ArchX86_64, machine: pe.IMAGE_FILE_MACHINE_AMD64, name: "BOOTX64 EFI"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.arch.String(), func(t *testing.T) {
+			img, err := esp.NewImage(tc.arch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			app := efiApplication(tc.machine, 10)
+			if err := img.AddBootLoader(app); err != nil {
+				t.Fatal(err)
+			}
+			if err := img.AddFile("loader/loader.conf", []byte("timeout 0\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "esp.img")
+			if err := img.WriteFile(path); err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if label, fsType := string(b[71:82]), string(b[82:90]); label != "ESP        " || fsType != "FAT32   " {
+				t.Fatalf("want the label ESP of FAT32 but got %q %q", label, fsType)
+			}
+			if !bytes.Contains(b, []byte(tc.name)) {
+				t.Fatalf("want the entry %q", tc.name)
+			}
+			if !bytes.Contains(b, app) {
+				t.Fatal("want the content of the boot loader")
+			}
+		})
+	}
+}
+
+func TestImageAddBootLoaderFromPath(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "systemd-bootaa64.efi")
+	if err := os.WriteFile(src, efiApplication(pe.IMAGE_FILE_MACHINE_ARM64, 10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	img, err := esp.NewImage(kernel.ArchARM64, fat.WithLabel("EFI"), fat.WithSize(64<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.AddBootLoaderFromPath(src); err != nil {
+		t.Fatal(err)
+	}
+	b, err := img.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 64<<20 {
+		t.Fatalf("want %d bytes but got %d", 64<<20, len(b))
+	}
+	if label := string(b[71:82]); label != "EFI        " {
+		t.Fatalf("want the label EFI but got %q", label)
+	}
+}
+
+func TestImageInvalidBootLoader(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{name: "not PE", data: []byte("#!/bin/sh\n")},
+		{name: "other machine", data: efiApplication(pe.IMAGE_FILE_MACHINE_AMD64, 10)},
+		{name: "console application", data: efiApplication(pe.IMAGE_FILE_MACHINE_ARM64, 3)},
+	}
+	img, err := esp.NewImage(kernel.ArchARM64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := img.AddBootLoader(tc.data); !errors.Is(err, esp.ErrInvalidBootLoader) {
+				t.Fatalf("want %v but got %v", esp.ErrInvalidBootLoader, err)
+			}
+		})
+	}
+	if _, err := esp.NewImage(kernel.ArchX86); err == nil {
+		t.Fatal("want error for the unsupported architecture")
+	}
+}
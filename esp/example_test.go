@@ -0,0 +1,47 @@
+package esp_test
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/Code-Hex/vz/v3/esp"
+	"github.com/Code-Hex/vz/v3/fat"
+	"github.com/Code-Hex/vz/v3/gpt"
+	"github.com/Code-Hex/vz/v3/kernel"
+)
+
+func ExampleImage_partition() {
+	const diskSize = 8 << 30
+	table := gpt.NewTable(diskSize)
+	part, err := table.AddPartition(gpt.TypeEFISystem, "ESP", 256<<20)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := table.AddPartition(gpt.TypeLinuxRootARM64, "root", 0); err != nil {
+		log.Fatal(err)
+	}
+
+	img, err := esp.NewImage(kernel.ArchARM64, fat.WithSize(part.Size))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := img.AddBootLoaderFromPath("linux.efi"); err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := os.Create("disk.img")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(diskSize); err != nil {
+		log.Fatal(err)
+	}
+	if err := table.WriteTable(f); err != nil {
+		log.Fatal(err)
+	}
+	if err := img.WriteImage(io.NewOffsetWriter(f, part.Offset)); err != nil {
+		log.Fatal(err)
+	}
+}
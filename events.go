@@ -0,0 +1,438 @@
+package vz
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	infinity "github.com/Code-Hex/go-infinity-channel"
+)
+
+// DefaultEventHistory is the number of the recent events of a virtual machine which
+// are kept for replaying by default.
+const DefaultEventHistory = 256
+
+// EventType is the type of an Event.
+type EventType string
+
+const (
+	// EventStateChanged is the type of StateChangedEvent.
+	EventStateChanged EventType = "StateChanged"
+	// EventNetworkDisconnected is the type of NetworkDisconnectedEvent.
+	EventNetworkDisconnected EventType = "NetworkDisconnected"
+	// EventNBDConnected is the type of NBDConnectedEvent.
+	EventNBDConnected EventType = "NBDConnected"
+	// EventNBDError is the type of NBDErrorEvent.
+	EventNBDError EventType = "NBDError"
+	// EventUSBAttached is the type of USBAttachedEvent.
+	EventUSBAttached EventType = "USBAttached"
+	// EventUSBDetached is the type of USBDetachedEvent.
+	EventUSBDetached EventType = "USBDetached"
+	// EventSaveCompleted is the type of SaveCompletedEvent.
+	EventSaveCompleted EventType = "SaveCompleted"
+	// EventRestoreCompleted is the type of RestoreCompletedEvent.
+	EventRestoreCompleted EventType = "RestoreCompleted"
+	// EventInstallProgress is the type of InstallProgressEvent.
+	EventInstallProgress EventType = "InstallProgress"
+	// EventInstallCompleted is the type of InstallCompletedEvent.
+	EventInstallCompleted EventType = "InstallCompleted"
+)
+
+// EventMeta is the metadata of an event.
+type EventMeta struct {
+	// Seq is the sequence number of the event, which starts with 1 and increases
+	// monotonically for each virtual machine.
+	Seq uint64 `json:"seq"`
+	// Time is the time when the event has occurred.
+	Time time.Time `json:"time"`
+	// Type is the type of the event.
+	Type EventType `json:"type"`
+	// VM is the identifier of the virtual machine, which is the same as the value of
+	// LogKeyVM in the log records.
+	VM string `json:"vm"`
+}
+
+// Meta returns the metadata of the event.
+func (m EventMeta) Meta() EventMeta { return m }
+
+func (m *EventMeta) eventMeta() *EventMeta { return m }
+
+// Event is an event of a virtual machine. The concrete types are the pointers of
+// the structs whose names end with "Event", such as *StateChangedEvent, and they
+// are encoded in JSON with the fields of EventMeta.
+type Event interface {
+	// Meta returns the metadata of the event.
+	Meta() EventMeta
+
+	eventMeta() *EventMeta
+}
+
+// StateChangedEvent is emitted when the execution state of the virtual machine has
+// changed, like StateChangedNotify.
+type StateChangedEvent struct {
+	EventMeta
+	State VirtualMachineState
+}
+
+// MarshalJSON encodes the state by its name.
+func (e *StateChangedEvent) MarshalJSON() ([]byte, error) {
+	return marshalEvent(e.EventMeta, nil, struct {
+		State string `json:"state"`
+	}{e.State.String()})
+}
+
+// NetworkDisconnectedEvent is emitted when the network attachment of the device of
+// the index has been disconnected, like NetworkDeviceAttachmentWasDisconnected.
+type NetworkDisconnectedEvent struct {
+	EventMeta
+	Index int
+	Err   error
+}
+
+// MarshalJSON encodes the error by its message.
+func (e *NetworkDisconnectedEvent) MarshalJSON() ([]byte, error) {
+	return marshalEvent(e.EventMeta, e.Err, struct {
+		Index int `json:"index"`
+	}{e.Index})
+}
+
+// NBDConnectedEvent is emitted when the NBD client of the storage device has
+// connected or reconnected to the server, like
+// (*NetworkBlockDeviceStorageDeviceAttachment).Connected.
+type NBDConnectedEvent struct {
+	EventMeta
+	URL string
+}
+
+// MarshalJSON encodes the event with its metadata.
+func (e *NBDConnectedEvent) MarshalJSON() ([]byte, error) {
+	return marshalEvent(e.EventMeta, nil, struct {
+		URL string `json:"url"`
+	}{e.URL})
+}
+
+// NBDErrorEvent is emitted when the NBD client of the storage device has
+// encountered an error, like (*NetworkBlockDeviceStorageDeviceAttachment).DidEncounterError.
+type NBDErrorEvent struct {
+	EventMeta
+	URL string
+	Err error
+}
+
+// MarshalJSON encodes the error by its message.
+func (e *NBDErrorEvent) MarshalJSON() ([]byte, error) {
+	return marshalEvent(e.EventMeta, e.Err, struct {
+		URL string `json:"url"`
+	}{e.URL})
+}
+
+// USBAttachedEvent is emitted when (*USBController).Attach has completed. Err is
+// the error of Attach.
+type USBAttachedEvent struct {
+	EventMeta
+	UUID string
+	Err  error
+}
+
+// MarshalJSON encodes the error by its message.
+func (e *USBAttachedEvent) MarshalJSON() ([]byte, error) {
+	return marshalEvent(e.EventMeta, e.Err, struct {
+		UUID string `json:"uuid"`
+	}{e.UUID})
+}
+
+// USBDetachedEvent is emitted when (*USBController).Detach has completed. Err is
+// the error of Detach.
+type USBDetachedEvent struct {
+	EventMeta
+	UUID string
+	Err  error
+}
+
+// MarshalJSON encodes the error by its message.
+func (e *USBDetachedEvent) MarshalJSON() ([]byte, error) {
+	return marshalEvent(e.EventMeta, e.Err, struct {
+		UUID string `json:"uuid"`
+	}{e.UUID})
+}
+
+// SaveCompletedEvent is emitted when SaveMachineStateToPath has completed. Err is
+// the error of SaveMachineStateToPath.
+type SaveCompletedEvent struct {
+	EventMeta
+	Path string
+	Err  error
+}
+
+// MarshalJSON encodes the error by its message.
+func (e *SaveCompletedEvent) MarshalJSON() ([]byte, error) {
+	return marshalEvent(e.EventMeta, e.Err, struct {
+		Path string `json:"path"`
+	}{e.Path})
+}
+
+// RestoreCompletedEvent is emitted when RestoreMachineStateFromURL has completed.
+// Err is the error of RestoreMachineStateFromURL.
+type RestoreCompletedEvent struct {
+	EventMeta
+	Path string
+	Err  error
+}
+
+// MarshalJSON encodes the error by its message.
+func (e *RestoreCompletedEvent) MarshalJSON() ([]byte, error) {
+	return marshalEvent(e.EventMeta, e.Err, struct {
+		Path string `json:"path"`
+	}{e.Path})
+}
+
+// InstallProgressEvent is emitted when the fraction of the installation of
+// MacOSInstaller has changed.
+type InstallProgressEvent struct {
+	EventMeta
+	FractionCompleted float64
+}
+
+// MarshalJSON encodes the event with its metadata.
+func (e *InstallProgressEvent) MarshalJSON() ([]byte, error) {
+	return marshalEvent(e.EventMeta, nil, struct {
+		FractionCompleted float64 `json:"fractionCompleted"`
+	}{e.FractionCompleted})
+}
+
+// InstallCompletedEvent is emitted when the installation of MacOSInstaller has
+// completed. Err is the error of the installation.
+type InstallCompletedEvent struct {
+	EventMeta
+	Err error
+}
+
+// MarshalJSON encodes the error by its message.
+func (e *InstallCompletedEvent) MarshalJSON() ([]byte, error) {
+	return marshalEvent(e.EventMeta, e.Err, struct{}{})
+}
+
+// marshalEvent encodes the metadata, the error and the fields of an event into a
+// JSON object.
+func marshalEvent(meta EventMeta, err error, fields any) ([]byte, error) {
+	head := struct {
+		EventMeta
+		Error string `json:"error,omitempty"`
+	}{EventMeta: meta}
+	if err != nil {
+		head.Error = err.Error()
+	}
+	b, merr := json.Marshal(head)
+	if merr != nil {
+		return nil, merr
+	}
+	body, merr := json.Marshal(fields)
+	if merr != nil {
+		return nil, merr
+	}
+	if len(body) <= len("{}") {
+		return b, nil
+	}
+	return append(append(b[:len(b)-1], ','), body[1:]...), nil
+}
+
+// WriteEventsJSONLines writes the events to w in JSON Lines, one event per line.
+func WriteEventsJSONLines(w io.Writer, events []Event) error {
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eventHub keeps the recent events of a virtual machine and delivers the events to
+// the subscribers. It also carries the logger of the virtual machine for the
+// devices which are shared with eventHubs.
+type eventHub struct {
+	vm  string
+	log *machineLogger
+
+	mu          sync.Mutex
+	seq         uint64
+	history     []Event
+	size        int
+	subscribers map[*infinity.Channel[Event]]struct{}
+}
+
+func newEventHub(log *machineLogger, size int) *eventHub {
+	return &eventHub{
+		vm:          log.id,
+		log:         log,
+		size:        size,
+		subscribers: make(map[*infinity.Channel[Event]]struct{}),
+	}
+}
+
+// emit sets the metadata of the event of the type, and delivers it.
+func (h *eventHub) emit(typ EventType, e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	*e.eventMeta() = EventMeta{Seq: h.seq, Time: time.Now(), Type: typ, VM: h.vm}
+	if h.size > 0 {
+		if len(h.history) == h.size {
+			h.history = append(h.history[:0], h.history[1:]...)
+		}
+		h.history = append(h.history, e)
+	}
+	for ch := range h.subscribers {
+		ch.In() <- e
+	}
+}
+
+// recent returns the kept events whose sequence numbers are greater than after.
+// h.mu must be held.
+func (h *eventHub) recent(after uint64) []Event {
+	events := make([]Event, 0, len(h.history))
+	for _, e := range h.history {
+		if e.Meta().Seq > after {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// subscribe returns the channel which receives the events until ctx is done.
+func (h *eventHub) subscribe(ctx context.Context, replay bool, after uint64) <-chan Event {
+	ch := infinity.NewChannel[Event]()
+	h.mu.Lock()
+	if replay {
+		for _, e := range h.recent(after) {
+			ch.In() <- e
+		}
+	}
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		h.mu.Lock()
+		delete(h.subscribers, ch)
+		h.mu.Unlock()
+		ch.Close()
+	}()
+	return ch.Out()
+}
+
+// eventHubs is the set of the hubs of the virtual machines which use a device
+// created before them, such as the NBD storage device attachments.
+type eventHubs struct {
+	mu   sync.Mutex
+	hubs []*eventHub
+}
+
+func (s *eventHubs) add(h *eventHub) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hubs = append(s.hubs, h)
+}
+
+// remove removes the hub of the virtual machine which has been finalized.
+func (s *eventHubs) remove(h *eventHub) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, hub := range s.hubs {
+		if hub == h {
+			s.hubs = append(s.hubs[:i], s.hubs[i+1:]...)
+			return
+		}
+	}
+}
+
+// loggers returns the loggers of the virtual machines of the hubs. The
+// package-level logger is returned if no virtual machine uses the device yet.
+func (s *eventHubs) loggers() []*slog.Logger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.hubs) == 0 {
+		return []*slog.Logger{Logger()}
+	}
+	loggers := make([]*slog.Logger, 0, len(s.hubs))
+	for _, h := range s.hubs {
+		loggers = append(loggers, h.log.get())
+	}
+	return loggers
+}
+
+// emit emits the event created by newEvent to each hub.
+func (s *eventHubs) emit(typ EventType, newEvent func() Event) {
+	s.mu.Lock()
+	hubs := append([]*eventHub(nil), s.hubs...)
+	s.mu.Unlock()
+	for _, h := range hubs {
+		h.emit(typ, newEvent())
+	}
+}
+
+type eventsOptions struct {
+	replay bool
+	after  uint64
+}
+
+// EventsOption is an option for (*VirtualMachine).Events.
+type EventsOption func(*eventsOptions)
+
+// WithEventReplay replays the kept events whose sequence numbers are greater than
+// after before the new events, so that a consumer can resume from the last event it
+// has received. 0 replays all the kept events.
+func WithEventReplay(after uint64) EventsOption {
+	return func(o *eventsOptions) {
+		o.replay = true
+		o.after = after
+	}
+}
+
+// Events returns the channel which receives the events of the virtual machine in
+// the order of their sequence numbers, until ctx is done. The channel is closed
+// when ctx is done, and the events are buffered without limit until they are
+// received.
+//
+// The replayed events and the new events do not overlap nor have a gap between
+// them.
+func (v *VirtualMachine) Events(ctx context.Context, opts ...EventsOption) <-chan Event {
+	o := &eventsOptions{}
+	for _, optFunc := range opts {
+		optFunc(o)
+	}
+	return v.events.subscribe(ctx, o.replay, o.after)
+}
+
+// EventHistory returns the kept recent events of the virtual machine in the order
+// of their sequence numbers.
+func (v *VirtualMachine) EventHistory() []Event {
+	v.events.mu.Lock()
+	defer v.events.mu.Unlock()
+	return v.events.recent(0)
+}
+
+// ExportEvents writes the events of the virtual machine to w in JSON Lines until
+// ctx is done or writing fails. The options are the same as Events.
+func (v *VirtualMachine) ExportEvents(ctx context.Context, w io.Writer, opts ...EventsOption) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	enc := json.NewEncoder(w)
+	for e := range v.Events(ctx, opts...) {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// WithVirtualMachineEventHistory sets the number of the recent events which are
+// kept for EventHistory and WithEventReplay. The default is DefaultEventHistory,
+// and 0 keeps no events.
+func WithVirtualMachineEventHistory(n int) NewVirtualMachineOption {
+	return func(v *VirtualMachine) {
+		v.eventHistory = n
+	}
+}
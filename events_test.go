@@ -0,0 +1,164 @@
+package vz
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, ch <-chan Event, n int) []Event {
+	t.Helper()
+	var events []Event
+	for len(events) < n {
+		select {
+		case e := <-ch:
+			events = append(events, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("want %d events but got %d", n, len(events))
+		}
+	}
+	return events
+}
+
+func seqs(events []Event) []uint64 {
+	s := make([]uint64, len(events))
+	for i, e := range events {
+		s[i] = e.Meta().Seq
+	}
+	return s
+}
+
+func equalSeqs(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEventHub(t *testing.T) {
+	h := newEventHub(&machineLogger{id: "vm-1"}, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	live := h.subscribe(ctx, false, 0)
+
+	start := time.Now()
+	for _, s := range []VirtualMachineState{VirtualMachineStateStarting, VirtualMachineStateRunning, VirtualMachineStatePausing, VirtualMachineStatePaused} {
+		h.emit(EventStateChanged, &StateChangedEvent{State: s})
+	}
+	h.emit(EventSaveCompleted, &SaveCompletedEvent{Path: "state.vzvmsave"})
+
+	events := receive(t, live, 5)
+	if want := []uint64{1, 2, 3, 4, 5}; !equalSeqs(seqs(events), want) {
+		t.Fatalf("want %v but got %v", want, seqs(events))
+	}
+	first := events[0].Meta()
+	if first.Type != EventStateChanged || first.VM != "vm-1" || first.Time.Before(start) {
+		t.Fatalf("unexpected metadata: %+v", first)
+	}
+	if e, ok := events[4].(*SaveCompletedEvent); !ok || e.Path != "state.vzvmsave" || e.Type != EventSaveCompleted {
+		t.Fatalf("want SaveCompletedEvent but got %#v", events[4])
+	}
+
+	h.mu.Lock()
+	history := h.recent(0)
+	h.mu.Unlock()
+	if want := []uint64{3, 4, 5}; !equalSeqs(seqs(history), want) {
+		t.Fatalf("want the history %v but got %v", want, seqs(history))
+	}
+
+	cases := []struct {
+		name  string
+		after uint64
+		want  []uint64
+	}{
+		{name: "all", after: 0, want: []uint64{3, 4, 5, 6}},
+		{name: "after", after: 4, want: []uint64{5, 6}},
+		{name: "latest", after: 5, want: []uint64{6}},
+	}
+	subs := make([]<-chan Event, len(cases))
+	for i, tc := range cases {
+		subs[i] = h.subscribe(ctx, true, tc.after)
+	}
+	h.emit(EventStateChanged, &StateChangedEvent{State: VirtualMachineStateRunning})
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := seqs(receive(t, subs[i], len(tc.want))); !equalSeqs(got, tc.want) {
+				t.Fatalf("want %v but got %v", tc.want, got)
+			}
+		})
+	}
+
+	cancel()
+	for range live {
+	}
+	h.mu.Lock()
+	n := len(h.subscribers)
+	h.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("want no subscribers after cancel but got %d", n)
+	}
+}
+
+func TestEventHubs(t *testing.T) {
+	var buf bytes.Buffer
+	h1 := newEventHub(&machineLogger{id: "vm-1", logger: newTestLogger(&buf)}, 1)
+	h2 := newEventHub(&machineLogger{id: "vm-2", logger: newTestLogger(&buf)}, 1)
+	var hubs eventHubs
+	if loggers := hubs.loggers(); len(loggers) != 1 || loggers[0] != Logger() {
+		t.Fatalf("want the package-level logger without hubs but got %v", loggers)
+	}
+	hubs.add(h1)
+	hubs.add(h2)
+	h1.emit(EventStateChanged, &StateChangedEvent{State: VirtualMachineStateRunning})
+	hubs.emit(EventNBDConnected, func() Event { return &NBDConnectedEvent{URL: "nbd://localhost/disk"} })
+
+	e1, e2 := h1.history[0].Meta(), h2.history[0].Meta()
+	if e1.Seq != 2 || e1.VM != "vm-1" || e2.Seq != 1 || e2.VM != "vm-2" {
+		t.Fatalf("want the event in each hub but got %+v and %+v", e1, e2)
+	}
+	// The records of a shared device are logged with each virtual machine.
+	for _, logger := range hubs.loggers() {
+		logger.Info("network block device was connected")
+	}
+	if got := buf.String(); !strings.Contains(got, "vm=vm-1") || !strings.Contains(got, "vm=vm-2") {
+		t.Fatalf("want the records of both virtual machines but got %q", got)
+	}
+
+	// The hub of the finalized virtual machine is removed.
+	hubs.remove(h1)
+	hubs.emit(EventNBDConnected, func() Event { return &NBDConnectedEvent{URL: "nbd://localhost/disk"} })
+	if len(hubs.hubs) != 1 || h1.history[0].Meta().Seq != 2 || h2.history[0].Meta().Seq != 2 {
+		t.Fatalf("want the event only in the remaining hub but got %d hubs", len(hubs.hubs))
+	}
+}
+
+func TestWriteEventsJSONLines(t *testing.T) {
+	meta := func(seq uint64, typ EventType) EventMeta {
+		return EventMeta{Seq: seq, Time: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Type: typ, VM: "vm-1"}
+	}
+	events := []Event{
+		&StateChangedEvent{EventMeta: meta(1, EventStateChanged), State: VirtualMachineStateRunning},
+		&NetworkDisconnectedEvent{EventMeta: meta(2, EventNetworkDisconnected), Index: 1, Err: errors.New("reset")},
+		&InstallCompletedEvent{EventMeta: meta(3, EventInstallCompleted)},
+	}
+	var buf bytes.Buffer
+	if err := WriteEventsJSONLines(&buf, events); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		`{"seq":1,"time":"2024-01-02T03:04:05Z","type":"StateChanged","vm":"vm-1","state":"VirtualMachineStateRunning"}`,
+		`{"seq":2,"time":"2024-01-02T03:04:05Z","type":"NetworkDisconnected","vm":"vm-1","error":"reset","index":1}`,
+		`{"seq":3,"time":"2024-01-02T03:04:05Z","type":"InstallCompleted","vm":"vm-1"}`,
+	}, "\n") + "\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("want\n%s\nbut got\n%s", want, got)
+	}
+}
@@ -1,41 +1,20 @@
 package main
 
 import (
+	"context"
 	l "log"
 	"os"
 	"os/signal"
-	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/Code-Hex/vz/v3"
-	"github.com/pkg/term/termios"
-	"golang.org/x/sys/unix"
+	"github.com/Code-Hex/vz/v3/console"
+	"github.com/Code-Hex/vz/v3/kernel"
 )
 
 var log *l.Logger
 
-// https://developer.apple.com/documentation/virtualization/running_linux_in_a_virtual_machine?language=objc#:~:text=Configure%20the%20Serial%20Port%20Device%20for%20Standard%20In%20and%20Out
-func setRawMode(f *os.File) {
-	var attr unix.Termios
-
-	// Get settings for terminal
-	termios.Tcgetattr(f.Fd(), &attr)
-
-	// Put stdin into raw mode, disabling local echo, input canonicalization,
-	// and CR-NL mapping.
-	attr.Iflag &^= syscall.ICRNL
-	attr.Lflag &^= syscall.ICANON | syscall.ECHO
-
-	// Set minimum characters when reading = 1 char
-	attr.Cc[syscall.VMIN] = 1
-
-	// set timeout when reading as non-canonical mode
-	attr.Cc[syscall.VTIME] = 0
-
-	// reflects the changed settings
-	termios.Tcsetattr(f.Fd(), termios.TCSANOW, &attr)
-}
-
 func main() {
 	file, err := os.Create("./log.log")
 	if err != nil {
@@ -44,13 +23,12 @@ func main() {
 	defer file.Close()
 	log = l.New(file, "", l.LstdFlags)
 
-	kernelCommandLineArguments := []string{
+	kernelCommandLine := kernel.NewCommandLine().
 		// Use the first virtio console device as system console.
-		"console=hvc0",
+		SetConsole(kernel.ConsoleHVC0).
 		// Stop in the initial ramdisk before attempting to transition to
 		// the root file system.
-		"root=/dev/vda",
-	}
+		Set("root", "/dev/vda")
 
 	vmlinuz := os.Getenv("VMLINUZ_PATH")
 	initrd := os.Getenv("INITRD_PATH")
@@ -58,8 +36,10 @@ func main() {
 
 	bootLoader, err := vz.NewLinuxBootLoader(
 		vmlinuz,
-		vz.WithCommandLine(strings.Join(kernelCommandLineArguments, " ")),
+		vz.WithKernelCommandLine(kernelCommandLine),
 		vz.WithInitrd(initrd),
+		// The kernel of the distributions (e.g. /casper/vmlinuz) is compressed.
+		vz.WithAutoDecompress(""),
 	)
 	if err != nil {
 		log.Fatalf("bootloader creation failed: %s", err)
@@ -75,13 +55,16 @@ func main() {
 		log.Fatalf("failed to create virtual machine configuration: %s", err)
 	}
 
-	setRawMode(os.Stdin)
-
 	// console
-	serialPortAttachment, err := vz.NewFileHandleSerialPortAttachment(os.Stdin, os.Stdout)
+	//
+	// The guest console is backed by a pseudo-terminal. The terminal of this process is
+	// attached to it after the virtual machine has started, and restored on exit.
+	serialPortAttachment, pty, err := vz.NewPTYSerialPortAttachment()
 	if err != nil {
 		log.Fatalf("Serial port attachment creation failed: %s", err)
 	}
+	defer pty.Close()
+	log.Println("console pseudo-terminal:", pty.Name())
 	consoleConfig, err := vz.NewVirtioConsoleDeviceSerialPortConfiguration(serialPortAttachment)
 	if err != nil {
 		log.Fatalf("Failed to create serial configuration: %s", err)
@@ -90,6 +73,31 @@ func main() {
 		consoleConfig,
 	})
 
+	// side channel to propagate window size changes of the terminal. (optional)
+	//
+	// An agent in the guest can read them from /dev/virtio-ports/<console.ResizePortName>.
+	registry := console.NewRegistry()
+	defer registry.Close()
+	resizeWriter := func(console.Winsize) {}
+	consoleDevice, err := vz.NewVirtioConsoleDeviceConfigurationWithRegistry(registry, console.ResizePortName)
+	if err != nil {
+		log.Println("resize side channel is not available:", err)
+	} else {
+		config.SetConsoleDevicesVirtualMachineConfiguration([]vz.ConsoleDeviceConfiguration{
+			consoleDevice,
+		})
+		resizeStream, err := registry.Lookup(console.ResizePortName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rw := console.NewResizeWriter(resizeStream)
+		resizeWriter = func(ws console.Winsize) {
+			if err := rw.WriteResize(ws); err != nil {
+				log.Println("failed to send window size:", err)
+			}
+		}
+	}
+
 	// network
 	natAttachment, err := vz.NewNATNetworkDeviceAttachment()
 	if err != nil {
@@ -166,6 +174,37 @@ func main() {
 		log.Fatalf("Start virtual machine is failed: %s", err)
 	}
 
+	// The terminal is raw while it is attached. restoreTerminal detaches it and
+	// waits for its state to be restored, and must be called on every exit path,
+	// including the fatal errors and the panics which skip the deferred calls.
+	ctx, cancel := context.WithCancel(context.Background())
+	attachDone := make(chan struct{})
+	var restoreOnce sync.Once
+	restoreTerminal := func() {
+		restoreOnce.Do(func() {
+			cancel()
+			<-attachDone
+		})
+	}
+	fatalf := func(format string, v ...any) {
+		restoreTerminal()
+		log.Fatalf(format, v...)
+	}
+	defer restoreTerminal()
+	defer func() {
+		if r := recover(); r != nil {
+			restoreTerminal()
+			panic(r)
+		}
+	}()
+	go func() {
+		defer close(attachDone)
+		err := pty.Attach(ctx, os.Stdin, os.Stdout, console.WithResizeFunc(resizeWriter))
+		if err != nil && err != context.Canceled {
+			log.Println("console attach error:", err)
+		}
+	}()
+
 	errCh := make(chan error, 1)
 
 	for {
@@ -173,8 +212,7 @@ func main() {
 		case <-signalCh:
 			result, err := vm.RequestStop()
 			if err != nil {
-				log.Println("request stop error:", err)
-				return
+				fatalf("request stop error: %s", err)
 			}
 			log.Println("recieved signal", result)
 		case newState := <-vm.StateChangedNotify():
@@ -0,0 +1,31 @@
+package ext4_test
+
+import (
+	"log"
+	"os"
+
+	"github.com/Code-Hex/vz/v3/ext4"
+)
+
+func ExampleImage_AddTar() {
+	// Build the root file system of a guest from the layers of a container image.
+	img := ext4.NewImage(ext4.WithLabel("rootfs"))
+	defer img.Close()
+	for _, layer := range []string{"/path/to/layer1.tar.gz", "/path/to/layer2.tar.gz"} {
+		f, err := os.Open(layer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = img.AddTar(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	// The image is created by vz.CreateDiskImage("/path/to/rootfs.img", 4<<30).
+	if err := img.WriteFile("/path/to/rootfs.img"); err != nil {
+		log.Fatal(err)
+	}
+	// Attach "/path/to/rootfs.img" as the first virtio block device and boot the
+	// kernel with "root=/dev/vda".
+}
@@ -0,0 +1,128 @@
+//go:build darwin || linux
+
+package ext4
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// AddHostDir adds the entries under the directory src on the host to the root
+// directory of the image. The modes, the owners, the modification times, the
+// extended attributes, the symbolic links, the hard links and the special files are
+// preserved. The attributes of src are used for the root directory.
+//
+// The contents of the regular files are read when the image is written. The extended
+// attributes which are not supported by ext4, such as "com.apple.provenance", are
+// ignored.
+func (img *Image) AddHostDir(src string) error {
+	// links has the first paths of the files which have multiple links.
+	links := make(map[[2]uint64]string)
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if err := img.addHostEntry(name, p, d, links); err != nil {
+			return fmt.Errorf("failed to add %q: %w", p, err)
+		}
+		return nil
+	})
+}
+
+func (img *Image) addHostEntry(name, p string, d fs.DirEntry, links map[[2]uint64]string) error {
+	fi, err := d.Info()
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("unsupported file info %T", fi.Sys())
+	}
+	if !fi.IsDir() && st.Nlink > 1 {
+		key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+		if target, ok := links[key]; ok {
+			return img.AddHardlink(name, target)
+		}
+		links[key] = name
+	}
+
+	xattrs, err := readXattrs(p)
+	if err != nil {
+		return err
+	}
+	opts := []EntryOption{
+		WithOwner(int(st.Uid), int(st.Gid)),
+		WithTimestamp(fi.ModTime()),
+	}
+	for attr, value := range xattrs {
+		opts = append(opts, WithXattr(attr, value))
+	}
+
+	mode := fi.Mode()
+	rdev := uint64(st.Rdev)
+	switch mode.Type() {
+	case 0:
+		return img.AddFileFromPath(name, p, mode, opts...)
+	case fs.ModeDir:
+		return img.AddDir(name, mode, opts...)
+	case fs.ModeSymlink:
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		return img.AddSymlink(name, target, opts...)
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return img.AddCharDevice(name, unix.Major(rdev), unix.Minor(rdev), mode, opts...)
+	case fs.ModeDevice:
+		return img.AddBlockDevice(name, unix.Major(rdev), unix.Minor(rdev), mode, opts...)
+	case fs.ModeNamedPipe:
+		return img.AddFifo(name, mode, opts...)
+	case fs.ModeSocket:
+		return img.AddSocket(name, mode, opts...)
+	}
+	return fmt.Errorf("%w: unsupported file type %v", ErrInvalidPath, mode.Type())
+}
+
+// readXattrs returns the extended attributes of the file at p, which are supported
+// by ext4. It does not follow the symbolic link.
+func readXattrs(p string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(p, nil)
+	if errors.Is(err, unix.ENOTSUP) || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("llistxattr: %w", err)
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(p, buf); err != nil {
+		return nil, fmt.Errorf("llistxattr: %w", err)
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if _, _, ok := xattrIndex(string(name)); !ok {
+			continue
+		}
+		n, err := unix.Lgetxattr(p, string(name), nil)
+		if err != nil {
+			return nil, fmt.Errorf("lgetxattr %s: %w", name, err)
+		}
+		value := make([]byte, n)
+		if n, err = unix.Lgetxattr(p, string(name), value); err != nil {
+			return nil, fmt.Errorf("lgetxattr %s: %w", name, err)
+		}
+		xattrs[string(name)] = value[:n]
+	}
+	return xattrs, nil
+}
@@ -0,0 +1,76 @@
+//go:build darwin || linux
+
+package ext4_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/ext4"
+	"golang.org/x/sys/unix"
+)
+
+func TestImageAddHostDir(t *testing.T) {
+	src := t.TempDir()
+	steps := []func() error{
+		func() error { return os.MkdirAll(filepath.Join(src, "usr/bin"), 0o755) },
+		func() error { return os.WriteFile(filepath.Join(src, "usr/bin/tool"), []byte("tool"), 0o755) },
+		func() error {
+			return os.Link(filepath.Join(src, "usr/bin/tool"), filepath.Join(src, "usr/bin/tool-link"))
+		},
+		func() error { return os.Symlink("usr/bin", filepath.Join(src, "bin")) },
+		func() error { return syscall.Mkfifo(filepath.Join(src, "fifo"), 0o600) },
+		func() error { return os.Mkdir(filepath.Join(src, "private"), 0o700) },
+		func() error { return os.Chmod(filepath.Join(src, "private"), fs.ModeSetgid|0o750) },
+		func() error { return os.Chmod(src, 0o751) },
+		func() error {
+			return os.Chtimes(filepath.Join(src, "usr/bin/tool"), testTime, testTime)
+		},
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+	// Some file systems do not support the extended attributes in the user namespace.
+	hasXattr := unix.Lsetxattr(filepath.Join(src, "usr/bin/tool"), "user.origin", []byte("host"), 0) == nil
+
+	img := ext4.NewImage()
+	if err := img.AddHostDir(src); err != nil {
+		t.Fatal(err)
+	}
+	path := createImage(t, img, 16<<20)
+	e2fsck(t, path)
+
+	if want, got := []string{"bin", "fifo", "lost+found", "private", "usr"}, listDir(t, path, "/"); !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %q but got %q", want, got)
+	}
+	want := []string{"Mode:  0755", "Links: 2", "mtime: 0x65937d25:00000960"}
+	if hasXattr {
+		want = append(want, "user.origin (4) = \"host\"")
+	}
+	cases := []struct {
+		cmd  string
+		want []string
+	}{
+		{cmd: "cat /usr/bin/tool-link", want: []string{"tool"}},
+		{cmd: "stat /usr/bin/tool", want: want},
+		{cmd: "stat /bin", want: []string{"Fast link dest: \"usr/bin\""}},
+		{cmd: "stat /fifo", want: []string{"Type: FIFO", "Mode:  0600"}},
+		{cmd: "stat /private", want: []string{"Type: directory", "Mode:  02750"}},
+		{cmd: "stat /", want: []string{"Mode:  0751"}},
+	}
+	for _, tc := range cases {
+		got := debugfs(t, path, tc.cmd)
+		for _, want := range tc.want {
+			if !strings.Contains(got, want) {
+				t.Fatalf("%s: want %q but got:\n%s", tc.cmd, want, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,822 @@
+package ext4
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+
+	"github.com/Code-Hex/vz/v3/internal/fstree"
+)
+
+const (
+	inodeSize       = 256
+	extraInodeSize  = 32
+	inodesPerBlock  = BlockSize / inodeSize
+	blocksPerGroup  = 8 * BlockSize
+	bytesPerInode   = 16384
+	descSize        = 32
+	sectorsPerBlock = BlockSize / 512
+
+	rootIno  = 2
+	firstIno = 11
+
+	maxNameLen = 255
+	maxLinks   = 65000
+
+	extentsInInode  = 4
+	extentsPerBlock = (BlockSize - 12) / 12
+	extentMagic     = 0xf30a
+
+	// fastSymlinkLen is the maximum length of the symbolic link target which is
+	// stored in the inode.
+	fastSymlinkLen = 59
+
+	// minLastGroupBlocks is the minimum number of the data blocks of the last block
+	// group. The smaller group is dropped like mke2fs.
+	minLastGroupBlocks = 50
+
+	lostFound       = "lost+found"
+	lostFoundBlocks = 4
+
+	reservedPercent = 5
+
+	copyBufferSize = 1 << 20
+)
+
+// Feature flags of the superblock.
+const (
+	compatExtAttr = 0x0008
+
+	incompatFiletype = 0x0002
+	incompatExtents  = 0x0040
+
+	roCompatSparseSuper = 0x0001
+	roCompatLargeFile   = 0x0002
+	roCompatDirNlink    = 0x0020
+	roCompatExtraIsize  = 0x0040
+)
+
+const inodeFlagExtents = 0x80000
+
+// File types of directory entries.
+const (
+	ftRegular = 1
+	ftDir     = 2
+	ftChar    = 3
+	ftBlock   = 4
+	ftFifo    = 5
+	ftSocket  = 6
+	ftSymlink = 7
+)
+
+// geometry is the layout of the block groups. Each group has the backup of the
+// superblock and the group descriptors if it is 0, 1 or a power of 3, 5 or 7, the
+// block bitmap, the inode bitmap, the inode table and the data blocks in this order.
+type geometry struct {
+	blocks         uint32
+	groups         uint32
+	gdtBlocks      uint32
+	inodesPerGroup uint32
+	itableBlocks   uint32
+}
+
+func newGeometry(size int64, inodes uint32) (*geometry, error) {
+	n := size / BlockSize
+	if n >= 1<<32 {
+		return nil, fmt.Errorf("ext4: the image is larger than %d bytes", (1<<32-1)*BlockSize)
+	}
+	g := &geometry{blocks: uint32(n)}
+	for g.blocks > 0 {
+		g.groups = (g.blocks + blocksPerGroup - 1) / blocksPerGroup
+		g.gdtBlocks = (g.groups*descSize + BlockSize - 1) / BlockSize
+
+		ipg := uint32(uint64(g.blocks) * BlockSize / bytesPerInode / uint64(g.groups))
+		ipg = max(ipg, (inodes+g.groups-1)/g.groups)
+		ipg = (ipg + inodesPerBlock - 1) / inodesPerBlock * inodesPerBlock
+		if ipg == 0 {
+			ipg = inodesPerBlock
+		}
+		if ipg > 8*BlockSize {
+			return nil, fmt.Errorf("%w: too many entries", ErrNoSpace)
+		}
+		g.inodesPerGroup = ipg
+		g.itableBlocks = ipg / inodesPerBlock
+
+		last := g.groups - 1
+		if g.groupBlocks(last) >= g.overhead(last)+minLastGroupBlocks {
+			return g, nil
+		}
+		g.blocks = last * blocksPerGroup
+	}
+	return nil, fmt.Errorf("%w: the image is too small", ErrNoSpace)
+}
+
+func (g *geometry) hasSuper(group uint32) bool {
+	if group <= 1 {
+		return true
+	}
+	for _, base := range []uint32{3, 5, 7} {
+		n := base
+		for n < group {
+			n *= base
+		}
+		if n == group {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *geometry) groupStart(group uint32) uint32 {
+	return group * blocksPerGroup
+}
+
+func (g *geometry) groupBlocks(group uint32) uint32 {
+	return min(blocksPerGroup, g.blocks-g.groupStart(group))
+}
+
+func (g *geometry) overhead(group uint32) uint32 {
+	n := 2 + g.itableBlocks
+	if g.hasSuper(group) {
+		n += 1 + g.gdtBlocks
+	}
+	return n
+}
+
+func (g *geometry) blockBitmap(group uint32) uint32 {
+	return g.groupStart(group) + g.overhead(group) - 2 - g.itableBlocks
+}
+
+func (g *geometry) inodeBitmap(group uint32) uint32 {
+	return g.blockBitmap(group) + 1
+}
+
+func (g *geometry) inodeTable(group uint32) uint32 {
+	return g.blockBitmap(group) + 2
+}
+
+func (g *geometry) dataStart(group uint32) uint32 {
+	return g.groupStart(group) + g.overhead(group)
+}
+
+// extent is a run of blocks.
+type extent struct {
+	start, len uint32
+}
+
+// allocator allocates the data blocks from the first group in order. The runs never
+// span the groups, so they are shorter than the maximum length of extents, 32768.
+type allocator struct {
+	geo   *geometry
+	group uint32
+	next  uint32
+}
+
+func (a *allocator) alloc(n uint32) ([]extent, error) {
+	var exts []extent
+	for n > 0 {
+		if a.group >= a.geo.groups {
+			return nil, ErrNoSpace
+		}
+		end := a.geo.groupStart(a.group) + a.geo.groupBlocks(a.group)
+		if a.next >= end {
+			a.group++
+			if a.group < a.geo.groups {
+				a.next = a.geo.dataStart(a.group)
+			}
+			continue
+		}
+		c := min(n, end-a.next)
+		exts = append(exts, extent{start: a.next, len: c})
+		a.next += c
+		n -= c
+	}
+	return exts, nil
+}
+
+// usedEnd returns the end of the used blocks of the group.
+func (a *allocator) usedEnd(group uint32) uint32 {
+	switch {
+	case group < a.group:
+		return a.geo.groupStart(group) + a.geo.groupBlocks(group)
+	case group == a.group:
+		return max(a.next, a.geo.dataStart(group))
+	}
+	return a.geo.dataStart(group)
+}
+
+type dirEntry struct {
+	name string
+	ino  uint32
+	typ  uint8
+}
+
+type inode struct {
+	ino  uint32
+	node *fstree.Node
+	// links is the number of the directory entries which refer to the inode.
+	links uint32
+
+	// parent, subdirs and entries are used for directories.
+	parent  uint32
+	subdirs uint32
+	entries []dirEntry
+
+	// data is the content of the directory or the long symbolic link.
+	data    []byte
+	size    uint64
+	extents []extent
+	leaves  []uint32
+	xattr   *xattrBlock
+}
+
+// layout is the placement of the inodes and the blocks of an image.
+type layout struct {
+	geo      *geometry
+	alloc    allocator
+	label    string
+	uuid     [16]byte
+	hashSeed [16]byte
+	modTime  uint32
+
+	// inodes are sorted by the inode number. The first one is the root directory.
+	inodes []*inode
+	xattrs []*xattrBlock
+}
+
+func (img *Image) layout(size int64) (*layout, error) {
+	if img.tree.Lookup(lostFound) == nil {
+		if _, err := img.tree.AddDir(lostFound, 0o700); err != nil {
+			return nil, err
+		}
+	}
+
+	l := &layout{
+		label:   img.label,
+		uuid:    img.uuid,
+		modTime: uint32(img.modTime.Unix()),
+	}
+	inodes := make(map[*fstree.Node]*inode)
+	next := uint32(firstIno)
+	err := img.tree.Walk(func(n *fstree.Node) error {
+		target := n
+		if n.Link != nil {
+			target = n.Link
+		}
+		in := inodes[target]
+		if in == nil {
+			in = &inode{node: target, ino: rootIno}
+			if n.Parent != nil {
+				in.ino = next
+				next++
+			}
+			inodes[target] = in
+			l.inodes = append(l.inodes, in)
+		}
+		in.links++
+		if n.Parent == nil {
+			in.parent = rootIno
+			return nil
+		}
+		if len(n.Name) > maxNameLen {
+			return fmt.Errorf("%w: the name of %q is too long", ErrInvalidPath, n.Path())
+		}
+		if in.links > maxLinks {
+			return fmt.Errorf("ext4: too many links to %q", n.Path())
+		}
+		parent := inodes[n.Parent]
+		parent.entries = append(parent.entries, dirEntry{name: n.Name, ino: in.ino, typ: fileType(target.Mode)})
+		if n.IsDir() {
+			in.parent = parent.ino
+			parent.subdirs++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if l.geo, err = newGeometry(size, next-1); err != nil {
+		return nil, err
+	}
+	l.alloc = allocator{geo: l.geo, next: l.geo.dataStart(0)}
+	if !img.hasUUID {
+		l.uuid = img.deriveUUID()
+	}
+	seed := sha256.Sum256(l.uuid[:])
+	copy(l.hashSeed[:], seed[:])
+
+	xattrs := make(map[string]*xattrBlock)
+	for _, in := range l.inodes {
+		if err := l.allocate(in, xattrs); err != nil {
+			if in.node.Parent == nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("failed to allocate %q: %w", in.node.Path(), err)
+		}
+	}
+	return l, nil
+}
+
+// deriveUUID derives a random-based (version 4) UUID from the label and the entries.
+func (img *Image) deriveUUID() [16]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\n", img.label)
+	img.tree.Walk(func(n *fstree.Node) error {
+		fmt.Fprintf(h, "%q %v %d %d %d %d %q %d %d\n", n.Path(), n.Mode, n.UID, n.GID,
+			n.ModTime.UnixNano(), n.Size(), n.Linkname, n.DevMajor, n.DevMinor)
+		return nil
+	})
+	var uuid [16]byte
+	copy(uuid[:], h.Sum(nil))
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return uuid
+}
+
+func (l *layout) allocate(in *inode, xattrs map[string]*xattrBlock) error {
+	n := in.node
+	switch n.Mode.Type() {
+	case fs.ModeDir:
+		in.data = encodeDir(in)
+		if n.Name == lostFound && n.Parent != nil && n.Parent.Parent == nil {
+			// e2fsck uses the preallocated blocks of lost+found.
+			for len(in.data) < lostFoundBlocks*BlockSize {
+				in.data = append(in.data, emptyDirBlock()...)
+			}
+		}
+		in.size = uint64(len(in.data))
+	case 0:
+		in.size = uint64(n.Size())
+	case fs.ModeSymlink:
+		in.size = uint64(len(n.Linkname))
+		if len(n.Linkname) > fastSymlinkLen {
+			in.data = []byte(n.Linkname)
+		}
+	}
+	var blocks uint32
+	if n.Mode.IsRegular() || in.data != nil {
+		blocks = uint32((in.size + BlockSize - 1) / BlockSize)
+	}
+
+	var err error
+	if in.extents, err = l.alloc.alloc(blocks); err != nil {
+		return err
+	}
+	if len(in.extents) > extentsInInode {
+		leaves := (len(in.extents) + extentsPerBlock - 1) / extentsPerBlock
+		if leaves > extentsInInode {
+			return fmt.Errorf("ext4: too many extents")
+		}
+		exts, err := l.alloc.alloc(uint32(leaves))
+		if err != nil {
+			return err
+		}
+		for _, e := range exts {
+			for i := uint32(0); i < e.len; i++ {
+				in.leaves = append(in.leaves, e.start+i)
+			}
+		}
+	}
+
+	b, err := encodeXattrs(n.Xattrs)
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		return nil
+	}
+	key := string(b)
+	x := xattrs[key]
+	if x == nil || x.refs >= maxXattrRefs {
+		exts, err := l.alloc.alloc(1)
+		if err != nil {
+			return err
+		}
+		x = &xattrBlock{block: exts[0].start, data: b}
+		xattrs[key] = x
+		l.xattrs = append(l.xattrs, x)
+	}
+	x.refs++
+	in.xattr = x
+	return nil
+}
+
+func fileType(mode fs.FileMode) uint8 {
+	switch mode.Type() {
+	case fs.ModeDir:
+		return ftDir
+	case fs.ModeSymlink:
+		return ftSymlink
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return ftChar
+	case fs.ModeDevice:
+		return ftBlock
+	case fs.ModeNamedPipe:
+		return ftFifo
+	case fs.ModeSocket:
+		return ftSocket
+	}
+	return ftRegular
+}
+
+func unixMode(mode fs.FileMode) uint16 {
+	var m uint16
+	switch fileType(mode) {
+	case ftRegular:
+		m = 0o100000
+	case ftDir:
+		m = 0o040000
+	case ftSymlink:
+		m = 0o120000
+	case ftChar:
+		m = 0o020000
+	case ftBlock:
+		m = 0o060000
+	case ftFifo:
+		m = 0o010000
+	case ftSocket:
+		m = 0o140000
+	}
+	m |= uint16(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	return m
+}
+
+// encodeDir returns the blocks of the linear directory which has ".", ".." and the
+// entries.
+func encodeDir(in *inode) []byte {
+	entries := append([]dirEntry{
+		{name: ".", ino: in.ino, typ: ftDir},
+		{name: "..", ino: in.parent, typ: ftDir},
+	}, in.entries...)
+
+	var b []byte
+	last := -1
+	// closeBlock extends the last entry to the end of the block.
+	closeBlock := func() {
+		end := (last/BlockSize + 1) * BlockSize
+		binary.LittleEndian.PutUint16(b[last+4:], uint16(end-last))
+		b = append(b, make([]byte, end-len(b))...)
+	}
+	for _, e := range entries {
+		recLen := 8 + (len(e.name)+3)&^3
+		if last >= 0 && len(b)-last/BlockSize*BlockSize+recLen > BlockSize {
+			closeBlock()
+		}
+		last = len(b)
+		entry := make([]byte, recLen)
+		binary.LittleEndian.PutUint32(entry[0:], e.ino)
+		binary.LittleEndian.PutUint16(entry[4:], uint16(recLen))
+		entry[6] = uint8(len(e.name))
+		entry[7] = e.typ
+		copy(entry[8:], e.name)
+		b = append(b, entry...)
+	}
+	closeBlock()
+	return b
+}
+
+// emptyDirBlock returns a directory block which has no entries.
+func emptyDirBlock() []byte {
+	b := make([]byte, BlockSize)
+	binary.LittleEndian.PutUint16(b[4:], BlockSize)
+	return b
+}
+
+func (l *layout) write(w io.WriterAt) error {
+	for _, in := range l.inodes {
+		if err := l.writeData(w, in); err != nil {
+			if in.node.Parent == nil {
+				return err
+			}
+			return fmt.Errorf("failed to write %q: %w", in.node.Path(), err)
+		}
+	}
+	for _, x := range l.xattrs {
+		if _, err := w.WriteAt(x.encode(), int64(x.block)*BlockSize); err != nil {
+			return err
+		}
+	}
+	return l.writeMetadata(w)
+}
+
+func (l *layout) writeData(w io.WriterAt, in *inode) error {
+	var r io.Reader
+	switch {
+	case in.data != nil:
+		r = bytes.NewReader(in.data)
+	case in.node.Mode.IsRegular() && in.size > 0:
+		rc, err := in.node.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		r = rc
+	default:
+		return nil
+	}
+	remaining := int64(in.size)
+	buf := make([]byte, copyBufferSize)
+	for _, e := range in.extents {
+		n := min(remaining, int64(e.len)*BlockSize)
+		if err := copySparse(w, int64(e.start)*BlockSize, r, n, buf); err != nil {
+			return err
+		}
+		remaining -= n
+	}
+
+	if in.leaves != nil {
+		for i, block := range in.leaves {
+			exts := in.extents[i*extentsPerBlock:]
+			if len(exts) > extentsPerBlock {
+				exts = exts[:extentsPerBlock]
+			}
+			b := make([]byte, BlockSize)
+			putExtentNode(b, exts, l.logicalBlocks(in, i*extentsPerBlock), extentsPerBlock)
+			if _, err := w.WriteAt(b, int64(block)*BlockSize); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copySparse copies n bytes from r to w at off. The blocks which have only zeros are
+// not written, so that the image is kept sparse.
+func copySparse(w io.WriterAt, off int64, r io.Reader, n int64, buf []byte) error {
+	for n > 0 {
+		b := buf[:min(n, int64(len(buf)))]
+		if _, err := io.ReadFull(r, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		for i := 0; i < len(b); {
+			j := i
+			for j < len(b) && !isZero(b[j:min(j+BlockSize, len(b))]) {
+				j += BlockSize
+			}
+			j = min(j, len(b))
+			if j > i {
+				if _, err := w.WriteAt(b[i:j], off+int64(i)); err != nil {
+					return err
+				}
+			}
+			i = j + BlockSize
+		}
+		off += int64(len(b))
+		n -= int64(len(b))
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// logicalBlocks returns the first logical block of the i-th extent of the inode.
+func (l *layout) logicalBlocks(in *inode, i int) uint32 {
+	var n uint32
+	for _, e := range in.extents[:i] {
+		n += e.len
+	}
+	return n
+}
+
+// putExtentNode puts the extent header and the leaf entries of exts into b.
+// first is the logical block of exts[0].
+func putExtentNode(b []byte, exts []extent, first uint32, capacity int) {
+	putExtentHeader(b, len(exts), capacity, 0)
+	for i, e := range exts {
+		p := b[12+12*i:]
+		binary.LittleEndian.PutUint32(p[0:], first)
+		binary.LittleEndian.PutUint16(p[4:], uint16(e.len))
+		binary.LittleEndian.PutUint32(p[8:], e.start)
+		first += e.len
+	}
+}
+
+func putExtentHeader(b []byte, entries, capacity, depth int) {
+	binary.LittleEndian.PutUint16(b[0:], extentMagic)
+	binary.LittleEndian.PutUint16(b[2:], uint16(entries))
+	binary.LittleEndian.PutUint16(b[4:], uint16(capacity))
+	binary.LittleEndian.PutUint16(b[6:], uint16(depth))
+}
+
+func (l *layout) encodeInode(b []byte, in *inode) {
+	n := in.node
+	le := binary.LittleEndian
+	le.PutUint16(b[0:], unixMode(n.Mode))
+	le.PutUint16(b[2:], uint16(n.UID))
+	le.PutUint16(b[120:], uint16(n.UID>>16))
+	le.PutUint16(b[24:], uint16(n.GID))
+	le.PutUint16(b[122:], uint16(n.GID>>16))
+	le.PutUint32(b[4:], uint32(in.size))
+	le.PutUint32(b[108:], uint32(in.size>>32))
+
+	sec, nsec := n.ModTime.Unix(), n.ModTime.Nanosecond()
+	// The extra fields have the nanoseconds and the epoch bits of the years after 2038.
+	extra := uint32((sec-int64(int32(sec)))>>32)&3 | uint32(nsec)<<2
+	for _, off := range []int{8, 12, 16, 144} { // atime, ctime, mtime and crtime
+		le.PutUint32(b[off:], uint32(sec))
+	}
+	for _, off := range []int{132, 136, 140, 148} {
+		le.PutUint32(b[off:], extra)
+	}
+
+	links := in.links
+	if n.IsDir() {
+		if links = 2 + in.subdirs; links > maxLinks {
+			// dir_nlink allows the directories which have too many subdirectories.
+			links = 1
+		}
+	}
+	le.PutUint16(b[26:], uint16(links))
+
+	blocks := uint32(len(in.leaves))
+	for _, e := range in.extents {
+		blocks += e.len
+	}
+	if in.xattr != nil {
+		blocks++
+		le.PutUint32(b[104:], in.xattr.block)
+	}
+	le.PutUint32(b[28:], blocks*sectorsPerBlock)
+	le.PutUint16(b[128:], extraInodeSize)
+
+	iblock := b[40:100]
+	switch {
+	case n.Mode.Type() == fs.ModeSymlink && in.data == nil:
+		copy(iblock, n.Linkname)
+	case n.Mode.Type()&fs.ModeDevice != 0:
+		if n.DevMajor < 256 && n.DevMinor < 256 {
+			le.PutUint32(iblock[0:], n.DevMajor<<8|n.DevMinor)
+		} else {
+			le.PutUint32(iblock[4:], n.DevMinor&0xff|n.DevMajor<<8|(n.DevMinor&^0xff)<<12)
+		}
+	case n.Mode.Type() == fs.ModeNamedPipe || n.Mode.Type() == fs.ModeSocket:
+	case in.leaves != nil:
+		le.PutUint32(b[32:], inodeFlagExtents)
+		putExtentHeader(iblock, len(in.leaves), extentsInInode, 1)
+		for i, block := range in.leaves {
+			p := iblock[12+12*i:]
+			le.PutUint32(p[0:], l.logicalBlocks(in, i*extentsPerBlock))
+			le.PutUint32(p[4:], block)
+		}
+	default:
+		le.PutUint32(b[32:], inodeFlagExtents)
+		putExtentNode(iblock, in.extents, 0, extentsInInode)
+	}
+}
+
+func (l *layout) writeMetadata(w io.WriterAt) error {
+	geo := l.geo
+	ipg := geo.inodesPerGroup
+	usedInodes := make([]uint32, geo.groups)
+	usedDirs := make([]uint32, geo.groups)
+	// The reserved inodes are used.
+	usedInodes[0] = firstIno - 1
+
+	tables := make(map[uint32][]byte)
+	for _, in := range l.inodes {
+		group, index := (in.ino-1)/ipg, (in.ino-1)%ipg
+		t := tables[group]
+		if need := int(index+1) * inodeSize; len(t) < need {
+			t = append(t, make([]byte, need-len(t))...)
+		}
+		l.encodeInode(t[index*inodeSize:], in)
+		tables[group] = t
+		if in.ino >= firstIno {
+			usedInodes[group] = max(usedInodes[group], index+1)
+		}
+		if in.node.IsDir() {
+			usedDirs[group]++
+		}
+	}
+
+	groups := make([]uint32, 0, len(tables))
+	for group := range tables {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i] < groups[j] })
+	for _, group := range groups {
+		if _, err := w.WriteAt(tables[group], int64(geo.inodeTable(group))*BlockSize); err != nil {
+			return err
+		}
+	}
+
+	gdt := make([]byte, geo.gdtBlocks*BlockSize)
+	var freeBlocks, freeInodes uint64
+	for group := uint32(0); group < geo.groups; group++ {
+		start, n := geo.groupStart(group), geo.groupBlocks(group)
+		used := l.alloc.usedEnd(group) - start
+		// The bits after the end of the group are set as padding.
+		blockBitmap := make([]byte, BlockSize)
+		setBits(blockBitmap, 0, used)
+		setBits(blockBitmap, n, blocksPerGroup)
+		inodeBitmap := make([]byte, BlockSize)
+		setBits(inodeBitmap, 0, usedInodes[group])
+		setBits(inodeBitmap, ipg, 8*BlockSize)
+		if _, err := w.WriteAt(blockBitmap, int64(geo.blockBitmap(group))*BlockSize); err != nil {
+			return err
+		}
+		if _, err := w.WriteAt(inodeBitmap, int64(geo.inodeBitmap(group))*BlockSize); err != nil {
+			return err
+		}
+
+		d := gdt[group*descSize:]
+		binary.LittleEndian.PutUint32(d[0:], geo.blockBitmap(group))
+		binary.LittleEndian.PutUint32(d[4:], geo.inodeBitmap(group))
+		binary.LittleEndian.PutUint32(d[8:], geo.inodeTable(group))
+		binary.LittleEndian.PutUint16(d[12:], uint16(n-used))
+		binary.LittleEndian.PutUint16(d[14:], uint16(ipg-usedInodes[group]))
+		binary.LittleEndian.PutUint16(d[16:], uint16(usedDirs[group]))
+		freeBlocks += uint64(n - used)
+		freeInodes += uint64(ipg - usedInodes[group])
+	}
+
+	for group := uint32(0); group < geo.groups; group++ {
+		if !geo.hasSuper(group) {
+			continue
+		}
+		off := int64(geo.groupStart(group)) * BlockSize
+		sb := l.superblock(group, freeBlocks, freeInodes)
+		if group == 0 {
+			// The first 1024 bytes are the boot sector.
+			off += 1024
+		}
+		if _, err := w.WriteAt(sb, off); err != nil {
+			return err
+		}
+		if _, err := w.WriteAt(gdt, int64(geo.groupStart(group)+1)*BlockSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setBits sets the bits from start to end, exclusive.
+func setBits(b []byte, start, end uint32) {
+	for i := start; i < end; i++ {
+		b[i/8] |= 1 << (i % 8)
+	}
+}
+
+func (l *layout) superblock(group uint32, freeBlocks, freeInodes uint64) []byte {
+	geo := l.geo
+	b := make([]byte, 1024)
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], geo.groups*geo.inodesPerGroup)
+	le.PutUint32(b[4:], geo.blocks)
+	le.PutUint32(b[8:], uint32(uint64(geo.blocks)*reservedPercent/100))
+	le.PutUint32(b[12:], uint32(freeBlocks))
+	le.PutUint32(b[16:], uint32(freeInodes))
+	le.PutUint32(b[20:], 0) // s_first_data_block
+	le.PutUint32(b[24:], 2) // s_log_block_size
+	le.PutUint32(b[28:], 2) // s_log_cluster_size
+	le.PutUint32(b[32:], blocksPerGroup)
+	le.PutUint32(b[36:], blocksPerGroup)
+	le.PutUint32(b[40:], geo.inodesPerGroup)
+	le.PutUint32(b[48:], l.modTime) // s_wtime
+	le.PutUint16(b[54:], 0xffff)    // s_max_mnt_count
+	le.PutUint16(b[56:], 0xef53)    // s_magic
+	le.PutUint16(b[58:], 1)         // s_state: cleanly unmounted
+	le.PutUint16(b[60:], 1)         // s_errors: continue
+	le.PutUint32(b[64:], l.modTime) // s_lastcheck
+	le.PutUint32(b[76:], 1)         // s_rev_level: dynamic
+	le.PutUint32(b[84:], firstIno)
+	le.PutUint16(b[88:], inodeSize)
+	le.PutUint16(b[90:], uint16(group))
+	le.PutUint32(b[92:], compatExtAttr)
+	le.PutUint32(b[96:], incompatFiletype|incompatExtents)
+	le.PutUint32(b[100:], roCompatSparseSuper|roCompatLargeFile|roCompatDirNlink|roCompatExtraIsize)
+	copy(b[104:120], l.uuid[:])
+	copy(b[120:136], l.label)
+	copy(b[236:252], l.hashSeed[:])
+	b[252] = 1                       // s_def_hash_version: half MD4
+	le.PutUint32(b[256:], 0x000c)    // s_default_mount_opts: user_xattr and acl
+	le.PutUint32(b[264:], l.modTime) // s_mkfs_time
+	le.PutUint16(b[348:], extraInodeSize)
+	le.PutUint16(b[350:], extraInodeSize)
+	le.PutUint32(b[352:], 0x0001) // s_flags: signed directory hash
+	return b
+}
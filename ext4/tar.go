@@ -0,0 +1,170 @@
+package ext4
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Code-Hex/vz/v3/internal/fstree"
+	"github.com/Code-Hex/vz/v3/internal/zstd"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// AddTar adds the entries of the tar archive read from r, such as a layer of an OCI
+// or Docker image. The archive may be compressed with gzip or zstd. The layers of an
+// image are added in order from the lowest one.
+//
+// The whiteout files of the layers remove the entries which are added before the
+// archive: ".wh.<name>" removes <name>, and ".wh..wh..opq" removes the entries of its
+// directory. The extended attributes are read from the "SCHILY.xattr." PAX records.
+// The contents of the regular files are stored in a temporary file until Close is
+// called.
+//
+// see: https://github.com/opencontainers/image-spec/blob/main/layer.md
+func (img *Image) AddTar(r io.Reader) error {
+	br := bufio.NewReader(r)
+	src := io.Reader(br)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("failed to decompress gzip: %w", err)
+		}
+		defer zr.Close()
+		src = zr
+	case bytes.Equal(magic, zstdMagic):
+		src = zstd.NewReader(br)
+	}
+
+	tr := tar.NewReader(src)
+	// added has the entries of this archive which are not removed by the whiteouts.
+	added := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the tar archive: %w", err)
+		}
+		if err := img.addTarEntry(tr, hdr, added); err != nil {
+			return fmt.Errorf("failed to add %q: %w", hdr.Name, err)
+		}
+	}
+}
+
+func (img *Image) addTarEntry(r io.Reader, hdr *tar.Header, added map[string]bool) error {
+	name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+	dir, base := path.Split(name)
+	switch {
+	case base == opaqueWhiteout:
+		if d := img.tree.Lookup(dir); d != nil && d.IsDir() {
+			for _, child := range append([]*fstree.Node(nil), d.Children()...) {
+				if added[child.Path()] {
+					continue
+				}
+				if err := img.tree.Remove(child.Path()); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case strings.HasPrefix(base, whiteoutPrefix):
+		if target := path.Join(dir, base[len(whiteoutPrefix):]); !added[target] {
+			return img.tree.Remove(target)
+		}
+		return nil
+	}
+
+	if name == "" {
+		if hdr.Typeflag != tar.TypeDir {
+			return fmt.Errorf("%w: the root is not a directory", ErrInvalidPath)
+		}
+	} else if old := img.tree.Lookup(name); old != nil && old.IsDir() != (hdr.Typeflag == tar.TypeDir) {
+		// The entry of the lower layer is replaced with the other type.
+		if err := img.tree.Remove(name); err != nil {
+			return err
+		}
+	}
+
+	opts := []EntryOption{WithOwner(hdr.Uid, hdr.Gid), WithTimestamp(hdr.ModTime)}
+	for key, value := range hdr.PAXRecords {
+		if attr, ok := strings.CutPrefix(key, paxXattrPrefix); ok {
+			opts = append(opts, WithXattr(attr, []byte(value)))
+		}
+	}
+	mode := hdr.FileInfo().Mode()
+
+	var err error
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		err = img.addSpooledFile(name, r, hdr.Size, mode, opts)
+	case tar.TypeDir:
+		err = img.AddDir(name, mode, opts...)
+	case tar.TypeSymlink:
+		err = img.AddSymlink(name, hdr.Linkname, opts...)
+	case tar.TypeLink:
+		err = img.AddHardlink(name, hdr.Linkname)
+	case tar.TypeChar:
+		err = img.AddCharDevice(name, uint32(hdr.Devmajor), uint32(hdr.Devminor), mode, opts...)
+	case tar.TypeBlock:
+		err = img.AddBlockDevice(name, uint32(hdr.Devmajor), uint32(hdr.Devminor), mode, opts...)
+	case tar.TypeFifo:
+		err = img.AddFifo(name, mode, opts...)
+	default:
+		// The other types, such as the global PAX headers, have no entries.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for p := name; p != "." && p != ""; p = path.Dir(p) {
+		added[p] = true
+	}
+	return nil
+}
+
+// addSpooledFile adds a regular file whose content is copied from r into the spool.
+func (img *Image) addSpooledFile(name string, r io.Reader, size int64, mode fs.FileMode, opts []EntryOption) error {
+	if size == 0 {
+		return img.AddFile(name, nil, mode, opts...)
+	}
+	if img.spool == nil {
+		f, err := os.CreateTemp("", "vz-ext4-*")
+		if err != nil {
+			return err
+		}
+		// The file is unlinked at once, and its space is freed when it is closed.
+		if err := os.Remove(f.Name()); err != nil {
+			f.Close()
+			return err
+		}
+		img.spool, img.spoolSize = f, 0
+	}
+	w := io.NewOffsetWriter(img.spool, img.spoolSize)
+	if _, err := io.CopyN(w, r, size); err != nil {
+		return err
+	}
+	n, err := img.tree.AddFileFromReaderAt(name, io.NewSectionReader(img.spool, img.spoolSize, size), size, mode)
+	img.spoolSize += size
+	if err != nil {
+		return err
+	}
+	apply(n, mode, opts)
+	return nil
+}
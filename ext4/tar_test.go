@@ -0,0 +1,160 @@
+package ext4_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/ext4"
+)
+
+type tarEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+func createTar(t *testing.T, entries []tarEntry, compress bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(&buf)
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.data))
+		hdr.ModTime = testTime
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// listDir returns the names of the entries of the directory except "." and "..".
+func listDir(t *testing.T, path, dir string) []string {
+	t.Helper()
+	var names []string
+	for _, line := range strings.Split(debugfs(t, path, "ls -p "+dir), "\n") {
+		// The line is "/ino/mode/uid/gid/name/size/".
+		fields := strings.Split(line, "/")
+		if len(fields) < 6 || fields[5] == "." || fields[5] == ".." {
+			continue
+		}
+		names = append(names, fields[5])
+	}
+	return names
+}
+
+func TestImageAddTar(t *testing.T) {
+	lower := createTar(t, []tarEntry{
+		{hdr: tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0o755}},
+		{hdr: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		{hdr: tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0o644}, data: "root:x:0:0::/root:/bin/sh\n"},
+		{hdr: tar.Header{Name: "etc/removed", Typeflag: tar.TypeReg, Mode: 0o644}, data: "removed"},
+		{
+			hdr: tar.Header{
+				Name: "usr/bin/tool", Typeflag: tar.TypeReg, Mode: 0o4755, Uid: 1000, Gid: 1000,
+				PAXRecords: map[string]string{"SCHILY.xattr.user.origin": "lower"},
+			},
+			data: "tool",
+		},
+		{hdr: tar.Header{Name: "usr/bin/tool-link", Typeflag: tar.TypeLink, Linkname: "usr/bin/tool"}},
+		{hdr: tar.Header{Name: "usr/bin/sh", Typeflag: tar.TypeSymlink, Linkname: "busybox", Mode: 0o777}},
+		{hdr: tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3, Mode: 0o666}},
+		{hdr: tar.Header{Name: "opaque/old", Typeflag: tar.TypeReg, Mode: 0o644}, data: "old"},
+		{hdr: tar.Header{Name: "conflict", Typeflag: tar.TypeReg, Mode: 0o644}, data: "file"},
+	}, false)
+	upper := createTar(t, []tarEntry{
+		{hdr: tar.Header{Name: "etc/.wh.removed", Typeflag: tar.TypeReg}},
+		{hdr: tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0o600}, data: "upper"},
+		{hdr: tar.Header{Name: "opaque/new", Typeflag: tar.TypeReg, Mode: 0o644}, data: "new"},
+		{hdr: tar.Header{Name: "opaque/.wh..wh..opq", Typeflag: tar.TypeReg}},
+		{hdr: tar.Header{Name: "conflict/", Typeflag: tar.TypeDir, Mode: 0o700}},
+	}, true)
+	zstdLayer, err := os.ReadFile("testdata/layer.tar.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := ext4.NewImage()
+	defer img.Close()
+	for _, layer := range [][]byte{lower, upper, zstdLayer} {
+		if err := img.AddTar(bytes.NewReader(layer)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := createImage(t, img, 16<<20)
+	e2fsck(t, path)
+
+	dirs := map[string][]string{
+		"/":        {"conflict", "dev", "etc", "lost+found", "opaque", "usr"},
+		"/etc":     {"motd", "passwd"},
+		"/opaque":  {"new"},
+		"/usr/bin": {"sh", "tool", "tool-link"},
+	}
+	for dir, want := range dirs {
+		if got := listDir(t, path, dir); !reflect.DeepEqual(want, got) {
+			t.Fatalf("%s: want %q but got %q", dir, want, got)
+		}
+	}
+	cases := []struct {
+		cmd  string
+		want []string
+	}{
+		{cmd: "cat /etc/passwd", want: []string{"upper"}},
+		{cmd: "cat /etc/motd", want: []string{"zstd\n"}},
+		{cmd: "stat /etc/passwd", want: []string{"Mode:  0600", "mtime: 0x65937d25"}},
+		{cmd: "stat /usr/bin/tool", want: []string{"Mode:  04755", "User:  1000   Group:  1000", "Links: 2", "user.origin (5) = \"lower\""}},
+		{cmd: "stat /usr/bin/sh", want: []string{"Fast link dest: \"busybox\""}},
+		{cmd: "stat /dev/null", want: []string{"Type: character", "Mode:  0666", "01:03"}},
+		{cmd: "stat /conflict", want: []string{"Type: directory", "Mode:  0700"}},
+	}
+	for _, tc := range cases {
+		got := debugfs(t, path, tc.cmd)
+		for _, want := range tc.want {
+			if !strings.Contains(got, want) {
+				t.Fatalf("%s: want %q but got:\n%s", tc.cmd, want, got)
+			}
+		}
+	}
+}
+
+func TestImageAddTarError(t *testing.T) {
+	img := ext4.NewImage()
+	defer img.Close()
+	b := createTar(t, []tarEntry{
+		{hdr: tar.Header{Name: "a", Typeflag: tar.TypeReg, Mode: 0o644}, data: strings.Repeat("a", 1024)},
+	}, false)
+	// Drop the end of the content and the trailer of 1024 bytes.
+	truncated := b[:len(b)-1024-512]
+	if err := img.AddTar(bytes.NewReader(truncated)); err == nil {
+		t.Fatal("want error for the truncated archive")
+	}
+	link := createTar(t, []tarEntry{
+		{hdr: tar.Header{Name: "b", Typeflag: tar.TypeLink, Linkname: "missing"}},
+	}, false)
+	if err := img.AddTar(bytes.NewReader(link)); err == nil {
+		t.Fatal("want error for the missing hard link target")
+	}
+}
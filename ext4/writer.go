@@ -0,0 +1,283 @@
+// Package ext4 writes ext4 file system images for the root file systems of Linux
+// guests, without mkfs.ext4 and root privileges.
+//
+// The images use the extents and do not have the journal, the metadata checksums and
+// the hashed directory indexes. The Linux kernel mounts them read-write and e2fsck
+// accepts them as clean.
+//
+// see: https://www.kernel.org/doc/html/latest/filesystems/ext4/index.html
+package ext4
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/internal/fstree"
+)
+
+// BlockSize is the size of a block of ext4 images.
+const BlockSize = 4096
+
+var (
+	// ErrInvalidPath is returned when the path of an entry is invalid.
+	ErrInvalidPath = fstree.ErrInvalidPath
+
+	// ErrNoSpace is returned when the entries do not fit in the image of the
+	// specified size.
+	ErrNoSpace = errors.New("ext4: no space left in the image")
+)
+
+// Image is a set of files, directories, symbolic links, hard links and special files
+// which are written as an ext4 image.
+//
+// The image is reproducible: the entries are sorted by name, the inode numbers and
+// the blocks are assigned in that order, the timestamps are those of the entries, and
+// the UUID is derived from the label and the entries unless it is specified. The
+// parent directories which are not added explicitly are created with the mode 0755
+// and owned by root. The "lost+found" directory is created if it is not added.
+type Image struct {
+	tree    *fstree.Tree
+	label   string
+	uuid    [16]byte
+	hasUUID bool
+	modTime time.Time
+
+	// spool holds the contents of the files in the added tar archives.
+	spool     *os.File
+	spoolSize int64
+}
+
+// ImageOption is an option for NewImage.
+type ImageOption func(*Image)
+
+// WithLabel sets the volume label, such as "rootfs". The label is truncated to 16
+// bytes.
+func WithLabel(label string) ImageOption {
+	return func(img *Image) {
+		img.label = label
+		if len(img.label) > 16 {
+			img.label = img.label[:16]
+		}
+	}
+}
+
+// WithUUID sets the UUID of the file system which is used in "root=UUID=...".
+func WithUUID(uuid [16]byte) ImageOption {
+	return func(img *Image) {
+		img.uuid = uuid
+		img.hasUUID = true
+	}
+}
+
+// WithModTime sets the timestamps of the entries which are added without
+// WithTimestamp, the implicit parent directories and the file system. The default is
+// the Unix epoch.
+func WithModTime(t time.Time) ImageOption {
+	return func(img *Image) {
+		img.modTime = t
+	}
+}
+
+// NewImage creates a new empty Image.
+func NewImage(opts ...ImageOption) *Image {
+	img := &Image{
+		modTime: time.Unix(0, 0),
+	}
+	for _, opt := range opts {
+		opt(img)
+	}
+	img.tree = fstree.New(img.modTime)
+	return img
+}
+
+// Close removes the temporary file which holds the contents of the files in the
+// added tar archives. The image can not be written after it is closed.
+func (img *Image) Close() error {
+	if img.spool == nil {
+		return nil
+	}
+	err := img.spool.Close()
+	img.spool = nil
+	return err
+}
+
+// EntryOption is an option for an entry of Image.
+type EntryOption func(*fstree.Node)
+
+// WithOwner sets the owner of the entry. The default is root (0:0).
+func WithOwner(uid, gid int) EntryOption {
+	return func(n *fstree.Node) {
+		n.UID = uid
+		n.GID = gid
+	}
+}
+
+// WithTimestamp sets the modification time of the entry, which is also used as the
+// access, change and creation times.
+func WithTimestamp(t time.Time) EntryOption {
+	return func(n *fstree.Node) {
+		n.ModTime = t
+	}
+}
+
+// WithXattr adds an extended attribute to the entry, such as "security.capability".
+// The attributes whose names do not start with "user.", "trusted.", "security." or
+// "system." are ignored. The POSIX ACLs ("system.posix_acl_access" and
+// "system.posix_acl_default") are in the format of getxattr(2).
+func WithXattr(name string, value []byte) EntryOption {
+	return func(n *fstree.Node) {
+		if n.Xattrs == nil {
+			n.Xattrs = make(map[string][]byte)
+		}
+		n.Xattrs[name] = value
+	}
+}
+
+// modeBits are the bits of fs.FileMode which are recorded in addition to the type.
+const modeBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+func apply(n *fstree.Node, mode fs.FileMode, opts []EntryOption) {
+	n.Mode = n.Mode.Type() | mode&modeBits
+	for _, opt := range opts {
+		opt(n)
+	}
+}
+
+// AddFile adds a regular file which has the data. An entry which has the same name
+// is replaced. mode may have fs.ModeSetuid, fs.ModeSetgid and fs.ModeSticky in
+// addition to the permission bits.
+func (img *Image) AddFile(name string, data []byte, mode fs.FileMode, opts ...EntryOption) error {
+	n, err := img.tree.AddFile(name, data, mode)
+	if err != nil {
+		return err
+	}
+	apply(n, mode, opts)
+	return nil
+}
+
+// AddFileFromPath adds a regular file whose content is read from the file at src on
+// the host when the image is written. The mode is used instead of the mode of src.
+func (img *Image) AddFileFromPath(name, src string, mode fs.FileMode, opts ...EntryOption) error {
+	n, err := img.tree.AddFileFromPath(name, src, mode)
+	if err != nil {
+		return err
+	}
+	apply(n, mode, opts)
+	return nil
+}
+
+// AddDir adds a directory. If the directory already exists, its attributes are
+// updated and its entries are kept. The name "/" refers to the root directory.
+func (img *Image) AddDir(name string, mode fs.FileMode, opts ...EntryOption) error {
+	n := img.tree.Root()
+	if cleaned, err := fstree.Clean(name); err == nil {
+		if n, err = img.tree.AddDir(cleaned, mode); err != nil {
+			return err
+		}
+	}
+	// The attributes of the existing directory are replaced.
+	n.UID, n.GID, n.ModTime, n.Xattrs = 0, 0, img.modTime, nil
+	apply(n, mode, opts)
+	return nil
+}
+
+// AddSymlink adds a symbolic link which points to target.
+func (img *Image) AddSymlink(name, target string, opts ...EntryOption) error {
+	if len(target) >= BlockSize {
+		return fmt.Errorf("%w: symbolic link target is too long", ErrInvalidPath)
+	}
+	n, err := img.tree.AddSymlink(name, target)
+	if err != nil {
+		return err
+	}
+	apply(n, 0o777, opts)
+	return nil
+}
+
+// AddHardlink adds a hard link to the existing entry target, which must not be a
+// directory. The hard link shares the content and the attributes of target.
+func (img *Image) AddHardlink(name, target string) error {
+	_, err := img.tree.AddHardlink(name, target)
+	return err
+}
+
+// AddCharDevice adds a character device node, such as "dev/console" (5, 1).
+func (img *Image) AddCharDevice(name string, major, minor uint32, mode fs.FileMode, opts ...EntryOption) error {
+	return img.addSpecialFile(name, fs.ModeDevice|fs.ModeCharDevice, major, minor, mode, opts)
+}
+
+// AddBlockDevice adds a block device node.
+func (img *Image) AddBlockDevice(name string, major, minor uint32, mode fs.FileMode, opts ...EntryOption) error {
+	return img.addSpecialFile(name, fs.ModeDevice, major, minor, mode, opts)
+}
+
+// AddFifo adds a named pipe.
+func (img *Image) AddFifo(name string, mode fs.FileMode, opts ...EntryOption) error {
+	return img.addSpecialFile(name, fs.ModeNamedPipe, 0, 0, mode, opts)
+}
+
+// AddSocket adds a Unix domain socket.
+func (img *Image) AddSocket(name string, mode fs.FileMode, opts ...EntryOption) error {
+	return img.addSpecialFile(name, fs.ModeSocket, 0, 0, mode, opts)
+}
+
+func (img *Image) addSpecialFile(name string, typ fs.FileMode, major, minor uint32, mode fs.FileMode, opts []EntryOption) error {
+	n, err := img.tree.AddSpecialFile(name, typ|mode.Perm(), major, minor)
+	if err != nil {
+		return err
+	}
+	apply(n, mode, opts)
+	return nil
+}
+
+// Remove removes the entry of name and its descendants. It does nothing if the entry
+// does not exist.
+func (img *Image) Remove(name string) error {
+	return img.tree.Remove(name)
+}
+
+// WriteImage writes the file system of size bytes to w. The size is rounded down to
+// the block size.
+//
+// Only the used areas are written, so w must read as zeros at first, like a new
+// image created by vz.CreateDiskImage. WriteFile satisfies it for existing images.
+func (img *Image) WriteImage(w io.WriterAt, size int64) error {
+	l, err := img.layout(size)
+	if err != nil {
+		return err
+	}
+	return l.write(w)
+}
+
+// WriteFile writes the file system to the disk image at path, such as the one created
+// by vz.CreateDiskImage. The file system fills the whole image and the existing
+// content is discarded.
+func (img *Image) WriteFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// Truncate the image to zero it without losing its sparseness.
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if err := f.Truncate(fi.Size()); err != nil {
+		return err
+	}
+	if err := img.WriteImage(f, fi.Size()); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
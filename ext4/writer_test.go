@@ -0,0 +1,298 @@
+package ext4_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/ext4"
+)
+
+var testTime = time.Date(2024, 1, 2, 3, 4, 5, 600, time.UTC)
+
+// createImage writes img to a new sparse image of size bytes like vz.CreateDiskImage.
+func createImage(t *testing.T, img *ext4.Image, size int64) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rootfs.img")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, size); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// e2fsck checks the image with e2fsck of e2fsprogs if it is installed.
+func e2fsck(t *testing.T, path string) {
+	t.Helper()
+	if _, err := exec.LookPath("e2fsck"); err != nil {
+		t.Log("e2fsck is not installed")
+		return
+	}
+	out, err := exec.Command("e2fsck", "-fn", path).CombinedOutput()
+	if err != nil {
+		t.Fatalf("e2fsck: %v\n%s", err, out)
+	}
+}
+
+// debugfs runs the command of debugfs of e2fsprogs. It skips the test if debugfs is
+// not installed.
+func debugfs(t *testing.T, path, cmd string) string {
+	t.Helper()
+	if _, err := exec.LookPath("debugfs"); err != nil {
+		t.Skip("debugfs is not installed")
+	}
+	out, err := exec.Command("debugfs", "-R", cmd, path).Output()
+	if err != nil {
+		t.Fatalf("debugfs %q: %v", cmd, err)
+	}
+	return string(out)
+}
+
+func readSuperblock(t *testing.T, path string) []byte {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, 1024)
+	if _, err := f.ReadAt(b, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if magic := binary.LittleEndian.Uint16(b[56:]); magic != 0xef53 {
+		t.Fatalf("want the ext4 magic but got %#x", magic)
+	}
+	return b
+}
+
+func TestImage(t *testing.T) {
+	img := ext4.NewImage(ext4.WithLabel("rootfs"), ext4.WithModTime(testTime))
+	defer img.Close()
+	capability := []byte{1, 0, 0, 2, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	big := bytes.Repeat([]byte("0123456789abcdef"), 1<<18)
+	steps := []error{
+		img.AddFile("etc/hostname", []byte("vm\n"), 0o644),
+		img.AddFile("usr/bin/ping", big, fs.ModeSetuid|0o755,
+			ext4.WithOwner(1000, 100000),
+			ext4.WithXattr("security.capability", capability),
+			ext4.WithXattr("com.apple.provenance", []byte("ignored"))),
+		img.AddHardlink("usr/bin/ping6", "usr/bin/ping"),
+		img.AddSymlink("bin", "usr/bin"),
+		img.AddSymlink("long", strings.Repeat("a/", 100)),
+		img.AddCharDevice("dev/console", 5, 1, 0o600),
+		img.AddBlockDevice("dev/nvme0n1p1", 259, 1000, 0o660, ext4.WithOwner(0, 6)),
+		img.AddFifo("run/initctl", 0o600),
+		img.AddDir("tmp", fs.ModeSticky|0o777, ext4.WithTimestamp(time.Unix(1<<33, 0))),
+		img.AddDir("/", 0o750),
+	}
+	for i := 0; i < 300; i++ {
+		steps = append(steps, img.AddFile(strings.Repeat("x", 200)+"/"+time.Duration(i).String(), nil, 0o644,
+			ext4.WithXattr("user.index", []byte{byte(i % 2)})))
+	}
+	for i, err := range steps {
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+	}
+	path := createImage(t, img, 64<<20)
+	e2fsck(t, path)
+
+	sb := readSuperblock(t, path)
+	if label := string(bytes.TrimRight(sb[120:136], "\x00")); label != "rootfs" {
+		t.Fatalf("want label %q but got %q", "rootfs", label)
+	}
+	if blocks := binary.LittleEndian.Uint32(sb[4:]); blocks != 64<<20/ext4.BlockSize {
+		t.Fatalf("want %d blocks but got %d", 64<<20/ext4.BlockSize, blocks)
+	}
+
+	cases := []struct {
+		cmd  string
+		want []string
+	}{
+		{cmd: "cat /etc/hostname", want: []string{"vm\n"}},
+		{cmd: "stat /", want: []string{"Mode:  0750", "Links: 9"}},
+		{
+			cmd: "stat /usr/bin/ping",
+			want: []string{
+				"Mode:  04755", "User:  1000   Group: 100000", "Links: 2", "Size: 4194304",
+				"security.capability (20)", "mtime: 0x65937d25:00000960",
+			},
+		},
+		{cmd: "stat /bin", want: []string{"Fast link dest: \"usr/bin\""}},
+		{cmd: "stat /long", want: []string{"Size: 200", "EXTENTS"}},
+		{cmd: "stat /dev/console", want: []string{"Type: character", "Device major/minor number: 05:01"}},
+		{cmd: "stat /dev/nvme0n1p1", want: []string{"Type: block", "Group:     6", "major/minor number: 259:1000"}},
+		{cmd: "stat /run/initctl", want: []string{"Type: FIFO", "Mode:  0600"}},
+		{cmd: "stat /tmp", want: []string{"Mode:  01777", "mtime: 0x00000000:00000002"}},
+		{cmd: "stat /lost+found", want: []string{"Mode:  0700", "Size: 16384"}},
+		{cmd: "ea_list /" + strings.Repeat("x", 200) + "/299ns", want: []string{"user.index (1) = 01"}},
+	}
+	for _, tc := range cases {
+		got := debugfs(t, path, tc.cmd)
+		for _, want := range tc.want {
+			if !strings.Contains(got, want) {
+				t.Fatalf("%s: want %q but got:\n%s", tc.cmd, want, got)
+			}
+		}
+	}
+	if got := debugfs(t, path, "cat /usr/bin/ping6"); got != string(big) {
+		t.Fatalf("want the content of the hard link but got %d bytes", len(got))
+	}
+	if got := debugfs(t, path, "stat /usr/bin/ping"); strings.Contains(got, "com.apple") {
+		t.Fatalf("want the unsupported attribute to be ignored but got:\n%s", got)
+	}
+}
+
+func TestImageLargeFile(t *testing.T) {
+	// The file spans more than 4 block groups, so the extents do not fit in the inode.
+	src := filepath.Join(t.TempDir(), "large")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const size = 5 * 32768 * ext4.BlockSize
+	if _, err := f.WriteAt([]byte("tail"), size-4); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	img := ext4.NewImage()
+	if err := img.AddFileFromPath("large", src, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path := createImage(t, img, 1<<30)
+	e2fsck(t, path)
+	if got := debugfs(t, path, "stat /large"); !strings.Contains(got, "(ETB0)") {
+		t.Fatalf("want the extent tree but got:\n%s", got)
+	}
+	out := debugfs(t, path, fmt.Sprintf("bmap /large %d", size/ext4.BlockSize-1))
+	block, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if f, err = os.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.ReadAt(b, (block+1)*ext4.BlockSize-4); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "tail" {
+		t.Fatalf("want the last block of the file but got %q", b)
+	}
+
+	// The blocks which have only zeros are not written.
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Blocks*512 >= size {
+		t.Fatalf("want the sparse image but %d bytes are allocated", st.Blocks*512)
+	}
+}
+
+func TestImageReproducible(t *testing.T) {
+	build := func(opts ...ext4.ImageOption) []byte {
+		img := ext4.NewImage(append([]ext4.ImageOption{ext4.WithLabel("rootfs")}, opts...)...)
+		for _, name := range []string{"b", "a/c", "a/b"} {
+			if err := img.AddFile(name, []byte(name), 0o644, ext4.WithXattr("user.name", []byte(name))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b, err := os.ReadFile(createImage(t, img, 8<<20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	first, second := build(), build()
+	if sha256.Sum256(first) != sha256.Sum256(second) {
+		t.Fatal("want the same images")
+	}
+
+	uuid := [16]byte{0: 0x12, 15: 0x34}
+	b := build(ext4.WithUUID(uuid))
+	if got := b[1024+104 : 1024+120]; !bytes.Equal(uuid[:], got) {
+		t.Fatalf("want UUID %x but got %x", uuid, got)
+	}
+	if derived := first[1024+104 : 1024+120]; derived[6]>>4 != 4 || derived[8]>>6 != 2 {
+		t.Fatalf("want the version 4 UUID but got %x", derived)
+	}
+}
+
+func TestImageNoSpace(t *testing.T) {
+	cases := []struct {
+		name string
+		size int64
+		data int
+	}{
+		{name: "too small", size: 64 << 10, data: 0},
+		{name: "large file", size: 4 << 20, data: 4 << 20},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			img := ext4.NewImage()
+			if err := img.AddFile("data", make([]byte, tc.data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "rootfs.img")
+			if err := os.WriteFile(path, make([]byte, tc.size), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if err := img.WriteFile(path); !errors.Is(err, ext4.ErrNoSpace) {
+				t.Fatalf("want %v but got %v", ext4.ErrNoSpace, err)
+			}
+		})
+	}
+}
+
+func TestImageInvalidPath(t *testing.T) {
+	img := ext4.NewImage()
+	if err := img.AddFile("a", nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cases := []error{
+		img.AddFile("/", nil, 0o644),
+		img.AddHardlink("b", "missing"),
+		img.AddHardlink("b", "/"),
+		img.AddSymlink("c", strings.Repeat("a", ext4.BlockSize)),
+	}
+	for i, err := range cases {
+		if !errors.Is(err, ext4.ErrInvalidPath) {
+			t.Fatalf("%d: want %v but got %v", i, ext4.ErrInvalidPath, err)
+		}
+	}
+
+	if err := img.AddFile(strings.Repeat("a", 256), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "rootfs.img")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, 8<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.WriteFile(path); !errors.Is(err, ext4.ErrInvalidPath) {
+		t.Fatalf("want %v but got %v", ext4.ErrInvalidPath, err)
+	}
+}
@@ -0,0 +1,189 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	xattrMagic      = 0xea020000
+	xattrHeaderSize = 32
+	xattrEntrySize  = 16
+
+	// maxXattrRefs is the maximum number of the inodes which share an extended
+	// attribute block, which is the same as the Linux kernel.
+	maxXattrRefs = 1024
+)
+
+// xattrPrefixes are the name indexes of the extended attributes. The full names
+// are listed before the prefixes which match them.
+var xattrPrefixes = []struct {
+	index  uint8
+	prefix string
+}{
+	{2, "system.posix_acl_access"},
+	{3, "system.posix_acl_default"},
+	{1, "user."},
+	{4, "trusted."},
+	{6, "security."},
+	{7, "system."},
+}
+
+// xattrIndex returns the name index and the rest of the name. It reports false if
+// the namespace of the name is not supported.
+func xattrIndex(name string) (uint8, string, bool) {
+	for _, p := range xattrPrefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			suffix := name[len(p.prefix):]
+			if p.index == 2 || p.index == 3 {
+				if suffix != "" {
+					continue
+				}
+			} else if suffix == "" {
+				return 0, "", false
+			}
+			return p.index, suffix, true
+		}
+	}
+	return 0, "", false
+}
+
+// xattrBlock is an extended attribute block which is shared by the inodes which have
+// the same attributes.
+type xattrBlock struct {
+	block uint32
+	refs  uint32
+	// data is the content of the block without the reference count.
+	data []byte
+}
+
+func (x *xattrBlock) encode() []byte {
+	b := append([]byte(nil), x.data...)
+	binary.LittleEndian.PutUint32(b[4:], x.refs)
+	return b
+}
+
+type xattr struct {
+	index uint8
+	name  string
+	value []byte
+}
+
+// encodeXattrs returns the extended attribute block of the attributes, or nil if
+// there are no attributes to record.
+//
+// see: https://www.kernel.org/doc/html/latest/filesystems/ext4/attributes.html
+func encodeXattrs(attrs map[string][]byte) ([]byte, error) {
+	var xattrs []xattr
+	for name, value := range attrs {
+		index, suffix, ok := xattrIndex(name)
+		if !ok {
+			continue
+		}
+		if index == 2 || index == 3 {
+			var err error
+			if value, err = convertACL(value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+		xattrs = append(xattrs, xattr{index: index, name: suffix, value: value})
+	}
+	if len(xattrs) == 0 {
+		return nil, nil
+	}
+	// The entries are sorted like the Linux kernel to look up them.
+	sort.Slice(xattrs, func(i, j int) bool {
+		a, b := xattrs[i], xattrs[j]
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		if len(a.name) != len(b.name) {
+			return len(a.name) < len(b.name)
+		}
+		return a.name < b.name
+	})
+
+	b := make([]byte, BlockSize)
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], xattrMagic)
+	le.PutUint32(b[8:], 1) // h_blocks
+	off, valueOff := xattrHeaderSize, BlockSize
+	var blockHash uint32
+	hashed := true
+	for _, x := range xattrs {
+		entryLen := (xattrEntrySize + len(x.name) + 3) &^ 3
+		valueLen := (len(x.value) + 3) &^ 3
+		// The entries are followed by the 4 bytes terminator.
+		if off+entryLen+4 > valueOff-valueLen || len(x.name) > 255 {
+			return nil, fmt.Errorf("ext4: extended attributes are too large")
+		}
+		e := b[off:]
+		e[0] = uint8(len(x.name))
+		e[1] = x.index
+		if len(x.value) > 0 {
+			valueOff -= valueLen
+			copy(b[valueOff:], x.value)
+			le.PutUint16(e[2:], uint16(valueOff))
+		}
+		le.PutUint32(e[8:], uint32(len(x.value)))
+		hash := xattrHash(x.name, b[valueOff:valueOff+valueLen])
+		le.PutUint32(e[12:], hash)
+		copy(e[xattrEntrySize:], x.name)
+		off += entryLen
+		blockHash = blockHash<<16 ^ blockHash>>16 ^ hash
+		hashed = hashed && hash != 0
+	}
+	if hashed {
+		le.PutUint32(b[12:], blockHash)
+	}
+	return b, nil
+}
+
+// xattrHash returns the hash of the entry, where value is padded to 4 bytes.
+func xattrHash(name string, value []byte) uint32 {
+	var hash uint32
+	for i := 0; i < len(name); i++ {
+		// The name is hashed as signed chars.
+		hash = hash<<5 ^ hash>>27 ^ uint32(int32(int8(name[i])))
+	}
+	for i := 0; i+4 <= len(value); i += 4 {
+		hash = hash<<16 ^ hash>>16 ^ binary.LittleEndian.Uint32(value[i:])
+	}
+	return hash
+}
+
+// Tags of the POSIX ACL entries.
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+// convertACL converts the POSIX ACL in the format of getxattr(2), which has the
+// version 2, into the format of ext4, which has the version 1 and omits the IDs of
+// the entries which do not need them.
+func convertACL(b []byte) ([]byte, error) {
+	le := binary.LittleEndian
+	if len(b) < 4 || (len(b)-4)%8 != 0 || le.Uint32(b) != 2 {
+		return nil, fmt.Errorf("unsupported format")
+	}
+	out := le.AppendUint32(nil, 1)
+	for p := b[4:]; len(p) > 0; p = p[8:] {
+		tag := le.Uint16(p[0:])
+		out = le.AppendUint16(out, tag)
+		out = le.AppendUint16(out, le.Uint16(p[2:]))
+		switch tag {
+		case aclUser, aclGroup:
+			out = le.AppendUint32(out, le.Uint32(p[4:]))
+		case aclUserObj, aclGroupObj, aclMask, aclOther:
+		default:
+			return nil, fmt.Errorf("unknown tag %#x", tag)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,960 @@
+// Package fat writes FAT file system images.
+//
+// see: https://academy.cba.mit.edu/classes/networking_communications/SD/FAT.pdf
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/Code-Hex/vz/v3/internal/fstree"
+)
+
+// SectorSize is the size of a sector of FAT images.
+const SectorSize = 512
+
+var (
+	// ErrInvalidPath is returned when the path of an entry is invalid.
+	ErrInvalidPath = fstree.ErrInvalidPath
+
+	// ErrNoSpace is returned when the entries do not fit in the image of the
+	// specified size.
+	ErrNoSpace = errors.New("fat: no space left in the image")
+)
+
+// Type is the type of the FAT file system which is determined by the number of
+// clusters.
+type Type int
+
+const (
+	// FAT12 is the file system which has less than 4085 clusters.
+	FAT12 Type = 12
+	// FAT16 is the file system which has less than 65525 clusters.
+	FAT16 Type = 16
+	// FAT32 is the file system which has 65525 or more clusters. The EFI System
+	// Partition should be FAT32.
+	FAT32 Type = 32
+)
+
+func (t Type) String() string {
+	return "FAT" + strconv.Itoa(int(t))
+}
+
+const (
+	maxFAT12Clusters = 4084
+	maxFAT16Clusters = 65524
+
+	numFATs      = 2
+	dirEntrySize = 32
+	mediaFixed   = 0xf8
+
+	// sizeUnit is the unit of the image size which is determined automatically.
+	sizeUnit = 1 << 20
+	// minFAT32Size is the smallest multiple of sizeUnit which has enough clusters
+	// for FAT32 with the cluster size of a sector.
+	minFAT32Size = 33 << 20
+)
+
+// Sectors of the reserved region of FAT32.
+const (
+	fat32ReservedSectors = 32
+	fsInfoSector         = 1
+	backupBootSector     = 6
+	rootCluster          = 2
+)
+
+// Attributes of directory entries.
+const (
+	attrReadOnly = 0x01
+	attrVolumeID = 0x08
+	attrDir      = 0x10
+	attrArchive  = 0x20
+	attrLongName = 0x0f
+)
+
+// Image is a set of files and directories which are written as a FAT image.
+//
+// Names which are not valid upper case 8.3 names are recorded as VFAT long file
+// names with generated short names such as "USER-D~1".
+//
+// The image is reproducible: the entries are sorted by name, the timestamps are fixed,
+// and the volume serial number is derived from the label and the entries unless it is
+// specified. The parent directories which are not added explicitly are created.
+type Image struct {
+	tree      *fstree.Tree
+	label     string
+	size      int64
+	modTime   time.Time
+	serial    uint32
+	hasSerial bool
+	typ       Type
+}
+
+// ImageOption is an option for NewImage.
+type ImageOption func(*Image)
+
+// WithLabel sets the volume label, such as "CIDATA". The label is converted to upper
+// case and truncated to 11 bytes.
+func WithLabel(label string) ImageOption {
+	return func(img *Image) {
+		img.label = strings.ToUpper(label)
+		if len(img.label) > 11 {
+			img.label = img.label[:11]
+		}
+	}
+}
+
+// WithSize sets the size of the image in bytes, which is rounded up to the sector
+// size. By default, the size is the smallest multiple of 1 MiB which can hold the
+// entries.
+func WithSize(size int64) ImageOption {
+	return func(img *Image) {
+		img.size = size
+	}
+}
+
+// WithModTime sets the timestamps of all entries. The default is 1980-01-01 which is
+// the earliest time of FAT. The earlier times are recorded as 1980-01-01.
+func WithModTime(t time.Time) ImageOption {
+	return func(img *Image) {
+		img.modTime = t
+	}
+}
+
+// WithSerialNumber sets the volume serial number.
+func WithSerialNumber(serial uint32) ImageOption {
+	return func(img *Image) {
+		img.serial = serial
+		img.hasSerial = true
+	}
+}
+
+// WithType sets the type of the file system. By default, FAT12 or FAT16 is used
+// according to the number of clusters, and FAT32 is used only when the image is too
+// large for FAT16. The image of FAT32 is at least 33 MiB to have 65525 clusters.
+func WithType(typ Type) ImageOption {
+	return func(img *Image) {
+		img.typ = typ
+	}
+}
+
+// NewImage creates a new empty Image.
+func NewImage(opts ...ImageOption) *Image {
+	img := &Image{
+		modTime: time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for _, opt := range opts {
+		opt(img)
+	}
+	img.tree = fstree.New(img.modTime)
+	return img
+}
+
+// AddFile adds a regular file which has the data. A file which has the same name is
+// replaced. The file is read-only if perm does not have the write permission of the
+// owner.
+func (img *Image) AddFile(name string, data []byte, perm fs.FileMode) error {
+	_, err := img.tree.AddFile(name, data, perm)
+	return err
+}
+
+// AddFileFromPath adds a regular file whose content is read from the file at src on
+// the host when the image is written.
+func (img *Image) AddFileFromPath(name, src string, perm fs.FileMode) error {
+	_, err := img.tree.AddFileFromPath(name, src, perm)
+	return err
+}
+
+// AddDir adds a directory.
+func (img *Image) AddDir(name string) error {
+	_, err := img.tree.AddDir(name, 0o755)
+	return err
+}
+
+// geometry is the layout of the file system.
+type geometry struct {
+	typ               Type
+	totalSectors      uint32
+	sectorsPerCluster uint32
+	fatSectors        uint32
+	rootEntries       uint32
+	clusters          uint32
+}
+
+func (g *geometry) clusterSize() uint32 {
+	return g.sectorsPerCluster * SectorSize
+}
+
+func (g *geometry) reservedSectors() uint32 {
+	if g.typ == FAT32 {
+		return fat32ReservedSectors
+	}
+	return 1
+}
+
+func (g *geometry) rootDirSectors() uint32 {
+	return g.rootEntries * dirEntrySize / SectorSize
+}
+
+func (g *geometry) dataSector() uint32 {
+	return g.reservedSectors() + numFATs*g.fatSectors + g.rootDirSectors()
+}
+
+// newGeometry returns the geometry of the image which has totalSectors. For FAT12
+// and FAT16, it uses the smallest cluster size which gives the type. If typ is zero,
+// the type is determined by the number of clusters, and FAT32 is used only when the
+// image is too large for FAT16.
+func newGeometry(totalSectors, rootEntries uint32, typ Type) (*geometry, error) {
+	if typ == FAT32 {
+		return newFAT32Geometry(totalSectors)
+	}
+	for spc := uint32(1); spc <= 128; spc *= 2 {
+		g := &geometry{
+			totalSectors:      totalSectors,
+			sectorsPerCluster: spc,
+			rootEntries:       rootEntries,
+		}
+		if err := g.fit(); err != nil {
+			return nil, err
+		}
+		if g.clusters > maxFAT16Clusters || (typ != 0 && g.typ != typ) {
+			continue
+		}
+		return g, nil
+	}
+	switch typ {
+	case 0:
+		return newFAT32Geometry(totalSectors)
+	case FAT12, FAT16:
+		return nil, fmt.Errorf("fat: the image of %d sectors cannot be %s", totalSectors, typ)
+	}
+	return nil, fmt.Errorf("fat: unsupported type %d", typ)
+}
+
+// newFAT32Geometry returns the geometry of FAT32 which has the cluster size
+// recommended by Microsoft for the size of the image.
+func newFAT32Geometry(totalSectors uint32) (*geometry, error) {
+	g := &geometry{typ: FAT32, totalSectors: totalSectors}
+	switch {
+	case totalSectors <= 532480: // 260 MiB
+		g.sectorsPerCluster = 1
+	case totalSectors <= 16777216: // 8 GiB
+		g.sectorsPerCluster = 8
+	case totalSectors <= 33554432: // 16 GiB
+		g.sectorsPerCluster = 16
+	case totalSectors <= 67108864: // 32 GiB
+		g.sectorsPerCluster = 32
+	default:
+		g.sectorsPerCluster = 64
+	}
+	if err := g.fit(); err != nil {
+		return nil, err
+	}
+	if g.clusters <= maxFAT16Clusters {
+		return nil, fmt.Errorf("%w: the image of %d sectors is too small for FAT32", ErrNoSpace, totalSectors)
+	}
+	return g, nil
+}
+
+// fit determines the size of the FAT and the number of clusters. The type is also
+// determined unless it is FAT32.
+func (g *geometry) fit() error {
+	g.fatSectors = 1
+	for {
+		meta := g.dataSector()
+		if meta >= g.totalSectors {
+			return ErrNoSpace
+		}
+		g.clusters = (g.totalSectors - meta) / g.sectorsPerCluster
+		if g.typ != FAT32 {
+			g.typ = FAT16
+			if g.clusters <= maxFAT12Clusters {
+				g.typ = FAT12
+			}
+		}
+		fatBytes := ((g.clusters+2)*uint32(g.typ) + 7) / 8
+		need := (fatBytes + SectorSize - 1) / SectorSize
+		if need <= g.fatSectors {
+			return nil
+		}
+		g.fatSectors = need
+	}
+}
+
+// dirent is an entry of a directory.
+type dirent struct {
+	node      *fstree.Node
+	shortName [11]byte
+	// long is the VFAT long file name entries in the order on the disk.
+	long    [][dirEntrySize]byte
+	cluster uint32
+}
+
+type dir struct {
+	node    *fstree.Node
+	entries []*dirent
+	cluster uint32
+	// parent is nil for the root directory.
+	parent *dir
+}
+
+func (d *dir) size() uint32 {
+	n := uint32(len(d.entries))
+	if d.parent != nil {
+		n += 2 // "." and ".."
+	}
+	for _, e := range d.entries {
+		n += uint32(len(e.long))
+	}
+	return n * dirEntrySize
+}
+
+type layout struct {
+	img  *Image
+	geo  *geometry
+	root *dir
+	// extents are the directories and the files in the order of the clusters.
+	extents []extent
+	fat     []uint32
+	serial  uint32
+	// nextFree is the first free cluster.
+	nextFree uint32
+}
+
+type extent struct {
+	dir  *dir
+	file *fstree.Node
+	size uint32
+}
+
+// WriteTo writes the FAT image to w.
+func (img *Image) WriteTo(w io.Writer) (int64, error) {
+	l, err := img.layout()
+	if err != nil {
+		return 0, err
+	}
+	cw := &countWriter{w: w}
+	if err := l.write(cw); err != nil {
+		return cw.n, err
+	}
+	return cw.n, nil
+}
+
+// WriteImage writes the FAT image to w from the offset 0, such as a new file or a
+// partition of a disk image wrapped with io.NewOffsetWriter. The ranges which have
+// only zeros are not written, so the image is sparse and w must be filled with zeros
+// like a disk image created by vz.CreateDiskImage.
+func (img *Image) WriteImage(w io.WriterAt) error {
+	l, err := img.layout()
+	if err != nil {
+		return err
+	}
+	sw := &sparseWriter{w: w}
+	if err := l.write(sw); err != nil {
+		return err
+	}
+	if sw.skipped {
+		// The last byte is written to extend a new file to the size of the image.
+		if _, err := w.WriteAt([]byte{0}, sw.off-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bytes returns the FAT image.
+func (img *Image) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := img.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (img *Image) layout() (*layout, error) {
+	root, err := newDir(img.tree.Root(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// The root directory of FAT12 and FAT16 has the fixed number of entries
+	// including the volume label.
+	rootEntries := root.size() / dirEntrySize
+	if img.label != "" {
+		rootEntries++
+	}
+	rootEntries = (rootEntries + 15) / 16 * 16
+	if rootEntries < 512 {
+		rootEntries = 512
+	}
+
+	size := img.size
+	if size == 0 {
+		size = img.estimateSize()
+	}
+	for {
+		totalSectors := (size + SectorSize - 1) / SectorSize
+		if totalSectors > 0xffffffff {
+			return nil, ErrNoSpace
+		}
+		geo, err := newGeometry(uint32(totalSectors), rootEntries, img.typ)
+		if err == nil {
+			l := &layout{img: img, geo: geo, root: root}
+			err = l.allocate()
+			if err == nil {
+				return l, nil
+			}
+		}
+		if img.size != 0 || !errors.Is(err, ErrNoSpace) {
+			return nil, err
+		}
+		size += sizeUnit
+	}
+}
+
+// estimateSize returns the size which is a multiple of sizeUnit and enough to hold
+// the entries in most cases.
+func (img *Image) estimateSize() int64 {
+	size := int64(64 << 10)
+	img.tree.Walk(func(n *fstree.Node) error {
+		size += n.Size() + 4<<10
+		return nil
+	})
+	size = (size + sizeUnit - 1) / sizeUnit * sizeUnit
+	if img.typ == FAT32 && size < minFAT32Size {
+		size = minFAT32Size
+	}
+	return size
+}
+
+func newDir(n *fstree.Node, parent *dir) (*dir, error) {
+	d := &dir{node: n, parent: parent}
+	used := make(map[[11]byte]bool)
+	for _, child := range n.Children() {
+		if !child.IsDir() && !child.Mode.IsRegular() {
+			return nil, fmt.Errorf("fat: unsupported file type of %q: %v", child.Path(), child.Mode.Type())
+		}
+		if child.Size() > 0xffffffff {
+			return nil, fmt.Errorf("fat: %q is too large", child.Path())
+		}
+		e, err := newDirent(child, used)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = append(d.entries, e)
+	}
+	return d, nil
+}
+
+func newDirent(n *fstree.Node, used map[[11]byte]bool) (*dirent, error) {
+	e := &dirent{node: n}
+	if short, ok := validShortName(n.Name); ok && !used[short] {
+		e.shortName = short
+		used[short] = true
+		return e, nil
+	}
+	long := utf16.Encode([]rune(n.Name))
+	if len(long) > 255 {
+		return nil, fmt.Errorf("%w: %q is too long", ErrInvalidPath, n.Name)
+	}
+	e.shortName = generateShortName(n.Name, used)
+	used[e.shortName] = true
+	e.long = longNameEntries(long, shortNameChecksum(e.shortName))
+	return e, nil
+}
+
+const shortNameSpecials = "!#$%&'()-@^_`{}~"
+
+func isShortNameChar(r rune) bool {
+	return ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || strings.ContainsRune(shortNameSpecials, r)
+}
+
+// validShortName returns the short name if name is a valid upper case 8.3 name, so
+// that it is not necessary to record the long name.
+func validShortName(name string) ([11]byte, bool) {
+	var short [11]byte
+	base, ext, _ := strings.Cut(name, ".")
+	if len(base) == 0 || len(base) > 8 || len(ext) > 3 || strings.Contains(ext, ".") {
+		return short, false
+	}
+	if strings.HasSuffix(name, ".") {
+		return short, false
+	}
+	for _, r := range base + ext {
+		if !isShortNameChar(r) {
+			return short, false
+		}
+	}
+	copy(short[:], fmt.Sprintf("%-8s%-3s", base, ext))
+	return short, true
+}
+
+// generateShortName generates the short name which has a numeric tail such as
+// "NETWOR~1" from the long name.
+func generateShortName(name string, used map[[11]byte]bool) [11]byte {
+	convert := func(s string) string {
+		var b strings.Builder
+		for _, r := range strings.ToUpper(s) {
+			switch {
+			case r == ' ' || r == '.':
+			case isShortNameChar(r):
+				b.WriteRune(r)
+			default:
+				b.WriteByte('_')
+			}
+		}
+		return b.String()
+	}
+	trimmed := strings.TrimLeft(name, ".")
+	base, ext := trimmed, ""
+	if i := strings.LastIndexByte(trimmed, '.'); i >= 0 {
+		base, ext = trimmed[:i], trimmed[i+1:]
+	}
+	base, ext = convert(base), convert(ext)
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	if base == "" {
+		base = "_"
+	}
+
+	var short [11]byte
+	for i := 1; ; i++ {
+		tail := "~" + strconv.Itoa(i)
+		b := base
+		if len(b)+len(tail) > 8 {
+			b = b[:8-len(tail)]
+		}
+		copy(short[:], fmt.Sprintf("%-8s%-3s", b+tail, ext))
+		if !used[short] {
+			return short
+		}
+	}
+}
+
+func shortNameChecksum(name [11]byte) byte {
+	var sum byte
+	for _, c := range name {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// longNameEntries returns the long file name entries in the order on the disk,
+// that is, the last part of the name comes first.
+func longNameEntries(name []uint16, checksum byte) [][dirEntrySize]byte {
+	const charsPerEntry = 13
+	n := (len(name) + charsPerEntry - 1) / charsPerEntry
+	// The name is terminated by 0x0000 and padded with 0xFFFF.
+	padded := make([]uint16, n*charsPerEntry)
+	copy(padded, name)
+	for i := len(name); i < len(padded); i++ {
+		if i == len(name) {
+			padded[i] = 0
+		} else {
+			padded[i] = 0xffff
+		}
+	}
+
+	entries := make([][dirEntrySize]byte, n)
+	for i := 0; i < n; i++ {
+		var b [dirEntrySize]byte
+		seq := byte(i + 1)
+		if i == n-1 {
+			seq |= 0x40
+		}
+		b[0] = seq
+		chars := padded[i*charsPerEntry : (i+1)*charsPerEntry]
+		for j, c := range chars {
+			var off int
+			switch {
+			case j < 5:
+				off = 1 + 2*j
+			case j < 11:
+				off = 14 + 2*(j-5)
+			default:
+				off = 28 + 2*(j-11)
+			}
+			binary.LittleEndian.PutUint16(b[off:], c)
+		}
+		b[11] = attrLongName
+		b[13] = checksum
+		entries[n-1-i] = b
+	}
+	return entries
+}
+
+// allocate assigns the clusters to the directories and the files in depth-first order.
+func (l *layout) allocate() error {
+	l.fat = make([]uint32, l.geo.clusters+2)
+	l.fat[0] = 0x0fffff00 | mediaFixed
+	l.fat[1] = 0x0fffffff
+	next := uint32(2)
+	alloc := func(size uint32) (uint32, error) {
+		if size == 0 {
+			return 0, nil
+		}
+		n := (size + l.geo.clusterSize() - 1) / l.geo.clusterSize()
+		if next+n > l.geo.clusters+2 {
+			return 0, ErrNoSpace
+		}
+		first := next
+		for i := uint32(0); i < n-1; i++ {
+			l.fat[next] = next + 1
+			next++
+		}
+		l.fat[next] = 0x0fffffff
+		next++
+		return first, nil
+	}
+
+	if l.geo.typ == FAT32 {
+		// The root directory of FAT32 is stored in the clusters like the other
+		// directories.
+		size := l.root.size()
+		if l.img.label != "" {
+			size += dirEntrySize
+		}
+		var err error
+		if l.root.cluster, err = alloc(max(size, 1)); err != nil {
+			return err
+		}
+		l.extents = append(l.extents, extent{dir: l.root, size: size})
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(l.img.label))
+	var walk func(d *dir) error
+	walk = func(d *dir) error {
+		for _, e := range d.entries {
+			h.Write([]byte(e.node.Path()))
+			h.Write([]byte{0})
+			var err error
+			if e.node.IsDir() {
+				sub, err := newDir(e.node, d)
+				if err != nil {
+					return err
+				}
+				if sub.cluster, err = alloc(sub.size()); err != nil {
+					return err
+				}
+				e.cluster = sub.cluster
+				l.extents = append(l.extents, extent{dir: sub, size: sub.size()})
+				if err := walk(sub); err != nil {
+					return err
+				}
+				continue
+			}
+			size := uint32(e.node.Size())
+			if e.cluster, err = alloc(size); err != nil {
+				return err
+			}
+			if size > 0 {
+				l.extents = append(l.extents, extent{file: e.node, size: size})
+			}
+		}
+		return nil
+	}
+	if err := walk(l.root); err != nil {
+		return err
+	}
+	l.nextFree = next
+	l.serial = h.Sum32()
+	if l.img.hasSerial {
+		l.serial = l.img.serial
+	}
+	return nil
+}
+
+func (l *layout) write(w io.Writer) error {
+	if _, err := w.Write(l.reservedRegion()); err != nil {
+		return err
+	}
+	fat := l.fatBytes()
+	for i := 0; i < numFATs; i++ {
+		if _, err := w.Write(fat); err != nil {
+			return err
+		}
+	}
+	if l.geo.typ != FAT32 {
+		root := make([]byte, l.geo.rootDirSectors()*SectorSize)
+		l.dirEntries(root, l.root)
+		if _, err := w.Write(root); err != nil {
+			return err
+		}
+	}
+
+	written := int64(0)
+	clusterSize := int64(l.geo.clusterSize())
+	for _, ext := range l.extents {
+		var err error
+		if ext.dir != nil {
+			b := make([]byte, ext.size)
+			l.dirEntries(b, ext.dir)
+			_, err = w.Write(b)
+		} else {
+			err = writeFile(w, ext.file)
+		}
+		if err != nil {
+			return err
+		}
+		size := (int64(ext.size) + clusterSize - 1) / clusterSize * clusterSize
+		if _, err := w.Write(make([]byte, size-int64(ext.size))); err != nil {
+			return err
+		}
+		written += size
+	}
+
+	dataSize := int64(l.geo.totalSectors-l.geo.dataSector()) * SectorSize
+	return writeZeros(w, dataSize-written)
+}
+
+func writeFile(w io.Writer, n *fstree.Node) error {
+	r, err := n.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	written, err := io.Copy(w, io.LimitReader(r, n.Size()))
+	if err != nil {
+		return fmt.Errorf("failed to copy %q: %w", n.Path(), err)
+	}
+	if written != n.Size() {
+		return fmt.Errorf("failed to copy %q: %w", n.Path(), io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+func writeZeros(w io.Writer, n int64) error {
+	zeros := make([]byte, 64<<10)
+	for n > 0 {
+		chunk := zeros
+		if int64(len(chunk)) > n {
+			chunk = chunk[:n]
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		n -= int64(len(chunk))
+	}
+	return nil
+}
+
+// reservedRegion returns the sectors before the FATs. FAT32 has the FSInfo sector
+// and the backup of the boot sector and the FSInfo sector in the region.
+func (l *layout) reservedRegion() []byte {
+	b := make([]byte, l.geo.reservedSectors()*SectorSize)
+	copy(b, l.bootSector())
+	if l.geo.typ == FAT32 {
+		copy(b[fsInfoSector*SectorSize:], l.fsInfo())
+		copy(b[backupBootSector*SectorSize:], b[:2*SectorSize])
+	}
+	return b
+}
+
+func (l *layout) bootSector() []byte {
+	g := l.geo
+	b := make([]byte, SectorSize)
+	copy(b, []byte{0xeb, 0x3c, 0x90})
+	copy(b[3:], "MSWIN4.1")
+	binary.LittleEndian.PutUint16(b[11:], SectorSize)
+	b[13] = byte(g.sectorsPerCluster)
+	binary.LittleEndian.PutUint16(b[14:], uint16(g.reservedSectors()))
+	b[16] = numFATs
+	binary.LittleEndian.PutUint16(b[17:], uint16(g.rootEntries))
+	if g.totalSectors < 0x10000 && g.typ != FAT32 {
+		binary.LittleEndian.PutUint16(b[19:], uint16(g.totalSectors))
+	} else {
+		binary.LittleEndian.PutUint32(b[32:], g.totalSectors)
+	}
+	b[21] = mediaFixed
+	binary.LittleEndian.PutUint16(b[24:], 32) // sectors per track
+	binary.LittleEndian.PutUint16(b[26:], 64) // number of heads
+
+	// The extended BIOS parameter block of FAT32 follows the fields of FAT32.
+	ext := b[36:]
+	if g.typ == FAT32 {
+		b[1] = 0x58
+		binary.LittleEndian.PutUint32(b[36:], g.fatSectors)
+		binary.LittleEndian.PutUint32(b[44:], rootCluster)
+		binary.LittleEndian.PutUint16(b[48:], fsInfoSector)
+		binary.LittleEndian.PutUint16(b[50:], backupBootSector)
+		ext = b[64:]
+	} else {
+		binary.LittleEndian.PutUint16(b[22:], uint16(g.fatSectors))
+	}
+	ext[0] = 0x80 // drive number
+	ext[2] = 0x29 // extended boot signature
+	binary.LittleEndian.PutUint32(ext[3:], l.serial)
+	copy(ext[7:18], l.labelBytes())
+	copy(ext[18:26], fmt.Sprintf("%-8s", g.typ))
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
+
+// fsInfo returns the FSInfo sector of FAT32 which has the hints of the free clusters.
+func (l *layout) fsInfo() []byte {
+	b := make([]byte, SectorSize)
+	binary.LittleEndian.PutUint32(b[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(b[484:], 0x61417272)
+	binary.LittleEndian.PutUint32(b[488:], l.geo.clusters+2-l.nextFree)
+	binary.LittleEndian.PutUint32(b[492:], l.nextFree)
+	binary.LittleEndian.PutUint32(b[508:], 0xaa550000)
+	return b
+}
+
+func (l *layout) labelBytes() []byte {
+	if l.img.label == "" {
+		return []byte("NO NAME    ")
+	}
+	return []byte(fmt.Sprintf("%-11s", l.img.label))
+}
+
+func (l *layout) fatBytes() []byte {
+	b := make([]byte, l.geo.fatSectors*SectorSize)
+	for i, v := range l.fat {
+		switch l.geo.typ {
+		case FAT12:
+			v &= 0xfff
+			off := i * 3 / 2
+			if i%2 == 0 {
+				b[off] = byte(v)
+				b[off+1] = b[off+1]&0xf0 | byte(v>>8)
+			} else {
+				b[off] = b[off]&0x0f | byte(v<<4)
+				b[off+1] = byte(v >> 4)
+			}
+		case FAT16:
+			binary.LittleEndian.PutUint16(b[2*i:], uint16(v))
+		case FAT32:
+			binary.LittleEndian.PutUint32(b[4*i:], v)
+		}
+	}
+	return b
+}
+
+// dirEntries writes the entries of the directory d to b.
+func (l *layout) dirEntries(b []byte, d *dir) {
+	off := 0
+	put := func(e [dirEntrySize]byte) {
+		copy(b[off:], e[:])
+		off += dirEntrySize
+	}
+	modTime := l.img.modTime
+	if d.parent == nil {
+		if l.img.label != "" {
+			var name [11]byte
+			copy(name[:], l.labelBytes())
+			put(shortEntry(name, attrVolumeID, 0, 0, modTime))
+		}
+	} else {
+		put(shortEntry(dotName("."), attrDir, d.cluster, 0, modTime))
+		// ".." has the cluster 0 if the parent is the root directory even in FAT32.
+		parent := d.parent.cluster
+		if d.parent.parent == nil {
+			parent = 0
+		}
+		put(shortEntry(dotName(".."), attrDir, parent, 0, modTime))
+	}
+	for _, e := range d.entries {
+		for _, long := range e.long {
+			put(long)
+		}
+		if e.node.IsDir() {
+			put(shortEntry(e.shortName, attrDir, e.cluster, 0, modTime))
+			continue
+		}
+		attr := byte(attrArchive)
+		if e.node.Mode.Perm()&0o200 == 0 {
+			attr |= attrReadOnly
+		}
+		put(shortEntry(e.shortName, attr, e.cluster, uint32(e.node.Size()), modTime))
+	}
+}
+
+func dotName(name string) [11]byte {
+	var b [11]byte
+	copy(b[:], fmt.Sprintf("%-11s", name))
+	return b
+}
+
+func shortEntry(name [11]byte, attr byte, cluster, size uint32, t time.Time) [dirEntrySize]byte {
+	var b [dirEntrySize]byte
+	copy(b[:11], name[:])
+	b[11] = attr
+	date, tm := dosTime(t)
+	binary.LittleEndian.PutUint16(b[14:], tm)
+	binary.LittleEndian.PutUint16(b[16:], date)
+	binary.LittleEndian.PutUint16(b[18:], date)
+	binary.LittleEndian.PutUint16(b[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(b[22:], tm)
+	binary.LittleEndian.PutUint16(b[24:], date)
+	binary.LittleEndian.PutUint16(b[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(b[28:], size)
+	return b
+}
+
+// dosTime returns the date and the time in the MS-DOS format. The time is recorded
+// in UTC and clamped to the range from 1980 to 2107.
+func dosTime(t time.Time) (date, tm uint16) {
+	t = t.UTC()
+	if t.Year() < 1980 {
+		return 1<<5 | 1, 0
+	}
+	if t.Year() > 2107 {
+		return 127<<9 | 12<<5 | 31, 23<<11 | 59<<5 | 29
+	}
+	date = uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tm = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, tm
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// sparseWriter writes to w sequentially skipping the chunks which have only zeros.
+type sparseWriter struct {
+	w       io.WriterAt
+	off     int64
+	skipped bool
+}
+
+func (s *sparseWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s.skipped = isZero(p)
+	if !s.skipped {
+		if n, err := s.w.WriteAt(p, s.off); err != nil {
+			s.off += int64(n)
+			return n, err
+		}
+	}
+	s.off += int64(len(p))
+	return len(p), nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,312 @@
+package fat_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/Code-Hex/vz/v3/fat"
+)
+
+type bootSector struct {
+	sectorsPerCluster int
+	reservedSectors   int
+	numFATs           int
+	rootEntries       int
+	totalSectors      int
+	fatSectors        int
+	label             string
+	fsType            string
+}
+
+func parseBootSector(b []byte) bootSector {
+	total := int(binary.LittleEndian.Uint16(b[19:]))
+	if total == 0 {
+		total = int(binary.LittleEndian.Uint32(b[32:]))
+	}
+	return bootSector{
+		sectorsPerCluster: int(b[13]),
+		reservedSectors:   int(binary.LittleEndian.Uint16(b[14:])),
+		numFATs:           int(b[16]),
+		rootEntries:       int(binary.LittleEndian.Uint16(b[17:])),
+		totalSectors:      total,
+		fatSectors:        int(binary.LittleEndian.Uint16(b[22:])),
+		label:             string(b[43:54]),
+		fsType:            string(b[54:62]),
+	}
+}
+
+type entry struct {
+	name      string
+	shortName string
+	attr      byte
+	cluster   int
+	size      int
+}
+
+// readRootDir reads the entries of the root directory joining the long file names.
+func readRootDir(b []byte) []entry {
+	bs := parseBootSector(b)
+	off := (bs.reservedSectors + bs.numFATs*bs.fatSectors) * fat.SectorSize
+	dir := b[off : off+bs.rootEntries*32]
+	var entries []entry
+	var long []uint16
+	for i := 0; i < len(dir) && dir[i] != 0; i += 32 {
+		e := dir[i : i+32]
+		if e[11] == 0x0f {
+			var chars []uint16
+			for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+				for j := r[0]; j < r[1]; j += 2 {
+					chars = append(chars, binary.LittleEndian.Uint16(e[j:]))
+				}
+			}
+			long = append(chars, long...)
+			continue
+		}
+		name := strings.TrimRight(string(e[:8]), " ")
+		if ext := strings.TrimRight(string(e[8:11]), " "); ext != "" {
+			name += "." + ext
+		}
+		if long != nil {
+			for j, c := range long {
+				if c == 0 {
+					long = long[:j]
+					break
+				}
+			}
+			name = string(utf16.Decode(long))
+			long = nil
+		}
+		entries = append(entries, entry{
+			name:      name,
+			shortName: string(e[:11]),
+			attr:      e[11],
+			cluster:   int(binary.LittleEndian.Uint16(e[26:])),
+			size:      int(binary.LittleEndian.Uint32(e[28:])),
+		})
+	}
+	return entries
+}
+
+func TestImage(t *testing.T) {
+	img := fat.NewImage(fat.WithLabel("cidata"))
+	files := []struct {
+		name string
+		data string
+	}{
+		{name: "user-data", data: "#cloud-config\n"},
+		{name: "meta-data", data: "instance-id: iid-local01\n"},
+		{name: "README.TXT", data: "readme"},
+		{name: "network-config-1", data: "1"},
+		{name: "network-config-2", data: "2"},
+	}
+	for _, f := range files {
+		if err := img.AddFile(f.name, []byte(f.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := img.AddFile("EFI/BOOT/BOOTAA64.EFI", []byte("MZ"), 0o444); err != nil {
+		t.Fatal(err)
+	}
+	b, err := img.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 1<<20 {
+		t.Fatalf("want the size of 1 MiB but got %d", len(b))
+	}
+	if b[510] != 0x55 || b[511] != 0xaa {
+		t.Fatal("want the boot signature")
+	}
+	bs := parseBootSector(b)
+	if bs.label != "CIDATA     " || bs.fsType != "FAT12   " {
+		t.Fatalf("want the label CIDATA of FAT12 but got %q %q", bs.label, bs.fsType)
+	}
+
+	entries := readRootDir(b)
+	want := []entry{
+		{name: "CIDATA", shortName: "CIDATA     ", attr: 0x08},
+		{name: "EFI", shortName: "EFI        ", attr: 0x10, cluster: 2},
+		{name: "README.TXT", shortName: "README  TXT", attr: 0x20, cluster: 5, size: 6},
+		{name: "meta-data", shortName: "META-D~1   ", attr: 0x20, cluster: 6, size: 25},
+		{name: "network-config-1", shortName: "NETWOR~1   ", attr: 0x20, cluster: 7, size: 1},
+		{name: "network-config-2", shortName: "NETWOR~2   ", attr: 0x20, cluster: 8, size: 1},
+		{name: "user-data", shortName: "USER-D~1   ", attr: 0x20, cluster: 9, size: 14},
+	}
+	if !reflect.DeepEqual(want, entries) {
+		t.Fatalf("want %+v\n but got %+v", want, entries)
+	}
+
+	dataOff := (bs.reservedSectors + bs.numFATs*bs.fatSectors + bs.rootEntries*32/fat.SectorSize) * fat.SectorSize
+	clusterSize := bs.sectorsPerCluster * fat.SectorSize
+	userData := entries[6]
+	off := dataOff + (userData.cluster-2)*clusterSize
+	if got := string(b[off : off+userData.size]); got != "#cloud-config\n" {
+		t.Fatalf("want the content of user-data but got %q", got)
+	}
+}
+
+func TestImageType(t *testing.T) {
+	cases := []struct {
+		size int64
+		typ  fat.Type
+		want string
+	}{
+		{size: 1 << 20, want: "FAT12   "},
+		{size: 32 << 20, want: "FAT16   "},
+		{size: 64 << 20, want: "FAT16   "},
+		{size: 64 << 20, typ: fat.FAT32, want: "FAT32   "},
+		{size: 64 << 20, typ: fat.FAT12, want: "FAT12   "},
+	}
+	for _, tc := range cases {
+		var buf bytes.Buffer
+		img := fat.NewImage(fat.WithSize(tc.size), fat.WithType(tc.typ))
+		if err := img.AddFile("a", []byte("a"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := img.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if int64(buf.Len()) != tc.size {
+			t.Fatalf("want %d bytes but got %d", tc.size, buf.Len())
+		}
+		b := buf.Bytes()
+		label, fsType := string(b[43:54]), string(b[54:62])
+		if tc.typ == fat.FAT32 {
+			// The extended BIOS parameter block of FAT32 follows the fields of FAT32.
+			label, fsType = string(b[71:82]), string(b[82:90])
+		}
+		if fsType != tc.want {
+			t.Fatalf("%d: want %q but got %q", tc.size, tc.want, fsType)
+		}
+		if label != "NO NAME    " {
+			t.Fatalf("want no label but got %q", label)
+		}
+	}
+}
+
+func TestImageFAT32(t *testing.T) {
+	img := fat.NewImage(fat.WithType(fat.FAT32), fat.WithLabel("ESP"))
+	if err := img.AddFile("EFI/BOOT/BOOTAA64.EFI", []byte("MZ"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "esp.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := img.WriteImage(f); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The smallest FAT32 image which has 65525 clusters of a sector.
+	if fi.Size() != 33<<20 {
+		t.Fatalf("want the size of 33 MiB but got %d", fi.Size())
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	le := binary.LittleEndian
+	bs := parseBootSector(b)
+	if bs.reservedSectors != 32 || bs.rootEntries != 0 || bs.fatSectors != 0 {
+		t.Fatalf("want the BPB of FAT32 but got %+v", bs)
+	}
+	if label, fsType := string(b[71:82]), string(b[82:90]); label != "ESP        " || fsType != "FAT32   " {
+		t.Fatalf("want the label ESP of FAT32 but got %q %q", label, fsType)
+	}
+	if !bytes.Equal(b[:2*fat.SectorSize], b[6*fat.SectorSize:8*fat.SectorSize]) {
+		t.Fatal("want the backup boot sector")
+	}
+	fsInfo := b[fat.SectorSize : 2*fat.SectorSize]
+	if le.Uint32(fsInfo[0:]) != 0x41615252 || le.Uint32(fsInfo[484:]) != 0x61417272 {
+		t.Fatal("want the FSInfo sector")
+	}
+	// The root directory, "EFI", "BOOT" and the file use the clusters from 2 to 5.
+	if free := le.Uint32(fsInfo[492:]); free != 6 {
+		t.Fatalf("want the next free cluster 6 but got %d", free)
+	}
+
+	fatSectors := int(le.Uint32(b[36:]))
+	if root := le.Uint32(b[44:]); root != 2 {
+		t.Fatalf("want the root cluster 2 but got %d", root)
+	}
+	fatOff := bs.reservedSectors * fat.SectorSize
+	if got := le.Uint32(b[fatOff+2*4:]); got != 0x0fffffff {
+		t.Fatalf("want the end of the root directory but got %#x", got)
+	}
+	cluster := func(n int) []byte {
+		off := (bs.reservedSectors + bs.numFATs*fatSectors + (n-2)*bs.sectorsPerCluster) * fat.SectorSize
+		return b[off : off+bs.sectorsPerCluster*fat.SectorSize]
+	}
+	root := cluster(2)
+	if got := string(root[:11]); got != "ESP        " {
+		t.Fatalf("want the volume label but got %q", got)
+	}
+	if got := string(root[32:43]); got != "EFI        " {
+		t.Fatalf("want the directory EFI but got %q", got)
+	}
+	// ".." of the subdirectory of the root has the cluster 0.
+	efi := cluster(int(le.Uint16(root[32+26:])))
+	if got, cl := string(efi[32:43]), le.Uint16(efi[32+26:]); got != "..         " || cl != 0 {
+		t.Fatalf("want \"..\" of the cluster 0 but got %q %d", got, cl)
+	}
+
+	if st := fi.Sys().(*syscall.Stat_t); st.Blocks*512 >= fi.Size() {
+		t.Fatalf("want the sparse image but %d bytes are allocated", st.Blocks*512)
+	}
+}
+
+func TestImageReproducible(t *testing.T) {
+	build := func(opts ...fat.ImageOption) []byte {
+		img := fat.NewImage(opts...)
+		if err := img.AddFile("A/B", []byte("b"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		b, err := img.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if !bytes.Equal(build(), build()) {
+		t.Fatal("want the same image")
+	}
+	b := build(fat.WithSerialNumber(0x12345678), fat.WithModTime(time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC)))
+	if got := binary.LittleEndian.Uint32(b[39:]); got != 0x12345678 {
+		t.Fatalf("want the serial number but got %#x", got)
+	}
+	bs := parseBootSector(b)
+	// The first entry of the root directory is the directory "A".
+	e := b[(bs.reservedSectors+bs.numFATs*bs.fatSectors)*fat.SectorSize:]
+	if got, want := string(e[:11]), "A          "; got != want {
+		t.Fatalf("want %q but got %q", want, got)
+	}
+	wantDate, wantTime := uint16(2024-1980)<<9|2<<5|3, uint16(4)<<11|5<<5|3
+	if date, tm := binary.LittleEndian.Uint16(e[24:]), binary.LittleEndian.Uint16(e[22:]); date != wantDate || tm != wantTime {
+		t.Fatalf("want %#x %#x but got %#x %#x", wantDate, wantTime, date, tm)
+	}
+}
+
+func TestImageNoSpace(t *testing.T) {
+	img := fat.NewImage(fat.WithSize(1 << 20))
+	if err := img.AddFile("big", make([]byte, 2<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.Bytes(); !errors.Is(err, fat.ErrNoSpace) {
+		t.Fatalf("want %v but got %v", fat.ErrNoSpace, err)
+	}
+}
@@ -8,6 +8,6 @@ require (
 	github.com/Code-Hex/go-infinity-channel v1.0.0
 	golang.org/x/crypto v0.31.0
 	golang.org/x/mod v0.22.0
+	golang.org/x/sys v0.28.0
+	golang.org/x/term v0.27.0
 )
-
-require golang.org/x/sys v0.28.0 // indirect
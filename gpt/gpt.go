@@ -0,0 +1,303 @@
+// Package gpt writes GUID Partition Tables of disk images, so that the images which
+// are created by the other packages, such as the EFI System Partition, can be put in
+// a disk image with partitions.
+//
+// see: https://uefi.org/specs/UEFI/2.10/05_GUID_Partition_Table_Format.html
+package gpt
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// SectorSize is the size of a logical block of disk images.
+const SectorSize = 512
+
+const (
+	// alignment is the alignment of the partitions, which is the same as the other
+	// partitioning tools.
+	alignment = 1 << 20
+
+	numEntries     = 128
+	entrySize      = 128
+	entriesSectors = numEntries * entrySize / SectorSize
+	headerSize     = 92
+	maxNameLen     = 36
+)
+
+var (
+	// ErrNoSpace is returned when a partition does not fit in the disk.
+	ErrNoSpace = errors.New("gpt: no space left on the disk")
+
+	// ErrInvalidName is returned when the name of a partition is longer than 36
+	// UTF-16 code units.
+	ErrInvalidName = errors.New("gpt: invalid partition name")
+)
+
+// GUID is a globally unique identifier in the order of the bytes of the string
+// representation.
+type GUID [16]byte
+
+// ParseGUID parses the string representation of a GUID such as
+// "C12A7328-F81F-11D2-BA4B-00A0C93EC93B".
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return g, fmt.Errorf("gpt: invalid GUID %q", s)
+	}
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil {
+		return g, fmt.Errorf("gpt: invalid GUID %q: %w", s, err)
+	}
+	copy(g[:], b)
+	return g, nil
+}
+
+// MustParseGUID is like ParseGUID but panics if s is invalid.
+func MustParseGUID(s string) GUID {
+	g, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+func (g GUID) String() string {
+	h := strings.ToUpper(hex.EncodeToString(g[:]))
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// encode returns the GUID in the mixed-endian format of the disk, where the first
+// three fields are little-endian.
+func (g GUID) encode() []byte {
+	b := g
+	b[0], b[1], b[2], b[3] = g[3], g[2], g[1], g[0]
+	b[4], b[5] = g[5], g[4]
+	b[6], b[7] = g[7], g[6]
+	return b[:]
+}
+
+// newGUID returns the version 4 GUID derived from the data.
+func newGUID(data ...any) GUID {
+	h := sha256.New()
+	for _, v := range data {
+		fmt.Fprintf(h, "%v\x00", v)
+	}
+	var g GUID
+	copy(g[:], h.Sum(nil))
+	g[6] = g[6]&0x0f | 0x40
+	g[8] = g[8]&0x3f | 0x80
+	return g
+}
+
+// Partition type GUIDs.
+//
+// see: https://uapi-group.org/specifications/specs/discoverable_partitions_specification/
+var (
+	// TypeEFISystem is the type of the EFI System Partition.
+	TypeEFISystem = MustParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	// TypeLinuxFilesystem is the type of generic Linux data partitions.
+	TypeLinuxFilesystem = MustParseGUID("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	// TypeLinuxRootARM64 is the type of the root partition of arm64 Linux.
+	TypeLinuxRootARM64 = MustParseGUID("B921B045-1DF0-41C3-AF44-4C6F280D3FAE")
+	// TypeLinuxRootX86_64 is the type of the root partition of x86_64 Linux.
+	TypeLinuxRootX86_64 = MustParseGUID("4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709")
+	// TypeLinuxSwap is the type of Linux swap partitions.
+	TypeLinuxSwap = MustParseGUID("0657FD6D-A4AB-43C4-84E5-0933C84B4F4F")
+)
+
+// Partition is a partition of the disk. The fields can be changed before the table
+// is written except Offset and Size.
+type Partition struct {
+	// Type is the partition type GUID such as TypeEFISystem.
+	Type GUID
+	// GUID is the unique partition GUID. It is derived from the disk size, the index
+	// and the attributes of the partition by default.
+	GUID GUID
+	// Name is the name of the partition which is up to 36 UTF-16 code units.
+	Name string
+	// Attributes is the attribute flags of the partition.
+	Attributes uint64
+	// Offset is the offset of the partition in bytes from the start of the disk.
+	Offset int64
+	// Size is the size of the partition in bytes.
+	Size int64
+}
+
+func (p *Partition) firstLBA() uint64 { return uint64(p.Offset / SectorSize) }
+func (p *Partition) lastLBA() uint64  { return uint64((p.Offset+p.Size)/SectorSize) - 1 }
+
+// Table is a GUID Partition Table of a disk image.
+//
+// The table is reproducible: the GUIDs of the disk and the partitions are derived
+// from the layout unless they are specified.
+type Table struct {
+	size       int64
+	guid       GUID
+	hasGUID    bool
+	partitions []*Partition
+}
+
+// TableOption is an option for NewTable.
+type TableOption func(*Table)
+
+// WithDiskGUID sets the disk GUID.
+func WithDiskGUID(guid GUID) TableOption {
+	return func(t *Table) {
+		t.guid = guid
+		t.hasGUID = true
+	}
+}
+
+// NewTable creates a new empty partition table of the disk of size bytes, which is
+// rounded down to the sector size.
+func NewTable(size int64, opts ...TableOption) *Table {
+	t := &Table{size: size / SectorSize * SectorSize}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Size returns the size of the disk in bytes.
+func (t *Table) Size() int64 {
+	return t.size
+}
+
+// Partitions returns the partitions in the order of the offsets.
+func (t *Table) Partitions() []*Partition {
+	return t.partitions
+}
+
+// lastUsableLBA returns the last sector before the backup partition entries.
+func (t *Table) lastUsableLBA() int64 {
+	return t.size/SectorSize - 2 - entriesSectors
+}
+
+// AddPartition adds a partition of size bytes after the last partition. The offset is
+// aligned to 1 MiB, and the size is rounded up to the sector size. If size is zero,
+// the partition uses the rest of the disk.
+func (t *Table) AddPartition(typ GUID, name string, size int64) (*Partition, error) {
+	if len(t.partitions) == numEntries {
+		return nil, fmt.Errorf("%w: too many partitions", ErrNoSpace)
+	}
+	if len(utf16.Encode([]rune(name))) > maxNameLen {
+		return nil, fmt.Errorf("%w: %q is too long", ErrInvalidName, name)
+	}
+	offset := int64(alignment)
+	if n := len(t.partitions); n > 0 {
+		last := t.partitions[n-1]
+		offset = (last.Offset + last.Size + alignment - 1) / alignment * alignment
+	}
+	end := (t.lastUsableLBA() + 1) * SectorSize
+	if size == 0 {
+		size = end - offset
+	}
+	size = (size + SectorSize - 1) / SectorSize * SectorSize
+	if size <= 0 || offset+size > end {
+		return nil, fmt.Errorf("%w: partition %q of %d bytes", ErrNoSpace, name, size)
+	}
+	p := &Partition{
+		Type:   typ,
+		GUID:   newGUID("partition", t.size, len(t.partitions), typ, name, offset, size),
+		Name:   name,
+		Offset: offset,
+		Size:   size,
+	}
+	t.partitions = append(t.partitions, p)
+	return p, nil
+}
+
+// WriteTable writes the protective MBR and the primary and the backup GPT to w. The
+// other sectors, including the contents of the partitions, are not written.
+func (t *Table) WriteTable(w io.WriterAt) error {
+	if t.lastUsableLBA() < 2+entriesSectors {
+		return fmt.Errorf("%w: the disk of %d bytes is too small", ErrNoSpace, t.size)
+	}
+	entries := make([]byte, numEntries*entrySize)
+	for i, p := range t.partitions {
+		e := entries[i*entrySize:]
+		copy(e[0:], p.Type.encode())
+		copy(e[16:], p.GUID.encode())
+		binary.LittleEndian.PutUint64(e[32:], p.firstLBA())
+		binary.LittleEndian.PutUint64(e[40:], p.lastLBA())
+		binary.LittleEndian.PutUint64(e[48:], p.Attributes)
+		name := utf16.Encode([]rune(p.Name))
+		if len(name) > maxNameLen {
+			return fmt.Errorf("%w: %q is too long", ErrInvalidName, p.Name)
+		}
+		for j, c := range name {
+			binary.LittleEndian.PutUint16(e[56+2*j:], c)
+		}
+	}
+
+	diskGUID := t.guid
+	if !t.hasGUID {
+		var guids []any
+		for _, p := range t.partitions {
+			guids = append(guids, p.GUID)
+		}
+		diskGUID = newGUID(append([]any{"disk", t.size}, guids...)...)
+	}
+	lastLBA := uint64(t.size/SectorSize - 1)
+	backupEntriesLBA := lastLBA - entriesSectors
+	primary := t.header(diskGUID, 1, lastLBA, 2, entries)
+	backup := t.header(diskGUID, lastLBA, 1, backupEntriesLBA, entries)
+
+	writes := []struct {
+		lba uint64
+		b   []byte
+	}{
+		{0, t.protectiveMBR()},
+		{1, primary},
+		{2, entries},
+		{backupEntriesLBA, entries},
+		{lastLBA, backup},
+	}
+	for _, wr := range writes {
+		if _, err := w.WriteAt(wr.b, int64(wr.lba)*SectorSize); err != nil {
+			return fmt.Errorf("failed to write the partition table: %w", err)
+		}
+	}
+	return nil
+}
+
+func (t *Table) header(diskGUID GUID, current, backup, entriesLBA uint64, entries []byte) []byte {
+	b := make([]byte, SectorSize)
+	le := binary.LittleEndian
+	copy(b[0:], "EFI PART")
+	le.PutUint32(b[8:], 0x00010000) // revision 1.0
+	le.PutUint32(b[12:], headerSize)
+	le.PutUint64(b[24:], current)
+	le.PutUint64(b[32:], backup)
+	le.PutUint64(b[40:], 2+entriesSectors)
+	le.PutUint64(b[48:], uint64(t.lastUsableLBA()))
+	copy(b[56:], diskGUID.encode())
+	le.PutUint64(b[72:], entriesLBA)
+	le.PutUint32(b[80:], numEntries)
+	le.PutUint32(b[84:], entrySize)
+	le.PutUint32(b[88:], crc32.ChecksumIEEE(entries))
+	le.PutUint32(b[16:], crc32.ChecksumIEEE(b[:headerSize]))
+	return b
+}
+
+// protectiveMBR returns the MBR which has a partition of the type 0xEE covering the
+// disk, so that the tools which do not know GPT do not treat the disk as empty.
+func (t *Table) protectiveMBR() []byte {
+	b := make([]byte, SectorSize)
+	e := b[446:]
+	copy(e[1:4], []byte{0x00, 0x02, 0x00}) // CHS of the LBA 1
+	e[4] = 0xee
+	copy(e[5:8], []byte{0xff, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(e[8:], 1)
+	binary.LittleEndian.PutUint32(e[12:], uint32(min(t.size/SectorSize-1, 0xffffffff)))
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
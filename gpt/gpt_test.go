@@ -0,0 +1,164 @@
+package gpt_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/gpt"
+)
+
+func TestGUID(t *testing.T) {
+	const s = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	g, err := gpt.ParseGUID(strings.ToLower(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g != gpt.TypeEFISystem || g.String() != s {
+		t.Fatalf("want %s but got %s", s, g)
+	}
+	for _, invalid := range []string{"", "C12A7328F81F11D2BA4B00A0C93EC93B", "X12A7328-F81F-11D2-BA4B-00A0C93EC93B"} {
+		if _, err := gpt.ParseGUID(invalid); err == nil {
+			t.Fatalf("want error for %q", invalid)
+		}
+	}
+}
+
+// writeTable writes the table to a new sparse disk image and returns its content.
+func writeTable(t *testing.T, table *gpt.Table) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(table.Size()); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.WriteTable(f); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// checkHeader checks the header at lba and returns the partition entries.
+func checkHeader(t *testing.T, disk []byte, lba int64) []byte {
+	t.Helper()
+	le := binary.LittleEndian
+	h := disk[lba*gpt.SectorSize:]
+	if string(h[:8]) != "EFI PART" {
+		t.Fatalf("LBA %d: want the GPT header", lba)
+	}
+	if got := int64(le.Uint64(h[24:])); got != lba {
+		t.Fatalf("want the current LBA %d but got %d", lba, got)
+	}
+	hdr := append([]byte(nil), h[:92]...)
+	binary.LittleEndian.PutUint32(hdr[16:], 0)
+	if want, got := crc32.ChecksumIEEE(hdr), le.Uint32(h[16:]); want != got {
+		t.Fatalf("LBA %d: want the header CRC32 %#x but got %#x", lba, want, got)
+	}
+	off := int64(le.Uint64(h[72:])) * gpt.SectorSize
+	entries := disk[off : off+int64(le.Uint32(h[80:])*le.Uint32(h[84:]))]
+	if want, got := crc32.ChecksumIEEE(entries), le.Uint32(h[88:]); want != got {
+		t.Fatalf("LBA %d: want the entries CRC32 %#x but got %#x", lba, want, got)
+	}
+	return entries
+}
+
+func TestTable(t *testing.T) {
+	const size = 128 << 20
+	table := gpt.NewTable(size)
+	esp, err := table.AddPartition(gpt.TypeEFISystem, "ESP", 100<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := table.AddPartition(gpt.TypeLinuxRootARM64, "root", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if esp.Offset != 1<<20 || esp.Size != 100<<20 {
+		t.Fatalf("want the ESP at 1 MiB but got %d+%d", esp.Offset, esp.Size)
+	}
+	// The backup GPT uses the last 33 sectors.
+	if want := int64(size - 101<<20 - 33*gpt.SectorSize); root.Offset != 101<<20 || root.Size != want {
+		t.Fatalf("want the root of %d bytes at 101 MiB but got %d+%d", want, root.Offset, root.Size)
+	}
+
+	disk := writeTable(t, table)
+	mbr := disk[:gpt.SectorSize]
+	if mbr[446+4] != 0xee || mbr[510] != 0x55 || mbr[511] != 0xaa {
+		t.Fatal("want the protective MBR")
+	}
+	primary := checkHeader(t, disk, 1)
+	backup := checkHeader(t, disk, size/gpt.SectorSize-1)
+	if !bytes.Equal(primary, backup) {
+		t.Fatal("want the same partition entries in the backup")
+	}
+
+	le := binary.LittleEndian
+	e := primary[128:]
+	// The type GUID is mixed-endian.
+	if want := []byte{0x45, 0xb0, 0x21, 0xb9, 0xf0, 0x1d, 0xc3, 0x41, 0xaf, 0x44}; !bytes.Equal(e[:10], want) {
+		t.Fatalf("want the type of the root partition but got %x", e[:16])
+	}
+	if first, last := le.Uint64(e[32:]), le.Uint64(e[40:]); first != 101<<20/512 || last != size/512-34 {
+		t.Fatalf("want the LBAs from %d to %d but got %d to %d", 101<<20/512, size/512-34, first, last)
+	}
+	if name := string(bytes.ReplaceAll(e[56:66], []byte{0}, nil)); name != "root" {
+		t.Fatalf("want the name root but got %q", name)
+	}
+	if !bytes.Equal(primary[256:], make([]byte, len(primary)-256)) {
+		t.Fatal("want the unused entries to be zero")
+	}
+
+}
+
+func TestTableGUID(t *testing.T) {
+	build := func(opts ...gpt.TableOption) []byte {
+		table := gpt.NewTable(64<<20, opts...)
+		if _, err := table.AddPartition(gpt.TypeEFISystem, "ESP", 0); err != nil {
+			t.Fatal(err)
+		}
+		return writeTable(t, table)
+	}
+	first, second := build(), build()
+	if !bytes.Equal(first, second) {
+		t.Fatal("want the same tables")
+	}
+	guid := gpt.MustParseGUID("01234567-89AB-CDEF-0123-456789ABCDEF")
+	b := build(gpt.WithDiskGUID(guid))
+	want := []byte{0x67, 0x45, 0x23, 0x01, 0xab, 0x89, 0xef, 0xcd, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	if got := b[512+56 : 512+72]; !bytes.Equal(want, got) {
+		t.Fatalf("want the disk GUID %x but got %x", want, got)
+	}
+	// The version 4 bits are in the mixed-endian fields.
+	if derived := first[512+56 : 512+72]; derived[7]>>4 != 4 || derived[8]>>6 != 2 {
+		t.Fatalf("want the version 4 GUID but got %x", derived)
+	}
+}
+
+func TestTableNoSpace(t *testing.T) {
+	table := gpt.NewTable(64 << 20)
+	if _, err := table.AddPartition(gpt.TypeEFISystem, "ESP", 64<<20); !errors.Is(err, gpt.ErrNoSpace) {
+		t.Fatalf("want %v but got %v", gpt.ErrNoSpace, err)
+	}
+	if _, err := table.AddPartition(gpt.TypeLinuxFilesystem, strings.Repeat("a", 37), 0); !errors.Is(err, gpt.ErrInvalidName) {
+		t.Fatalf("want %v but got %v", gpt.ErrInvalidName, err)
+	}
+	if _, err := table.AddPartition(gpt.TypeLinuxFilesystem, "data", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.AddPartition(gpt.TypeLinuxFilesystem, "more", 0); !errors.Is(err, gpt.ErrNoSpace) {
+		t.Fatalf("want %v but got %v", gpt.ErrNoSpace, err)
+	}
+}
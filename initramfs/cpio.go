@@ -0,0 +1,476 @@
+// Package initramfs reads and writes initramfs archives which are passed to
+// LinuxBootLoader with WithInitrd.
+//
+// An initramfs is a cpio archive in the "newc" format, optionally compressed.
+// The Linux kernel extracts concatenated archives in order, and a later entry
+// replaces an earlier entry which has the same name. Overlay uses this to add
+// files to an existing initramfs without rebuilding it.
+//
+// see: https://www.kernel.org/doc/html/latest/driver-api/early-userspace/buffer-format.html
+package initramfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"time"
+)
+
+const (
+	magicNewc    = "070701"
+	magicNewcCRC = "070702"
+
+	headerSize = 110
+
+	// TrailerName is the name of the entry which marks the end of an archive.
+	TrailerName = "TRAILER!!!"
+)
+
+// File type bits of Header.Mode.
+const (
+	TypeMask    = 0o170000
+	TypeSocket  = 0o140000
+	TypeSymlink = 0o120000
+	TypeReg     = 0o100000
+	TypeBlock   = 0o060000
+	TypeDir     = 0o040000
+	TypeChar    = 0o020000
+	TypeFifo    = 0o010000
+)
+
+var (
+	// ErrHeader is returned when the header of an entry is invalid.
+	ErrHeader = errors.New("initramfs: invalid cpio header")
+
+	// ErrWriteTooLong is returned when more bytes than the size in the header
+	// are written to an entry.
+	ErrWriteTooLong = errors.New("initramfs: write too long")
+
+	// ErrWriteAfterClose is returned when writing to a closed Writer.
+	ErrWriteAfterClose = errors.New("initramfs: write after close")
+)
+
+// Header is the header of an entry of a cpio archive.
+type Header struct {
+	// Name is the path name of the entry, such as "bin/sh".
+	Name string
+
+	// Linkname is the target of a symbolic link. It is stored as the data of the entry.
+	Linkname string
+
+	// Mode is the file type and the permission bits (st_mode).
+	Mode uint32
+
+	UID int
+	GID int
+
+	// NLink is the number of links. If it is zero, Writer uses 2 for directories
+	// and 1 for others.
+	NLink int
+
+	ModTime time.Time
+
+	// Size is the size of the data. It is ignored for symbolic links by Writer.
+	Size int64
+
+	// Inode is the inode number. If it is zero, Writer assigns a sequential number.
+	Inode int64
+
+	// DevMajor and DevMinor are the device which contains the file.
+	DevMajor int
+	DevMinor int
+
+	// RDevMajor and RDevMinor are the device which a character or block device
+	// node refers to.
+	RDevMajor int
+	RDevMinor int
+}
+
+// FileMode returns the mode of the entry as fs.FileMode.
+func (h *Header) FileMode() fs.FileMode {
+	mode := fs.FileMode(h.Mode & 0o777)
+	if h.Mode&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if h.Mode&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if h.Mode&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	switch h.Mode & TypeMask {
+	case TypeDir:
+		mode |= fs.ModeDir
+	case TypeSymlink:
+		mode |= fs.ModeSymlink
+	case TypeChar:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case TypeBlock:
+		mode |= fs.ModeDevice
+	case TypeFifo:
+		mode |= fs.ModeNamedPipe
+	case TypeSocket:
+		mode |= fs.ModeSocket
+	}
+	return mode
+}
+
+// unixMode converts the permission bits of fs.FileMode to st_mode bits.
+func unixMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	return m
+}
+
+func align4(n int64) int64 {
+	return (4 - n%4) % 4
+}
+
+// Reader reads entries from cpio archives.
+//
+// Like the Linux kernel, the Reader continues to read the next archive after the
+// trailer of an archive. Zero bytes between archives are skipped, and gzip
+// compressed archives are decompressed.
+type Reader struct {
+	base *bufio.Reader
+
+	// cur is base or the decompressor of the current compressed segment.
+	cur *bufio.Reader
+	gz  *gzip.Reader
+
+	// remaining is the number of bytes of data of the current entry which are
+	// not read yet, and pad is the padding after the data.
+	remaining int64
+	pad       int64
+
+	err error
+}
+
+// NewReader creates a new Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	br := bufio.NewReader(r)
+	return &Reader{
+		base: br,
+		cur:  br,
+	}
+}
+
+// Next advances to the next entry. It returns io.EOF at the end of the input.
+// The trailer entries are skipped.
+func (r *Reader) Next() (*Header, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	hdr, err := r.next()
+	if err != nil {
+		r.err = err
+	}
+	return hdr, err
+}
+
+func (r *Reader) next() (*Header, error) {
+	if _, err := r.cur.Discard(int(r.remaining + r.pad)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	r.remaining, r.pad = 0, 0
+
+	for {
+		if err := r.skipZeros(); err != nil {
+			return nil, err
+		}
+		magic, err := r.cur.Peek(6)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if bytes.HasPrefix(magic, []byte{0x1f, 0x8b}) && r.gz == nil {
+			if err := r.startGzip(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if string(magic) != magicNewc && string(magic) != magicNewcCRC {
+			return nil, fmt.Errorf("%w: unknown magic %q", ErrHeader, magic)
+		}
+		hdr, err := r.readHeader()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == TrailerName {
+			continue
+		}
+		return hdr, nil
+	}
+}
+
+// skipZeros skips zero bytes. It returns io.EOF at the end of the input.
+func (r *Reader) skipZeros() error {
+	for {
+		b, err := r.cur.ReadByte()
+		if err == io.EOF && r.gz != nil {
+			// the end of the compressed segment.
+			if err := r.gz.Close(); err != nil {
+				return err
+			}
+			r.gz = nil
+			r.cur = r.base
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if b != 0 {
+			return r.cur.UnreadByte()
+		}
+	}
+}
+
+func (r *Reader) startGzip() error {
+	gz, err := gzip.NewReader(r.base)
+	if err != nil {
+		return err
+	}
+	// stop at the end of the gzip member, because an uncompressed archive may follow.
+	gz.Multistream(false)
+	r.gz = gz
+	r.cur = bufio.NewReader(gz)
+	return nil
+}
+
+func (r *Reader) readHeader() (*Header, error) {
+	var buf [headerSize]byte
+	if _, err := io.ReadFull(r.cur, buf[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	var fields [13]uint64
+	for i := range fields {
+		s := buf[6+i*8 : 6+(i+1)*8]
+		v, err := strconv.ParseUint(string(s), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid field %q", ErrHeader, s)
+		}
+		fields[i] = v
+	}
+	hdr := &Header{
+		Inode:     int64(fields[0]),
+		Mode:      uint32(fields[1]),
+		UID:       int(fields[2]),
+		GID:       int(fields[3]),
+		NLink:     int(fields[4]),
+		ModTime:   time.Unix(int64(fields[5]), 0),
+		Size:      int64(fields[6]),
+		DevMajor:  int(fields[7]),
+		DevMinor:  int(fields[8]),
+		RDevMajor: int(fields[9]),
+		RDevMinor: int(fields[10]),
+	}
+	nameSize := int64(fields[11])
+	if nameSize == 0 || nameSize > 4096 {
+		return nil, fmt.Errorf("%w: invalid name size %d", ErrHeader, nameSize)
+	}
+	name := make([]byte, nameSize+align4(headerSize+nameSize))
+	if _, err := io.ReadFull(r.cur, name); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if name[nameSize-1] != 0 {
+		return nil, fmt.Errorf("%w: name is not terminated", ErrHeader)
+	}
+	hdr.Name = string(name[:nameSize-1])
+
+	r.remaining = hdr.Size
+	r.pad = align4(hdr.Size)
+	if hdr.Mode&TypeMask == TypeSymlink {
+		if hdr.Size > 4096 {
+			return nil, fmt.Errorf("%w: symbolic link target is too long", ErrHeader)
+		}
+		target := make([]byte, hdr.Size)
+		if _, err := io.ReadFull(r, target); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		hdr.Linkname = string(target)
+	}
+	return hdr, nil
+}
+
+// Read reads the data of the current entry.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.cur.Read(p)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Writer writes a cpio archive in the newc format.
+type Writer struct {
+	w         io.Writer
+	inode     int64
+	remaining int64
+	pad       int64
+	closed    bool
+	err       error
+}
+
+// NewWriter creates a new Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteHeader writes hdr and prepares to accept the data of the entry.
+// The data of a symbolic link is hdr.Linkname, and it is written by WriteHeader.
+func (w *Writer) WriteHeader(hdr *Header) error {
+	if err := w.finishEntry(); err != nil {
+		return err
+	}
+	h := *hdr
+	if h.Mode&TypeMask == TypeSymlink {
+		h.Size = int64(len(h.Linkname))
+	}
+	if h.Inode == 0 {
+		w.inode++
+		h.Inode = w.inode
+	}
+	if h.NLink == 0 {
+		h.NLink = 1
+		if h.Mode&TypeMask == TypeDir {
+			h.NLink = 2
+		}
+	}
+	if err := w.writeHeader(&h); err != nil {
+		return err
+	}
+	w.remaining = h.Size
+	w.pad = align4(h.Size)
+	if h.Mode&TypeMask == TypeSymlink {
+		_, err := w.Write([]byte(h.Linkname))
+		return err
+	}
+	return nil
+}
+
+func (w *Writer) writeHeader(h *Header) error {
+	if w.closed {
+		return ErrWriteAfterClose
+	}
+	if h.Name == "" || len(h.Name) >= 4096 {
+		return fmt.Errorf("%w: invalid name %q", ErrHeader, h.Name)
+	}
+	var mtime int64
+	if !h.ModTime.IsZero() {
+		mtime = h.ModTime.Unix()
+	}
+	fields := []int64{
+		h.Inode,
+		int64(h.Mode),
+		int64(h.UID),
+		int64(h.GID),
+		int64(h.NLink),
+		mtime,
+		h.Size,
+		int64(h.DevMajor),
+		int64(h.DevMinor),
+		int64(h.RDevMajor),
+		int64(h.RDevMinor),
+		int64(len(h.Name) + 1),
+		0, // check
+	}
+	buf := make([]byte, 0, headerSize+len(h.Name)+4)
+	buf = append(buf, magicNewc...)
+	for _, v := range fields {
+		if v < 0 || v > 0xffffffff {
+			return fmt.Errorf("%w: field value %d of %q is out of range", ErrHeader, v, h.Name)
+		}
+		buf = append(buf, fmt.Sprintf("%08X", v)...)
+	}
+	buf = append(buf, h.Name...)
+	buf = append(buf, 0)
+	buf = append(buf, make([]byte, align4(int64(len(buf))))...)
+	return w.write(buf)
+}
+
+// Write writes the data of the current entry.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrWriteAfterClose
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	overflow := false
+	if int64(len(p)) > w.remaining {
+		p = p[:w.remaining]
+		overflow = true
+	}
+	n, err := w.w.Write(p)
+	w.remaining -= int64(n)
+	if err != nil {
+		w.err = err
+		return n, err
+	}
+	if overflow {
+		return n, ErrWriteTooLong
+	}
+	return n, nil
+}
+
+func (w *Writer) write(p []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	_, w.err = w.w.Write(p)
+	return w.err
+}
+
+// finishEntry writes the padding of the current entry.
+func (w *Writer) finishEntry() error {
+	if w.remaining > 0 {
+		return fmt.Errorf("initramfs: missed writing %d bytes", w.remaining)
+	}
+	if w.pad > 0 {
+		pad := w.pad
+		w.pad = 0
+		return w.write(make([]byte, pad))
+	}
+	return nil
+}
+
+// Close writes the trailer entry. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	if err := w.finishEntry(); err != nil {
+		return err
+	}
+	if err := w.writeHeader(&Header{Name: TrailerName, NLink: 1}); err != nil {
+		return err
+	}
+	w.closed = true
+	return nil
+}
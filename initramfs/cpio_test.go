@@ -0,0 +1,191 @@
+package initramfs_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/initramfs"
+)
+
+type entry struct {
+	hdr  initramfs.Header
+	data string
+}
+
+func readAll(t *testing.T, r io.Reader) []entry {
+	t.Helper()
+	cr := initramfs.NewReader(r)
+	var entries []entry
+	for {
+		hdr, err := cr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(cr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry{hdr: *hdr, data: string(data)})
+	}
+}
+
+func TestWriterGolden(t *testing.T) {
+	var buf bytes.Buffer
+	w := initramfs.NewWriter(&buf)
+	err := w.WriteHeader(&initramfs.Header{
+		Name:    "init",
+		Mode:    initramfs.TypeReg | 0o755,
+		ModTime: time.Unix(0x5f5e100, 0),
+		Size:    3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "070701" + "00000001" + "000081ED" + "00000000" + "00000000" + "00000001" + "05F5E100" +
+		"00000003" + "00000000" + "00000000" + "00000000" + "00000000" + "00000005" + "00000000" +
+		"init\x00" + "\x00" + // 110 + 5 bytes of the name is padded to 116
+		"abc\x00" +
+		"070701" + "00000000" + "00000000" + "00000000" + "00000000" + "00000001" + "00000000" +
+		"00000000" + "00000000" + "00000000" + "00000000" + "00000000" + "0000000B" + "00000000" +
+		"TRAILER!!!\x00" + "\x00\x00\x00" // 110 + 11 bytes is padded to 124
+	if got := buf.String(); got != want {
+		t.Fatalf("want %q\n but got %q", want, got)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	mtime := time.Unix(1700000000, 0)
+	entries := []entry{
+		{
+			hdr: initramfs.Header{Name: "bin", Mode: initramfs.TypeDir | 0o755, NLink: 2, ModTime: mtime},
+		},
+		{
+			hdr:  initramfs.Header{Name: "bin/agent", Mode: initramfs.TypeReg | 0o4755, UID: 1000, GID: 100, NLink: 1, ModTime: mtime, Size: 5},
+			data: "agent",
+		},
+		{
+			hdr:  initramfs.Header{Name: "bin/sh", Mode: initramfs.TypeSymlink | 0o777, NLink: 1, ModTime: mtime, Linkname: "busybox", Size: 7},
+			data: "",
+		},
+		{
+			hdr: initramfs.Header{Name: "dev/console", Mode: initramfs.TypeChar | 0o600, NLink: 1, ModTime: mtime, RDevMajor: 5, RDevMinor: 1},
+		},
+		{
+			hdr: initramfs.Header{Name: "dev/vda", Mode: initramfs.TypeBlock | 0o660, GID: 6, NLink: 1, ModTime: mtime, RDevMajor: 254, RDevMinor: 0},
+		},
+	}
+
+	var buf bytes.Buffer
+	w := initramfs.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		if err := w.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if e.hdr.Mode&initramfs.TypeMask != initramfs.TypeSymlink {
+			if _, err := w.Write([]byte(e.data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len()%4 != 0 {
+		t.Fatalf("want the archive to be aligned to 4 bytes but got %d bytes", buf.Len())
+	}
+
+	got := readAll(t, &buf)
+	if len(got) != len(entries) {
+		t.Fatalf("want %d entries but got %d", len(entries), len(got))
+	}
+	for i, want := range entries {
+		want.hdr.Inode = int64(i + 1)
+		if got[i] != want {
+			t.Fatalf("entry %d: want %+v but got %+v", i, want, got[i])
+		}
+	}
+	if mode := got[1].hdr.FileMode(); mode.String() != "urwxr-xr-x" {
+		t.Fatalf("want setuid mode but got %v", mode)
+	}
+	if mode := got[3].hdr.FileMode(); mode.String() != "Dcrw-------" {
+		t.Fatalf("want character device mode but got %v", mode)
+	}
+}
+
+func TestWriterError(t *testing.T) {
+	t.Run("write too long", func(t *testing.T) {
+		w := initramfs.NewWriter(io.Discard)
+		if err := w.WriteHeader(&initramfs.Header{Name: "a", Mode: initramfs.TypeReg, Size: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("ab")); !errors.Is(err, initramfs.ErrWriteTooLong) {
+			t.Fatalf("want %v but got %v", initramfs.ErrWriteTooLong, err)
+		}
+	})
+	t.Run("missed writing", func(t *testing.T) {
+		w := initramfs.NewWriter(io.Discard)
+		if err := w.WriteHeader(&initramfs.Header{Name: "a", Mode: initramfs.TypeReg, Size: 2}); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err == nil {
+			t.Fatal("want error but got nil")
+		}
+	})
+	t.Run("write after close", func(t *testing.T) {
+		w := initramfs.NewWriter(io.Discard)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		err := w.WriteHeader(&initramfs.Header{Name: "a", Mode: initramfs.TypeReg})
+		if !errors.Is(err, initramfs.ErrWriteAfterClose) {
+			t.Fatalf("want %v but got %v", initramfs.ErrWriteAfterClose, err)
+		}
+	})
+}
+
+func TestReaderError(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  error
+	}{
+		{
+			name:  "unknown magic",
+			input: "070707" + strings.Repeat("0", 104),
+			want:  initramfs.ErrHeader,
+		},
+		{
+			name:  "invalid field",
+			input: "070701" + strings.Repeat("Z", 104),
+			want:  initramfs.ErrHeader,
+		},
+		{
+			name:  "truncated",
+			input: "070701" + strings.Repeat("0", 50),
+			want:  io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := initramfs.NewReader(strings.NewReader(tc.input)).Next()
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("want %v but got %v", tc.want, err)
+			}
+		})
+	}
+}
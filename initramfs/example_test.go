@@ -0,0 +1,25 @@
+package initramfs_test
+
+import (
+	"log"
+
+	"github.com/Code-Hex/vz/v3/initramfs"
+)
+
+func ExampleAppendFile() {
+	// Inject an agent and an SSH key into the initrd of a distribution.
+	overlay := initramfs.NewOverlay()
+	if err := overlay.AddFileFromPath("usr/local/bin/agent", "/path/to/agent", 0o755); err != nil {
+		log.Fatal(err)
+	}
+	if err := overlay.AddFile("root/.ssh/authorized_keys", []byte("ssh-ed25519 AAAA..."), 0o600); err != nil {
+		log.Fatal(err)
+	}
+	if err := overlay.AddDir("root/.ssh", 0o700); err != nil {
+		log.Fatal(err)
+	}
+	if err := initramfs.AppendFile("/path/to/initrd.img", "/path/to/initrd.gz", overlay); err != nil {
+		log.Fatal(err)
+	}
+	// Pass "/path/to/initrd.img" to vz.WithInitrd.
+}
@@ -0,0 +1,347 @@
+package initramfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrInvalidPath is returned when the path of an overlay entry is invalid.
+var ErrInvalidPath = errors.New("initramfs: invalid path")
+
+// Overlay is a set of files, directories, symbolic links and device nodes which are
+// written as a cpio archive.
+//
+// The archive is reproducible: the entries are sorted by name, the inode numbers are
+// assigned in that order, and the modification times are fixed. The parent directories
+// which are not added explicitly are created with the mode 0755 and owned by root.
+type Overlay struct {
+	entries map[string]*overlayEntry
+	modTime time.Time
+}
+
+type overlayEntry struct {
+	hdr  Header
+	data []byte
+	// src is the path of the file on the host whose content is the data.
+	src string
+}
+
+// OverlayOption is an option for NewOverlay.
+type OverlayOption func(*Overlay)
+
+// WithModTime sets the modification time of all entries. The default is the Unix epoch.
+func WithModTime(t time.Time) OverlayOption {
+	return func(o *Overlay) {
+		o.modTime = t
+	}
+}
+
+// NewOverlay creates a new empty Overlay.
+func NewOverlay(opts ...OverlayOption) *Overlay {
+	o := &Overlay{
+		entries: make(map[string]*overlayEntry),
+		modTime: time.Unix(0, 0),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// EntryOption is an option for an entry of Overlay.
+type EntryOption func(*Header)
+
+// WithOwner sets the owner of the entry. The default is root (0:0).
+func WithOwner(uid, gid int) EntryOption {
+	return func(h *Header) {
+		h.UID = uid
+		h.GID = gid
+	}
+}
+
+// cleanName converts the name to the form used in initramfs, such as "usr/bin/agent".
+func cleanName(name string) (string, error) {
+	cleaned := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if cleaned == "" || cleaned == TrailerName {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPath, name)
+	}
+	return cleaned, nil
+}
+
+func (o *Overlay) add(name string, mode uint32, data []byte, src string, opts []EntryOption) (*overlayEntry, error) {
+	cleaned, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	e := &overlayEntry{
+		hdr: Header{
+			Name:    cleaned,
+			Mode:    mode,
+			ModTime: o.modTime,
+			Size:    int64(len(data)),
+		},
+		data: data,
+		src:  src,
+	}
+	for _, opt := range opts {
+		opt(&e.hdr)
+	}
+	o.entries[cleaned] = e
+	return e, nil
+}
+
+// AddFile adds a regular file which has the data. An entry which has the same name
+// is replaced.
+func (o *Overlay) AddFile(name string, data []byte, mode fs.FileMode, opts ...EntryOption) error {
+	_, err := o.add(name, TypeReg|unixMode(mode), data, "", opts)
+	return err
+}
+
+// AddFileFromPath adds a regular file whose content is read from the file at src on
+// the host when the overlay is written. The mode is used instead of the mode of src.
+func (o *Overlay) AddFileFromPath(name, src string, mode fs.FileMode, opts ...EntryOption) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%w: %q is not a regular file", ErrInvalidPath, src)
+	}
+	_, err = o.add(name, TypeReg|unixMode(mode), nil, src, opts)
+	return err
+}
+
+// AddDir adds a directory.
+func (o *Overlay) AddDir(name string, mode fs.FileMode, opts ...EntryOption) error {
+	_, err := o.add(name, TypeDir|unixMode(mode), nil, "", opts)
+	return err
+}
+
+// AddSymlink adds a symbolic link which points to target.
+func (o *Overlay) AddSymlink(name, target string, opts ...EntryOption) error {
+	if target == "" {
+		return fmt.Errorf("%w: empty symbolic link target", ErrInvalidPath)
+	}
+	e, err := o.add(name, TypeSymlink|0o777, nil, "", opts)
+	if err != nil {
+		return err
+	}
+	e.hdr.Linkname = target
+	return nil
+}
+
+// AddCharDevice adds a character device node, such as "dev/console" (5, 1).
+func (o *Overlay) AddCharDevice(name string, major, minor int, mode fs.FileMode, opts ...EntryOption) error {
+	return o.addDevice(name, TypeChar, major, minor, mode, opts)
+}
+
+// AddBlockDevice adds a block device node.
+func (o *Overlay) AddBlockDevice(name string, major, minor int, mode fs.FileMode, opts ...EntryOption) error {
+	return o.addDevice(name, TypeBlock, major, minor, mode, opts)
+}
+
+func (o *Overlay) addDevice(name string, typ uint32, major, minor int, mode fs.FileMode, opts []EntryOption) error {
+	e, err := o.add(name, typ|unixMode(mode), nil, "", opts)
+	if err != nil {
+		return err
+	}
+	e.hdr.RDevMajor = major
+	e.hdr.RDevMinor = minor
+	return nil
+}
+
+// Names returns the sorted names of the entries, including the implicit parent directories.
+func (o *Overlay) Names() []string {
+	entries := o.sortedEntries()
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.hdr.Name
+	}
+	return names
+}
+
+// sortedEntries returns the entries and the implicit parent directories sorted by name,
+// so that a directory is always written before its children.
+func (o *Overlay) sortedEntries() []*overlayEntry {
+	all := make(map[string]*overlayEntry, len(o.entries))
+	for name, e := range o.entries {
+		all[name] = e
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := o.entries[dir]; ok {
+				continue
+			}
+			all[dir] = &overlayEntry{
+				hdr: Header{
+					Name:    dir,
+					Mode:    TypeDir | 0o755,
+					ModTime: o.modTime,
+				},
+			}
+		}
+	}
+	entries := make([]*overlayEntry, 0, len(all))
+	for _, e := range all {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].hdr.Name < entries[j].hdr.Name
+	})
+	return entries
+}
+
+// WriteTo writes the overlay as a cpio archive to w.
+func (o *Overlay) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	cpio := NewWriter(cw)
+	for _, e := range o.sortedEntries() {
+		if err := writeEntry(cpio, e); err != nil {
+			return cw.n, err
+		}
+	}
+	if err := cpio.Close(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, nil
+}
+
+func writeEntry(cpio *Writer, e *overlayEntry) error {
+	hdr := e.hdr
+	if e.src == "" {
+		if err := cpio.WriteHeader(&hdr); err != nil {
+			return err
+		}
+		_, err := cpio.Write(e.data)
+		return err
+	}
+
+	f, err := os.Open(e.src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr.Size = fi.Size()
+	if err := cpio.WriteHeader(&hdr); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(cpio, f, hdr.Size); err != nil {
+		return fmt.Errorf("failed to copy %q: %w", e.src, err)
+	}
+	return nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// AppendOption is an option for Append and AppendFile.
+type AppendOption func(*appendConfig)
+
+type appendConfig struct {
+	gzip bool
+}
+
+// WithGzip compresses the overlay archive by gzip. The base initramfs is not changed.
+func WithGzip() AppendOption {
+	return func(c *appendConfig) {
+		c.gzip = true
+	}
+}
+
+// Append writes the initramfs read from base followed by the overlay archive to w.
+//
+// The base may be compressed by any method which the kernel supports, because it is
+// copied as is. The kernel extracts the overlay after the base, so the entries of the
+// overlay replace the entries of the base which have the same name.
+func Append(w io.Writer, base io.Reader, overlay *Overlay, opts ...AppendOption) error {
+	var cfg appendConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	cw := &countWriter{w: w}
+	if _, err := io.Copy(cw, base); err != nil {
+		return fmt.Errorf("failed to copy the base initramfs: %w", err)
+	}
+	// The kernel requires an uncompressed archive to start at a 4 byte boundary,
+	// and skips the zero bytes between archives.
+	if pad := align4(cw.n); pad > 0 {
+		if _, err := cw.Write(make([]byte, pad)); err != nil {
+			return err
+		}
+	}
+
+	if !cfg.gzip {
+		_, err := overlay.WriteTo(cw)
+		return err
+	}
+	zw := gzip.NewWriter(cw)
+	if _, err := overlay.WriteTo(zw); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// AppendFile writes the initramfs at base followed by the overlay archive to the file
+// at dst. The file is replaced atomically. See Append for details.
+func AppendFile(dst, base string, overlay *Overlay, opts ...AppendOption) error {
+	in, err := os.Open(base)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	bw := bufio.NewWriter(tmp)
+	if err := Append(bw, in, overlay, opts...); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// Bytes returns the overlay as a cpio archive.
+func (o *Overlay) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := o.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,243 @@
+package initramfs_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/initramfs"
+)
+
+func newTestOverlay(t *testing.T, reverse bool) *initramfs.Overlay {
+	t.Helper()
+	o := initramfs.NewOverlay()
+	adds := []func() error{
+		func() error { return o.AddFile("/usr/bin/agent", []byte("#!/bin/sh\necho agent\n"), 0o755) },
+		func() error {
+			return o.AddFile("root/.ssh/authorized_keys", []byte("ssh-ed25519 AAAA test\n"), 0o600, initramfs.WithOwner(0, 0))
+		},
+		func() error { return o.AddDir("root/.ssh", 0o700) },
+		func() error { return o.AddDir("home/user", 0o750, initramfs.WithOwner(1000, 1000)) },
+		func() error { return o.AddSymlink("init", "/usr/bin/agent") },
+		func() error { return o.AddCharDevice("dev/console", 5, 1, 0o600) },
+		func() error { return o.AddBlockDevice("dev/vda", 254, 0, 0o660, initramfs.WithOwner(0, 6)) },
+	}
+	if reverse {
+		for i, j := 0, len(adds)-1; i < j; i, j = i+1, j-1 {
+			adds[i], adds[j] = adds[j], adds[i]
+		}
+	}
+	for _, add := range adds {
+		if err := add(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return o
+}
+
+func TestOverlay(t *testing.T) {
+	o := newTestOverlay(t, false)
+	want := []string{
+		"dev",
+		"dev/console",
+		"dev/vda",
+		"home",
+		"home/user",
+		"init",
+		"root",
+		"root/.ssh",
+		"root/.ssh/authorized_keys",
+		"usr",
+		"usr/bin",
+		"usr/bin/agent",
+	}
+	if got := o.Names(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v but got %v", want, got)
+	}
+
+	archive, err := o.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := readAll(t, bytes.NewReader(archive))
+	if len(entries) != len(want) {
+		t.Fatalf("want %d entries but got %d", len(want), len(entries))
+	}
+	byName := make(map[string]entry)
+	for i, e := range entries {
+		if e.hdr.Name != want[i] {
+			t.Fatalf("want %q but got %q", want[i], e.hdr.Name)
+		}
+		if !e.hdr.ModTime.Equal(time.Unix(0, 0)) {
+			t.Fatalf("want the Unix epoch but got %v", e.hdr.ModTime)
+		}
+		byName[e.hdr.Name] = e
+	}
+
+	cases := []struct {
+		name     string
+		wantMode string
+		wantUID  int
+		wantGID  int
+	}{
+		{"dev", "drwxr-xr-x", 0, 0},
+		{"dev/console", "Dcrw-------", 0, 0},
+		{"dev/vda", "Drw-rw----", 0, 6},
+		{"home/user", "drwxr-x---", 1000, 1000},
+		{"init", "Lrwxrwxrwx", 0, 0},
+		{"root/.ssh", "drwx------", 0, 0},
+		{"root/.ssh/authorized_keys", "-rw-------", 0, 0},
+		{"usr/bin/agent", "-rwxr-xr-x", 0, 0},
+	}
+	for _, tc := range cases {
+		e := byName[tc.name]
+		if got := e.hdr.FileMode().String(); got != tc.wantMode {
+			t.Fatalf("%s: want mode %s but got %s", tc.name, tc.wantMode, got)
+		}
+		if e.hdr.UID != tc.wantUID || e.hdr.GID != tc.wantGID {
+			t.Fatalf("%s: want owner %d:%d but got %d:%d", tc.name, tc.wantUID, tc.wantGID, e.hdr.UID, e.hdr.GID)
+		}
+	}
+	if got := byName["init"].hdr.Linkname; got != "/usr/bin/agent" {
+		t.Fatalf("want link to /usr/bin/agent but got %q", got)
+	}
+	if got := byName["dev/console"].hdr; got.RDevMajor != 5 || got.RDevMinor != 1 {
+		t.Fatalf("want device 5:1 but got %d:%d", got.RDevMajor, got.RDevMinor)
+	}
+	if got := byName["usr/bin/agent"].data; got != "#!/bin/sh\necho agent\n" {
+		t.Fatalf("unexpected data: %q", got)
+	}
+}
+
+func TestOverlayReproducible(t *testing.T) {
+	a, err := newTestOverlay(t, false).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newTestOverlay(t, true).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Fatal("want the same archive regardless of the order of additions")
+	}
+}
+
+func TestOverlayInvalidPath(t *testing.T) {
+	o := initramfs.NewOverlay()
+	for _, name := range []string{"", "/", ".", "../..", "TRAILER!!!"} {
+		if err := o.AddFile(name, nil, 0o644); !errors.Is(err, initramfs.ErrInvalidPath) {
+			t.Fatalf("%q: want %v but got %v", name, initramfs.ErrInvalidPath, err)
+		}
+	}
+	if err := o.AddSymlink("a", ""); !errors.Is(err, initramfs.ErrInvalidPath) {
+		t.Fatalf("want %v but got %v", initramfs.ErrInvalidPath, err)
+	}
+}
+
+// writeBaseInitrd writes a gzip compressed initramfs which has "init" and "etc/hostname".
+// The size is not aligned to 4 bytes on purpose.
+func writeBaseInitrd(t *testing.T, path string) {
+	t.Helper()
+	base := initramfs.NewOverlay()
+	if err := base.AddFile("init", []byte("#!/bin/sh\nexec /sbin/init\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := base.AddFile("etc/hostname", []byte("base\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := base.WriteTo(zw); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len()%4 == 0 {
+		buf.WriteByte(0)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppendFile(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "initrd.gz")
+	writeBaseInitrd(t, base)
+
+	agent := filepath.Join(dir, "agent")
+	if err := os.WriteFile(agent, []byte("\x7fELF agent"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	overlay := initramfs.NewOverlay(initramfs.WithModTime(time.Unix(1700000000, 0)))
+	if err := overlay.AddFileFromPath("usr/bin/agent", agent, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := overlay.AddFile("etc/hostname", []byte("overlay\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		opts []initramfs.AppendOption
+	}{
+		{"uncompressed", nil},
+		{"gzip", []initramfs.AppendOption{initramfs.WithGzip()}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dst := filepath.Join(dir, tc.name+".img")
+			if err := initramfs.AppendFile(dst, base, overlay, tc.opts...); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			var names []string
+			files := make(map[string]string)
+			for _, e := range readAll(t, f) {
+				names = append(names, e.hdr.Name)
+				// later entries replace earlier entries like the kernel does.
+				files[e.hdr.Name] = e.data
+			}
+			want := []string{"etc", "etc/hostname", "init", "etc", "etc/hostname", "usr", "usr/bin", "usr/bin/agent"}
+			if !reflect.DeepEqual(want, names) {
+				t.Fatalf("want %v but got %v", want, names)
+			}
+			if got := files["etc/hostname"]; got != "overlay\n" {
+				t.Fatalf("want the overlay to replace the base but got %q", got)
+			}
+			if got := files["usr/bin/agent"]; got != "\x7fELF agent" {
+				t.Fatalf("unexpected agent: %q", got)
+			}
+
+			// The output is reproducible.
+			dst2 := filepath.Join(dir, tc.name+"-2.img")
+			if err := initramfs.AppendFile(dst2, base, overlay, tc.opts...); err != nil {
+				t.Fatal(err)
+			}
+			a, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(dst2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(a, b) {
+				t.Fatal("want the same output for the same input")
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+package fileutil
+
+import "golang.org/x/sys/unix"
+
+func clone(dst, src string) error {
+	return unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
+}
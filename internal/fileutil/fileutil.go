@@ -0,0 +1,69 @@
+//go:build darwin || linux
+// +build darwin linux
+
+// Package fileutil copies large files such as disk images without allocating the
+// blocks which are not used.
+package fileutil
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// CopySparse copies src to dst without writing the blocks of zero bytes, so that
+// the copies of sparse disk images stay sparse. dst is truncated if it exists.
+func CopySparse(dst, src string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	buf := make([]byte, 1<<20)
+	zero := make([]byte, len(buf))
+	var off int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 && !bytes.Equal(buf[:n], zero[:n]) {
+			if _, err := w.WriteAt(buf[:n], off); err != nil {
+				return err
+			}
+		}
+		off += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := w.Truncate(off); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// Clone copies src to dst, replacing dst. The file is cloned with clonefile(2) on
+// APFS or FICLONE on Linux, which shares the blocks until either file is written,
+// and it is copied with CopySparse on the file systems which do not support it.
+func Clone(dst, src string) error {
+	if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := clone(dst, src); err == nil {
+		return nil
+	}
+	// clone may leave an empty file behind.
+	if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return CopySparse(dst, src)
+}
@@ -0,0 +1,52 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package fileutil_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/internal/fileutil"
+)
+
+func TestCopy(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.img")
+	// A hole in the middle and data at both ends.
+	want := make([]byte, 3<<20)
+	copy(want, "head")
+	copy(want[len(want)-4:], "tail")
+	if err := os.WriteFile(src, want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		copy func(dst, src string) error
+	}{
+		{"CopySparse", fileutil.CopySparse},
+		{"Clone", fileutil.Clone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(dir, tt.name+".img")
+			// The existing file is replaced.
+			if err := os.WriteFile(dst, bytes.Repeat([]byte{1}, 4<<20), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.copy(dst, src); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("want the same content of %d bytes but got %d bytes", len(want), len(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+// Package fstree provides an in-memory tree of files and directories which is
+// shared by the file system image writers.
+package fstree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrInvalidPath is returned when the path of an entry is invalid.
+var ErrInvalidPath = errors.New("invalid path")
+
+// Node is a file, a directory, a symbolic link, a hard link or a special file in Tree.
+type Node struct {
+	// Name is the base name of the node. It is empty for the root directory.
+	Name string
+
+	// Mode is the type and the permission bits of the node.
+	Mode fs.FileMode
+
+	// UID and GID are the owner of the node.
+	UID, GID int
+
+	// ModTime is the modification time of the node.
+	ModTime time.Time
+
+	// Linkname is the target of the symbolic link.
+	Linkname string
+
+	// Link is the node which the hard link refers to. It is nil unless the node is
+	// a hard link.
+	Link *Node
+
+	// DevMajor and DevMinor are the device number of the device node.
+	DevMajor, DevMinor uint32
+
+	// Xattrs are the extended attributes of the node, such as "security.capability".
+	// Writers which do not support extended attributes ignore them.
+	Xattrs map[string][]byte
+
+	// Parent is the parent directory. It is nil for the root directory.
+	Parent *Node
+
+	data     []byte
+	src      string
+	ra       io.ReaderAt
+	size     int64
+	children []*Node
+}
+
+// IsDir reports whether the node is a directory.
+func (n *Node) IsDir() bool {
+	return n.Mode.IsDir()
+}
+
+// Size returns the size of the content of the regular file.
+func (n *Node) Size() int64 {
+	return n.size
+}
+
+// Children returns the entries of the directory sorted by name.
+func (n *Node) Children() []*Node {
+	return n.children
+}
+
+// Path returns the slash-separated path of the node from the root, such as "a/b".
+// It returns "" for the root directory.
+func (n *Node) Path() string {
+	if n.Parent == nil {
+		return ""
+	}
+	if p := n.Parent.Path(); p != "" {
+		return p + "/" + n.Name
+	}
+	return n.Name
+}
+
+// Open opens the content of the regular file.
+func (n *Node) Open() (io.ReadCloser, error) {
+	if n.Link != nil {
+		return n.Link.Open()
+	}
+	if n.ra != nil {
+		return io.NopCloser(io.NewSectionReader(n.ra, 0, n.size)), nil
+	}
+	if n.src == "" {
+		return io.NopCloser(bytes.NewReader(n.data)), nil
+	}
+	f, err := os.Open(n.src)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size() != n.size {
+		f.Close()
+		return nil, fmt.Errorf("%q has been changed after it was added", n.src)
+	}
+	return f, nil
+}
+
+// Tree is a tree of nodes whose root is a directory.
+type Tree struct {
+	root    *Node
+	modTime time.Time
+}
+
+// New creates a new Tree which has only the root directory. modTime is used for
+// the root and the implicit parent directories.
+func New(modTime time.Time) *Tree {
+	return &Tree{
+		root: &Node{
+			Mode:    fs.ModeDir | 0o755,
+			ModTime: modTime,
+		},
+		modTime: modTime,
+	}
+}
+
+// Root returns the root directory.
+func (t *Tree) Root() *Node {
+	return t.root
+}
+
+// Clean converts name to the form which is used in Tree, such as "a/b".
+func Clean(name string) (string, error) {
+	cleaned := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if cleaned == "" {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPath, name)
+	}
+	return cleaned, nil
+}
+
+// AddFile adds a regular file which has the data.
+func (t *Tree) AddFile(name string, data []byte, perm fs.FileMode) (*Node, error) {
+	return t.add(name, &Node{
+		Mode: perm.Perm(),
+		data: data,
+		size: int64(len(data)),
+	})
+}
+
+// AddFileFromPath adds a regular file whose content is read from src on the host
+// when it is opened.
+func (t *Tree) AddFileFromPath(name, src string, perm fs.FileMode) (*Node, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: %q is not a regular file", ErrInvalidPath, src)
+	}
+	return t.add(name, &Node{
+		Mode: perm.Perm(),
+		src:  src,
+		size: fi.Size(),
+	})
+}
+
+// AddFileFromReaderAt adds a regular file whose content is the first size bytes of
+// r. r must not be changed until the tree is written.
+func (t *Tree) AddFileFromReaderAt(name string, r io.ReaderAt, size int64, perm fs.FileMode) (*Node, error) {
+	return t.add(name, &Node{
+		Mode: perm.Perm(),
+		ra:   r,
+		size: size,
+	})
+}
+
+// AddDir adds a directory. If the directory already exists, its mode is updated.
+func (t *Tree) AddDir(name string, perm fs.FileMode) (*Node, error) {
+	return t.add(name, &Node{Mode: fs.ModeDir | perm.Perm()})
+}
+
+// AddSymlink adds a symbolic link which points to target.
+func (t *Tree) AddSymlink(name, target string) (*Node, error) {
+	if target == "" {
+		return nil, fmt.Errorf("%w: empty symbolic link target", ErrInvalidPath)
+	}
+	return t.add(name, &Node{
+		Mode:     fs.ModeSymlink | 0o777,
+		Linkname: target,
+		size:     int64(len(target)),
+	})
+}
+
+// AddSpecialFile adds a device node, a named pipe or a socket. mode has the type bits,
+// such as fs.ModeDevice|fs.ModeCharDevice for a character device.
+func (t *Tree) AddSpecialFile(name string, mode fs.FileMode, major, minor uint32) (*Node, error) {
+	switch mode.Type() {
+	case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice, fs.ModeNamedPipe, fs.ModeSocket:
+	default:
+		return nil, fmt.Errorf("%w: unsupported file type %v", ErrInvalidPath, mode.Type())
+	}
+	return t.add(name, &Node{
+		Mode:     mode.Type() | mode.Perm(),
+		DevMajor: major,
+		DevMinor: minor,
+	})
+}
+
+// AddHardlink adds a hard link to the existing entry target, which must not be a
+// directory. The hard link shares the content and the attributes of target.
+func (t *Tree) AddHardlink(name, target string) (*Node, error) {
+	orig := t.Lookup(target)
+	if orig == nil || orig.IsDir() {
+		return nil, fmt.Errorf("%w: invalid hard link target %q", ErrInvalidPath, target)
+	}
+	if orig.Link != nil {
+		orig = orig.Link
+	}
+	if n := t.Lookup(name); n != nil && (n == orig || n.Link == orig) {
+		// It is already linked.
+		return n, nil
+	}
+	return t.add(name, &Node{
+		Mode: orig.Mode,
+		Link: orig,
+		size: orig.size,
+	})
+}
+
+// Lookup returns the node of name, or nil if it does not exist. It returns the root
+// directory for "/" or ".".
+func (t *Tree) Lookup(name string) *Node {
+	n := t.root
+	cleaned := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if cleaned == "" {
+		return n
+	}
+	for _, elem := range strings.Split(cleaned, "/") {
+		if n = n.lookup(elem); n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// Remove removes the entry of name and its descendants. It does nothing if the entry
+// does not exist. The hard links to the removed entries are kept.
+func (t *Tree) Remove(name string) error {
+	cleaned, err := Clean(name)
+	if err != nil {
+		return err
+	}
+	if n := t.Lookup(cleaned); n != nil {
+		n.Parent.remove(n)
+	}
+	return nil
+}
+
+func (t *Tree) add(name string, n *Node) (*Node, error) {
+	cleaned, err := Clean(name)
+	if err != nil {
+		return nil, err
+	}
+	dir := t.root
+	elems := strings.Split(cleaned, "/")
+	for _, elem := range elems[:len(elems)-1] {
+		child := dir.lookup(elem)
+		if child == nil {
+			child = &Node{
+				Name:    elem,
+				Mode:    fs.ModeDir | 0o755,
+				ModTime: t.modTime,
+			}
+			dir.insert(child)
+		} else if !child.IsDir() {
+			return nil, fmt.Errorf("%w: %q is not a directory", ErrInvalidPath, child.Path())
+		}
+		dir = child
+	}
+
+	n.Name = elems[len(elems)-1]
+	n.ModTime = t.modTime
+	if old := dir.lookup(n.Name); old != nil {
+		if old.IsDir() != n.IsDir() {
+			return nil, fmt.Errorf("%w: %q already exists", ErrInvalidPath, cleaned)
+		}
+		if old.IsDir() {
+			// Keep the entries of the existing directory.
+			old.Mode = n.Mode
+			return old, nil
+		}
+		dir.remove(old)
+	}
+	dir.insert(n)
+	return n, nil
+}
+
+func (n *Node) lookup(name string) *Node {
+	i := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].Name >= name
+	})
+	if i < len(n.children) && n.children[i].Name == name {
+		return n.children[i]
+	}
+	return nil
+}
+
+func (n *Node) insert(child *Node) {
+	child.Parent = n
+	i := sort.Search(len(n.children), func(i int) bool {
+		return n.children[i].Name >= child.Name
+	})
+	n.children = append(n.children, nil)
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = child
+}
+
+func (n *Node) remove(child *Node) {
+	for i, c := range n.children {
+		if c == child {
+			n.children = append(n.children[:i], n.children[i+1:]...)
+			return
+		}
+	}
+}
+
+// Walk calls fn for each node in the tree in depth-first order, starting from the
+// root. A directory is visited before its entries, which are visited in name order.
+func (t *Tree) Walk(fn func(n *Node) error) error {
+	return walk(t.root, fn)
+}
+
+func walk(n *Node, fn func(n *Node) error) error {
+	if err := fn(n); err != nil {
+		return err
+	}
+	for _, child := range n.children {
+		if err := walk(child, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package fstree_test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/internal/fstree"
+)
+
+func TestTree(t *testing.T) {
+	tree := fstree.New(time.Unix(0, 0))
+	if _, err := tree.AddFile("/b/c", []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.AddFile("b/c", []byte("new"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.AddDir("a", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.AddSymlink("a/link", "../b/c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.AddDir("b", 0o750); err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	var modes []fs.FileMode
+	err := tree.Walk(func(n *fstree.Node) error {
+		paths = append(paths, n.Path())
+		modes = append(modes, n.Mode)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPaths := []string{"", "a", "a/link", "b", "b/c"}
+	if !reflect.DeepEqual(wantPaths, paths) {
+		t.Fatalf("want %q but got %q", wantPaths, paths)
+	}
+	wantModes := []fs.FileMode{fs.ModeDir | 0o755, fs.ModeDir | 0o700, fs.ModeSymlink | 0o777, fs.ModeDir | 0o750, 0o600}
+	if !reflect.DeepEqual(wantModes, modes) {
+		t.Fatalf("want %v but got %v", wantModes, modes)
+	}
+
+	c := tree.Root().Children()[1].Children()[0]
+	r, err := c.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new" || c.Size() != 3 {
+		t.Fatalf("want the replaced content but got %q", data)
+	}
+}
+
+func TestTreeError(t *testing.T) {
+	tree := fstree.New(time.Unix(0, 0))
+	if _, err := tree.AddFile("a", nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cases := []func() error{
+		func() error { _, err := tree.AddFile("/", nil, 0o644); return err },
+		func() error { _, err := tree.AddFile("a/b", nil, 0o644); return err },
+		func() error { _, err := tree.AddDir("a", 0o755); return err },
+		func() error { _, err := tree.AddSymlink("c", ""); return err },
+	}
+	for i, add := range cases {
+		if err := add(); !errors.Is(err, fstree.ErrInvalidPath) {
+			t.Fatalf("%d: want %v but got %v", i, fstree.ErrInvalidPath, err)
+		}
+	}
+}
+
+func TestTreeLinksAndRemove(t *testing.T) {
+	tree := fstree.New(time.Unix(0, 0))
+	src := strings.NewReader("0123456789")
+	if _, err := tree.AddFileFromReaderAt("a/file", src, 4, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	link, err := tree.AddHardlink("b/link", "/a/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := tree.AddHardlink("b/link2", "b/link"); err != nil || again.Link != link.Link {
+		t.Fatalf("want the link to the original file but got %+v, %v", again, err)
+	}
+	if _, err := tree.AddSpecialFile("dev/null", fs.ModeDevice|fs.ModeCharDevice|0o666, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.AddSpecialFile("dev/file", 0o666, 0, 0); !errors.Is(err, fstree.ErrInvalidPath) {
+		t.Fatalf("want %v but got %v", fstree.ErrInvalidPath, err)
+	}
+	if _, err := tree.AddHardlink("c", "a"); !errors.Is(err, fstree.ErrInvalidPath) {
+		t.Fatalf("want %v for the directory but got %v", fstree.ErrInvalidPath, err)
+	}
+
+	if err := tree.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Remove("missing"); err != nil {
+		t.Fatal(err)
+	}
+	if n := tree.Lookup("a/file"); n != nil {
+		t.Fatalf("want the removed file to be missing but got %+v", n)
+	}
+	if n := tree.Lookup("/dev/null"); n == nil || n.DevMajor != 1 || n.DevMinor != 3 {
+		t.Fatalf("want the device node but got %+v", n)
+	}
+	if tree.Lookup(".") != tree.Root() {
+		t.Fatal("want the root directory")
+	}
+
+	// The hard link keeps the content of the removed file.
+	r, err := tree.Lookup("b/link").Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "0123" || link.Size() != 4 {
+		t.Fatalf("want the content of the removed file but got %q", data)
+	}
+}
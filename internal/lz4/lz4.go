@@ -0,0 +1,402 @@
+// Package lz4 provides a decompressor for LZ4 streams.
+//
+// Both the frame format and the legacy format are supported. The legacy format
+// is used by the Linux kernel build system to compress kernel images and initrds.
+//
+// see: https://github.com/lz4/lz4/blob/dev/doc/lz4_Frame_format.md
+// see: https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md
+package lz4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// FrameMagic is the magic number of the LZ4 frame format.
+	FrameMagic = 0x184D2204
+
+	// LegacyMagic is the magic number of the LZ4 legacy format.
+	LegacyMagic = 0x184C2102
+
+	skippableMagicMask = 0xFFFFFFF0
+	skippableMagic     = 0x184D2A50
+
+	legacyBlockSize = 8 << 20
+
+	// windowSize is the maximum distance of a match.
+	windowSize = 64 << 10
+)
+
+// ErrCorrupt is returned when the stream is not a valid LZ4 stream.
+var ErrCorrupt = errors.New("lz4: corrupt input")
+
+// Reader implements io.Reader to read an LZ4 compressed stream.
+//
+// The stream may consist of multiple concatenated frames, and skippable frames
+// are ignored.
+type Reader struct {
+	r io.Reader
+
+	// format of the current frame. zero if the next frame has not been started.
+	magic uint32
+
+	// frame descriptor of the current frame.
+	blockChecksum   bool
+	contentChecksum bool
+	independent     bool
+	blockMaxSize    int
+	contentHash     xxhash32
+
+	// buffer holds the history window followed by the decompressed data of
+	// the current block. buffer[off:] is not read yet.
+	buffer []byte
+	off    int
+
+	compressed []byte
+	scratch    [8]byte
+
+	// peekedMagic is set when the legacy stream was terminated by the magic
+	// number of the next frame.
+	peekedMagic *uint32
+
+	err error
+}
+
+// NewReader creates a new Reader that decompresses data from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Read implements io.Reader.
+func (r *Reader) Read(p []byte) (int, error) {
+	for r.off >= len(r.buffer) {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if err := r.refill(); err != nil {
+			r.err = err
+			if r.off >= len(r.buffer) {
+				return 0, err
+			}
+		}
+	}
+	n := copy(p, r.buffer[r.off:])
+	r.off += n
+	return n, nil
+}
+
+// refill decompresses the next block into the buffer.
+func (r *Reader) refill() error {
+	for {
+		if r.magic == 0 {
+			if err := r.readFrameHeader(); err != nil {
+				return err
+			}
+		}
+		var (
+			done bool
+			err  error
+		)
+		switch r.magic {
+		case LegacyMagic:
+			done, err = r.readLegacyBlock()
+		case FrameMagic:
+			done, err = r.readBlock()
+		}
+		if err != nil {
+			return err
+		}
+		if !done {
+			return nil
+		}
+		r.magic = 0
+	}
+}
+
+func (r *Reader) readFrameHeader() error {
+	var magic uint32
+	if r.peekedMagic != nil {
+		magic = *r.peekedMagic
+		r.peekedMagic = nil
+	} else {
+		if _, err := io.ReadFull(r.r, r.scratch[:4]); err != nil {
+			// io.EOF at a frame boundary is the end of the stream.
+			if err == io.ErrUnexpectedEOF {
+				return ErrCorrupt
+			}
+			return err
+		}
+		magic = binary.LittleEndian.Uint32(r.scratch[:4])
+	}
+
+	switch {
+	case magic == LegacyMagic:
+		r.magic = magic
+		r.independent = false
+		r.blockMaxSize = legacyBlockSize
+		r.resetWindow()
+		return nil
+	case magic == FrameMagic:
+		return r.readFrameDescriptor()
+	case magic&skippableMagicMask == skippableMagic:
+		if _, err := io.ReadFull(r.r, r.scratch[:4]); err != nil {
+			return unexpectedEOF(err)
+		}
+		size := int64(binary.LittleEndian.Uint32(r.scratch[:4]))
+		if _, err := io.CopyN(io.Discard, r.r, size); err != nil {
+			return unexpectedEOF(err)
+		}
+		return r.readFrameHeader()
+	default:
+		return fmt.Errorf("%w: invalid magic number %#x", ErrCorrupt, magic)
+	}
+}
+
+func (r *Reader) readFrameDescriptor() error {
+	var desc [2 + 8 + 4 + 1]byte
+	if _, err := io.ReadFull(r.r, desc[:2]); err != nil {
+		return unexpectedEOF(err)
+	}
+	flg, bd := desc[0], desc[1]
+	if version := flg >> 6; version != 1 {
+		return fmt.Errorf("%w: unsupported version %d", ErrCorrupt, version)
+	}
+	if flg&0x02 != 0 || bd&0x8f != 0 {
+		return fmt.Errorf("%w: reserved bits are set", ErrCorrupt)
+	}
+	if flg&0x01 != 0 {
+		return errors.New("lz4: dictionaries are not supported")
+	}
+	n := 2
+	if flg&0x08 != 0 {
+		// content size is only informational.
+		n += 8
+	}
+	// header checksum.
+	n++
+	if _, err := io.ReadFull(r.r, desc[2:n]); err != nil {
+		return unexpectedEOF(err)
+	}
+	if want := byte(xxhash32Sum(desc[:n-1]) >> 8); desc[n-1] != want {
+		return fmt.Errorf("%w: header checksum mismatch", ErrCorrupt)
+	}
+
+	switch (bd >> 4) & 0x7 {
+	case 4:
+		r.blockMaxSize = 64 << 10
+	case 5:
+		r.blockMaxSize = 256 << 10
+	case 6:
+		r.blockMaxSize = 1 << 20
+	case 7:
+		r.blockMaxSize = 4 << 20
+	default:
+		return fmt.Errorf("%w: invalid block maximum size", ErrCorrupt)
+	}
+	r.magic = FrameMagic
+	r.independent = flg&0x20 != 0
+	r.blockChecksum = flg&0x10 != 0
+	r.contentChecksum = flg&0x04 != 0
+	r.contentHash.reset()
+	r.resetWindow()
+	return nil
+}
+
+// resetWindow discards the history of the previous frame.
+func (r *Reader) resetWindow() {
+	r.buffer = r.buffer[:0]
+	r.off = 0
+}
+
+// readBlock reads a block of the frame format. It reports whether the end of
+// the frame has been reached.
+func (r *Reader) readBlock() (bool, error) {
+	if _, err := io.ReadFull(r.r, r.scratch[:4]); err != nil {
+		return false, unexpectedEOF(err)
+	}
+	size := binary.LittleEndian.Uint32(r.scratch[:4])
+	if size == 0 {
+		// end mark.
+		if r.contentChecksum {
+			if _, err := io.ReadFull(r.r, r.scratch[:4]); err != nil {
+				return false, unexpectedEOF(err)
+			}
+			if binary.LittleEndian.Uint32(r.scratch[:4]) != r.contentHash.digest() {
+				return false, fmt.Errorf("%w: content checksum mismatch", ErrCorrupt)
+			}
+		}
+		return true, nil
+	}
+	uncompressed := size&0x80000000 != 0
+	size &^= 0x80000000
+	if int(size) > r.blockMaxSize {
+		return false, fmt.Errorf("%w: block size %d exceeds the maximum %d", ErrCorrupt, size, r.blockMaxSize)
+	}
+
+	data, err := r.readCompressed(int(size))
+	if err != nil {
+		return false, err
+	}
+	if r.blockChecksum {
+		if _, err := io.ReadFull(r.r, r.scratch[:4]); err != nil {
+			return false, unexpectedEOF(err)
+		}
+		if binary.LittleEndian.Uint32(r.scratch[:4]) != xxhash32Sum(data) {
+			return false, fmt.Errorf("%w: block checksum mismatch", ErrCorrupt)
+		}
+	}
+
+	start := r.prepareBuffer()
+	if uncompressed {
+		r.buffer = append(r.buffer, data...)
+	} else {
+		r.buffer, err = decodeBlock(r.buffer, data, r.blockMaxSize)
+		if err != nil {
+			return false, err
+		}
+	}
+	if r.contentChecksum {
+		r.contentHash.update(r.buffer[start:])
+	}
+	return false, nil
+}
+
+// readLegacyBlock reads a block of the legacy format. It reports whether the
+// end of the legacy stream has been reached.
+func (r *Reader) readLegacyBlock() (bool, error) {
+	_, err := io.ReadFull(r.r, r.scratch[:4])
+	if err == io.EOF {
+		return true, nil
+	}
+	if err != nil {
+		return false, unexpectedEOF(err)
+	}
+	size := binary.LittleEndian.Uint32(r.scratch[:4])
+	if size == LegacyMagic || size == FrameMagic || size&skippableMagicMask == skippableMagic {
+		// a new frame is concatenated.
+		r.peekedMagic = &size
+		return true, nil
+	}
+	// compressed blocks are never larger than LZ4_compressBound(8 MiB).
+	if int(size) > legacyBlockSize+legacyBlockSize/255+16 {
+		return false, fmt.Errorf("%w: block size %d is too large", ErrCorrupt, size)
+	}
+	data, err := r.readCompressed(int(size))
+	if err != nil {
+		return false, err
+	}
+	r.prepareBuffer()
+	r.buffer, err = decodeBlock(r.buffer, data, legacyBlockSize)
+	return false, err
+}
+
+func (r *Reader) readCompressed(size int) ([]byte, error) {
+	if cap(r.compressed) < size {
+		r.compressed = make([]byte, size)
+	}
+	r.compressed = r.compressed[:size]
+	if _, err := io.ReadFull(r.r, r.compressed); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return r.compressed, nil
+}
+
+// prepareBuffer keeps the history which may be referenced by the next block
+// and returns the offset where the next block starts.
+func (r *Reader) prepareBuffer() int {
+	keep := 0
+	if !r.independent {
+		keep = min(len(r.buffer), windowSize)
+	}
+	copy(r.buffer, r.buffer[len(r.buffer)-keep:])
+	r.buffer = r.buffer[:keep]
+	r.off = keep
+	return keep
+}
+
+// decodeBlock decodes an LZ4 block and appends the result to dst.
+// Matches may refer to the data which is already in dst.
+func decodeBlock(dst, src []byte, maxSize int) ([]byte, error) {
+	base := len(dst)
+	for i := 0; ; {
+		if i >= len(src) {
+			return nil, ErrCorrupt
+		}
+		token := src[i]
+		i++
+
+		litLen := int(token >> 4)
+		if litLen == 15 {
+			n, next, err := readLength(src, i)
+			if err != nil {
+				return nil, err
+			}
+			litLen += n
+			i = next
+		}
+		if litLen > len(src)-i || len(dst)-base+litLen > maxSize {
+			return nil, ErrCorrupt
+		}
+		dst = append(dst, src[i:i+litLen]...)
+		i += litLen
+		if i == len(src) {
+			// the last sequence has only literals.
+			return dst, nil
+		}
+
+		if len(src)-i < 2 {
+			return nil, ErrCorrupt
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, fmt.Errorf("%w: invalid match offset %d", ErrCorrupt, offset)
+		}
+		matchLen := int(token&0xf) + 4
+		if matchLen == 19 {
+			n, next, err := readLength(src, i)
+			if err != nil {
+				return nil, err
+			}
+			matchLen += n
+			i = next
+		}
+		if len(dst)-base+matchLen > maxSize {
+			return nil, ErrCorrupt
+		}
+		start := len(dst) - offset
+		if offset >= matchLen {
+			dst = append(dst, dst[start:start+matchLen]...)
+			continue
+		}
+		// overlapping match repeats the last offset bytes.
+		for j := 0; j < matchLen; j++ {
+			dst = append(dst, dst[start+j])
+		}
+	}
+}
+
+func readLength(src []byte, i int) (int, int, error) {
+	n := 0
+	for {
+		if i >= len(src) {
+			return 0, 0, ErrCorrupt
+		}
+		b := src[i]
+		i++
+		n += int(b)
+		if b != 255 {
+			return n, i, nil
+		}
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,186 @@
+package lz4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sampleData returns the uncompressed content of the files in testdata.
+func sampleData() []byte {
+	var b bytes.Buffer
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&b, "%d: the quick brown fox jumps over the lazy dog %d\n", i, i*i%1009)
+	}
+	return b.Bytes()
+}
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestReader(t *testing.T) {
+	want := sampleData()
+	cases := []string{
+		// linked blocks with the content size and the content checksum.
+		"linked.lz4",
+		// independent blocks with the block checksums and the content checksum.
+		"independent.lz4",
+		// the format used by the Linux kernel.
+		"legacy.lz4",
+	}
+	for _, name := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := io.ReadAll(NewReader(bytes.NewReader(readTestdata(t, name))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(want, got) {
+				t.Fatalf("want %d bytes but got %d bytes", len(want), len(got))
+			}
+		})
+	}
+}
+
+func TestReaderConcatenated(t *testing.T) {
+	skippable := binary.LittleEndian.AppendUint32(nil, skippableMagic+3)
+	skippable = binary.LittleEndian.AppendUint32(skippable, 5)
+	skippable = append(skippable, "hello"...)
+
+	var input []byte
+	input = append(input, readTestdata(t, "legacy.lz4")...)
+	input = append(input, readTestdata(t, "linked.lz4")...)
+	input = append(input, skippable...)
+	input = append(input, readTestdata(t, "independent.lz4")...)
+
+	got, err := io.ReadAll(NewReader(bytes.NewReader(input)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Repeat(sampleData(), 3)
+	if !bytes.Equal(want, got) {
+		t.Fatalf("want %d bytes but got %d bytes", len(want), len(got))
+	}
+}
+
+func TestReaderCorrupt(t *testing.T) {
+	linked := readTestdata(t, "linked.lz4")
+	independent := readTestdata(t, "independent.lz4")
+
+	flip := func(b []byte, i int) []byte {
+		b = append([]byte(nil), b...)
+		b[i] ^= 0xff
+		return b
+	}
+	cases := []struct {
+		name  string
+		input []byte
+	}{
+		{
+			name:  "invalid magic",
+			input: []byte("not lz4 at all"),
+		},
+		{
+			name:  "header checksum",
+			input: flip(linked, 6),
+		},
+		{
+			name:  "content checksum",
+			input: flip(linked, len(linked)-1),
+		},
+		{
+			name:  "block checksum",
+			input: flip(independent, 200),
+		},
+		{
+			name:  "truncated",
+			input: linked[:len(linked)/2],
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := io.ReadAll(NewReader(bytes.NewReader(tc.input)))
+			if err == nil {
+				t.Fatal("want error but got nil")
+			}
+			if !errors.Is(err, ErrCorrupt) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("want ErrCorrupt or io.ErrUnexpectedEOF but got %v", err)
+			}
+		})
+	}
+}
+
+func TestDecodeBlock(t *testing.T) {
+	cases := []struct {
+		name    string
+		src     []byte
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "literals only",
+			src:  []byte{0x50, 'h', 'e', 'l', 'l', 'o'},
+			want: "hello",
+		},
+		{
+			// "ab" followed by a match of offset 2 and length 6, then "c".
+			name: "overlapping match",
+			src:  []byte{0x22, 'a', 'b', 0x02, 0x00, 0x10, 'c'},
+			want: "abababab" + "c",
+		},
+		{
+			name:    "offset beyond the output",
+			src:     []byte{0x10, 'a', 0x05, 0x00, 0x10, 'c'},
+			wantErr: true,
+		},
+		{
+			name:    "truncated literals",
+			src:     []byte{0x50, 'h', 'e'},
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := decodeBlock(nil, tc.src, 1<<20)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("want error but got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Fatalf("want %q but got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestXXHash32(t *testing.T) {
+	cases := []struct {
+		input string
+		want  uint32
+	}{
+		{"", 0x02cc5d05},
+		{"a", 0x550d7456},
+		{"abc", 0x32d153ff},
+		{"Nobody inspects the spammish repetition", 0xe2293b2f},
+	}
+	for _, tc := range cases {
+		if got := xxhash32Sum([]byte(tc.input)); got != tc.want {
+			t.Fatalf("%q: want %#x but got %#x", tc.input, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package lz4
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// xxhash32 is the 32-bit xxHash which is used by the checksums of the frame format.
+//
+// see: https://github.com/Cyan4973/xxHash/blob/dev/doc/xxhash_spec.md
+type xxhash32 struct {
+	v     [4]uint32
+	total uint64
+	buf   [16]byte
+	n     int
+}
+
+const (
+	prime32_1 = 2654435761
+	prime32_2 = 2246822519
+	prime32_3 = 3266489917
+	prime32_4 = 668265263
+	prime32_5 = 374761393
+)
+
+func (h *xxhash32) reset() {
+	p1, p2 := uint32(prime32_1), uint32(prime32_2)
+	h.v[0] = p1 + p2
+	h.v[1] = p2
+	h.v[2] = 0
+	h.v[3] = -p1
+	h.total = 0
+	h.n = 0
+}
+
+func xxhash32Round(acc, lane uint32) uint32 {
+	acc += lane * prime32_2
+	acc = bits.RotateLeft32(acc, 13)
+	return acc * prime32_1
+}
+
+func (h *xxhash32) update(p []byte) {
+	h.total += uint64(len(p))
+	if h.n > 0 {
+		c := copy(h.buf[h.n:], p)
+		h.n += c
+		p = p[c:]
+		if h.n < len(h.buf) {
+			return
+		}
+		h.stripe(h.buf[:])
+		h.n = 0
+	}
+	for len(p) >= 16 {
+		h.stripe(p[:16])
+		p = p[16:]
+	}
+	h.n = copy(h.buf[:], p)
+}
+
+func (h *xxhash32) stripe(p []byte) {
+	for i := range h.v {
+		h.v[i] = xxhash32Round(h.v[i], binary.LittleEndian.Uint32(p[i*4:]))
+	}
+}
+
+func (h *xxhash32) digest() uint32 {
+	var acc uint32
+	if h.total >= 16 {
+		acc = bits.RotateLeft32(h.v[0], 1) + bits.RotateLeft32(h.v[1], 7) +
+			bits.RotateLeft32(h.v[2], 12) + bits.RotateLeft32(h.v[3], 18)
+	} else {
+		acc = h.v[2] + prime32_5
+	}
+	acc += uint32(h.total)
+
+	p := h.buf[:h.n]
+	for len(p) >= 4 {
+		acc += binary.LittleEndian.Uint32(p) * prime32_3
+		acc = bits.RotateLeft32(acc, 17) * prime32_4
+		p = p[4:]
+	}
+	for _, b := range p {
+		acc += uint32(b) * prime32_5
+		acc = bits.RotateLeft32(acc, 11) * prime32_1
+	}
+
+	acc ^= acc >> 15
+	acc *= prime32_2
+	acc ^= acc >> 13
+	acc *= prime32_3
+	acc ^= acc >> 16
+	return acc
+}
+
+func xxhash32Sum(p []byte) uint32 {
+	var h xxhash32
+	h.reset()
+	h.update(p)
+	return h.digest()
+}
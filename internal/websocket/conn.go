@@ -0,0 +1,347 @@
+// Package websocket implements the minimum of the WebSocket protocol (RFC 6455)
+// which is needed to serve and test browser based consoles.
+//
+// see: https://www.rfc-editor.org/rfc/rfc6455
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageType is the type of a data message.
+type MessageType int
+
+// Opcodes defined in RFC 6455 section 5.2.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+const (
+	// TextMessage denotes a text data message. The payload is UTF-8 encoded text.
+	TextMessage MessageType = opText
+	// BinaryMessage denotes a binary data message.
+	BinaryMessage MessageType = opBinary
+)
+
+// Close codes defined in RFC 6455 section 7.4.1.
+const (
+	CloseNormalClosure     = 1000
+	CloseGoingAway         = 1001
+	CloseProtocolError     = 1002
+	CloseUnsupportedData   = 1003
+	CloseNoStatusReceived  = 1005
+	CloseInvalidPayload    = 1007
+	ClosePolicyViolation   = 1008
+	CloseMessageTooBig     = 1009
+	CloseInternalServerErr = 1011
+)
+
+// DefaultMaxMessageSize is the default maximum size of a received message.
+const DefaultMaxMessageSize = 1 << 20
+
+const maxControlPayloadSize = 125
+
+// CloseError is returned by ReadMessage when the peer closed the connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Reason)
+}
+
+// ErrClosed is returned when using a connection which has already been closed.
+var ErrClosed = errors.New("websocket: use of closed connection")
+
+// Conn is a WebSocket connection.
+//
+// ReadMessage must not be called concurrently, but WriteMessage and Close can be
+// called concurrently with each other and with ReadMessage.
+type Conn struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	isServer bool
+
+	// MaxMessageSize is the maximum size of a received message.
+	MaxMessageSize int
+
+	writeMu    sync.Mutex
+	closeSent  bool
+	closeOnce  sync.Once
+	readClosed bool
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, isServer bool) *Conn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	return &Conn{
+		conn:           conn,
+		br:             br,
+		isServer:       isServer,
+		MaxMessageSize: DefaultMaxMessageSize,
+	}
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// SetReadDeadline sets the read deadline on the underlying network connection.
+func (c *Conn) SetReadDeadline(t time.Time) error { return c.conn.SetReadDeadline(t) }
+
+// ReadMessage reads the next data message.
+//
+// Ping frames are answered automatically and pong frames are ignored.
+// If the peer sent a close frame, a close frame is sent back and *CloseError is returned.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	if c.readClosed {
+		return 0, nil, ErrClosed
+	}
+	var (
+		msgType MessageType
+		msg     []byte
+		started bool
+	)
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.readClosed = true
+			closeErr := parseClosePayload(payload)
+			code := closeErr.Code
+			if code == CloseNoStatusReceived {
+				code = CloseNormalClosure
+			}
+			c.writeClose(code, "")
+			c.conn.Close()
+			return 0, nil, closeErr
+		case opText, opBinary:
+			if started {
+				return 0, nil, c.fail(protocolError("data frame in the middle of a fragmented message"))
+			}
+			started = true
+			msgType = MessageType(opcode)
+		case opContinuation:
+			if !started {
+				return 0, nil, c.fail(protocolError("unexpected continuation frame"))
+			}
+		default:
+			return 0, nil, c.fail(protocolError(fmt.Sprintf("unknown opcode %#x", opcode)))
+		}
+
+		if len(msg)+len(payload) > c.MaxMessageSize {
+			return 0, nil, c.fail(&CloseError{Code: CloseMessageTooBig, Reason: "message too big"})
+		}
+		msg = append(msg, payload...)
+		if !fin {
+			continue
+		}
+		if msgType == TextMessage && !utf8.Valid(msg) {
+			return 0, nil, c.fail(&CloseError{Code: CloseInvalidPayload, Reason: "invalid UTF-8"})
+		}
+		return msgType, msg, nil
+	}
+}
+
+func protocolError(reason string) error {
+	return &CloseError{Code: CloseProtocolError, Reason: reason}
+}
+
+// fail closes the connection with the close code of err if it is a *CloseError.
+func (c *Conn) fail(err error) error {
+	var closeErr *CloseError
+	if errors.As(err, &closeErr) {
+		c.writeClose(closeErr.Code, closeErr.Reason)
+	}
+	c.readClosed = true
+	c.conn.Close()
+	return err
+}
+
+func parseClosePayload(payload []byte) *CloseError {
+	if len(payload) < 2 {
+		return &CloseError{Code: CloseNoStatusReceived}
+	}
+	return &CloseError{
+		Code:   int(binary.BigEndian.Uint16(payload)),
+		Reason: string(payload[2:]),
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = hdr[0]&0x80 != 0
+	if hdr[0]&0x70 != 0 {
+		return false, 0, nil, protocolError("reserved bits are set")
+	}
+	opcode = hdr[0] & 0x0f
+	masked := hdr[1]&0x80 != 0
+	if c.isServer && !masked {
+		return false, 0, nil, protocolError("client frame is not masked")
+	}
+	if !c.isServer && masked {
+		return false, 0, nil, protocolError("server frame is masked")
+	}
+
+	length := uint64(hdr[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if opcode >= opClose {
+		if !fin {
+			return false, 0, nil, protocolError("fragmented control frame")
+		}
+		if length > maxControlPayloadSize {
+			return false, 0, nil, protocolError("control frame too big")
+		}
+	}
+	if length > uint64(c.MaxMessageSize) {
+		return false, 0, nil, &CloseError{Code: CloseMessageTooBig, Reason: "message too big"}
+	}
+
+	var maskKey [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, maskKey[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		maskBytes(maskKey, payload)
+	}
+	return fin, opcode, payload, nil
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
+
+// WriteMessage writes a data message.
+func (c *Conn) WriteMessage(msgType MessageType, data []byte) error {
+	switch msgType {
+	case TextMessage, BinaryMessage:
+	default:
+		return fmt.Errorf("websocket: invalid message type %d", msgType)
+	}
+	return c.writeFrame(byte(msgType), data)
+}
+
+// Ping sends a ping frame.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayloadSize {
+		return errors.New("websocket: ping payload too big")
+	}
+	return c.writeFrame(opPing, data)
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|opcode)
+
+	var maskBit byte
+	if !c.isServer {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+
+	if c.isServer {
+		buf = append(buf, payload...)
+	} else {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		buf = append(buf, key[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		maskBytes(key, buf[start:])
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (c *Conn) writeClose(code int, reason string) error {
+	var payload []byte
+	if code != CloseNoStatusReceived {
+		if len(reason) > maxControlPayloadSize-2 {
+			reason = reason[:maxControlPayloadSize-2]
+		}
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	return c.writeFrame(opClose, payload)
+}
+
+// Close sends a close frame with the code and the reason, and closes the connection.
+func (c *Conn) Close(code int, reason string) error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.writeClose(code, reason)
+		err = c.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,121 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// rawFrame builds a masked client frame.
+func rawFrame(fin bool, opcode byte, payload []byte) []byte {
+	var b0 byte = opcode
+	if fin {
+		b0 |= 0x80
+	}
+	key := [4]byte{1, 2, 3, 4}
+	masked := append([]byte(nil), payload...)
+	maskBytes(key, masked)
+	frame := []byte{b0, 0x80 | byte(len(payload))}
+	frame = append(frame, key[:]...)
+	return append(frame, masked...)
+}
+
+func newPipeConn(t *testing.T) (*Conn, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	// drain frames sent by the server.
+	go io.Copy(io.Discard, client)
+	return newConn(server, nil, true), client
+}
+
+func TestReadFragmentedMessage(t *testing.T) {
+	conn, client := newPipeConn(t)
+	go func() {
+		client.Write(rawFrame(false, opText, []byte("hel")))
+		client.Write(rawFrame(true, opPing, []byte("p")))
+		client.Write(rawFrame(false, opContinuation, []byte("lo ")))
+		client.Write(rawFrame(true, opContinuation, []byte("world")))
+	}()
+	msgType, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgType != TextMessage || !bytes.Equal(msg, []byte("hello world")) {
+		t.Fatalf("unexpected message: %d %q", msgType, msg)
+	}
+}
+
+func TestReadProtocolErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		frames   [][]byte
+		wantCode int
+	}{
+		{
+			name:     "unmasked frame",
+			frames:   [][]byte{{0x81, 0x01, 'a'}},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name:     "unexpected continuation",
+			frames:   [][]byte{rawFrame(true, opContinuation, []byte("a"))},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name:     "fragmented control frame",
+			frames:   [][]byte{rawFrame(false, opPing, []byte("a"))},
+			wantCode: CloseProtocolError,
+		},
+		{
+			name:     "invalid utf-8",
+			frames:   [][]byte{rawFrame(true, opText, []byte{0xff, 0xfe})},
+			wantCode: CloseInvalidPayload,
+		},
+		{
+			name: "interleaved data frame",
+			frames: [][]byte{
+				rawFrame(false, opText, []byte("a")),
+				rawFrame(true, opBinary, []byte("b")),
+			},
+			wantCode: CloseProtocolError,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, client := newPipeConn(t)
+			go func() {
+				for _, frame := range tc.frames {
+					client.Write(frame)
+				}
+			}()
+			_, _, err := conn.ReadMessage()
+			var closeErr *CloseError
+			if !errors.As(err, &closeErr) {
+				t.Fatalf("want *CloseError but got %v", err)
+			}
+			if tc.wantCode != closeErr.Code {
+				t.Fatalf("want close code %d but got %d", tc.wantCode, closeErr.Code)
+			}
+		})
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	conn, client := newPipeConn(t)
+	conn.MaxMessageSize = 4
+	go func() {
+		client.Write(rawFrame(false, opBinary, []byte("abc")))
+		client.Write(rawFrame(true, opContinuation, []byte("def")))
+	}()
+	_, _, err := conn.ReadMessage()
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseMessageTooBig {
+		t.Fatalf("want close code %d but got %v", CloseMessageTooBig, err)
+	}
+}
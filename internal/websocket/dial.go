@@ -0,0 +1,95 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Dial opens a client connection to the WebSocket server at rawURL (ws://).
+// It is mainly intended for tests.
+func Dial(ctx context.Context, rawURL string, header http.Header) (*Conn, error) {
+	var d Dialer
+	return d.Dial(ctx, rawURL, header)
+}
+
+// Dialer opens client connections to WebSocket servers.
+type Dialer struct {
+	// NetDial dials the network connection to the host of the URL. If it is nil,
+	// net.Dialer is used. Set it to dial a server listening on a Unix socket.
+	NetDial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Dial opens a client connection to the WebSocket server at rawURL (ws://).
+func (d *Dialer) Dial(ctx context.Context, rawURL string, header http.Header) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+
+	dial := d.NetDial
+	if dial == nil {
+		var nd net.Dialer
+		dial = nd.DialContext
+	}
+	netConn, err := dial(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(netConn); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(netConn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		netConn.Close()
+		return nil, &HandshakeError{Status: resp.StatusCode, Reason: "unexpected status " + resp.Status}
+	}
+	if resp.Header.Get("Sec-Websocket-Accept") != computeAcceptKey(key) {
+		netConn.Close()
+		return nil, &HandshakeError{Status: resp.StatusCode, Reason: "mismatched 'Sec-WebSocket-Accept' header"}
+	}
+	return newConn(netConn, br, false), nil
+}
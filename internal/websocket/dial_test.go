@@ -0,0 +1,35 @@
+package websocket_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/internal/websocket"
+)
+
+func TestDialerNetDial(t *testing.T) {
+	srv := newEchoServer(t)
+	var dialed string
+	d := &websocket.Dialer{
+		NetDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = addr
+			var nd net.Dialer
+			return nd.DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+	}
+	conn, err := d.Dial(context.Background(), "ws://machine/console", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.CloseNormalClosure, "")
+	if dialed != "machine:80" {
+		t.Fatalf("want machine:80 but got %q", dialed)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "hello" {
+		t.Fatalf("want hello but got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,129 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// see: https://www.rfc-editor.org/rfc/rfc6455#section-1.3
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func computeAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// HandshakeError describes an error with the handshake from the peer.
+type HandshakeError struct {
+	Status int
+	Reason string
+}
+
+func (e *HandshakeError) Error() string { return "websocket: " + e.Reason }
+
+// Upgrader upgrades an HTTP connection to a WebSocket connection.
+type Upgrader struct {
+	// CheckOrigin returns true if the request Origin header is acceptable.
+	// If CheckOrigin is nil, the host in the Origin header must not be set or
+	// must match the Host header of the request.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// Upgrade upgrades the HTTP server connection to the WebSocket protocol.
+//
+// If the upgrade fails, Upgrade replies to the client with an HTTP error response
+// and returns *HandshakeError.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if err := u.checkRequest(r); err != nil {
+		var hsErr *HandshakeError
+		if errors.As(err, &hsErr) {
+			if hsErr.Status == http.StatusUpgradeRequired {
+				w.Header().Set("Sec-WebSocket-Version", "13")
+			}
+			http.Error(w, hsErr.Reason, hsErr.Status)
+		}
+		return nil, err
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		err := &HandshakeError{Status: http.StatusInternalServerError, Reason: "response does not implement http.Hijacker"}
+		http.Error(w, err.Reason, err.Status)
+		return nil, err
+	}
+	netConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	if brw.Reader.Buffered() > 0 {
+		netConn.Close()
+		return nil, errors.New("websocket: client sent data before handshake is complete")
+	}
+
+	var b strings.Builder
+	b.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	b.WriteString("Upgrade: websocket\r\n")
+	b.WriteString("Connection: Upgrade\r\n")
+	b.WriteString("Sec-WebSocket-Accept: " + computeAcceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n")
+	b.WriteString("\r\n")
+	if _, err := netConn.Write([]byte(b.String())); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return newConn(netConn, brw.Reader, true), nil
+}
+
+func (u *Upgrader) checkRequest(r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return &HandshakeError{Status: http.StatusMethodNotAllowed, Reason: "request method is not GET"}
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") {
+		return &HandshakeError{Status: http.StatusBadRequest, Reason: "'upgrade' token not found in 'Connection' header"}
+	}
+	if !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		return &HandshakeError{Status: http.StatusBadRequest, Reason: "'websocket' token not found in 'Upgrade' header"}
+	}
+	if r.Header.Get("Sec-Websocket-Version") != "13" {
+		return &HandshakeError{Status: http.StatusUpgradeRequired, Reason: "unsupported version"}
+	}
+	key := r.Header.Get("Sec-Websocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return &HandshakeError{Status: http.StatusBadRequest, Reason: "invalid 'Sec-WebSocket-Key' header"}
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = checkSameOrigin
+	}
+	if !checkOrigin(r) {
+		return &HandshakeError{Status: http.StatusForbidden, Reason: "request origin not allowed"}
+	}
+	return nil
+}
+
+func checkSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package websocket_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/internal/websocket"
+)
+
+func newEchoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u websocket.Upgrader
+		conn, err := u.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(msgType, msg); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func wsURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestEcho(t *testing.T) {
+	srv := newEchoServer(t)
+	conn, err := websocket.Dial(context.Background(), wsURL(srv), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.CloseNormalClosure, "")
+
+	cases := []struct {
+		msgType websocket.MessageType
+		data    []byte
+	}{
+		{websocket.TextMessage, []byte("hello")},
+		{websocket.BinaryMessage, []byte{0, 1, 2, 3}},
+		{websocket.BinaryMessage, bytes.Repeat([]byte("a"), 200)},   // 16-bit length
+		{websocket.BinaryMessage, bytes.Repeat([]byte("b"), 70000)}, // 64-bit length
+		{websocket.TextMessage, []byte{}},
+	}
+	for _, tc := range cases {
+		if err := conn.Ping([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(tc.msgType, tc.data); err != nil {
+			t.Fatal(err)
+		}
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.msgType != msgType {
+			t.Fatalf("want message type %d but got %d", tc.msgType, msgType)
+		}
+		if !bytes.Equal(tc.data, data) {
+			t.Fatalf("want %d bytes but got %d bytes", len(tc.data), len(data))
+		}
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	closed := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u websocket.Upgrader
+		conn, err := u.Upgrade(w, r)
+		if err != nil {
+			closed <- err
+			return
+		}
+		_, _, err = conn.ReadMessage()
+		closed <- err
+	}))
+	defer srv.Close()
+
+	conn, err := websocket.Dial(context.Background(), wsURL(srv), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Close(websocket.CloseGoingAway, "bye"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-closed
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("want *CloseError but got %v", err)
+	}
+	if closeErr.Code != websocket.CloseGoingAway || closeErr.Reason != "bye" {
+		t.Fatalf("unexpected close error: %v", closeErr)
+	}
+}
+
+func TestUpgradeErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u websocket.Upgrader
+		u.Upgrade(w, r)
+	}))
+	defer srv.Close()
+
+	validHeader := func() http.Header {
+		h := make(http.Header)
+		h.Set("Connection", "keep-alive, Upgrade")
+		h.Set("Upgrade", "websocket")
+		h.Set("Sec-WebSocket-Version", "13")
+		h.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		return h
+	}
+	cases := []struct {
+		name   string
+		method string
+		modify func(h http.Header)
+		want   int
+	}{
+		{
+			name:   "valid",
+			method: http.MethodGet,
+			modify: func(h http.Header) {},
+			want:   http.StatusSwitchingProtocols,
+		},
+		{
+			name:   "not GET",
+			method: http.MethodPost,
+			modify: func(h http.Header) {},
+			want:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "no upgrade header",
+			method: http.MethodGet,
+			modify: func(h http.Header) { h.Del("Upgrade") },
+			want:   http.StatusBadRequest,
+		},
+		{
+			name:   "unsupported version",
+			method: http.MethodGet,
+			modify: func(h http.Header) { h.Set("Sec-WebSocket-Version", "8") },
+			want:   http.StatusUpgradeRequired,
+		},
+		{
+			name:   "invalid key",
+			method: http.MethodGet,
+			modify: func(h http.Header) { h.Set("Sec-WebSocket-Key", "short") },
+			want:   http.StatusBadRequest,
+		},
+		{
+			name:   "cross origin",
+			method: http.MethodGet,
+			modify: func(h http.Header) { h.Set("Origin", "http://evil.example.com") },
+			want:   http.StatusForbidden,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header = validHeader()
+			tc.modify(req.Header)
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if tc.want != resp.StatusCode {
+				t.Fatalf("want status %d but got %d", tc.want, resp.StatusCode)
+			}
+			if tc.want == http.StatusSwitchingProtocols {
+				// see: https://www.rfc-editor.org/rfc/rfc6455#section-1.3
+				if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+					t.Fatalf("unexpected accept key: %q", got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,489 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+const (
+	// maxBlockSize is the maximum size of a block. RFC 3.1.1.2.3.
+	maxBlockSize = 128 << 10
+
+	// writerWindowLog is the log of the window size of the frames written by Writer.
+	writerWindowLog  = 20
+	writerWindowSize = 1 << writerWindowLog
+
+	minMatch = 4
+	hashLog  = 16
+)
+
+// Block types. RFC 3.1.1.2.2.
+const (
+	blockRaw        = 0
+	blockRLE        = 1
+	blockCompressed = 2
+)
+
+var errWriterClosed = errors.New("zstd: writer is closed")
+
+// Writer implements [io.WriteCloser] to write a zstd compressed stream.
+//
+// Writer is a simple greedy compressor which finds matches with a hash table and
+// encodes the sequences with the predefined FSE tables. The literals are not
+// compressed with Huffman coding, so that the compression ratio is lower than the
+// reference implementation, but a block of the same byte such as the unused area
+// of a disk image is written as an RLE block of a few bytes.
+type Writer struct {
+	w   io.Writer
+	err error
+
+	wroteHeader bool
+	closed      bool
+
+	// hist has the window followed by the current block.
+	hist []byte
+	// histBase is the position of hist[0] in the stream.
+	histBase int64
+	// blockStart is the start of the current block in hist.
+	blockStart int
+	// table maps the hashes of 4 bytes to their positions in the stream plus 1.
+	table []int64
+
+	xh xxhash64
+
+	literals []byte
+	seqs     []sequence
+	out      []byte
+}
+
+// sequence is a sequence of a compressed block. RFC 3.1.1.3.2.
+type sequence struct {
+	litLen   uint32
+	matchLen uint32
+	offset   uint32
+}
+
+// NewWriter creates a new Writer that compresses data to w.
+// The caller must call Close to write the end of the frame.
+func NewWriter(w io.Writer) *Writer {
+	zw := &Writer{
+		w:     w,
+		hist:  make([]byte, 0, 2*writerWindowSize),
+		table: make([]int64, 1<<hashLog),
+	}
+	zw.xh.reset()
+	return zw
+}
+
+// Write compresses p. The data is written to the underlying writer for each block.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errWriterClosed
+	}
+	n := 0
+	for len(p) > 0 && w.err == nil {
+		// The full block is written when there is more data, so that the last
+		// block is written by Close.
+		if len(w.hist)-w.blockStart == maxBlockSize {
+			w.writeBlock(false)
+			continue
+		}
+		m := min(len(p), maxBlockSize-(len(w.hist)-w.blockStart))
+		w.hist = append(w.hist, p[:m]...)
+		w.xh.update(p[:m])
+		p = p[m:]
+		n += m
+	}
+	return n, w.err
+}
+
+// Close writes the last block and the checksum of the frame. It does not close
+// the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	w.writeBlock(true)
+	if w.err == nil {
+		var checksum [4]byte
+		binary.LittleEndian.PutUint32(checksum[:], uint32(w.xh.digest()))
+		_, w.err = w.w.Write(checksum[:])
+	}
+	return w.err
+}
+
+// writeHeader writes the frame header, which has the window size and the content
+// checksum flag. RFC 3.1.1.1.
+func (w *Writer) writeHeader() {
+	w.wroteHeader = true
+	header := []byte{
+		0x28, 0xb5, 0x2f, 0xfd,
+		1 << 2, // Content_Checksum_flag
+		(writerWindowLog - 10) << 3,
+	}
+	_, w.err = w.w.Write(header)
+}
+
+// writeBlock writes the current block.
+func (w *Writer) writeBlock(last bool) {
+	if !w.wroteHeader {
+		if w.writeHeader(); w.err != nil {
+			return
+		}
+	}
+	src := w.hist[w.blockStart:]
+	typ, content := blockRaw, src
+	switch {
+	case len(src) > 0 && isRLE(src):
+		typ, content = blockRLE, src[:1]
+	default:
+		if b := w.compressBlock(); b != nil {
+			typ, content = blockCompressed, b
+		}
+	}
+
+	size := len(src)
+	if typ == blockCompressed {
+		size = len(content)
+	}
+	header := uint32(typ)<<1 | uint32(size)<<3
+	if last {
+		header |= 1
+	}
+	if _, w.err = w.w.Write([]byte{byte(header), byte(header >> 8), byte(header >> 16)}); w.err != nil {
+		return
+	}
+	if _, w.err = w.w.Write(content); w.err != nil {
+		return
+	}
+
+	w.blockStart = len(w.hist)
+	if len(w.hist)+maxBlockSize > cap(w.hist) {
+		// Keep the window for the next block.
+		drop := len(w.hist) - writerWindowSize
+		copy(w.hist, w.hist[drop:])
+		w.hist = w.hist[:writerWindowSize]
+		w.histBase += int64(drop)
+		w.blockStart -= drop
+	}
+}
+
+func isRLE(b []byte) bool {
+	for _, c := range b[1:] {
+		if c != b[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func hash4(u uint32) uint32 {
+	return (u * 2654435761) >> (32 - hashLog)
+}
+
+// compressBlock finds the matches in the current block and returns the content of
+// a compressed block, or nil if the block is not compressible.
+func (w *Writer) compressBlock() []byte {
+	hist, start, end := w.hist, w.blockStart, len(w.hist)
+	w.literals, w.seqs = w.literals[:0], w.seqs[:0]
+	le := binary.LittleEndian
+
+	anchor := start
+	for i := start; i+minMatch <= end; {
+		cur := le.Uint32(hist[i:])
+		h := hash4(cur)
+		pos := w.histBase + int64(i)
+		cand := int(w.table[h] - 1 - w.histBase)
+		valid := w.table[h] > w.histBase && pos-int64(w.table[h]-1) <= writerWindowSize
+		w.table[h] = pos + 1
+		if !valid || le.Uint32(hist[cand:]) != cur {
+			// Skip faster in the incompressible data.
+			i += 1 + (i-anchor)>>6
+			continue
+		}
+		for i > anchor && cand > 0 && hist[i-1] == hist[cand-1] {
+			i--
+			cand--
+		}
+		n := minMatch
+		for i+n < end && hist[cand+n] == hist[i+n] {
+			n++
+		}
+		w.seqs = append(w.seqs, sequence{
+			litLen:   uint32(i - anchor),
+			matchLen: uint32(n),
+			offset:   uint32(i - cand),
+		})
+		w.literals = append(w.literals, hist[anchor:i]...)
+		i += n
+		anchor = i
+		if i-2 >= start && i+2 <= end {
+			w.table[hash4(le.Uint32(hist[i-2:]))] = w.histBase + int64(i-2) + 1
+		}
+	}
+	w.literals = append(w.literals, hist[anchor:end]...)
+	if len(w.seqs) == 0 {
+		return nil
+	}
+
+	b := appendLiterals(w.out[:0], w.literals)
+	b = appendSequences(b, w.seqs)
+	w.out = b
+	if len(b) >= end-start {
+		return nil
+	}
+	return b
+}
+
+// appendLiterals appends the literals section of the raw literals. RFC 3.1.1.3.1.
+func appendLiterals(b, literals []byte) []byte {
+	n := len(literals)
+	switch {
+	case n < 1<<5:
+		b = append(b, byte(n<<3))
+	case n < 1<<12:
+		b = append(b, byte(n<<4|1<<2), byte(n>>4))
+	default:
+		b = append(b, byte(n<<4|3<<2), byte(n>>4), byte(n>>12))
+	}
+	return append(b, literals...)
+}
+
+// appendSequences appends the sequences section which is encoded with the
+// predefined FSE tables. RFC 3.1.1.3.2.
+func appendSequences(b []byte, seqs []sequence) []byte {
+	n := len(seqs)
+	switch {
+	case n < 128:
+		b = append(b, byte(n))
+	case n < 0x7f00:
+		b = append(b, byte(n>>8)+0x80, byte(n))
+	default:
+		b = append(b, 0xff, byte(n-0x7f00), byte((n-0x7f00)>>8))
+	}
+	// Symbol_Compression_Modes: Predefined_Mode for all the symbols.
+	b = append(b, 0)
+
+	codes := make([]sequenceCodes, n)
+	for i, s := range seqs {
+		codes[i] = newSequenceCodes(s)
+	}
+
+	bw := bitWriter{out: b}
+	var llState, ofState, mlState fseState
+	c := codes[n-1]
+	mlState.init(predefinedMatchEncoder, c.ml)
+	ofState.init(predefinedOffsetEncoder, c.of)
+	llState.init(predefinedLiteralEncoder, c.ll)
+	c.addExtraBits(&bw)
+	for i := n - 2; i >= 0; i-- {
+		c := codes[i]
+		ofState.encode(&bw, c.of)
+		mlState.encode(&bw, c.ml)
+		llState.encode(&bw, c.ll)
+		c.addExtraBits(&bw)
+	}
+	mlState.flush(&bw)
+	ofState.flush(&bw)
+	llState.flush(&bw)
+	return bw.close()
+}
+
+// sequenceCodes are the codes of a sequence and the values of their extra bits.
+type sequenceCodes struct {
+	ll, ml, of             uint8
+	llBits, mlBits, ofBits uint8
+	llExtra, mlExtra       uint32
+	ofExtra                uint32
+}
+
+func newSequenceCodes(s sequence) sequenceCodes {
+	var c sequenceCodes
+	c.ll, c.llBits, c.llExtra = lengthCode(s.litLen, 0, literalLengthOffset, literalLengthBase)
+	c.ml, c.mlBits, c.mlExtra = lengthCode(s.matchLen, 3, matchLengthOffset, matchLengthBase)
+	// The offset values 1 to 3 are the repeated offsets, which are not used.
+	ofValue := s.offset + 3
+	c.of = uint8(bits.Len32(ofValue) - 1)
+	c.ofBits = c.of
+	c.ofExtra = ofValue - 1<<c.of
+	return c
+}
+
+// lengthCode returns the code of a literal length or a match length, the number of
+// the extra bits and their value. RFC 3.1.1.3.2.1.1.
+func lengthCode(v, bias uint32, offset int, base []uint32) (code, nbits uint8, extra uint32) {
+	if v-bias < uint32(offset) {
+		return uint8(v - bias), 0, 0
+	}
+	i := len(base) - 1
+	for base[i]&0xffffff > v {
+		i--
+	}
+	return uint8(offset + i), uint8(base[i] >> 24), v - base[i]&0xffffff
+}
+
+func (c *sequenceCodes) addExtraBits(bw *bitWriter) {
+	bw.add(c.llExtra, c.llBits)
+	bw.add(c.mlExtra, c.mlBits)
+	bw.add(c.ofExtra, c.ofBits)
+}
+
+// bitWriter writes a bitstream which is read backward by bitReader.
+type bitWriter struct {
+	out  []byte
+	bits uint64
+	n    uint8
+}
+
+func (bw *bitWriter) add(v uint32, n uint8) {
+	bw.bits |= uint64(v&(1<<n-1)) << bw.n
+	bw.n += n
+	for bw.n >= 8 {
+		bw.out = append(bw.out, byte(bw.bits))
+		bw.bits >>= 8
+		bw.n -= 8
+	}
+}
+
+// close writes the padding which starts with a 1 bit and returns the stream.
+func (bw *bitWriter) close() []byte {
+	bw.add(1, 1)
+	if bw.n > 0 {
+		bw.out = append(bw.out, byte(bw.bits))
+	}
+	return bw.out
+}
+
+// fseEncoder is an FSE encoding table built from a distribution as FSE_buildCTable
+// of the reference implementation does.
+type fseEncoder struct {
+	tableLog   uint8
+	stateTable []uint16
+	symbols    []fseSymbolTransform
+}
+
+type fseSymbolTransform struct {
+	deltaNbBits    uint32
+	deltaFindState int32
+}
+
+// The decoder has the predefined tables already built, so the distributions are
+// only needed by the encoder.
+
+// writerLiteralDistribution is the predefined distribution table
+// for literal lengths. RFC 3.1.1.3.2.2.1.
+var writerLiteralDistribution = []int16{
+	4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+	-1, -1, -1, -1,
+}
+
+// writerOffsetDistribution is the predefined distribution table
+// for offsets. RFC 3.1.1.3.2.2.3.
+var writerOffsetDistribution = []int16{
+	1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+}
+
+// writerMatchDistribution is the predefined distribution table
+// for match lengths. RFC 3.1.1.3.2.2.2.
+var writerMatchDistribution = []int16{
+	1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+	-1, -1, -1, -1, -1,
+}
+
+var (
+	predefinedLiteralEncoder = newFSEEncoder(writerLiteralDistribution, 6)
+	predefinedOffsetEncoder  = newFSEEncoder(writerOffsetDistribution, 5)
+	predefinedMatchEncoder   = newFSEEncoder(writerMatchDistribution, 6)
+)
+
+func newFSEEncoder(norm []int16, tableLog uint8) *fseEncoder {
+	tableSize := 1 << tableLog
+	mask := tableSize - 1
+	highThreshold := tableSize - 1
+
+	// The symbols are spread in the same way as buildFSE.
+	cumul := make([]int, len(norm)+1)
+	tableSymbol := make([]uint8, tableSize)
+	for s, n := range norm {
+		if n == -1 {
+			cumul[s+1] = cumul[s] + 1
+			tableSymbol[highThreshold] = uint8(s)
+			highThreshold--
+		} else {
+			cumul[s+1] = cumul[s] + int(n)
+		}
+	}
+	pos := 0
+	step := (tableSize >> 1) + (tableSize >> 3) + 3
+	for s, n := range norm {
+		for j := 0; j < int(n); j++ {
+			tableSymbol[pos] = uint8(s)
+			pos = (pos + step) & mask
+			for pos > highThreshold {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+
+	e := &fseEncoder{
+		tableLog:   tableLog,
+		stateTable: make([]uint16, tableSize),
+		symbols:    make([]fseSymbolTransform, len(norm)),
+	}
+	for u, s := range tableSymbol {
+		e.stateTable[cumul[s]] = uint16(tableSize + u)
+		cumul[s]++
+	}
+	total := int32(0)
+	for s, n := range norm {
+		t := &e.symbols[s]
+		switch n {
+		case 0:
+			t.deltaNbBits = uint32(tableLog+1)<<16 - uint32(tableSize)
+		case -1, 1:
+			t.deltaNbBits = uint32(tableLog)<<16 - uint32(tableSize)
+			t.deltaFindState = total - 1
+			total++
+		default:
+			maxBitsOut := uint32(tableLog) - uint32(bits.Len16(uint16(n-1))-1)
+			minStatePlus := uint32(n) << maxBitsOut
+			t.deltaNbBits = maxBitsOut<<16 - minStatePlus
+			t.deltaFindState = total - int32(n)
+			total += int32(n)
+		}
+	}
+	return e
+}
+
+// fseState is the state of an FSE encoder.
+type fseState struct {
+	e     *fseEncoder
+	value uint32
+}
+
+// init sets the state of the first symbol without writing bits.
+func (st *fseState) init(e *fseEncoder, sym uint8) {
+	t := e.symbols[sym]
+	nbBitsOut := (t.deltaNbBits + 1<<15) >> 16
+	value := nbBitsOut<<16 - t.deltaNbBits
+	st.e = e
+	st.value = uint32(e.stateTable[int32(value>>nbBitsOut)+t.deltaFindState])
+}
+
+func (st *fseState) encode(bw *bitWriter, sym uint8) {
+	t := st.e.symbols[sym]
+	nbBitsOut := (st.value + t.deltaNbBits) >> 16
+	bw.add(st.value, uint8(nbBitsOut))
+	st.value = uint32(st.e.stateTable[int32(st.value>>nbBitsOut)+t.deltaFindState])
+}
+
+func (st *fseState) flush(bw *bitWriter) {
+	bw.add(st.value, st.e.tableLog)
+}
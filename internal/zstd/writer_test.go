@@ -0,0 +1,133 @@
+package zstd
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func compress(t testing.TB, data []byte, chunk int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for len(data) > 0 {
+		n := min(chunk, len(data))
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writerTestData(t testing.TB) []struct {
+	name string
+	data []byte
+} {
+	random := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	mixed := append(bytes.Repeat([]byte{0}, 200<<10), random[:100<<10]...)
+	mixed = append(mixed, []byte(strings.Repeat("abcdefgh", 40<<10))...)
+	// A repetition of the random data which is farther than a block.
+	far := append(append([]byte(nil), random[:200<<10]...), random[:200<<10]...)
+	return []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "short", data: []byte("hello, world\n")},
+		{name: "block size", data: bytes.Repeat([]byte("0123456789abcdef"), maxBlockSize/16)},
+		{name: "zero", data: make([]byte, 1<<20)},
+		{name: "random", data: random},
+		{name: "mixed", data: mixed},
+		{name: "far", data: far},
+		{name: "large", data: bigData(t)},
+	}
+}
+
+func TestWriter(t *testing.T) {
+	for _, tc := range writerTestData(t) {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, chunk := range []int{1000, 1 << 20} {
+				compressed := compress(t, tc.data, chunk)
+				got, err := io.ReadAll(NewReader(bytes.NewReader(compressed)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, tc.data) {
+					showDiffs(t, got, tc.data)
+				}
+			}
+		})
+	}
+}
+
+func TestWriterRatio(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		max  int
+	}{
+		{name: "zero", data: make([]byte, 64<<20), max: 4 << 10},
+		{name: "text", data: bigData(t), max: 5 << 20},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if n := len(compress(t, tc.data, 1<<20)); n > tc.max {
+				t.Fatalf("want at most %d bytes but got %d", tc.max, n)
+			}
+		})
+	}
+}
+
+// TestWriterZstd checks that the reference implementation decompresses the output.
+func TestWriterZstd(t *testing.T) {
+	zstd := findZstd(t)
+	for _, tc := range writerTestData(t) {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := exec.Command(zstd, "-d", "-c")
+			cmd.Stdin = bytes.NewReader(compress(t, tc.data, 1<<20))
+			got, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("zstd failed: %v", err)
+			}
+			if !bytes.Equal(got, tc.data) {
+				showDiffs(t, got, tc.data)
+			}
+		})
+	}
+}
+
+func TestWriterClosed(t *testing.T) {
+	w := NewWriter(io.Discard)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("data")); err != errWriterClosed {
+		t.Fatalf("want %v but got %v", errWriterClosed, err)
+	}
+}
+
+// TestWriterDistributions verifies that the encoder uses the same predefined
+// distributions as the ones the decoder tables are tested with.
+func TestWriterDistributions(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		got, want []int16
+	}{
+		{"literal", writerLiteralDistribution, literalPredefinedDistribution},
+		{"offset", writerOffsetDistribution, offsetPredefinedDistribution},
+		{"match", writerMatchDistribution, matchPredefinedDistribution},
+	} {
+		if !slices.Equal(tc.got, tc.want) {
+			t.Errorf("%s: want %v but got %v", tc.name, tc.want, tc.got)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Platform is the platform ID of an El Torito boot entry.
+type Platform uint8
+
+const (
+	// PlatformX86 is the BIOS of x86 PCs.
+	PlatformX86 Platform = 0x00
+	// PlatformPowerPC is PowerPC.
+	PlatformPowerPC Platform = 0x01
+	// PlatformMac is Mac.
+	PlatformMac Platform = 0x02
+	// PlatformEFI is UEFI. The boot image is usually a FAT image which has
+	// EFI/BOOT/BOOTAA64.EFI or EFI/BOOT/BOOTX64.EFI.
+	PlatformEFI Platform = 0xef
+)
+
+func (p Platform) String() string {
+	switch p {
+	case PlatformX86:
+		return "x86"
+	case PlatformPowerPC:
+		return "PowerPC"
+	case PlatformMac:
+		return "Mac"
+	case PlatformEFI:
+		return "EFI"
+	}
+	return fmt.Sprintf("Platform(%#x)", uint8(p))
+}
+
+// Emulation is the boot media type of an El Torito boot entry.
+type Emulation uint8
+
+const (
+	// EmulationNone loads the boot image as is. EFI boot images are not emulated.
+	EmulationNone Emulation = 0
+	// Emulation12Floppy emulates a 1.2 MB floppy disk.
+	Emulation12Floppy Emulation = 1
+	// Emulation144Floppy emulates a 1.44 MB floppy disk.
+	Emulation144Floppy Emulation = 2
+	// Emulation288Floppy emulates a 2.88 MB floppy disk.
+	Emulation288Floppy Emulation = 3
+	// EmulationHardDisk emulates a hard disk.
+	EmulationHardDisk Emulation = 4
+)
+
+// BootEntry is a boot entry of the El Torito boot catalog.
+//
+// see: https://pdos.csail.mit.edu/6.828/2018/readings/boot-cdrom.pdf
+type BootEntry struct {
+	// Platform is the platform of the section which has the entry.
+	Platform Platform
+
+	// Bootable reports whether the entry is bootable.
+	Bootable bool
+
+	// Emulation is the emulated media type of the boot image.
+	Emulation Emulation
+
+	// LoadSegment is the segment to load the boot image for x86.
+	LoadSegment uint16
+
+	// SectorCount is the number of 512 bytes virtual sectors to load.
+	SectorCount uint16
+
+	// LBA is the sector of the boot image.
+	LBA uint32
+}
+
+// BootEntries returns the entries of the El Torito boot catalog. It returns nil if
+// the image is not bootable.
+func (r *Reader) BootEntries() ([]BootEntry, error) {
+	if r.bootRecord == 0 {
+		return nil, nil
+	}
+	base := int64(r.bootRecord) * SectorSize
+	readEntry := func(i int) ([]byte, error) {
+		b := make([]byte, 32)
+		if _, err := r.r.ReadAt(b, base+int64(i)*32); err != nil {
+			return nil, fmt.Errorf("%w: failed to read the boot catalog: %v", ErrFormat, err)
+		}
+		return b, nil
+	}
+
+	validation, err := readEntry(0)
+	if err != nil {
+		return nil, err
+	}
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += binary.LittleEndian.Uint16(validation[i:])
+	}
+	if validation[0] != 0x01 || validation[30] != 0x55 || validation[31] != 0xaa || sum != 0 {
+		return nil, fmt.Errorf("%w: invalid validation entry of the boot catalog", ErrFormat)
+	}
+
+	initial, err := readEntry(1)
+	if err != nil {
+		return nil, err
+	}
+	entries := []BootEntry{parseBootEntry(initial, Platform(validation[1]))}
+
+	// The section headers and entries follow the initial entry. The catalog is
+	// limited to a few sectors.
+	const maxEntries = 4 * SectorSize / 32
+	for i := 2; i < maxEntries; {
+		header, err := readEntry(i)
+		if err != nil {
+			return nil, err
+		}
+		i++
+		if header[0] != 0x90 && header[0] != 0x91 {
+			break
+		}
+		platform := Platform(header[1])
+		n := int(binary.LittleEndian.Uint16(header[2:]))
+		for j := 0; j < n && i < maxEntries; i++ {
+			b, err := readEntry(i)
+			if err != nil {
+				return nil, err
+			}
+			if b[0] == 0x44 {
+				// The section entry extension.
+				continue
+			}
+			entries = append(entries, parseBootEntry(b, platform))
+			j++
+		}
+		if header[0] == 0x91 {
+			break
+		}
+	}
+	return entries, nil
+}
+
+func parseBootEntry(b []byte, platform Platform) BootEntry {
+	return BootEntry{
+		Platform:    platform,
+		Bootable:    b[0] == 0x88,
+		Emulation:   Emulation(b[1] & 0x0f),
+		LoadSegment: binary.LittleEndian.Uint16(b[2:]),
+		SectorCount: binary.LittleEndian.Uint16(b[6:]),
+		LBA:         binary.LittleEndian.Uint32(b[8:]),
+	}
+}
+
+// OpenBootImage returns the reader of the boot image of the entry.
+//
+// The sector count of EFI entries is often too small because the field can not
+// express the size of the large images, so the size of the FAT file system in the
+// image is used if it is larger.
+func (r *Reader) OpenBootImage(e BootEntry) *io.SectionReader {
+	size := int64(e.SectorCount) * 512
+	if e.Platform == PlatformEFI {
+		if fatSize := r.fatSize(int64(e.LBA) * SectorSize); fatSize > size {
+			size = fatSize
+		}
+	}
+	return io.NewSectionReader(r.r, int64(e.LBA)*SectorSize, size)
+}
+
+// fatSize returns the size of the FAT file system at off, or 0 if there is no FAT
+// file system.
+func (r *Reader) fatSize(off int64) int64 {
+	b := make([]byte, 512)
+	if _, err := r.r.ReadAt(b, off); err != nil {
+		return 0
+	}
+	if b[510] != 0x55 || b[511] != 0xaa {
+		return 0
+	}
+	bytesPerSector := int64(binary.LittleEndian.Uint16(b[11:]))
+	switch bytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return 0
+	}
+	total := int64(binary.LittleEndian.Uint16(b[19:]))
+	if total == 0 {
+		total = int64(binary.LittleEndian.Uint32(b[32:]))
+	}
+	return total * bytesPerSector
+}
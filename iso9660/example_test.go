@@ -0,0 +1,34 @@
+package iso9660_test
+
+import (
+	"log"
+
+	"github.com/Code-Hex/vz/v3/iso9660"
+)
+
+func ExampleReader_FindLinux() {
+	// Boot the kernel of an installer ISO directly instead of through EFI.
+	r, err := iso9660.OpenReader("/path/to/installer.iso")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer r.Close()
+
+	boots, err := r.FindLinux()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(boots) == 0 {
+		log.Fatal("no kernel found")
+	}
+	if err := r.Extract(boots[0].Kernel, "/path/to/vmlinuz"); err != nil {
+		log.Fatal(err)
+	}
+	if err := r.Extract(boots[0].Initrd, "/path/to/initrd"); err != nil {
+		log.Fatal(err)
+	}
+	// Pass "/path/to/vmlinuz" to vz.NewLinuxBootLoader with vz.WithAutoDecompress,
+	// vz.WithInitrd("/path/to/initrd") and
+	// vz.WithKernelCommandLine(boots[0].CommandLine.SetConsole(kernel.ConsoleHVC0)),
+	// and attach the ISO as a read-only disk.
+}
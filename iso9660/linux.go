@@ -0,0 +1,145 @@
+package iso9660
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+
+	"github.com/Code-Hex/vz/v3/kernel"
+)
+
+// LinuxBoot is a pair of the kernel and the initial ramdisk of a Linux distribution
+// found in the image.
+type LinuxBoot struct {
+	// Distro is the name of the distribution family, such as "Ubuntu" or "Fedora".
+	Distro string
+
+	// Kernel is the path of the kernel in the image, such as "casper/vmlinuz".
+	Kernel string
+
+	// Initrd is the path of the initial ramdisk in the image.
+	Initrd string
+
+	// CommandLine has the kernel parameters which the distribution requires to
+	// find the installation media. It is empty if none is required.
+	CommandLine *kernel.CommandLine
+}
+
+type linuxLayout struct {
+	distro string
+	// kernel and initrd are the paths in the image. If kernel has "*", initrd has
+	// "*" too and it is replaced by the same string.
+	kernel string
+	initrd string
+	// cmdLine returns the required parameters for the volume ID of the image.
+	cmdLine func(volumeID string) *kernel.CommandLine
+}
+
+// linuxLayouts is the list of the well-known layouts of the installer and live images.
+var linuxLayouts = []linuxLayout{
+	// Ubuntu and its derivatives such as Linux Mint.
+	{distro: "Ubuntu", kernel: "casper/vmlinuz", initrd: "casper/initrd"},
+	{distro: "Ubuntu", kernel: "casper/vmlinuz", initrd: "casper/initrd.lz"},
+	{distro: "Ubuntu", kernel: "casper/hwe-vmlinuz", initrd: "casper/hwe-initrd"},
+	// Debian installer.
+	{distro: "Debian", kernel: "install.a64/vmlinuz", initrd: "install.a64/initrd.gz"},
+	{distro: "Debian", kernel: "install.amd/vmlinuz", initrd: "install.amd/initrd.gz"},
+	{distro: "Debian", kernel: "install/vmlinuz", initrd: "install/initrd.gz"},
+	// Debian live and its derivatives such as Kali Linux.
+	{
+		distro: "Debian Live",
+		kernel: "live/vmlinuz*",
+		initrd: "live/initrd.img*",
+		cmdLine: func(string) *kernel.CommandLine {
+			return kernel.NewCommandLine().Set("boot", "live").SetFlag("components")
+		},
+	},
+	// Fedora, RHEL, CentOS Stream, AlmaLinux, Rocky Linux and so on.
+	{
+		distro: "Fedora",
+		kernel: "images/pxeboot/vmlinuz",
+		initrd: "images/pxeboot/initrd.img",
+		cmdLine: func(volumeID string) *kernel.CommandLine {
+			return kernel.NewCommandLine().Set("inst.stage2", "hd:LABEL="+escapeLabel(volumeID))
+		},
+	},
+	// openSUSE and SUSE Linux Enterprise.
+	{distro: "openSUSE", kernel: "boot/aarch64/linux", initrd: "boot/aarch64/initrd"},
+	{distro: "openSUSE", kernel: "boot/x86_64/loader/linux", initrd: "boot/x86_64/loader/initrd"},
+	// Arch Linux.
+	{
+		distro: "Arch Linux",
+		kernel: "arch/boot/x86_64/vmlinuz-linux",
+		initrd: "arch/boot/x86_64/initramfs-linux.img",
+		cmdLine: func(volumeID string) *kernel.CommandLine {
+			return kernel.NewCommandLine().Set("archisobasedir", "arch").Set("archisolabel", volumeID)
+		},
+	},
+	// Alpine Linux.
+	{distro: "Alpine Linux", kernel: "boot/vmlinuz-virt", initrd: "boot/initramfs-virt"},
+	{distro: "Alpine Linux", kernel: "boot/vmlinuz-lts", initrd: "boot/initramfs-lts"},
+}
+
+// escapeLabel escapes the spaces in the label like the udev /dev/disk/by-label names.
+func escapeLabel(label string) string {
+	return strings.ReplaceAll(label, " ", `\x20`)
+}
+
+// FindLinux returns the kernels and the initial ramdisks of the well-known layouts of
+// Linux distributions, in the order of preference. It returns nil if none is found.
+//
+// The kernel may be compressed and it may be for another architecture; use
+// kernel.Inspect to check it, and vz.WithAutoDecompress to boot it.
+func (r *Reader) FindLinux() ([]LinuxBoot, error) {
+	var boots []LinuxBoot
+	for _, layout := range linuxLayouts {
+		kernels := []string{layout.kernel}
+		if strings.Contains(layout.kernel, "*") {
+			var err error
+			if kernels, err = fs.Glob(r, layout.kernel); err != nil {
+				return nil, err
+			}
+		}
+		for _, k := range kernels {
+			initrd := layout.initrd
+			if prefix, _, ok := strings.Cut(layout.kernel, "*"); ok {
+				initrd = strings.Replace(initrd, "*", strings.TrimPrefix(k, prefix), 1)
+			}
+			ok, err := r.isRegular(k)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			if ok, err = r.isRegular(initrd); err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+			boot := LinuxBoot{
+				Distro:      layout.distro,
+				Kernel:      k,
+				Initrd:      initrd,
+				CommandLine: kernel.NewCommandLine(),
+			}
+			if layout.cmdLine != nil {
+				boot.CommandLine = layout.cmdLine(r.volumeID)
+			}
+			boots = append(boots, boot)
+		}
+	}
+	return boots, nil
+}
+
+func (r *Reader) isRegular(name string) (bool, error) {
+	fi, err := r.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return fi.Mode().IsRegular(), nil
+}
@@ -0,0 +1,715 @@
+package iso9660
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+// ErrFormat is returned when the image is not a valid ISO 9660 image.
+var ErrFormat = errors.New("iso9660: invalid format")
+
+const (
+	vdTypeBootRecord    = 0
+	vdTypePrimary       = 1
+	vdTypeSupplementary = 2
+	vdTypeTerminator    = 255
+
+	recordFlagMultiExtent = 0x80
+
+	// maxVolumeDescriptors limits the number of volume descriptors to read.
+	maxVolumeDescriptors = 64
+	// maxContinuations limits the number of SUSP continuation areas of a record.
+	maxContinuations = 16
+)
+
+// Reader reads files from an ISO 9660 image. It implements fs.FS, fs.ReadDirFS and
+// fs.StatFS, so that the image can be used with fs.WalkDir, fs.ReadFile and so on.
+//
+// The names are read from the Rock Ridge extensions if the image has them, from the
+// Joliet extensions if it has them, or from the primary directory records otherwise.
+// Like Linux, the primary names are converted to lower case and their versions such
+// as ";1" are removed.
+type Reader struct {
+	r          io.ReaderAt
+	volumeID   string
+	rockRidge  bool
+	suspSkip   int
+	joliet     bool
+	root       *entry
+	bootRecord uint32 // the sector of the El Torito boot catalog, or 0.
+
+	mu   sync.Mutex
+	dirs map[uint32][]*entry
+}
+
+// ReadCloser is a Reader which closes the underlying file.
+type ReadCloser struct {
+	*Reader
+	f *os.File
+}
+
+// OpenReader opens the ISO 9660 image at name.
+func OpenReader(name string) (*ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &ReadCloser{Reader: r, f: f}, nil
+}
+
+// Close closes the image file.
+func (rc *ReadCloser) Close() error {
+	return rc.f.Close()
+}
+
+// NewReader returns a new Reader which reads the ISO 9660 image from r.
+func NewReader(r io.ReaderAt) (*Reader, error) {
+	ir := &Reader{
+		r:    r,
+		dirs: make(map[uint32][]*entry),
+	}
+	var primary, joliet []byte
+	buf := make([]byte, SectorSize)
+	for i := 0; i < maxVolumeDescriptors; i++ {
+		if _, err := r.ReadAt(buf, int64(systemAreaSectors+i)*SectorSize); err != nil {
+			return nil, fmt.Errorf("%w: failed to read the volume descriptor: %v", ErrFormat, err)
+		}
+		if string(buf[1:6]) != "CD001" {
+			return nil, fmt.Errorf("%w: no volume descriptor", ErrFormat)
+		}
+		vd := append([]byte(nil), buf...)
+		switch vd[0] {
+		case vdTypeBootRecord:
+			if strings.TrimRight(string(vd[7:39]), "\x00") == "EL TORITO SPECIFICATION" {
+				ir.bootRecord = binary.LittleEndian.Uint32(vd[71:])
+			}
+		case vdTypePrimary:
+			primary = vd
+		case vdTypeSupplementary:
+			switch string(vd[88:91]) {
+			case "%/@", "%/C", "%/E":
+				joliet = vd
+			}
+		}
+		if vd[0] == vdTypeTerminator {
+			break
+		}
+	}
+	if primary == nil {
+		return nil, fmt.Errorf("%w: no primary volume descriptor", ErrFormat)
+	}
+	ir.volumeID = strings.TrimRight(string(primary[40:72]), " \x00")
+
+	root, err := ir.parseRecord(primary[156:190], false)
+	if err != nil {
+		return nil, err
+	}
+	// The Rock Ridge extensions are detected by the "SP" entry of the "." record of
+	// the root directory.
+	dot, err := ir.readRecords(root.extents[0].lba, root.extents[0].size)
+	if err != nil {
+		return nil, err
+	}
+	if len(dot) > 0 {
+		su := systemUse(dot[0])
+		if len(su) >= 7 && string(su[:2]) == "SP" && su[4] == 0xbe && su[5] == 0xef {
+			ir.rockRidge = true
+			ir.suspSkip = int(su[6])
+		}
+	}
+	if !ir.rockRidge && joliet != nil {
+		ir.joliet = true
+		if root, err = ir.parseRecord(joliet[156:190], false); err != nil {
+			return nil, err
+		}
+		if id := decodeUCS2(joliet[40:72]); strings.TrimSpace(id) != "" {
+			ir.volumeID = strings.TrimRight(id, " \x00")
+		}
+	}
+	root.name = "."
+	root.mode = fs.ModeDir | 0o555
+	ir.root = root
+	return ir, nil
+}
+
+// VolumeID returns the volume identifier (label) of the image.
+func (r *Reader) VolumeID() string {
+	return r.volumeID
+}
+
+// extent is a contiguous area of a file.
+type extent struct {
+	lba  uint32
+	size uint32
+}
+
+type entry struct {
+	name     string
+	mode     fs.FileMode
+	modTime  time.Time
+	size     int64
+	extents  []extent
+	linkname string
+	// relocated reports whether the directory is relocated by the Rock Ridge "RE"
+	// entry. It is listed at the position of the "CL" entry instead.
+	relocated bool
+	// multiExtent reports whether the file continues to the next record.
+	multiExtent bool
+}
+
+// systemUse returns the System Use area of the directory record.
+func systemUse(rec []byte) []byte {
+	identLen := int(rec[32])
+	off := 33 + identLen + (1 - identLen%2)
+	if off > len(rec) {
+		return nil
+	}
+	return rec[off:]
+}
+
+// readRecords reads the directory records of the extent.
+func (r *Reader) readRecords(lba, size uint32) ([][]byte, error) {
+	buf := make([]byte, size)
+	if _, err := r.r.ReadAt(buf, int64(lba)*SectorSize); err != nil {
+		return nil, fmt.Errorf("%w: failed to read the directory: %v", ErrFormat, err)
+	}
+	var records [][]byte
+	for off := 0; off < len(buf); {
+		n := int(buf[off])
+		if n == 0 {
+			// The rest of the sector is padding.
+			off = (off/SectorSize + 1) * SectorSize
+			continue
+		}
+		if n < 34 || off+n > len(buf) || 33+int(buf[off+32]) > n {
+			return nil, fmt.Errorf("%w: invalid directory record", ErrFormat)
+		}
+		records = append(records, buf[off:off+n])
+		off += n
+	}
+	return records, nil
+}
+
+func (r *Reader) parseRecord(rec []byte, withSUSP bool) (*entry, error) {
+	if len(rec) < 34 {
+		return nil, fmt.Errorf("%w: invalid directory record", ErrFormat)
+	}
+	identLen := int(rec[32])
+	ident := rec[33 : 33+identLen]
+	e := &entry{
+		modTime:     recordTime(rec[18:25]),
+		extents:     []extent{{lba: binary.LittleEndian.Uint32(rec[2:]), size: binary.LittleEndian.Uint32(rec[10:])}},
+		size:        int64(binary.LittleEndian.Uint32(rec[10:])),
+		multiExtent: rec[25]&recordFlagMultiExtent != 0,
+	}
+	if rec[25]&recordFlagDir != 0 {
+		e.mode = fs.ModeDir | 0o555
+	} else {
+		e.mode = 0o444
+	}
+	switch {
+	case r.joliet:
+		e.name = strings.TrimSuffix(decodeUCS2(ident), ";1")
+	default:
+		name := string(ident)
+		if i := strings.LastIndexByte(name, ';'); i >= 0 {
+			name = name[:i]
+		}
+		if rec[25]&recordFlagDir == 0 {
+			name = strings.TrimSuffix(name, ".")
+		}
+		e.name = strings.ToLower(name)
+	}
+	if withSUSP && r.rockRidge {
+		su := systemUse(rec)
+		if len(su) >= r.suspSkip {
+			if err := r.parseRockRidge(e, su[r.suspSkip:]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return e, nil
+}
+
+// parseRockRidge parses the System Use entries of the Rock Ridge extensions.
+func (r *Reader) parseRockRidge(e *entry, su []byte) error {
+	var (
+		name        []byte
+		hasName     bool
+		link        []string
+		linkPart    []byte
+		linkPending bool
+	)
+	for cont := 0; ; cont++ {
+		var next *extent
+		var nextOffset uint32
+		for len(su) >= 4 {
+			sig, n := string(su[:2]), int(su[2])
+			if n < 4 || n > len(su) {
+				break
+			}
+			data := su[4:n]
+			su = su[n:]
+			switch sig {
+			case "ST":
+				su = nil
+			case "CE":
+				if len(data) >= 24 {
+					next = &extent{
+						lba:  binary.LittleEndian.Uint32(data[0:]),
+						size: binary.LittleEndian.Uint32(data[16:]),
+					}
+					nextOffset = binary.LittleEndian.Uint32(data[8:])
+				}
+			case "NM":
+				if len(data) >= 1 {
+					flags := data[0]
+					switch {
+					case flags&0x02 != 0:
+						name = append(name, '.')
+					case flags&0x04 != 0:
+						name = append(name, ".."...)
+					default:
+						name = append(name, data[1:]...)
+					}
+					hasName = true
+				}
+			case "PX":
+				if len(data) >= 8 {
+					e.mode = posixMode(binary.LittleEndian.Uint32(data[0:]))
+				}
+			case "TF":
+				if t, ok := modifyTime(data); ok {
+					e.modTime = t
+				}
+			case "SL":
+				if len(data) < 1 {
+					continue
+				}
+				comps := data[1:]
+				for len(comps) >= 2 {
+					flags, n := comps[0], int(comps[1])
+					if 2+n > len(comps) {
+						break
+					}
+					switch {
+					case flags&0x02 != 0:
+						linkPart = append(linkPart, '.')
+					case flags&0x04 != 0:
+						linkPart = append(linkPart, ".."...)
+					case flags&0x08 != 0:
+						// The root is represented by the empty first component.
+					default:
+						linkPart = append(linkPart, comps[2:2+n]...)
+					}
+					comps = comps[2+n:]
+					if flags&0x01 == 0 {
+						link = append(link, string(linkPart))
+						linkPart = nil
+					}
+				}
+				linkPending = true
+			case "CL":
+				if len(data) >= 8 {
+					// The directory has been relocated to the location.
+					e.mode = fs.ModeDir | e.mode.Perm()
+					e.extents = []extent{{lba: binary.LittleEndian.Uint32(data[0:])}}
+					e.size = 0
+				}
+			case "RE":
+				e.relocated = true
+			}
+		}
+		if next == nil || cont >= maxContinuations {
+			break
+		}
+		if next.size > SectorSize || nextOffset >= SectorSize {
+			return fmt.Errorf("%w: invalid continuation area", ErrFormat)
+		}
+		buf := make([]byte, next.size)
+		if _, err := r.r.ReadAt(buf, int64(next.lba)*SectorSize+int64(nextOffset)); err != nil {
+			return fmt.Errorf("%w: failed to read the continuation area: %v", ErrFormat, err)
+		}
+		su = buf
+	}
+	if hasName {
+		e.name = string(name)
+	}
+	if linkPending {
+		target := strings.Join(link, "/")
+		if len(link) > 0 && link[0] == "" {
+			target = "/" + strings.Join(link[1:], "/")
+		}
+		e.linkname = target
+		e.mode = fs.ModeSymlink | e.mode.Perm()
+	}
+	return nil
+}
+
+func posixMode(m uint32) fs.FileMode {
+	mode := fs.FileMode(m & 0o777)
+	if m&0o4000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if m&0o2000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if m&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	switch m & 0o170000 {
+	case 0o040000:
+		mode |= fs.ModeDir
+	case 0o120000:
+		mode |= fs.ModeSymlink
+	case 0o020000:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case 0o060000:
+		mode |= fs.ModeDevice
+	case 0o010000:
+		mode |= fs.ModeNamedPipe
+	case 0o140000:
+		mode |= fs.ModeSocket
+	}
+	return mode
+}
+
+// modifyTime returns the modification time of the "TF" entry.
+func modifyTime(data []byte) (time.Time, bool) {
+	if len(data) < 1 {
+		return time.Time{}, false
+	}
+	flags := data[0]
+	size := 7
+	if flags&0x80 != 0 {
+		size = 17
+	}
+	off := 1
+	if flags&0x01 != 0 {
+		// The creation time precedes the modification time.
+		off += size
+	}
+	if flags&0x02 == 0 || off+size > len(data) {
+		return time.Time{}, false
+	}
+	if size == 17 {
+		return volumeTime(data[off : off+size]), true
+	}
+	return recordTime(data[off : off+size]), true
+}
+
+// recordTime parses the 7 bytes recording date and time.
+func recordTime(b []byte) time.Time {
+	if b[0] == 0 && b[1] == 0 && b[2] == 0 {
+		return time.Time{}
+	}
+	loc := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, loc)
+}
+
+// volumeTime parses the 17 bytes date and time.
+func volumeTime(b []byte) time.Time {
+	t, err := time.Parse("20060102150405", string(b[:14]))
+	if err != nil {
+		return time.Time{}
+	}
+	var hundredths int
+	fmt.Sscanf(string(b[14:16]), "%02d", &hundredths)
+	loc := time.FixedZone("", int(int8(b[16]))*15*60)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), hundredths*10000000, loc)
+}
+
+func decodeUCS2(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// readDir returns the entries of the directory sorted by name.
+func (r *Reader) readDir(dir *entry) ([]*entry, error) {
+	lba := dir.extents[0].lba
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entries, ok := r.dirs[lba]; ok {
+		return entries, nil
+	}
+
+	size := dir.extents[0].size
+	if size == 0 {
+		// The size of a relocated directory is read from its "." record.
+		buf := make([]byte, 34)
+		if _, err := r.r.ReadAt(buf, int64(lba)*SectorSize); err != nil {
+			return nil, fmt.Errorf("%w: failed to read the directory: %v", ErrFormat, err)
+		}
+		size = binary.LittleEndian.Uint32(buf[10:])
+	}
+	records, err := r.readRecords(lba, size)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*entry
+	var prev *entry
+	for _, rec := range records {
+		if rec[32] == 1 && rec[33] <= 1 {
+			// "." and ".."
+			continue
+		}
+		e, err := r.parseRecord(rec, true)
+		if err != nil {
+			return nil, err
+		}
+		if prev != nil && prev.multiExtent {
+			// The file continues from the previous record.
+			prev.extents = append(prev.extents, e.extents...)
+			prev.size += e.size
+			prev.multiExtent = e.multiExtent
+			continue
+		}
+		prev = e
+		if e.relocated || e.name == "" || e.name == "." || e.name == ".." || strings.Contains(e.name, "/") {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	r.dirs[lba] = entries
+	return entries, nil
+}
+
+// lookup returns the entry of the slash-separated path name.
+func (r *Reader) lookup(op, name string) (*entry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e := r.root
+	if name == "." {
+		return e, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !e.mode.IsDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		entries, err := r.readDir(e)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		i := sort.Search(len(entries), func(i int) bool {
+			return entries[i].name >= elem
+		})
+		if i == len(entries) || entries[i].name != elem {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		e = entries[i]
+	}
+	return e, nil
+}
+
+// Open opens the named file or directory. It implements fs.FS. Symbolic links are
+// not followed.
+func (r *Reader) Open(name string) (fs.File, error) {
+	e, err := r.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.mode.IsDir() {
+		return &dirFile{r: r, e: e, name: name}, nil
+	}
+	return &file{e: e, SectionReader: io.NewSectionReader(r.extentReader(e), 0, e.size)}, nil
+}
+
+// Stat returns the information of the named file. It implements fs.StatFS.
+func (r *Reader) Stat(name string) (fs.FileInfo, error) {
+	e, err := r.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{e}, nil
+}
+
+// ReadDir reads the named directory. It implements fs.ReadDirFS.
+func (r *Reader) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := r.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := r.readDir(e)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	dirEntries := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		dirEntries[i] = fileInfo{e}
+	}
+	return dirEntries, nil
+}
+
+// Readlink returns the target of the named symbolic link.
+func (r *Reader) Readlink(name string) (string, error) {
+	e, err := r.lookup("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if e.mode.Type() != fs.ModeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return e.linkname, nil
+}
+
+// Extract writes the content of the named file to the file at dst. The file is
+// replaced atomically.
+func (r *Reader) Extract(name, dst string) error {
+	f, err := r.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil {
+		return err
+	} else if !fi.Mode().IsRegular() {
+		return &fs.PathError{Op: "extract", Path: name, Err: errors.New("not a regular file")}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, f); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to extract %q: %w", name, err)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (r *Reader) extentReader(e *entry) io.ReaderAt {
+	if len(e.extents) == 1 {
+		return io.NewSectionReader(r.r, int64(e.extents[0].lba)*SectorSize, int64(e.extents[0].size))
+	}
+	return &multiExtentReader{r: r.r, extents: e.extents}
+}
+
+// multiExtentReader reads a file which consists of multiple extents.
+type multiExtentReader struct {
+	r       io.ReaderAt
+	extents []extent
+}
+
+func (m *multiExtentReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for _, ext := range m.extents {
+		if len(p) == 0 {
+			break
+		}
+		if off >= int64(ext.size) {
+			off -= int64(ext.size)
+			continue
+		}
+		chunk := p
+		if rest := int64(ext.size) - off; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		read, err := m.r.ReadAt(chunk, int64(ext.lba)*SectorSize+off)
+		n += read
+		if err != nil {
+			return n, err
+		}
+		p = p[read:]
+		off = 0
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fileInfo implements fs.FileInfo and fs.DirEntry.
+type fileInfo struct {
+	e *entry
+}
+
+func (fi fileInfo) Name() string               { return fi.e.name }
+func (fi fileInfo) Size() int64                { return fi.e.size }
+func (fi fileInfo) Mode() fs.FileMode          { return fi.e.mode }
+func (fi fileInfo) ModTime() time.Time         { return fi.e.modTime }
+func (fi fileInfo) IsDir() bool                { return fi.e.mode.IsDir() }
+func (fi fileInfo) Sys() any                   { return nil }
+func (fi fileInfo) Type() fs.FileMode          { return fi.e.mode.Type() }
+func (fi fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+func (fi fileInfo) String() string             { return fs.FormatFileInfo(fi) }
+
+type file struct {
+	*io.SectionReader
+	e *entry
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return fileInfo{f.e}, nil }
+func (f *file) Close() error               { return nil }
+
+type dirFile struct {
+	r      *Reader
+	e      *entry
+	name   string
+	offset int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return fileInfo{d.e}, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := d.r.readDir(d.e)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+	}
+	entries = entries[d.offset:]
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && len(entries) > n {
+		entries = entries[:n]
+	}
+	d.offset += len(entries)
+	dirEntries := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		dirEntries[i] = fileInfo{e}
+	}
+	return dirEntries, nil
+}
+
+var (
+	_ fs.ReadDirFS = (*Reader)(nil)
+	_ fs.StatFS    = (*Reader)(nil)
+)
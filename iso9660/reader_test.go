@@ -0,0 +1,342 @@
+package iso9660_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/iso9660"
+)
+
+// The fixtures are created by libarchive from the same directory:
+//
+//	bsdtar -cf rockridge.iso --format iso9660 \
+//	  --options 'volume-id=TEST_ISO,boot=boot/efi.img,boot-type=no-emulation' -C dir .
+//
+// joliet.iso has "!rockridge" and plain.iso has "!rockridge,!joliet" in addition.
+// The deep directories and the symbolic links are recorded only in rockridge.iso.
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newReader(t *testing.T, b []byte) *iso9660.Reader {
+	t.Helper()
+	r, err := iso9660.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestReader(t *testing.T) {
+	cases := []struct {
+		fixture   string
+		wantFiles map[string]string
+		wantLinks map[string]string
+		wantMode  fs.FileMode
+	}{
+		{
+			fixture: "rockridge.iso.gz",
+			wantFiles: map[string]string{
+				"casper/vmlinuz":                 "ubuntu kernel",
+				"casper/initrd":                  "ubuntu initrd",
+				"live/vmlinuz-6.1.0-arm64":       "live kernel",
+				"Long File Name With Spaces.txt": "long",
+				"a/b/c/d/e/f/g/h/i/j/deep.txt":   "deep\n",
+			},
+			wantLinks: map[string]string{
+				"casper/vmlinuz.link": "vmlinuz",
+				"boot/abs.link":       "/boot/efi.img",
+			},
+			wantMode: 0o555,
+		},
+		{
+			fixture: "joliet.iso.gz",
+			wantFiles: map[string]string{
+				"casper/vmlinuz":                 "ubuntu kernel",
+				"live/vmlinuz-6.1.0-arm64":       "live kernel",
+				"Long File Name With Spaces.txt": "long",
+			},
+			wantMode: 0o444,
+		},
+		{
+			fixture: "plain.iso.gz",
+			wantFiles: map[string]string{
+				"casper/vmlinuz": "ubuntu kernel",
+				"long_fil.txt":   "long",
+			},
+			wantMode: 0o444,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.fixture, func(t *testing.T) {
+			r := newReader(t, readFixture(t, tc.fixture))
+			if got := r.VolumeID(); got != "TEST_ISO" {
+				t.Fatalf("want volume ID %q but got %q", "TEST_ISO", got)
+			}
+			for name, want := range tc.wantFiles {
+				got, err := fs.ReadFile(r, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Fatalf("%s: want %q but got %q", name, want, got)
+				}
+			}
+			for name, want := range tc.wantLinks {
+				got, err := r.Readlink(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Fatalf("%s: want %q but got %q", name, want, got)
+				}
+			}
+
+			fi, err := r.Stat("casper/vmlinuz")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode() != tc.wantMode {
+				t.Fatalf("want mode %v but got %v", tc.wantMode, fi.Mode())
+			}
+			if want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC); !fi.ModTime().Equal(want) {
+				t.Fatalf("want %v but got %v", want, fi.ModTime())
+			}
+
+			if _, err := r.Open("casper/missing"); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("want %v but got %v", fs.ErrNotExist, err)
+			}
+			if err := fstest.TestFS(r, "casper/vmlinuz", "casper/initrd"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestReaderRoundTrip(t *testing.T) {
+	img := iso9660.NewImage(iso9660.WithVolumeID("cidata"), iso9660.WithModTime(time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)))
+	files := map[string]string{
+		"user-data":          "#cloud-config\n",
+		"meta-data":          "instance-id: iid-local01\n",
+		"dir/Mixed Case.txt": "mixed",
+		"dir/sub/big":        string(bytes.Repeat([]byte("0123456789"), 1000)),
+	}
+	for name, data := range files {
+		if err := img.AddFile(name, []byte(data), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := img.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newReader(t, b)
+	if got := r.VolumeID(); got != "cidata" {
+		t.Fatalf("want volume ID %q but got %q", "cidata", got)
+	}
+	var names []string
+	err = fs.WalkDir(r, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantNames := []string{".", "dir", "dir/Mixed Case.txt", "dir/sub", "dir/sub/big", "meta-data", "user-data"}
+	if !reflect.DeepEqual(wantNames, names) {
+		t.Fatalf("want %q but got %q", wantNames, names)
+	}
+	for name, want := range files {
+		got, err := fs.ReadFile(r, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("%s: want %q but got %q", name, want, got)
+		}
+		fi, err := r.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != 0o640 {
+			t.Fatalf("%s: want mode %v but got %v", name, fs.FileMode(0o640), fi.Mode())
+		}
+	}
+	if err := fstest.TestFS(r, "user-data", "dir/sub/big"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderExtract(t *testing.T) {
+	r := newReader(t, readFixture(t, "rockridge.iso.gz"))
+	dst := filepath.Join(t.TempDir(), "vmlinuz")
+	if err := r.Extract("casper/vmlinuz", dst); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ubuntu kernel" {
+		t.Fatalf("want the kernel but got %q", got)
+	}
+	if err := r.Extract("casper", dst); err == nil {
+		t.Fatal("want error for the directory")
+	}
+}
+
+func TestReaderBootEntries(t *testing.T) {
+	b := readFixture(t, "rockridge.iso.gz")
+	r := newReader(t, b)
+	entries, err := r.BootEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("want 1 boot entry but got %d", len(entries))
+	}
+	e := entries[0]
+	if e.Platform != iso9660.PlatformX86 || !e.Bootable || e.Emulation != iso9660.EmulationNone {
+		t.Fatalf("want a bootable x86 entry without emulation but got %+v", e)
+	}
+	efiImg, err := fs.ReadFile(r, "boot/efi.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bootImg, err := io.ReadAll(r.OpenBootImage(e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(efiImg[:len(bootImg)], bootImg) {
+		t.Fatal("want the boot image to be boot/efi.img")
+	}
+
+	// Change the platform of the catalog to EFI. Then the size of the FAT image is
+	// used instead of the sector count.
+	catalog := b[binary.LittleEndian.Uint32(b[17*iso9660.SectorSize+71:])*iso9660.SectorSize:]
+	catalog[1] = byte(iso9660.PlatformEFI)
+	binary.LittleEndian.PutUint16(catalog[28:], 0)
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += binary.LittleEndian.Uint16(catalog[i:])
+	}
+	binary.LittleEndian.PutUint16(catalog[28:], -sum)
+
+	entries, err = newReader(t, b).BootEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].Platform != iso9660.PlatformEFI {
+		t.Fatalf("want the EFI entry but got %v", entries[0].Platform)
+	}
+	bootImg, err = io.ReadAll(r.OpenBootImage(entries[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(efiImg, bootImg) {
+		t.Fatalf("want the whole boot/efi.img but got %d bytes", len(bootImg))
+	}
+}
+
+func TestReaderNoBootEntries(t *testing.T) {
+	b, err := iso9660.NewImage().Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := newReader(t, b).BootEntries()
+	if err != nil || entries != nil {
+		t.Fatalf("want no entries but got %v, %v", entries, err)
+	}
+}
+
+func TestReaderError(t *testing.T) {
+	_, err := iso9660.NewReader(bytes.NewReader(make([]byte, 20*iso9660.SectorSize)))
+	if !errors.Is(err, iso9660.ErrFormat) {
+		t.Fatalf("want %v but got %v", iso9660.ErrFormat, err)
+	}
+}
+
+func TestFindLinux(t *testing.T) {
+	cases := []struct {
+		fixture string
+		want    []string
+	}{
+		{
+			fixture: "rockridge.iso.gz",
+			want: []string{
+				"Ubuntu casper/vmlinuz casper/initrd []",
+				"Debian Live live/vmlinuz-6.1.0-arm64 live/initrd.img-6.1.0-arm64 [boot=live components]",
+			},
+		},
+		{
+			fixture: "plain.iso.gz",
+			want: []string{
+				"Ubuntu casper/vmlinuz casper/initrd []",
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.fixture, func(t *testing.T) {
+			boots, err := newReader(t, readFixture(t, tc.fixture)).FindLinux()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, b := range boots {
+				got = append(got, b.Distro+" "+b.Kernel+" "+b.Initrd+" ["+b.CommandLine.String()+"]")
+			}
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("want %q but got %q", tc.want, got)
+			}
+		})
+	}
+
+	img := iso9660.NewImage(iso9660.WithVolumeID("Fedora-S-dvd-aarch64-40"))
+	for _, name := range []string{"images/pxeboot/vmlinuz", "images/pxeboot/initrd.img"} {
+		if err := img.AddFile(name, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := img.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	boots, err := newReader(t, b).FindLinux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(boots) != 1 || boots[0].Distro != "Fedora" {
+		t.Fatalf("want Fedora but got %+v", boots)
+	}
+	if want, got := "inst.stage2=hd:LABEL=Fedora-S-dvd-aarch64-40", boots[0].CommandLine.String(); want != got {
+		t.Fatalf("want %q but got %q", want, got)
+	}
+}
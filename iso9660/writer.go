@@ -0,0 +1,746 @@
+// Package iso9660 reads and writes ISO 9660 images with the Joliet and Rock Ridge
+// extensions, and reads the El Torito boot catalog.
+//
+// see: https://www.ecma-international.org/publications-and-standards/standards/ecma-119/
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/Code-Hex/vz/v3/internal/fstree"
+)
+
+// SectorSize is the size of a logical sector (block) of ISO 9660 images.
+const SectorSize = 2048
+
+var (
+	// ErrInvalidPath is returned when the path of an entry is invalid.
+	ErrInvalidPath = fstree.ErrInvalidPath
+
+	// ErrNameTooLong is returned when a name can not be recorded in a directory record.
+	ErrNameTooLong = errors.New("iso9660: name too long")
+)
+
+const (
+	// maxRockRidgeName is the maximum length of a name which is recorded in a single
+	// NM entry. Longer names would need a continuation area.
+	maxRockRidgeName = 150
+
+	// maxJolietName is the maximum number of UCS-2 characters of Joliet identifiers.
+	maxJolietName = 64
+)
+
+const (
+	// first sector after the system area.
+	systemAreaSectors = 16
+
+	recordFlagDir = 0x02
+)
+
+// Image is a set of files and directories which are written as an ISO 9660 image.
+//
+// The image has the primary volume descriptor whose names are restricted to the
+// interchange level 1 (8.3 upper case names), the Rock Ridge extensions in the
+// primary directory tree which record the original names and the POSIX modes,
+// and the Joliet supplementary volume descriptor for Windows and macOS.
+//
+// The image is reproducible: the entries are sorted by name and the timestamps are
+// fixed. The parent directories which are not added explicitly are created with the
+// mode 0755.
+type Image struct {
+	tree     *fstree.Tree
+	volumeID string
+	modTime  time.Time
+}
+
+// ImageOption is an option for NewImage.
+type ImageOption func(*Image)
+
+// WithVolumeID sets the volume identifier (label) of the image, such as "cidata".
+// It is truncated to 32 bytes in the primary volume descriptor and to 16 characters
+// in the Joliet volume descriptor.
+func WithVolumeID(id string) ImageOption {
+	return func(img *Image) {
+		img.volumeID = id
+	}
+}
+
+// WithModTime sets the timestamps of the volume and all entries. The default is the
+// Unix epoch.
+func WithModTime(t time.Time) ImageOption {
+	return func(img *Image) {
+		img.modTime = t
+	}
+}
+
+// NewImage creates a new empty Image.
+func NewImage(opts ...ImageOption) *Image {
+	img := &Image{
+		modTime: time.Unix(0, 0),
+	}
+	for _, opt := range opts {
+		opt(img)
+	}
+	img.tree = fstree.New(img.modTime)
+	return img
+}
+
+// AddFile adds a regular file which has the data. A file which has the same name is
+// replaced.
+func (img *Image) AddFile(name string, data []byte, perm fs.FileMode) error {
+	_, err := img.tree.AddFile(name, data, perm)
+	return err
+}
+
+// AddFileFromPath adds a regular file whose content is read from the file at src on
+// the host when the image is written. The perm is used instead of the mode of src.
+func (img *Image) AddFileFromPath(name, src string, perm fs.FileMode) error {
+	_, err := img.tree.AddFileFromPath(name, src, perm)
+	return err
+}
+
+// AddDir adds a directory.
+func (img *Image) AddDir(name string, perm fs.FileMode) error {
+	_, err := img.tree.AddDir(name, perm)
+	return err
+}
+
+// volume is a directory hierarchy of the primary or the Joliet volume descriptor.
+type volume struct {
+	joliet bool
+	// dirs are in the order of the path table.
+	dirs          []*dirExtent
+	pathTableSize uint32
+	lPathTableLBA uint32
+	mPathTableLBA uint32
+}
+
+type dirExtent struct {
+	node    *fstree.Node
+	ident   []byte
+	parent  *dirExtent
+	number  uint16
+	entries []*dirEntry
+	lba     uint32
+	size    uint32
+}
+
+type dirEntry struct {
+	node  *fstree.Node
+	ident []byte
+	// dir is the extent of the directory. It is nil for files.
+	dir *dirExtent
+}
+
+type layout struct {
+	img      *Image
+	primary  *volume
+	joliet   *volume
+	files    []*fstree.Node
+	fileLBA  map[*fstree.Node]uint32
+	ceLBA    uint32
+	metaSize uint32
+	total    uint32
+}
+
+// WriteTo writes the ISO 9660 image to w.
+func (img *Image) WriteTo(w io.Writer) (int64, error) {
+	l, err := img.layout()
+	if err != nil {
+		return 0, err
+	}
+	cw := &countWriter{w: w}
+	if _, err := cw.Write(l.metadata()); err != nil {
+		return cw.n, err
+	}
+	for _, f := range l.files {
+		if err := writeFile(cw, f); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// Bytes returns the ISO 9660 image.
+func (img *Image) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := img.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeFile(w io.Writer, n *fstree.Node) error {
+	r, err := n.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	written, err := io.Copy(w, io.LimitReader(r, n.Size()))
+	if err != nil {
+		return fmt.Errorf("failed to copy %q: %w", n.Path(), err)
+	}
+	if written != n.Size() {
+		return fmt.Errorf("failed to copy %q: %w", n.Path(), io.ErrUnexpectedEOF)
+	}
+	_, err = w.Write(make([]byte, padSector(written)))
+	return err
+}
+
+func (img *Image) layout() (*layout, error) {
+	l := &layout{
+		img:     img,
+		fileLBA: make(map[*fstree.Node]uint32),
+	}
+	var err error
+	if l.primary, err = newVolume(img.tree.Root(), false); err != nil {
+		return nil, err
+	}
+	if l.joliet, err = newVolume(img.tree.Root(), true); err != nil {
+		return nil, err
+	}
+
+	// The primary, Joliet and terminator volume descriptors are followed by the path
+	// tables and the directories.
+	lba := uint32(systemAreaSectors + 3)
+	for _, v := range []*volume{l.primary, l.joliet} {
+		v.lPathTableLBA = lba
+		lba += sectors(v.pathTableSize)
+		v.mPathTableLBA = lba
+		lba += sectors(v.pathTableSize)
+	}
+	for _, v := range []*volume{l.primary, l.joliet} {
+		for _, d := range v.dirs {
+			d.size = l.dirSize(v, d)
+			d.lba = lba
+			lba += sectors(d.size)
+		}
+	}
+	// The continuation area of the Rock Ridge "ER" entry is placed after the
+	// directories, because some readers such as libarchive read the image
+	// sequentially.
+	l.ceLBA = lba
+	lba++
+	l.metaSize = lba
+	err = img.tree.Walk(func(n *fstree.Node) error {
+		if n.IsDir() {
+			return nil
+		}
+		l.files = append(l.files, n)
+		if n.Size() > 0 {
+			l.fileLBA[n] = lba
+			lba += sectors(uint32(n.Size()))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	l.total = lba
+	return l, nil
+}
+
+func newVolume(root *fstree.Node, joliet bool) (*volume, error) {
+	v := &volume{joliet: joliet}
+	rootDir := &dirExtent{node: root, ident: []byte{0}, number: 1}
+	rootDir.parent = rootDir
+	v.dirs = append(v.dirs, rootDir)
+	// The breadth-first order with the sorted entries is the order of the path table.
+	for i := 0; i < len(v.dirs); i++ {
+		d := v.dirs[i]
+		entries, err := newEntries(d.node.Children(), joliet)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		for _, e := range entries {
+			if !e.node.IsDir() {
+				continue
+			}
+			if len(v.dirs) >= 0xffff {
+				return nil, errors.New("iso9660: too many directories")
+			}
+			e.dir = &dirExtent{
+				node:   e.node,
+				ident:  e.ident,
+				parent: d,
+				number: uint16(len(v.dirs) + 1),
+			}
+			v.dirs = append(v.dirs, e.dir)
+		}
+	}
+	for _, d := range v.dirs {
+		v.pathTableSize += uint32(8 + len(d.ident) + len(d.ident)%2)
+	}
+	return v, nil
+}
+
+func newEntries(nodes []*fstree.Node, joliet bool) ([]*dirEntry, error) {
+	entries := make([]*dirEntry, 0, len(nodes))
+	used := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		if !n.IsDir() && !n.Mode.IsRegular() {
+			return nil, fmt.Errorf("iso9660: unsupported file type of %q: %v", n.Path(), n.Mode.Type())
+		}
+		if n.Size() > 0xffffffff {
+			return nil, fmt.Errorf("iso9660: %q is too large", n.Path())
+		}
+		if len(n.Name) > maxRockRidgeName {
+			return nil, fmt.Errorf("%w: %q", ErrNameTooLong, n.Path())
+		}
+		var ident []byte
+		if joliet {
+			ident = jolietIdent(n.Name, n.IsDir(), used)
+		} else {
+			ident = primaryIdent(n.Name, n.IsDir(), used)
+		}
+		entries = append(entries, &dirEntry{node: n, ident: ident})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if joliet {
+			return bytes.Compare(entries[i].ident, entries[j].ident) < 0
+		}
+		return comparePrimaryIdent(entries[i].ident, entries[j].ident) < 0
+	})
+	return entries, nil
+}
+
+// primaryIdent returns the identifier of the interchange level 1 such as "USER_DAT.;1".
+func primaryIdent(name string, isDir bool, used map[string]bool) []byte {
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); i > 0 && !isDir {
+		base, ext = name[:i], name[i+1:]
+	}
+	ext = dChars(ext, 3)
+	for i := 0; ; i++ {
+		// Resolve the conflict by a numeric suffix, such as "USER_DA1".
+		suffix := ""
+		if i > 0 {
+			suffix = strconv.Itoa(i)
+		}
+		ident := dChars(base, 8-len(suffix)) + suffix
+		if ident == "" {
+			ident = "_"
+		}
+		if !isDir {
+			ident += "." + ext
+		}
+		if !used[ident] {
+			used[ident] = true
+			if !isDir {
+				ident += ";1"
+			}
+			return []byte(ident)
+		}
+	}
+}
+
+// dChars converts s to the d-characters (A-Z, 0-9 and _) up to n characters.
+func dChars(s string, n int) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(s) {
+		if b.Len() == n {
+			break
+		}
+		if ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || r == '_' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// comparePrimaryIdent compares the identifiers by the name and then by the extension
+// as specified in ECMA-119 9.3.
+func comparePrimaryIdent(a, b []byte) int {
+	aBase, aExt, _ := bytes.Cut(a, []byte("."))
+	bBase, bExt, _ := bytes.Cut(b, []byte("."))
+	if c := bytes.Compare(aBase, bBase); c != 0 {
+		return c
+	}
+	return bytes.Compare(aExt, bExt)
+}
+
+// jolietIdent returns the identifier of the Joliet directory record encoded in UCS-2
+// big endian.
+func jolietIdent(name string, isDir bool, used map[string]bool) []byte {
+	runes := []rune(strings.Map(func(r rune) rune {
+		switch r {
+		case '*', '/', ':', ';', '?', '\\':
+			return '_'
+		}
+		return r
+	}, name))
+	ident := truncateUTF16(runes, maxJolietName)
+	for i := 1; used[ident]; i++ {
+		suffix := "~" + strconv.Itoa(i)
+		ident = truncateUTF16(runes, maxJolietName-len(suffix)) + suffix
+	}
+	used[ident] = true
+	if !isDir {
+		ident += ";1"
+	}
+	return ucs2(ident)
+}
+
+func truncateUTF16(runes []rune, n int) string {
+	units := 0
+	for i, r := range runes {
+		units += len(utf16.Encode([]rune{r}))
+		if units > n {
+			return string(runes[:i])
+		}
+	}
+	return string(runes)
+}
+
+func ucs2(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+func (l *layout) dirSize(v *volume, d *dirExtent) uint32 {
+	var size uint32
+	for _, rec := range l.dirRecords(v, d) {
+		size = appendRecordSize(size, len(rec))
+	}
+	return roundSector(size)
+}
+
+// appendRecordSize returns the offset after the record of the size which is placed
+// at the offset. A directory record does not cross a sector boundary.
+func appendRecordSize(offset uint32, size int) uint32 {
+	if offset%SectorSize+uint32(size) > SectorSize {
+		offset = roundSector(offset)
+	}
+	return offset + uint32(size)
+}
+
+func (l *layout) dirRecords(v *volume, d *dirExtent) [][]byte {
+	modTime := l.img.modTime
+	records := make([][]byte, 0, len(d.entries)+2)
+
+	var selfSU, parentSU []byte
+	if !v.joliet {
+		if d.parent == d {
+			selfSU = append(selfSU, suspSP()...)
+		}
+		selfSU = append(selfSU, rockRidge(d.node, modTime, false, nlink(d.node))...)
+		if d.parent == d {
+			selfSU = append(selfSU, suspCE(l.ceLBA, uint32(len(suspER())))...)
+		}
+		parentSU = rockRidge(d.parent.node, modTime, false, nlink(d.parent.node))
+	}
+	records = append(records,
+		dirRecord([]byte{0}, d.lba, d.size, recordFlagDir, modTime, selfSU),
+		dirRecord([]byte{1}, d.parent.lba, d.parent.size, recordFlagDir, modTime, parentSU),
+	)
+	for _, e := range d.entries {
+		var su []byte
+		if !v.joliet {
+			su = rockRidge(e.node, modTime, true, nlink(e.node))
+		}
+		if e.dir != nil {
+			records = append(records, dirRecord(e.ident, e.dir.lba, e.dir.size, recordFlagDir, modTime, su))
+		} else {
+			records = append(records, dirRecord(e.ident, l.fileLBA[e.node], uint32(e.node.Size()), 0, modTime, su))
+		}
+	}
+	return records
+}
+
+func nlink(n *fstree.Node) uint32 {
+	if !n.IsDir() {
+		return 1
+	}
+	nlink := uint32(2)
+	for _, child := range n.Children() {
+		if child.IsDir() {
+			nlink++
+		}
+	}
+	return nlink
+}
+
+// dirRecord returns the directory record (ECMA-119 9.1).
+func dirRecord(ident []byte, lba, size uint32, flags byte, t time.Time, su []byte) []byte {
+	n := 33 + len(ident)
+	if len(ident)%2 == 0 {
+		n++
+	}
+	n += len(su)
+	n += n % 2
+	b := make([]byte, n)
+	b[0] = byte(n)
+	putBoth32(b[2:], lba)
+	putBoth32(b[10:], size)
+	putRecordTime(b[18:], t)
+	b[25] = flags
+	putBoth16(b[28:], 1)
+	b[32] = byte(len(ident))
+	copy(b[33:], ident)
+	copy(b[33+len(ident)+(1-len(ident)%2):], su)
+	return b
+}
+
+// Rock Ridge flags of the "RR" entry.
+const (
+	rrPX = 0x01
+	rrNM = 0x08
+	rrTF = 0x80
+)
+
+// rockRidge returns the System Use entries of the Rock Ridge extensions (RRIP 1.09).
+func rockRidge(n *fstree.Node, t time.Time, named bool, nlink uint32) []byte {
+	flags := byte(rrPX | rrTF)
+	if named {
+		flags |= rrNM
+	}
+	b := []byte{'R', 'R', 5, 1, flags}
+
+	px := make([]byte, 36)
+	copy(px, []byte{'P', 'X', 36, 1})
+	putBoth32(px[4:], unixMode(n.Mode))
+	putBoth32(px[12:], nlink)
+	putBoth32(px[20:], uint32(n.UID))
+	putBoth32(px[28:], uint32(n.GID))
+	b = append(b, px...)
+
+	// Only the modification time is recorded.
+	tf := make([]byte, 12)
+	copy(tf, []byte{'T', 'F', 12, 1, 0x02})
+	putRecordTime(tf[5:], t)
+	b = append(b, tf...)
+
+	if named {
+		b = append(b, 'N', 'M', byte(5+len(n.Name)), 1, 0)
+		b = append(b, n.Name...)
+	}
+	return b
+}
+
+func unixMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	if mode.IsDir() {
+		return 0o040000 | m
+	}
+	return 0o100000 | m
+}
+
+// suspSP returns the "SP" entry which indicates that SUSP is used.
+func suspSP() []byte {
+	return []byte{'S', 'P', 7, 1, 0xbe, 0xef, 0}
+}
+
+// suspCE returns the "CE" entry which points to the continuation area.
+func suspCE(lba, size uint32) []byte {
+	b := make([]byte, 28)
+	copy(b, []byte{'C', 'E', 28, 1})
+	putBoth32(b[4:], lba)
+	putBoth32(b[12:], 0)
+	putBoth32(b[20:], size)
+	return b
+}
+
+// suspER returns the "ER" entry which identifies the Rock Ridge extensions.
+func suspER() []byte {
+	const (
+		id  = "RRIP_1991A"
+		des = "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+		src = "PLEASE CONTACT DISC PUBLISHER FOR SPECIFICATION SOURCE.  SEE PUBLISHER IDENTIFIER IN PRIMARY VOLUME DESCRIPTOR FOR CONTACT INFORMATION."
+	)
+	b := []byte{'E', 'R', byte(8 + len(id) + len(des) + len(src)), 1, byte(len(id)), byte(len(des)), byte(len(src)), 1}
+	b = append(b, id...)
+	b = append(b, des...)
+	return append(b, src...)
+}
+
+func (l *layout) metadata() []byte {
+	b := make([]byte, l.metaSize*SectorSize)
+	sector := func(lba uint32) []byte {
+		return b[lba*SectorSize : (lba+1)*SectorSize]
+	}
+
+	l.volumeDescriptor(sector(systemAreaSectors), l.primary)
+	l.volumeDescriptor(sector(systemAreaSectors+1), l.joliet)
+	terminator := sector(systemAreaSectors + 2)
+	terminator[0] = 255
+	copy(terminator[1:], "CD001")
+	terminator[6] = 1
+	copy(sector(l.ceLBA), suspER())
+
+	for _, v := range []*volume{l.primary, l.joliet} {
+		lpt := b[v.lPathTableLBA*SectorSize:]
+		mpt := b[v.mPathTableLBA*SectorSize:]
+		off := 0
+		for _, d := range v.dirs {
+			for _, pt := range []struct {
+				b     []byte
+				order binary.ByteOrder
+			}{{lpt, binary.LittleEndian}, {mpt, binary.BigEndian}} {
+				pt.b[off] = byte(len(d.ident))
+				pt.order.PutUint32(pt.b[off+2:], d.lba)
+				pt.order.PutUint16(pt.b[off+6:], d.parent.number)
+				copy(pt.b[off+8:], d.ident)
+			}
+			off += 8 + len(d.ident) + len(d.ident)%2
+		}
+		for _, d := range v.dirs {
+			off := d.lba * SectorSize
+			var size uint32
+			for _, rec := range l.dirRecords(v, d) {
+				start := appendRecordSize(size, len(rec)) - uint32(len(rec))
+				copy(b[off+start:], rec)
+				size = start + uint32(len(rec))
+			}
+		}
+	}
+	return b
+}
+
+// volumeDescriptor writes the primary or the Joliet supplementary volume descriptor
+// (ECMA-119 8.4 and 8.5).
+func (l *layout) volumeDescriptor(b []byte, v *volume) {
+	fill := func(field []byte, s string) {
+		if v.joliet {
+			u := ucs2(s)
+			for i := 0; i+1 < len(field); i += 2 {
+				if i+1 < len(u) {
+					field[i], field[i+1] = u[i], u[i+1]
+				} else {
+					field[i], field[i+1] = 0, ' '
+				}
+			}
+			return
+		}
+		for i := range field {
+			field[i] = ' '
+		}
+		copy(field, s)
+	}
+
+	b[0] = 1
+	if v.joliet {
+		b[0] = 2
+	}
+	copy(b[1:], "CD001")
+	b[6] = 1
+	fill(b[8:40], "")
+	fill(b[40:72], l.img.volumeID)
+	putBoth32(b[80:], l.total)
+	if v.joliet {
+		// UCS-2 level 3.
+		copy(b[88:], "%/E")
+	}
+	putBoth16(b[120:], 1)
+	putBoth16(b[124:], 1)
+	putBoth16(b[128:], SectorSize)
+	putBoth32(b[132:], v.pathTableSize)
+	binary.LittleEndian.PutUint32(b[140:], v.lPathTableLBA)
+	binary.BigEndian.PutUint32(b[148:], v.mPathTableLBA)
+	root := v.dirs[0]
+	copy(b[156:190], dirRecord([]byte{0}, root.lba, root.size, recordFlagDir, l.img.modTime, nil))
+	fill(b[190:318], "")
+	fill(b[318:446], "")
+	fill(b[446:574], "")
+	fill(b[574:702], "")
+	fill(b[702:739], "")
+	fill(b[739:776], "")
+	fill(b[776:813], "")
+	putVolumeTime(b[813:], l.img.modTime)
+	putVolumeTime(b[830:], l.img.modTime)
+	putVolumeTime(b[847:], time.Time{})
+	putVolumeTime(b[864:], time.Time{})
+	b[881] = 1
+}
+
+// putRecordTime writes the 7 bytes recording date and time in UTC.
+func putRecordTime(b []byte, t time.Time) {
+	t = t.UTC()
+	year := t.Year() - 1900
+	if year < 0 {
+		year = 0
+	} else if year > 255 {
+		year = 255
+	}
+	b[0] = byte(year)
+	b[1] = byte(t.Month())
+	b[2] = byte(t.Day())
+	b[3] = byte(t.Hour())
+	b[4] = byte(t.Minute())
+	b[5] = byte(t.Second())
+	b[6] = 0
+}
+
+// putVolumeTime writes the 17 bytes date and time in UTC. The zero time is written as
+// "not specified".
+func putVolumeTime(b []byte, t time.Time) {
+	if t.IsZero() {
+		copy(b, "0000000000000000")
+		b[16] = 0
+		return
+	}
+	t = t.UTC()
+	copy(b, fmt.Sprintf("%04d%02d%02d%02d%02d%02d%02d", t.Year(), t.Month(), t.Day(),
+		t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/10000000))
+	b[16] = 0
+}
+
+// putBoth16 writes v in both-byte orders (little endian followed by big endian).
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+// putBoth32 writes v in both-byte orders (little endian followed by big endian).
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func sectors(size uint32) uint32 {
+	return (size + SectorSize - 1) / SectorSize
+}
+
+func roundSector(size uint32) uint32 {
+	return sectors(size) * SectorSize
+}
+
+func padSector(size int64) int64 {
+	return (SectorSize - size%SectorSize) % SectorSize
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,181 @@
+package iso9660_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/Code-Hex/vz/v3/iso9660"
+)
+
+type record struct {
+	ident    string
+	rockName string
+	lba      uint32
+	size     uint32
+	isDir    bool
+}
+
+// readDir reads the directory records of the extent. The "." and ".." records are
+// skipped.
+func readDir(t *testing.T, img []byte, lba, size uint32, joliet bool) []record {
+	t.Helper()
+	var records []record
+	extent := img[lba*iso9660.SectorSize : lba*iso9660.SectorSize+size]
+	for off := 0; off < len(extent); {
+		n := int(extent[off])
+		if n == 0 {
+			off = (off/iso9660.SectorSize + 1) * iso9660.SectorSize
+			continue
+		}
+		b := extent[off : off+n]
+		off += n
+		identLen := int(b[32])
+		ident := b[33 : 33+identLen]
+		if identLen == 1 && ident[0] <= 1 {
+			continue
+		}
+		r := record{
+			lba:   binary.LittleEndian.Uint32(b[2:]),
+			size:  binary.LittleEndian.Uint32(b[10:]),
+			isDir: b[25]&0x02 != 0,
+			ident: string(ident),
+		}
+		if joliet {
+			u := make([]uint16, identLen/2)
+			for i := range u {
+				u[i] = binary.BigEndian.Uint16(ident[2*i:])
+			}
+			r.ident = string(utf16.Decode(u))
+		}
+		su := b[33+identLen+(1-identLen%2):]
+		for len(su) >= 4 && su[2] >= 4 {
+			if string(su[:2]) == "NM" {
+				r.rockName = string(su[5:su[2]])
+			}
+			su = su[su[2]:]
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func rootDir(t *testing.T, img []byte, sector int) []record {
+	t.Helper()
+	vd := img[sector*iso9660.SectorSize:]
+	root := vd[156:]
+	return readDir(t, img, binary.LittleEndian.Uint32(root[2:]), binary.LittleEndian.Uint32(root[10:]), vd[0] == 2)
+}
+
+func TestImage(t *testing.T) {
+	img := iso9660.NewImage(iso9660.WithVolumeID("cidata"))
+	if err := img.AddFile("user-data", []byte("#cloud-config\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.AddFile("Long Name A.txt", []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.AddFile("Long Name B.txt", bytes.Repeat([]byte("b"), 3000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.AddFile("dir/empty", nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := img.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b)%iso9660.SectorSize != 0 {
+		t.Fatalf("want the image to consist of sectors but got %d bytes", len(b))
+	}
+
+	for i, want := range []string{"\x01CD001", "\x02CD001", "\xffCD001"} {
+		if got := string(b[(16+i)*iso9660.SectorSize:][:6]); got != want {
+			t.Fatalf("volume descriptor %d: want %q but got %q", i, want, got)
+		}
+	}
+	if got := strings.TrimRight(string(b[16*iso9660.SectorSize+40:][:32]), " "); got != "cidata" {
+		t.Fatalf("want volume ID %q but got %q", "cidata", got)
+	}
+	if got := binary.LittleEndian.Uint32(b[16*iso9660.SectorSize+80:]); int(got)*iso9660.SectorSize != len(b) {
+		t.Fatalf("want the volume space size %d but got %d", len(b)/iso9660.SectorSize, got)
+	}
+
+	primary := rootDir(t, b, 16)
+	var idents, names []string
+	for _, r := range primary {
+		idents = append(idents, r.ident)
+		names = append(names, r.rockName)
+	}
+	wantIdents := []string{"DIR", "LONG_NA1.TXT;1", "LONG_NAM.TXT;1", "USER_DAT.;1"}
+	if !reflect.DeepEqual(wantIdents, idents) {
+		t.Fatalf("want identifiers %q but got %q", wantIdents, idents)
+	}
+	wantNames := []string{"dir", "Long Name B.txt", "Long Name A.txt", "user-data"}
+	if !reflect.DeepEqual(wantNames, names) {
+		t.Fatalf("want Rock Ridge names %q but got %q", wantNames, names)
+	}
+	data := primary[1]
+	if got := string(b[data.lba*iso9660.SectorSize:][:data.size]); got != strings.Repeat("b", 3000) {
+		t.Fatalf("want the content of %q but got %q", data.rockName, got)
+	}
+
+	var jolietNames []string
+	for _, r := range rootDir(t, b, 17) {
+		jolietNames = append(jolietNames, r.ident)
+	}
+	wantJoliet := []string{"Long Name A.txt;1", "Long Name B.txt;1", "dir", "user-data;1"}
+	if !reflect.DeepEqual(wantJoliet, jolietNames) {
+		t.Fatalf("want Joliet names %q but got %q", wantJoliet, jolietNames)
+	}
+}
+
+func TestImageReproducible(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.WriteFile(src, []byte("from path"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	build := func(reverse bool) []byte {
+		img := iso9660.NewImage()
+		adds := []func() error{
+			func() error { return img.AddFile("a/b/c", []byte("c"), 0o644) },
+			func() error { return img.AddDir("a", 0o700) },
+			func() error { return img.AddFileFromPath("z", src, 0o644) },
+		}
+		if reverse {
+			adds[0], adds[2] = adds[2], adds[0]
+		}
+		for _, add := range adds {
+			if err := add(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b, err := img.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if !bytes.Equal(build(false), build(true)) {
+		t.Fatal("want the same image regardless of the order of additions")
+	}
+}
+
+func TestImageError(t *testing.T) {
+	img := iso9660.NewImage()
+	if err := img.AddFile("/", nil, 0o644); !errors.Is(err, iso9660.ErrInvalidPath) {
+		t.Fatalf("want %v but got %v", iso9660.ErrInvalidPath, err)
+	}
+	if err := img.AddFile(strings.Repeat("a", 200), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.Bytes(); !errors.Is(err, iso9660.ErrNameTooLong) {
+		t.Fatalf("want %v but got %v", iso9660.ErrNameTooLong, err)
+	}
+}
@@ -0,0 +1,404 @@
+package kernel
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrUnterminatedQuote is returned when a quote in the command line is not closed.
+	ErrUnterminatedQuote = errors.New("unterminated quote in kernel command line")
+
+	// ErrInvalidParameter is returned when a parameter can not be represented in the
+	// kernel command line.
+	ErrInvalidParameter = errors.New("invalid kernel command-line parameter")
+)
+
+// ConsoleHVC0 is the first virtio console device which is used as the console by
+// Virtualization.framework guests.
+const ConsoleHVC0 = "hvc0"
+
+// Param is a parameter of the kernel command line.
+type Param struct {
+	// Key is the name of the parameter, such as "console" or "quiet".
+	Key string
+
+	// Value is the value of the parameter. It is empty if HasValue is false.
+	Value string
+
+	// HasValue reports whether the parameter has "=", so that "quiet" and "quiet="
+	// are distinguished.
+	HasValue bool
+}
+
+func (p Param) String() string {
+	if !p.HasValue {
+		return p.Key
+	}
+	return p.Key + "=" + quoteIfNeeded(p.Value)
+}
+
+// CommandLine is a kernel command line which consists of parameters and the arguments
+// for init after "--".
+//
+// The parameters are kept in order. The same key may appear multiple times (e.g.
+// "console=ttyS0 console=hvc0"). Like the kernel, "-" and "_" in keys are regarded as
+// the same character.
+//
+// see: https://www.kernel.org/doc/html/latest/admin-guide/kernel-parameters.html
+type CommandLine struct {
+	params   []Param
+	initArgs []string
+}
+
+// NewCommandLine creates a new CommandLine which has params.
+func NewCommandLine(params ...Param) *CommandLine {
+	return &CommandLine{
+		params: append([]Param(nil), params...),
+	}
+}
+
+// ParseCommandLine parses the kernel command line s in the same way as the kernel.
+//
+// A value which contains spaces can be quoted by double quotes, either the value
+// (key="a b") or the whole parameter ("key=a b"). The arguments after "--" are the
+// arguments for init.
+func ParseCommandLine(s string) (*CommandLine, error) {
+	c := &CommandLine{}
+	afterDashes := false
+	for {
+		s = strings.TrimLeft(s, " \t\n")
+		if s == "" {
+			return c, nil
+		}
+		p, rest, err := nextParam(s)
+		if err != nil {
+			return nil, err
+		}
+		s = rest
+		if !afterDashes && p.Key == "--" && !p.HasValue {
+			afterDashes = true
+			continue
+		}
+		if afterDashes {
+			c.initArgs = append(c.initArgs, unquotedString(p))
+			continue
+		}
+		c.params = append(c.params, p)
+	}
+}
+
+// nextParam parses the next parameter like next_arg in the kernel (lib/cmdline.c).
+func nextParam(s string) (Param, string, error) {
+	quoted := strings.HasPrefix(s, `"`)
+	if quoted {
+		s = s[1:]
+	}
+	inQuote := quoted
+	equals := -1
+	i := 0
+	for ; i < len(s); i++ {
+		ch := s[i]
+		if (ch == ' ' || ch == '\t' || ch == '\n') && !inQuote {
+			break
+		}
+		if equals < 0 && ch == '=' {
+			equals = i
+		}
+		if ch == '"' {
+			inQuote = !inQuote
+		}
+	}
+	if inQuote {
+		return Param{}, "", fmt.Errorf("%w: %s", ErrUnterminatedQuote, s[:i])
+	}
+	token, rest := s[:i], s[i:]
+
+	// The quotes which enclose the value or the whole parameter are removed.
+	var p Param
+	if equals < 0 {
+		p.Key = token
+	} else {
+		p.Key, p.Value, p.HasValue = token[:equals], token[equals+1:], true
+		if strings.HasPrefix(p.Value, `"`) {
+			p.Value = strings.TrimSuffix(p.Value[1:], `"`)
+			quoted = false
+		}
+	}
+	if quoted {
+		if p.HasValue {
+			p.Value = strings.TrimSuffix(p.Value, `"`)
+		} else {
+			p.Key = strings.TrimSuffix(p.Key, `"`)
+		}
+	}
+	return p, rest, nil
+}
+
+func unquotedString(p Param) string {
+	if !p.HasValue {
+		return p.Key
+	}
+	return p.Key + "=" + p.Value
+}
+
+func quoteIfNeeded(s string) string {
+	if s == "" || !strings.ContainsAny(s, " \t\n") {
+		return s
+	}
+	return `"` + s + `"`
+}
+
+// keyEqual reports whether the keys are the same. "-" and "_" are the same like
+// parameq in the kernel.
+func keyEqual(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		x, y := a[i], b[i]
+		if x == '-' {
+			x = '_'
+		}
+		if y == '-' {
+			y = '_'
+		}
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the command line which can be passed to WithCommandLine.
+// Values which contain spaces are quoted.
+func (c *CommandLine) String() string {
+	parts := make([]string, 0, len(c.params)+len(c.initArgs)+1)
+	for _, p := range c.params {
+		parts = append(parts, p.String())
+	}
+	if len(c.initArgs) > 0 {
+		parts = append(parts, "--")
+		for _, arg := range c.initArgs {
+			parts = append(parts, quoteIfNeeded(arg))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Validate reports an error if the command line can not be represented as a string
+// which the kernel parses to the same parameters. The kernel does not support escaping,
+// so keys and values can not contain double quotes, and keys can not contain "=" or
+// spaces.
+func (c *CommandLine) Validate() error {
+	for _, p := range c.params {
+		if p.Key == "" || p.Key == "--" || strings.ContainsAny(p.Key, "= \t\n\"") {
+			return fmt.Errorf("%w: key %q", ErrInvalidParameter, p.Key)
+		}
+		if strings.Contains(p.Value, `"`) {
+			return fmt.Errorf("%w: value of %q contains a double quote", ErrInvalidParameter, p.Key)
+		}
+	}
+	for _, arg := range c.initArgs {
+		if arg == "" || strings.Contains(arg, `"`) {
+			return fmt.Errorf("%w: init argument %q", ErrInvalidParameter, arg)
+		}
+	}
+	return nil
+}
+
+// Params returns a copy of the parameters.
+func (c *CommandLine) Params() []Param {
+	return append([]Param(nil), c.params...)
+}
+
+// Get returns the value of the last parameter which has the key, because the last one
+// takes effect for most parameters.
+func (c *CommandLine) Get(key string) (string, bool) {
+	for i := len(c.params) - 1; i >= 0; i-- {
+		if keyEqual(c.params[i].Key, key) {
+			return c.params[i].Value, true
+		}
+	}
+	return "", false
+}
+
+// GetAll returns the values of all parameters which have the key, in order.
+func (c *CommandLine) GetAll(key string) []string {
+	var values []string
+	for _, p := range c.params {
+		if keyEqual(p.Key, key) {
+			values = append(values, p.Value)
+		}
+	}
+	return values
+}
+
+// Has reports whether the command line has a parameter which has the key.
+func (c *CommandLine) Has(key string) bool {
+	_, ok := c.Get(key)
+	return ok
+}
+
+// Add appends the parameter key=value, even if the key already exists.
+func (c *CommandLine) Add(key, value string) *CommandLine {
+	c.params = append(c.params, Param{Key: key, Value: value, HasValue: true})
+	return c
+}
+
+// AddFlag appends the parameter which has no value, such as "quiet".
+func (c *CommandLine) AddFlag(key string) *CommandLine {
+	c.params = append(c.params, Param{Key: key})
+	return c
+}
+
+// Set sets the parameter key=value. The first parameter which has the key is replaced
+// and the others are removed. If there is no such parameter, it is appended.
+func (c *CommandLine) Set(key, value string) *CommandLine {
+	return c.set(Param{Key: key, Value: value, HasValue: true})
+}
+
+// SetFlag sets the parameter which has no value like Set.
+func (c *CommandLine) SetFlag(key string) *CommandLine {
+	return c.set(Param{Key: key})
+}
+
+func (c *CommandLine) set(p Param) *CommandLine {
+	replaced := false
+	params := c.params[:0]
+	for _, q := range c.params {
+		if !keyEqual(q.Key, p.Key) {
+			params = append(params, q)
+			continue
+		}
+		if !replaced {
+			params = append(params, p)
+			replaced = true
+		}
+	}
+	c.params = params
+	if !replaced {
+		c.params = append(c.params, p)
+	}
+	return c
+}
+
+// Delete removes all parameters which have the key.
+func (c *CommandLine) Delete(key string) *CommandLine {
+	params := c.params[:0]
+	for _, p := range c.params {
+		if !keyEqual(p.Key, key) {
+			params = append(params, p)
+		}
+	}
+	c.params = params
+	return c
+}
+
+// InitArgs returns a copy of the arguments for init.
+func (c *CommandLine) InitArgs() []string {
+	return append([]string(nil), c.initArgs...)
+}
+
+// SetInitArgs sets the arguments for init which are passed after "--".
+func (c *CommandLine) SetInitArgs(args ...string) *CommandLine {
+	c.initArgs = append([]string(nil), args...)
+	return c
+}
+
+// Merge merges other into c. The parameters of c which have the keys in other are
+// replaced by all parameters of other which have the key, and the other parameters
+// are appended. The arguments for init of other replace those of c if there are any.
+func (c *CommandLine) Merge(other *CommandLine) *CommandLine {
+	done := make(map[string]bool)
+	for _, p := range other.params {
+		key := strings.ReplaceAll(p.Key, "-", "_")
+		if done[key] {
+			continue
+		}
+		done[key] = true
+		values := make([]Param, 0, 1)
+		for _, q := range other.params {
+			if keyEqual(q.Key, p.Key) {
+				values = append(values, q)
+			}
+		}
+		c.replaceAll(p.Key, values)
+	}
+	if len(other.initArgs) > 0 {
+		c.initArgs = append([]string(nil), other.initArgs...)
+	}
+	return c
+}
+
+// replaceAll replaces the parameters which have the key by values. The values are
+// placed at the position of the first parameter which has the key.
+func (c *CommandLine) replaceAll(key string, values []Param) {
+	replaced := false
+	params := make([]Param, 0, len(c.params)+len(values))
+	for _, q := range c.params {
+		if !keyEqual(q.Key, key) {
+			params = append(params, q)
+			continue
+		}
+		if !replaced {
+			params = append(params, values...)
+			replaced = true
+		}
+	}
+	if !replaced {
+		params = append(params, values...)
+	}
+	c.params = params
+}
+
+// Clone returns a deep copy of c.
+func (c *CommandLine) Clone() *CommandLine {
+	return &CommandLine{
+		params:   c.Params(),
+		initArgs: c.InitArgs(),
+	}
+}
+
+// SetConsole sets the console device such as ConsoleHVC0 or "ttyS0" replacing the
+// other console parameters.
+func (c *CommandLine) SetConsole(device string) *CommandLine {
+	return c.Set("console", device)
+}
+
+// SetRoot sets the root file system device such as "/dev/vda1".
+// If fsType is not empty, rootfstype is also set.
+func (c *CommandLine) SetRoot(device, fsType string) *CommandLine {
+	c.Set("root", device)
+	if fsType != "" {
+		c.Set("rootfstype", fsType)
+	} else {
+		c.Delete("rootfstype")
+	}
+	return c
+}
+
+// SetVirtioFSRoot uses the virtio file system which has the tag as the root file system.
+// The tag is the one of the shared directory configuration.
+//
+// see: https://virtio-fs.gitlab.io/howto-boot.html
+func (c *CommandLine) SetVirtioFSRoot(tag string) *CommandLine {
+	c.SetRoot(tag, "virtiofs")
+	c.Delete("ro")
+	c.SetFlag("rw")
+	return c
+}
+
+// AddVirtioFSMount adds a mount of the virtio file system which has the tag at target,
+// with the mount options such as "ro". The mount is performed by systemd (v254 or newer)
+// with systemd.mount-extra.
+//
+// see: https://www.freedesktop.org/software/systemd/man/latest/systemd-fstab-generator.html
+func (c *CommandLine) AddVirtioFSMount(tag, target, options string) *CommandLine {
+	value := tag + ":" + target + ":virtiofs"
+	if options != "" {
+		value += ":" + options
+	}
+	return c.Add("systemd.mount-extra", value)
+}
@@ -0,0 +1,187 @@
+package kernel_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/kernel"
+)
+
+func TestParseCommandLine(t *testing.T) {
+	cases := []struct {
+		name         string
+		input        string
+		wantParams   []kernel.Param
+		wantInitArgs []string
+		wantString   string
+	}{
+		{
+			name:  "simple",
+			input: "console=hvc0 root=/dev/vda quiet",
+			wantParams: []kernel.Param{
+				{Key: "console", Value: "hvc0", HasValue: true},
+				{Key: "root", Value: "/dev/vda", HasValue: true},
+				{Key: "quiet"},
+			},
+			wantString: "console=hvc0 root=/dev/vda quiet",
+		},
+		{
+			name:  "empty value and extra spaces",
+			input: "  init=  \tfoo.bar=1=2\n",
+			wantParams: []kernel.Param{
+				{Key: "init", Value: "", HasValue: true},
+				{Key: "foo.bar", Value: "1=2", HasValue: true},
+			},
+			wantString: "init= foo.bar=1=2",
+		},
+		{
+			name:  "quoted value",
+			input: `dyndbg="file drivers/virtio/* +p" quiet`,
+			wantParams: []kernel.Param{
+				{Key: "dyndbg", Value: "file drivers/virtio/* +p", HasValue: true},
+				{Key: "quiet"},
+			},
+			wantString: `dyndbg="file drivers/virtio/* +p" quiet`,
+		},
+		{
+			name:  "quoted parameter",
+			input: `"dyndbg=file a.c +p" "quiet"`,
+			wantParams: []kernel.Param{
+				{Key: "dyndbg", Value: "file a.c +p", HasValue: true},
+				{Key: "quiet"},
+			},
+			wantString: `dyndbg="file a.c +p" quiet`,
+		},
+		{
+			name:  "init args",
+			input: `console=hvc0 -- single "a b" x=1 --`,
+			wantParams: []kernel.Param{
+				{Key: "console", Value: "hvc0", HasValue: true},
+			},
+			wantInitArgs: []string{"single", "a b", "x=1", "--"},
+			wantString:   `console=hvc0 -- single "a b" x=1 --`,
+		},
+		{
+			name:       "empty",
+			input:      "",
+			wantString: "",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := kernel.ParseCommandLine(tc.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.Params(); !reflect.DeepEqual(tc.wantParams, got) && len(tc.wantParams)+len(got) > 0 {
+				t.Fatalf("want params %+v but got %+v", tc.wantParams, got)
+			}
+			if got := c.InitArgs(); !reflect.DeepEqual(tc.wantInitArgs, got) && len(tc.wantInitArgs)+len(got) > 0 {
+				t.Fatalf("want init args %q but got %q", tc.wantInitArgs, got)
+			}
+			if got := c.String(); got != tc.wantString {
+				t.Fatalf("want %q but got %q", tc.wantString, got)
+			}
+			if err := c.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			// String is parsed to the same command line.
+			c2, err := kernel.ParseCommandLine(c.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c2.String() != c.String() {
+				t.Fatalf("want %q but got %q", c.String(), c2.String())
+			}
+		})
+	}
+}
+
+func TestParseCommandLineError(t *testing.T) {
+	for _, input := range []string{`root="/dev/vda`, `"quiet`, `a -- "b`} {
+		_, err := kernel.ParseCommandLine(input)
+		if !errors.Is(err, kernel.ErrUnterminatedQuote) {
+			t.Fatalf("%q: want %v but got %v", input, kernel.ErrUnterminatedQuote, err)
+		}
+	}
+}
+
+func TestCommandLineSet(t *testing.T) {
+	c, err := kernel.ParseCommandLine("console=ttyS0 quiet console=tty0 panic-on-oops=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set("console", "hvc0").Set("panic_on_oops", "0").SetFlag("ro").Add("console", "tty1")
+	if want, got := "console=hvc0 quiet panic_on_oops=0 ro console=tty1", c.String(); want != got {
+		t.Fatalf("want %q but got %q", want, got)
+	}
+	if got, _ := c.Get("console"); got != "tty1" {
+		t.Fatalf("want the last console but got %q", got)
+	}
+	if got := c.GetAll("console"); !reflect.DeepEqual([]string{"hvc0", "tty1"}, got) {
+		t.Fatalf("want all consoles but got %q", got)
+	}
+	c.Delete("console")
+	if c.Has("console") {
+		t.Fatal("want console to be deleted")
+	}
+	if !c.Has("panic-on-oops") {
+		t.Fatal(`want "-" and "_" to be the same`)
+	}
+}
+
+func TestCommandLineMerge(t *testing.T) {
+	base, err := kernel.ParseCommandLine("console=ttyS0 root=/dev/sda1 ro quiet -- single")
+	if err != nil {
+		t.Fatal(err)
+	}
+	override, err := kernel.ParseCommandLine("console=tty0 console=hvc0 rw loglevel=7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := base.Clone().Merge(override)
+	want := "console=tty0 console=hvc0 root=/dev/sda1 ro quiet rw loglevel=7 -- single"
+	if got := merged.String(); got != want {
+		t.Fatalf("want %q but got %q", want, got)
+	}
+	if got := base.String(); got != "console=ttyS0 root=/dev/sda1 ro quiet -- single" {
+		t.Fatalf("want the base not to be changed but got %q", got)
+	}
+
+	merged.Merge(kernel.NewCommandLine().SetInitArgs("emergency"))
+	if got := merged.InitArgs(); !reflect.DeepEqual([]string{"emergency"}, got) {
+		t.Fatalf("want the init args to be replaced but got %q", got)
+	}
+}
+
+func TestCommandLineHelpers(t *testing.T) {
+	c := kernel.NewCommandLine().
+		SetConsole(kernel.ConsoleHVC0).
+		SetRoot("/dev/vda1", "ext4").
+		AddFlag("ro")
+	if want, got := "console=hvc0 root=/dev/vda1 rootfstype=ext4 ro", c.String(); want != got {
+		t.Fatalf("want %q but got %q", want, got)
+	}
+
+	c.SetVirtioFSRoot("rootfs").AddVirtioFSMount("shared", "/mnt/shared", "ro")
+	want := "console=hvc0 root=rootfs rootfstype=virtiofs rw systemd.mount-extra=shared:/mnt/shared:virtiofs:ro"
+	if got := c.String(); want != got {
+		t.Fatalf("want %q but got %q", want, got)
+	}
+}
+
+func TestCommandLineValidate(t *testing.T) {
+	cases := []*kernel.CommandLine{
+		kernel.NewCommandLine().Add("key", `a"b`),
+		kernel.NewCommandLine().Add("a b", "c"),
+		kernel.NewCommandLine().AddFlag(""),
+		kernel.NewCommandLine().SetInitArgs(""),
+	}
+	for _, c := range cases {
+		if err := c.Validate(); !errors.Is(err, kernel.ErrInvalidParameter) {
+			t.Fatalf("%q: want %v but got %v", c.String(), kernel.ErrInvalidParameter, err)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package kernel
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Code-Hex/vz/v3/internal/lz4"
+	"github.com/Code-Hex/vz/v3/internal/zstd"
+)
+
+// Compression is the compression method which wraps a kernel image.
+type Compression int
+
+const (
+	// CompressionNone indicates the kernel image is not compressed.
+	CompressionNone Compression = iota
+	// CompressionGzip indicates the kernel image is compressed by gzip (Image.gz).
+	CompressionGzip
+	// CompressionZstd indicates the kernel image is compressed by zstd (Image.zst).
+	CompressionZstd
+	// CompressionLZ4 indicates the kernel image is compressed by lz4 (Image.lz4).
+	CompressionLZ4
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionLZ4:
+		return "lz4"
+	}
+	return "unknown"
+}
+
+// EFI zboot header.
+//
+// see: https://github.com/torvalds/linux/blob/master/drivers/firmware/efi/libstub/zboot-header.S
+const (
+	zbootMagicOffset       = 4
+	zbootPayloadOffset     = 8
+	zbootPayloadSizeOffset = 12
+	zbootCompTypeOffset    = 24
+	zbootHeaderSize        = 0x38
+)
+
+var zbootMagic = []byte("zimg")
+
+func isEFIZBoot(head []byte) bool {
+	return len(head) >= zbootHeaderSize && bytes.HasPrefix(head, []byte("MZ")) &&
+		bytes.Equal(head[zbootMagicOffset:zbootMagicOffset+4], zbootMagic)
+}
+
+// magic numbers of the compression formats which are not supported.
+var unsupportedMagics = []struct {
+	name  string
+	magic []byte
+}{
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"bzip2", []byte("BZh")},
+	{"lzma", []byte{0x5d, 0x00, 0x00}},
+	{"lzo", []byte{0x89, 'L', 'Z', 'O', 0x00}},
+}
+
+// detectCompression detects the compression method from the leading bytes.
+func detectCompression(head []byte) (Compression, error) {
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return CompressionGzip, nil
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return CompressionZstd, nil
+	case len(head) >= 4 && (binary.LittleEndian.Uint32(head) == lz4.LegacyMagic ||
+		binary.LittleEndian.Uint32(head) == lz4.FrameMagic):
+		return CompressionLZ4, nil
+	}
+	for _, m := range unsupportedMagics {
+		if bytes.HasPrefix(head, m.magic) {
+			return CompressionNone, fmt.Errorf("%w: %s", ErrUnsupportedCompression, m.name)
+		}
+	}
+	return CompressionNone, nil
+}
+
+func compressionByName(name string) (Compression, error) {
+	switch name {
+	case "gzip":
+		return CompressionGzip, nil
+	case "zstd":
+		return CompressionZstd, nil
+	case "lz4":
+		return CompressionLZ4, nil
+	}
+	return CompressionNone, fmt.Errorf("%w: %s", ErrUnsupportedCompression, name)
+}
+
+// Decompress writes the decompressed kernel image read from r to w, and returns the
+// information of the kernel image. If the kernel image is not compressed, it is
+// copied as is.
+func Decompress(w io.Writer, r io.Reader) (*Info, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	head, err := br.Peek(zbootHeaderSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	var src io.Reader = br
+	zboot := isEFIZBoot(head)
+
+	var comp Compression
+	if zboot {
+		offset := binary.LittleEndian.Uint32(head[zbootPayloadOffset:])
+		size := binary.LittleEndian.Uint32(head[zbootPayloadSizeOffset:])
+		name := head[zbootCompTypeOffset:zbootHeaderSize]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		comp, err = compressionByName(string(name))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := br.Discard(int(offset)); err != nil {
+			return nil, fmt.Errorf("failed to seek to the zboot payload: %w", err)
+		}
+		src = io.LimitReader(br, int64(size))
+	} else {
+		comp, err = detectCompression(head)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var info *Info
+	if comp == CompressionNone {
+		info, err = inspectImage(w, src)
+	} else {
+		info, err = decompress(w, src, comp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Compression = comp
+	info.EFIZBoot = zboot
+	return info, nil
+}
+
+func decompress(w io.Writer, r io.Reader, comp Compression) (*Info, error) {
+	tr := &trailerReader{r: r}
+	var dr io.Reader
+	switch comp {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(tr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress gzip: %w", err)
+		}
+		dr = zr
+	case CompressionZstd:
+		dr = zstd.NewReader(tr)
+	case CompressionLZ4:
+		dr = lz4.NewReader(tr)
+	}
+	info, err := inspectImage(w, &sizeTrailerReader{r: dr, trailer: tr})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %w", comp, err)
+	}
+	return info, nil
+}
+
+// trailerReader remembers the last 4 bytes read from r.
+type trailerReader struct {
+	r    io.Reader
+	last [4]byte
+	n    int64
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n >= 4 {
+		copy(t.last[:], p[n-4:n])
+	} else {
+		copy(t.last[:], t.last[n:])
+		copy(t.last[4-n:], p[:n])
+	}
+	t.n += int64(n)
+	return n, err
+}
+
+// isSizeTrailer reports whether the input has been read to the end and the last 4
+// bytes are the little-endian size of the decompressed data.
+//
+// The kernel build system appends the size to the compressed data (size_append in
+// scripts/Makefile.lib), which is not a part of the compressed stream.
+func (t *trailerReader) isSizeTrailer(size int64) bool {
+	if t.n < 4 {
+		return false
+	}
+	var b [1]byte
+	if n, _ := io.ReadFull(t.r, b[:]); n != 0 {
+		return false
+	}
+	return binary.LittleEndian.Uint32(t.last[:]) == uint32(size)
+}
+
+// sizeTrailerReader reads the decompressed data from r. It returns io.EOF instead of
+// the error of the decompressor which is caused by the size trailer.
+type sizeTrailerReader struct {
+	r       io.Reader
+	trailer *trailerReader
+	n       int64
+}
+
+func (s *sizeTrailerReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	if err != nil && err != io.EOF && s.trailer.isSizeTrailer(s.n) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// DefaultCacheDir returns the default directory where DecompressToCache stores the
+// decompressed kernel images.
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "vz", "kernel"), nil
+}
+
+// DecompressToCache decompresses the kernel image at path into cacheDir, and returns
+// the path of the decompressed kernel image. If the kernel image is not compressed,
+// path is returned as is. If cacheDir is empty, DefaultCacheDir is used.
+//
+// The decompressed kernel image is named after the SHA-256 digest of the compressed
+// file, so that it is reused until the compressed file is changed.
+func DecompressToCache(path, cacheDir string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, zbootHeaderSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+	zboot := isEFIZBoot(head)
+	comp, err := detectCompression(head)
+	if err != nil {
+		return "", err
+	}
+	if !zboot && comp == CompressionNone {
+		return path, nil
+	}
+
+	if cacheDir == "" {
+		cacheDir, err = DefaultCacheDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to get the cache directory: %w", err)
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(cacheDir, hex.EncodeToString(h.Sum(nil))+".Image")
+	if _, err := os.Stat(dst); err == nil {
+		return dst, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create the cache directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(cacheDir, ".kernel-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := Decompress(tmp, f); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	// rename is atomic, so that a concurrent caller never sees a partial image.
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
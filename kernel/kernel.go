@@ -0,0 +1,435 @@
+// Package kernel inspects Linux kernel images which are booted by LinuxBootLoader,
+// and builds their command lines.
+//
+// It recognizes arm64 Image headers, x86 bzImage setup headers, and kernels which
+// are wrapped by gzip, zstd, lz4 or an EFI zboot image. Virtualization.framework can
+// not boot compressed kernels on arm64, so compressed kernels can be decompressed
+// with Decompress or DecompressToCache before booting.
+//
+// CommandLine parses and builds the kernel command line which is passed with
+// WithCommandLine or WithKernelCommandLine.
+package kernel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Arch is the CPU architecture of a kernel image.
+type Arch int
+
+const (
+	// ArchUnknown is an unknown architecture.
+	ArchUnknown Arch = iota
+	// ArchARM64 is the 64-bit ARM architecture (aarch64).
+	ArchARM64
+	// ArchX86_64 is the 64-bit x86 architecture (amd64).
+	ArchX86_64
+	// ArchX86 is the 32-bit x86 architecture (i386).
+	ArchX86
+)
+
+func (a Arch) String() string {
+	switch a {
+	case ArchARM64:
+		return "arm64"
+	case ArchX86_64:
+		return "x86_64"
+	case ArchX86:
+		return "x86"
+	}
+	return "unknown"
+}
+
+// Format is the format of a decompressed kernel image.
+type Format int
+
+const (
+	// FormatUnknown is an unknown format.
+	FormatUnknown Format = iota
+	// FormatARM64Image is the arm64 Image format.
+	// see: https://www.kernel.org/doc/html/latest/arch/arm64/booting.html
+	FormatARM64Image
+	// FormatBzImage is the x86 bzImage format.
+	// see: https://www.kernel.org/doc/html/latest/arch/x86/boot.html
+	FormatBzImage
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatARM64Image:
+		return "arm64 Image"
+	case FormatBzImage:
+		return "bzImage"
+	}
+	return "unknown"
+}
+
+var (
+	// ErrUnknownFormat is returned when the file is not a recognized kernel image.
+	ErrUnknownFormat = errors.New("unknown kernel image format")
+
+	// ErrUnsupportedCompression is returned when the kernel image is compressed by a
+	// compression method which is not supported.
+	ErrUnsupportedCompression = errors.New("unsupported kernel image compression")
+)
+
+// Info describes a kernel image.
+type Info struct {
+	// Arch is the CPU architecture of the kernel.
+	Arch Arch
+
+	// Format is the format of the decompressed kernel image.
+	Format Format
+
+	// Compression is the compression which wraps the kernel image.
+	// It is CompressionNone if the file is the kernel image itself.
+	Compression Compression
+
+	// EFIZBoot reports whether the compressed kernel image is wrapped in an EFI zboot
+	// image (vmlinuz.efi) which is built with CONFIG_EFI_ZBOOT.
+	EFIZBoot bool
+
+	// Version is the kernel release such as "6.1.0-13-arm64". It is empty if the
+	// kernel image does not contain the version string.
+	Version string
+
+	// Banner is the full version string such as
+	// "Linux version 6.1.0 (user@host) (gcc ...) #1 SMP ...".
+	// For bzImage, it is the kernel_version field of the setup header.
+	Banner string
+
+	// Size is the size of the decompressed kernel image in bytes.
+	Size int64
+
+	// ARM64 is the header of the arm64 Image. It is set only for FormatARM64Image.
+	ARM64 *ARM64Header
+
+	// X86 is the setup header of the bzImage. It is set only for FormatBzImage.
+	X86 *X86SetupHeader
+}
+
+// NeedsDecompression reports whether the kernel image must be decompressed to be
+// booted by LinuxBootLoader.
+func (i *Info) NeedsDecompression() bool {
+	return i.Compression != CompressionNone
+}
+
+// MemorySize returns the size of the memory which the kernel requires to be loaded,
+// including the uninitialized data (bss). It returns the size of the image when the
+// header does not specify it.
+func (i *Info) MemorySize() uint64 {
+	switch {
+	case i.ARM64 != nil && i.ARM64.ImageSize != 0:
+		return i.ARM64.ImageSize
+	case i.X86 != nil && i.X86.InitSize != 0:
+		return uint64(i.X86.InitSize)
+	}
+	return uint64(i.Size)
+}
+
+func (i *Info) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (%s)", i.Format, i.Arch)
+	if i.Version != "" {
+		fmt.Fprintf(&b, " version %s", i.Version)
+	}
+	if i.EFIZBoot {
+		b.WriteString(", EFI zboot")
+	}
+	if i.Compression != CompressionNone {
+		fmt.Fprintf(&b, ", %s compressed", i.Compression)
+	}
+	return b.String()
+}
+
+// ARM64Header is the header of the arm64 Image.
+//
+// see: https://www.kernel.org/doc/html/latest/arch/arm64/booting.html#call-the-kernel-image
+type ARM64Header struct {
+	// TextOffset is the offset of the image from a 2MiB aligned base address.
+	TextOffset uint64
+
+	// ImageSize is the effective size of the image in memory, including bss.
+	// It is zero for kernels older than v3.17.
+	ImageSize uint64
+
+	// BigEndian reports whether the kernel is big-endian.
+	BigEndian bool
+
+	// PageSize is the page size of the kernel in bytes. It is zero if unspecified.
+	PageSize int
+
+	// PhysicalPlacementAnywhere reports whether the image may be placed anywhere in
+	// physical memory. Otherwise the base address should be as close as possible to
+	// the base of DRAM.
+	PhysicalPlacementAnywhere bool
+}
+
+// X86SetupHeader is the setup header of the x86 bzImage.
+//
+// see: https://www.kernel.org/doc/html/latest/arch/x86/boot.html#the-real-mode-kernel-header
+type X86SetupHeader struct {
+	// SetupSectors is the number of 512-byte sectors of the real-mode code.
+	SetupSectors int
+
+	// Protocol is the boot protocol version such as 0x020f (2.15).
+	Protocol uint16
+
+	// Relocatable reports whether the protected-mode kernel is relocatable.
+	Relocatable bool
+
+	// KernelAlignment is the physical address alignment required by the kernel.
+	KernelAlignment uint32
+
+	// MinAlignment is the minimum alignment to which the kernel can be relocated.
+	MinAlignment uint32
+
+	// PrefAddress is the preferred load address of the kernel.
+	PrefAddress uint64
+
+	// InitSize is the amount of linear contiguous memory starting at the load address
+	// which is required to initialize the kernel.
+	InitSize uint32
+
+	// CmdlineSize is the maximum size of the kernel command line, excluding the
+	// terminating zero.
+	CmdlineSize uint32
+
+	// Kernel64 reports whether the kernel has the 64-bit entry point (XLF_KERNEL_64).
+	Kernel64 bool
+}
+
+// ProtocolVersion returns the boot protocol version in "major.minor" form.
+func (h *X86SetupHeader) ProtocolVersion() string {
+	return fmt.Sprintf("%d.%02d", h.Protocol>>8, h.Protocol&0xff)
+}
+
+// Inspect inspects the kernel image file at path.
+func Inspect(path string) (*Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return InspectReader(f)
+}
+
+// InspectReader inspects the kernel image read from r.
+// A compressed kernel image is decompressed while inspecting it.
+func InspectReader(r io.Reader) (*Info, error) {
+	return Decompress(io.Discard, r)
+}
+
+const (
+	arm64MagicOffset = 0x38
+	arm64HeaderSize  = 0x40
+
+	bzImageBootFlagOffset = 0x1fe
+	bzImageHeaderOffset   = 0x1f1
+	bzImageMagicOffset    = 0x202
+	bzImageHeaderEnd      = 0x268
+
+	// headerSize is the size of the leading bytes which are needed to detect
+	// the format of a kernel image.
+	headerSize = bzImageHeaderEnd
+)
+
+var (
+	arm64Magic   = []byte("ARM\x64")
+	bzImageMagic = []byte("HdrS")
+
+	bannerPrefix = []byte("Linux version ")
+)
+
+// inspectImage inspects the decompressed kernel image read from r, writing it to w.
+func inspectImage(w io.Writer, r io.Reader) (*Info, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	header, err := br.Peek(headerSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	info := &Info{}
+	switch {
+	case len(header) >= arm64HeaderSize && bytes.Equal(header[arm64MagicOffset:arm64MagicOffset+4], arm64Magic):
+		info.Format = FormatARM64Image
+		info.Arch = ArchARM64
+		info.ARM64 = parseARM64Header(header)
+	case len(header) >= bzImageHeaderEnd &&
+		bytes.Equal(header[bzImageMagicOffset:bzImageMagicOffset+4], bzImageMagic) &&
+		binary.LittleEndian.Uint16(header[bzImageBootFlagOffset:]) == 0xaa55:
+		info.Format = FormatBzImage
+		info.X86 = parseX86SetupHeader(header)
+		info.Arch = ArchX86
+		if info.X86.Kernel64 {
+			info.Arch = ArchX86_64
+		}
+	default:
+		return nil, ErrUnknownFormat
+	}
+
+	s := &bannerScanner{w: w, found: info.Format == FormatBzImage}
+	n, err := io.Copy(s, br)
+	if err != nil {
+		return nil, err
+	}
+	info.Size = n
+
+	banner := s.banner
+	if info.Format == FormatBzImage {
+		banner = bzImageKernelVersion(info.X86, s.head)
+	}
+	if banner != "" {
+		info.Banner = banner
+		info.Version = versionFromBanner(banner)
+	}
+	return info, nil
+}
+
+func parseARM64Header(b []byte) *ARM64Header {
+	flags := binary.LittleEndian.Uint64(b[24:])
+	h := &ARM64Header{
+		TextOffset:                binary.LittleEndian.Uint64(b[8:]),
+		ImageSize:                 binary.LittleEndian.Uint64(b[16:]),
+		BigEndian:                 flags&0x1 != 0,
+		PhysicalPlacementAnywhere: flags&0x8 != 0,
+	}
+	if h.ImageSize == 0 {
+		// see: https://www.kernel.org/doc/html/latest/arch/arm64/booting.html
+		// Prior to v3.17, text_offset is assumed to be 0x80000 when image_size is zero.
+		h.TextOffset = 0x80000
+	}
+	switch (flags >> 1) & 0x3 {
+	case 1:
+		h.PageSize = 4 << 10
+	case 2:
+		h.PageSize = 16 << 10
+	case 3:
+		h.PageSize = 64 << 10
+	}
+	return h
+}
+
+func parseX86SetupHeader(b []byte) *X86SetupHeader {
+	h := &X86SetupHeader{
+		SetupSectors: int(b[bzImageHeaderOffset]),
+		Protocol:     binary.LittleEndian.Uint16(b[0x206:]),
+	}
+	if h.SetupSectors == 0 {
+		h.SetupSectors = 4
+	}
+	if h.Protocol >= 0x0205 {
+		h.Relocatable = b[0x234] != 0
+		h.KernelAlignment = binary.LittleEndian.Uint32(b[0x230:])
+	}
+	if h.Protocol >= 0x0206 {
+		h.CmdlineSize = binary.LittleEndian.Uint32(b[0x238:])
+	} else {
+		h.CmdlineSize = 255
+	}
+	if h.Protocol >= 0x020a {
+		h.MinAlignment = 1 << b[0x235]
+		h.PrefAddress = binary.LittleEndian.Uint64(b[0x258:])
+		h.InitSize = binary.LittleEndian.Uint32(b[0x260:])
+	}
+	if h.Protocol >= 0x020c {
+		h.Kernel64 = binary.LittleEndian.Uint16(b[0x236:])&0x1 != 0
+	}
+	return h
+}
+
+// bzImageKernelVersion returns the kernel_version string of the setup header.
+// head is the leading bytes of the image which are kept while copying it.
+func bzImageKernelVersion(h *X86SetupHeader, head []byte) string {
+	if h.Protocol < 0x0200 {
+		return ""
+	}
+	ptr := binary.LittleEndian.Uint16(head[0x20e:])
+	if ptr == 0 {
+		return ""
+	}
+	off := int(ptr) + 0x200
+	if off >= len(head) {
+		return ""
+	}
+	s := head[off:]
+	if i := bytes.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return string(s)
+}
+
+func versionFromBanner(banner string) string {
+	version := strings.TrimPrefix(banner, string(bannerPrefix))
+	if i := strings.IndexAny(version, " \t\n"); i >= 0 {
+		version = version[:i]
+	}
+	return version
+}
+
+// bannerHeadSize is the size of the leading bytes which are kept by bannerScanner.
+// The kernel_version string of bzImage is in the real-mode code of the setup sectors.
+const bannerHeadSize = 64 * 1024
+
+// maxBannerSize is the maximum length of the "Linux version" banner.
+const maxBannerSize = 1024
+
+// bannerScanner is an io.Writer which finds the "Linux version" banner in the
+// written data and writes the data to w.
+type bannerScanner struct {
+	w      io.Writer
+	head   []byte
+	tail   []byte
+	found  bool
+	banner string
+}
+
+func (s *bannerScanner) Write(p []byte) (int, error) {
+	if len(s.head) < bannerHeadSize {
+		s.head = append(s.head, p[:min(len(p), bannerHeadSize-len(s.head))]...)
+	}
+	if !s.found {
+		s.scan(p)
+	}
+	return s.w.Write(p)
+}
+
+func (s *bannerScanner) scan(p []byte) {
+	// tail holds the end of the previous writes so that the banner which spans
+	// multiple writes can be found.
+	buf := append(s.tail, p...)
+	for off := 0; ; {
+		i := bytes.Index(buf[off:], bannerPrefix)
+		if i < 0 {
+			break
+		}
+		start := off + i
+		rest := buf[start:]
+		end := bytes.IndexAny(rest, "\n\x00")
+		if end < 0 {
+			if len(rest) < maxBannerSize {
+				// wait for more data.
+				s.tail = append(s.tail[:0], rest...)
+				return
+			}
+			end = maxBannerSize
+		}
+		// The banner is followed by the kernel release which starts with a digit.
+		if end > len(bannerPrefix) && rest[len(bannerPrefix)] >= '0' && rest[len(bannerPrefix)] <= '9' {
+			s.banner = strings.TrimSpace(string(rest[:end]))
+			s.found = true
+			s.tail = nil
+			return
+		}
+		off = start + len(bannerPrefix)
+	}
+	keep := min(len(buf), len(bannerPrefix)-1)
+	s.tail = append(s.tail[:0], buf[len(buf)-keep:]...)
+}
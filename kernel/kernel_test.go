@@ -0,0 +1,281 @@
+package kernel_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/Code-Hex/vz/v3/kernel"
+)
+
+// The files in testdata are a fake arm64 Image which has the header and the banner,
+// and the compressed forms of it which are made the same way as the kernel build
+// system does (with the size trailer).
+func TestInspect(t *testing.T) {
+	cases := []struct {
+		file            string
+		wantCompression kernel.Compression
+		wantEFIZBoot    bool
+	}{
+		{"Image", kernel.CompressionNone, false},
+		{"Image.gz", kernel.CompressionGzip, false},
+		{"Image.zst", kernel.CompressionZstd, false},
+		{"Image.lz4", kernel.CompressionLZ4, false},
+		{"vmlinuz.efi", kernel.CompressionGzip, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.file, func(t *testing.T) {
+			info, err := kernel.Inspect(filepath.Join("testdata", tc.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Arch != kernel.ArchARM64 {
+				t.Fatalf("want arch %v but got %v", kernel.ArchARM64, info.Arch)
+			}
+			if info.Format != kernel.FormatARM64Image {
+				t.Fatalf("want format %v but got %v", kernel.FormatARM64Image, info.Format)
+			}
+			if info.Compression != tc.wantCompression {
+				t.Fatalf("want compression %v but got %v", tc.wantCompression, info.Compression)
+			}
+			if info.EFIZBoot != tc.wantEFIZBoot {
+				t.Fatalf("want EFIZBoot %v but got %v", tc.wantEFIZBoot, info.EFIZBoot)
+			}
+			if got := info.NeedsDecompression(); got != (tc.wantCompression != kernel.CompressionNone) {
+				t.Fatalf("unexpected NeedsDecompression: %v", got)
+			}
+			if want := "6.1.0-test"; info.Version != want {
+				t.Fatalf("want version %q but got %q", want, info.Version)
+			}
+			if want := "Linux version 6.1.0-test (builder@vz) (gcc (GCC) 12.2.0) #1 SMP PREEMPT"; info.Banner != want {
+				t.Fatalf("want banner %q but got %q", want, info.Banner)
+			}
+			if want := int64(20 * 1024); info.Size != want {
+				t.Fatalf("want size %d but got %d", want, info.Size)
+			}
+			want := kernel.ARM64Header{
+				TextOffset:                0,
+				ImageSize:                 0x1230000,
+				PageSize:                  4096,
+				PhysicalPlacementAnywhere: true,
+			}
+			if *info.ARM64 != want {
+				t.Fatalf("want header %+v but got %+v", want, *info.ARM64)
+			}
+			if info.MemorySize() != want.ImageSize {
+				t.Fatalf("want memory size %#x but got %#x", want.ImageSize, info.MemorySize())
+			}
+		})
+	}
+}
+
+func TestInspectOneByteReader(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "Image.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The banner must be found even if it spans multiple reads.
+	info, err := kernel.InspectReader(iotest.OneByteReader(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "6.1.0-test"; info.Version != want {
+		t.Fatalf("want version %q but got %q", want, info.Version)
+	}
+}
+
+// fakeBzImage returns the leading sectors of a bzImage which has the setup header.
+func fakeBzImage(version string) []byte {
+	b := make([]byte, 5*512)
+	b[0x1f1] = 4                                          // setup_sects
+	binary.LittleEndian.PutUint16(b[0x1fe:], 0xaa55)      // boot_flag
+	copy(b[0x202:], "HdrS")                               // header
+	binary.LittleEndian.PutUint16(b[0x206:], 0x020f)      // version
+	binary.LittleEndian.PutUint16(b[0x20e:], 0x400-0x200) // kernel_version
+	binary.LittleEndian.PutUint32(b[0x230:], 0x200000)    // kernel_alignment
+	b[0x234] = 1                                          // relocatable_kernel
+	b[0x235] = 21                                         // min_alignment
+	binary.LittleEndian.PutUint16(b[0x236:], 0x1)         // xloadflags
+	binary.LittleEndian.PutUint32(b[0x238:], 2047)        // cmdline_size
+	binary.LittleEndian.PutUint64(b[0x258:], 0x1000000)   // pref_address
+	binary.LittleEndian.PutUint32(b[0x260:], 0x2000000)   // init_size
+	copy(b[0x400:], version+"\x00")
+	return b
+}
+
+func TestInspectBzImage(t *testing.T) {
+	image := fakeBzImage("6.6.7 (builder@vz) #1 SMP PREEMPT_DYNAMIC")
+	info, err := kernel.InspectReader(bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Arch != kernel.ArchX86_64 {
+		t.Fatalf("want arch %v but got %v", kernel.ArchX86_64, info.Arch)
+	}
+	if info.Format != kernel.FormatBzImage {
+		t.Fatalf("want format %v but got %v", kernel.FormatBzImage, info.Format)
+	}
+	if want := "6.6.7"; info.Version != want {
+		t.Fatalf("want version %q but got %q", want, info.Version)
+	}
+	if info.NeedsDecompression() {
+		t.Fatal("bzImage does not need to be decompressed")
+	}
+	want := kernel.X86SetupHeader{
+		SetupSectors:    4,
+		Protocol:        0x020f,
+		Relocatable:     true,
+		KernelAlignment: 0x200000,
+		MinAlignment:    0x200000,
+		PrefAddress:     0x1000000,
+		InitSize:        0x2000000,
+		CmdlineSize:     2047,
+		Kernel64:        true,
+	}
+	if *info.X86 != want {
+		t.Fatalf("want header %+v but got %+v", want, *info.X86)
+	}
+	if got := info.X86.ProtocolVersion(); got != "2.15" {
+		t.Fatalf("want protocol version 2.15 but got %q", got)
+	}
+	if info.MemorySize() != 0x2000000 {
+		t.Fatalf("want memory size %#x but got %#x", 0x2000000, info.MemorySize())
+	}
+}
+
+func TestInspectError(t *testing.T) {
+	cases := []struct {
+		name  string
+		input []byte
+		want  error
+	}{
+		{
+			name:  "empty",
+			input: nil,
+			want:  kernel.ErrUnknownFormat,
+		},
+		{
+			name:  "not a kernel",
+			input: bytes.Repeat([]byte("hello"), 1000),
+			want:  kernel.ErrUnknownFormat,
+		},
+		{
+			name:  "xz",
+			input: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00, 0x04},
+			want:  kernel.ErrUnsupportedCompression,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := kernel.InspectReader(bytes.NewReader(tc.input))
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("want %v but got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	want, err := os.ReadFile(filepath.Join("testdata", "Image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"Image", "Image.gz", "Image.zst", "Image.lz4", "vmlinuz.efi"} {
+		t.Run(file, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			var got bytes.Buffer
+			if _, err := kernel.Decompress(&got, f); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(want, got.Bytes()) {
+				t.Fatalf("want %d bytes but got %d bytes", len(want), got.Len())
+			}
+		})
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	compressed, err := os.ReadFile(filepath.Join("testdata", "Image.zst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last 4 bytes are the size trailer, and the rest must not be ignored.
+	truncated := compressed[:len(compressed)-8]
+	if _, err := kernel.InspectReader(bytes.NewReader(truncated)); err == nil {
+		t.Fatal("want error but got nil")
+	}
+}
+
+func TestDecompressToCache(t *testing.T) {
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+
+	t.Run("not compressed", func(t *testing.T) {
+		path := filepath.Join("testdata", "Image")
+		got, err := kernel.DecompressToCache(path, cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != path {
+			t.Fatalf("want %q but got %q", path, got)
+		}
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		want, err := os.ReadFile(filepath.Join("testdata", "Image"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path, err := kernel.DecompressToCache(filepath.Join("testdata", "Image.gz"), cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(path) != cacheDir {
+			t.Fatalf("want the path in %q but got %q", cacheDir, path)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Fatalf("want %d bytes but got %d bytes", len(want), len(got))
+		}
+
+		// The cached image is reused.
+		if err := os.WriteFile(path, []byte("cached"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		path2, err := kernel.DecompressToCache(filepath.Join("testdata", "Image.gz"), cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != path2 {
+			t.Fatalf("want %q but got %q", path, path2)
+		}
+		got, err = os.ReadFile(path2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "cached" {
+			t.Fatal("want the cached image to be reused")
+		}
+
+		entries, err := os.ReadDir(cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("want 1 file in the cache directory but got %d", len(entries))
+		}
+	})
+}
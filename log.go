@@ -0,0 +1,89 @@
+package vz
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+)
+
+// Keys of the attributes of the log records. The records of the same device and
+// virtual machine have the same attributes, so that they can be filtered.
+const (
+	// LogKeyVM is the identifier of the virtual machine.
+	LogKeyVM = "vm"
+	// LogKeyDevice is the kind of the device such as "network", "nbd", "usb",
+	// "vsock" and "restore-image".
+	LogKeyDevice = "device"
+	// LogKeyPort is the port of the virtio socket connection.
+	LogKeyPort = "port"
+	// LogKeyError is the error.
+	LogKeyError = "error"
+	// LogKeyErrorDomain is the domain of the NSError.
+	LogKeyErrorDomain = "error_domain"
+	// LogKeyErrorCode is the code of the NSError, which is one of the ErrorCode
+	// constants in VZErrorDomain.
+	LogKeyErrorCode = "error_code"
+)
+
+var logger atomic.Pointer[slog.Logger]
+
+// SetLogger sets the package-level logger which logs the callbacks from
+// Virtualization.framework such as the state changes of the virtual machines, the
+// connections of the devices and their errors, and the downloads of the restore
+// images. The virtual machines created with WithVirtualMachineLogger use their own
+// loggers instead.
+//
+// The records are discarded by default, and setting nil discards them again.
+func SetLogger(l *slog.Logger) {
+	logger.Store(l)
+}
+
+// Logger returns the package-level logger set by SetLogger.
+func Logger() *slog.Logger {
+	if l := logger.Load(); l != nil {
+		return l
+	}
+	return discardLogger
+}
+
+var discardLogger = slog.New(discardHandler{})
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// errorAttrs returns the attributes of err, which have the domain and the code if
+// err is an NSError.
+func errorAttrs(err error) []any {
+	attrs := []any{slog.Any(LogKeyError, err)}
+	var nserr *NSError
+	if errors.As(err, &nserr) {
+		attrs = append(attrs,
+			slog.String(LogKeyErrorDomain, nserr.Domain),
+			slog.Int(LogKeyErrorCode, nserr.Code),
+		)
+	}
+	return attrs
+}
+
+// machineLogger is the logger of a virtual machine which is shared with the
+// callbacks of the virtual machine and its devices.
+type machineLogger struct {
+	id     string
+	logger *slog.Logger
+}
+
+// get returns the logger with the identifier of the virtual machine. The
+// package-level logger is used at the time of logging if the virtual machine has no
+// logger, so that SetLogger takes effect on the existing virtual machines.
+func (l *machineLogger) get() *slog.Logger {
+	logger := l.logger
+	if logger == nil {
+		logger = Logger()
+	}
+	return logger.With(LogKeyVM, l.id)
+}
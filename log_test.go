@@ -0,0 +1,79 @@
+package vz
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func newTestLogger(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+}
+
+func TestLogger(t *testing.T) {
+	defer SetLogger(nil)
+
+	if Logger().Enabled(context.Background(), slog.LevelError) {
+		t.Fatal("want the records discarded by default")
+	}
+
+	var pkg, vm bytes.Buffer
+	l := &machineLogger{id: "vm-1"}
+	SetLogger(newTestLogger(&pkg))
+	l.get().Info("state changed")
+	if want := `level=INFO msg="state changed" vm=vm-1`; strings.TrimSpace(pkg.String()) != want {
+		t.Fatalf("want %q but got %q", want, pkg.String())
+	}
+
+	l.logger = newTestLogger(&vm)
+	l.get().Info("state changed")
+	if !strings.Contains(vm.String(), "vm=vm-1") || strings.Count(pkg.String(), "\n") != 1 {
+		t.Fatalf("want the logger of the virtual machine but got %q and %q", vm.String(), pkg.String())
+	}
+
+	SetLogger(nil)
+	if Logger().Enabled(context.Background(), slog.LevelError) {
+		t.Fatal("want the records discarded after SetLogger(nil)")
+	}
+}
+
+func TestErrorAttrs(t *testing.T) {
+	nserr := &NSError{Domain: "VZErrorDomain", Code: int(ErrorInternal), LocalizedDescription: "internal error"}
+	cases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "error",
+			err:  errors.New("oops"),
+			want: `level=WARN msg=failed error=oops`,
+		},
+		{
+			name: "NSError",
+			err:  fmt.Errorf("wrapped: %w", nserr),
+			want: `error_domain=VZErrorDomain error_code=1`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			newTestLogger(&buf).Warn("failed", errorAttrs(tc.err)...)
+			if !strings.Contains(buf.String(), tc.want) {
+				t.Fatalf("want %q in %q", tc.want, buf.String())
+			}
+		})
+	}
+}
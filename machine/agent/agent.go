@@ -0,0 +1,202 @@
+// Package agent implements the protocol between the host and the guest agent, a
+// small server which runs in the guest and listens on a virtio-vsock port, so that
+// the host can ask the guest to do things which Virtualization.framework cannot,
+// such as powering off when the guest ignores RequestStop.
+//
+// Each connection carries one request. The client sends a Request as a JSON line,
+// and the agent replies with a Response as a JSON line. The exec method is
+// answered with the responses which carry the chunks of the output of the command
+// as it is written, followed by the last one which has the exit code.
+//
+// The agent for Linux guests is cmd/vzagent.
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+// DefaultPort is the virtio-vsock port on which the guest agent listens by default.
+const DefaultPort uint32 = 1024
+
+// Methods of the requests.
+const (
+	MethodPing     = "ping"
+	MethodPowerOff = "poweroff"
+	MethodExec     = "exec"
+)
+
+// Streams of the output of MethodExec.
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// ErrUnsupported is returned when the agent does not support the method.
+var ErrUnsupported = errors.New("agent: unsupported method")
+
+// Request is a request to the agent.
+type Request struct {
+	Method string `json:"method"`
+
+	// Args is the command line of MethodExec. Args[0] is looked up in PATH.
+	Args []string `json:"args,omitempty"`
+	// Env is the environment variables added to the ones of the agent such as
+	// "KEY=value".
+	Env []string `json:"env,omitempty"`
+	// Dir is the working directory of the command. It is the one of the agent if
+	// it is empty.
+	Dir string `json:"dir,omitempty"`
+}
+
+// Response is the response of the agent.
+type Response struct {
+	// Error is the error message if the request has failed.
+	Error string `json:"error,omitempty"`
+	// Unsupported is true if the method is not supported by the agent.
+	Unsupported bool `json:"unsupported,omitempty"`
+
+	// Stream is StreamStdout or StreamStderr if the response carries the output of
+	// the command of MethodExec.
+	Stream string `json:"stream,omitempty"`
+	// Data is the chunk of the output.
+	Data []byte `json:"data,omitempty"`
+	// ExitCode is the exit code of the command, which is set in the last response
+	// of MethodExec.
+	ExitCode *int `json:"exitCode,omitempty"`
+}
+
+// Command is a command run by Exec.
+type Command struct {
+	// Args, Env and Dir are the ones of Request.
+	Args []string
+	Env  []string
+	Dir  string
+	// Stdout and Stderr receive the output of the command as it is written. The
+	// output is discarded if they are nil.
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Client is a client of the guest agent.
+type Client struct {
+	dial func(ctx context.Context) (net.Conn, error)
+}
+
+// NewClient creates a new Client which connects to the agent with dial.
+func NewClient(dial func(ctx context.Context) (net.Conn, error)) *Client {
+	return &Client{dial: dial}
+}
+
+// NewMachineClient creates a new Client of the agent listening on the port of the
+// guest of m.
+func NewMachineClient(m machine.VsockDialer, port uint32) *Client {
+	return NewClient(func(ctx context.Context) (net.Conn, error) {
+		return m.DialVsock(ctx, port)
+	})
+}
+
+// call sends the request and receives the response.
+func (c *Client) call(ctx context.Context, req *Request) error {
+	return c.roundTrip(ctx, req, func(*Response) (bool, error) {
+		return true, nil
+	})
+}
+
+// roundTrip sends the request and passes the responses to handle until it reports
+// that the last one is received.
+func (c *Client) roundTrip(ctx context.Context, req *Request, handle func(resp *Response) (bool, error)) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("agent: failed to connect: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return callError(ctx, req, err)
+	}
+	dec := json.NewDecoder(conn)
+	for {
+		var resp Response
+		if err := dec.Decode(&resp); err != nil {
+			return callError(ctx, req, err)
+		}
+		switch {
+		case resp.Unsupported:
+			return fmt.Errorf("%w: %s", ErrUnsupported, req.Method)
+		case resp.Error != "":
+			return fmt.Errorf("agent: %s: %s", req.Method, resp.Error)
+		}
+		done, err := handle(&resp)
+		if err != nil {
+			return fmt.Errorf("agent: %s: %w", req.Method, err)
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+func callError(ctx context.Context, req *Request, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = ctxErr
+	}
+	return fmt.Errorf("agent: %s: %w", req.Method, err)
+}
+
+// Ping checks that the agent is responding.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.call(ctx, &Request{Method: MethodPing})
+}
+
+// PowerOff asks the agent to power off the guest. It returns when the agent has
+// accepted the request, so wait for the machine to stop after it.
+func (c *Client) PowerOff(ctx context.Context) error {
+	return c.call(ctx, &Request{Method: MethodPowerOff})
+}
+
+// Exec runs the command in the guest and returns its exit code. The output is
+// written to cmd.Stdout and cmd.Stderr as it is received. The command is killed
+// when ctx is done.
+//
+// A non-zero exit code is not an error. The error is returned when the command
+// cannot be run or its result cannot be received.
+func (c *Client) Exec(ctx context.Context, cmd *Command) (int, error) {
+	if len(cmd.Args) == 0 {
+		return -1, errors.New("agent: exec: no command")
+	}
+	req := &Request{Method: MethodExec, Args: cmd.Args, Env: cmd.Env, Dir: cmd.Dir}
+	code := -1
+	err := c.roundTrip(ctx, req, func(resp *Response) (bool, error) {
+		if resp.ExitCode != nil {
+			code = *resp.ExitCode
+			return true, nil
+		}
+		var w io.Writer
+		switch resp.Stream {
+		case StreamStdout:
+			w = cmd.Stdout
+		case StreamStderr:
+			w = cmd.Stderr
+		default:
+			return false, fmt.Errorf("unknown stream %q", resp.Stream)
+		}
+		if w == nil {
+			return false, nil
+		}
+		_, err := w.Write(resp.Data)
+		return false, err
+	})
+	return code, err
+}
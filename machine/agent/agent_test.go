@@ -0,0 +1,142 @@
+package agent_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/agent"
+	"github.com/Code-Hex/vz/v3/machine/fake"
+)
+
+func newMachine(t *testing.T) *fake.Machine {
+	t.Helper()
+	m := fake.New(&machine.Spec{Name: "vm"})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func serve(t *testing.T, m *fake.Machine, s *agent.Server) {
+	t.Helper()
+	ln, err := m.ListenVsock(agent.DefaultPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+}
+
+func TestClient(t *testing.T) {
+	m := newMachine(t)
+	poweredOff := make(chan struct{})
+	serve(t, m, &agent.Server{
+		PowerOff: func() error {
+			m.Shutdown()
+			close(poweredOff)
+			return nil
+		},
+	})
+	client := agent.NewMachineClient(m, agent.DefaultPort)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.PowerOff(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-poweredOff:
+	case <-ctx.Done():
+		t.Fatal("the guest is not powered off")
+	}
+	if s := m.State(); s != machine.StateStopped {
+		t.Fatalf("want stopped but got %s", s)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	m := newMachine(t)
+	client := agent.NewMachineClient(m, agent.DefaultPort)
+	ctx := context.Background()
+	if err := client.Ping(ctx); err == nil {
+		t.Fatal("want an error without the agent")
+	}
+
+	serve(t, m, &agent.Server{})
+	if err := client.PowerOff(ctx); !errors.Is(err, agent.ErrUnsupported) {
+		t.Fatalf("want ErrUnsupported but got %v", err)
+	}
+	if _, err := client.Exec(ctx, &agent.Command{Args: []string{"true"}}); !errors.Is(err, agent.ErrUnsupported) {
+		t.Fatalf("want ErrUnsupported but got %v", err)
+	}
+
+	// The agent which does not respond is canceled by the context.
+	ln, err := m.ListenVsock(agent.DefaultPort + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			<-time.After(5 * time.Second)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	err = agent.NewMachineClient(m, agent.DefaultPort+1).Ping(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want DeadlineExceeded but got %v", err)
+	}
+}
+
+func TestClientExec(t *testing.T) {
+	m := newMachine(t)
+	serve(t, m, &agent.Server{Exec: agent.ExecCommand})
+	client := agent.NewMachineClient(m, agent.DefaultPort)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		args   []string
+		env    []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{args: []string{"sh", "-c", "echo out; echo err >&2; exit 3"}, code: 3, stdout: "out\n", stderr: "err\n"},
+		{args: []string{"sh", "-c", "echo $GREETING"}, env: []string{"GREETING=hello"}, stdout: "hello\n"},
+	}
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		code, err := client.Exec(ctx, &agent.Command{Args: tt.args, Env: tt.env, Stdout: &stdout, Stderr: &stderr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code || stdout.String() != tt.stdout || stderr.String() != tt.stderr {
+			t.Fatalf("%v: want %d, %q, %q but got %d, %q, %q", tt.args, tt.code, tt.stdout, tt.stderr, code, stdout.String(), stderr.String())
+		}
+	}
+
+	if _, err := client.Exec(ctx, &agent.Command{Args: []string{"/nonexistent"}}); err == nil || !strings.Contains(err.Error(), "nonexistent") {
+		t.Fatalf("want the error of the missing command but got %v", err)
+	}
+
+	// The command is killed when the context is done.
+	short, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.Exec(short, &agent.Command{Args: []string{"sleep", "10"}})
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 5*time.Second {
+		t.Fatalf("want DeadlineExceeded but got %v", err)
+	}
+}
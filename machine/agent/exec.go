@@ -0,0 +1,31 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// ExecCommand runs the command of the exec request with os/exec. It is the
+// implementation of Server.Exec. The command is killed when ctx is canceled.
+func ExecCommand(ctx context.Context, req *Request, stdout, stderr io.Writer) (int, error) {
+	if len(req.Args) == 0 {
+		return -1, errors.New("no command")
+	}
+	cmd := exec.CommandContext(ctx, req.Args[0], req.Args[1:]...)
+	cmd.Env = append(os.Environ(), req.Env...)
+	cmd.Dir = req.Dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
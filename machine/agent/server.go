@@ -0,0 +1,128 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+)
+
+// Server is the guest agent which serves the requests of Client.
+type Server struct {
+	// PowerOff powers off the guest. It is called after the response is sent,
+	// because it usually does not return. The poweroff method is unsupported if
+	// it is nil.
+	PowerOff func() error
+
+	// Exec runs the command of the exec request, writing its output to stdout and
+	// stderr, and returns its exit code. ctx is canceled when the client
+	// disconnects. The exec method is unsupported if it is nil. ExecCommand
+	// runs the command with os/exec.
+	Exec func(ctx context.Context, req *Request, stdout, stderr io.Writer) (int, error)
+
+	// ErrorLog is called with the errors which cannot be sent to the client.
+	// They are ignored if it is nil.
+	ErrorLog func(err error)
+}
+
+// Serve accepts the connections on ln and serves them until Accept fails.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a request on conn, and closes it.
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		s.logError(err)
+		return
+	}
+	var (
+		resp  Response
+		after func() error
+	)
+	switch {
+	case req.Method == MethodPing:
+	case req.Method == MethodPowerOff && s.PowerOff != nil:
+		after = s.PowerOff
+	case req.Method == MethodExec && s.Exec != nil:
+		s.exec(conn, &req)
+		return
+	default:
+		resp.Unsupported = true
+	}
+	if err := json.NewEncoder(conn).Encode(&resp); err != nil {
+		s.logError(err)
+		return
+	}
+	if after != nil {
+		conn.Close()
+		if err := after(); err != nil {
+			s.logError(err)
+		}
+	}
+}
+
+// exec runs the command, and sends its output and its exit code.
+func (s *Server) exec(conn net.Conn, req *Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The client sends nothing after the request, so the read returns when it
+	// disconnects.
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+	}()
+
+	enc := &encoder{enc: json.NewEncoder(conn)}
+	code, err := s.Exec(ctx, req,
+		&streamWriter{enc: enc, stream: StreamStdout},
+		&streamWriter{enc: enc, stream: StreamStderr},
+	)
+	resp := &Response{ExitCode: &code}
+	if err != nil {
+		resp = &Response{Error: err.Error()}
+	}
+	if err := enc.encode(resp); err != nil {
+		s.logError(err)
+	}
+}
+
+func (s *Server) logError(err error) {
+	if s.ErrorLog != nil {
+		s.ErrorLog(err)
+	}
+}
+
+// encoder sends the responses of the streams written concurrently.
+type encoder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (e *encoder) encode(resp *Response) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.enc.Encode(resp)
+}
+
+// streamWriter sends the written data as the responses of the stream.
+type streamWriter struct {
+	enc    *encoder
+	stream string
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if err := w.enc.encode(&Response{Stream: w.stream, Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,100 @@
+// Package api provides the HTTP API to control machines managed by
+// machine.Manager, and its client. The API is JSON over HTTP, and is usually served
+// on a Unix socket:
+//
+//	GET    /v1/machines                 list the machines
+//	POST   /v1/machines                 create a machine of the spec in the body
+//	GET    /v1/machines/{name}          get the machine
+//	DELETE /v1/machines/{name}          delete the stopped machine
+//	POST   /v1/machines/{name}/start    start the machine
+//	POST   /v1/machines/{name}/stop     stop the machine ({"force": true} to stop immediately)
+//	POST   /v1/machines/{name}/pause    pause the machine
+//	POST   /v1/machines/{name}/resume   resume the machine
+//	POST   /v1/machines/{name}/save     save the state of the paused machine ({"path": "..."})
+//	POST   /v1/machines/{name}/restore  restore the state of the stopped machine ({"path": "..."})
+//	GET    /v1/machines/{name}/console  attach to the serial console with WebSocket
+//	GET    /v1/events                   stream the state changes as JSON lines
+//
+// The errors are returned as Error in JSON, and the client converts them back to the
+// errors of the machine package, so that errors.Is works across the API.
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+// Error is the body of an error response.
+type Error struct {
+	// Code is the kind of the error such as "not_found".
+	Code string `json:"code"`
+	// Message is the human-readable message.
+	Message string `json:"message"`
+}
+
+// Error implements error. It returns the message.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the sentinel error of the machine package for the code.
+func (e *Error) Unwrap() error {
+	for _, c := range errorCodes {
+		if c.code == e.Code {
+			return c.err
+		}
+	}
+	return nil
+}
+
+// errorCodes maps the errors of the machine package to the codes and the statuses.
+var errorCodes = []struct {
+	err    error
+	code   string
+	status int
+}{
+	{err: machine.ErrNotFound, code: "not_found", status: http.StatusNotFound},
+	{err: machine.ErrExists, code: "exists", status: http.StatusConflict},
+	{err: machine.ErrInvalidState, code: "invalid_state", status: http.StatusConflict},
+	{err: machine.ErrInvalidSpec, code: "invalid_spec", status: http.StatusBadRequest},
+	{err: machine.ErrUnsupported, code: "unsupported", status: http.StatusNotImplemented},
+}
+
+// errBadRequest is the code of the errors of invalid requests.
+const errBadRequest = "bad_request"
+
+// toError converts err to Error and the status of the response.
+func toError(err error) (*Error, int) {
+	if e := (*Error)(nil); errors.As(err, &e) && e.Code == errBadRequest {
+		return e, http.StatusBadRequest
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return &Error{Code: c.code, Message: err.Error()}, c.status
+		}
+	}
+	return &Error{Code: "internal", Message: err.Error()}, http.StatusInternalServerError
+}
+
+// StopRequest is the body of the stop request.
+type StopRequest struct {
+	// Force stops the machine immediately instead of requesting the guest to stop.
+	Force bool `json:"force,omitempty"`
+}
+
+// StateRequest is the body of the save and restore requests.
+type StateRequest struct {
+	// Path is the path of the file of the saved state on the host of the server.
+	Path string `json:"path"`
+}
+
+// Store persists the definitions of the machines which are created and deleted
+// through the API.
+type Store interface {
+	// Put stores the spec of the machine which has been created.
+	Put(spec *machine.Spec) error
+	// Delete deletes the spec of the machine which has been deleted.
+	Delete(name string) error
+}
@@ -0,0 +1,226 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/api"
+	"github.com/Code-Hex/vz/v3/machine/fake"
+)
+
+func newServer(t *testing.T, opts ...api.ServerOption) (*api.Client, *machine.Manager, *fake.Backend) {
+	t.Helper()
+	backend := fake.NewBackend()
+	manager := machine.NewManager(backend)
+	if _, err := manager.Create(&machine.Spec{Name: "vm"}); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(t.TempDir(), "api.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := api.NewServer(manager, opts...)
+	srv := &http.Server{Handler: server}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		server.Close()
+		srv.Close()
+	})
+	return api.NewClient(sock), manager, backend
+}
+
+func TestClient(t *testing.T) {
+	client, _, _ := newServer(t)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "vm.state")
+
+	steps := []struct {
+		name string
+		op   func() (*machine.Info, error)
+		want machine.State
+	}{
+		{name: "get", op: func() (*machine.Info, error) { return client.Get(ctx, "vm") }, want: machine.StateStopped},
+		{name: "start", op: func() (*machine.Info, error) { return client.Start(ctx, "vm") }, want: machine.StateRunning},
+		{name: "pause", op: func() (*machine.Info, error) { return client.Pause(ctx, "vm") }, want: machine.StatePaused},
+		{name: "save", op: func() (*machine.Info, error) { return client.Save(ctx, "vm", path) }, want: machine.StatePaused},
+		{name: "resume", op: func() (*machine.Info, error) { return client.Resume(ctx, "vm") }, want: machine.StateRunning},
+		{name: "stop", op: func() (*machine.Info, error) { return client.Stop(ctx, "vm", true) }, want: machine.StateStopped},
+		{name: "restore", op: func() (*machine.Info, error) { return client.Restore(ctx, "vm", path) }, want: machine.StatePaused},
+	}
+	for _, step := range steps {
+		info, err := step.op()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if info.Name != "vm" || info.State != step.want {
+			t.Fatalf("%s: want %s but got %+v", step.name, step.want, info)
+		}
+	}
+
+	infos, err := client.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Spec.Memory != machine.DefaultMemory {
+		t.Fatalf("unexpected list %+v", infos)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	client, _, _ := newServer(t)
+	ctx := context.Background()
+	if _, err := client.Get(ctx, "missing"); !errors.Is(err, machine.ErrNotFound) {
+		t.Fatalf("want ErrNotFound but got %v", err)
+	}
+	if _, err := client.Pause(ctx, "vm"); !errors.Is(err, machine.ErrInvalidState) {
+		t.Fatalf("want ErrInvalidState but got %v", err)
+	}
+	var apiErr *api.Error
+	if _, err := client.Save(ctx, "vm", ""); !errors.As(err, &apiErr) || apiErr.Code != "bad_request" {
+		t.Fatalf("want bad_request but got %v", err)
+	}
+	if _, err := client.Console(ctx, "missing"); !errors.Is(err, machine.ErrNotFound) {
+		t.Fatalf("want ErrNotFound but got %v", err)
+	}
+}
+
+func TestClientConsole(t *testing.T) {
+	client, _, backend := newServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := client.Console(ctx, "vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	guest := backend.Machine("vm").Guest()
+
+	if _, err := conn.Write([]byte("ls\r")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(guest, buf); err != nil || string(buf) != "ls\r" {
+		t.Fatalf("want the input but got %q, %v", buf, err)
+	}
+	go guest.Write([]byte("hello\r\n"))
+	buf = make([]byte, 7)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello\r\n" {
+		t.Fatalf("want the output but got %q, %v", buf, err)
+	}
+}
+
+// memoryStore is an api.Store which keeps the specs in memory.
+type memoryStore struct {
+	mu    sync.Mutex
+	specs map[string]*machine.Spec
+	err   error
+}
+
+func (s *memoryStore) Put(spec *machine.Spec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.specs[spec.Name] = spec
+	return nil
+}
+
+func (s *memoryStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.specs, name)
+	return nil
+}
+
+func TestClientCreateDelete(t *testing.T) {
+	store := &memoryStore{specs: make(map[string]*machine.Spec)}
+	client, manager, _ := newServer(t, api.WithStore(store))
+	ctx := context.Background()
+
+	info, err := client.Create(ctx, &machine.Spec{Name: "new", CPUs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "new" || info.State != machine.StateStopped || info.Spec.CPUs != 2 || info.Spec.Memory != machine.DefaultMemory {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	if spec := store.specs["new"]; spec == nil || spec.Memory != machine.DefaultMemory {
+		t.Fatalf("want the stored spec with the defaults but got %+v", spec)
+	}
+	if _, err := client.Create(ctx, &machine.Spec{Name: "new"}); !errors.Is(err, machine.ErrExists) {
+		t.Fatalf("want ErrExists but got %v", err)
+	}
+	if _, err := client.Create(ctx, &machine.Spec{Name: "in/valid"}); !errors.Is(err, machine.ErrInvalidSpec) {
+		t.Fatalf("want ErrInvalidSpec but got %v", err)
+	}
+
+	// The machine is not created if it cannot be stored.
+	store.err = errors.New("disk full")
+	if _, err := client.Create(ctx, &machine.Spec{Name: "unstored"}); err == nil {
+		t.Fatal("want an error of the store")
+	}
+	if _, err := manager.Get("unstored"); !errors.Is(err, machine.ErrNotFound) {
+		t.Fatalf("want the machine removed but got %v", err)
+	}
+
+	if _, err := client.Start(ctx, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Delete(ctx, "new"); !errors.Is(err, machine.ErrInvalidState) {
+		t.Fatalf("want ErrInvalidState but got %v", err)
+	}
+	if _, err := client.Stop(ctx, "new", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Delete(ctx, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.specs["new"]; ok {
+		t.Fatal("want the spec deleted from the store")
+	}
+	if err := client.Delete(ctx, "new"); !errors.Is(err, machine.ErrNotFound) {
+		t.Fatalf("want ErrNotFound but got %v", err)
+	}
+}
+
+func TestClientEvents(t *testing.T) {
+	client, _, _ := newServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events, err := client.Events(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Start(ctx, "vm"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Stop(ctx, "vm", true); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []machine.State{machine.StateStarting, machine.StateRunning, machine.StateStopped}
+	for _, state := range want {
+		select {
+		case ev := <-events:
+			if ev.Name != "vm" || ev.State != state || ev.Time.IsZero() {
+				t.Fatalf("want %s but got %+v", state, ev)
+			}
+		case <-ctx.Done():
+			t.Fatalf("want %s but got nothing", state)
+		}
+	}
+
+	cancel()
+	for range events {
+	}
+}
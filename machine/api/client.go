@@ -0,0 +1,250 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/Code-Hex/vz/v3/internal/websocket"
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+// Client is a client of the API served on a Unix socket.
+type Client struct {
+	socketPath string
+	httpClient *http.Client
+}
+
+// NewClient creates a new Client of the server listening on the Unix socket at
+// socketPath.
+func NewClient(socketPath string) *Client {
+	c := &Client{socketPath: socketPath}
+	c.httpClient = &http.Client{
+		Transport: &http.Transport{DialContext: c.dial},
+	}
+	return c
+}
+
+// dial ignores the address because the host of the URLs is a placeholder.
+func (c *Client) dial(ctx context.Context, _, _ string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", c.socketPath)
+}
+
+// do sends the request and decodes the response into out if it is not nil.
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://machine"+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("api: invalid response: %w", err)
+	}
+	return nil
+}
+
+func decodeError(resp *http.Response) error {
+	e := &Error{}
+	if err := json.NewDecoder(resp.Body).Decode(e); err != nil || e.Message == "" {
+		return fmt.Errorf("api: unexpected status %s", resp.Status)
+	}
+	return e
+}
+
+func machinePath(name, op string) string {
+	p := "/v1/machines/" + url.PathEscape(name)
+	if op != "" {
+		p += "/" + op
+	}
+	return p
+}
+
+// List returns the machines.
+func (c *Client) List(ctx context.Context) ([]*machine.Info, error) {
+	var infos []*machine.Info
+	if err := c.do(ctx, http.MethodGet, "/v1/machines", nil, &infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// Create creates a machine of the spec.
+func (c *Client) Create(ctx context.Context, spec *machine.Spec) (*machine.Info, error) {
+	info := &machine.Info{}
+	if err := c.do(ctx, http.MethodPost, "/v1/machines", spec, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Delete deletes the stopped machine of the name.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, machinePath(name, ""), nil, nil)
+}
+
+// Get returns the machine of the name.
+func (c *Client) Get(ctx context.Context, name string) (*machine.Info, error) {
+	info := &machine.Info{}
+	if err := c.do(ctx, http.MethodGet, machinePath(name, ""), nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (c *Client) post(ctx context.Context, name, op string, in any) (*machine.Info, error) {
+	info := &machine.Info{}
+	if err := c.do(ctx, http.MethodPost, machinePath(name, op), in, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Start starts the machine of the name.
+func (c *Client) Start(ctx context.Context, name string) (*machine.Info, error) {
+	return c.post(ctx, name, "start", nil)
+}
+
+// Stop stops the machine of the name. It requests the guest to stop unless force is
+// true.
+func (c *Client) Stop(ctx context.Context, name string, force bool) (*machine.Info, error) {
+	return c.post(ctx, name, "stop", &StopRequest{Force: force})
+}
+
+// Pause pauses the machine of the name.
+func (c *Client) Pause(ctx context.Context, name string) (*machine.Info, error) {
+	return c.post(ctx, name, "pause", nil)
+}
+
+// Resume resumes the machine of the name.
+func (c *Client) Resume(ctx context.Context, name string) (*machine.Info, error) {
+	return c.post(ctx, name, "resume", nil)
+}
+
+// Save saves the state of the paused machine of the name to path on the host of
+// the server.
+func (c *Client) Save(ctx context.Context, name, path string) (*machine.Info, error) {
+	return c.post(ctx, name, "save", &StateRequest{Path: path})
+}
+
+// Restore restores the state of the stopped machine of the name from path on the
+// host of the server.
+func (c *Client) Restore(ctx context.Context, name, path string) (*machine.Info, error) {
+	return c.post(ctx, name, "restore", &StateRequest{Path: path})
+}
+
+// Events returns the channel which receives the state changes of the machines. The
+// channel is closed when ctx is done or the connection is lost.
+func (c *Client) Events(ctx context.Context) (<-chan machine.Event, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://machine/v1/events", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, decodeError(resp)
+	}
+	events := make(chan machine.Event)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var ev machine.Event
+			if err := dec.Decode(&ev); err != nil {
+				return
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Console attaches to the serial console of the machine of the name. Read returns
+// the output of the console including the recent output before attaching, and Write
+// sends the input to the guest.
+func (c *Client) Console(ctx context.Context, name string) (io.ReadWriteCloser, error) {
+	if _, err := c.Get(ctx, name); err != nil {
+		return nil, err
+	}
+	d := &websocket.Dialer{NetDial: c.dial}
+	conn, err := d.Dial(ctx, "ws://machine"+machinePath(name, "console"), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &consoleConn{conn: conn}, nil
+}
+
+// consoleConn adapts a WebSocket connection of the console to io.ReadWriteCloser.
+type consoleConn struct {
+	conn *websocket.Conn
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (c *consoleConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.buf) == 0 {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) || errors.Is(err, websocket.ErrClosed) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		c.buf = data
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *consoleConn) Write(p []byte) (int, error) {
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *consoleConn) Close() error {
+	return c.conn.Close(websocket.CloseNormalClosure, "")
+}
@@ -0,0 +1,285 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/Code-Hex/vz/v3/console"
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+// Server is an http.Handler which serves the API for a machine.Manager.
+type Server struct {
+	manager *machine.Manager
+	store   Store
+	mux     *http.ServeMux
+	done    chan struct{}
+
+	mu       sync.Mutex
+	consoles map[string]*console.WebHandler
+	closed   bool
+}
+
+var _ http.Handler = (*Server)(nil)
+
+// ServerOption is an option for NewServer.
+type ServerOption func(*Server)
+
+// WithStore sets the store which persists the machines created and deleted through
+// the API. Without the store, the machines are only added to and removed from the
+// manager.
+func WithStore(store Store) ServerOption {
+	return func(s *Server) {
+		s.store = store
+	}
+}
+
+// NewServer creates a new Server for the manager.
+func NewServer(manager *machine.Manager, opts ...ServerOption) *Server {
+	s := &Server{
+		manager:  manager,
+		mux:      http.NewServeMux(),
+		done:     make(chan struct{}),
+		consoles: make(map[string]*console.WebHandler),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.mux.HandleFunc("GET /v1/machines", s.list)
+	s.mux.HandleFunc("POST /v1/machines", s.create)
+	s.mux.HandleFunc("GET /v1/machines/{name}", s.get)
+	s.mux.HandleFunc("DELETE /v1/machines/{name}", s.remove)
+	s.mux.HandleFunc("POST /v1/machines/{name}/start", s.action(manager.Start))
+	s.mux.HandleFunc("POST /v1/machines/{name}/stop", s.stop)
+	s.mux.HandleFunc("POST /v1/machines/{name}/pause", s.action(manager.Pause))
+	s.mux.HandleFunc("POST /v1/machines/{name}/resume", s.action(manager.Resume))
+	s.mux.HandleFunc("POST /v1/machines/{name}/save", s.state(manager.Save))
+	s.mux.HandleFunc("POST /v1/machines/{name}/restore", s.state(manager.Restore))
+	s.mux.HandleFunc("GET /v1/machines/{name}/console", s.console)
+	s.mux.HandleFunc("GET /v1/events", s.events)
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Close disconnects the clients of the consoles and the event streams.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		close(s.done)
+	}
+	s.closed = true
+	for name, h := range s.consoles {
+		h.Close()
+		delete(s.consoles, name)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	e, status := toError(err)
+	writeJSON(w, status, e)
+}
+
+// decode decodes the JSON body of r into v. An empty body is allowed.
+func decode(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return &Error{Code: errBadRequest, Message: fmt.Sprintf("invalid request body: %v", err)}
+	}
+	return nil
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.manager.List())
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request) {
+	spec := &machine.Spec{}
+	if err := decode(r, spec); err != nil {
+		writeError(w, err)
+		return
+	}
+	if _, err := s.manager.Create(spec); err != nil {
+		writeError(w, err)
+		return
+	}
+	info, err := s.manager.Info(spec.Name)
+	if err == nil && s.store != nil {
+		if err = s.store.Put(info.Spec); err != nil {
+			s.manager.Remove(spec.Name)
+			err = fmt.Errorf("failed to store %s: %w", spec.Name, err)
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func (s *Server) remove(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := s.manager.Remove(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	s.closeConsole(name)
+	if s.store != nil {
+		if err := s.store.Delete(name); err != nil {
+			writeError(w, fmt.Errorf("failed to delete %s from the store: %w", name, err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request) {
+	info, err := s.manager.Info(r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// reply writes the information of the machine after an operation.
+func (s *Server) reply(w http.ResponseWriter, name string, err error) {
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	info, err := s.manager.Info(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (s *Server) action(fn func(name string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		s.reply(w, name, fn(name))
+	}
+}
+
+func (s *Server) stop(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var req StopRequest
+	err := decode(r, &req)
+	if err == nil {
+		err = s.manager.Stop(name, req.Force)
+	}
+	s.reply(w, name, err)
+}
+
+func (s *Server) state(fn func(name, path string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		var req StateRequest
+		err := decode(r, &req)
+		if err == nil && req.Path == "" {
+			err = &Error{Code: errBadRequest, Message: "path is required"}
+		}
+		if err == nil {
+			err = fn(name, req.Path)
+		}
+		s.reply(w, name, err)
+	}
+}
+
+func (s *Server) console(w http.ResponseWriter, r *http.Request) {
+	h, err := s.consoleHandler(r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// closeConsole disconnects the clients of the console of the removed machine.
+func (s *Server) closeConsole(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, ok := s.consoles[name]; ok {
+		h.Close()
+		delete(s.consoles, name)
+	}
+}
+
+// consoleHandler returns the WebHandler of the console of the machine. The handler
+// is shared by the clients because the console stream can have only one reader.
+func (s *Server) consoleHandler(name string) (*console.WebHandler, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, ok := s.consoles[name]; ok {
+		select {
+		case <-h.Done():
+		default:
+			return h, nil
+		}
+	}
+	if s.closed {
+		return nil, errors.New("api: server is closed")
+	}
+	stream, err := s.manager.Console(name)
+	if err != nil {
+		return nil, err
+	}
+	h := console.NewWebHandler(stream)
+	s.consoles[name] = h
+	return h, nil
+}
+
+// events streams the state changes of the machines as JSON lines until the client
+// disconnects or the server is closed.
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	events := s.manager.Subscribe(ctx)
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(w)
+	// The channel is drained until it is closed after ctx is done.
+	for ev := range events {
+		if ctx.Err() != nil {
+			continue
+		}
+		if err := enc.Encode(ev); err != nil {
+			cancel()
+			continue
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
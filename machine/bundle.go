@@ -0,0 +1,133 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/Code-Hex/vz/v3/bundle"
+	"github.com/Code-Hex/vz/v3/internal/fileutil"
+)
+
+// Files of the bundles created by CreateBundle.
+const (
+	bundleKernel           = "kernel"
+	bundleInitrd           = "initrd"
+	bundleEFIVariableStore = "NVRAM"
+	bundleAuxiliaryStorage = "AuxiliaryStorage"
+)
+
+// SpecFromBundle returns the spec of the machine in the bundle. The paths of the
+// spec are absolute, and the spec has a Virtio socket device for guest agents.
+func SpecFromBundle(b *bundle.Bundle) *Spec {
+	m := b.Manifest()
+	spec := &Spec{
+		Name:              m.Name,
+		OS:                OS(m.OS),
+		CPUs:              m.Config.CPUCount,
+		Memory:            Size(m.Config.MemorySize),
+		Kernel:            b.Path(m.Config.Kernel),
+		Initrd:            b.Path(m.Config.Initrd),
+		CommandLine:       m.Config.CommandLine,
+		EFIVariableStore:  b.EFIVariableStorePath(),
+		MachineIdentifier: m.MachineIdentifier,
+		HardwareModel:     m.HardwareModel,
+		AuxiliaryStorage:  b.AuxiliaryStoragePath(),
+		Vsock:             true,
+	}
+	if spec.Name == "" {
+		spec.Name = filepath.Base(b.Dir())
+	}
+	for _, d := range m.Disks {
+		spec.Disks = append(spec.Disks, Disk{Path: b.Path(d.Path), Size: Size(d.Size), ReadOnly: d.ReadOnly})
+	}
+	for _, mac := range m.MACAddresses {
+		spec.Networks = append(spec.Networks, Network{MACAddress: mac})
+	}
+	return spec
+}
+
+// CreateBundle creates a bundle at dir for the spec. The kernel, the initial RAM disk,
+// the auxiliary storage and the disk images which exist are copied into the bundle,
+// and the disk images which do not exist are created as sparse files of their sizes.
+// The networks without MAC addresses are given random addresses.
+//
+// The shared directories of the spec are not stored in the bundle because they are
+// the paths on the host.
+func CreateBundle(dir string, spec *Spec) (*bundle.Bundle, error) {
+	spec = spec.WithDefaults()
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	m := &bundle.Manifest{
+		Name: spec.Name,
+		OS:   bundle.OS(spec.OS),
+		Config: bundle.Config{
+			CPUCount:    spec.CPUs,
+			MemorySize:  uint64(spec.Memory),
+			CommandLine: spec.CommandLine,
+		},
+		MachineIdentifier: spec.MachineIdentifier,
+		HardwareModel:     spec.HardwareModel,
+	}
+	// copies maps the paths in the bundle to the files to copy.
+	copies := make(map[string]string)
+	if spec.Kernel != "" {
+		m.Config.Kernel = bundleKernel
+		copies[bundleKernel] = spec.Kernel
+		if spec.Initrd != "" {
+			m.Config.Initrd = bundleInitrd
+			copies[bundleInitrd] = spec.Initrd
+		}
+	} else if spec.OS == OSLinux {
+		m.EFIVariableStore = bundleEFIVariableStore
+		if spec.EFIVariableStore != "" {
+			copies[bundleEFIVariableStore] = spec.EFIVariableStore
+		}
+	}
+	if spec.AuxiliaryStorage != "" {
+		m.AuxiliaryStorage = bundleAuxiliaryStorage
+		copies[bundleAuxiliaryStorage] = spec.AuxiliaryStorage
+	}
+	for i, d := range spec.Disks {
+		name := "disk" + strconv.Itoa(i) + ".img"
+		size := int64(d.Size)
+		if fi, err := os.Stat(d.Path); err == nil {
+			size = fi.Size()
+			copies[name] = d.Path
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		} else if size == 0 {
+			return nil, fmt.Errorf("%w: disk %q does not exist and has no size", ErrInvalidSpec, d.Path)
+		}
+		m.Disks = append(m.Disks, bundle.Disk{Path: name, Size: size, ReadOnly: d.ReadOnly})
+	}
+	for _, n := range spec.Networks {
+		mac := n.MACAddress
+		if mac == "" {
+			var err error
+			if mac, err = NewMACAddress(); err != nil {
+				return nil, err
+			}
+		}
+		m.MACAddresses = append(m.MACAddresses, mac)
+	}
+
+	b, err := bundle.Create(dir, m)
+	if err != nil {
+		return nil, err
+	}
+	for name, src := range copies {
+		if err := fileutil.CopySparse(b.Path(name), src); err != nil {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("failed to copy %s: %w", src, err)
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,76 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package machine_test
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+func TestCreateBundle(t *testing.T) {
+	src := t.TempDir()
+	kernel := filepath.Join(src, "vmlinuz")
+	if err := os.WriteFile(kernel, []byte("kernel"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	disk := filepath.Join(src, "root.img")
+	content := append(make([]byte, 3<<20), "root"...)
+	if err := os.WriteFile(disk, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	spec := &machine.Spec{
+		Name:        "debian",
+		Memory:      machine.GiB,
+		Kernel:      kernel,
+		CommandLine: "console=hvc0",
+		Disks: []machine.Disk{
+			{Path: disk},
+			{Path: filepath.Join(src, "data.img"), Size: 16 * machine.MiB},
+		},
+		Networks: []machine.Network{{}, {MACAddress: "52:54:00:12:34:56"}},
+	}
+	dir := filepath.Join(t.TempDir(), "debian")
+	b, err := machine.CreateBundle(dir, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := machine.SpecFromBundle(b)
+	if got.Name != "debian" || got.CPUs != machine.DefaultCPUs || got.Memory != machine.GiB || !got.Vsock {
+		t.Fatalf("unexpected spec %+v", got)
+	}
+	if b, err := os.ReadFile(got.Kernel); err != nil || string(b) != "kernel" {
+		t.Fatalf("want the copied kernel but got %q, %v", b, err)
+	}
+	if len(got.Disks) != 2 {
+		t.Fatalf("want 2 disks but got %d", len(got.Disks))
+	}
+	if b, err := os.ReadFile(got.Disks[0].Path); err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("want the copied disk image but got %d bytes, %v", len(b), err)
+	}
+	if fi, err := os.Stat(got.Disks[1].Path); err != nil || fi.Size() != int64(16*machine.MiB) {
+		t.Fatalf("want the created disk image but got %v", err)
+	}
+	if len(got.Networks) != 2 || got.Networks[0].MACAddress == "" || got.Networks[1].MACAddress != "52:54:00:12:34:56" {
+		t.Fatalf("unexpected networks %+v", got.Networks)
+	}
+	if err := got.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := machine.CreateBundle(dir, spec); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("want fs.ErrExist but got %v", err)
+	}
+	spec.Name = "nosize"
+	spec.Disks = []machine.Disk{{Path: filepath.Join(src, "missing.img")}}
+	if _, err := machine.CreateBundle(filepath.Join(t.TempDir(), "nosize"), spec); !errors.Is(err, machine.ErrInvalidSpec) {
+		t.Fatalf("want ErrInvalidSpec but got %v", err)
+	}
+}
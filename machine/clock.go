@@ -0,0 +1,20 @@
+package machine
+
+import "time"
+
+// Clock is the source of the time of the tools which wait for machines, so that
+// they can be tested with a fake clock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After returns the channel which receives the time after d.
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the Clock of the system time.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -0,0 +1,8 @@
+package ephemeral
+
+import (
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/vzmachine"
+)
+
+var defaultBackend machine.Backend = vzmachine.Backend
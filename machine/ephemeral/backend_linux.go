@@ -0,0 +1,7 @@
+package ephemeral
+
+import "github.com/Code-Hex/vz/v3/machine"
+
+// defaultBackend is nil because Virtualization.framework is not available, so Run
+// requires WithBackend.
+var defaultBackend machine.Backend
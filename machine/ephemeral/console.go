@@ -0,0 +1,144 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package ephemeral
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+// consoleExec runs the command by the shell on the console of m and returns its
+// exit code. The output of the command is written to stdout, and ready is called
+// when the shell starts running the command. bootCtx bounds the time to wait for
+// the shell, and ctx bounds the whole.
+//
+// When it gives up, the reader of the console is interrupted by the read deadline
+// of the console, or by closing m if the console has no deadline, and it returns
+// after the reader, so that stdout is not written after it.
+//
+// The output is delimited by the markers which the shell prints around the
+// command. They are printed from two words, so that the echo of the command line
+// does not match them.
+func consoleExec(ctx, bootCtx context.Context, m machine.Consoler, cmd, env []string, stdout io.Writer, ready func()) (int, error) {
+	console := m.Console()
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return -1, err
+	}
+	id := hex.EncodeToString(nonce[:])
+	begin, end := "__vz_begin_"+id, "__vz_end_"+id
+	line := shellQuote(cmd)
+	if len(env) > 0 {
+		line = "env " + shellQuote(env) + " " + line
+	}
+	script := fmt.Sprintf("printf '%%s%%s\\n' __vz_begin_ %s; %s; printf '\\n%%s%%s:%%d\\n' __vz_end_ %s $?\n", id, line, id)
+	if _, err := io.WriteString(console, script); err != nil {
+		return -1, fmt.Errorf("ephemeral: failed to write to the console: %w", err)
+	}
+
+	type result struct {
+		code int
+		err  error
+	}
+	started := make(chan struct{})
+	done := make(chan result, 1)
+	go func() {
+		code, err := scanOutput(console, begin, end, stdout, func() {
+			ready()
+			close(started)
+		})
+		done <- result{code: code, err: err}
+	}()
+	abandon := func() {
+		if d, ok := console.(readDeadliner); ok && d.SetReadDeadline(time.Now()) == nil {
+			<-done
+			d.SetReadDeadline(time.Time{})
+			return
+		}
+		if c, ok := m.(io.Closer); ok {
+			c.Close()
+			<-done
+		}
+	}
+	select {
+	case <-started:
+	case r := <-done:
+		return r.code, r.err
+	case <-bootCtx.Done():
+		abandon()
+		return -1, fmt.Errorf("ephemeral: the shell on the console is not ready: %w", bootCtx.Err())
+	}
+	select {
+	case r := <-done:
+		return r.code, r.err
+	case <-ctx.Done():
+		abandon()
+		return -1, ctx.Err()
+	}
+}
+
+// readDeadliner is a console whose reads can be interrupted such as
+// console.Stream.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// scanOutput reads the console until the end marker, and writes the lines between
+// the markers to stdout.
+func scanOutput(console io.Reader, begin, end string, stdout io.Writer, started func()) (int, error) {
+	r := bufio.NewReader(console)
+	inside := false
+	// The newline of the last line is written with the next line, because the one
+	// before the end marker is printed by the script.
+	pending := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return -1, fmt.Errorf("ephemeral: failed to read the console: %w", err)
+		}
+		// The terminal of the guest translates "\n" into "\r\n".
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if !inside {
+			if line == begin {
+				inside = true
+				started()
+			}
+			continue
+		}
+		if code, ok := strings.CutPrefix(line, end+":"); ok {
+			n, err := strconv.Atoi(code)
+			if err != nil {
+				return -1, fmt.Errorf("ephemeral: invalid exit code %q", code)
+			}
+			return n, nil
+		}
+		if pending {
+			if _, err := io.WriteString(stdout, "\n"); err != nil {
+				return -1, err
+			}
+		}
+		if _, err := io.WriteString(stdout, line); err != nil {
+			return -1, err
+		}
+		pending = true
+	}
+}
+
+// shellQuote quotes the words for the POSIX shell.
+func shellQuote(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = "'" + strings.ReplaceAll(w, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,314 @@
+//go:build darwin || linux
+// +build darwin linux
+
+// Package ephemeral runs a command in a fresh Linux machine which is thrown away
+// afterwards:
+//
+//	r, err := ephemeral.Run(ctx, spec, []string{"uname", "-a"})
+//	if err != nil {
+//		return err
+//	}
+//	fmt.Printf("%s(exit %d in %s)\n", r.Stdout, r.ExitCode, r.Duration)
+//
+// The machine boots with LinuxBootLoader, and the command is run by the guest
+// agent (cmd/vzagent) over virtio-vsock, or by the shell on the serial console
+// with WithTransport(TransportConsole).
+//
+// The writable disk images of the spec are copied to a temporary directory, so
+// that the command does not change them, and the copies are removed together with
+// the machine. Each machine has a new machine identifier and new MAC addresses.
+package ephemeral
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/internal/fileutil"
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/agent"
+)
+
+// Transport is the way to run the command in the guest.
+type Transport string
+
+const (
+	// TransportAgent runs the command by the guest agent, which separates stdout
+	// and stderr.
+	TransportAgent Transport = "agent"
+	// TransportConsole runs the command by the shell on the serial console, for
+	// the guests which run a shell there such as with "init=/bin/sh". stdout and
+	// stderr are merged, and the messages of the kernel on the console may be
+	// mixed in the output.
+	TransportConsole Transport = "console"
+)
+
+// stopTimeout is the time to wait for the machine to stop after Stop.
+const stopTimeout = 10 * time.Second
+
+// Result is the result of Run.
+type Result struct {
+	// ExitCode is the exit code of the command, or -1 if it has not exited.
+	ExitCode int `json:"exitCode"`
+	// Stdout is the output of the command.
+	Stdout []byte `json:"stdout"`
+	// Stderr is the error output of the command. It is empty with
+	// TransportConsole.
+	Stderr []byte `json:"stderr"`
+	// Transport is the transport which has run the command.
+	Transport Transport `json:"transport"`
+
+	// StartedAt is the time when Run has started.
+	StartedAt time.Time `json:"startedAt"`
+	// BootDuration is the time from starting the machine until the guest is ready
+	// to run the command.
+	BootDuration time.Duration `json:"bootDuration"`
+	// ExecDuration is the time to run the command.
+	ExecDuration time.Duration `json:"execDuration"`
+	// TeardownDuration is the time to stop the machine and to remove its files.
+	TeardownDuration time.Duration `json:"teardownDuration"`
+	// Duration is the whole time of Run.
+	Duration time.Duration `json:"duration"`
+}
+
+// Success reports whether the command has exited with 0.
+func (r *Result) Success() bool {
+	return r.ExitCode == 0
+}
+
+type options struct {
+	backend     machine.Backend
+	transport   Transport
+	port        uint32
+	env         []string
+	stdout      io.Writer
+	stderr      io.Writer
+	bootTimeout time.Duration
+}
+
+// Option is an option for Run.
+type Option func(*options)
+
+// WithBackend sets the backend which creates the machine. The default is
+// vzmachine.Backend on macOS, and there is no default on the other platforms.
+func WithBackend(backend machine.Backend) Option {
+	return func(o *options) {
+		o.backend = backend
+	}
+}
+
+// WithTransport sets the transport which runs the command. The default is
+// TransportAgent.
+func WithTransport(t Transport) Option {
+	return func(o *options) {
+		o.transport = t
+	}
+}
+
+// WithAgentPort sets the virtio-vsock port of the guest agent. The default is
+// agent.DefaultPort.
+func WithAgentPort(port uint32) Option {
+	return func(o *options) {
+		o.port = port
+	}
+}
+
+// WithEnv adds the environment variables of the command such as "KEY=value".
+func WithEnv(env ...string) Option {
+	return func(o *options) {
+		o.env = append(o.env, env...)
+	}
+}
+
+// WithStdout streams the output of the command to w as it is received, in
+// addition to Result.Stdout.
+func WithStdout(w io.Writer) Option {
+	return func(o *options) {
+		o.stdout = w
+	}
+}
+
+// WithStderr streams the error output of the command to w as it is received, in
+// addition to Result.Stderr.
+func WithStderr(w io.Writer) Option {
+	return func(o *options) {
+		o.stderr = w
+	}
+}
+
+// WithBootTimeout sets the time to wait for the machine to start and the guest to
+// be ready. The default is 2 minutes.
+func WithBootTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.bootTimeout = d
+	}
+}
+
+// Run boots a fresh machine of the spec, runs cmd in it, and stops and removes the
+// machine. The spec must have a Linux kernel.
+//
+// A non-zero exit code is not an error. The error is returned when the command
+// cannot be run, such as when the guest is not ready within the boot timeout or
+// ctx is done, and the result has the timing data until then.
+func Run(ctx context.Context, spec *machine.Spec, cmd []string, opts ...Option) (*Result, error) {
+	o := &options{
+		backend:     defaultBackend,
+		transport:   TransportAgent,
+		port:        agent.DefaultPort,
+		bootTimeout: 2 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	r := &Result{ExitCode: -1, Transport: o.transport, StartedAt: time.Now()}
+	defer func() {
+		r.Duration = time.Since(r.StartedAt)
+	}()
+	if o.backend == nil {
+		return r, fmt.Errorf("%w: running machines requires macOS", machine.ErrUnsupported)
+	}
+	if len(cmd) == 0 {
+		return r, errors.New("ephemeral: no command")
+	}
+	if o.transport != TransportAgent && o.transport != TransportConsole {
+		return r, fmt.Errorf("ephemeral: unknown transport %q", o.transport)
+	}
+
+	dir, err := os.MkdirTemp("", "vzrun")
+	if err != nil {
+		return r, err
+	}
+	spec, err = prepare(spec, dir, o.transport)
+	if err == nil {
+		var m machine.Machine
+		m, err = o.backend.NewMachine(spec)
+		if err == nil {
+			err = run(ctx, m, cmd, o, r)
+			start := time.Now()
+			if stopErr := machine.StopAndWait(m, stopTimeout); stopErr != nil && err == nil {
+				err = fmt.Errorf("ephemeral: failed to stop the machine: %w", stopErr)
+			}
+			// The machine which holds resources such as its console is closed
+			// like machine.Manager.Remove does.
+			if c, ok := m.(io.Closer); ok {
+				if closeErr := c.Close(); closeErr != nil && err == nil {
+					err = fmt.Errorf("ephemeral: failed to close the machine: %w", closeErr)
+				}
+			}
+			r.TeardownDuration = time.Since(start)
+		}
+	}
+	start := time.Now()
+	if rmErr := os.RemoveAll(dir); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	r.TeardownDuration += time.Since(start)
+	return r, err
+}
+
+// prepare returns the spec of the fresh machine whose writable files are copied to
+// dir.
+func prepare(spec *machine.Spec, dir string, t Transport) (*machine.Spec, error) {
+	spec = spec.WithDefaults()
+	if spec.OS != machine.OSLinux || spec.Kernel == "" {
+		return nil, fmt.Errorf("%w: ephemeral machines require a Linux kernel", machine.ErrInvalidSpec)
+	}
+	if spec.Name == "" {
+		spec.Name = "ephemeral"
+	}
+	spec.MachineIdentifier = nil
+	for i := range spec.Networks {
+		spec.Networks[i].MACAddress = ""
+	}
+	if t == TransportAgent {
+		spec.Vsock = true
+	}
+	for i, d := range spec.Disks {
+		if d.ReadOnly {
+			continue
+		}
+		path := filepath.Join(dir, fmt.Sprintf("disk%d%s", i, filepath.Ext(d.Path)))
+		if _, err := os.Stat(d.Path); err == nil {
+			if err := fileutil.Clone(path, d.Path); err != nil {
+				return nil, fmt.Errorf("failed to copy %s: %w", d.Path, err)
+			}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		// The disk which does not exist is created by the backend.
+		spec.Disks[i].Path = path
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// run boots the machine and runs the command.
+func run(ctx context.Context, m machine.Machine, cmd []string, o *options, r *Result) error {
+	var stdout, stderr bytes.Buffer
+	out := io.Writer(&stdout)
+	if o.stdout != nil {
+		out = io.MultiWriter(&stdout, o.stdout)
+	}
+	errOut := io.Writer(&stderr)
+	if o.stderr != nil {
+		errOut = io.MultiWriter(&stderr, o.stderr)
+	}
+	defer func() {
+		r.Stdout, r.Stderr = stdout.Bytes(), stderr.Bytes()
+	}()
+
+	// The boot timeout covers the machine stuck in starting too.
+	bootCtx, cancel := context.WithTimeout(ctx, o.bootTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := m.Start(); err != nil {
+		return fmt.Errorf("ephemeral: failed to start the machine: %w", err)
+	}
+	if err := machine.WaitRunning(bootCtx, m); err != nil {
+		if errors.Is(err, machine.ErrInvalidState) {
+			return err
+		}
+		return fmt.Errorf("ephemeral: the machine is still starting: %w", err)
+	}
+	var execStart time.Time
+	ready := func() {
+		execStart = time.Now()
+		r.BootDuration = execStart.Sub(start)
+	}
+
+	var err error
+	switch o.transport {
+	case TransportAgent:
+		d, ok := m.(machine.VsockDialer)
+		if !ok {
+			return fmt.Errorf("%w: the machine has no virtio-vsock device", machine.ErrUnsupported)
+		}
+		client := agent.NewMachineClient(d, o.port)
+		if err := machine.WaitReady(bootCtx, m, client.Ping); err != nil {
+			if errors.Is(err, machine.ErrInvalidState) {
+				return err
+			}
+			return fmt.Errorf("ephemeral: the guest agent is not ready: %w", err)
+		}
+		ready()
+		r.ExitCode, err = client.Exec(ctx, &agent.Command{Args: cmd, Env: o.env, Stdout: out, Stderr: errOut})
+	case TransportConsole:
+		c, ok := m.(machine.Consoler)
+		if !ok {
+			return fmt.Errorf("%w: the machine has no console", machine.ErrUnsupported)
+		}
+		r.ExitCode, err = consoleExec(ctx, bootCtx, c, cmd, o.env, out, ready)
+	}
+	if !execStart.IsZero() {
+		r.ExecDuration = time.Since(execStart)
+	}
+	return err
+}
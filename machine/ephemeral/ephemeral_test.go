@@ -0,0 +1,223 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package ephemeral_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/agent"
+	"github.com/Code-Hex/vz/v3/machine/ephemeral"
+	"github.com/Code-Hex/vz/v3/machine/fake"
+)
+
+// withAgent runs the guest agent of the fake machines, which runs the commands on
+// the host.
+func withAgent(t *testing.T) *fake.Backend {
+	return fake.NewBackend(func(m *fake.Machine) {
+		ln, err := m.ListenVsock(agent.DefaultPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go (&agent.Server{Exec: agent.ExecCommand}).Serve(ln)
+	})
+}
+
+// withShell runs a shell on the consoles of the fake machines, which echoes the
+// input and translates the newlines of the output like a terminal.
+func withShell(t *testing.T) *fake.Backend {
+	return fake.NewBackend(func(m *fake.Machine) {
+		go func() {
+			guest := m.Guest()
+			tty := &crlfWriter{w: guest}
+			r := bufio.NewReader(guest)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				tty.Write([]byte(line))
+				cmd := exec.Command("sh", "-c", line)
+				cmd.Stdout, cmd.Stderr = tty, tty
+				cmd.Run()
+			}
+		}()
+	})
+}
+
+// starting is a machine which is stuck in starting.
+type starting struct {
+	*fake.Machine
+}
+
+func (m *starting) State() machine.State {
+	if s := m.Machine.State(); s != machine.StateRunning {
+		return s
+	}
+	return machine.StateStarting
+}
+
+type crlfWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *crlfWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func TestRunAgent(t *testing.T) {
+	backend := withAgent(t)
+	spec := fake.NewSpec(t, "runner")
+	var stdout bytes.Buffer
+	r, err := ephemeral.Run(context.Background(), spec,
+		[]string{"sh", "-c", "echo out; echo err >&2; echo $GREETING; exit 3"},
+		ephemeral.WithBackend(backend),
+		ephemeral.WithEnv("GREETING=hello"),
+		ephemeral.WithStdout(&stdout),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ExitCode != 3 || r.Success() || string(r.Stdout) != "out\nhello\n" || string(r.Stderr) != "err\n" {
+		t.Fatalf("unexpected result %d, %q, %q", r.ExitCode, r.Stdout, r.Stderr)
+	}
+	if stdout.String() != "out\nhello\n" {
+		t.Fatalf("want the output streamed but got %q", stdout.String())
+	}
+	if r.Transport != ephemeral.TransportAgent || r.StartedAt.IsZero() || r.Duration < r.BootDuration+r.ExecDuration+r.TeardownDuration {
+		t.Fatalf("unexpected timing %+v", r)
+	}
+
+	m := backend.Machine("runner")
+	if s := m.State(); s != machine.StateStopped {
+		t.Fatalf("want the machine stopped but got %s", s)
+	}
+	s := m.Spec()
+	if !s.Vsock || s.MachineIdentifier != nil || s.Networks[0].MACAddress != "" {
+		t.Fatalf("want a fresh machine with virtio-vsock but got %+v", s)
+	}
+	if s.Disks[0].Path == spec.Disks[0].Path || s.Disks[1].Path != "/base.img" {
+		t.Fatalf("want the copy of the writable disk but got %+v", s.Disks)
+	}
+	if _, err := os.Stat(filepath.Dir(s.Disks[0].Path)); !os.IsNotExist(err) {
+		t.Fatalf("want the temporary disks removed but got %v", err)
+	}
+	if b, err := os.ReadFile(spec.Disks[0].Path); err != nil || string(b) != "root" {
+		t.Fatalf("want the disk untouched but got %q, %v", b, err)
+	}
+}
+
+func TestRunConsole(t *testing.T) {
+	tests := []struct {
+		cmd    []string
+		code   int
+		stdout string
+	}{
+		{cmd: []string{"sh", "-c", `echo "it's $GREETING"; echo err >&2; exit 2`}, code: 2, stdout: "it's me\nerr\n"},
+		{cmd: []string{"printf", "no newline"}, stdout: "no newline"},
+		{cmd: []string{"true"}, stdout: ""},
+	}
+	for _, tt := range tests {
+		backend := withShell(t)
+		r, err := ephemeral.Run(context.Background(), fake.NewSpec(t, "runner"), tt.cmd,
+			ephemeral.WithBackend(backend),
+			ephemeral.WithTransport(ephemeral.TransportConsole),
+			ephemeral.WithEnv("GREETING=me"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.ExitCode != tt.code || string(r.Stdout) != tt.stdout || len(r.Stderr) != 0 {
+			t.Fatalf("%v: want %d, %q but got %d, %q, %q", tt.cmd, tt.code, tt.stdout, r.ExitCode, r.Stdout, r.Stderr)
+		}
+		if s := backend.Machine("runner").State(); s != machine.StateStopped {
+			t.Fatalf("want the machine stopped but got %s", s)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	ctx := context.Background()
+
+	// The guest without the agent is not ready.
+	backend := fake.NewBackend()
+	start := time.Now()
+	r, err := ephemeral.Run(ctx, fake.NewSpec(t, "runner"), []string{"true"},
+		ephemeral.WithBackend(backend),
+		ephemeral.WithBootTimeout(200*time.Millisecond),
+	)
+	if err == nil || !strings.Contains(err.Error(), "not ready") || time.Since(start) > 5*time.Second {
+		t.Fatalf("want the boot timeout but got %v", err)
+	}
+	if r.ExitCode != -1 || r.ExecDuration != 0 {
+		t.Fatalf("unexpected result %+v", r)
+	}
+	m := backend.Machine("runner")
+	if s := m.State(); s != machine.StateStopped {
+		t.Fatalf("want the machine stopped but got %s", s)
+	}
+	if _, err := os.Stat(filepath.Dir(m.Spec().Disks[0].Path)); !os.IsNotExist(err) {
+		t.Fatalf("want the temporary disks removed but got %v", err)
+	}
+
+	// The machine stuck in starting is bounded by the boot timeout too.
+	stuck := machine.BackendFunc(func(spec *machine.Spec) (machine.Machine, error) {
+		return &starting{fake.New(spec)}, nil
+	})
+	start = time.Now()
+	_, err = ephemeral.Run(ctx, fake.NewSpec(t, "runner"), []string{"true"},
+		ephemeral.WithBackend(stuck),
+		ephemeral.WithBootTimeout(200*time.Millisecond),
+	)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "still starting") || time.Since(start) > 5*time.Second {
+		t.Fatalf("want the boot timeout but got %v", err)
+	}
+
+	// The reader of the console without the shell is stopped by closing the
+	// console.
+	backend = fake.NewBackend(func(m *fake.Machine) {
+		go io.Copy(io.Discard, m.Guest())
+	})
+	_, err = ephemeral.Run(ctx, fake.NewSpec(t, "runner"), []string{"true"},
+		ephemeral.WithBackend(backend),
+		ephemeral.WithTransport(ephemeral.TransportConsole),
+		ephemeral.WithBootTimeout(200*time.Millisecond),
+	)
+	if err == nil || !strings.Contains(err.Error(), "not ready") {
+		t.Fatalf("want the boot timeout but got %v", err)
+	}
+	if _, err := backend.Machine("runner").Console().Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("want the console closed but got %v", err)
+	}
+
+	noKernel := fake.NewSpec(t, "runner")
+	noKernel.Kernel = ""
+	if _, err := ephemeral.Run(ctx, noKernel, []string{"true"}, ephemeral.WithBackend(withAgent(t))); !errors.Is(err, machine.ErrInvalidSpec) {
+		t.Fatalf("want ErrInvalidSpec but got %v", err)
+	}
+	if _, err := ephemeral.Run(ctx, fake.NewSpec(t, "runner"), []string{"true"}, ephemeral.WithBackend(nil)); !errors.Is(err, machine.ErrUnsupported) {
+		t.Fatalf("want ErrUnsupported but got %v", err)
+	}
+	if _, err := ephemeral.Run(ctx, fake.NewSpec(t, "runner"), nil, ephemeral.WithBackend(withAgent(t))); err == nil {
+		t.Fatal("want an error without the command")
+	}
+}
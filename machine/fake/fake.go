@@ -0,0 +1,411 @@
+// Package fake provides fake machines which follow the state transitions of
+// vz.VirtualMachine, so that the tools built on the machine package can be tested
+// without Virtualization.framework.
+package fake
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	infinity "github.com/Code-Hex/go-infinity-channel"
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+// Operations which can fail with FailNext.
+const (
+	OpStart       = "start"
+	OpPause       = "pause"
+	OpResume      = "resume"
+	OpRequestStop = "requestStop"
+	OpStop        = "stop"
+	OpSave        = "save"
+	OpRestore     = "restore"
+	OpClose       = "close"
+)
+
+// Machine is a fake machine. It implements machine.SaveRestoreValidator,
+// machine.Consoler, machine.VsockDialer, machine.MemoryBalloon,
+// machine.DeviceNotifier and io.Closer.
+type Machine struct {
+	spec   *machine.Spec
+	notify *infinity.Channel[machine.State]
+
+	mu           sync.Mutex
+	state        machine.State
+	failures     map[string]error
+	ignoreStop   bool
+	stopRequests int
+	saveRestore  error
+	listeners    map[uint32]*vsockListener
+	balloon      machine.Size
+	deviceSubs   map[*infinity.Channel[machine.DeviceEvent]]struct{}
+
+	host  *pipeConsole
+	guest *pipeConsole
+}
+
+var (
+	_ machine.SaveRestoreValidator = (*Machine)(nil)
+	_ machine.Consoler             = (*Machine)(nil)
+	_ machine.VsockDialer          = (*Machine)(nil)
+	_ machine.MemoryBalloon        = (*Machine)(nil)
+	_ machine.DeviceNotifier       = (*Machine)(nil)
+	_ io.Closer                    = (*Machine)(nil)
+)
+
+// New creates a new stopped fake machine for the spec. The target size of the
+// memory balloon is the memory of the spec.
+func New(spec *machine.Spec) *Machine {
+	toGuestR, toGuestW := io.Pipe()
+	toHostR, toHostW := io.Pipe()
+	return &Machine{
+		spec:       spec.Clone(),
+		notify:     infinity.NewChannel[machine.State](),
+		failures:   make(map[string]error),
+		listeners:  make(map[uint32]*vsockListener),
+		balloon:    spec.WithDefaults().Memory,
+		deviceSubs: make(map[*infinity.Channel[machine.DeviceEvent]]struct{}),
+		host:       &pipeConsole{r: toHostR, w: toGuestW},
+		guest:      &pipeConsole{r: toGuestR, w: toHostW},
+	}
+}
+
+// Spec returns the spec of the machine.
+func (m *Machine) Spec() *machine.Spec {
+	return m.spec.Clone()
+}
+
+// State returns the current state.
+func (m *Machine) State() machine.State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// StateChangedNotify returns the channel which receives every state transition.
+func (m *Machine) StateChangedNotify() <-chan machine.State {
+	return m.notify.Out()
+}
+
+// setState changes the state and notifies it. m.mu must be held.
+func (m *Machine) setState(states ...machine.State) {
+	for _, s := range states {
+		m.state = s
+		m.notify.In() <- s
+	}
+}
+
+// begin checks the state for the operation and returns the error set by FailNext.
+// m.mu must be held.
+func (m *Machine) begin(op string, allowed ...machine.State) error {
+	ok := false
+	for _, s := range allowed {
+		ok = ok || m.state == s
+	}
+	if !ok {
+		return fmt.Errorf("%w: cannot %s the %s machine", machine.ErrInvalidState, op, m.state)
+	}
+	if err, ok := m.failures[op]; ok {
+		delete(m.failures, op)
+		return err
+	}
+	return nil
+}
+
+// Start transitions the machine to starting and then running.
+func (m *Machine) Start() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(OpStart, machine.StateStopped, machine.StateError); err != nil {
+		return err
+	}
+	m.setState(machine.StateStarting, machine.StateRunning)
+	return nil
+}
+
+// Pause transitions the machine to pausing and then paused.
+func (m *Machine) Pause() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(OpPause, machine.StateRunning); err != nil {
+		return err
+	}
+	m.setState(machine.StatePausing, machine.StatePaused)
+	return nil
+}
+
+// Resume transitions the machine to resuming and then running.
+func (m *Machine) Resume() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(OpResume, machine.StatePaused); err != nil {
+		return err
+	}
+	m.setState(machine.StateResuming, machine.StateRunning)
+	return nil
+}
+
+// RequestStop transitions the running machine to stopping and then stopped, as if
+// the guest has shut down, unless IgnoreStopRequests is set.
+func (m *Machine) RequestStop() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(OpRequestStop, machine.StateRunning); err != nil {
+		return false, err
+	}
+	m.stopRequests++
+	if !m.ignoreStop {
+		m.setState(machine.StateStopping, machine.StateStopped)
+	}
+	return true, nil
+}
+
+// Stop stops the machine immediately.
+func (m *Machine) Stop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(OpStop, machine.StateRunning, machine.StatePaused, machine.StateStarting, machine.StateStopping); err != nil {
+		return err
+	}
+	m.setState(machine.StateStopped)
+	return nil
+}
+
+// savedState is the content of the files written by SaveMachineStateToPath. It
+// depends on the devices of the machine but not on their identities such as the
+// paths and the MAC addresses, so that a state can be restored to the clones of the
+// machine.
+func (m *Machine) savedState() []byte {
+	s := m.spec.WithDefaults()
+	return fmt.Appendf(nil, "fake machine state: os=%s cpus=%d memory=%d disks=%d networks=%d vsock=%t\n",
+		s.OS, s.CPUs, s.Memory, len(s.Disks), len(s.Networks), s.Vsock)
+}
+
+// SaveMachineStateToPath writes a file to path which can be restored by
+// RestoreMachineStateFromURL of the machines of the same devices.
+func (m *Machine) SaveMachineStateToPath(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.saveRestore != nil {
+		return m.saveRestore
+	}
+	if err := m.begin(OpSave, machine.StatePaused); err != nil {
+		return err
+	}
+	m.setState(machine.StateSaving)
+	defer m.setState(machine.StatePaused)
+	return os.WriteFile(path, m.savedState(), 0o600)
+}
+
+// RestoreMachineStateFromURL restores the state saved by SaveMachineStateToPath.
+// The machine is paused after it is restored.
+func (m *Machine) RestoreMachineStateFromURL(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.saveRestore != nil {
+		return m.saveRestore
+	}
+	if err := m.begin(OpRestore, machine.StateStopped); err != nil {
+		return err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b, m.savedState()) {
+		return fmt.Errorf("%s is not a saved state of the devices of %s", path, m.spec.Name)
+	}
+	m.setState(machine.StateRestoring, machine.StatePaused)
+	return nil
+}
+
+// ValidateSaveRestoreSupport returns the error set by SetSaveRestoreSupport.
+func (m *Machine) ValidateSaveRestoreSupport() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.saveRestore
+}
+
+// SetSaveRestoreSupport makes ValidateSaveRestoreSupport, SaveMachineStateToPath
+// and RestoreMachineStateFromURL fail with err, like a configuration which cannot
+// be saved. nil supports them again.
+func (m *Machine) SetSaveRestoreSupport(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.saveRestore = err
+}
+
+// Console returns the host side of the serial console. The data written to it is
+// read from Guest, and vice versa. Writes block until the other side reads.
+func (m *Machine) Console() io.ReadWriter {
+	return m.host
+}
+
+// Guest returns the guest side of the serial console.
+func (m *Machine) Guest() io.ReadWriter {
+	return m.guest
+}
+
+// Close closes the serial console, so that the reads from Console and Guest
+// return io.EOF. The console is closed even if the close fails by FailNext.
+func (m *Machine) Close() error {
+	m.host.w.Close()
+	m.guest.w.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err, ok := m.failures[OpClose]; ok {
+		delete(m.failures, OpClose)
+		return err
+	}
+	return nil
+}
+
+// Crash transitions the machine to the error state like an internal error of
+// Virtualization.framework.
+func (m *Machine) Crash() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setState(machine.StateError)
+}
+
+// Shutdown stops the active machine as if the guest has shut down by itself.
+func (m *Machine) Shutdown() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state.Active() {
+		m.setState(machine.StateStopped)
+	}
+}
+
+// FailNext makes the next operation op fail with err. op is one of the Op constants.
+func (m *Machine) FailNext(op string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[op] = err
+}
+
+// IgnoreStopRequests makes RequestStop succeed without stopping the machine, like a
+// guest which does not handle the power button.
+func (m *Machine) IgnoreStopRequests(ignore bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ignoreStop = ignore
+}
+
+// StopRequests returns the number of the successful calls of RequestStop.
+func (m *Machine) StopRequests() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stopRequests
+}
+
+// MemoryBalloonTargetSize returns the size set by SetMemoryBalloonTargetSize.
+func (m *Machine) MemoryBalloonTargetSize() machine.Size {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.balloon
+}
+
+// SetMemoryBalloonTargetSize sets the target size of the memory balloon.
+func (m *Machine) SetMemoryBalloonTargetSize(size machine.Size) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.balloon = size
+}
+
+// DeviceEvents returns the channel which receives the events emitted by
+// EmitDeviceEvent and the connections of DialVsock.
+func (m *Machine) DeviceEvents(ctx context.Context) <-chan machine.DeviceEvent {
+	sub := infinity.NewChannel[machine.DeviceEvent]()
+	m.mu.Lock()
+	m.deviceSubs[sub] = struct{}{}
+	m.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		m.mu.Lock()
+		delete(m.deviceSubs, sub)
+		m.mu.Unlock()
+		sub.Close()
+	}()
+	return sub.Out()
+}
+
+// EmitDeviceEvent emits the event of the device as if it has occurred in the
+// machine.
+func (m *Machine) EmitDeviceEvent(kind machine.DeviceEventKind, device string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.emitDeviceEvent(kind, device, err)
+}
+
+// emitDeviceEvent sends the event to the subscribers. m.mu must be held.
+func (m *Machine) emitDeviceEvent(kind machine.DeviceEventKind, device string, err error) {
+	ev := machine.DeviceEvent{Kind: kind, Device: device, Err: err, Time: time.Now()}
+	for sub := range m.deviceSubs {
+		sub.In() <- ev
+	}
+}
+
+type pipeConsole struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func (c *pipeConsole) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *pipeConsole) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// Backend is a machine.Backend which creates fake machines.
+type Backend struct {
+	setup []func(m *Machine)
+
+	mu       sync.Mutex
+	machines map[string]*Machine
+	err      error
+}
+
+var _ machine.Backend = (*Backend)(nil)
+
+// NewBackend creates a new Backend. The setup functions are called with each
+// machine after it is created, such as to run a fake guest on its console.
+func NewBackend(setup ...func(m *Machine)) *Backend {
+	return &Backend{setup: setup, machines: make(map[string]*Machine)}
+}
+
+// NewMachine creates a new fake machine and calls the setup functions with it. It
+// replaces the machine of the same name which has been created before.
+func (b *Backend) NewMachine(spec *machine.Spec) (machine.Machine, error) {
+	b.mu.Lock()
+	if err := b.err; err != nil {
+		b.err = nil
+		b.mu.Unlock()
+		return nil, err
+	}
+	b.mu.Unlock()
+	m := New(spec)
+	for _, setup := range b.setup {
+		setup(m)
+	}
+	b.mu.Lock()
+	b.machines[spec.Name] = m
+	b.mu.Unlock()
+	return m, nil
+}
+
+// Machine returns the last machine of the name which has been created, or nil.
+func (b *Backend) Machine(name string) *Machine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.machines[name]
+}
+
+// FailNext makes the next NewMachine fail with err.
+func (b *Backend) FailNext(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
@@ -0,0 +1,26 @@
+package fake
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+// NewSpec returns the spec of a Linux machine of the name which has a writable
+// disk with "root" in a temporary directory of tb, a read-only disk and a network
+// device. The kernel and the read-only disk do not exist.
+func NewSpec(tb testing.TB, name string) *machine.Spec {
+	tb.Helper()
+	disk := filepath.Join(tb.TempDir(), "root.img")
+	if err := os.WriteFile(disk, []byte("root"), 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	return &machine.Spec{
+		Name:     name,
+		Kernel:   "/vmlinuz",
+		Disks:    []machine.Disk{{Path: disk}, {Path: "/base.img", ReadOnly: true}},
+		Networks: []machine.Network{{MACAddress: "52:54:00:12:34:56"}},
+	}
+}
@@ -0,0 +1,91 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+// ListenVsock listens on the port of the guest, so that the connections of
+// DialVsock to the port are accepted from the returned listener. It is used to run
+// the servers of the guest such as the guest agent in tests.
+func (m *Machine) ListenVsock(port uint32) (net.Listener, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.listeners[port]; ok {
+		return nil, fmt.Errorf("fake: port %d is already in use", port)
+	}
+	l := &vsockListener{
+		m:     m,
+		port:  port,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	m.listeners[port] = l
+	return l, nil
+}
+
+// DialVsock connects to the listener of ListenVsock. The machine must be running.
+func (m *Machine) DialVsock(ctx context.Context, port uint32) (net.Conn, error) {
+	m.mu.Lock()
+	state, l := m.state, m.listeners[port]
+	m.mu.Unlock()
+	if state != machine.StateRunning {
+		return nil, fmt.Errorf("%w: cannot connect to the %s machine", machine.ErrInvalidState, state)
+	}
+	if l == nil {
+		return nil, fmt.Errorf("fake: connection refused on port %d", port)
+	}
+	host, guest := net.Pipe()
+	select {
+	case l.conns <- guest:
+		m.mu.Lock()
+		m.emitDeviceEvent(machine.DeviceVsockConnected, strconv.FormatUint(uint64(port), 10), nil)
+		m.mu.Unlock()
+		return host, nil
+	case <-l.done:
+		return nil, fmt.Errorf("fake: connection refused on port %d", port)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type vsockListener struct {
+	m     *Machine
+	port  uint32
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *vsockListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.m.mu.Lock()
+		delete(l.m.listeners, l.port)
+		l.m.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return vsockAddr(l.port)
+}
+
+type vsockAddr uint32
+
+func (a vsockAddr) Network() string { return "vsock" }
+func (a vsockAddr) String() string  { return fmt.Sprintf("3:%d", uint32(a)) }
@@ -0,0 +1,145 @@
+// Package machine provides the abstraction of virtual machines which is not tied to
+// Virtualization.framework, so that the tools built on top of it such as vzctl and
+// vzd can be tested on any platform with a fake machine.
+//
+// The machines backed by Virtualization.framework are created by the vzmachine
+// package, and the fake machines for tests are created by the fake package.
+package machine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a machine is not found.
+	ErrNotFound = errors.New("machine: not found")
+
+	// ErrExists is returned when a machine of the same name already exists.
+	ErrExists = errors.New("machine: already exists")
+
+	// ErrInvalidState is returned when an operation is not allowed in the current
+	// state of a machine.
+	ErrInvalidState = errors.New("machine: invalid state")
+
+	// ErrUnsupported is returned when a machine does not support an operation.
+	ErrUnsupported = errors.New("machine: unsupported operation")
+)
+
+// Machine is a virtual machine. The methods correspond to the ones of
+// vz.VirtualMachine.
+type Machine interface {
+	// State returns the execution state of the machine.
+	State() State
+	// StateChangedNotify returns the channel which receives the new states.
+	StateChangedNotify() <-chan State
+	// Start starts the machine.
+	Start() error
+	// Pause pauses the running machine.
+	Pause() error
+	// Resume resumes the paused machine.
+	Resume() error
+	// RequestStop requests the guest to stop, which is like pressing the power
+	// button. It returns false if the request cannot be sent.
+	RequestStop() (bool, error)
+	// Stop stops the machine immediately without the cooperation of the guest.
+	Stop() error
+}
+
+// StateSaver is a Machine which can save and restore its state.
+type StateSaver interface {
+	Machine
+	// SaveMachineStateToPath saves the state of the paused machine to path.
+	SaveMachineStateToPath(path string) error
+	// RestoreMachineStateFromURL restores the state of the stopped machine from
+	// path. The machine is paused after it is restored.
+	RestoreMachineStateFromURL(path string) error
+}
+
+// SaveRestoreValidator is a StateSaver which can tell up front whether its
+// configuration supports saving and restoring the state.
+type SaveRestoreValidator interface {
+	StateSaver
+	// ValidateSaveRestoreSupport returns an error wrapping ErrUnsupported if the
+	// state of the machine cannot be saved and restored.
+	ValidateSaveRestoreSupport() error
+}
+
+// Consoler is a Machine which has a serial console.
+type Consoler interface {
+	Machine
+	// Console returns the host side of the serial console. Data written to it goes
+	// to the guest.
+	Console() io.ReadWriter
+}
+
+// VsockDialer is a Machine which can connect to the ports of the guest over
+// virtio-vsock.
+type VsockDialer interface {
+	Machine
+	// DialVsock connects to the port of the guest.
+	DialVsock(ctx context.Context, port uint32) (net.Conn, error)
+}
+
+// MemoryBalloon is a Machine which has a memory balloon device.
+type MemoryBalloon interface {
+	Machine
+	// MemoryBalloonTargetSize returns the target size of the memory of the guest
+	// which is set to the memory balloon device.
+	MemoryBalloonTargetSize() Size
+}
+
+// DeviceEventKind is the kind of a DeviceEvent.
+type DeviceEventKind string
+
+const (
+	// DeviceNBDConnected is emitted when the NBD client of a storage device has
+	// connected or reconnected to the server. Device is the URL of the server.
+	DeviceNBDConnected DeviceEventKind = "nbdConnected"
+	// DeviceNBDError is emitted when the NBD client of a storage device has
+	// encountered an error. Device is the URL of the server.
+	DeviceNBDError DeviceEventKind = "nbdError"
+	// DeviceNetworkDisconnected is emitted when the attachment of a network device
+	// has been disconnected. Device is the index of the network device.
+	DeviceNetworkDisconnected DeviceEventKind = "networkDisconnected"
+	// DeviceVsockConnected is emitted when a virtio-vsock connection to the guest
+	// has been established. Device is the port.
+	DeviceVsockConnected DeviceEventKind = "vsockConnected"
+)
+
+// DeviceEvent is an event of a device of a machine.
+type DeviceEvent struct {
+	Kind DeviceEventKind `json:"kind"`
+	// Device identifies the device of the kind.
+	Device string `json:"device"`
+	// Err is the error of the event, if any.
+	Err  error     `json:"-"`
+	Time time.Time `json:"time"`
+}
+
+// DeviceNotifier is a Machine which reports the events of its devices.
+type DeviceNotifier interface {
+	Machine
+	// DeviceEvents returns the channel which receives the events of the devices
+	// until ctx is done. The channel is closed after ctx is done.
+	DeviceEvents(ctx context.Context) <-chan DeviceEvent
+}
+
+// Backend creates machines from specs.
+//
+// A machine which holds resources that are not released by stopping it, such as
+// the pipes of its console, implements io.Closer. Manager.Remove closes it.
+type Backend interface {
+	NewMachine(spec *Spec) (Machine, error)
+}
+
+// BackendFunc is an adapter to use a function as a Backend.
+type BackendFunc func(spec *Spec) (Machine, error)
+
+// NewMachine calls f(spec).
+func (f BackendFunc) NewMachine(spec *Spec) (Machine, error) {
+	return f(spec)
+}
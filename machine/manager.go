@@ -0,0 +1,376 @@
+package machine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	infinity "github.com/Code-Hex/go-infinity-channel"
+)
+
+// Info is the information of a machine managed by Manager.
+type Info struct {
+	Name  string `json:"name"`
+	State State  `json:"state"`
+	Spec  *Spec  `json:"spec"`
+	// StartedAt is the time when the machine has started running last time.
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+}
+
+// Event is a change of the state of a machine managed by Manager.
+type Event struct {
+	Name  string    `json:"name"`
+	State State     `json:"state"`
+	Time  time.Time `json:"time"`
+}
+
+// Manager manages named machines which are created by a Backend.
+//
+// Manager consumes StateChangedNotify of the machines it manages, so use Subscribe
+// or Wait instead of receiving from the channels directly.
+type Manager struct {
+	backend Backend
+
+	mu       sync.Mutex
+	machines map[string]*managed
+	// creating has the names of the machines which are being created by the
+	// backend outside the lock.
+	creating map[string]struct{}
+	subs     map[*infinity.Channel[Event]]struct{}
+}
+
+type managed struct {
+	spec      *Spec
+	machine   Machine
+	startedAt time.Time
+	done      chan struct{}
+}
+
+// NewManager creates a new Manager which creates machines with backend.
+func NewManager(backend Backend) *Manager {
+	return &Manager{
+		backend:  backend,
+		machines: make(map[string]*managed),
+		creating: make(map[string]struct{}),
+		subs:     make(map[*infinity.Channel[Event]]struct{}),
+	}
+}
+
+// Create creates a machine for the spec. It returns ErrExists if a machine of the
+// same name exists or is being created.
+func (m *Manager) Create(spec *Spec) (Machine, error) {
+	spec = spec.WithDefaults()
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	// The name is reserved while the backend creates the machine, which may take
+	// long to create the disks, so that the other methods are not blocked.
+	m.mu.Lock()
+	_, exists := m.machines[spec.Name]
+	_, creating := m.creating[spec.Name]
+	if exists || creating {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrExists, spec.Name)
+	}
+	m.creating[spec.Name] = struct{}{}
+	m.mu.Unlock()
+
+	vm, err := m.backend.NewMachine(spec)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.creating, spec.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create machine %q: %w", spec.Name, err)
+	}
+	m.add(spec, vm)
+	return vm, nil
+}
+
+// Add adds the machine created for the spec outside the manager, such as the one
+// restored from a snapshot. It returns ErrExists if a machine of the same name
+// exists or is being created.
+func (m *Manager) Add(spec *Spec, vm Machine) error {
+	spec = spec.WithDefaults()
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, exists := m.machines[spec.Name]
+	_, creating := m.creating[spec.Name]
+	if exists || creating {
+		return fmt.Errorf("%w: %s", ErrExists, spec.Name)
+	}
+	m.add(spec, vm)
+	return nil
+}
+
+// add adds the machine and watches its state. m.mu must be held.
+func (m *Manager) add(spec *Spec, vm Machine) {
+	e := &managed{spec: spec, machine: vm, done: make(chan struct{})}
+	m.machines[spec.Name] = e
+	go m.watch(spec.Name, e)
+}
+
+// watch records the state changes of the machine and sends them to the subscribers.
+func (m *Manager) watch(name string, e *managed) {
+	notify := e.machine.StateChangedNotify()
+	for {
+		select {
+		case <-e.done:
+			return
+		case state, ok := <-notify:
+			if !ok {
+				return
+			}
+			ev := Event{Name: name, State: state, Time: time.Now()}
+			m.mu.Lock()
+			if state == StateRunning {
+				e.startedAt = ev.Time
+			}
+			for sub := range m.subs {
+				sub.In() <- ev
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+func (m *Manager) lookup(name string) (*managed, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.machines[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return e, nil
+}
+
+// Get returns the machine of the name.
+func (m *Manager) Get(name string) (Machine, error) {
+	e, err := m.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.machine, nil
+}
+
+// Info returns the information of the machine of the name.
+func (m *Manager) Info(name string) (*Info, error) {
+	e, err := m.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.info(name, e), nil
+}
+
+func (m *Manager) info(name string, e *managed) *Info {
+	info := &Info{
+		Name:  name,
+		State: e.machine.State(),
+		Spec:  e.spec.Clone(),
+	}
+	if !e.startedAt.IsZero() && info.State.Active() {
+		t := e.startedAt
+		info.StartedAt = &t
+	}
+	return info
+}
+
+// List returns the information of the machines sorted by name.
+func (m *Manager) List() []*Info {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	infos := make([]*Info, 0, len(m.machines))
+	for name, e := range m.machines {
+		infos = append(infos, m.info(name, e))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Start starts the machine of the name.
+func (m *Manager) Start(name string) error {
+	e, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	if s := e.machine.State(); s != StateStopped && s != StateError {
+		return fmt.Errorf("%w: %s is %s", ErrInvalidState, name, s)
+	}
+	return e.machine.Start()
+}
+
+// Stop stops the machine of the name. It requests the guest to stop unless force is
+// true, in which case the machine is stopped immediately.
+func (m *Manager) Stop(name string, force bool) error {
+	e, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	if s := e.machine.State(); !s.Active() {
+		return fmt.Errorf("%w: %s is %s", ErrInvalidState, name, s)
+	}
+	if force {
+		return e.machine.Stop()
+	}
+	ok, err := e.machine.RequestStop()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s cannot be requested to stop", ErrInvalidState, name)
+	}
+	return nil
+}
+
+// Pause pauses the machine of the name.
+func (m *Manager) Pause(name string) error {
+	e, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	if s := e.machine.State(); s != StateRunning {
+		return fmt.Errorf("%w: %s is %s", ErrInvalidState, name, s)
+	}
+	return e.machine.Pause()
+}
+
+// Resume resumes the machine of the name.
+func (m *Manager) Resume(name string) error {
+	e, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	if s := e.machine.State(); s != StatePaused {
+		return fmt.Errorf("%w: %s is %s", ErrInvalidState, name, s)
+	}
+	return e.machine.Resume()
+}
+
+func (m *Manager) saver(name string) (StateSaver, error) {
+	e, err := m.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := e.machine.(StateSaver)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s cannot save its state", ErrUnsupported, name)
+	}
+	return s, nil
+}
+
+// Save saves the state of the paused machine of the name to path.
+func (m *Manager) Save(name, path string) error {
+	s, err := m.saver(name)
+	if err != nil {
+		return err
+	}
+	if state := s.State(); state != StatePaused {
+		return fmt.Errorf("%w: %s is %s", ErrInvalidState, name, state)
+	}
+	return s.SaveMachineStateToPath(path)
+}
+
+// Restore restores the state of the stopped machine of the name from path. The
+// machine is paused after it is restored.
+func (m *Manager) Restore(name, path string) error {
+	s, err := m.saver(name)
+	if err != nil {
+		return err
+	}
+	if state := s.State(); state != StateStopped {
+		return fmt.Errorf("%w: %s is %s", ErrInvalidState, name, state)
+	}
+	return s.RestoreMachineStateFromURL(path)
+}
+
+// Console returns the host side of the serial console of the machine of the name.
+func (m *Manager) Console(name string) (io.ReadWriter, error) {
+	e, err := m.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	c, ok := e.machine.(Consoler)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s has no console", ErrUnsupported, name)
+	}
+	return c.Console(), nil
+}
+
+// Remove removes the stopped machine of the name from the manager. The machine is
+// closed if it implements io.Closer.
+func (m *Manager) Remove(name string) error {
+	m.mu.Lock()
+	e, ok := m.machines[name]
+	if !ok {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if s := e.machine.State(); s.Active() {
+		m.mu.Unlock()
+		return fmt.Errorf("%w: %s is %s", ErrInvalidState, name, s)
+	}
+	close(e.done)
+	delete(m.machines, name)
+	m.mu.Unlock()
+
+	if c, ok := e.machine.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			return fmt.Errorf("failed to close machine %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Subscribe returns the channel which receives the state changes of all machines.
+// The events are never dropped even if the receiver is slow. The channel is closed
+// after ctx is done and the pending events are received.
+func (m *Manager) Subscribe(ctx context.Context) <-chan Event {
+	sub := infinity.NewChannel[Event]()
+	m.mu.Lock()
+	m.subs[sub] = struct{}{}
+	m.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		m.mu.Lock()
+		delete(m.subs, sub)
+		m.mu.Unlock()
+		sub.Close()
+	}()
+	return sub.Out()
+}
+
+// Wait waits until the machine of the name stops or fails, and returns the state.
+func (m *Manager) Wait(ctx context.Context, name string) (State, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	events := m.Subscribe(ctx)
+	defer func() {
+		cancel()
+		for range events {
+		}
+	}()
+	e, err := m.lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	if s := e.machine.State(); !s.Active() {
+		return s, nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case ev := <-events:
+			if ev.Name == name && !ev.State.Active() {
+				return ev.State, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package machine_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/fake"
+)
+
+func newManager(t *testing.T, names ...string) (*machine.Manager, *fake.Backend) {
+	t.Helper()
+	backend := fake.NewBackend()
+	m := machine.NewManager(backend)
+	for _, name := range names {
+		if _, err := m.Create(&machine.Spec{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m, backend
+}
+
+func TestManagerLifecycle(t *testing.T) {
+	m, backend := newManager(t, "vm")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events := m.Subscribe(ctx)
+
+	steps := []struct {
+		op   func() error
+		want []machine.State
+	}{
+		{
+			op:   func() error { return m.Start("vm") },
+			want: []machine.State{machine.StateStarting, machine.StateRunning},
+		},
+		{
+			op:   func() error { return m.Pause("vm") },
+			want: []machine.State{machine.StatePausing, machine.StatePaused},
+		},
+		{
+			op:   func() error { return m.Resume("vm") },
+			want: []machine.State{machine.StateResuming, machine.StateRunning},
+		},
+		{
+			op:   func() error { return m.Stop("vm", false) },
+			want: []machine.State{machine.StateStopping, machine.StateStopped},
+		},
+	}
+	for _, step := range steps {
+		if err := step.op(); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range step.want {
+			select {
+			case ev := <-events:
+				if ev.Name != "vm" || ev.State != want {
+					t.Fatalf("want %s but got %+v", want, ev)
+				}
+			case <-ctx.Done():
+				t.Fatalf("want %s but timed out", want)
+			}
+		}
+	}
+	if n := backend.Machine("vm").StopRequests(); n != 1 {
+		t.Fatalf("want 1 stop request but got %d", n)
+	}
+}
+
+func TestManagerErrors(t *testing.T) {
+	m, _ := newManager(t, "vm")
+	if _, err := m.Create(&machine.Spec{Name: "vm"}); !errors.Is(err, machine.ErrExists) {
+		t.Fatalf("want ErrExists but got %v", err)
+	}
+	if _, err := m.Create(&machine.Spec{Name: "-"}); !errors.Is(err, machine.ErrInvalidSpec) {
+		t.Fatalf("want ErrInvalidSpec but got %v", err)
+	}
+	if err := m.Start("missing"); !errors.Is(err, machine.ErrNotFound) {
+		t.Fatalf("want ErrNotFound but got %v", err)
+	}
+	for name, op := range map[string]func() error{
+		"pause":  func() error { return m.Pause("vm") },
+		"resume": func() error { return m.Resume("vm") },
+		"stop":   func() error { return m.Stop("vm", true) },
+		"save":   func() error { return m.Save("vm", filepath.Join(t.TempDir(), "state")) },
+	} {
+		if err := op(); !errors.Is(err, machine.ErrInvalidState) {
+			t.Fatalf("%s: want ErrInvalidState but got %v", name, err)
+		}
+	}
+	if err := m.Start("vm"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove("vm"); !errors.Is(err, machine.ErrInvalidState) {
+		t.Fatalf("want ErrInvalidState but got %v", err)
+	}
+	if err := m.Stop("vm", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove("vm"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Info("vm"); !errors.Is(err, machine.ErrNotFound) {
+		t.Fatalf("want ErrNotFound but got %v", err)
+	}
+}
+
+func TestManagerSaveRestore(t *testing.T) {
+	m, _ := newManager(t, "vm")
+	path := filepath.Join(t.TempDir(), "vm.state")
+	for _, op := range []func() error{
+		func() error { return m.Start("vm") },
+		func() error { return m.Pause("vm") },
+		func() error { return m.Save("vm", path) },
+		func() error { return m.Stop("vm", true) },
+		func() error { return m.Restore("vm", path) },
+	} {
+		if err := op(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	info, err := m.Info("vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State != machine.StatePaused {
+		t.Fatalf("want paused but got %s", info.State)
+	}
+}
+
+func TestManagerList(t *testing.T) {
+	m, _ := newManager(t, "b", "a", "c")
+	if err := m.Start("c"); err != nil {
+		t.Fatal(err)
+	}
+	infos := m.List()
+	if len(infos) != 3 {
+		t.Fatalf("want 3 machines but got %d", len(infos))
+	}
+	for i, want := range []string{"a", "b", "c"} {
+		if infos[i].Name != want {
+			t.Fatalf("want %s but got %s", want, infos[i].Name)
+		}
+	}
+	if infos[2].State != machine.StateRunning || infos[0].State != machine.StateStopped {
+		t.Fatalf("want running c and stopped a but got %s and %s", infos[2].State, infos[0].State)
+	}
+	if infos[0].Spec.CPUs != machine.DefaultCPUs {
+		t.Fatalf("want the default CPUs but got %d", infos[0].Spec.CPUs)
+	}
+}
+
+func TestManagerWait(t *testing.T) {
+	m, backend := newManager(t, "vm")
+	if err := m.Start("vm"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		backend.Machine("vm").Crash()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	state, err := m.Wait(ctx, "vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != machine.StateError {
+		t.Fatalf("want error but got %s", state)
+	}
+}
+
+func TestManagerCreateConcurrent(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	m := machine.NewManager(machine.BackendFunc(func(spec *machine.Spec) (machine.Machine, error) {
+		close(entered)
+		<-release
+		return fake.New(spec), nil
+	}))
+	created := make(chan error, 1)
+	go func() {
+		_, err := m.Create(&machine.Spec{Name: "slow"})
+		created <- err
+	}()
+	<-entered
+
+	// The manager is not locked while the backend creates the machine, and the
+	// name is reserved.
+	if infos := m.List(); len(infos) != 0 {
+		t.Fatalf("want no machines but got %d", len(infos))
+	}
+	if _, err := m.Create(&machine.Spec{Name: "slow"}); !errors.Is(err, machine.ErrExists) {
+		t.Fatalf("want ErrExists but got %v", err)
+	}
+	close(release)
+	if err := <-created; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Info("slow"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManagerRemoveCloses(t *testing.T) {
+	m, backend := newManager(t, "vm")
+	console, err := m.Console("vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, err := console.Read(make([]byte, 1))
+		read <- err
+	}()
+	if err := m.Remove("vm"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Fatal("want an error from the closed console")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the console is not closed by Remove")
+	}
+	if _, err := backend.Machine("vm").Guest().Write([]byte("x")); err == nil {
+		t.Fatal("want an error writing to the closed console")
+	}
+}
+
+func TestManagerAdd(t *testing.T) {
+	m, _ := newManager(t, "vm")
+	spec := &machine.Spec{Name: "added"}
+	vm := fake.New(spec.WithDefaults())
+	if err := m.Add(spec, vm); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start("added"); err != nil {
+		t.Fatal(err)
+	}
+	if state := vm.State(); state != machine.StateRunning {
+		t.Fatalf("want the added machine running but got %s", state)
+	}
+	if err := m.Add(&machine.Spec{Name: "vm"}, fake.New(&machine.Spec{Name: "vm"})); !errors.Is(err, machine.ErrExists) {
+		t.Fatalf("want ErrExists but got %v", err)
+	}
+}
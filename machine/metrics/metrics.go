@@ -0,0 +1,448 @@
+// Package metrics exports the metrics of the machines of a machine.Manager and
+// their devices in the Prometheus text exposition format, without a client
+// library:
+//
+//	c := metrics.New(manager)
+//	go c.Run(ctx)
+//	http.Handle("/metrics", c)
+//
+// The collector exports the following metrics:
+//
+//	vz_machines{state}                                         gauge
+//	vz_machine_state{machine,state}                            gauge
+//	vz_machine_state_transitions_total{machine,from,to}        counter
+//	vz_machine_operation_duration_seconds{machine,operation}   histogram
+//	vz_machine_memory_balloon_target_bytes{machine}            gauge
+//	vz_machine_nbd_reconnects_total{machine,device}            counter
+//	vz_machine_nbd_errors_total{machine,device}                counter
+//	vz_machine_vsock_connections_total{machine,port}           counter
+//	vz_machine_network_disconnects_total{machine,device}       counter
+//
+// The device metrics are collected from the machines which implement
+// machine.DeviceNotifier, and the balloon target sizes from the machines which
+// implement machine.MemoryBalloon.
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+// ContentType is the content type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the upper bounds in seconds of the buckets of the operation
+// durations.
+var DefaultBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// operations maps the transitional states to the lifecycle operations. The
+// duration of an operation is the time from entering the transitional state to
+// leaving it, whether the operation succeeds or not.
+var operations = map[machine.State]string{
+	machine.StateStarting:  "start",
+	machine.StatePausing:   "pause",
+	machine.StateResuming:  "resume",
+	machine.StateStopping:  "stop",
+	machine.StateSaving:    "save",
+	machine.StateRestoring: "restore",
+}
+
+// states are all the states of the machines in the order of the values.
+var states = []machine.State{
+	machine.StateStopped,
+	machine.StateRunning,
+	machine.StatePaused,
+	machine.StateError,
+	machine.StateStarting,
+	machine.StatePausing,
+	machine.StateResuming,
+	machine.StateStopping,
+	machine.StateSaving,
+	machine.StateRestoring,
+}
+
+// Collector collects the metrics of the machines of a machine.Manager. It is an
+// http.Handler which serves the metrics.
+//
+// Collector subscribes to the manager while Run is running. The counters and the
+// histograms of a machine are kept after it is removed from the manager, so that
+// they do not go backwards when a machine of the same name is created again.
+type Collector struct {
+	manager *machine.Manager
+	buckets []float64
+
+	mu       sync.Mutex
+	machines map[string]*machineMetrics
+}
+
+type transition struct {
+	from, to machine.State
+}
+
+type deviceKey struct {
+	kind   machine.DeviceEventKind
+	device string
+}
+
+type machineMetrics struct {
+	// machine is the instance whose device events are watched.
+	machine machine.Machine
+	cancel  context.CancelFunc
+
+	state       machine.State
+	since       time.Time
+	transitions map[transition]uint64
+	durations   map[string]*histogram
+	// devices counts the device events other than the first connection of each
+	// NBD device, which is not a reconnection.
+	devices      map[deviceKey]uint64
+	nbdConnected map[string]bool
+}
+
+type histogram struct {
+	// counts are the numbers of the observations in each bucket, and the last one
+	// is the +Inf bucket.
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	i := sort.SearchFloat64s(buckets, v)
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+// Option is an option for New.
+type Option func(*Collector)
+
+// WithBuckets sets the upper bounds in seconds of the buckets of the operation
+// durations. The default is DefaultBuckets.
+func WithBuckets(buckets []float64) Option {
+	return func(c *Collector) {
+		c.buckets = append([]float64(nil), buckets...)
+		sort.Float64s(c.buckets)
+	}
+}
+
+// New creates a new Collector of the machines of manager.
+func New(manager *machine.Manager, opts ...Option) *Collector {
+	c := &Collector{
+		manager:  manager,
+		buckets:  DefaultBuckets,
+		machines: make(map[string]*machineMetrics),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Run collects the state changes of the machines and the events of their devices
+// until ctx is done. It returns the error of ctx.
+func (c *Collector) Run(ctx context.Context) error {
+	events := c.manager.Subscribe(ctx)
+	for _, info := range c.manager.List() {
+		c.mu.Lock()
+		c.entry(info.Name).state = info.State
+		c.mu.Unlock()
+		c.watch(ctx, info.Name)
+	}
+	for ev := range events {
+		c.watch(ctx, ev.Name)
+		c.observe(ev)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range c.machines {
+		if m.cancel != nil {
+			m.cancel()
+		}
+		m.machine, m.cancel = nil, nil
+	}
+	return ctx.Err()
+}
+
+// entry returns the metrics of the machine of the name. c.mu must be held.
+func (c *Collector) entry(name string) *machineMetrics {
+	m, ok := c.machines[name]
+	if !ok {
+		m = &machineMetrics{
+			transitions:  make(map[transition]uint64),
+			durations:    make(map[string]*histogram),
+			devices:      make(map[deviceKey]uint64),
+			nbdConnected: make(map[string]bool),
+		}
+		c.machines[name] = m
+	}
+	return m
+}
+
+// observe records the state change.
+func (c *Collector) observe(ev machine.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := c.entry(ev.Name)
+	m.transitions[transition{from: m.state, to: ev.State}]++
+	if op, ok := operations[m.state]; ok && !m.since.IsZero() {
+		h, ok := m.durations[op]
+		if !ok {
+			h = &histogram{counts: make([]uint64, len(c.buckets)+1)}
+			m.durations[op] = h
+		}
+		h.observe(c.buckets, ev.Time.Sub(m.since).Seconds())
+	}
+	m.state = ev.State
+	m.since = ev.Time
+}
+
+// watch subscribes to the device events of the machine of the name if it is not
+// watched yet, which is the case when the machine has been created again.
+func (c *Collector) watch(ctx context.Context, name string) {
+	vm, err := c.manager.Get(name)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := c.entry(name)
+	if m.machine == vm {
+		return
+	}
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.machine, m.cancel = vm, nil
+	clear(m.nbdConnected)
+	n, ok := vm.(machine.DeviceNotifier)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	m.cancel = cancel
+	events := n.DeviceEvents(ctx)
+	go func() {
+		for ev := range events {
+			c.mu.Lock()
+			m.device(ev)
+			c.mu.Unlock()
+		}
+	}()
+}
+
+// device records the event of the device. c.mu must be held.
+func (m *machineMetrics) device(ev machine.DeviceEvent) {
+	if ev.Kind == machine.DeviceNBDConnected && !m.nbdConnected[ev.Device] {
+		m.nbdConnected[ev.Device] = true
+		return
+	}
+	m.devices[deviceKey{kind: ev.Kind, device: ev.Device}]++
+}
+
+// ServeHTTP serves the metrics in the text exposition format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	c.WriteTo(w)
+}
+
+// WriteTo writes the metrics to w in the text exposition format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	infos := c.manager.List()
+	balloons := make(map[string]machine.Size)
+	for _, info := range infos {
+		vm, err := c.manager.Get(info.Name)
+		if err != nil {
+			continue
+		}
+		if b, ok := vm.(machine.MemoryBalloon); ok {
+			balloons[info.Name] = b.MemoryBalloonTargetSize()
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &encoder{w: bufio.NewWriter(w)}
+
+	counts := make(map[machine.State]int)
+	for _, info := range infos {
+		counts[info.State]++
+	}
+	e.family("vz_machines", "gauge", "Number of machines in each state.")
+	for _, s := range states {
+		e.sample("vz_machines", float64(counts[s]), "state", s.String())
+	}
+
+	e.family("vz_machine_state", "gauge", "Whether the machine is in the state.")
+	for _, info := range infos {
+		for _, s := range states {
+			v := 0.0
+			if info.State == s {
+				v = 1
+			}
+			e.sample("vz_machine_state", v, "machine", info.Name, "state", s.String())
+		}
+	}
+
+	names := make([]string, 0, len(c.machines))
+	for name := range c.machines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	e.family("vz_machine_state_transitions_total", "counter", "Number of the state transitions of the machine.")
+	for _, name := range names {
+		m := c.machines[name]
+		keys := make([]transition, 0, len(m.transitions))
+		for k := range m.transitions {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].from != keys[j].from {
+				return keys[i].from < keys[j].from
+			}
+			return keys[i].to < keys[j].to
+		})
+		for _, k := range keys {
+			e.sample("vz_machine_state_transitions_total", float64(m.transitions[k]),
+				"machine", name, "from", k.from.String(), "to", k.to.String())
+		}
+	}
+
+	e.family("vz_machine_operation_duration_seconds", "histogram", "Duration of the lifecycle operations of the machine.")
+	for _, name := range names {
+		m := c.machines[name]
+		ops := make([]string, 0, len(m.durations))
+		for op := range m.durations {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		for _, op := range ops {
+			h := m.durations[op]
+			var cumulative uint64
+			for i, count := range h.counts {
+				cumulative += count
+				le := math.Inf(1)
+				if i < len(c.buckets) {
+					le = c.buckets[i]
+				}
+				e.sample("vz_machine_operation_duration_seconds_bucket", float64(cumulative),
+					"machine", name, "operation", op, "le", formatFloat(le))
+			}
+			e.sample("vz_machine_operation_duration_seconds_sum", h.sum, "machine", name, "operation", op)
+			e.sample("vz_machine_operation_duration_seconds_count", float64(h.count), "machine", name, "operation", op)
+		}
+	}
+
+	e.family("vz_machine_memory_balloon_target_bytes", "gauge", "Target size of the memory of the guest set to the memory balloon device.")
+	for _, info := range infos {
+		if size, ok := balloons[info.Name]; ok {
+			e.sample("vz_machine_memory_balloon_target_bytes", float64(size), "machine", info.Name)
+		}
+	}
+
+	for _, f := range []struct {
+		name, help, label string
+		kind              machine.DeviceEventKind
+	}{
+		{"vz_machine_nbd_reconnects_total", "Number of the reconnections of the NBD clients to the servers.", "device", machine.DeviceNBDConnected},
+		{"vz_machine_nbd_errors_total", "Number of the errors of the NBD clients.", "device", machine.DeviceNBDError},
+		{"vz_machine_vsock_connections_total", "Number of the virtio-vsock connections to the guest.", "port", machine.DeviceVsockConnected},
+		{"vz_machine_network_disconnects_total", "Number of the disconnections of the network attachments.", "device", machine.DeviceNetworkDisconnected},
+	} {
+		e.family(f.name, "counter", f.help)
+		for _, name := range names {
+			m := c.machines[name]
+			var devices []string
+			for k := range m.devices {
+				if k.kind == f.kind {
+					devices = append(devices, k.device)
+				}
+			}
+			sort.Strings(devices)
+			for _, device := range devices {
+				e.sample(f.name, float64(m.devices[deviceKey{kind: f.kind, device: device}]), "machine", name, f.label, device)
+			}
+		}
+	}
+	return e.n, e.flush()
+}
+
+// encoder writes the samples in the text exposition format.
+type encoder struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (e *encoder) write(s string) {
+	if e.err != nil {
+		return
+	}
+	n, err := e.w.WriteString(s)
+	e.n += int64(n)
+	e.err = err
+}
+
+func (e *encoder) flush() error {
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+func (e *encoder) family(name, typ, help string) {
+	e.write("# HELP " + name + " " + help + "\n")
+	e.write("# TYPE " + name + " " + typ + "\n")
+}
+
+// sample writes the sample of the labels, which are the pairs of the names and
+// the values.
+func (e *encoder) sample(name string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			b.WriteByte('{')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	if len(labels) > 0 {
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(value))
+	b.WriteByte('\n')
+	e.write(b.String())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	case v == math.Trunc(v) && math.Abs(v) < 1e15:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
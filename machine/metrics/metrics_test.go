@@ -0,0 +1,177 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/fake"
+	"github.com/Code-Hex/vz/v3/machine/metrics"
+)
+
+// waitWatched waits until c watches the devices of vm, which is after it has
+// subscribed to the state changes of the machines.
+func waitWatched(t *testing.T, c *metrics.Collector, vm *fake.Machine) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		vm.EmitDeviceEvent(machine.DeviceNetworkDisconnected, "probe", nil)
+		var buf strings.Builder
+		if _, err := c.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(buf.String(), `device="probe"`) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the collector does not watch the devices")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// scrape waits until the metrics served by c contain all the lines of want, and
+// returns the metrics.
+func scrape(t *testing.T, c *metrics.Collector, want ...string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		if ct := rec.Header().Get("Content-Type"); ct != metrics.ContentType {
+			t.Fatalf("want content type %q but got %q", metrics.ContentType, ct)
+		}
+		body := rec.Body.String()
+		missing := ""
+		for _, line := range want {
+			if !strings.Contains(body, line+"\n") {
+				missing = line
+				break
+			}
+		}
+		if missing == "" {
+			return body
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want %q in\n%s", missing, body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	backend := fake.NewBackend()
+	manager := machine.NewManager(backend)
+	if _, err := manager.Create(&machine.Spec{Name: "vm-a", Memory: 2 * machine.GiB}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Create(&machine.Spec{Name: "vm-b"}); err != nil {
+		t.Fatal(err)
+	}
+	c := metrics.New(manager, metrics.WithBuckets([]float64{1, 0.5}))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("want context.Canceled but got %v", err)
+		}
+	}()
+
+	vm := backend.Machine("vm-a")
+	waitWatched(t, c, vm)
+	scrape(t, c, `vz_machines{state="stopped"} 2`)
+	for _, op := range []func(string) error{manager.Start, manager.Pause, manager.Resume} {
+		if err := op("vm-a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scrape(t, c, `vz_machine_state{machine="vm-a",state="running"} 1`)
+
+	l, err := vm.ListenVsock(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		conn, err := vm.DialVsock(context.Background(), 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	const url = "nbd://localhost:10809/disk"
+	vm.EmitDeviceEvent(machine.DeviceNBDConnected, url, nil)
+	vm.EmitDeviceEvent(machine.DeviceNBDError, url, io.ErrUnexpectedEOF)
+	vm.EmitDeviceEvent(machine.DeviceNBDConnected, url, nil)
+	vm.EmitDeviceEvent(machine.DeviceNetworkDisconnected, "0", errors.New("reset"))
+	vm.EmitDeviceEvent(machine.DeviceNBDError, `nbd://"quoted"\`, io.EOF)
+	vm.SetMemoryBalloonTargetSize(machine.GiB)
+
+	body := scrape(t, c,
+		`vz_machines{state="running"} 1`,
+		`vz_machine_state{machine="vm-a",state="stopped"} 0`,
+		`vz_machine_state{machine="vm-b",state="stopped"} 1`,
+		`vz_machine_state_transitions_total{machine="vm-a",from="stopped",to="starting"} 1`,
+		`vz_machine_state_transitions_total{machine="vm-a",from="running",to="pausing"} 1`,
+		`vz_machine_state_transitions_total{machine="vm-a",from="resuming",to="running"} 1`,
+		`vz_machine_operation_duration_seconds_bucket{machine="vm-a",operation="start",le="0.5"} 1`,
+		`vz_machine_operation_duration_seconds_bucket{machine="vm-a",operation="start",le="+Inf"} 1`,
+		`vz_machine_operation_duration_seconds_count{machine="vm-a",operation="pause"} 1`,
+		`vz_machine_operation_duration_seconds_count{machine="vm-a",operation="resume"} 1`,
+		`vz_machine_memory_balloon_target_bytes{machine="vm-a"} 1073741824`,
+		`vz_machine_memory_balloon_target_bytes{machine="vm-b"} 2147483648`,
+		`vz_machine_nbd_reconnects_total{machine="vm-a",device="nbd://localhost:10809/disk"} 1`,
+		`vz_machine_nbd_errors_total{machine="vm-a",device="nbd://localhost:10809/disk"} 1`,
+		`vz_machine_vsock_connections_total{machine="vm-a",port="1024"} 2`,
+		`vz_machine_nbd_errors_total{machine="vm-a",device="nbd://\"quoted\"\\"} 1`,
+		`vz_machine_network_disconnects_total{machine="vm-a",device="0"} 1`,
+	)
+	for _, family := range []string{
+		"# TYPE vz_machine_state gauge",
+		"# TYPE vz_machine_state_transitions_total counter",
+		"# TYPE vz_machine_operation_duration_seconds histogram",
+	} {
+		if !strings.Contains(body, family+"\n") {
+			t.Errorf("want %q in\n%s", family, body)
+		}
+	}
+	if strings.Contains(body, `operation="stop"`) {
+		t.Errorf("want no stop operation in\n%s", body)
+	}
+
+	// The counters are kept when the machine is created again, and the devices
+	// of the new machine are watched.
+	if err := manager.Stop("vm-a", true); err != nil {
+		t.Fatal(err)
+	}
+	scrape(t, c, `vz_machine_state_transitions_total{machine="vm-a",from="running",to="stopped"} 1`)
+	if err := manager.Remove("vm-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Create(&machine.Spec{Name: "vm-a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Start("vm-a"); err != nil {
+		t.Fatal(err)
+	}
+	scrape(t, c, `vz_machine_state_transitions_total{machine="vm-a",from="stopped",to="starting"} 2`)
+	backend.Machine("vm-a").EmitDeviceEvent(machine.DeviceNBDConnected, url, nil)
+	backend.Machine("vm-a").EmitDeviceEvent(machine.DeviceNBDConnected, url, nil)
+	scrape(t, c, `vz_machine_nbd_reconnects_total{machine="vm-a",device="nbd://localhost:10809/disk"} 2`)
+}
@@ -0,0 +1,613 @@
+//go:build darwin || linux
+// +build darwin linux
+
+// Package pool keeps warm machines ready to be handed out, so that a machine can
+// be acquired in much less time than it takes to boot.
+//
+// The pool boots a template machine from the spec first, waits until it is ready,
+// and saves its state together with the copies of its writable files such as the
+// disk images. Then it keeps the configured number of clones which are restored
+// from the saved state and paused:
+//
+//	p := pool.New(vzmachine.Backend, spec, pool.WithSize(4))
+//	go p.Run(ctx)
+//	vm, err := p.Acquire(ctx) // a running clone
+//	...
+//	p.Release(vm) // the clone is destroyed and another one is prepared
+//
+// Each clone has its own copies of the writable files cloned from the ones of the
+// template, which share the blocks on APFS until they are written, a new machine
+// identifier and new MAC addresses, so that the clones do not collide with each
+// other on the host. The clones which cannot be restored, for example because the
+// machine cannot save its state, are booted cold from the files of the spec
+// instead.
+//
+// The guest of a restored clone still uses the MAC addresses of the template,
+// because the guest kernel reads them from the devices when it probes them at
+// boot, and the restored memory is the one of the template. If the clones share
+// a network, set the addresses of VM.Spec in the guest after Acquire, for example
+// by running "ip link set dev eth0 address MAC" through the guest agent, or boot
+// the clones cold.
+//
+// The pool is built on machine.Backend, so it can be tested with fake machines.
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/internal/fileutil"
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+var (
+	// ErrClosed is returned by Acquire after Run has returned.
+	ErrClosed = errors.New("pool: closed")
+
+	// ErrReleased is returned by Release when the machine has been released.
+	ErrReleased = errors.New("pool: already released")
+
+	// ErrNotOwned is returned by Release when the machine has not been acquired
+	// from the pool.
+	ErrNotOwned = errors.New("pool: not a machine of the pool")
+
+	// ErrRunning is returned by Run when it is called more than once.
+	ErrRunning = errors.New("pool: already running")
+)
+
+// ReadyFunc waits until the guest of the running machine is ready to be used,
+// such as until the guest agent responds.
+type ReadyFunc func(ctx context.Context, m machine.Machine) error
+
+// stopTimeout is the time to wait for a machine to stop after Stop.
+const stopTimeout = 10 * time.Second
+
+// stateFile is the name of the saved state of the template.
+const stateFile = "state.vzvmsave"
+
+// Stats is the statistics of a pool.
+type Stats struct {
+	// Size is the number of the idle clones which the pool keeps.
+	Size int `json:"size"`
+	// Idle is the number of the clones which are ready to be acquired.
+	Idle int `json:"idle"`
+	// Leased is the number of the clones which are acquired and not released.
+	Leased int `json:"leased"`
+	// Restored is the number of the clones restored from the saved state.
+	Restored int `json:"restored"`
+	// Booted is the number of the clones booted cold.
+	Booted int `json:"booted"`
+	// Failures is the number of the clones which have failed to be prepared.
+	Failures int `json:"failures"`
+}
+
+// VM is a clone acquired from a pool.
+type VM struct {
+	machine.Machine
+
+	pool     *Pool
+	spec     *machine.Spec
+	dir      string
+	restored bool
+}
+
+// Spec returns the spec of the clone, which has the paths of its own files, its
+// MAC addresses and its name. The guest of a restored clone does not use the MAC
+// addresses until they are set in the guest.
+func (v *VM) Spec() *machine.Spec {
+	return v.spec.Clone()
+}
+
+// Restored reports whether the clone has been restored from the saved state of
+// the template instead of booted cold.
+func (v *VM) Restored() bool {
+	return v.restored
+}
+
+// Pool is a pool of warm clones of a machine.
+type Pool struct {
+	backend  machine.Backend
+	spec     *machine.Spec
+	size     int
+	dir      string
+	ready    ReadyFunc
+	backoff  time.Duration
+	clock    machine.Clock
+	errorLog func(err error)
+
+	idle chan *VM
+	wake chan struct{}
+	done chan struct{}
+
+	mu      sync.Mutex
+	running bool
+	closed  bool
+	seq     int
+	stats   Stats
+	leased  map[*VM]struct{}
+	// tmp is the temporary directory which is removed when the last clone is
+	// released after Run has returned.
+	tmp string
+}
+
+// Option is an option for New.
+type Option func(*Pool)
+
+// WithSize sets the number of the idle clones to keep. The default is 1.
+func WithSize(n int) Option {
+	return func(p *Pool) {
+		p.size = n
+	}
+}
+
+// WithDir sets the directory of the files of the template and the clones. A
+// temporary directory is used by default, which is removed after Run returns and
+// all the acquired clones are released.
+func WithDir(dir string) Option {
+	return func(p *Pool) {
+		p.dir = dir
+	}
+}
+
+// WithReady sets the function which waits until the guest is ready after boot.
+// The template is saved after it, so the restored clones are ready immediately.
+func WithReady(ready ReadyFunc) Option {
+	return func(p *Pool) {
+		p.ready = ready
+	}
+}
+
+// WithBackoff sets the time to wait before preparing a clone again after it has
+// failed. The default is 1 second.
+func WithBackoff(d time.Duration) Option {
+	return func(p *Pool) {
+		p.backoff = d
+	}
+}
+
+// WithClock sets the clock of the backoff. The default is machine.SystemClock.
+func WithClock(clock machine.Clock) Option {
+	return func(p *Pool) {
+		p.clock = clock
+	}
+}
+
+// WithErrorLog sets the function which is called with the errors of the clones
+// which have failed to be prepared or destroyed. They are ignored by default.
+func WithErrorLog(fn func(err error)) Option {
+	return func(p *Pool) {
+		p.errorLog = fn
+	}
+}
+
+// New creates a new pool of the clones of the machine of the spec created by
+// backend. The disk images of the spec must exist. Call Run to fill the pool.
+func New(backend machine.Backend, spec *machine.Spec, opts ...Option) *Pool {
+	p := &Pool{
+		backend: backend,
+		spec:    spec.WithDefaults(),
+		size:    1,
+		backoff: time.Second,
+		clock:   machine.SystemClock,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		leased:  make(map[*VM]struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.size = max(p.size, 1)
+	p.idle = make(chan *VM, p.size)
+	p.stats.Size = p.size
+	return p
+}
+
+// Stats returns the statistics of the pool.
+func (p *Pool) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats
+	s.Idle = len(p.idle)
+	return s
+}
+
+// Run boots the template, and keeps the pool filled until ctx is done. The idle
+// clones are destroyed when it returns, but the acquired ones are not until they
+// are released, and the temporary directory is kept until then.
+//
+// It returns an error if the template cannot be booted, and ctx.Err() when ctx is
+// done.
+func (p *Pool) Run(ctx context.Context) error {
+	p.mu.Lock()
+	if p.running {
+		p.mu.Unlock()
+		return ErrRunning
+	}
+	p.running = true
+	p.mu.Unlock()
+
+	dir, tmp := p.dir, ""
+	if dir == "" {
+		var err error
+		if tmp, err = os.MkdirTemp("", "vzpool"); err != nil {
+			p.close("")
+			return err
+		}
+		dir = tmp
+	} else if err := os.MkdirAll(dir, 0o755); err != nil {
+		p.close("")
+		return err
+	}
+	defer p.close(tmp)
+
+	t, err := p.prepare(ctx, dir)
+	if err != nil {
+		return fmt.Errorf("pool: failed to prepare the template: %w", err)
+	}
+	for {
+		for len(p.idle) < p.size {
+			vm, err := p.clone(ctx, dir, t)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				p.logError(err)
+				p.update(func(s *Stats) { s.Failures++ })
+				select {
+				case <-p.clock.After(p.backoff):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				continue
+			}
+			p.idle <- vm
+		}
+		select {
+		case <-p.wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Acquire returns a running clone. It waits until a clone is ready, ctx is done or
+// the pool is closed.
+func (p *Pool) Acquire(ctx context.Context) (*VM, error) {
+	for {
+		select {
+		case <-p.done:
+			return nil, ErrClosed
+		default:
+		}
+		select {
+		case vm := <-p.idle:
+			p.refill()
+			if err := vm.Resume(); err != nil {
+				p.logError(fmt.Errorf("pool: failed to resume %s: %w", vm.spec.Name, err))
+				p.update(func(s *Stats) { s.Failures++ })
+				if err := destroy(vm); err != nil {
+					p.logError(err)
+				}
+				continue
+			}
+			p.mu.Lock()
+			if p.closed {
+				// Run has returned without the clone in the leases, so the
+				// files of the clone may have been removed.
+				p.mu.Unlock()
+				if err := destroy(vm); err != nil {
+					p.logError(err)
+				}
+				return nil, ErrClosed
+			}
+			p.leased[vm] = struct{}{}
+			p.stats.Leased++
+			p.mu.Unlock()
+			return vm, nil
+		case <-p.done:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Release stops the clone acquired from the pool and removes its files. It
+// returns ErrNotOwned for a machine of another pool.
+func (p *Pool) Release(vm *VM) error {
+	if vm == nil || vm.pool != p {
+		return ErrNotOwned
+	}
+	p.mu.Lock()
+	if _, ok := p.leased[vm]; !ok {
+		p.mu.Unlock()
+		return ErrReleased
+	}
+	delete(p.leased, vm)
+	p.stats.Leased--
+	var tmp string
+	if len(p.leased) == 0 {
+		tmp, p.tmp = p.tmp, ""
+	}
+	p.mu.Unlock()
+	err := destroy(vm)
+	if tmp != "" {
+		if rerr := os.RemoveAll(tmp); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// close closes the pool and destroys the idle clones. The temporary directory tmp
+// is removed unless a clone is leased, and then it is removed by Release of the
+// last clone.
+func (p *Pool) close(tmp string) {
+	close(p.done)
+	p.drain()
+	p.mu.Lock()
+	p.closed = true
+	if len(p.leased) > 0 {
+		p.tmp, tmp = tmp, ""
+	}
+	p.mu.Unlock()
+	if tmp != "" {
+		if err := os.RemoveAll(tmp); err != nil {
+			p.logError(err)
+		}
+	}
+}
+
+// drain destroys the idle clones.
+func (p *Pool) drain() {
+	for {
+		select {
+		case vm := <-p.idle:
+			if err := destroy(vm); err != nil {
+				p.logError(err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *Pool) refill() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Pool) update(fn func(s *Stats)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn(&p.stats)
+}
+
+func (p *Pool) logError(err error) {
+	if p.errorLog != nil {
+		p.errorLog(err)
+	}
+}
+
+// template is the machine which the clones are restored from.
+type template struct {
+	// spec is the spec of the template whose writable files are the ones at the
+	// time of saving.
+	spec *machine.Spec
+	// state is the path of the saved state, or "" if the state cannot be saved.
+	state string
+}
+
+// prepare boots the template and saves its state.
+func (p *Pool) prepare(ctx context.Context, dir string) (_ *template, err error) {
+	spec, err := p.identity(p.spec.Name + "-template")
+	if err != nil {
+		return nil, err
+	}
+	tdir := filepath.Join(dir, "template")
+	if err := os.RemoveAll(tdir); err != nil {
+		return nil, err
+	}
+	if err := overlay(spec, p.spec, tdir); err != nil {
+		return nil, err
+	}
+	m, err := p.backend.NewMachine(spec)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := shutdown(m); cerr != nil && err == nil {
+			err = fmt.Errorf("pool: failed to shut down the template: %w", cerr)
+		}
+	}()
+	if err := p.boot(ctx, m); err != nil {
+		return nil, err
+	}
+
+	t := &template{spec: spec}
+	saver, ok := m.(machine.StateSaver)
+	if !ok {
+		return t, nil
+	}
+	if v, ok := m.(machine.SaveRestoreValidator); ok {
+		if err := v.ValidateSaveRestoreSupport(); err != nil {
+			p.logError(fmt.Errorf("pool: the clones are booted cold: %w", err))
+			return t, nil
+		}
+	}
+	if err := m.Pause(); err != nil {
+		return nil, err
+	}
+	state := filepath.Join(tdir, stateFile)
+	if err := saver.SaveMachineStateToPath(state); err != nil {
+		p.logError(fmt.Errorf("pool: the clones are booted cold: failed to save the template: %w", err))
+		return t, nil
+	}
+	t.state = state
+	return t, nil
+}
+
+// clone prepares a paused clone of the template.
+func (p *Pool) clone(ctx context.Context, dir string, t *template) (_ *VM, err error) {
+	p.mu.Lock()
+	p.seq++
+	name := fmt.Sprintf("%s-%d", p.spec.Name, p.seq)
+	p.mu.Unlock()
+	spec, err := p.identity(name)
+	if err != nil {
+		return nil, err
+	}
+	vm := &VM{pool: p, spec: spec, dir: filepath.Join(dir, name)}
+	defer func() {
+		if err != nil {
+			destroy(vm)
+		}
+	}()
+
+	if t.state != "" {
+		if err := overlay(spec, t.spec, vm.dir); err != nil {
+			return nil, err
+		}
+		if vm.Machine, err = p.backend.NewMachine(spec); err != nil {
+			return nil, err
+		}
+		if err := restore(vm.Machine, t.state); err != nil {
+			p.logError(fmt.Errorf("pool: %s is booted cold: failed to restore: %w", name, err))
+		} else {
+			vm.restored = true
+			p.update(func(s *Stats) { s.Restored++ })
+			return vm, nil
+		}
+		if err := shutdown(vm.Machine); err != nil {
+			return nil, err
+		}
+		vm.Machine = nil
+	}
+
+	// The files of the template are inconsistent without its memory.
+	if err := overlay(spec, p.spec, vm.dir); err != nil {
+		return nil, err
+	}
+	if vm.Machine, err = p.backend.NewMachine(spec); err != nil {
+		return nil, err
+	}
+	if err := p.boot(ctx, vm.Machine); err != nil {
+		return nil, err
+	}
+	if err := vm.Pause(); err != nil {
+		return nil, err
+	}
+	p.update(func(s *Stats) { s.Booted++ })
+	return vm, nil
+}
+
+func restore(m machine.Machine, path string) error {
+	saver, ok := m.(machine.StateSaver)
+	if !ok {
+		return fmt.Errorf("%w: the machine cannot restore its state", machine.ErrUnsupported)
+	}
+	return saver.RestoreMachineStateFromURL(path)
+}
+
+// identity returns the spec of the machine of the name which has new MAC
+// addresses. The machine identifier is removed so that the backend creates a new
+// one.
+func (p *Pool) identity(name string) (*machine.Spec, error) {
+	spec := p.spec.Clone()
+	spec.Name = name
+	spec.MachineIdentifier = nil
+	for i := range spec.Networks {
+		mac, err := machine.NewMACAddress()
+		if err != nil {
+			return nil, err
+		}
+		spec.Networks[i].MACAddress = mac
+	}
+	return spec, nil
+}
+
+// boot starts the machine and waits until it is ready.
+func (p *Pool) boot(ctx context.Context, m machine.Machine) error {
+	if err := m.Start(); err != nil {
+		return err
+	}
+	if err := machine.WaitRunning(ctx, m); err != nil {
+		return err
+	}
+	if p.ready != nil {
+		return p.ready(ctx, m)
+	}
+	return nil
+}
+
+// overlay points the writable files of spec to their copies in dir, which are
+// cloned from the files of src of the same devices. The files which do not exist
+// in src are left to be created by the backend.
+func overlay(spec, src *machine.Spec, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	copyFile := func(dst *string, src, name string) error {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(src); errors.Is(err, fs.ErrNotExist) {
+			os.Remove(path)
+			*dst = path
+			return nil
+		}
+		if err := fileutil.Clone(path, src); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", src, err)
+		}
+		*dst = path
+		return nil
+	}
+	for i := range spec.Disks {
+		if spec.Disks[i].ReadOnly {
+			continue
+		}
+		name := fmt.Sprintf("disk%d%s", i, filepath.Ext(src.Disks[i].Path))
+		if err := copyFile(&spec.Disks[i].Path, src.Disks[i].Path, name); err != nil {
+			return err
+		}
+	}
+	if spec.Kernel == "" && spec.EFIVariableStore != "" {
+		if err := copyFile(&spec.EFIVariableStore, src.EFIVariableStore, "efi-variable-store"); err != nil {
+			return err
+		}
+	}
+	if spec.AuxiliaryStorage != "" {
+		if err := copyFile(&spec.AuxiliaryStorage, src.AuxiliaryStorage, "auxiliary-storage"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// destroy stops and closes the clone and removes its files.
+func destroy(vm *VM) error {
+	if vm.Machine != nil {
+		if err := shutdown(vm.Machine); err != nil {
+			return fmt.Errorf("pool: failed to shut down %s: %w", vm.spec.Name, err)
+		}
+	}
+	return os.RemoveAll(vm.dir)
+}
+
+// shutdown stops the machine and closes it if it implements io.Closer.
+func shutdown(m machine.Machine) error {
+	if err := machine.StopAndWait(m, stopTimeout); err != nil {
+		return err
+	}
+	if c, ok := m.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package pool_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/fake"
+	"github.com/Code-Hex/vz/v3/machine/pool"
+)
+
+// run runs the pool in the background and returns the function which stops it.
+func run(t *testing.T, p *pool.Pool) (stop func() error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.Run(ctx) }()
+	stopped := false
+	stop = func() error {
+		if stopped {
+			return nil
+		}
+		stopped = true
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			return err
+		}
+		return nil
+	}
+	t.Cleanup(func() { stop() })
+	return stop
+}
+
+func waitStats(t *testing.T, p *pool.Pool, ok func(s pool.Stats) bool) pool.Stats {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s := p.Stats()
+		if ok(s) {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected stats %+v", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func acquire(t *testing.T, p *pool.Pool) *pool.VM {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	vm, err := p.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vm
+}
+
+func TestPool(t *testing.T) {
+	spec := fake.NewSpec(t, "ci")
+	spec.MachineIdentifier = []byte("template")
+	dir := t.TempDir()
+	backend := fake.NewBackend()
+	var (
+		mu    sync.Mutex
+		ready []string
+	)
+	p := pool.New(backend, spec,
+		pool.WithSize(2),
+		pool.WithDir(dir),
+		pool.WithReady(func(ctx context.Context, m machine.Machine) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ready = append(ready, m.(*fake.Machine).Spec().Name)
+			return nil
+		}),
+	)
+	stop := run(t, p)
+
+	a, b := acquire(t, p), acquire(t, p)
+	for _, vm := range []*pool.VM{a, b} {
+		if s := vm.State(); s != machine.StateRunning || !vm.Restored() {
+			t.Fatalf("want the restored clone running but got %s, restored %v", s, vm.Restored())
+		}
+		s := vm.Spec()
+		if !strings.HasPrefix(s.Disks[0].Path, dir) || s.Disks[1].Path != "/base.img" {
+			t.Fatalf("want the overlay of the writable disk but got %+v", s.Disks)
+		}
+		if b, err := os.ReadFile(s.Disks[0].Path); err != nil || string(b) != "root" {
+			t.Fatalf("want the copy of the disk but got %q, %v", b, err)
+		}
+		if s.MachineIdentifier != nil || s.Networks[0].MACAddress == spec.Networks[0].MACAddress {
+			t.Fatalf("want a new identity but got %+v", s)
+		}
+	}
+	if a.Spec().Name == b.Spec().Name || a.Spec().Networks[0].MACAddress == b.Spec().Networks[0].MACAddress {
+		t.Fatal("want the clones of the different identities")
+	}
+	// The guest is ready in the saved state, so only the template is waited for.
+	mu.Lock()
+	if len(ready) != 1 || ready[0] != "ci-template" {
+		t.Fatalf("want the template waited for but got %v", ready)
+	}
+	mu.Unlock()
+
+	// The pool is refilled in the background.
+	waitStats(t, p, func(s pool.Stats) bool { return s.Idle == 2 && s.Leased == 2 && s.Restored == 4 })
+
+	clone := a.Spec().Disks[0].Path
+	if err := p.Release(a); err != nil {
+		t.Fatal(err)
+	}
+	if s := a.State(); s != machine.StateStopped {
+		t.Fatalf("want the released clone stopped but got %s", s)
+	}
+	if _, err := os.Stat(clone); !os.IsNotExist(err) {
+		t.Fatalf("want the overlay removed but got %v", err)
+	}
+	// The consoles of the released clone and of the template are closed.
+	for _, m := range []*fake.Machine{a.Machine.(*fake.Machine), backend.Machine("ci-template")} {
+		if _, err := m.Guest().Write([]byte("x")); err == nil {
+			t.Fatalf("want %s closed", m.Spec().Name)
+		}
+	}
+	if err := p.Release(a); !errors.Is(err, pool.ErrReleased) {
+		t.Fatalf("want ErrReleased but got %v", err)
+	}
+
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Acquire(context.Background()); !errors.Is(err, pool.ErrClosed) {
+		t.Fatalf("want ErrClosed but got %v", err)
+	}
+	if s := p.Stats(); s.Idle != 0 || s.Leased != 1 {
+		t.Fatalf("want the idle clones destroyed but got %+v", s)
+	}
+	// The acquired clone is still running until it is released.
+	if s := b.State(); s != machine.StateRunning {
+		t.Fatalf("want running but got %s", s)
+	}
+	if err := p.Release(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolTempDir(t *testing.T) {
+	p := pool.New(fake.NewBackend(), fake.NewSpec(t, "ci"))
+	stop := run(t, p)
+	vm := acquire(t, p)
+	other := pool.New(fake.NewBackend(), fake.NewSpec(t, "ci"))
+	if err := other.Release(vm); !errors.Is(err, pool.ErrNotOwned) {
+		t.Fatalf("want ErrNotOwned but got %v", err)
+	}
+	if err := p.Release(nil); !errors.Is(err, pool.ErrNotOwned) {
+		t.Fatalf("want ErrNotOwned but got %v", err)
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The temporary directory is kept for the leased clone.
+	disk := vm.Spec().Disks[0].Path
+	if b, err := os.ReadFile(disk); err != nil || string(b) != "root" {
+		t.Fatalf("want the overlay of the leased clone but got %q, %v", b, err)
+	}
+	if err := p.Release(vm); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Dir(filepath.Dir(disk))); !os.IsNotExist(err) {
+		t.Fatalf("want the temporary directory removed but got %v", err)
+	}
+}
+
+func TestPoolColdBoot(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(m *fake.Machine)
+	}{
+		{
+			name: "unsupported",
+			setup: func(m *fake.Machine) {
+				m.SetSaveRestoreSupport(fmt.Errorf("%w: not savable", machine.ErrUnsupported))
+			},
+		},
+		{
+			name: "restore failed",
+			setup: func(m *fake.Machine) {
+				m.FailNext(fake.OpRestore, errors.New("incompatible state"))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu   sync.Mutex
+				errs []error
+			)
+			p := pool.New(fake.NewBackend(tt.setup), fake.NewSpec(t, "ci"), pool.WithErrorLog(func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, err)
+			}))
+			run(t, p)
+			vm := acquire(t, p)
+			if s := vm.State(); s != machine.StateRunning || vm.Restored() {
+				t.Fatalf("want the clone booted cold but got %s, restored %v", s, vm.Restored())
+			}
+			waitStats(t, p, func(s pool.Stats) bool { return s.Booted == 2 && s.Restored == 0 && s.Failures == 0 })
+			mu.Lock()
+			defer mu.Unlock()
+			if len(errs) == 0 || !strings.Contains(errs[0].Error(), "booted cold") {
+				t.Fatalf("want the reason of the cold boot logged but got %v", errs)
+			}
+		})
+	}
+}
+
+func TestPoolBackoff(t *testing.T) {
+	clock := fake.NewClock(time.Now())
+	fb := fake.NewBackend()
+	// The template is created, and then the first clone fails.
+	var (
+		mu sync.Mutex
+		n  int
+	)
+	p := pool.New(machine.BackendFunc(func(spec *machine.Spec) (machine.Machine, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		n++
+		if n == 2 {
+			return nil, errors.New("out of memory")
+		}
+		return fb.NewMachine(spec)
+	}), fake.NewSpec(t, "ci"), pool.WithClock(clock), pool.WithBackoff(time.Minute))
+	run(t, p)
+
+	clock.BlockUntil(1)
+	if s := p.Stats(); s.Failures != 1 || s.Idle != 0 {
+		t.Fatalf("want a failure but got %+v", s)
+	}
+	clock.Advance(time.Minute)
+	if vm := acquire(t, p); !vm.Restored() {
+		t.Fatal("want the restored clone")
+	}
+}
+
+func TestPoolTemplateError(t *testing.T) {
+	p := pool.New(fake.NewBackend(), fake.NewSpec(t, "ci"), pool.WithReady(func(ctx context.Context, m machine.Machine) error {
+		return errors.New("the guest did not boot")
+	}))
+	if err := p.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "did not boot") {
+		t.Fatalf("want the error of the template but got %v", err)
+	}
+	if _, err := p.Acquire(context.Background()); !errors.Is(err, pool.ErrClosed) {
+		t.Fatalf("want ErrClosed but got %v", err)
+	}
+	if err := p.Run(context.Background()); !errors.Is(err, pool.ErrRunning) {
+		t.Fatalf("want ErrRunning but got %v", err)
+	}
+}
+
+func TestPoolCloseError(t *testing.T) {
+	closeErr := errors.New("close failed")
+	t.Run("clone", func(t *testing.T) {
+		p := pool.New(fake.NewBackend(func(m *fake.Machine) {
+			if m.Spec().Name != "ci-template" {
+				m.FailNext(fake.OpClose, closeErr)
+			}
+		}), fake.NewSpec(t, "ci"))
+		run(t, p)
+		if err := p.Release(acquire(t, p)); !errors.Is(err, closeErr) {
+			t.Fatalf("want the error of Close but got %v", err)
+		}
+	})
+	t.Run("template", func(t *testing.T) {
+		p := pool.New(fake.NewBackend(func(m *fake.Machine) {
+			m.FailNext(fake.OpClose, closeErr)
+		}), fake.NewSpec(t, "ci"))
+		if err := p.Run(context.Background()); !errors.Is(err, closeErr) {
+			t.Fatalf("want the error of Close but got %v", err)
+		}
+	})
+}
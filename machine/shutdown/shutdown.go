@@ -0,0 +1,244 @@
+// Package shutdown stops machines gracefully.
+//
+// Stop tries the phases in order until the machine stops:
+//
+//  1. PhaseRequest requests the guest to stop with RequestStop, which is like
+//     pressing the power button, and waits for the machine to stop.
+//  2. PhaseAgent asks the guest agent to power off over virtio-vsock, and waits
+//     for the machine to stop. It is skipped without WithAgent.
+//  3. PhaseForce stops the machine with Stop, which is like pulling the power
+//     cable and may corrupt the file systems of the guest.
+//
+// The Report tells which phase has stopped the machine and why the earlier ones
+// have not.
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+// Phase is a phase of the shutdown.
+type Phase string
+
+const (
+	// PhaseNone means that the machine was not running.
+	PhaseNone Phase = "none"
+	// PhaseRequest requests the guest to stop with RequestStop.
+	PhaseRequest Phase = "request"
+	// PhaseAgent asks the guest agent to power off.
+	PhaseAgent Phase = "agent"
+	// PhaseForce stops the machine with Stop.
+	PhaseForce Phase = "force"
+)
+
+// Agent is the guest agent which powers off the guest. *agent.Client implements it.
+type Agent interface {
+	PowerOff(ctx context.Context) error
+}
+
+type options struct {
+	requestTimeout time.Duration
+	agent          Agent
+	agentTimeout   time.Duration
+	forceTimeout   time.Duration
+}
+
+// Option is an option for Stop.
+type Option func(*options)
+
+// WithRequestTimeout sets the time to wait for the guest to stop after
+// RequestStop. Zero skips PhaseRequest. The default is 30 seconds.
+func WithRequestTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.requestTimeout = d
+	}
+}
+
+// WithAgent enables PhaseAgent, which asks the agent to power off the guest and
+// waits for timeout.
+func WithAgent(agent Agent, timeout time.Duration) Option {
+	return func(o *options) {
+		o.agent = agent
+		o.agentTimeout = timeout
+	}
+}
+
+// WithForceTimeout sets the time to wait for the machine to stop after Stop. The
+// default is 10 seconds.
+func WithForceTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.forceTimeout = d
+	}
+}
+
+// Attempt is the result of a phase.
+type Attempt struct {
+	Phase    Phase         `json:"phase"`
+	Duration time.Duration `json:"duration"`
+	// Error is why the phase has not stopped the machine.
+	Error string `json:"error,omitempty"`
+}
+
+// Report is the result of Stop.
+type Report struct {
+	// Phase is the phase which has stopped the machine.
+	Phase Phase `json:"phase"`
+	// State is the state of the machine after Stop.
+	State machine.State `json:"state"`
+	// Attempts are the phases which have been tried in order.
+	Attempts []Attempt     `json:"attempts"`
+	Duration time.Duration `json:"duration"`
+}
+
+// String returns the summary of the report such as "stopped by force in 30s (request:
+// timed out after 30s)".
+func (r *Report) String() string {
+	if r.Phase == PhaseNone {
+		return "not running"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "stopped by %s in %s", r.Phase, r.Duration.Round(time.Millisecond))
+	var failed []string
+	for _, a := range r.Attempts {
+		if a.Error != "" {
+			failed = append(failed, fmt.Sprintf("%s: %s", a.Phase, a.Error))
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(failed, ", "))
+	}
+	return b.String()
+}
+
+// Stop stops the machine gracefully. When ctx is done, the remaining graceful
+// phases are skipped and the machine is stopped forcibly, so ctx can be canceled to
+// stop the machine immediately. A paused machine is resumed first so that the
+// guest can handle the requests.
+//
+// It returns an error only if the machine cannot be stopped even forcibly. The
+// report is returned with the error.
+func Stop(ctx context.Context, m machine.Machine, opts ...Option) (*Report, error) {
+	o := &options{
+		requestTimeout: 30 * time.Second,
+		forceTimeout:   10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	start := time.Now()
+	r := &Report{}
+	defer func() {
+		r.State = m.State()
+		r.Duration = time.Since(start)
+	}()
+	if !m.State().Active() {
+		r.Phase = PhaseNone
+		return r, nil
+	}
+
+	var resumeErr error
+	if m.State() == machine.StatePaused {
+		resumeErr = m.Resume()
+	}
+	phases := []struct {
+		phase   Phase
+		timeout time.Duration
+		fn      func(ctx context.Context) error
+	}{
+		{
+			phase:   PhaseRequest,
+			timeout: o.requestTimeout,
+			fn: func(ctx context.Context) error {
+				if resumeErr != nil {
+					return fmt.Errorf("failed to resume: %w", resumeErr)
+				}
+				ok, err := m.RequestStop()
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return errors.New("the request is not accepted")
+				}
+				return nil
+			},
+		},
+		{
+			phase:   PhaseAgent,
+			timeout: o.agentTimeout,
+			fn: func(ctx context.Context) error {
+				return o.agent.PowerOff(ctx)
+			},
+		},
+	}
+	for _, p := range phases {
+		if p.timeout <= 0 || (p.phase == PhaseAgent && o.agent == nil) {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if !m.State().Active() {
+			// The machine has stopped after the previous phase has timed out.
+			r.Phase = r.lastPhase()
+			return r, nil
+		}
+		if r.try(ctx, m, p.phase, p.timeout, p.fn) {
+			return r, nil
+		}
+	}
+
+	if !m.State().Active() {
+		r.Phase = r.lastPhase()
+		return r, nil
+	}
+	ok := r.try(context.Background(), m, PhaseForce, o.forceTimeout, func(context.Context) error {
+		return m.Stop()
+	})
+	if !ok {
+		return r, fmt.Errorf("shutdown: failed to stop the machine: %s", r.Attempts[len(r.Attempts)-1].Error)
+	}
+	return r, nil
+}
+
+// lastPhase returns the phase of the last attempt, or PhaseNone.
+func (r *Report) lastPhase() Phase {
+	if len(r.Attempts) == 0 {
+		return PhaseNone
+	}
+	return r.Attempts[len(r.Attempts)-1].Phase
+}
+
+// try runs the phase, waits for the machine to stop, and records the attempt. It
+// reports whether the machine has stopped.
+func (r *Report) try(ctx context.Context, m machine.Machine, phase Phase, timeout time.Duration, fn func(ctx context.Context) error) bool {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := fn(ctx)
+	if err == nil {
+		err = machine.WaitStopped(ctx, m)
+	}
+	a := Attempt{Phase: phase, Duration: time.Since(start)}
+	// The machine may have stopped by itself while fn has failed.
+	if err == nil || !m.State().Active() {
+		r.Phase = phase
+		r.Attempts = append(r.Attempts, a)
+		return true
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) && ctx.Err() == context.DeadlineExceeded:
+		a.Error = fmt.Sprintf("timed out after %s", timeout)
+	case errors.Is(err, context.Canceled):
+		a.Error = "canceled"
+	default:
+		a.Error = err.Error()
+	}
+	r.Attempts = append(r.Attempts, a)
+	return false
+}
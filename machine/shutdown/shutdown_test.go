@@ -0,0 +1,188 @@
+package shutdown_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/agent"
+	"github.com/Code-Hex/vz/v3/machine/fake"
+	"github.com/Code-Hex/vz/v3/machine/shutdown"
+)
+
+func newMachine(t *testing.T, ignoreStop bool) *fake.Machine {
+	t.Helper()
+	m := fake.New(&machine.Spec{Name: "vm"})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	m.IgnoreStopRequests(ignoreStop)
+	return m
+}
+
+// serveAgent serves the guest agent which powers off the machine.
+func serveAgent(t *testing.T, m *fake.Machine) *agent.Client {
+	t.Helper()
+	ln, err := m.ListenVsock(agent.DefaultPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &agent.Server{PowerOff: func() error {
+		m.Shutdown()
+		return nil
+	}}
+	go s.Serve(ln)
+	return agent.NewMachineClient(m, agent.DefaultPort)
+}
+
+func phases(r *shutdown.Report) []shutdown.Phase {
+	var ps []shutdown.Phase
+	for _, a := range r.Attempts {
+		ps = append(ps, a.Phase)
+	}
+	return ps
+}
+
+func TestStop(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	cases := []struct {
+		name       string
+		ignoreStop bool
+		agent      string // "" for no agent, "up" or "down"
+		pause      bool
+		want       shutdown.Phase
+		attempts   []shutdown.Phase
+		errors     []string
+	}{
+		{
+			name:     "request",
+			want:     shutdown.PhaseRequest,
+			attempts: []shutdown.Phase{shutdown.PhaseRequest},
+		},
+		{
+			name:     "paused",
+			pause:    true,
+			want:     shutdown.PhaseRequest,
+			attempts: []shutdown.Phase{shutdown.PhaseRequest},
+		},
+		{
+			name:       "agent",
+			ignoreStop: true,
+			agent:      "up",
+			want:       shutdown.PhaseAgent,
+			attempts:   []shutdown.Phase{shutdown.PhaseRequest, shutdown.PhaseAgent},
+			errors:     []string{"timed out after 50ms", ""},
+		},
+		{
+			name:       "force",
+			ignoreStop: true,
+			want:       shutdown.PhaseForce,
+			attempts:   []shutdown.Phase{shutdown.PhaseRequest, shutdown.PhaseForce},
+			errors:     []string{"timed out after 50ms", ""},
+		},
+		{
+			name:       "agent down",
+			ignoreStop: true,
+			agent:      "down",
+			want:       shutdown.PhaseForce,
+			attempts:   []shutdown.Phase{shutdown.PhaseRequest, shutdown.PhaseAgent, shutdown.PhaseForce},
+			errors:     []string{"timed out after 50ms", "connection refused", ""},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMachine(t, tc.ignoreStop)
+			if tc.pause {
+				if err := m.Pause(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := []shutdown.Option{shutdown.WithRequestTimeout(timeout)}
+			switch tc.agent {
+			case "up":
+				opts = append(opts, shutdown.WithAgent(serveAgent(t, m), timeout))
+			case "down":
+				opts = append(opts, shutdown.WithAgent(agent.NewMachineClient(m, agent.DefaultPort), timeout))
+			}
+			r, err := shutdown.Stop(context.Background(), m, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Phase != tc.want || r.State != machine.StateStopped {
+				t.Fatalf("want stopped by %s but got %+v", tc.want, r)
+			}
+			got := phases(r)
+			if len(got) != len(tc.attempts) {
+				t.Fatalf("want %v but got %v", tc.attempts, got)
+			}
+			for i := range got {
+				if got[i] != tc.attempts[i] {
+					t.Fatalf("want %v but got %v", tc.attempts, got)
+				}
+				if tc.errors != nil && !strings.Contains(r.Attempts[i].Error, tc.errors[i]) || tc.errors == nil && r.Attempts[i].Error != "" {
+					t.Fatalf("unexpected error of %s: %q", got[i], r.Attempts[i].Error)
+				}
+			}
+		})
+	}
+}
+
+func TestStopNotRunning(t *testing.T) {
+	m := fake.New(&machine.Spec{Name: "vm"})
+	r, err := shutdown.Stop(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Phase != shutdown.PhaseNone || len(r.Attempts) != 0 || r.String() != "not running" {
+		t.Fatalf("unexpected report %+v", r)
+	}
+}
+
+func TestStopCanceled(t *testing.T) {
+	m := newMachine(t, true)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	r, err := shutdown.Stop(ctx, m, shutdown.WithRequestTimeout(time.Minute), shutdown.WithAgent(agent.NewMachineClient(m, agent.DefaultPort), time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The agent is skipped after the request is canceled.
+	got := phases(r)
+	if r.Phase != shutdown.PhaseForce || len(got) != 2 || r.Attempts[0].Error != "canceled" {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	if r.Duration > 10*time.Second {
+		t.Fatalf("want stopped immediately but took %s", r.Duration)
+	}
+}
+
+func TestStopFailure(t *testing.T) {
+	m := newMachine(t, true)
+	m.FailNext(fake.OpStop, errors.New("stuck"))
+	r, err := shutdown.Stop(context.Background(), m, shutdown.WithRequestTimeout(0))
+	if err == nil || !strings.Contains(err.Error(), "stuck") {
+		t.Fatalf("want the error of Stop but got %v", err)
+	}
+	if r.State != machine.StateRunning || len(r.Attempts) != 1 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+}
+
+func TestReportString(t *testing.T) {
+	r := &shutdown.Report{
+		Phase: shutdown.PhaseForce,
+		Attempts: []shutdown.Attempt{
+			{Phase: shutdown.PhaseRequest, Error: "timed out after 30s"},
+			{Phase: shutdown.PhaseForce},
+		},
+		Duration: 30 * time.Second,
+	}
+	want := "stopped by force in 30s (request: timed out after 30s)"
+	if got := r.String(); got != want {
+		t.Fatalf("want %q but got %q", want, got)
+	}
+}
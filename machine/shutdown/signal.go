@@ -0,0 +1,45 @@
+package shutdown
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// NotifyContext returns the context which is done when the process receives the
+// first SIGINT or SIGTERM, and the context which is done on the second one. The
+// former tells the process to shut down, and the latter is passed to Stop so that
+// the user can skip the graceful phases by sending the signal again:
+//
+//	ctx, force, cancel := shutdown.NotifyContext(context.Background())
+//	defer cancel()
+//	<-ctx.Done()
+//	report, err := shutdown.Stop(force, vm)
+//
+// cancel stops receiving the signals and cancels both contexts.
+func NotifyContext(parent context.Context) (ctx, force context.Context, cancel context.CancelFunc) {
+	ctx, cancelCtx := context.WithCancel(parent)
+	force, cancelForce := context.WithCancel(parent)
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(signals)
+		for n := 0; n < 2; n++ {
+			select {
+			case <-signals:
+			case <-force.Done():
+				return
+			}
+			if n == 0 {
+				cancelCtx()
+			} else {
+				cancelForce()
+			}
+		}
+	}()
+	return ctx, force, func() {
+		cancelCtx()
+		cancelForce()
+	}
+}
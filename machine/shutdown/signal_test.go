@@ -0,0 +1,32 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package shutdown_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine/shutdown"
+)
+
+func TestNotifyContext(t *testing.T) {
+	ctx, force, cancel := shutdown.NotifyContext(context.Background())
+	defer cancel()
+
+	for i, want := range []context.Context{ctx, force} {
+		if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-want.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("want the context %d done", i)
+		}
+		if i == 0 && force.Err() != nil {
+			t.Fatal("want the force context alive after the first signal")
+		}
+	}
+}
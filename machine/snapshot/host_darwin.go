@@ -0,0 +1,19 @@
+package snapshot
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+func currentHostOS() (HostOS, error) {
+	version, err := unix.Sysctl("kern.osproductversion")
+	if err != nil {
+		return HostOS{}, err
+	}
+	build, err := unix.Sysctl("kern.osversion")
+	if err != nil {
+		return HostOS{}, err
+	}
+	return HostOS{OS: runtime.GOOS, Version: version, Build: build}, nil
+}
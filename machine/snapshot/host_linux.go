@@ -0,0 +1,15 @@
+package snapshot
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+func currentHostOS() (HostOS, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return HostOS{}, err
+	}
+	return HostOS{OS: runtime.GOOS, Version: unix.ByteSliceToString(uts.Release[:])}, nil
+}
@@ -0,0 +1,598 @@
+//go:build darwin || linux
+// +build darwin linux
+
+// Package snapshot manages named snapshots of the machines of bundles, which are
+// built on SaveMachineStateToPath and RestoreMachineStateFromURL.
+//
+// A snapshot is the saved state of the machine together with the checkpoints of
+// its writable files, such as the disk images and the EFI variable store, because
+// the saved state is consistent only with the files at the time of saving. The
+// snapshots are stored in the bundle:
+//
+//	NAME.bundle/snapshots/SNAPSHOT/snapshot.json   metadata
+//	NAME.bundle/snapshots/SNAPSHOT/state.vzvmsave  saved state
+//	NAME.bundle/snapshots/SNAPSHOT/0-disk0.img     checkpoints
+//
+// Each snapshot records the fingerprint of the configuration of the machine, and
+// Restore refuses to restore it to a machine of a different configuration, which
+// Virtualization.framework may fail to restore or restore into a broken guest.
+package snapshot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/bundle"
+	"github.com/Code-Hex/vz/v3/internal/fileutil"
+	"github.com/Code-Hex/vz/v3/machine"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// ErrNotFound is returned when a snapshot is not found.
+	ErrNotFound = errors.New("snapshot: not found")
+
+	// ErrExists is returned when a snapshot of the same name already exists.
+	ErrExists = errors.New("snapshot: already exists")
+
+	// ErrMismatch is returned by Restore when the configuration of the machine
+	// differs from the one of the snapshot.
+	ErrMismatch = errors.New("snapshot: configuration mismatch")
+)
+
+// Files of the catalog.
+const (
+	catalogDir   = "snapshots"
+	metadataFile = "snapshot.json"
+	stateFile    = "state.vzvmsave"
+)
+
+// Snapshot is the metadata of a snapshot.
+type Snapshot struct {
+	// Name is the name of the snapshot.
+	Name string `json:"name"`
+	// CreatedAt is the time when the snapshot is created.
+	CreatedAt time.Time `json:"createdAt"`
+	// RestoredAt is the time when the snapshot is restored last, or nil.
+	RestoredAt *time.Time `json:"restoredAt,omitempty"`
+	// Fingerprint is the fingerprint of the configuration of the machine.
+	Fingerprint string `json:"fingerprint"`
+	// Host is the operating system of the host which has saved the state.
+	Host HostOS `json:"host"`
+	// StateSize is the size of the saved state in bytes.
+	StateSize int64 `json:"stateSize"`
+	// Checkpoints are the copies of the writable files of the machine.
+	Checkpoints []Checkpoint `json:"checkpoints,omitempty"`
+}
+
+// Checkpoint is a copy of a writable file of the machine in the snapshot.
+type Checkpoint struct {
+	// Path is the path of the file of the machine. It is relative to the bundle if
+	// the file is in the bundle.
+	Path string `json:"path"`
+	// File is the name of the copy in the snapshot.
+	File string `json:"file"`
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+}
+
+// HostOS is the operating system of a host.
+type HostOS struct {
+	// OS is the operating system such as "darwin".
+	OS string `json:"os"`
+	// Version is the version such as "14.4.1".
+	Version string `json:"version"`
+	// Build is the build version such as "23E224".
+	Build string `json:"build,omitempty"`
+}
+
+// String returns the host such as "darwin 14.4.1 (23E224)".
+func (h HostOS) String() string {
+	s := h.OS + " " + h.Version
+	if h.Build != "" {
+		s += " (" + h.Build + ")"
+	}
+	return s
+}
+
+// CurrentHostOS returns the operating system of this host.
+func CurrentHostOS() (HostOS, error) {
+	return currentHostOS()
+}
+
+// Fingerprint returns the fingerprint of the configuration of the machine of the
+// spec such as "sha256:...". The name of the spec is not a part of the
+// configuration, and the paths under base are made relative to it, so that the
+// fingerprint does not change when the bundle is renamed or moved.
+func Fingerprint(spec *machine.Spec, base string) string {
+	s := relativeSpec(spec, base)
+	s.Name = ""
+	b, err := json.Marshal(s)
+	if err != nil {
+		// Spec consists of the types which are always marshaled.
+		panic(err)
+	}
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// relativeSpec returns the copy of spec with defaults whose paths under base are
+// relative to it.
+func relativeSpec(spec *machine.Spec, base string) *machine.Spec {
+	s := spec.WithDefaults()
+	rel := func(path *string) {
+		*path = relativePath(*path, base)
+	}
+	rel(&s.Kernel)
+	rel(&s.Initrd)
+	rel(&s.EFIVariableStore)
+	rel(&s.AuxiliaryStorage)
+	for i := range s.Disks {
+		rel(&s.Disks[i].Path)
+	}
+	for i := range s.SharedDirectories {
+		rel(&s.SharedDirectories[i].Path)
+	}
+	return s
+}
+
+func relativePath(path, base string) string {
+	if path == "" || base == "" {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if base, err = filepath.Abs(base); err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(base, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return rel
+}
+
+// Catalog is the catalog of the snapshots of a bundle.
+type Catalog struct {
+	base   string
+	dir    string
+	clock  machine.Clock
+	hostOS func() (HostOS, error)
+
+	mu sync.Mutex
+}
+
+// Option is an option for Open.
+type Option func(*Catalog)
+
+// WithClock sets the clock of the timestamps of the snapshots and of Prune. The
+// default is machine.SystemClock.
+func WithClock(clock machine.Clock) Option {
+	return func(c *Catalog) {
+		c.clock = clock
+	}
+}
+
+// Open returns the catalog of the snapshots of the bundle. The directory of the
+// catalog is created when the first snapshot is created.
+func Open(b *bundle.Bundle, opts ...Option) *Catalog {
+	c := &Catalog{
+		base:   b.Path("."),
+		dir:    b.Path(catalogDir),
+		clock:  machine.SystemClock,
+		hostOS: currentHostOS,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Dir returns the directory of the catalog.
+func (c *Catalog) Dir() string {
+	return c.dir
+}
+
+// Create creates the snapshot of the name of the machine m created for the spec of
+// the bundle. A running machine is paused while the state is saved and the files
+// are copied, and resumed after it. A paused machine stays paused.
+//
+// The support of saving and restoring is validated up front if m implements
+// machine.SaveRestoreValidator.
+func (c *Catalog) Create(name string, m machine.StateSaver, spec *machine.Spec) (_ *Snapshot, err error) {
+	if err := machine.ValidateName(name); err != nil {
+		return nil, err
+	}
+	if err := validate(m); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dir := filepath.Join(c.dir, name)
+	if _, err := os.Stat(dir); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrExists, name)
+	}
+	host, err := c.hostOS()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the version of the host: %w", err)
+	}
+	s := &Snapshot{
+		Name:        name,
+		CreatedAt:   c.clock.Now().UTC(),
+		Fingerprint: Fingerprint(spec, c.base),
+		Host:        host,
+	}
+
+	switch state := m.State(); state {
+	case machine.StatePaused:
+	case machine.StateRunning:
+		if err := m.Pause(); err != nil {
+			return nil, fmt.Errorf("failed to pause: %w", err)
+		}
+		defer func() {
+			if resumeErr := m.Resume(); resumeErr != nil && err == nil {
+				err = fmt.Errorf("snapshot %s is created but failed to resume: %w", name, resumeErr)
+			}
+		}()
+	default:
+		return nil, fmt.Errorf("%w: cannot create a snapshot of the %s machine", machine.ErrInvalidState, state)
+	}
+
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp(c.dir, "."+name+"-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := m.SaveMachineStateToPath(filepath.Join(tmp, stateFile)); err != nil {
+		return nil, fmt.Errorf("failed to save the state: %w", err)
+	}
+	fi, err := os.Stat(filepath.Join(tmp, stateFile))
+	if err != nil {
+		return nil, err
+	}
+	s.StateSize = fi.Size()
+	for i, path := range writableFiles(spec) {
+		cp := Checkpoint{
+			Path: relativePath(path, c.base),
+			File: fmt.Sprintf("%d-%s", i, filepath.Base(path)),
+		}
+		if err := fileutil.Clone(filepath.Join(tmp, cp.File), path); err != nil {
+			return nil, fmt.Errorf("failed to copy %s: %w", path, err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		cp.Size = fi.Size()
+		s.Checkpoints = append(s.Checkpoints, cp)
+	}
+	if err := writeMetadata(tmp, s); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		if errors.Is(err, fs.ErrExist) || errors.Is(err, unix.ENOTEMPTY) {
+			return nil, fmt.Errorf("%w: %s", ErrExists, name)
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// writableFiles returns the paths of the files of the spec which the guest writes.
+func writableFiles(spec *machine.Spec) []string {
+	var paths []string
+	for _, d := range spec.Disks {
+		if !d.ReadOnly {
+			paths = append(paths, d.Path)
+		}
+	}
+	if spec.Kernel == "" && spec.EFIVariableStore != "" {
+		paths = append(paths, spec.EFIVariableStore)
+	}
+	if spec.AuxiliaryStorage != "" {
+		paths = append(paths, spec.AuxiliaryStorage)
+	}
+	return paths
+}
+
+// validate checks whether the state of m can be saved and restored.
+func validate(m machine.StateSaver) error {
+	v, ok := m.(machine.SaveRestoreValidator)
+	if !ok {
+		return nil
+	}
+	return v.ValidateSaveRestoreSupport()
+}
+
+// Restore restores the snapshot of the name to a new machine of the spec of the
+// bundle, which is created with backend. The files of the machine are replaced with
+// the checkpoints before the machine is created, because the machine keeps the
+// files open from its creation. So the files must not be used by another machine.
+// The machine is paused after the state is restored, so call Resume to run it.
+//
+// The snapshot is checked up front before any file is touched. ErrMismatch is
+// returned if the configuration of the spec differs from the one of the snapshot,
+// or if the state has been saved on another version of the host OS, which
+// Virtualization.framework cannot restore. The support of saving and restoring is
+// validated on a machine created with backend and closed before restoring, if it
+// implements machine.SaveRestoreValidator.
+//
+// The original files are moved aside while the machine is restored, and they are
+// put back if the machine cannot be created or restored.
+func (c *Catalog) Restore(name string, backend machine.Backend, spec *machine.Spec) (_ machine.Machine, _ *Snapshot, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, err := c.get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fp := Fingerprint(spec, c.base); fp != s.Fingerprint {
+		return nil, nil, fmt.Errorf("%w: snapshot %s is of %s but the machine is %s", ErrMismatch, name, s.Fingerprint, fp)
+	}
+	host, err := c.hostOS()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get the version of the host: %w", err)
+	}
+	if host.OS != s.Host.OS || host.Version != s.Host.Version {
+		return nil, nil, fmt.Errorf("%w: snapshot %s is saved on %s but the host is %s", ErrMismatch, name, s.Host, host)
+	}
+	if err := probe(backend, spec); err != nil {
+		return nil, nil, err
+	}
+
+	dir := filepath.Join(c.dir, name)
+	var replaced []string
+	defer func() {
+		if err != nil {
+			rollback(replaced)
+			return
+		}
+		for _, path := range replaced {
+			os.Remove(path + asideSuffix)
+		}
+	}()
+	for _, cp := range s.Checkpoints {
+		path := cp.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(c.base, path)
+		}
+		if err := replace(path, filepath.Join(dir, cp.File)); err != nil {
+			return nil, nil, fmt.Errorf("failed to restore %s: %w", path, err)
+		}
+		replaced = append(replaced, path)
+	}
+
+	vm, err := backend.NewMachine(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			release(vm)
+		}
+	}()
+	m, ok := vm.(machine.StateSaver)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s cannot restore a state", machine.ErrUnsupported, spec.Name)
+	}
+	if err := m.RestoreMachineStateFromURL(filepath.Join(dir, stateFile)); err != nil {
+		return nil, nil, fmt.Errorf("failed to restore the state saved on %s: %w", s.Host, err)
+	}
+
+	now := c.clock.Now().UTC()
+	s.RestoredAt = &now
+	if err := writeMetadata(dir, s); err != nil {
+		return nil, nil, err
+	}
+	return vm, s, nil
+}
+
+// asideSuffix is the suffix of the original files of the machine which are moved
+// aside while a snapshot is restored.
+const asideSuffix = ".orig"
+
+// probe checks whether the machine of the spec can restore a state on a machine
+// created with backend, which is closed before returning.
+func probe(backend machine.Backend, spec *machine.Spec) error {
+	vm, err := backend.NewMachine(spec)
+	if err != nil {
+		return err
+	}
+	defer release(vm)
+	m, ok := vm.(machine.StateSaver)
+	if !ok {
+		return fmt.Errorf("%w: %s cannot restore a state", machine.ErrUnsupported, spec.Name)
+	}
+	return validate(m)
+}
+
+// release stops the machine which is not returned and closes it.
+func release(vm machine.Machine) {
+	if vm.State().Active() {
+		vm.Stop()
+	}
+	if c, ok := vm.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// replace moves the file of path aside and replaces it with the copy of src. The
+// file is replaced atomically so that it is never partial.
+func replace(path, src string) error {
+	tmp := path + ".snapshot"
+	if err := fileutil.Clone(tmp, src); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(path, path+asideSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		os.Rename(path+asideSuffix, path)
+		return err
+	}
+	return nil
+}
+
+// rollback puts the original files moved aside by replace back.
+func rollback(paths []string) {
+	for _, path := range paths {
+		if err := os.Rename(path+asideSuffix, path); errors.Is(err, fs.ErrNotExist) {
+			// The file did not exist before the snapshot was restored.
+			os.Remove(path)
+		}
+	}
+}
+
+// Get returns the snapshot of the name.
+func (c *Catalog) Get(name string) (*Snapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(name)
+}
+
+func (c *Catalog) get(name string) (*Snapshot, error) {
+	if machine.ValidateName(name) != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	b, err := os.ReadFile(filepath.Join(c.dir, name, metadataFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", name, err)
+	}
+	s.Name = name
+	return &s, nil
+}
+
+// List returns the snapshots from the oldest to the newest. The snapshots which
+// cannot be read are skipped and reported in the error, together with the others.
+func (c *Catalog) List() ([]*Snapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.list()
+}
+
+func (c *Catalog) list() ([]*Snapshot, error) {
+	entries, err := os.ReadDir(c.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var (
+		snapshots []*Snapshot
+		errs      []error
+	)
+	for _, e := range entries {
+		// The temporary directories of Create start with a dot.
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		s, err := c.get(e.Name())
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		snapshots = append(snapshots, s)
+	}
+	slices.SortStableFunc(snapshots, func(a, b *Snapshot) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return snapshots, errors.Join(errs...)
+}
+
+// Delete deletes the snapshot of the name.
+func (c *Catalog) Delete(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.delete(name)
+}
+
+func (c *Catalog) delete(name string) error {
+	if _, err := c.get(name); err != nil {
+		return err
+	}
+	// The snapshot is renamed first so that a partially deleted one is not listed.
+	dir := filepath.Join(c.dir, name)
+	tmp := filepath.Join(c.dir, ".deleted-"+name)
+	if err := os.Rename(dir, tmp); err != nil {
+		return err
+	}
+	return os.RemoveAll(tmp)
+}
+
+// Retention is the policy of Prune. The zero values mean no limit, so the zero
+// Retention keeps all the snapshots.
+type Retention struct {
+	// KeepLast is the number of the newest snapshots to keep.
+	KeepLast int
+	// MaxAge is the age of the snapshots to delete.
+	MaxAge time.Duration
+}
+
+// Prune deletes the snapshots which are not among the newest KeepLast snapshots or
+// older than MaxAge, and returns the deleted ones.
+func (c *Catalog) Prune(r Retention) ([]*Snapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snapshots, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+	now := c.clock.Now()
+	var deleted []*Snapshot
+	for i, s := range snapshots {
+		newer := len(snapshots) - 1 - i
+		expired := (r.KeepLast > 0 && newer >= r.KeepLast) ||
+			(r.MaxAge > 0 && now.Sub(s.CreatedAt) > r.MaxAge)
+		if !expired {
+			continue
+		}
+		if err := c.delete(s.Name); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, s)
+	}
+	return deleted, nil
+}
+
+// writeMetadata writes the metadata of s to dir atomically.
+func writeMetadata(dir string, s *Snapshot) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, metadataFile+".tmp")
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, metadataFile))
+}
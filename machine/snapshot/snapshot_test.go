@@ -0,0 +1,432 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package snapshot_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/bundle"
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/fake"
+	"github.com/Code-Hex/vz/v3/machine/snapshot"
+)
+
+type testMachine struct {
+	*fake.Machine
+	bundle  *bundle.Bundle
+	spec    *machine.Spec
+	catalog *snapshot.Catalog
+	clock   *fake.Clock
+}
+
+// newMachine creates a running machine of a new bundle.
+func newMachine(t *testing.T) *testMachine {
+	t.Helper()
+	dir := t.TempDir()
+	kernel := filepath.Join(dir, "vmlinuz")
+	if err := os.WriteFile(kernel, []byte("kernel"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := machine.CreateBundle(filepath.Join(dir, "vm.bundle"), &machine.Spec{
+		Name:     "vm",
+		Kernel:   kernel,
+		Disks:    []machine.Disk{{Path: filepath.Join(dir, "root.img"), Size: machine.MiB}},
+		Networks: []machine.Network{{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := machine.SpecFromBundle(b)
+	clock := fake.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	m := &testMachine{
+		Machine: fake.New(spec),
+		bundle:  b,
+		spec:    spec,
+		catalog: snapshot.Open(b, snapshot.WithClock(clock)),
+		clock:   clock,
+	}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func (m *testMachine) writeDisk(t *testing.T, content string) {
+	t.Helper()
+	if err := os.WriteFile(m.spec.Disks[0].Path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (m *testMachine) readDisk(t *testing.T) string {
+	t.Helper()
+	b, err := os.ReadFile(m.spec.Disks[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCreateRestore(t *testing.T) {
+	m := newMachine(t)
+	m.writeDisk(t, "before")
+	s, err := m.catalog.Create("first", m, m.spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := m.State(); state != machine.StateRunning {
+		t.Fatalf("want the machine resumed but got %s", state)
+	}
+	if want := snapshot.Fingerprint(m.spec, m.bundle.Dir()); s.Fingerprint != want {
+		t.Fatalf("want fingerprint %s but got %s", want, s.Fingerprint)
+	}
+	host, err := snapshot.CurrentHostOS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Host != host || s.Host.Version == "" {
+		t.Fatalf("want host %v but got %v", host, s.Host)
+	}
+	if len(s.Checkpoints) != 1 || s.Checkpoints[0].Path != "disk0.img" || s.Checkpoints[0].Size != 6 {
+		t.Fatalf("want the checkpoint of disk0.img but got %+v", s.Checkpoints)
+	}
+	if s.StateSize == 0 || s.RestoredAt != nil {
+		t.Fatalf("unexpected snapshot %+v", s)
+	}
+
+	m.writeDisk(t, "after")
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	m.clock.Advance(time.Hour)
+	// The disk is restored before the machine is created, which opens it.
+	var restored string
+	backend := fake.NewBackend(func(*fake.Machine) {
+		restored = m.readDisk(t)
+	})
+	vm, s, err := m.catalog.Restore("first", backend, m.spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != "before" {
+		t.Fatalf("want the disk restored before the machine is created but got %q", restored)
+	}
+	if state := vm.State(); state != machine.StatePaused {
+		t.Fatalf("want paused but got %s", state)
+	}
+	if s.RestoredAt == nil || !s.RestoredAt.Equal(m.clock.Now()) {
+		t.Fatalf("want restored at %v but got %v", m.clock.Now(), s.RestoredAt)
+	}
+	got, err := m.catalog.Get("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RestoredAt == nil || !got.RestoredAt.Equal(*s.RestoredAt) {
+		t.Fatalf("want the restored time recorded but got %v", got.RestoredAt)
+	}
+
+	// A paused machine stays paused.
+	if _, err := m.catalog.Create("second", vm.(*fake.Machine), m.spec); err != nil {
+		t.Fatal(err)
+	}
+	if state := vm.State(); state != machine.StatePaused {
+		t.Fatalf("want paused but got %s", state)
+	}
+}
+
+func TestRestoreMismatch(t *testing.T) {
+	m := newMachine(t)
+	m.writeDisk(t, "before")
+	if _, err := m.catalog.Create("first", m, m.spec); err != nil {
+		t.Fatal(err)
+	}
+	m.writeDisk(t, "after")
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	spec := m.spec.Clone()
+	spec.CPUs = 4
+	backend := fake.NewBackend()
+	if _, _, err := m.catalog.Restore("first", backend, spec); !errors.Is(err, snapshot.ErrMismatch) {
+		t.Fatalf("want ErrMismatch but got %v", err)
+	}
+	if got := m.readDisk(t); got != "after" {
+		t.Fatalf("want the disk untouched but got %q", got)
+	}
+	if vm := backend.Machine("vm"); vm != nil {
+		t.Fatal("want no machine created")
+	}
+}
+
+func TestRestoreUnsupported(t *testing.T) {
+	m := newMachine(t)
+	if _, err := m.catalog.Create("first", m, m.spec); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	backend := fake.NewBackend(func(vm *fake.Machine) {
+		vm.SetSaveRestoreSupport(fmt.Errorf("%w: not restorable", machine.ErrUnsupported))
+	})
+	m.writeDisk(t, "after")
+	vm, _, err := m.catalog.Restore("first", backend, m.spec)
+	if !errors.Is(err, machine.ErrUnsupported) {
+		t.Fatalf("want ErrUnsupported but got %v", err)
+	}
+	if vm != nil {
+		t.Fatalf("want no machine but got %v", vm)
+	}
+	if got := m.readDisk(t); got != "after" {
+		t.Fatalf("want the disk untouched but got %q", got)
+	}
+	got, err := m.catalog.Get("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RestoredAt != nil {
+		t.Fatalf("want no restored time but got %v", got.RestoredAt)
+	}
+}
+
+func TestRestoreRollback(t *testing.T) {
+	m := newMachine(t)
+	m.writeDisk(t, "before")
+	if _, err := m.catalog.Create("first", m, m.spec); err != nil {
+		t.Fatal(err)
+	}
+	m.writeDisk(t, "after")
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	backend := fake.NewBackend(func(vm *fake.Machine) {
+		vm.FailNext(fake.OpRestore, errors.New("restore failed"))
+	})
+	if _, _, err := m.catalog.Restore("first", backend, m.spec); err == nil {
+		t.Fatal("want error")
+	}
+	if got := m.readDisk(t); got != "after" {
+		t.Fatalf("want the original disk put back but got %q", got)
+	}
+	if _, err := os.Stat(m.spec.Disks[0].Path + ".orig"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("want the original disk not left aside but got %v", err)
+	}
+	if vm := backend.Machine("vm"); vm.State() != machine.StateStopped {
+		t.Fatalf("want the machine stopped but got %s", vm.State())
+	}
+}
+
+func TestRestoreHostMismatch(t *testing.T) {
+	m := newMachine(t)
+	if _, err := m.catalog.Create("first", m, m.spec); err != nil {
+		t.Fatal(err)
+	}
+	m.writeDisk(t, "after")
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(m.catalog.Dir(), "first", "snapshot.json")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta map[string]any
+	if err := json.Unmarshal(b, &meta); err != nil {
+		t.Fatal(err)
+	}
+	meta["host"].(map[string]any)["version"] = "0.0.0"
+	if b, err = json.Marshal(meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	backend := fake.NewBackend()
+	if _, _, err := m.catalog.Restore("first", backend, m.spec); !errors.Is(err, snapshot.ErrMismatch) {
+		t.Fatalf("want ErrMismatch but got %v", err)
+	}
+	if got := m.readDisk(t); got != "after" {
+		t.Fatalf("want the disk untouched but got %q", got)
+	}
+	if vm := backend.Machine("vm"); vm != nil {
+		t.Fatal("want no machine created")
+	}
+}
+
+func TestCreateErrors(t *testing.T) {
+	m := newMachine(t)
+	if _, err := m.catalog.Create("first", m, m.spec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.catalog.Create("first", m, m.spec); !errors.Is(err, snapshot.ErrExists) {
+		t.Fatalf("want ErrExists but got %v", err)
+	}
+	if _, err := m.catalog.Create("../first", m, m.spec); !errors.Is(err, machine.ErrInvalidSpec) {
+		t.Fatalf("want ErrInvalidSpec but got %v", err)
+	}
+	if _, _, err := m.catalog.Restore("missing", fake.NewBackend(), m.spec); !errors.Is(err, snapshot.ErrNotFound) {
+		t.Fatalf("want ErrNotFound but got %v", err)
+	}
+
+	// The support is validated before the machine is paused.
+	m.SetSaveRestoreSupport(fmt.Errorf("%w: not savable", machine.ErrUnsupported))
+	if _, err := m.catalog.Create("second", m, m.spec); !errors.Is(err, machine.ErrUnsupported) {
+		t.Fatalf("want ErrUnsupported but got %v", err)
+	}
+	if state := m.State(); state != machine.StateRunning {
+		t.Fatalf("want running but got %s", state)
+	}
+	if _, err := m.catalog.Get("second"); !errors.Is(err, snapshot.ErrNotFound) {
+		t.Fatalf("want no snapshot but got %v", err)
+	}
+
+	// A failed save leaves no snapshot behind.
+	m.SetSaveRestoreSupport(nil)
+	m.FailNext(fake.OpSave, errors.New("save failed"))
+	if _, err := m.catalog.Create("third", m, m.spec); err == nil {
+		t.Fatal("want an error")
+	}
+	if state := m.State(); state != machine.StateRunning {
+		t.Fatalf("want running but got %s", state)
+	}
+	entries, err := os.ReadDir(m.catalog.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "first" {
+		t.Fatalf("want only the first snapshot but got %v", entries)
+	}
+}
+
+func names(snapshots []*snapshot.Snapshot) []string {
+	var names []string
+	for _, s := range snapshots {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+func TestListDeletePrune(t *testing.T) {
+	m := newMachine(t)
+	if list, err := m.catalog.List(); err != nil || len(list) != 0 {
+		t.Fatalf("want no snapshots but got %v, %v", list, err)
+	}
+	for _, name := range []string{"c", "b", "a", "d"} {
+		if _, err := m.catalog.Create(name, m, m.spec); err != nil {
+			t.Fatal(err)
+		}
+		m.clock.Advance(time.Hour)
+	}
+
+	list, err := m.catalog.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(list), []string{"c", "b", "a", "d"}; !slices.Equal(got, want) {
+		t.Fatalf("want %v but got %v", want, got)
+	}
+
+	if err := m.catalog.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.catalog.Delete("b"); !errors.Is(err, snapshot.ErrNotFound) {
+		t.Fatalf("want ErrNotFound but got %v", err)
+	}
+
+	tests := []struct {
+		retention snapshot.Retention
+		want      []string
+	}{
+		{retention: snapshot.Retention{}, want: nil},
+		// a is 2h old and d is 1h old.
+		{retention: snapshot.Retention{MaxAge: 150 * time.Minute}, want: []string{"c"}},
+		{retention: snapshot.Retention{KeepLast: 1}, want: []string{"a"}},
+	}
+	for _, tt := range tests {
+		deleted, err := m.catalog.Prune(tt.retention)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(deleted); !slices.Equal(got, tt.want) {
+			t.Fatalf("%+v: want %v deleted but got %v", tt.retention, tt.want, got)
+		}
+	}
+	list, err = m.catalog.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(list), []string{"d"}; !slices.Equal(got, want) {
+		t.Fatalf("want %v but got %v", want, got)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	base := &machine.Spec{
+		Name:   "vm",
+		Kernel: "/vms/vm.bundle/kernel",
+		Disks:  []machine.Disk{{Path: "/vms/vm.bundle/disk0.img"}},
+	}
+	want := snapshot.Fingerprint(base, "/vms/vm.bundle")
+
+	tests := []struct {
+		name string
+		fn   func(s *machine.Spec) string
+		same bool
+	}{
+		{
+			name: "renamed",
+			fn: func(s *machine.Spec) string {
+				s.Name = "other"
+				return snapshot.Fingerprint(s, "/vms/vm.bundle")
+			},
+			same: true,
+		},
+		{
+			name: "moved",
+			fn: func(s *machine.Spec) string {
+				s.Kernel = "/archive/vm.bundle/kernel"
+				s.Disks[0].Path = "/archive/vm.bundle/disk0.img"
+				return snapshot.Fingerprint(s, "/archive/vm.bundle")
+			},
+			same: true,
+		},
+		{
+			name: "defaults",
+			fn: func(s *machine.Spec) string {
+				s.CPUs = machine.DefaultCPUs
+				return snapshot.Fingerprint(s, "/vms/vm.bundle")
+			},
+			same: true,
+		},
+		{
+			name: "cpus",
+			fn: func(s *machine.Spec) string {
+				s.CPUs = 4
+				return snapshot.Fingerprint(s, "/vms/vm.bundle")
+			},
+		},
+		{
+			name: "disk",
+			fn: func(s *machine.Spec) string {
+				s.Disks[0].Path = "/vms/vm.bundle/disk1.img"
+				return snapshot.Fingerprint(s, "/vms/vm.bundle")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.fn(base.Clone())
+			if (got == want) != tt.same {
+				t.Fatalf("want same %v but got %s and %s", tt.same, want, got)
+			}
+		})
+	}
+}
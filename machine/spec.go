@@ -0,0 +1,336 @@
+package machine
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidSpec is returned when a spec is invalid.
+var ErrInvalidSpec = errors.New("machine: invalid spec")
+
+// OS is the guest operating system of a machine. The values are the same as
+// bundle.OS.
+type OS string
+
+const (
+	// OSLinux is a Linux guest which boots with LinuxBootLoader or EFIBootLoader.
+	OSLinux OS = "linux"
+	// OSMacOS is a macOS guest which boots with MacOSBootLoader.
+	OSMacOS OS = "macOS"
+)
+
+// Defaults of the resources of a machine.
+const (
+	DefaultCPUs   = 2
+	DefaultMemory = 2 * GiB
+)
+
+// Spec is the declarative specification of a machine, which is typically written in
+// JSON:
+//
+//	{
+//	  "name": "debian",
+//	  "cpus": 2,
+//	  "memory": "4GiB",
+//	  "kernel": "vmlinuz",
+//	  "initrd": "initrd.img",
+//	  "commandLine": "console=hvc0 root=/dev/vda",
+//	  "disks": [{"path": "disk.img", "size": "16GiB"}],
+//	  "networks": [{}]
+//	}
+//
+// The guest boots with LinuxBootLoader if Kernel is set, and with EFIBootLoader
+// otherwise.
+type Spec struct {
+	// Name is the name of the machine.
+	Name string `json:"name"`
+	// OS is the guest operating system. The default is OSLinux.
+	OS OS `json:"os,omitempty"`
+	// CPUs is the number of the virtual CPUs. The default is DefaultCPUs.
+	CPUs uint `json:"cpus,omitempty"`
+	// Memory is the size of the memory. The default is DefaultMemory.
+	Memory Size `json:"memory,omitempty"`
+
+	// Kernel is the path of the Linux kernel.
+	Kernel string `json:"kernel,omitempty"`
+	// Initrd is the path of the initial RAM disk.
+	Initrd string `json:"initrd,omitempty"`
+	// CommandLine is the kernel command line.
+	CommandLine string `json:"commandLine,omitempty"`
+	// EFIVariableStore is the path of the EFI variable store which is used when
+	// Kernel is empty. It is created if it does not exist.
+	EFIVariableStore string `json:"efiVariableStore,omitempty"`
+
+	// MachineIdentifier is the data representation of the machine identifier. A new
+	// one is created if it is empty.
+	MachineIdentifier []byte `json:"machineIdentifier,omitempty"`
+	// HardwareModel is the data representation of the hardware model of macOS
+	// guests.
+	HardwareModel []byte `json:"hardwareModel,omitempty"`
+	// AuxiliaryStorage is the path of the auxiliary storage of macOS guests.
+	AuxiliaryStorage string `json:"auxiliaryStorage,omitempty"`
+
+	// Disks are the disk images which are attached as Virtio block devices.
+	Disks []Disk `json:"disks,omitempty"`
+	// Networks are the NAT network devices.
+	Networks []Network `json:"networks,omitempty"`
+	// SharedDirectories are the directories shared with virtio-fs.
+	SharedDirectories []SharedDirectory `json:"sharedDirectories,omitempty"`
+	// Vsock attaches a Virtio socket device.
+	Vsock bool `json:"vsock,omitempty"`
+}
+
+// Disk is a disk image of a machine.
+type Disk struct {
+	// Path is the path of the disk image.
+	Path string `json:"path"`
+	// Size is the size of the disk image which is created if it does not exist.
+	Size Size `json:"size,omitempty"`
+	// ReadOnly attaches the disk image read-only.
+	ReadOnly bool `json:"readOnly,omitempty"`
+}
+
+// Network is a NAT network device of a machine.
+type Network struct {
+	// MACAddress is the MAC address such as "52:54:00:12:34:56". A random locally
+	// administered address is used if it is empty.
+	MACAddress string `json:"macAddress,omitempty"`
+}
+
+// SharedDirectory is a directory shared with virtio-fs.
+type SharedDirectory struct {
+	// Tag is the tag to mount the directory in the guest.
+	Tag string `json:"tag"`
+	// Path is the path of the directory on the host.
+	Path string `json:"path"`
+	// ReadOnly shares the directory read-only.
+	ReadOnly bool `json:"readOnly,omitempty"`
+}
+
+// LoadSpec reads the spec in JSON from path. The relative paths in the spec are
+// resolved against the directory of path.
+func LoadSpec(path string) (*Spec, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec := &Spec{}
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(spec); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidSpec, path, err)
+	}
+	spec.resolve(filepath.Dir(path))
+	return spec, nil
+}
+
+// resolve makes the relative paths absolute against dir.
+func (s *Spec) resolve(dir string) {
+	abs := func(p *string) {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	abs(&s.Kernel)
+	abs(&s.Initrd)
+	abs(&s.EFIVariableStore)
+	abs(&s.AuxiliaryStorage)
+	for i := range s.Disks {
+		abs(&s.Disks[i].Path)
+	}
+	for i := range s.SharedDirectories {
+		abs(&s.SharedDirectories[i].Path)
+	}
+}
+
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// ValidateName reports an error if name cannot be the name of a machine.
+func ValidateName(name string) error {
+	if len(name) > 64 || !namePattern.MatchString(name) {
+		return fmt.Errorf("%w: invalid name %q", ErrInvalidSpec, name)
+	}
+	return nil
+}
+
+// Validate reports an error if the spec is invalid.
+func (s *Spec) Validate() error {
+	if err := ValidateName(s.Name); err != nil {
+		return err
+	}
+	switch s.OS {
+	case "", OSLinux:
+		if s.AuxiliaryStorage != "" || len(s.HardwareModel) > 0 {
+			return fmt.Errorf("%w: Linux guests have no hardware model and auxiliary storage", ErrInvalidSpec)
+		}
+		if s.Kernel == "" && (s.Initrd != "" || s.CommandLine != "") {
+			return fmt.Errorf("%w: initrd and commandLine require kernel", ErrInvalidSpec)
+		}
+	case OSMacOS:
+		if s.Kernel != "" || s.EFIVariableStore != "" {
+			return fmt.Errorf("%w: macOS guests have no Linux kernel and EFI variable store", ErrInvalidSpec)
+		}
+		if s.AuxiliaryStorage == "" || len(s.HardwareModel) == 0 {
+			return fmt.Errorf("%w: macOS guests require hardware model and auxiliary storage", ErrInvalidSpec)
+		}
+	default:
+		return fmt.Errorf("%w: unknown OS %q", ErrInvalidSpec, s.OS)
+	}
+	for _, d := range s.Disks {
+		if d.Path == "" {
+			return fmt.Errorf("%w: disk without path", ErrInvalidSpec)
+		}
+	}
+	for _, n := range s.Networks {
+		if n.MACAddress == "" {
+			continue
+		}
+		if hw, err := net.ParseMAC(n.MACAddress); err != nil || len(hw) != 6 {
+			return fmt.Errorf("%w: invalid MAC address %q", ErrInvalidSpec, n.MACAddress)
+		}
+	}
+	tags := make(map[string]bool)
+	for _, d := range s.SharedDirectories {
+		if d.Tag == "" || d.Path == "" || tags[d.Tag] {
+			return fmt.Errorf("%w: shared directory %q has no path or a duplicated tag", ErrInvalidSpec, d.Tag)
+		}
+		tags[d.Tag] = true
+	}
+	return nil
+}
+
+// Clone returns a deep copy of the spec.
+func (s *Spec) Clone() *Spec {
+	c := *s
+	c.MachineIdentifier = append([]byte(nil), s.MachineIdentifier...)
+	c.HardwareModel = append([]byte(nil), s.HardwareModel...)
+	c.Disks = append([]Disk(nil), s.Disks...)
+	c.Networks = append([]Network(nil), s.Networks...)
+	c.SharedDirectories = append([]SharedDirectory(nil), s.SharedDirectories...)
+	return &c
+}
+
+// WithDefaults returns a copy of the spec which has the default values for the
+// empty fields.
+func (s *Spec) WithDefaults() *Spec {
+	c := s.Clone()
+	if c.OS == "" {
+		c.OS = OSLinux
+	}
+	if c.CPUs == 0 {
+		c.CPUs = DefaultCPUs
+	}
+	if c.Memory == 0 {
+		c.Memory = DefaultMemory
+	}
+	return c
+}
+
+// NewMACAddress returns a random locally administered unicast MAC address like
+// vz.NewRandomLocallyAdministeredMACAddress.
+func NewMACAddress() (string, error) {
+	mac := make(net.HardwareAddr, 6)
+	if _, err := rand.Read(mac); err != nil {
+		return "", err
+	}
+	mac[0] = mac[0]&^0x01 | 0x02
+	return mac.String(), nil
+}
+
+// Size is a size in bytes. In JSON, it is a number of bytes or a string with a
+// binary unit such as "512MiB" and "4G".
+type Size uint64
+
+// Units of Size.
+const (
+	KiB Size = 1 << (10 * (iota + 1))
+	MiB
+	GiB
+	TiB
+)
+
+var sizeUnits = []struct {
+	suffixes []string
+	size     Size
+}{
+	{suffixes: []string{"TiB", "T", "TB"}, size: TiB},
+	{suffixes: []string{"GiB", "G", "GB"}, size: GiB},
+	{suffixes: []string{"MiB", "M", "MB"}, size: MiB},
+	{suffixes: []string{"KiB", "K", "KB"}, size: KiB},
+	{suffixes: []string{"B", ""}, size: 1},
+}
+
+// ParseSize parses a size such as "4GiB", "512M" and "1048576". The units are
+// binary, so that "1G" and "1GB" are the same as "1GiB".
+func ParseSize(s string) (Size, error) {
+	s = strings.TrimSpace(s)
+	for _, u := range sizeUnits {
+		for _, suffix := range u.suffixes {
+			num, ok := strings.CutSuffix(s, suffix)
+			if !ok {
+				continue
+			}
+			n, err := strconv.ParseUint(strings.TrimSpace(num), 10, 64)
+			if err != nil {
+				continue
+			}
+			if n > uint64(^Size(0)/u.size) {
+				return 0, fmt.Errorf("size %q is too large", s)
+			}
+			return Size(n) * u.size, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid size %q", s)
+}
+
+// String returns the size with the largest unit which divides it, such as "4GiB".
+func (s Size) String() string {
+	for _, u := range sizeUnits[:len(sizeUnits)-1] {
+		if s != 0 && s%u.size == 0 {
+			return strconv.FormatUint(uint64(s/u.size), 10) + u.suffixes[0]
+		}
+	}
+	return strconv.FormatUint(uint64(s), 10) + "B"
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler to accept a number or a string.
+func (s *Size) UnmarshalJSON(b []byte) error {
+	var n uint64
+	if err := json.Unmarshal(b, &n); err == nil {
+		*s = Size(n)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return fmt.Errorf("size must be a number or a string: %s", b)
+	}
+	size, err := ParseSize(str)
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
+
+// Set implements flag.Value.
+func (s *Size) Set(v string) error {
+	size, err := ParseSize(v)
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
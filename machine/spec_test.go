@@ -0,0 +1,173 @@
+package machine_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		in   string
+		want machine.Size
+	}{
+		{in: "1048576", want: machine.MiB},
+		{in: "512B", want: 512},
+		{in: "4GiB", want: 4 * machine.GiB},
+		{in: "4G", want: 4 * machine.GiB},
+		{in: "4 GB", want: 4 * machine.GiB},
+		{in: "16MiB", want: 16 * machine.MiB},
+		{in: "1T", want: machine.TiB},
+	}
+	for _, tc := range cases {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := machine.ParseSize(tc.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("want %d but got %d", tc.want, got)
+			}
+		})
+	}
+	for _, in := range []string{"", "G", "-1", "1.5G", "1X", "99999999999999T"} {
+		if _, err := machine.ParseSize(in); err == nil {
+			t.Fatalf("want an error for %q", in)
+		}
+	}
+}
+
+func TestSizeString(t *testing.T) {
+	cases := map[machine.Size]string{
+		0:                         "0B",
+		1000:                      "1000B",
+		2 * machine.KiB:           "2KiB",
+		machine.GiB + machine.MiB: "1025MiB",
+		4 * machine.GiB:           "4GiB",
+	}
+	for size, want := range cases {
+		if got := size.String(); got != want {
+			t.Fatalf("want %q but got %q", want, got)
+		}
+	}
+}
+
+func TestLoadSpec(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "spec.json")
+	err := os.WriteFile(path, []byte(`{
+  "name": "debian",
+  "cpus": 4,
+  "memory": "4GiB",
+  "kernel": "vmlinuz",
+  "commandLine": "console=hvc0",
+  "disks": [{"path": "disk.img", "size": 1073741824}, {"path": "/abs/seed.img", "readOnly": true}],
+  "networks": [{}],
+  "sharedDirectories": [{"tag": "home", "path": "share"}]
+}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := machine.LoadSpec(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &machine.Spec{
+		Name:        "debian",
+		CPUs:        4,
+		Memory:      4 * machine.GiB,
+		Kernel:      filepath.Join(dir, "vmlinuz"),
+		CommandLine: "console=hvc0",
+		Disks: []machine.Disk{
+			{Path: filepath.Join(dir, "disk.img"), Size: machine.GiB},
+			{Path: "/abs/seed.img", ReadOnly: true},
+		},
+		Networks:          []machine.Network{{}},
+		SharedDirectories: []machine.SharedDirectory{{Tag: "home", Path: filepath.Join(dir, "share")}},
+	}
+	if !reflect.DeepEqual(want, spec) {
+		t.Fatalf("want %+v but got %+v", want, spec)
+	}
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"name": "debian", "cpu": 4}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := machine.LoadSpec(path); !errors.Is(err, machine.ErrInvalidSpec) {
+		t.Fatalf("want ErrInvalidSpec for an unknown field but got %v", err)
+	}
+}
+
+func TestSpecValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		spec machine.Spec
+	}{
+		{name: "empty name", spec: machine.Spec{}},
+		{name: "invalid name", spec: machine.Spec{Name: "../etc"}},
+		{name: "unknown OS", spec: machine.Spec{Name: "vm", OS: "windows"}},
+		{name: "initrd without kernel", spec: machine.Spec{Name: "vm", Initrd: "initrd"}},
+		{name: "macOS without hardware model", spec: machine.Spec{Name: "vm", OS: machine.OSMacOS, AuxiliaryStorage: "aux"}},
+		{name: "macOS with kernel", spec: machine.Spec{Name: "vm", OS: machine.OSMacOS, Kernel: "vmlinuz"}},
+		{name: "disk without path", spec: machine.Spec{Name: "vm", Disks: []machine.Disk{{Size: machine.GiB}}}},
+		{name: "invalid MAC address", spec: machine.Spec{Name: "vm", Networks: []machine.Network{{MACAddress: "52:54:00"}}}},
+		{
+			name: "duplicated tag",
+			spec: machine.Spec{Name: "vm", SharedDirectories: []machine.SharedDirectory{
+				{Tag: "home", Path: "/a"}, {Tag: "home", Path: "/b"},
+			}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.spec.Validate(); !errors.Is(err, machine.ErrInvalidSpec) {
+				t.Fatalf("want ErrInvalidSpec but got %v", err)
+			}
+		})
+	}
+}
+
+func TestSpecJSON(t *testing.T) {
+	spec := (&machine.Spec{Name: "vm", Memory: 512 * machine.MiB}).WithDefaults()
+	b, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"name":"vm","os":"linux","cpus":2,"memory":"512MiB"}`
+	if string(b) != want {
+		t.Fatalf("want %s but got %s", want, b)
+	}
+	got := &machine.Spec{}
+	if err := json.Unmarshal(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(spec, got) {
+		t.Fatalf("want %+v but got %+v", spec, got)
+	}
+}
+
+func TestNewMACAddress(t *testing.T) {
+	mac, err := machine.NewMACAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &machine.Spec{Name: "vm", Networks: []machine.Network{{MACAddress: mac}}}
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hw[0]&0x01 != 0 || hw[0]&0x02 == 0 {
+		t.Fatalf("want a locally administered unicast address but got %s", mac)
+	}
+}
@@ -0,0 +1,67 @@
+package machine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// State is the execution state of a machine. The values are the same as
+// vz.VirtualMachineState.
+type State int
+
+const (
+	StateStopped State = iota
+	StateRunning
+	StatePaused
+	StateError
+	StateStarting
+	StatePausing
+	StateResuming
+	StateStopping
+	StateSaving
+	StateRestoring
+)
+
+var stateNames = [...]string{
+	StateStopped:   "stopped",
+	StateRunning:   "running",
+	StatePaused:    "paused",
+	StateError:     "error",
+	StateStarting:  "starting",
+	StatePausing:   "pausing",
+	StateResuming:  "resuming",
+	StateStopping:  "stopping",
+	StateSaving:    "saving",
+	StateRestoring: "restoring",
+}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s State) MarshalText() ([]byte, error) {
+	if s < 0 || int(s) >= len(stateNames) {
+		return nil, fmt.Errorf("machine: unknown state %d", int(s))
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *State) UnmarshalText(b []byte) error {
+	for i, name := range stateNames {
+		if strings.EqualFold(name, string(b)) {
+			*s = State(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("machine: unknown state %q", b)
+}
+
+// Active reports whether the machine is started and not stopped yet.
+func (s State) Active() bool {
+	return s != StateStopped && s != StateError
+}
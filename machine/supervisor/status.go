@@ -0,0 +1,134 @@
+package supervisor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+// Policy is the restart policy which decides whether the machine is started again
+// after it stops.
+type Policy string
+
+const (
+	// PolicyNo never restarts the machine.
+	PolicyNo Policy = "no"
+	// PolicyOnFailure restarts the machine only when it fails.
+	PolicyOnFailure Policy = "on-failure"
+	// PolicyAlways restarts the machine whenever it stops unless it is stopped by
+	// Supervisor.Stop.
+	PolicyAlways Policy = "always"
+	// PolicyUnlessStopped restarts the machine like PolicyAlways. The difference
+	// is in StartOnBoot.
+	PolicyUnlessStopped Policy = "unless-stopped"
+)
+
+// ParsePolicy parses the name of a policy.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case PolicyNo, PolicyOnFailure, PolicyAlways, PolicyUnlessStopped:
+		return p, nil
+	}
+	return "", fmt.Errorf("supervisor: unknown restart policy %q", s)
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (p *Policy) UnmarshalText(text []byte) error {
+	v, err := ParsePolicy(string(text))
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
+
+// restarts reports whether the machine which has stopped is restarted.
+func (p Policy) restarts(failed bool) bool {
+	switch p {
+	case PolicyOnFailure:
+		return failed
+	case PolicyAlways, PolicyUnlessStopped:
+		return true
+	}
+	return false
+}
+
+// StartOnBoot reports whether the machine should be started when the host or the
+// daemon which supervises it starts. stopped is whether the machine has been
+// stopped by the user before.
+func (p Policy) StartOnBoot(stopped bool) bool {
+	switch p {
+	case PolicyAlways:
+		return true
+	case PolicyUnlessStopped:
+		return !stopped
+	}
+	return false
+}
+
+// Phase is the phase of the supervision.
+type Phase string
+
+const (
+	// PhaseIdle is the phase before Run is called.
+	PhaseIdle Phase = "idle"
+	// PhaseStarting is the phase while the machine is starting.
+	PhaseStarting Phase = "starting"
+	// PhaseRunning is the phase while the machine is running.
+	PhaseRunning Phase = "running"
+	// PhaseBackoff is the phase while waiting to restart the machine.
+	PhaseBackoff Phase = "backoff"
+	// PhaseStopped is the final phase when the machine has stopped and is not
+	// restarted.
+	PhaseStopped Phase = "stopped"
+	// PhaseFailed is the final phase when the machine has failed and is not
+	// restarted.
+	PhaseFailed Phase = "failed"
+)
+
+// Health is the result of the health checks.
+type Health string
+
+const (
+	// HealthStarting is the health before the first check succeeds.
+	HealthStarting Health = "starting"
+	// HealthHealthy is the health after the last check has succeeded.
+	HealthHealthy Health = "healthy"
+	// HealthUnhealthy is the health after the checks have failed the threshold
+	// number of times.
+	HealthUnhealthy Health = "unhealthy"
+)
+
+// Status is the status of a Supervisor.
+type Status struct {
+	Phase Phase         `json:"phase"`
+	State machine.State `json:"state"`
+	// Health is empty if there is no health check.
+	Health Health `json:"health,omitempty"`
+	// Restarts is the total number of the restarts.
+	Restarts int `json:"restarts"`
+	// LastError is the message of the last failure.
+	LastError string `json:"lastError,omitempty"`
+	// StartedAt is the time when the machine has started running.
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	// NextRestart is the time of the next restart in PhaseBackoff.
+	NextRestart *time.Time `json:"nextRestart,omitempty"`
+}
+
+func (st Status) clone() Status {
+	if st.StartedAt != nil {
+		t := *st.StartedAt
+		st.StartedAt = &t
+	}
+	if st.NextRestart != nil {
+		t := *st.NextRestart
+		st.NextRestart = &t
+	}
+	return st
+}
+
+// Done reports whether the supervision has finished.
+func (st Status) Done() bool {
+	return st.Phase == PhaseStopped || st.Phase == PhaseFailed
+}
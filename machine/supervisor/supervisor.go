@@ -0,0 +1,418 @@
+// Package supervisor keeps a machine running according to a restart policy.
+//
+// A Supervisor starts the machine and watches its state. When the machine fails,
+// that is when it enters the error state, fails to start or fails its health check,
+// or when the guest shuts down by itself, the supervisor starts it again if the
+// policy says so, waiting for an exponential backoff with jitter between the
+// restarts:
+//
+//	s := supervisor.New(m,
+//		supervisor.WithPolicy(supervisor.PolicyAlways),
+//		supervisor.WithMaxRestarts(5),
+//	)
+//	go s.Run(ctx)
+//	...
+//	s.Stop(false) // the machine is not restarted after it is stopped by Stop
+//
+// The time is taken from a machine.Clock, so the supervisor can be tested with
+// fake.Clock and fake machines.
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+var (
+	// ErrFailed is returned by Run when the machine fails and the policy does not
+	// restart it.
+	ErrFailed = errors.New("supervisor: machine failed")
+
+	// ErrTooManyRestarts is returned by Run when the machine fails after it has
+	// been restarted the maximum number of times.
+	ErrTooManyRestarts = errors.New("supervisor: too many restarts")
+
+	// ErrUnhealthy is the cause of the failure when the health check fails the
+	// threshold number of times in a row.
+	ErrUnhealthy = errors.New("supervisor: health check failed")
+
+	// ErrRunning is returned by Run when it is called more than once.
+	ErrRunning = errors.New("supervisor: already running")
+)
+
+// errMachineError is the cause of the failure when the machine enters the error
+// state.
+var errMachineError = errors.New("machine entered the error state")
+
+// HealthCheck checks the health of the running machine. ctx is canceled when the
+// machine stops.
+type HealthCheck func(ctx context.Context, m machine.Machine) error
+
+// Supervisor keeps a machine running according to a restart policy.
+//
+// Supervisor consumes StateChangedNotify of the machine while Run is running.
+type Supervisor struct {
+	machine machine.Machine
+	clock   machine.Clock
+
+	policy      Policy
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	jitter      float64
+	maxRestarts int
+	resetAfter  time.Duration
+
+	check          HealthCheck
+	checkInterval  time.Duration
+	checkThreshold int
+
+	stopped chan struct{}
+
+	mu       sync.Mutex
+	status   Status
+	running  bool
+	stopping bool
+}
+
+// Option is an option for New.
+type Option func(*Supervisor)
+
+// WithPolicy sets the restart policy. The default is PolicyOnFailure.
+func WithPolicy(policy Policy) Option {
+	return func(s *Supervisor) {
+		s.policy = policy
+	}
+}
+
+// WithBackoff sets the delay before the first restart, which is doubled for each
+// consecutive restart up to max. The defaults are 1 second and 5 minutes.
+func WithBackoff(initial, max time.Duration) Option {
+	return func(s *Supervisor) {
+		s.backoff = initial
+		s.maxBackoff = max
+	}
+}
+
+// WithJitter sets the fraction of the delay which is randomly added or subtracted,
+// so that the machines which fail together are not restarted together. The
+// default is 0.1.
+func WithJitter(fraction float64) Option {
+	return func(s *Supervisor) {
+		s.jitter = fraction
+	}
+}
+
+// WithMaxRestarts sets the maximum number of the consecutive restarts. Run gives
+// up with ErrTooManyRestarts when the machine stops after it. The default is 0,
+// which means unlimited.
+func WithMaxRestarts(n int) Option {
+	return func(s *Supervisor) {
+		s.maxRestarts = n
+	}
+}
+
+// WithResetAfter sets the duration of the run after which the machine is regarded
+// as recovered, so that the backoff and the count of the consecutive restarts are
+// reset. The default is 10 minutes.
+func WithResetAfter(d time.Duration) Option {
+	return func(s *Supervisor) {
+		s.resetAfter = d
+	}
+}
+
+// WithHealthCheck sets the health check which is called at the interval while the
+// machine is running. When it fails threshold times in a row, the machine is
+// stopped and treated as failed.
+func WithHealthCheck(check HealthCheck, interval time.Duration, threshold int) Option {
+	return func(s *Supervisor) {
+		s.check = check
+		s.checkInterval = interval
+		s.checkThreshold = max(threshold, 1)
+	}
+}
+
+// WithClock sets the clock. The default is machine.SystemClock.
+func WithClock(clock machine.Clock) Option {
+	return func(s *Supervisor) {
+		s.clock = clock
+	}
+}
+
+// New creates a new Supervisor of the machine. The machine is started by Run.
+func New(m machine.Machine, opts ...Option) *Supervisor {
+	s := &Supervisor{
+		machine:    m,
+		clock:      machine.SystemClock,
+		policy:     PolicyOnFailure,
+		backoff:    time.Second,
+		maxBackoff: 5 * time.Minute,
+		jitter:     0.1,
+		resetAfter: 10 * time.Minute,
+		stopped:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.status = Status{Phase: PhaseIdle, State: m.State()}
+	return s
+}
+
+// Status returns the current status.
+func (s *Supervisor) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status.clone()
+}
+
+func (s *Supervisor) update(fn func(st *Status)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.status)
+}
+
+func (s *Supervisor) isStopping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopping
+}
+
+// Stop stops the machine, and makes Run return without restarting it. The guest is
+// requested to stop unless force is true.
+func (s *Supervisor) Stop(force bool) error {
+	s.mu.Lock()
+	if !s.stopping {
+		s.stopping = true
+		close(s.stopped)
+	}
+	s.mu.Unlock()
+	if !s.machine.State().Active() {
+		return nil
+	}
+	if force {
+		return s.machine.Stop()
+	}
+	ok, err := s.machine.RequestStop()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: the guest cannot be requested to stop", machine.ErrInvalidState)
+	}
+	return nil
+}
+
+// Run starts the machine, and restarts it according to the policy until it stops
+// for good. It returns nil when the machine stops and is not restarted, either
+// because of Stop or because of the policy. It returns an error of ErrFailed or
+// ErrTooManyRestarts when the machine fails and is not restarted, and ctx.Err()
+// when ctx is done. The machine is left as it is when ctx is done.
+func (s *Supervisor) Run(ctx context.Context) error {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return ErrRunning
+	}
+	s.running = true
+	s.mu.Unlock()
+
+	notify := s.machine.StateChangedNotify()
+	attempts := 0
+	for {
+		startedAt := s.clock.Now()
+		cause := s.runOnce(ctx, notify)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if s.isStopping() {
+			s.finish(PhaseStopped, nil)
+			return nil
+		}
+		if s.resetAfter > 0 && s.clock.Now().Sub(startedAt) >= s.resetAfter {
+			attempts = 0
+		}
+		failed := cause != nil
+		if !s.policy.restarts(failed) {
+			if failed {
+				s.finish(PhaseFailed, cause)
+				return fmt.Errorf("%w: %w", ErrFailed, cause)
+			}
+			s.finish(PhaseStopped, nil)
+			return nil
+		}
+		if s.maxRestarts > 0 && attempts >= s.maxRestarts {
+			if cause == nil {
+				cause = errors.New("machine stopped")
+			}
+			s.finish(PhaseFailed, cause)
+			return fmt.Errorf("%w: gave up after %d restarts: %w", ErrTooManyRestarts, attempts, cause)
+		}
+
+		attempts++
+		delay := s.delay(attempts)
+		next := s.clock.Now().Add(delay)
+		s.update(func(st *Status) {
+			st.Phase = PhaseBackoff
+			st.NextRestart = &next
+		})
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.stopped:
+			s.finish(PhaseStopped, nil)
+			return nil
+		case <-s.clock.After(delay):
+		}
+		s.update(func(st *Status) {
+			st.Restarts++
+		})
+	}
+}
+
+// finish records the final phase.
+func (s *Supervisor) finish(phase Phase, cause error) {
+	s.update(func(st *Status) {
+		st.Phase = phase
+		st.State = s.machine.State()
+		st.NextRestart = nil
+		if cause != nil {
+			st.LastError = cause.Error()
+		}
+	})
+}
+
+// delay returns the backoff before the attempt-th consecutive restart.
+func (s *Supervisor) delay(attempt int) time.Duration {
+	d := s.backoff
+	for i := 1; i < attempt && d < s.maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, s.maxBackoff)
+	if s.jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * s.jitter * float64(d))
+	}
+	return max(d, 0)
+}
+
+// runOnce starts the machine and waits until it stops. It returns the cause of the
+// failure, or nil if the machine has stopped without failing.
+func (s *Supervisor) runOnce(ctx context.Context, notify <-chan machine.State) error {
+	if s.isStopping() {
+		return nil
+	}
+	s.update(func(st *Status) {
+		st.Phase = PhaseStarting
+		st.NextRestart = nil
+		st.StartedAt = nil
+		st.Health = ""
+	})
+	if !s.machine.State().Active() {
+		if err := s.machine.Start(); err != nil {
+			err = fmt.Errorf("failed to start: %w", err)
+			s.update(func(st *Status) {
+				st.LastError = err.Error()
+			})
+			return err
+		}
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		healthTimer <-chan time.Time
+		results     = make(chan error)
+		failures    int
+		unhealthy   error
+		running     bool
+	)
+	enterRunning := func() {
+		if running {
+			return
+		}
+		running = true
+		now := s.clock.Now()
+		s.update(func(st *Status) {
+			st.Phase = PhaseRunning
+			st.StartedAt = &now
+			if s.check != nil {
+				st.Health = HealthStarting
+			}
+		})
+		if s.check != nil {
+			healthTimer = s.clock.After(s.checkInterval)
+		}
+	}
+	// The machine may have been running before Run is called.
+	if s.machine.State() == machine.StateRunning {
+		enterRunning()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case state := <-notify:
+			s.update(func(st *Status) {
+				st.State = state
+			})
+			switch {
+			case state == machine.StateRunning:
+				enterRunning()
+			case state == machine.StateError:
+				if unhealthy != nil {
+					return unhealthy
+				}
+				s.update(func(st *Status) {
+					st.LastError = errMachineError.Error()
+				})
+				return errMachineError
+			case !state.Active():
+				return unhealthy
+			}
+
+		case <-healthTimer:
+			healthTimer = nil
+			go func() {
+				err := s.check(runCtx, s.machine)
+				select {
+				case results <- err:
+				case <-runCtx.Done():
+				}
+			}()
+
+		case err := <-results:
+			if unhealthy != nil {
+				continue
+			}
+			if err == nil {
+				failures = 0
+				s.update(func(st *Status) {
+					st.Health = HealthHealthy
+				})
+			} else {
+				failures++
+				s.update(func(st *Status) {
+					st.LastError = err.Error()
+				})
+			}
+			if failures < s.checkThreshold {
+				healthTimer = s.clock.After(s.checkInterval)
+				continue
+			}
+			unhealthy = fmt.Errorf("%w %d times: %w", ErrUnhealthy, failures, err)
+			s.update(func(st *Status) {
+				st.Health = HealthUnhealthy
+				st.LastError = unhealthy.Error()
+			})
+			if err := s.machine.Stop(); err != nil && s.machine.State().Active() {
+				return fmt.Errorf("%w, and failed to stop: %w", unhealthy, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package supervisor_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/fake"
+	"github.com/Code-Hex/vz/v3/machine/supervisor"
+)
+
+type testSupervisor struct {
+	*supervisor.Supervisor
+	t       *testing.T
+	machine *fake.Machine
+	clock   *fake.Clock
+	done    chan error
+}
+
+func start(t *testing.T, opts ...supervisor.Option) *testSupervisor {
+	t.Helper()
+	m := fake.New(&machine.Spec{Name: "vm"})
+	clock := fake.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	opts = append([]supervisor.Option{
+		supervisor.WithClock(clock),
+		supervisor.WithJitter(0),
+	}, opts...)
+	s := &testSupervisor{
+		Supervisor: supervisor.New(m, opts...),
+		t:          t,
+		machine:    m,
+		clock:      clock,
+		done:       make(chan error, 1),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { s.done <- s.Run(ctx) }()
+	t.Cleanup(cancel)
+	s.waitFor("running", func(st supervisor.Status) bool { return st.Phase == supervisor.PhaseRunning })
+	return s
+}
+
+// waitFor waits until the status satisfies cond.
+func (s *testSupervisor) waitFor(what string, cond func(st supervisor.Status) bool) supervisor.Status {
+	s.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st := s.Status()
+		if cond(st) {
+			return st
+		}
+		if time.Now().After(deadline) {
+			s.t.Fatalf("want %s but got %+v", what, st)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// backoff waits for the backoff and returns its delay.
+func (s *testSupervisor) backoff() time.Duration {
+	s.t.Helper()
+	st := s.waitFor("backoff", func(st supervisor.Status) bool { return st.Phase == supervisor.PhaseBackoff })
+	return st.NextRestart.Sub(s.clock.Now())
+}
+
+// restart advances the clock to restart the machine in the backoff.
+func (s *testSupervisor) restart() {
+	s.t.Helper()
+	restarts := s.Status().Restarts
+	s.clock.Advance(s.backoff())
+	s.waitFor("restarted", func(st supervisor.Status) bool {
+		return st.Phase == supervisor.PhaseRunning && st.Restarts == restarts+1
+	})
+}
+
+func (s *testSupervisor) wait() error {
+	s.t.Helper()
+	select {
+	case err := <-s.done:
+		return err
+	case <-time.After(5 * time.Second):
+		s.t.Fatalf("Run did not return: %+v", s.Status())
+		return nil
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	cases := []struct {
+		policy   supervisor.Policy
+		crash    bool
+		restarts bool
+	}{
+		{policy: supervisor.PolicyNo, crash: true, restarts: false},
+		{policy: supervisor.PolicyNo, crash: false, restarts: false},
+		{policy: supervisor.PolicyOnFailure, crash: true, restarts: true},
+		{policy: supervisor.PolicyOnFailure, crash: false, restarts: false},
+		{policy: supervisor.PolicyAlways, crash: true, restarts: true},
+		{policy: supervisor.PolicyAlways, crash: false, restarts: true},
+		{policy: supervisor.PolicyUnlessStopped, crash: false, restarts: true},
+	}
+	for _, tc := range cases {
+		s := start(t, supervisor.WithPolicy(tc.policy))
+		if tc.crash {
+			s.machine.Crash()
+		} else {
+			s.machine.Shutdown()
+		}
+		if tc.restarts {
+			s.restart()
+			if s := s.machine.State(); s != machine.StateRunning {
+				t.Fatalf("%s: want running but got %s", tc.policy, s)
+			}
+			continue
+		}
+		err := s.wait()
+		st := s.Status()
+		if tc.crash {
+			if !errors.Is(err, supervisor.ErrFailed) || st.Phase != supervisor.PhaseFailed || st.LastError == "" {
+				t.Fatalf("%s: want failed but got %v, %+v", tc.policy, err, st)
+			}
+		} else if err != nil || st.Phase != supervisor.PhaseStopped {
+			t.Fatalf("%s: want stopped but got %v, %+v", tc.policy, err, st)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	s := start(t,
+		supervisor.WithBackoff(time.Second, 4*time.Second),
+		supervisor.WithResetAfter(time.Minute),
+	)
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		s.machine.Crash()
+		if got := s.backoff(); got != want {
+			t.Fatalf("want %s but got %s", want, got)
+		}
+		s.restart()
+	}
+
+	// The backoff is reset after the machine has run for a while.
+	s.clock.Advance(time.Minute)
+	s.machine.Crash()
+	if got := s.backoff(); got != time.Second {
+		t.Fatalf("want the reset backoff but got %s", got)
+	}
+	if st := s.Status(); st.Restarts != 4 || st.State != machine.StateError {
+		t.Fatalf("unexpected status %+v", st)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	s := start(t, supervisor.WithBackoff(10*time.Second, 10*time.Second), supervisor.WithJitter(0.5))
+	for i := 0; i < 10; i++ {
+		s.machine.Crash()
+		if got := s.backoff(); got < 5*time.Second || got > 15*time.Second {
+			t.Fatalf("want 10s ± 5s but got %s", got)
+		}
+		s.restart()
+	}
+}
+
+func TestMaxRestarts(t *testing.T) {
+	s := start(t, supervisor.WithMaxRestarts(2), supervisor.WithPolicy(supervisor.PolicyAlways))
+	s.machine.Crash()
+	s.restart()
+	s.machine.Shutdown()
+	s.restart()
+	s.machine.Crash()
+	err := s.wait()
+	if !errors.Is(err, supervisor.ErrTooManyRestarts) || !strings.Contains(err.Error(), "error state") {
+		t.Fatalf("want ErrTooManyRestarts but got %v", err)
+	}
+	if st := s.Status(); st.Phase != supervisor.PhaseFailed || st.Restarts != 2 || !st.Done() {
+		t.Fatalf("unexpected status %+v", st)
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	s := start(t)
+	s.machine.FailNext(fake.OpStart, errors.New("no memory"))
+	s.machine.Crash()
+	s.clock.Advance(s.backoff())
+	// The restart fails, and is retried after the next backoff.
+	st := s.waitFor("the next backoff", func(st supervisor.Status) bool {
+		return st.Phase == supervisor.PhaseBackoff && st.Restarts == 1
+	})
+	if got := st.NextRestart.Sub(s.clock.Now()); got != 2*time.Second {
+		t.Fatalf("want the doubled backoff but got %s", got)
+	}
+	if st := s.Status(); !strings.Contains(st.LastError, "no memory") {
+		t.Fatalf("want the error of the start but got %+v", st)
+	}
+	s.restart()
+	if st := s.Status(); st.Restarts != 2 {
+		t.Fatalf("want 2 restarts but got %+v", st)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	var failing atomic.Bool
+	check := func(ctx context.Context, m machine.Machine) error {
+		if failing.Load() {
+			return errors.New("no response")
+		}
+		return nil
+	}
+	s := start(t, supervisor.WithHealthCheck(check, 10*time.Second, 2))
+	if st := s.Status(); st.Health != supervisor.HealthStarting {
+		t.Fatalf("want starting but got %+v", st)
+	}
+	s.clock.BlockUntil(1)
+	s.clock.Advance(10 * time.Second)
+	s.waitFor("healthy", func(st supervisor.Status) bool { return st.Health == supervisor.HealthHealthy })
+
+	failing.Store(true)
+	s.clock.BlockUntil(1)
+	s.clock.Advance(10 * time.Second)
+	s.waitFor("a failure", func(st supervisor.Status) bool { return st.LastError != "" })
+	if st := s.Status(); st.Health != supervisor.HealthHealthy || st.Phase != supervisor.PhaseRunning {
+		t.Fatalf("want healthy until the threshold but got %+v", st)
+	}
+	s.clock.BlockUntil(1)
+	s.clock.Advance(10 * time.Second)
+
+	// The unhealthy machine is stopped and restarted.
+	s.backoff()
+	if st := s.Status(); st.Health != supervisor.HealthUnhealthy || !strings.Contains(st.LastError, "health check failed 2 times") {
+		t.Fatalf("want unhealthy but got %+v", st)
+	}
+	if s := s.machine.State(); s != machine.StateStopped {
+		t.Fatalf("want stopped but got %s", s)
+	}
+	failing.Store(false)
+	s.restart()
+	if st := s.Status(); st.Health != supervisor.HealthStarting {
+		t.Fatalf("want the health reset but got %+v", st)
+	}
+}
+
+func TestStop(t *testing.T) {
+	s := start(t, supervisor.WithPolicy(supervisor.PolicyAlways))
+	if err := s.Stop(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.wait(); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Status(); st.Phase != supervisor.PhaseStopped || st.State != machine.StateStopped || st.Restarts != 0 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+	if s.machine.StopRequests() != 1 {
+		t.Fatal("want the guest requested to stop")
+	}
+	if err := s.Run(context.Background()); !errors.Is(err, supervisor.ErrRunning) {
+		t.Fatalf("want ErrRunning but got %v", err)
+	}
+
+	// Stop cancels the backoff.
+	s = start(t)
+	s.machine.Crash()
+	s.backoff()
+	if err := s.Stop(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.wait(); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Status(); st.Phase != supervisor.PhaseStopped || st.NextRestart != nil {
+		t.Fatalf("unexpected status %+v", st)
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	m := fake.New(&machine.Spec{Name: "vm"})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s := supervisor.New(m)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	// The running machine is adopted.
+	for s.Status().Phase != supervisor.PhaseRunning {
+		if time.Now().After(deadline) {
+			t.Fatalf("want running but got %+v", s.Status())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("want context.Canceled but got %v", err)
+	}
+	if s := m.State(); s != machine.StateRunning {
+		t.Fatalf("want the machine left running but got %s", s)
+	}
+}
+
+func TestPolicyParse(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    supervisor.Policy
+		boot    bool
+		stopped bool
+	}{
+		{in: "no", want: supervisor.PolicyNo},
+		{in: "on-failure", want: supervisor.PolicyOnFailure},
+		{in: "always", want: supervisor.PolicyAlways, boot: true, stopped: true},
+		{in: "unless-stopped", want: supervisor.PolicyUnlessStopped, boot: true},
+	}
+	for _, tc := range cases {
+		var p supervisor.Policy
+		if err := p.UnmarshalText([]byte(tc.in)); err != nil {
+			t.Fatal(err)
+		}
+		if p != tc.want {
+			t.Fatalf("want %s but got %s", tc.want, p)
+		}
+		if got := p.StartOnBoot(false); got != tc.boot {
+			t.Fatalf("%s: want %v but got %v", p, tc.boot, got)
+		}
+		if got := p.StartOnBoot(true); got != tc.stopped {
+			t.Fatalf("%s: want %v for the stopped machine but got %v", p, tc.stopped, got)
+		}
+	}
+	if _, err := supervisor.ParsePolicy("sometimes"); err == nil {
+		t.Fatal("want an error")
+	}
+}
@@ -0,0 +1,144 @@
+// Package suspend suspends machines to disk when the host process exits, and
+// resumes them when it starts again, so that the guests survive the restarts of
+// the process such as vzctl and vzd.
+//
+// Suspend pauses the machine, saves its state to a file and stops the machine.
+// Start restores the machine from the file, resumes it and removes the file,
+// because the state is inconsistent with the disks once the guest runs again. If
+// the state cannot be restored, the machine is booted cold instead.
+package suspend
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+// Validate returns an error wrapping machine.ErrUnsupported if the machine of the
+// name cannot be suspended, so that the caller can fall back to the shutdown.
+func Validate(manager *machine.Manager, name string) error {
+	vm, err := manager.Get(name)
+	if err != nil {
+		return err
+	}
+	switch vm := vm.(type) {
+	case machine.SaveRestoreValidator:
+		return vm.ValidateSaveRestoreSupport()
+	case machine.StateSaver:
+		return nil
+	}
+	return fmt.Errorf("%w: %s cannot save its state", machine.ErrUnsupported, name)
+}
+
+// Suspend saves the state of the running or paused machine of the name to path and
+// stops the machine. The running machine is paused first, and resumed if the state
+// cannot be saved.
+//
+// The state is written to a temporary file next to path and renamed to it, so that
+// a partial state is never restored.
+func Suspend(manager *machine.Manager, name, path string) (err error) {
+	if err := Validate(manager, name); err != nil {
+		return err
+	}
+	info, err := manager.Info(name)
+	if err != nil {
+		return err
+	}
+	switch info.State {
+	case machine.StatePaused:
+	case machine.StateRunning:
+		if err := manager.Pause(name); err != nil {
+			return fmt.Errorf("failed to pause %s: %w", name, err)
+		}
+		defer func() {
+			if err != nil {
+				manager.Resume(name)
+			}
+		}()
+	default:
+		return fmt.Errorf("%w: cannot suspend %s which is %s", machine.ErrInvalidState, name, info.State)
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	os.Remove(tmp)
+	if err := manager.Save(name, tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to save %s: %w", name, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := manager.Stop(name, true); err != nil {
+		// The guest would run twice with the same disks if it were restored.
+		os.Remove(path)
+		return fmt.Errorf("failed to stop %s: %w", name, err)
+	}
+	return nil
+}
+
+// Result tells how Start has started the machine.
+type Result struct {
+	// Restored is true if the machine has been restored from the saved state.
+	Restored bool
+	// RestoreError is why the saved state has not been restored, so that the
+	// machine has been booted cold. It is nil otherwise.
+	RestoreError error
+}
+
+// Start starts the stopped machine of the name. If there is the state saved by
+// Suspend at path, the machine is restored from it and resumed, and the file is
+// removed. If restoring fails, the file is removed and the machine is booted cold,
+// after it is created again from its spec if the failure has left it in the error
+// state.
+//
+// The error is returned only if the machine cannot be booted.
+func Start(manager *machine.Manager, name, path string) (*Result, error) {
+	r := &Result{}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return r, manager.Start(name)
+	}
+	r.RestoreError = restore(manager, name, path)
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) && r.RestoreError == nil {
+		// The state would be restored again over the changed disks next time.
+		manager.Stop(name, true)
+		return r, fmt.Errorf("failed to remove the state of %s: %w", name, err)
+	}
+	if r.RestoreError == nil {
+		r.Restored = true
+		return r, nil
+	}
+
+	info, err := manager.Info(name)
+	if err != nil {
+		return r, err
+	}
+	if info.State != machine.StateStopped {
+		if info.State.Active() {
+			if err := manager.Stop(name, true); err != nil {
+				return r, err
+			}
+		}
+		if err := manager.Remove(name); err != nil {
+			return r, err
+		}
+		if _, err := manager.Create(info.Spec); err != nil {
+			return r, err
+		}
+	}
+	return r, manager.Start(name)
+}
+
+func restore(manager *machine.Manager, name, path string) error {
+	if err := Validate(manager, name); err != nil {
+		return err
+	}
+	if err := manager.Restore(name, path); err != nil {
+		return err
+	}
+	return manager.Resume(name)
+}
@@ -0,0 +1,161 @@
+package suspend_test
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/fake"
+	"github.com/Code-Hex/vz/v3/machine/suspend"
+)
+
+// newManager returns a manager of the running machine "vm" and the path of its
+// saved state.
+func newManager(t *testing.T) (*machine.Manager, *fake.Backend, string) {
+	t.Helper()
+	backend := fake.NewBackend()
+	m := machine.NewManager(backend)
+	if _, err := m.Create(&machine.Spec{Name: "vm"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start("vm"); err != nil {
+		t.Fatal(err)
+	}
+	return m, backend, filepath.Join(t.TempDir(), "vm.vzvmsave")
+}
+
+func wantState(t *testing.T, m *machine.Manager, want machine.State) {
+	t.Helper()
+	info, err := m.Info("vm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.State != want {
+		t.Fatalf("want %s but got %s", want, info.State)
+	}
+}
+
+func wantNoFile(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("want %s removed but got %v", path, err)
+	}
+}
+
+func TestSuspendStart(t *testing.T) {
+	m, _, path := newManager(t)
+	if err := suspend.Suspend(m, "vm", path); err != nil {
+		t.Fatal(err)
+	}
+	wantState(t, m, machine.StateStopped)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := suspend.Start(m, "vm", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Restored || r.RestoreError != nil {
+		t.Fatalf("want restored but got %+v", r)
+	}
+	wantState(t, m, machine.StateRunning)
+	wantNoFile(t, path)
+
+	// The machine boots cold without the saved state.
+	if err := m.Stop("vm", true); err != nil {
+		t.Fatal(err)
+	}
+	r, err = suspend.Start(m, "vm", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Restored || r.RestoreError != nil {
+		t.Fatalf("want booted cold but got %+v", r)
+	}
+	wantState(t, m, machine.StateRunning)
+}
+
+func TestSuspendErrors(t *testing.T) {
+	m, backend, path := newManager(t)
+	vm := backend.Machine("vm")
+
+	vm.SetSaveRestoreSupport(fmt.Errorf("%w: not savable", machine.ErrUnsupported))
+	if err := suspend.Suspend(m, "vm", path); !errors.Is(err, machine.ErrUnsupported) {
+		t.Fatalf("want ErrUnsupported but got %v", err)
+	}
+	wantState(t, m, machine.StateRunning)
+	wantNoFile(t, path)
+
+	// The machine is resumed if the state cannot be saved.
+	vm.SetSaveRestoreSupport(nil)
+	vm.FailNext(fake.OpSave, errors.New("disk full"))
+	if err := suspend.Suspend(m, "vm", path); err == nil {
+		t.Fatal("want an error")
+	}
+	wantState(t, m, machine.StateRunning)
+	wantNoFile(t, path)
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("want no temporary files but got %v", entries)
+	}
+}
+
+func TestStartFallback(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, vm *fake.Machine, path string)
+	}{
+		{
+			name: "corrupted",
+			setup: func(t *testing.T, vm *fake.Machine, path string) {
+				if err := os.WriteFile(path, []byte("corrupted"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "unsupported",
+			setup: func(t *testing.T, vm *fake.Machine, path string) {
+				vm.SetSaveRestoreSupport(fmt.Errorf("%w: not restorable", machine.ErrUnsupported))
+			},
+		},
+		{
+			// The paused machine is created again to boot.
+			name: "resume",
+			setup: func(t *testing.T, vm *fake.Machine, path string) {
+				vm.FailNext(fake.OpResume, errors.New("resume failed"))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, backend, path := newManager(t)
+			if err := suspend.Suspend(m, "vm", path); err != nil {
+				t.Fatal(err)
+			}
+			old := backend.Machine("vm")
+			tt.setup(t, old, path)
+
+			r, err := suspend.Start(m, "vm", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Restored || r.RestoreError == nil {
+				t.Fatalf("want booted cold but got %+v", r)
+			}
+			wantState(t, m, machine.StateRunning)
+			wantNoFile(t, path)
+			if recreated := backend.Machine("vm") != old; recreated != (tt.name == "resume") {
+				t.Fatalf("want recreated %v but got %v", tt.name == "resume", recreated)
+			}
+		})
+	}
+}
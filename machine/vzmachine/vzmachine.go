@@ -0,0 +1,456 @@
+//go:build darwin
+// +build darwin
+
+// Package vzmachine creates the machines of the machine package which are backed by
+// Virtualization.framework.
+package vzmachine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	infinity "github.com/Code-Hex/go-infinity-channel"
+	"github.com/Code-Hex/vz/v3"
+	"github.com/Code-Hex/vz/v3/console"
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+// Machine is a machine.Machine backed by vz.VirtualMachine. It implements
+// machine.SaveRestoreValidator, machine.Consoler, machine.VsockDialer,
+// machine.MemoryBalloon, machine.DeviceNotifier and io.Closer.
+type Machine struct {
+	vm                *vz.VirtualMachine
+	config            *vz.VirtualMachineConfiguration
+	console           *console.Stream
+	notify            *infinity.Channel[machine.State]
+	machineIdentifier []byte
+
+	mu         sync.Mutex
+	deviceSubs map[*infinity.Channel[machine.DeviceEvent]]struct{}
+}
+
+var (
+	_ machine.SaveRestoreValidator = (*Machine)(nil)
+	_ machine.Consoler             = (*Machine)(nil)
+	_ machine.VsockDialer          = (*Machine)(nil)
+	_ machine.MemoryBalloon        = (*Machine)(nil)
+	_ machine.DeviceNotifier       = (*Machine)(nil)
+	_ io.Closer                    = (*Machine)(nil)
+)
+
+// Backend is a machine.Backend which creates machines with New.
+var Backend machine.Backend = machine.BackendFunc(func(spec *machine.Spec) (machine.Machine, error) {
+	return New(spec)
+})
+
+// New creates a new machine for the spec.
+//
+// The guest boots with vz.LinuxBootLoader if the spec has a kernel, and with
+// vz.EFIBootLoader otherwise. The EFI variable store and the disk images with sizes
+// are created if they do not exist. The serial console is a Virtio console which is
+// read and written with Console method.
+func New(spec *machine.Spec) (*Machine, error) {
+	spec = spec.WithDefaults()
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	stream, err := console.NewStream("console")
+	if err != nil {
+		return nil, err
+	}
+	config, id, err := newConfiguration(spec, stream)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	vm, err := vz.NewVirtualMachine(config)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	m := &Machine{
+		vm:                vm,
+		config:            config,
+		console:           stream,
+		notify:            infinity.NewChannel[machine.State](),
+		machineIdentifier: id,
+		deviceSubs:        make(map[*infinity.Channel[machine.DeviceEvent]]struct{}),
+	}
+	go m.watch()
+	return m, nil
+}
+
+// watch converts the states of the virtual machine.
+func (m *Machine) watch() {
+	for state := range m.vm.StateChangedNotify() {
+		m.notify.In() <- machine.State(state)
+	}
+}
+
+func newConfiguration(spec *machine.Spec, stream *console.Stream) (*vz.VirtualMachineConfiguration, []byte, error) {
+	var (
+		bootLoader vz.BootLoader
+		platform   vz.PlatformConfiguration
+		id         []byte
+		err        error
+	)
+	if spec.OS == machine.OSMacOS {
+		bootLoader, platform, id, err = newMacOSPlatform(spec)
+	} else {
+		bootLoader, platform, id, err = newLinuxPlatform(spec)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cpus := min(max(spec.CPUs, vz.VirtualMachineConfigurationMinimumAllowedCPUCount()), vz.VirtualMachineConfigurationMaximumAllowedCPUCount())
+	memory := min(max(uint64(spec.Memory), vz.VirtualMachineConfigurationMinimumAllowedMemorySize()), vz.VirtualMachineConfigurationMaximumAllowedMemorySize())
+	config, err := vz.NewVirtualMachineConfiguration(bootLoader, cpus, memory)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.SetPlatformVirtualMachineConfiguration(platform)
+
+	storages := make([]vz.StorageDeviceConfiguration, 0, len(spec.Disks))
+	for _, d := range spec.Disks {
+		if err := createDisk(d); err != nil {
+			return nil, nil, err
+		}
+		attachment, err := vz.NewDiskImageStorageDeviceAttachment(d.Path, d.ReadOnly)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to attach %s: %w", d.Path, err)
+		}
+		block, err := vz.NewVirtioBlockDeviceConfiguration(attachment)
+		if err != nil {
+			return nil, nil, err
+		}
+		storages = append(storages, block)
+	}
+	config.SetStorageDevicesVirtualMachineConfiguration(storages)
+
+	networks := make([]*vz.VirtioNetworkDeviceConfiguration, 0, len(spec.Networks))
+	for _, n := range spec.Networks {
+		network, err := newNetwork(n)
+		if err != nil {
+			return nil, nil, err
+		}
+		networks = append(networks, network)
+	}
+	config.SetNetworkDevicesVirtualMachineConfiguration(networks)
+
+	shares := make([]vz.DirectorySharingDeviceConfiguration, 0, len(spec.SharedDirectories))
+	for _, d := range spec.SharedDirectories {
+		device, err := vz.NewVirtioFileSystemDeviceConfiguration(d.Tag)
+		if err != nil {
+			return nil, nil, err
+		}
+		dir, err := vz.NewSharedDirectory(d.Path, d.ReadOnly)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to share %s: %w", d.Path, err)
+		}
+		share, err := vz.NewSingleDirectoryShare(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		device.SetDirectoryShare(share)
+		shares = append(shares, device)
+	}
+	config.SetDirectorySharingDevicesVirtualMachineConfiguration(shares)
+
+	if spec.Vsock {
+		vsock, err := vz.NewVirtioSocketDeviceConfiguration()
+		if err != nil {
+			return nil, nil, err
+		}
+		config.SetSocketDevicesVirtualMachineConfiguration([]vz.SocketDeviceConfiguration{vsock})
+	}
+
+	read, write := stream.AttachmentFiles()
+	attachment, err := vz.NewFileHandleSerialPortAttachment(read, write)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := vz.NewVirtioConsoleDeviceSerialPortConfiguration(attachment)
+	if err != nil {
+		return nil, nil, err
+	}
+	config.SetSerialPortsVirtualMachineConfiguration([]*vz.VirtioConsoleDeviceSerialPortConfiguration{serial})
+
+	entropy, err := vz.NewVirtioEntropyDeviceConfiguration()
+	if err != nil {
+		return nil, nil, err
+	}
+	config.SetEntropyDevicesVirtualMachineConfiguration([]*vz.VirtioEntropyDeviceConfiguration{entropy})
+
+	balloon, err := vz.NewVirtioTraditionalMemoryBalloonDeviceConfiguration()
+	if err != nil {
+		return nil, nil, err
+	}
+	config.SetMemoryBalloonDevicesVirtualMachineConfiguration([]vz.MemoryBalloonDeviceConfiguration{balloon})
+
+	if _, err := config.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return config, id, nil
+}
+
+func newLinuxPlatform(spec *machine.Spec) (vz.BootLoader, vz.PlatformConfiguration, []byte, error) {
+	var bootLoader vz.BootLoader
+	if spec.Kernel != "" {
+		var opts []vz.LinuxBootLoaderOption
+		if spec.CommandLine != "" {
+			opts = append(opts, vz.WithCommandLine(spec.CommandLine))
+		}
+		if spec.Initrd != "" {
+			opts = append(opts, vz.WithInitrd(spec.Initrd))
+		}
+		linux, err := vz.NewLinuxBootLoader(spec.Kernel, opts...)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		bootLoader = linux
+	} else {
+		if spec.EFIVariableStore == "" {
+			return nil, nil, nil, fmt.Errorf("%w: EFI boot requires an EFI variable store", machine.ErrInvalidSpec)
+		}
+		var opts []vz.NewEFIVariableStoreOption
+		if _, err := os.Stat(spec.EFIVariableStore); errors.Is(err, fs.ErrNotExist) {
+			opts = append(opts, vz.WithCreatingEFIVariableStore())
+		}
+		store, err := vz.NewEFIVariableStore(spec.EFIVariableStore, opts...)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		efi, err := vz.NewEFIBootLoader(vz.WithEFIVariableStore(store))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		bootLoader = efi
+	}
+
+	var (
+		id  *vz.GenericMachineIdentifier
+		err error
+	)
+	if len(spec.MachineIdentifier) > 0 {
+		id, err = vz.NewGenericMachineIdentifierWithData(spec.MachineIdentifier)
+	} else {
+		id, err = vz.NewGenericMachineIdentifier()
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	platform, err := vz.NewGenericPlatformConfiguration(vz.WithGenericMachineIdentifier(id))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return bootLoader, platform, id.DataRepresentation(), nil
+}
+
+// createDisk creates the disk image of the size if it does not exist.
+func createDisk(d machine.Disk) error {
+	if _, err := os.Stat(d.Path); !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if d.Size == 0 {
+		return fmt.Errorf("%w: disk %q does not exist and has no size", machine.ErrInvalidSpec, d.Path)
+	}
+	return vz.CreateDiskImage(d.Path, int64(d.Size))
+}
+
+func newNetwork(n machine.Network) (*vz.VirtioNetworkDeviceConfiguration, error) {
+	nat, err := vz.NewNATNetworkDeviceAttachment()
+	if err != nil {
+		return nil, err
+	}
+	network, err := vz.NewVirtioNetworkDeviceConfiguration(nat)
+	if err != nil {
+		return nil, err
+	}
+	var mac *vz.MACAddress
+	if n.MACAddress != "" {
+		hw, err := net.ParseMAC(n.MACAddress)
+		if err != nil {
+			return nil, err
+		}
+		mac, err = vz.NewMACAddress(hw)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		mac, err = vz.NewRandomLocallyAdministeredMACAddress()
+		if err != nil {
+			return nil, err
+		}
+	}
+	network.SetMACAddress(mac)
+	return network, nil
+}
+
+// VirtualMachine returns the underlying virtual machine.
+func (m *Machine) VirtualMachine() *vz.VirtualMachine {
+	return m.vm
+}
+
+// Configuration returns the configuration of the virtual machine.
+func (m *Machine) Configuration() *vz.VirtualMachineConfiguration {
+	return m.config
+}
+
+// MachineIdentifier returns the data representation of the machine identifier. It
+// is the one of the spec, or the new one if the spec has none, which should be
+// stored to boot the same machine again.
+func (m *Machine) MachineIdentifier() []byte {
+	return m.machineIdentifier
+}
+
+// State returns the execution state of the machine.
+func (m *Machine) State() machine.State {
+	return machine.State(m.vm.State())
+}
+
+// StateChangedNotify returns the channel which receives the new states.
+func (m *Machine) StateChangedNotify() <-chan machine.State {
+	return m.notify.Out()
+}
+
+// Start starts the machine.
+func (m *Machine) Start() error {
+	return m.vm.Start()
+}
+
+// Pause pauses the running machine.
+func (m *Machine) Pause() error {
+	return m.vm.Pause()
+}
+
+// Resume resumes the paused machine.
+func (m *Machine) Resume() error {
+	return m.vm.Resume()
+}
+
+// RequestStop requests the guest to stop.
+func (m *Machine) RequestStop() (bool, error) {
+	return m.vm.RequestStop()
+}
+
+// Stop stops the machine immediately.
+func (m *Machine) Stop() error {
+	return m.vm.Stop()
+}
+
+// Console returns the host side of the serial console.
+func (m *Machine) Console() io.ReadWriter {
+	return m.console
+}
+
+// Close closes the serial console, so that the readers of Console get io.EOF. It
+// should be called after the machine has stopped.
+func (m *Machine) Close() error {
+	return m.console.Close()
+}
+
+// DialVsock connects to the port of the guest through the first virtio-vsock device.
+func (m *Machine) DialVsock(ctx context.Context, port uint32) (net.Conn, error) {
+	devices := m.vm.SocketDevices()
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("%w: the machine has no virtio-vsock device", machine.ErrUnsupported)
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := devices[0].Connect(port)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		done <- result{conn: conn}
+	}()
+	select {
+	case r := <-done:
+		if r.err == nil {
+			m.emitDeviceEvent(machine.DeviceEvent{
+				Kind:   machine.DeviceVsockConnected,
+				Device: strconv.FormatUint(uint64(port), 10),
+				Time:   time.Now(),
+			})
+		}
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// MemoryBalloonTargetSize returns the target size of the memory of the virtio
+// traditional memory balloon device.
+func (m *Machine) MemoryBalloonTargetSize() machine.Size {
+	for _, d := range m.vm.MemoryBalloonDevices() {
+		if b := vz.AsVirtioTraditionalMemoryBalloonDevice(d); b != nil {
+			return machine.Size(b.GetTargetVirtualMachineMemorySize())
+		}
+	}
+	return 0
+}
+
+// DeviceEvents returns the channel which receives the events of the NBD storage
+// devices and the network devices of the virtual machine, and the connections of
+// DialVsock.
+func (m *Machine) DeviceEvents(ctx context.Context) <-chan machine.DeviceEvent {
+	sub := infinity.NewChannel[machine.DeviceEvent]()
+	m.mu.Lock()
+	m.deviceSubs[sub] = struct{}{}
+	m.mu.Unlock()
+	events := m.vm.Events(ctx)
+	go func() {
+		// events is closed after ctx is done.
+		for e := range events {
+			if ev, ok := deviceEvent(e); ok {
+				sub.In() <- ev
+			}
+		}
+		m.mu.Lock()
+		delete(m.deviceSubs, sub)
+		m.mu.Unlock()
+		sub.Close()
+	}()
+	return sub.Out()
+}
+
+// emitDeviceEvent sends the event to the subscribers of DeviceEvents.
+func (m *Machine) emitDeviceEvent(ev machine.DeviceEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for sub := range m.deviceSubs {
+		sub.In() <- ev
+	}
+}
+
+// deviceEvent converts the event of the virtual machine to the event of the
+// device. It reports false for the events which are not of the devices.
+func deviceEvent(e vz.Event) (machine.DeviceEvent, bool) {
+	switch e := e.(type) {
+	case *vz.NBDConnectedEvent:
+		return machine.DeviceEvent{Kind: machine.DeviceNBDConnected, Device: e.URL, Time: e.Time}, true
+	case *vz.NBDErrorEvent:
+		return machine.DeviceEvent{Kind: machine.DeviceNBDError, Device: e.URL, Err: e.Err, Time: e.Time}, true
+	case *vz.NetworkDisconnectedEvent:
+		return machine.DeviceEvent{Kind: machine.DeviceNetworkDisconnected, Device: strconv.Itoa(e.Index), Err: e.Err, Time: e.Time}, true
+	}
+	return machine.DeviceEvent{}, false
+}
@@ -0,0 +1,33 @@
+//go:build darwin && amd64
+// +build darwin,amd64
+
+package vzmachine
+
+import (
+	"fmt"
+
+	"github.com/Code-Hex/vz/v3"
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+func newMacOSPlatform(spec *machine.Spec) (vz.BootLoader, vz.PlatformConfiguration, []byte, error) {
+	return nil, nil, nil, fmt.Errorf("%w: macOS guests require Apple silicon", machine.ErrUnsupported)
+}
+
+// SaveMachineStateToPath returns machine.ErrUnsupported because saving the state
+// requires Apple silicon.
+func (m *Machine) SaveMachineStateToPath(path string) error {
+	return fmt.Errorf("%w: saving the state requires Apple silicon", machine.ErrUnsupported)
+}
+
+// RestoreMachineStateFromURL returns machine.ErrUnsupported because restoring the
+// state requires Apple silicon.
+func (m *Machine) RestoreMachineStateFromURL(path string) error {
+	return fmt.Errorf("%w: restoring the state requires Apple silicon", machine.ErrUnsupported)
+}
+
+// ValidateSaveRestoreSupport returns machine.ErrUnsupported because saving the state
+// requires Apple silicon.
+func (m *Machine) ValidateSaveRestoreSupport() error {
+	return fmt.Errorf("%w: saving the state requires Apple silicon", machine.ErrUnsupported)
+}
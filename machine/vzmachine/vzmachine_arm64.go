@@ -0,0 +1,75 @@
+//go:build darwin && arm64
+// +build darwin,arm64
+
+package vzmachine
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/Code-Hex/vz/v3"
+	"github.com/Code-Hex/vz/v3/machine"
+)
+
+func newMacOSPlatform(spec *machine.Spec) (vz.BootLoader, vz.PlatformConfiguration, []byte, error) {
+	bootLoader, err := vz.NewMacOSBootLoader()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	model, err := vz.NewMacHardwareModelWithData(spec.HardwareModel)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var opts []vz.NewMacAuxiliaryStorageOption
+	if _, err := os.Stat(spec.AuxiliaryStorage); errors.Is(err, fs.ErrNotExist) {
+		opts = append(opts, vz.WithCreatingMacAuxiliaryStorage(model))
+	}
+	aux, err := vz.NewMacAuxiliaryStorage(spec.AuxiliaryStorage, opts...)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open the auxiliary storage: %w", err)
+	}
+	var id *vz.MacMachineIdentifier
+	if len(spec.MachineIdentifier) > 0 {
+		id, err = vz.NewMacMachineIdentifierWithData(spec.MachineIdentifier)
+	} else {
+		id, err = vz.NewMacMachineIdentifier()
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	platform, err := vz.NewMacPlatformConfiguration(
+		vz.WithMacHardwareModel(model),
+		vz.WithMacAuxiliaryStorage(aux),
+		vz.WithMacMachineIdentifier(id),
+	)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return bootLoader, platform, id.DataRepresentation(), nil
+}
+
+// SaveMachineStateToPath saves the state of the paused machine to path.
+func (m *Machine) SaveMachineStateToPath(path string) error {
+	return m.vm.SaveMachineStateToPath(path)
+}
+
+// RestoreMachineStateFromURL restores the state of the stopped machine from path.
+func (m *Machine) RestoreMachineStateFromURL(path string) error {
+	return m.vm.RestoreMachineStateFromURL(path)
+}
+
+// ValidateSaveRestoreSupport returns an error wrapping machine.ErrUnsupported if
+// the configuration of the machine cannot be saved and restored, such as on macOS
+// older than 14 or with devices which do not support it.
+func (m *Machine) ValidateSaveRestoreSupport() error {
+	ok, err := m.config.ValidateSaveRestoreSupport()
+	if err != nil {
+		return fmt.Errorf("%w: %v", machine.ErrUnsupported, err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: the configuration cannot be saved", machine.ErrUnsupported)
+	}
+	return nil
+}
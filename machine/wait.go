@@ -0,0 +1,82 @@
+package machine
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// pollInterval is the interval to check the state of a machine. The state is
+// polled instead of StateChangedNotify because the channel may be consumed by the
+// owner of the machine such as Manager.
+const pollInterval = 20 * time.Millisecond
+
+// WaitRunning waits until the machine which has been started is running.
+// ErrInvalidState is returned if the machine enters another state than starting,
+// and the error of ctx is returned if ctx is done first.
+func WaitRunning(ctx context.Context, m Machine) error {
+	for {
+		switch s := m.State(); s {
+		case StateRunning:
+			return nil
+		case StateStarting:
+		default:
+			return fmt.Errorf("%w: the machine is %s after start", ErrInvalidState, s)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// WaitReady calls ready until it succeeds while the machine is running, such as
+// to wait for a service of the guest. ErrInvalidState is returned if the machine
+// is not running, and the last error of ready is returned if ctx is done first.
+func WaitReady(ctx context.Context, m Machine, ready func(ctx context.Context) error) error {
+	for {
+		err := ready(ctx)
+		if err == nil {
+			return nil
+		}
+		if s := m.State(); s != StateRunning {
+			return fmt.Errorf("%w: the machine is %s while waiting for the guest", ErrInvalidState, s)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// WaitStopped waits until the machine is not active. The error of ctx is returned
+// if ctx is done first.
+func WaitStopped(ctx context.Context, m Machine) error {
+	for m.State().Active() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+	return nil
+}
+
+// StopAndWait stops the active machine forcibly and waits until it stops.
+// ErrInvalidState is returned if the machine is still active after timeout.
+func StopAndWait(m Machine, timeout time.Duration) error {
+	if !m.State().Active() {
+		return nil
+	}
+	if err := m.Stop(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := WaitStopped(ctx, m); err != nil {
+		return fmt.Errorf("%w: the machine is still %s", ErrInvalidState, m.State())
+	}
+	return nil
+}
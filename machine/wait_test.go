@@ -0,0 +1,96 @@
+package machine_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/fake"
+)
+
+// stuck is the machine which stays in the state.
+type stuck struct {
+	*fake.Machine
+	state machine.State
+}
+
+func (m *stuck) State() machine.State { return m.state }
+
+func TestWaitRunning(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m := fake.New(&machine.Spec{Name: "vm"})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.WaitRunning(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	m.Crash()
+	if err := machine.WaitRunning(ctx, m); !errors.Is(err, machine.ErrInvalidState) {
+		t.Fatalf("want ErrInvalidState but got %v", err)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	starting := &stuck{Machine: fake.New(&machine.Spec{Name: "vm"}), state: machine.StateStarting}
+	if err := machine.WaitRunning(short, starting); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want DeadlineExceeded but got %v", err)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m := fake.New(&machine.Spec{Name: "vm"})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	err := machine.WaitReady(ctx, m, func(ctx context.Context) error {
+		if n++; n < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+	if err != nil || n != 3 {
+		t.Fatalf("want ready after 3 calls but got %d, %v", n, err)
+	}
+
+	notReady := errors.New("not ready")
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := machine.WaitReady(short, m, func(ctx context.Context) error { return notReady }); !errors.Is(err, notReady) {
+		t.Fatalf("want the error of ready but got %v", err)
+	}
+	m.Crash()
+	if err := machine.WaitReady(ctx, m, func(ctx context.Context) error { return notReady }); !errors.Is(err, machine.ErrInvalidState) {
+		t.Fatalf("want ErrInvalidState but got %v", err)
+	}
+}
+
+func TestStopAndWait(t *testing.T) {
+	m := fake.New(&machine.Spec{Name: "vm"})
+	if err := machine.StopAndWait(m, time.Second); err != nil {
+		t.Fatalf("want no error for the stopped machine but got %v", err)
+	}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.StopAndWait(m, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if s := m.State(); s != machine.StateStopped {
+		t.Fatalf("want stopped but got %s", s)
+	}
+
+	running := &stuck{Machine: fake.New(&machine.Spec{Name: "vm"}), state: machine.StateRunning}
+	if err := running.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := machine.StopAndWait(running, 50*time.Millisecond); !errors.Is(err, machine.ErrInvalidState) {
+		t.Fatalf("want ErrInvalidState but got %v", err)
+	}
+}
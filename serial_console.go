@@ -9,6 +9,7 @@ import "C"
 import (
 	"os"
 
+	"github.com/Code-Hex/vz/v3/console"
 	"github.com/Code-Hex/vz/v3/internal/objc"
 )
 
@@ -35,6 +36,10 @@ type FileHandleSerialPortAttachment struct {
 	*pointer
 
 	*baseSerialPortAttachment
+
+	// to keep the files reachable while the attachment is alive.
+	// The finalizer of *os.File closes the file descriptor.
+	read, write *os.File
 }
 
 // NewFileHandleSerialPortAttachment initialize the FileHandleSerialPortAttachment from file handles.
@@ -56,6 +61,8 @@ func NewFileHandleSerialPortAttachment(read, write *os.File) (*FileHandleSerialP
 				C.int(write.Fd()),
 			),
 		),
+		read:  read,
+		write: write,
 	}
 	objc.SetFinalizer(attachment, func(self *FileHandleSerialPortAttachment) {
 		objc.Release(self)
@@ -63,6 +70,33 @@ func NewFileHandleSerialPortAttachment(read, write *os.File) (*FileHandleSerialP
 	return attachment, nil
 }
 
+// NewPTYSerialPortAttachment allocates a new pseudo-terminal and initialize the FileHandleSerialPortAttachment
+// from the master side of it.
+//
+// The slave side of the returned console.PTY is the terminal of the guest console. You can connect
+// to it with a terminal program like screen(1) using (*console.PTY).Name, or connect the terminal of
+// this process with (*console.PTY).Attach, which puts the terminal in raw mode and restores it on return.
+//
+// The caller is responsible for closing the pseudo-terminal after the virtual machine has been stopped.
+//
+// This is only supported on macOS 11 and newer, error will
+// be returned on older versions.
+func NewPTYSerialPortAttachment() (*FileHandleSerialPortAttachment, *console.PTY, error) {
+	if err := macOSAvailable(11); err != nil {
+		return nil, nil, err
+	}
+	pty, err := console.OpenPTY()
+	if err != nil {
+		return nil, nil, err
+	}
+	attachment, err := NewFileHandleSerialPortAttachment(pty.Master(), pty.Master())
+	if err != nil {
+		pty.Close()
+		return nil, nil, err
+	}
+	return attachment, pty, nil
+}
+
 var _ SerialPortAttachment = (*FileSerialPortAttachment)(nil)
 
 // FileSerialPortAttachment defines a serial port attachment from a file.
@@ -8,6 +8,7 @@ package vz
 import "C"
 import (
 	"fmt"
+	"log/slog"
 	"net"
 	"os"
 	"runtime"
@@ -74,15 +75,22 @@ func newVirtioSocketDeviceConfiguration(ptr unsafe.Pointer) *VirtioSocketDeviceC
 type VirtioSocketDevice struct {
 	dispatchQueue unsafe.Pointer
 	*pointer
+	log *machineLogger
 }
 
-func newVirtioSocketDevice(ptr, dispatchQueue unsafe.Pointer) *VirtioSocketDevice {
+func newVirtioSocketDevice(ptr, dispatchQueue unsafe.Pointer, log *machineLogger) *VirtioSocketDevice {
 	return &VirtioSocketDevice{
 		dispatchQueue: dispatchQueue,
 		pointer:       objc.NewPointer(ptr),
+		log:           log,
 	}
 }
 
+// logger returns the logger of the connections of the port.
+func (v *VirtioSocketDevice) logger(port uint32) *slog.Logger {
+	return v.log.get().With(slog.String(LogKeyDevice, "vsock"), slog.Uint64(LogKeyPort, uint64(port)))
+}
+
 // Listen creates a new VirtioSocketListener which is a struct that listens for port-based connection requests
 // from the guest operating system.
 //
@@ -97,7 +105,13 @@ func (v *VirtioSocketDevice) Listen(port uint32) (*VirtioSocketListener, error)
 
 	ch := make(chan connResults, 1) // should I increase more caps?
 
+	logger := v.logger(port)
 	handle := cgo.NewHandle(func(conn *VirtioSocketConnection, err error) {
+		if err != nil {
+			logger.Warn("failed to accept virtio socket connection", errorAttrs(err)...)
+		} else {
+			logger.Debug("accepted virtio socket connection", slog.Uint64("source_port", uint64(conn.SourcePort())))
+		}
 		ch <- connResults{conn, err}
 	})
 	ptr := C.newVZVirtioSocketListener(
@@ -156,6 +170,11 @@ func (v *VirtioSocketDevice) Connect(port uint32) (*VirtioSocketConnection, erro
 	)
 	result := <-ch
 	runtime.KeepAlive(v)
+	if result.err != nil {
+		v.logger(port).Debug("failed to connect to virtio socket", errorAttrs(result.err)...)
+	} else {
+		v.logger(port).Debug("connected to virtio socket", slog.Uint64("source_port", uint64(result.conn.SourcePort())))
+	}
 	return result.conn, result.err
 }
 
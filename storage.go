@@ -11,6 +11,7 @@ package vz
 */
 import "C"
 import (
+	"log/slog"
 	"os"
 	"runtime/cgo"
 	"time"
@@ -422,6 +423,9 @@ type NetworkBlockDeviceStorageDeviceAttachment struct {
 
 	didEncounterError *infinity.Channel[error]
 	connected         *infinity.Channel[struct{}]
+
+	// events are the hubs of the virtual machines which use the attachment.
+	events *eventHubs
 }
 
 var _ StorageDeviceAttachment = (*NetworkBlockDeviceStorageDeviceAttachment)(nil)
@@ -447,12 +451,24 @@ func NewNetworkBlockDeviceStorageDeviceAttachment(url string, timeout time.Durat
 
 	didEncounterError := infinity.NewChannel[error]()
 	connected := infinity.NewChannel[struct{}]()
+	events := &eventHubs{}
 
+	// The attachment is created before the virtual machines which use it, so the
+	// callbacks are logged with the logger of each of them.
 	handle := cgo.NewHandle(func(err error) {
+		attrs := []any{slog.String(LogKeyDevice, "nbd"), slog.String("url", url)}
 		if err != nil {
+			for _, logger := range events.loggers() {
+				logger.With(attrs...).Error("network block device encountered an error", errorAttrs(err)...)
+			}
+			events.emit(EventNBDError, func() Event { return &NBDErrorEvent{URL: url, Err: err} })
 			didEncounterError.In() <- err
 			return
 		}
+		for _, logger := range events.loggers() {
+			logger.With(attrs...).Info("network block device was connected")
+		}
+		events.emit(EventNBDConnected, func() Event { return &NBDConnectedEvent{URL: url} })
 		connected.In() <- struct{}{}
 	})
 
@@ -473,6 +489,7 @@ func NewNetworkBlockDeviceStorageDeviceAttachment(url string, timeout time.Durat
 		),
 		didEncounterError: didEncounterError,
 		connected:         connected,
+		events:            events,
 	}
 	if err := newNSError(nserrPtr); err != nil {
 		return nil, err
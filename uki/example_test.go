@@ -0,0 +1,36 @@
+package uki_test
+
+import (
+	"log"
+
+	"github.com/Code-Hex/vz/v3/esp"
+	"github.com/Code-Hex/vz/v3/kernel"
+	"github.com/Code-Hex/vz/v3/uki"
+)
+
+func ExampleNewImage() {
+	img, err := uki.NewImage(
+		"/usr/lib/systemd/boot/efi/linuxaa64.efi.stub",
+		"vmlinuz",
+		uki.WithInitrd("initrd.img"),
+		uki.WithCommandLine("console=hvc0 root=LABEL=root"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := img.WriteFile("linux.efi"); err != nil {
+		log.Fatal(err)
+	}
+
+	// The image is booted by the firmware as the default boot loader.
+	part, err := esp.NewImage(kernel.ArchARM64)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := part.AddBootLoaderFromPath("linux.efi"); err != nil {
+		log.Fatal(err)
+	}
+	if err := part.WriteFile("esp.img"); err != nil {
+		log.Fatal(err)
+	}
+}
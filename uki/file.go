@@ -0,0 +1,246 @@
+package uki
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"debug/pe"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Code-Hex/vz/v3/kernel"
+)
+
+// Section is a section of a unified kernel image.
+type Section struct {
+	// Name is the name of the section such as ".linux".
+	Name string
+	// Offset is the offset of the content in the file.
+	Offset int64
+	// Size is the size of the content without the padding of the file alignment.
+	Size int64
+
+	r io.ReaderAt
+}
+
+// Open returns a reader of the content of the section.
+func (s *Section) Open() *io.SectionReader {
+	return io.NewSectionReader(s.r, s.Offset, s.Size)
+}
+
+// Data returns the content of the section.
+func (s *Section) Data() ([]byte, error) {
+	b := make([]byte, s.Size)
+	if _, err := io.ReadFull(s.Open(), b); err != nil {
+		return nil, fmt.Errorf("failed to read the section %s: %w", s.Name, err)
+	}
+	return b, nil
+}
+
+// File is an opened unified kernel image.
+type File struct {
+	// Arch is the architecture of the EFI stub.
+	Arch kernel.Arch
+	// Sections are the sections of the image including the ones of the EFI stub.
+	Sections []*Section
+
+	closer io.Closer
+}
+
+// Open opens the unified kernel image at path.
+func Open(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	uf, err := NewFile(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	uf.closer = f
+	return uf, nil
+}
+
+// NewFile creates a File to read the unified kernel image from r. It returns
+// ErrNotUKI if the image does not have the .linux section.
+func NewFile(r io.ReaderAt) (*File, error) {
+	pf, err := pe.NewFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotUKI, err)
+	}
+	defer pf.Close()
+	f := &File{Arch: (&peImage{machine: pf.Machine}).arch()}
+	for _, s := range pf.Sections {
+		size := int64(s.Size)
+		// VirtualSize is the size of the content, and Size is rounded up to the
+		// file alignment.
+		if s.VirtualSize != 0 && int64(s.VirtualSize) < size {
+			size = int64(s.VirtualSize)
+		}
+		f.Sections = append(f.Sections, &Section{Name: s.Name, Offset: int64(s.Offset), Size: size, r: r})
+	}
+	if f.Section(SectionLinux) == nil {
+		return nil, ErrNotUKI
+	}
+	return f, nil
+}
+
+// Close closes the file opened by Open.
+func (f *File) Close() error {
+	if f.closer == nil {
+		return nil
+	}
+	return f.closer.Close()
+}
+
+// Section returns the section of the name, or nil if there is no such section.
+func (f *File) Section(name string) *Section {
+	for _, s := range f.Sections {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// text returns the content of the text section without the trailing NUL and spaces.
+func (f *File) text(name string) (string, error) {
+	s := f.Section(name)
+	if s == nil {
+		return "", nil
+	}
+	b, err := s.Data()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\x00 \t\r\n"), nil
+}
+
+// CommandLine returns the kernel command line, or "" if there is no .cmdline section.
+func (f *File) CommandLine() (string, error) {
+	return f.text(SectionCmdline)
+}
+
+// Uname returns the kernel release, or "" if there is no .uname section.
+func (f *File) Uname() (string, error) {
+	return f.text(SectionUname)
+}
+
+// OSRelease returns the fields of os-release(5) in the .osrel section, such as
+// "PRETTY_NAME". It returns nil if there is no .osrel section.
+func (f *File) OSRelease() (map[string]string, error) {
+	s, err := f.text(SectionOSRel)
+	if err != nil || s == "" {
+		return nil, err
+	}
+	return parseOSRelease(s), nil
+}
+
+// parseOSRelease parses the assignments of os-release(5) ignoring the invalid lines.
+func parseOSRelease(s string) map[string]string {
+	fields := make(map[string]string)
+	sc := bufio.NewScanner(strings.NewReader(s))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			// The double-quoted values may have the escape sequences of the shell.
+			if unquoted, err := strconv.Unquote(value); value[0] == '"' && err == nil {
+				value = unquoted
+			} else {
+				value = value[1 : len(value)-1]
+			}
+		}
+		fields[key] = value
+	}
+	return fields
+}
+
+// BootFiles are the contents of a unified kernel image to be booted directly by
+// vz.NewLinuxBootLoader.
+type BootFiles struct {
+	// Linux is the path of the kernel image, which may have to be decompressed with
+	// kernel.DecompressToCache.
+	Linux string
+	// Initrd is the path of the initial RAM disk, or "" if the image does not have it.
+	Initrd string
+	// CommandLine is the kernel command line.
+	CommandLine string
+}
+
+// ExtractToCache extracts the kernel and the initial RAM disk of the unified kernel
+// image at path into cacheDir. If cacheDir is empty, kernel.DefaultCacheDir is used.
+//
+// The files are named after the SHA-256 digest of the image, so that they are reused
+// until the image is changed.
+func ExtractToCache(path, cacheDir string) (*BootFiles, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	uf, err := NewFile(f)
+	if err != nil {
+		return nil, err
+	}
+	cmdLine, err := uf.CommandLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if cacheDir == "" {
+		cacheDir, err = kernel.DefaultCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the cache directory: %w", err)
+		}
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	prefix := filepath.Join(cacheDir, hex.EncodeToString(h.Sum(nil)))
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create the cache directory: %w", err)
+	}
+
+	files := &BootFiles{Linux: prefix + SectionLinux, CommandLine: cmdLine}
+	if err := extractSection(uf.Section(SectionLinux), files.Linux); err != nil {
+		return nil, err
+	}
+	if s := uf.Section(SectionInitrd); s != nil {
+		files.Initrd = prefix + SectionInitrd
+		if err := extractSection(s, files.Initrd); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// extractSection writes the content of the section to dst unless it exists.
+func extractSection(s *Section, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".uki-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, s.Open()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to extract the section %s: %w", s.Name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// rename is atomic, so that a concurrent caller never sees a partial file.
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,146 @@
+package uki
+
+import (
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/Code-Hex/vz/v3/kernel"
+)
+
+const (
+	peSectionHeaderSize = 40
+	peSecurityDirectory = 4
+
+	// sectionCharacteristics is IMAGE_SCN_CNT_INITIALIZED_DATA | IMAGE_SCN_MEM_READ.
+	sectionCharacteristics = 0x40000040
+)
+
+// peSection is a section header of a PE image.
+type peSection struct {
+	name           string
+	virtualSize    uint32
+	virtualAddress uint32
+	rawSize        uint32
+	rawOffset      uint32
+}
+
+// peImage is the parsed headers of a PE image which are needed to append sections.
+//
+// see: https://learn.microsoft.com/en-us/windows/win32/debug/pe-format
+type peImage struct {
+	b                []byte
+	machine          uint16
+	peOffset         int
+	optOffset        int
+	sectionTable     int
+	dataDirectories  int
+	numDirectories   uint32
+	sectionAlignment uint32
+	fileAlignment    uint32
+	sizeOfHeaders    uint32
+	sections         []peSection
+}
+
+func parsePE(b []byte) (*peImage, error) {
+	le := binary.LittleEndian
+	if len(b) < 0x40 || string(b[:2]) != "MZ" {
+		return nil, fmt.Errorf("no DOS header")
+	}
+	peOffset := int(le.Uint32(b[0x3c:]))
+	if peOffset+24 > len(b) || string(b[peOffset:peOffset+4]) != "PE\x00\x00" {
+		return nil, fmt.Errorf("no PE signature")
+	}
+	img := &peImage{b: b, machine: le.Uint16(b[peOffset+4:]), peOffset: peOffset}
+	numSections := int(le.Uint16(b[peOffset+6:]))
+	optSize := int(le.Uint16(b[peOffset+20:]))
+	img.optOffset = peOffset + 24
+	img.sectionTable = img.optOffset + optSize
+	if img.sectionTable+numSections*peSectionHeaderSize > len(b) || optSize < 96 {
+		return nil, fmt.Errorf("truncated headers")
+	}
+	opt := b[img.optOffset:img.sectionTable]
+	switch le.Uint16(opt) {
+	case 0x10b: // PE32
+		img.dataDirectories, img.numDirectories = img.optOffset+96, le.Uint32(opt[92:])
+	case 0x20b: // PE32+
+		if optSize < 112 {
+			return nil, fmt.Errorf("truncated optional header")
+		}
+		img.dataDirectories, img.numDirectories = img.optOffset+112, le.Uint32(opt[108:])
+	default:
+		return nil, fmt.Errorf("unknown optional header magic %#x", le.Uint16(opt))
+	}
+	if img.dataDirectories+int(img.numDirectories)*8 > img.sectionTable {
+		return nil, fmt.Errorf("truncated data directories")
+	}
+	img.sectionAlignment = le.Uint32(opt[32:])
+	img.fileAlignment = le.Uint32(opt[36:])
+	img.sizeOfHeaders = le.Uint32(opt[60:])
+	if img.fileAlignment == 0 || img.sectionAlignment == 0 {
+		return nil, fmt.Errorf("invalid alignment")
+	}
+	for i := 0; i < numSections; i++ {
+		h := b[img.sectionTable+i*peSectionHeaderSize:]
+		s := peSection{
+			name:           strings.TrimRight(string(h[:8]), "\x00"),
+			virtualSize:    le.Uint32(h[8:]),
+			virtualAddress: le.Uint32(h[12:]),
+			rawSize:        le.Uint32(h[16:]),
+			rawOffset:      le.Uint32(h[20:]),
+		}
+		if uint64(s.rawOffset)+uint64(s.rawSize) > uint64(len(b)) {
+			return nil, fmt.Errorf("section %s is truncated", s.name)
+		}
+		img.sections = append(img.sections, s)
+	}
+	return img, nil
+}
+
+// subsystem returns the subsystem in the optional header.
+func (img *peImage) subsystem() uint16 {
+	return binary.LittleEndian.Uint16(img.b[img.optOffset+68:])
+}
+
+// end returns the end of the sections in the file and in the memory.
+func (img *peImage) end() (fileEnd, virtualEnd uint32) {
+	fileEnd = img.sizeOfHeaders
+	for _, s := range img.sections {
+		fileEnd = max(fileEnd, s.rawOffset+s.rawSize)
+		virtualEnd = max(virtualEnd, s.virtualAddress+max(s.virtualSize, s.rawSize))
+	}
+	return fileEnd, virtualEnd
+}
+
+// headerSpace returns the number of the section headers which can be added without
+// moving the sections.
+func (img *peImage) headerSpace() int {
+	limit := img.sizeOfHeaders
+	for _, s := range img.sections {
+		if s.rawSize > 0 {
+			limit = min(limit, s.rawOffset)
+		}
+	}
+	used := img.sectionTable + len(img.sections)*peSectionHeaderSize
+	if int(limit) < used {
+		return 0
+	}
+	return (int(limit) - used) / peSectionHeaderSize
+}
+
+func (img *peImage) arch() kernel.Arch {
+	switch img.machine {
+	case pe.IMAGE_FILE_MACHINE_ARM64:
+		return kernel.ArchARM64
+	case pe.IMAGE_FILE_MACHINE_AMD64:
+		return kernel.ArchX86_64
+	case pe.IMAGE_FILE_MACHINE_I386:
+		return kernel.ArchX86
+	}
+	return kernel.ArchUnknown
+}
+
+func alignUp(n, align uint32) uint32 {
+	return (n + align - 1) / align * align
+}
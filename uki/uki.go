@@ -0,0 +1,371 @@
+// Package uki assembles and inspects unified kernel images (UKI), which are single
+// EFI applications that have a Linux kernel, an initial RAM disk and a kernel command
+// line. A UKI can be booted by vz.NewEFIBootLoader from an EFI System Partition
+// created by the esp package, and its contents can be booted directly by
+// vz.NewLinuxBootLoader.
+//
+// A UKI is built like ukify of systemd: the sections are appended to the systemd EFI
+// stub (linuxaa64.efi.stub or linuxx64.efi.stub), which loads the kernel from them.
+//
+// see: https://uapi-group.org/specifications/specs/unified_kernel_image/
+package uki
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Code-Hex/vz/v3/kernel"
+)
+
+// Names of the sections of UKIs.
+const (
+	SectionLinux   = ".linux"
+	SectionInitrd  = ".initrd"
+	SectionCmdline = ".cmdline"
+	SectionOSRel   = ".osrel"
+	SectionUname   = ".uname"
+	SectionDTB     = ".dtb"
+	SectionSplash  = ".splash"
+)
+
+var (
+	// ErrInvalidStub is returned when the EFI stub is not a PE image of an EFI
+	// application which has enough room for the sections.
+	ErrInvalidStub = errors.New("uki: invalid EFI stub")
+
+	// ErrInvalidKernel is returned when the kernel is not for the architecture of
+	// the EFI stub or it is not built with the EFI stub of Linux.
+	ErrInvalidKernel = errors.New("uki: invalid kernel image")
+
+	// ErrNotUKI is returned when a PE image does not have the .linux section.
+	ErrNotUKI = errors.New("uki: not a unified kernel image")
+)
+
+// subsystemEFIApplication is the subsystem of the EFI applications in the PE optional
+// header.
+const subsystemEFIApplication = 10
+
+// section is a section which is appended to the EFI stub. Its content is data or
+// the concatenation of the files at paths.
+type section struct {
+	name  string
+	data  []byte
+	paths []string
+}
+
+// Image is a unified kernel image to be assembled.
+//
+// The files are read when the image is written, and the other contents are written
+// in the order of ukify, where .linux is the last section.
+type Image struct {
+	stub     *peImage
+	linux    string
+	initrds  []string
+	cmdline  *string
+	osRel    *string
+	uname    *string
+	dtb      string
+	sections []section
+}
+
+// ImageOption is an option for NewImage.
+type ImageOption func(*Image) error
+
+// WithInitrd adds the initial RAM disks. Multiple initial RAM disks are concatenated
+// in order, which the kernel unpacks as a single cpio archive.
+func WithInitrd(paths ...string) ImageOption {
+	return func(img *Image) error {
+		for _, path := range paths {
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("invalid initial RAM disk path: %w", err)
+			}
+		}
+		img.initrds = append(img.initrds, paths...)
+		return nil
+	}
+}
+
+// WithCommandLine sets the kernel command line.
+func WithCommandLine(cmdLine string) ImageOption {
+	return func(img *Image) error {
+		img.cmdline = &cmdLine
+		return nil
+	}
+}
+
+// WithKernelCommandLine sets the kernel command line built with kernel.CommandLine.
+// An error is returned if the command line can not be represented as a string.
+func WithKernelCommandLine(cmdLine *kernel.CommandLine) ImageOption {
+	return func(img *Image) error {
+		if err := cmdLine.Validate(); err != nil {
+			return err
+		}
+		return WithCommandLine(cmdLine.String())(img)
+	}
+}
+
+// WithOSRelease sets the content of os-release(5) of the operating system, which the
+// boot loaders show as the name of the entry.
+func WithOSRelease(osRelease string) ImageOption {
+	return func(img *Image) error {
+		img.osRel = &osRelease
+		return nil
+	}
+}
+
+// WithUname sets the kernel release such as "6.1.0-13-arm64". By default, it is read
+// from the kernel image, and the section is omitted if the kernel does not have it.
+func WithUname(uname string) ImageOption {
+	return func(img *Image) error {
+		img.uname = &uname
+		return nil
+	}
+}
+
+// WithDeviceTree sets the device tree blob.
+func WithDeviceTree(path string) ImageOption {
+	return func(img *Image) error {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("invalid device tree path: %w", err)
+		}
+		img.dtb = path
+		return nil
+	}
+}
+
+// WithSection adds a section which has data, such as ".splash" or ".sbat". The name
+// is up to 8 bytes.
+func WithSection(name string, data []byte) ImageOption {
+	return func(img *Image) error {
+		if len(name) == 0 || len(name) > 8 {
+			return fmt.Errorf("uki: invalid section name %q", name)
+		}
+		img.sections = append(img.sections, section{name: name, data: data})
+		return nil
+	}
+}
+
+// NewImage creates a new Image which has the EFI stub at stub and the Linux kernel at
+// linux. The kernel must be built with the EFI stub of Linux, and may be compressed
+// in an EFI zboot image (vmlinuz.efi).
+func NewImage(stub, linux string, opts ...ImageOption) (*Image, error) {
+	b, err := os.ReadFile(stub)
+	if err != nil {
+		return nil, err
+	}
+	s, err := parsePE(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidStub, err)
+	}
+	if s.subsystem() != subsystemEFIApplication {
+		return nil, fmt.Errorf("%w: the subsystem is %d but want an EFI application", ErrInvalidStub, s.subsystem())
+	}
+	for _, sec := range s.sections {
+		if sec.name == SectionLinux {
+			return nil, fmt.Errorf("%w: it is already a unified kernel image", ErrInvalidStub)
+		}
+	}
+
+	info, err := inspectKernel(linux)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKernel, err)
+	}
+	if info.Arch != s.arch() {
+		return nil, fmt.Errorf("%w: the kernel is for %s but the EFI stub is for %s", ErrInvalidKernel, info.Arch, s.arch())
+	}
+
+	img := &Image{stub: s, linux: linux}
+	for _, opt := range opts {
+		if err := opt(img); err != nil {
+			return nil, err
+		}
+	}
+	if img.uname == nil && info.Version != "" {
+		img.uname = &info.Version
+	}
+	return img, nil
+}
+
+// inspectKernel inspects the kernel image at path, which must start with the DOS
+// header of the EFI stub.
+func inspectKernel(path string) (*kernel.Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != "MZ" {
+		return nil, fmt.Errorf("the kernel is not built with the EFI stub")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return kernel.InspectReader(f)
+}
+
+// contents returns the sections to append in order.
+func (img *Image) contents() []section {
+	var sections []section
+	addString := func(name string, s *string) {
+		if s != nil {
+			sections = append(sections, section{name: name, data: []byte(*s)})
+		}
+	}
+	addString(SectionOSRel, img.osRel)
+	addString(SectionCmdline, img.cmdline)
+	if img.dtb != "" {
+		sections = append(sections, section{name: SectionDTB, paths: []string{img.dtb}})
+	}
+	addString(SectionUname, img.uname)
+	sections = append(sections, img.sections...)
+	if len(img.initrds) > 0 {
+		sections = append(sections, section{name: SectionInitrd, paths: img.initrds})
+	}
+	return append(sections, section{name: SectionLinux, paths: []string{img.linux}})
+}
+
+// size returns the size of the content of the section.
+func (s *section) size() (int64, error) {
+	if s.paths == nil {
+		return int64(len(s.data)), nil
+	}
+	var size int64
+	for _, path := range s.paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+	}
+	return size, nil
+}
+
+func (s *section) writeTo(w io.Writer, size int64) error {
+	if s.paths == nil {
+		_, err := w.Write(s.data)
+		return err
+	}
+	var written int64
+	for _, path := range s.paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(w, io.LimitReader(f, size-written))
+		f.Close()
+		written += n
+		if err != nil {
+			return fmt.Errorf("failed to copy %q: %w", path, err)
+		}
+	}
+	if written != size {
+		return fmt.Errorf("failed to copy the section %s: %w", s.name, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// WriteTo writes the unified kernel image to w.
+//
+// The checksum and the signature of the EFI stub are cleared since they do not match
+// the image, so the image must be signed again to be booted with Secure Boot.
+func (img *Image) WriteTo(w io.Writer) (int64, error) {
+	le := binary.LittleEndian
+	stub := img.stub
+	sections := img.contents()
+	if n := stub.headerSpace(); n < len(sections) {
+		return 0, fmt.Errorf("%w: the headers have room for %d sections but %d are needed", ErrInvalidStub, n, len(sections))
+	}
+
+	fileEnd, virtualEnd := stub.end()
+	// head is the EFI stub without the data after the sections, such as the
+	// certificate table.
+	head := bytes.Clone(stub.b[:fileEnd])
+	offset := alignUp(fileEnd, stub.fileAlignment)
+	va := alignUp(virtualEnd, stub.sectionAlignment)
+	sizes := make([]int64, len(sections))
+	var initializedData uint32
+	for i := range sections {
+		s := &sections[i]
+		size, err := s.size()
+		if err != nil {
+			return 0, err
+		}
+		if uint64(offset)+uint64(size) > 0xffffffff {
+			return 0, fmt.Errorf("uki: the image is too large")
+		}
+		sizes[i] = size
+		rawSize := alignUp(uint32(size), stub.fileAlignment)
+		h := head[stub.sectionTable+(len(stub.sections)+i)*peSectionHeaderSize:]
+		copy(h[:8], s.name)
+		le.PutUint32(h[8:], uint32(size))
+		le.PutUint32(h[12:], va)
+		le.PutUint32(h[16:], rawSize)
+		le.PutUint32(h[20:], offset)
+		le.PutUint32(h[36:], sectionCharacteristics)
+		offset += rawSize
+		va = alignUp(va+uint32(size), stub.sectionAlignment)
+		initializedData += rawSize
+	}
+
+	opt := head[stub.optOffset:]
+	le.PutUint16(head[stub.peOffset+6:], uint16(len(stub.sections)+len(sections)))
+	le.PutUint32(opt[8:], le.Uint32(opt[8:])+initializedData)
+	le.PutUint32(opt[56:], va) // SizeOfImage
+	le.PutUint32(opt[64:], 0)  // CheckSum
+	if stub.numDirectories > peSecurityDirectory {
+		// The certificate table is dropped with the data after the sections.
+		dir := head[stub.dataDirectories+peSecurityDirectory*8:]
+		le.PutUint64(dir, 0)
+	}
+
+	cw := &countWriter{w: w}
+	if _, err := cw.Write(head); err != nil {
+		return cw.n, err
+	}
+	pad := func() error {
+		_, err := cw.Write(make([]byte, alignUp(uint32(cw.n), stub.fileAlignment)-uint32(cw.n)))
+		return err
+	}
+	if err := pad(); err != nil {
+		return cw.n, err
+	}
+	for i := range sections {
+		if err := sections[i].writeTo(cw, sizes[i]); err != nil {
+			return cw.n, err
+		}
+		if err := pad(); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, nil
+}
+
+// WriteFile writes the unified kernel image to the file at path.
+func (img *Image) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := img.WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to write the unified kernel image: %w", err)
+	}
+	return f.Close()
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
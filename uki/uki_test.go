@@ -0,0 +1,240 @@
+package uki_test
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Code-Hex/vz/v3/kernel"
+	"github.com/Code-Hex/vz/v3/uki"
+)
+
+// createStub creates a minimal EFI application like the systemd EFI stub, which has
+// a .text section after the headers of sizeOfHeaders bytes.
+func createStub(t *testing.T, machine uint16, sizeOfHeaders uint32) string {
+	t.Helper()
+	le := binary.LittleEndian
+	const peOffset, optSize, textOffset = 0x40, 112 + 16*8, 0x1000
+	b := make([]byte, textOffset+0x200)
+	copy(b, "MZ")
+	le.PutUint32(b[0x3c:], peOffset)
+	copy(b[peOffset:], "PE\x00\x00")
+	fh := b[peOffset+4:]
+	le.PutUint16(fh[0:], machine)
+	le.PutUint16(fh[2:], 1) // number of sections
+	le.PutUint16(fh[16:], optSize)
+	le.PutUint16(fh[18:], 0x22)
+	opt := b[peOffset+24:]
+	le.PutUint16(opt[0:], 0x20b)
+	le.PutUint32(opt[16:], 0x1000) // entry point
+	le.PutUint32(opt[32:], 0x1000) // section alignment
+	le.PutUint32(opt[36:], 0x200)  // file alignment
+	le.PutUint32(opt[56:], 0x2000) // size of image
+	le.PutUint32(opt[60:], sizeOfHeaders)
+	le.PutUint16(opt[68:], 10) // EFI application
+	le.PutUint32(opt[108:], 16)
+	text := b[peOffset+24+optSize:]
+	copy(text, ".text")
+	le.PutUint32(text[8:], 0x200)
+	le.PutUint32(text[12:], 0x1000)
+	le.PutUint32(text[16:], 0x200)
+	le.PutUint32(text[20:], textOffset)
+	le.PutUint32(text[36:], 0x60000020)
+	copy(b[textOffset:], "stub code")
+
+	path := filepath.Join(t.TempDir(), "linux.efi.stub")
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// createKernel creates an arm64 Image which has the EFI stub and the version string.
+func createKernel(t *testing.T) string {
+	t.Helper()
+	b := make([]byte, 0x1234)
+	copy(b, "MZ")
+	binary.LittleEndian.PutUint64(b[16:], uint64(len(b))) // image size
+	copy(b[0x38:], "ARM\x64")
+	copy(b[0x100:], "Linux version 6.6.0-test (builder@host) #1 SMP\x00")
+	b[len(b)-1] = 0xff
+	path := filepath.Join(t.TempDir(), "Image")
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestImage(t *testing.T) {
+	stub := createStub(t, pe.IMAGE_FILE_MACHINE_ARM64, 0x400)
+	linux := createKernel(t)
+	cmdLine := kernel.NewCommandLine().SetConsole(kernel.ConsoleHVC0).Set("root", "LABEL=root")
+	img, err := uki.NewImage(stub, linux,
+		uki.WithInitrd(writeFile(t, "initrd1", "first"), writeFile(t, "initrd2", "second")),
+		uki.WithKernelCommandLine(cmdLine),
+		uki.WithOSRelease("ID=debian\nPRETTY_NAME=\"Debian GNU/Linux 12 (bookworm)\"\nVERSION_ID='12'\n"),
+		uki.WithSection(".sbat", []byte("sbat,1\n")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "linux.efi")
+	if err := img.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// The image is a valid PE image for debug/pe.
+	pf, err := pe.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	var names []string
+	for _, s := range pf.Sections {
+		names = append(names, s.Name)
+		if s.Offset%0x200 != 0 || s.VirtualAddress%0x1000 != 0 {
+			t.Fatalf("%s: want the aligned section but got %#x %#x", s.Name, s.Offset, s.VirtualAddress)
+		}
+	}
+	want := []string{".text", ".osrel", ".cmdline", ".uname", ".sbat", ".initrd", ".linux"}
+	if !reflect.DeepEqual(want, names) {
+		t.Fatalf("want %q but got %q", want, names)
+	}
+	last := pf.Sections[len(pf.Sections)-1]
+	if size := pf.OptionalHeader.(*pe.OptionalHeader64).SizeOfImage; size != last.VirtualAddress+0x2000 {
+		t.Fatalf("want the size of image %#x but got %#x", last.VirtualAddress+0x2000, size)
+	}
+	text, err := pf.Section(".text").Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(text, []byte("stub code")) {
+		t.Fatalf("want the code of the stub but got %q", text[:16])
+	}
+
+	f, err := uki.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Arch != kernel.ArchARM64 {
+		t.Fatalf("want %s but got %s", kernel.ArchARM64, f.Arch)
+	}
+	if got, err := f.CommandLine(); err != nil || got != cmdLine.String() {
+		t.Fatalf("want %q but got %q (%v)", cmdLine.String(), got, err)
+	}
+	if got, err := f.Uname(); err != nil || got != "6.6.0-test" {
+		t.Fatalf("want the uname of the kernel but got %q (%v)", got, err)
+	}
+	osRel, err := f.OSRelease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantOSRel := map[string]string{"ID": "debian", "PRETTY_NAME": "Debian GNU/Linux 12 (bookworm)", "VERSION_ID": "12"}
+	if !reflect.DeepEqual(wantOSRel, osRel) {
+		t.Fatalf("want %v but got %v", wantOSRel, osRel)
+	}
+	initrd, err := f.Section(uki.SectionInitrd).Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(initrd) != "firstsecond" {
+		t.Fatalf("want the concatenated initial RAM disks but got %q", initrd)
+	}
+	wantLinux, err := os.ReadFile(linux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := f.Section(uki.SectionLinux).Data(); err != nil || !bytes.Equal(wantLinux, got) {
+		t.Fatalf("want the kernel of %d bytes but got %d (%v)", len(wantLinux), len(got), err)
+	}
+}
+
+func TestExtractToCache(t *testing.T) {
+	stub := createStub(t, pe.IMAGE_FILE_MACHINE_ARM64, 0x400)
+	linux := createKernel(t)
+	img, err := uki.NewImage(stub, linux, uki.WithInitrd(writeFile(t, "initrd", "initrd")), uki.WithCommandLine("quiet\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "linux.efi")
+	if err := img.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	cacheDir := t.TempDir()
+	files, err := uki.ExtractToCache(path, cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files.CommandLine != "quiet" {
+		t.Fatalf("want the command line without NUL but got %q", files.CommandLine)
+	}
+	if filepath.Dir(files.Linux) != cacheDir || filepath.Dir(files.Initrd) != cacheDir {
+		t.Fatalf("want the files in %s but got %+v", cacheDir, files)
+	}
+	if info, err := kernel.Inspect(files.Linux); err != nil || info.Version != "6.6.0-test" {
+		t.Fatalf("want the extracted kernel but got %+v (%v)", info, err)
+	}
+	if b, err := os.ReadFile(files.Initrd); err != nil || string(b) != "initrd" {
+		t.Fatalf("want the extracted initial RAM disk but got %q (%v)", b, err)
+	}
+	again, err := uki.ExtractToCache(path, cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, again) {
+		t.Fatalf("want %+v but got %+v", files, again)
+	}
+}
+
+func TestNewImageError(t *testing.T) {
+	arm64Stub := createStub(t, pe.IMAGE_FILE_MACHINE_ARM64, 0x400)
+	x86Stub := createStub(t, pe.IMAGE_FILE_MACHINE_AMD64, 0x400)
+	linux := createKernel(t)
+	notEFI := writeFile(t, "Image", "\x00\x00not a kernel")
+	cases := []struct {
+		name  string
+		stub  string
+		linux string
+		want  error
+	}{
+		{name: "stub is not PE", stub: linux, linux: linux, want: uki.ErrInvalidStub},
+		{name: "other architecture", stub: x86Stub, linux: linux, want: uki.ErrInvalidKernel},
+		{name: "no EFI stub", stub: arm64Stub, linux: notEFI, want: uki.ErrInvalidKernel},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := uki.NewImage(tc.stub, tc.linux); !errors.Is(err, tc.want) {
+				t.Fatalf("want %v but got %v", tc.want, err)
+			}
+		})
+	}
+
+	// The headers have room only for 2 sections.
+	small := createStub(t, pe.IMAGE_FILE_MACHINE_ARM64, 0x40+24+112+16*8+40*3)
+	img, err := uki.NewImage(small, linux, uki.WithCommandLine("quiet"), uki.WithOSRelease("ID=test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.WriteFile(filepath.Join(t.TempDir(), "linux.efi")); !errors.Is(err, uki.ErrInvalidStub) {
+		t.Fatalf("want %v but got %v", uki.ErrInvalidStub, err)
+	}
+	if _, err := uki.Open(arm64Stub); !errors.Is(err, uki.ErrNotUKI) {
+		t.Fatalf("want %v but got %v", uki.ErrNotUKI, err)
+	}
+}
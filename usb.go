@@ -7,6 +7,7 @@ package vz
 */
 import "C"
 import (
+	"log/slog"
 	"runtime/cgo"
 	"unsafe"
 
@@ -71,15 +72,35 @@ func NewXHCIControllerConfiguration() (*XHCIControllerConfiguration, error) {
 type USBController struct {
 	dispatchQueue unsafe.Pointer
 	*pointer
+	log    *machineLogger
+	events *eventHub
 }
 
-func newUSBController(ptr, dispatchQueue unsafe.Pointer) *USBController {
+func newUSBController(ptr, dispatchQueue unsafe.Pointer, log *machineLogger, events *eventHub) *USBController {
 	return &USBController{
 		dispatchQueue: dispatchQueue,
 		pointer:       objc.NewPointer(ptr),
+		log:           log,
+		events:        events,
 	}
 }
 
+// complete logs the completion of the attach or detach operation of the device, and
+// emits its event.
+func (u *USBController) complete(op string, device USBDevice, err error) {
+	if op == "attach" {
+		u.events.emit(EventUSBAttached, &USBAttachedEvent{UUID: device.UUID(), Err: err})
+	} else {
+		u.events.emit(EventUSBDetached, &USBDetachedEvent{UUID: device.UUID(), Err: err})
+	}
+	logger := u.log.get().With(slog.String(LogKeyDevice, "usb"), slog.String("uuid", device.UUID()))
+	if err != nil {
+		logger.Warn("failed to "+op+" usb device", errorAttrs(err)...)
+		return
+	}
+	logger.Info("usb device " + op + "ed")
+}
+
 //export usbAttachDetachCompletionHandler
 func usbAttachDetachCompletionHandler(cgoHandleUintptr C.uintptr_t, errPtr unsafe.Pointer) {
 	cgoHandle := cgo.Handle(cgoHandleUintptr)
@@ -117,7 +138,9 @@ func (u *USBController) Attach(device USBDevice) error {
 		u.dispatchQueue,
 		C.uintptr_t(handle),
 	)
-	return <-errCh
+	err := <-errCh
+	u.complete("attach", device, err)
+	return err
 }
 
 // Detach detaches a USB device.
@@ -142,7 +165,9 @@ func (u *USBController) Detach(device USBDevice) error {
 		u.dispatchQueue,
 		C.uintptr_t(handle),
 	)
-	return <-errCh
+	err := <-errCh
+	u.complete("detach", device, err)
+	return err
 }
 
 // USBDevices return a list of USB devices attached to controller.
@@ -10,7 +10,9 @@ package vz
 */
 import "C"
 import (
+	"context"
 	"fmt"
+	"log/slog"
 	"runtime/cgo"
 	"sync"
 	"unsafe"
@@ -102,16 +104,37 @@ type VirtualMachine struct {
 
 	config *VirtualMachineConfiguration
 
+	log          *machineLogger
+	events       *eventHub
+	eventHistory int
+
 	mu sync.RWMutex
 }
 
 type machineState struct {
 	state       VirtualMachineState
 	stateNotify *infinity.Channel[VirtualMachineState]
+	log         *machineLogger
+	events      *eventHub
 
 	mu sync.RWMutex
 }
 
+// NewVirtualMachineOption is an option type to initialize a new VirtualMachine.
+type NewVirtualMachineOption func(*VirtualMachine)
+
+// WithVirtualMachineLogger sets the logger of the virtual machine which logs the
+// state changes, the disconnections of the network attachments, and the operations
+// of the USB controllers and the socket devices. The records have the identifier of
+// the virtual machine with LogKeyVM.
+//
+// The package-level logger set by SetLogger is used by default.
+func WithVirtualMachineLogger(l *slog.Logger) NewVirtualMachineOption {
+	return func(v *VirtualMachine) {
+		v.log.logger = l
+	}
+}
+
 // NewVirtualMachine creates a new VirtualMachine with VirtualMachineConfiguration.
 //
 // The configuration must be valid. Validation can be performed at runtime with (*VirtualMachineConfiguration).Validate() method.
@@ -119,43 +142,71 @@ type machineState struct {
 //
 // This is only supported on macOS 11 and newer, error will
 // be returned on older versions.
-func NewVirtualMachine(config *VirtualMachineConfiguration) (*VirtualMachine, error) {
+func NewVirtualMachine(config *VirtualMachineConfiguration, opts ...NewVirtualMachineOption) (*VirtualMachine, error) {
 	if err := macOSAvailable(11); err != nil {
 		return nil, err
 	}
 
 	// should not call Free function for this string.
 	cs := (*char)(objc.GetUUID())
+	id := cs.String()
+	v := &VirtualMachine{
+		id:           id,
+		config:       config,
+		log:          &machineLogger{id: id},
+		eventHistory: DefaultEventHistory,
+	}
+	for _, optFunc := range opts {
+		optFunc(v)
+	}
+	v.events = newEventHub(v.log, v.eventHistory)
+	// The hub is removed from the attachments when the virtual machine is
+	// finalized, because the attachments may outlive it.
+	var nbds []*NetworkBlockDeviceStorageDeviceAttachment
+	if config != nil {
+		for _, sc := range config.storageDeviceConfiguration {
+			if nbd, ok := sc.Attachment().(*NetworkBlockDeviceStorageDeviceAttachment); ok {
+				nbd.events.add(v.events)
+				nbds = append(nbds, nbd)
+			}
+		}
+	}
+
 	dispatchQueue := C.makeDispatchQueue(cs.CString())
 
 	machineState := &machineState{
 		state:       VirtualMachineState(0),
 		stateNotify: infinity.NewChannel[VirtualMachineState](),
+		log:         v.log,
+		events:      v.events,
 	}
 	stateHandle := cgo.NewHandle(machineState)
 
 	disconnectedIn := infinity.NewChannel[*disconnected]()
 	disconnectedOut := infinity.NewChannel[*DisconnectedError]()
-	disconnectedHandle := cgo.NewHandle(disconnectedIn)
+	disconnectedHandle := cgo.NewHandle(&disconnectedHandler{
+		ch:     disconnectedIn,
+		log:    v.log,
+		events: v.events,
+	})
 
-	v := &VirtualMachine{
-		id: cs.String(),
-		pointer: objc.NewPointer(
-			C.newVZVirtualMachineWithDispatchQueue(
-				objc.Ptr(config),
-				dispatchQueue,
-				C.uintptr_t(stateHandle),
-				C.uintptr_t(disconnectedHandle),
-			),
+	v.pointer = objc.NewPointer(
+		C.newVZVirtualMachineWithDispatchQueue(
+			objc.Ptr(config),
+			dispatchQueue,
+			C.uintptr_t(stateHandle),
+			C.uintptr_t(disconnectedHandle),
 		),
-		dispatchQueue:   dispatchQueue,
-		machineState:    machineState,
-		disconnectedIn:  disconnectedIn,
-		disconnectedOut: disconnectedOut,
-		config:          config,
-	}
+	)
+	v.dispatchQueue = dispatchQueue
+	v.machineState = machineState
+	v.disconnectedIn = disconnectedIn
+	v.disconnectedOut = disconnectedOut
 
 	objc.SetFinalizer(v, func(self *VirtualMachine) {
+		for _, nbd := range nbds {
+			nbd.events.remove(self.events)
+		}
 		self.finalize()
 		stateHandle.Delete()
 	})
@@ -182,7 +233,7 @@ func (v *VirtualMachine) SocketDevices() []*VirtioSocketDevice {
 	ptrs := nsArray.ToPointerSlice()
 	socketDevices := make([]*VirtioSocketDevice, len(ptrs))
 	for i, ptr := range ptrs {
-		socketDevices[i] = newVirtioSocketDevice(ptr, v.dispatchQueue)
+		socketDevices[i] = newVirtioSocketDevice(ptr, v.dispatchQueue, v.log)
 	}
 	return socketDevices
 }
@@ -201,7 +252,7 @@ func (v *VirtualMachine) USBControllers() []*USBController {
 	ptrs := nsArray.ToPointerSlice()
 	usbControllers := make([]*USBController, len(ptrs))
 	for i, ptr := range ptrs {
-		usbControllers[i] = newUSBController(ptr, v.dispatchQueue)
+		usbControllers[i] = newUSBController(ptr, v.dispatchQueue, v.log, v.events)
 	}
 	return usbControllers
 }
@@ -218,6 +269,13 @@ func changeStateOnObserver(newStateRaw C.int, cgoHandleUintptr C.uintptr_t) {
 	v.state = newState
 	v.stateNotify.In() <- newState
 	v.mu.Unlock()
+
+	level := slog.LevelInfo
+	if newState == VirtualMachineStateError {
+		level = slog.LevelError
+	}
+	v.log.get().Log(context.Background(), level, "virtual machine state changed", slog.String("state", newState.String()))
+	v.events.emit(EventStateChanged, &StateChangedEvent{State: newState})
 }
 
 // State represents execution state of the virtual machine.
@@ -460,6 +518,14 @@ type disconnected struct {
 	index int
 }
 
+// disconnectedHandler is the value of the handle which receives the disconnections
+// of the network attachments.
+type disconnectedHandler struct {
+	ch     *infinity.Channel[*disconnected]
+	log    *machineLogger
+	events *eventHub
+}
+
 // NetworkDeviceAttachmentWasDisconnected returns a receive channel.
 // The channel emits an error message each time the network attachment is disconnected,
 // typically triggered by events such as failure to start, initial boot, device reset, or reboot.
@@ -499,8 +565,12 @@ func emitAttachmentWasDisconnected(index C.int, errPtr unsafe.Pointer, cgoHandle
 	err := newNSError(errPtr)
 	// I expected it will not cause panic.
 	// if caused panic, that's unexpected behavior.
-	ch, _ := handler.Value().(*infinity.Channel[*disconnected])
-	ch.In() <- &disconnected{
+	h, _ := handler.Value().(*disconnectedHandler)
+	h.log.get().Warn("network attachment was disconnected",
+		append([]any{slog.String(LogKeyDevice, "network"), slog.Int("index", int(index))}, errorAttrs(err)...)...,
+	)
+	h.events.emit(EventNetworkDisconnected, &NetworkDisconnectedEvent{Index: int(index), Err: err})
+	h.ch.In() <- &disconnected{
 		err:   err,
 		index: int(index),
 	}
@@ -511,6 +581,6 @@ func closeAttachmentWasDisconnectedChannel(cgoHandleUintptr C.uintptr_t) {
 	handler := cgo.Handle(cgoHandleUintptr)
 	// I expected it will not cause panic.
 	// if caused panic, that's unexpected behavior.
-	ch, _ := handler.Value().(*infinity.Channel[*disconnected])
-	ch.Close()
+	h, _ := handler.Value().(*disconnectedHandler)
+	h.ch.Close()
 }
@@ -57,6 +57,7 @@ void closeAttachmentWasDisconnectedChannel(uintptr_t cgoHandle);
 
 /* BootLoader */
 void *newVZLinuxBootLoader(const char *kernelPath);
+void setKernelURLVZLinuxBootLoader(void *bootLoaderPtr, const char *kernelPath);
 void setCommandLineVZLinuxBootLoader(void *bootLoaderPtr, const char *commandLine);
 void setInitialRamdiskURLVZLinuxBootLoader(void *bootLoaderPtr, const char *ramdiskPath);
 
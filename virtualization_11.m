@@ -175,6 +175,23 @@ void *newVZLinuxBootLoader(const char *kernelPath)
     RAISE_UNSUPPORTED_MACOS_EXCEPTION();
 }
 
+/*!
+ @abstract Set the URL of the Linux kernel.
+ @param bootLoader VZLinuxBootLoader
+ @param kernelPath Path of Linux kernel on the local file system.
+ */
+void setKernelURLVZLinuxBootLoader(void *bootLoaderPtr, const char *kernelPath)
+{
+    if (@available(macOS 11, *)) {
+        NSString *kernelPathNSString = [NSString stringWithUTF8String:kernelPath];
+        NSURL *kernelURL = [NSURL fileURLWithPath:kernelPathNSString];
+        [(VZLinuxBootLoader *)bootLoaderPtr setKernelURL:kernelURL];
+        return;
+    }
+
+    RAISE_UNSUPPORTED_MACOS_EXCEPTION();
+}
+
 /*!
  @abstract Set the command-line parameters.
  @param bootLoader VZLinuxBootLoader
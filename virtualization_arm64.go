@@ -16,6 +16,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"runtime/cgo"
@@ -381,10 +382,17 @@ func downloadRestoreImage(ctx context.Context, url string, destPath string) (*pr
 
 	reader := progress.NewReader(resp.Body, resp.ContentLength, fileInfo.Size())
 
+	logger := Logger().With(slog.String(LogKeyDevice, "restore-image"), slog.String("url", url), slog.String("path", destPath))
+	logger.Info("downloading restore image", slog.Int64("offset", fileInfo.Size()), slog.Int64("size", resp.ContentLength))
 	go func() {
 		defer f.Close()
 		defer resp.Body.Close()
-		_, err := io.Copy(f, reader)
+		n, err := io.Copy(f, reader)
+		if err != nil {
+			logger.Error("failed to download restore image", append([]any{slog.Int64("bytes", n)}, errorAttrs(err)...)...)
+		} else {
+			logger.Info("downloaded restore image", slog.Int64("bytes", n))
+		}
 		reader.Finish(err)
 	}()
 
@@ -551,10 +559,12 @@ func (m *MacOSInstaller) Install(ctx context.Context) error {
 	m.once.Do(func() {
 		completionHandler := cgo.NewHandle(func(err error) {
 			m.err = err
+			m.vm.events.emit(EventInstallCompleted, &InstallCompletedEvent{Err: err})
 			close(m.doneCh)
 		})
 		fractionCompletedHandler := cgo.NewHandle(func(v float64) {
 			m.setFractionCompleted(v)
+			m.vm.events.emit(EventInstallProgress, &InstallProgressEvent{FractionCompleted: v})
 		})
 
 		C.installByVZMacOSInstaller(
@@ -618,7 +628,9 @@ func (v *VirtualMachine) SaveMachineStateToPath(saveFilePath string) error {
 	handle := cgo.NewHandle(h)
 	defer handle.Delete()
 	C.saveMachineStateToURLWithCompletionHandler(objc.Ptr(v), v.dispatchQueue, C.uintptr_t(handle), cs.CString())
-	return <-errCh
+	err := <-errCh
+	v.events.emit(EventSaveCompleted, &SaveCompletedEvent{Path: saveFilePath, Err: err})
+	return err
 }
 
 // RestoreMachineStateFromURL restores a VM from a previously saved state.
@@ -652,5 +664,7 @@ func (v *VirtualMachine) RestoreMachineStateFromURL(saveFilePath string) error {
 	handle := cgo.NewHandle(h)
 	defer handle.Delete()
 	C.restoreMachineStateFromURLWithCompletionHandler(objc.Ptr(v), v.dispatchQueue, C.uintptr_t(handle), cs.CString())
-	return <-errCh
+	err := <-errCh
+	v.events.emit(EventRestoreCompleted, &RestoreCompletedEvent{Path: saveFilePath, Err: err})
+	return err
 }
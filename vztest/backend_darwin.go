@@ -0,0 +1,29 @@
+package vztest
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/Code-Hex/vz/v3"
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/vzmachine"
+)
+
+var defaultBackend machine.Backend = vzmachine.Backend
+
+// unavailable reports whether err tells that virtualization is not available, such
+// as when the macOS version is not supported, when the process does not have the
+// entitlement, and when the host does not support virtualization like the virtual
+// machines of CI services.
+func unavailable(err error) bool {
+	if errors.Is(err, vz.ErrUnsupportedOSVersion) {
+		return true
+	}
+	var nserr *vz.NSError
+	if !errors.As(err, &nserr) {
+		return false
+	}
+	desc := nserr.LocalizedDescription + " " + nserr.UserInfo
+	return strings.Contains(desc, "com.apple.security.virtualization") ||
+		strings.Contains(desc, "Virtualization is not available")
+}
@@ -0,0 +1,12 @@
+package vztest
+
+import "github.com/Code-Hex/vz/v3/machine"
+
+// defaultBackend is nil because Virtualization.framework is not available, so the
+// tests are skipped unless WithBackend is given.
+var defaultBackend machine.Backend
+
+// unavailable reports whether err tells that virtualization is not available.
+func unavailable(error) bool {
+	return false
+}
@@ -0,0 +1,66 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package vztest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+)
+
+// maxConsoleLog is the size of the output of the console which is kept.
+const maxConsoleLog = 1 << 20
+
+// consoleLog keeps the tail of the output of the serial console.
+type consoleLog struct {
+	mu  sync.Mutex
+	buf []byte
+	// changed is closed and replaced when the output is written.
+	changed chan struct{}
+}
+
+func newConsoleLog() *consoleLog {
+	return &consoleLog{changed: make(chan struct{})}
+}
+
+// capture reads the console until it fails.
+func (l *consoleLog) capture(r io.Reader) {
+	io.Copy(l, r)
+}
+
+func (l *consoleLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf = append(l.buf, p...)
+	if n := len(l.buf) - maxConsoleLog; n > 0 {
+		l.buf = append(l.buf[:0], l.buf[n:]...)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return len(p), nil
+}
+
+func (l *consoleLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return string(l.buf)
+}
+
+// wait waits until the output contains s.
+func (l *consoleLog) wait(ctx context.Context, s string) error {
+	for {
+		l.mu.Lock()
+		found, changed := bytes.Contains(l.buf, []byte(s)), l.changed
+		l.mu.Unlock()
+		if found {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
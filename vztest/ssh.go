@@ -0,0 +1,86 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package vztest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"golang.org/x/crypto/ssh"
+)
+
+// PasswordConfig returns the client config which logs in with the password. The
+// host key is not verified because the guests of the tests are trusted.
+func PasswordConfig(user, password string) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	}
+}
+
+// SSH connects to the SSH server of the guest which listens on the virtio-vsock
+// port. It retries until the server accepts the connection, and the test fails if
+// it does not within the boot timeout. The client is closed when the test
+// completes.
+func (vm *VM) SSH(port uint32, config *ssh.ClientConfig) *ssh.Client {
+	vm.t.Helper()
+	d, ok := vm.Machine.(machine.VsockDialer)
+	if !ok {
+		vm.t.Fatalf("vztest: the machine %s has no virtio-vsock device", vm.spec.Name)
+	}
+	ctx, cancel := vm.bootContext()
+	defer cancel()
+	var client *ssh.Client
+	err := machine.WaitReady(ctx, vm.Machine, func(ctx context.Context) (err error) {
+		client, err = dialSSH(ctx, d, port, config)
+		return err
+	})
+	if err != nil {
+		vm.t.Fatalf("vztest: failed to connect to SSH of %s: %v", vm.spec.Name, err)
+	}
+	vm.t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// dialSSH connects to the port and performs the SSH handshake.
+func dialSSH(ctx context.Context, d machine.VsockDialer, port uint32, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := d.DialVsock(ctx, port)
+	if err != nil {
+		return nil, err
+	}
+	if config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, conn.RemoteAddr().String(), config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// SSHRun runs the command in a new session of the client and returns its combined
+// output. The test fails unless the command exits with 0.
+func (vm *VM) SSHRun(client *ssh.Client, cmd string) string {
+	vm.t.Helper()
+	out, err := sshRun(client, cmd)
+	if err != nil {
+		vm.t.Fatalf("vztest: %q failed in %s: %v\n%s", cmd, vm.spec.Name, err, out)
+	}
+	return string(out)
+}
+
+func sshRun(client *ssh.Client, cmd string) ([]byte, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a session: %w", err)
+	}
+	defer session.Close()
+	return session.CombinedOutput(cmd)
+}
@@ -0,0 +1,377 @@
+//go:build darwin || linux
+// +build darwin linux
+
+// Package vztest provides utilities for the tests which boot Linux machines, such
+// as the tests of the guest images and of the tools running in the guests:
+//
+//	func TestGuest(t *testing.T) {
+//		vm := vztest.NewFixture(t, "testdata/Image").
+//			Initrd("testdata/initramfs.cpio.gz").
+//			CommandLine("console=hvc0").
+//			EmptyDisk(1 * machine.GiB).
+//			Boot()
+//		vm.WaitConsole("login:")
+//		out := vm.Run("uname", "-r")
+//		...
+//	}
+//
+// The machine is stopped and its disk images are removed when the test and its
+// subtests complete. The output of the serial console is captured, and it is
+// logged when the test has failed.
+//
+// The tests are skipped when the machines cannot run, such as on the platforms
+// other than macOS, on the macOS versions which are not supported, and when the
+// test binary is not signed with the com.apple.security.virtualization
+// entitlement (see cmd/codesign).
+package vztest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/internal/fileutil"
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/agent"
+)
+
+// stopTimeout is the time to wait for the machine to stop in the cleanup.
+const stopTimeout = 10 * time.Second
+
+// Fixture builds the spec of a Linux machine for a test. The methods fail the test
+// on errors and return the fixture, so that they can be chained.
+type Fixture struct {
+	t    testing.TB
+	spec *machine.Spec
+}
+
+// NewFixture creates a fixture of the machine which boots the Linux kernel. The
+// machine has a virtio-vsock device for the guest agent and SSH.
+func NewFixture(t testing.TB, kernel string) *Fixture {
+	t.Helper()
+	f := &Fixture{t: t, spec: &machine.Spec{Name: machineName(t.Name()), Vsock: true}}
+	f.spec.Kernel = f.file(kernel)
+	return f
+}
+
+// invalidName matches the characters which are not allowed in the machine names.
+var invalidName = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// machineName returns the machine name for the test name.
+func machineName(test string) string {
+	name := strings.Trim(invalidName.ReplaceAllString(test, "-"), "-._")
+	if name == "" {
+		return "vztest"
+	}
+	return name
+}
+
+// file returns the absolute path of the file, which must exist.
+func (f *Fixture) file(path string) string {
+	f.t.Helper()
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		f.t.Fatalf("vztest: %v", err)
+	}
+	if _, err := os.Stat(abs); err != nil {
+		f.t.Fatalf("vztest: fixture file is not available: %v", err)
+	}
+	return abs
+}
+
+// Initrd sets the initial RAM disk.
+func (f *Fixture) Initrd(path string) *Fixture {
+	f.t.Helper()
+	f.spec.Initrd = f.file(path)
+	return f
+}
+
+// CommandLine sets the kernel command line.
+func (f *Fixture) CommandLine(cmdline string) *Fixture {
+	f.spec.CommandLine = cmdline
+	return f
+}
+
+// CPUs sets the number of the virtual CPUs.
+func (f *Fixture) CPUs(n uint) *Fixture {
+	f.spec.CPUs = n
+	return f
+}
+
+// Memory sets the size of the memory.
+func (f *Fixture) Memory(size machine.Size) *Fixture {
+	f.spec.Memory = size
+	return f
+}
+
+// Disk attaches a copy of the disk image, so that the test does not change the
+// image. The copy is removed when the test completes.
+func (f *Fixture) Disk(path string) *Fixture {
+	f.t.Helper()
+	src := f.file(path)
+	dst := filepath.Join(f.t.TempDir(), filepath.Base(src))
+	if err := fileutil.Clone(dst, src); err != nil {
+		f.t.Fatalf("vztest: failed to copy %s: %v", path, err)
+	}
+	f.spec.Disks = append(f.spec.Disks, machine.Disk{Path: dst})
+	return f
+}
+
+// ReadOnlyDisk attaches the disk image read-only without copying it.
+func (f *Fixture) ReadOnlyDisk(path string) *Fixture {
+	f.t.Helper()
+	f.spec.Disks = append(f.spec.Disks, machine.Disk{Path: f.file(path), ReadOnly: true})
+	return f
+}
+
+// EmptyDisk attaches a new empty disk image of the size, which is removed when the
+// test completes.
+func (f *Fixture) EmptyDisk(size machine.Size) *Fixture {
+	f.t.Helper()
+	path := filepath.Join(f.t.TempDir(), fmt.Sprintf("disk%d.img", len(f.spec.Disks)))
+	f.spec.Disks = append(f.spec.Disks, machine.Disk{Path: path, Size: size})
+	return f
+}
+
+// Network attaches a NAT network device.
+func (f *Fixture) Network() *Fixture {
+	f.spec.Networks = append(f.spec.Networks, machine.Network{})
+	return f
+}
+
+// Spec returns the spec of the machine. The machine is named after the test.
+func (f *Fixture) Spec() *machine.Spec {
+	return f.spec.Clone()
+}
+
+// Boot boots the machine of the fixture. See Boot.
+func (f *Fixture) Boot(opts ...Option) *VM {
+	f.t.Helper()
+	return Boot(f.t, f.Spec(), opts...)
+}
+
+type options struct {
+	backend     machine.Backend
+	bootTimeout time.Duration
+	agentPort   uint32
+}
+
+// Option is an option for Boot.
+type Option func(*options)
+
+// WithBackend sets the backend which creates the machine. The default is
+// vzmachine.Backend on macOS, and there is no default on the other platforms.
+func WithBackend(backend machine.Backend) Option {
+	return func(o *options) {
+		o.backend = backend
+	}
+}
+
+// WithBootTimeout sets the time to wait for the machine to be running, and for the
+// guest to be ready in the helpers such as WaitConsole, Agent and SSH. The default
+// is 2 minutes.
+func WithBootTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.bootTimeout = d
+	}
+}
+
+// WithAgentPort sets the virtio-vsock port of the guest agent. The default is
+// agent.DefaultPort.
+func WithAgentPort(port uint32) Option {
+	return func(o *options) {
+		o.agentPort = port
+	}
+}
+
+// VM is a running machine of a test.
+type VM struct {
+	machine.Machine
+
+	t       testing.TB
+	spec    *machine.Spec
+	opts    *options
+	console *consoleLog
+	// captured is closed when the capture of the console has ended.
+	captured chan struct{}
+	agent    *agent.Client
+}
+
+// Boot creates the machine of the spec and waits until it is running. The machine
+// is stopped when the test and its subtests complete, and the output of its serial
+// console is logged if the test has failed.
+//
+// The test is skipped if the machine cannot run on this host, and fails on the
+// other errors.
+func Boot(t testing.TB, spec *machine.Spec, opts ...Option) *VM {
+	t.Helper()
+	o := &options{
+		backend:     defaultBackend,
+		bootTimeout: 2 * time.Minute,
+		agentPort:   agent.DefaultPort,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.backend == nil {
+		t.Skipf("vztest: virtualization is not available on %s", runtime.GOOS)
+	}
+	m, err := o.backend.NewMachine(spec)
+	if err != nil {
+		skipUnavailable(t, err)
+		t.Fatalf("vztest: failed to create the machine %s: %v", spec.Name, err)
+	}
+	vm := &VM{Machine: m, t: t, spec: spec.Clone(), opts: o, console: newConsoleLog()}
+	if c, ok := m.(machine.Consoler); ok {
+		vm.captured = make(chan struct{})
+		go func() {
+			defer close(vm.captured)
+			vm.console.capture(c.Console())
+		}()
+	}
+	t.Cleanup(vm.teardown)
+
+	if err := m.Start(); err != nil {
+		skipUnavailable(t, err)
+		t.Fatalf("vztest: failed to start the machine %s: %v", spec.Name, err)
+	}
+	ctx, cancel := vm.bootContext()
+	defer cancel()
+	if err := machine.WaitRunning(ctx, m); err != nil {
+		if errors.Is(err, machine.ErrInvalidState) {
+			t.Fatalf("vztest: failed to boot the machine %s: %v", spec.Name, err)
+		}
+		t.Fatalf("vztest: the machine %s is not running within %s", spec.Name, o.bootTimeout)
+	}
+	return vm
+}
+
+// skipUnavailable skips the test if err tells that the machine cannot run on this
+// host.
+func skipUnavailable(t testing.TB, err error) {
+	t.Helper()
+	if errors.Is(err, machine.ErrUnsupported) || unavailable(err) {
+		t.Skipf("vztest: virtualization is not available: %v", err)
+	}
+}
+
+// bootContext returns the context which is done after the boot timeout.
+func (vm *VM) bootContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), vm.opts.bootTimeout)
+}
+
+// teardown stops the machine, and logs the console if the test has failed.
+func (vm *VM) teardown() {
+	if err := machine.StopAndWait(vm.Machine, stopTimeout); err != nil {
+		vm.t.Errorf("vztest: failed to stop the machine %s: %v", vm.spec.Name, err)
+	}
+	// Closing the stopped machine releases its console, which ends the capture.
+	if c, ok := vm.Machine.(io.Closer); ok && !vm.State().Active() {
+		if err := c.Close(); err != nil {
+			vm.t.Errorf("vztest: failed to close the machine %s: %v", vm.spec.Name, err)
+		}
+		if vm.captured != nil {
+			select {
+			case <-vm.captured:
+			case <-time.After(stopTimeout):
+			}
+		}
+	}
+	if vm.t.Failed() {
+		vm.t.Logf("console of %s:\n%s", vm.spec.Name, vm.console.String())
+	}
+}
+
+// Spec returns the spec of the machine.
+func (vm *VM) Spec() *machine.Spec {
+	return vm.spec.Clone()
+}
+
+// ConsoleLog returns the output of the serial console so far. The beginning is
+// dropped when the output is large.
+func (vm *VM) ConsoleLog() string {
+	return vm.console.String()
+}
+
+// WaitConsole waits until the serial console prints s, such as a login prompt. The
+// test fails if it is not printed within the boot timeout.
+func (vm *VM) WaitConsole(s string) {
+	vm.t.Helper()
+	ctx, cancel := vm.bootContext()
+	defer cancel()
+	if err := vm.console.wait(ctx, s); err != nil {
+		vm.t.Fatalf("vztest: the console of %s does not print %q: %v", vm.spec.Name, s, err)
+	}
+}
+
+// WriteConsole writes s to the serial console.
+func (vm *VM) WriteConsole(s string) {
+	vm.t.Helper()
+	c, ok := vm.Machine.(machine.Consoler)
+	if !ok {
+		vm.t.Fatalf("vztest: the machine %s has no console", vm.spec.Name)
+	}
+	if _, err := c.Console().Write([]byte(s)); err != nil {
+		vm.t.Fatalf("vztest: failed to write to the console of %s: %v", vm.spec.Name, err)
+	}
+}
+
+// Agent returns the client of the guest agent (cmd/vzagent) after it responds. The
+// test fails if the agent is not ready within the boot timeout.
+func (vm *VM) Agent() *agent.Client {
+	vm.t.Helper()
+	if vm.agent != nil {
+		return vm.agent
+	}
+	d, ok := vm.Machine.(machine.VsockDialer)
+	if !ok {
+		vm.t.Fatalf("vztest: the machine %s has no virtio-vsock device", vm.spec.Name)
+	}
+	client := agent.NewMachineClient(d, vm.opts.agentPort)
+	ctx, cancel := vm.bootContext()
+	defer cancel()
+	if err := machine.WaitReady(ctx, vm.Machine, client.Ping); err != nil {
+		vm.t.Fatalf("vztest: the guest agent of %s is not ready: %v", vm.spec.Name, err)
+	}
+	vm.agent = client
+	return client
+}
+
+// ExecResult is the result of Exec.
+type ExecResult struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+}
+
+// Exec runs the command by the guest agent. A non-zero exit code is not a failure,
+// but the test fails if the command cannot be run.
+func (vm *VM) Exec(args ...string) *ExecResult {
+	vm.t.Helper()
+	client := vm.Agent()
+	var stdout, stderr strings.Builder
+	code, err := client.Exec(context.Background(), &agent.Command{Args: args, Stdout: &stdout, Stderr: &stderr})
+	if err != nil {
+		vm.t.Fatalf("vztest: failed to run %q in %s: %v", args, vm.spec.Name, err)
+	}
+	return &ExecResult{ExitCode: code, Stdout: stdout.String(), Stderr: stderr.String()}
+}
+
+// Run runs the command by the guest agent and returns its output. The test fails
+// unless the command exits with 0.
+func (vm *VM) Run(args ...string) string {
+	vm.t.Helper()
+	r := vm.Exec(args...)
+	if r.ExitCode != 0 {
+		vm.t.Fatalf("vztest: %q exited with %d in %s: %s", args, r.ExitCode, vm.spec.Name, r.Stderr)
+	}
+	return r.Stdout
+}
@@ -0,0 +1,437 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package vztest_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Code-Hex/vz/v3/machine"
+	"github.com/Code-Hex/vz/v3/machine/agent"
+	"github.com/Code-Hex/vz/v3/machine/fake"
+	"github.com/Code-Hex/vz/v3/vztest"
+	"golang.org/x/crypto/ssh"
+)
+
+// errStop stops the function run by recordTB like runtime.Goexit of testing.T.
+var errStop = errors.New("test stopped")
+
+// recordTB records the results of the test instead of reporting them, so that the
+// failures and the skips of the helpers can be tested.
+type recordTB struct {
+	testing.TB
+
+	mu       sync.Mutex
+	cleanups []func()
+	logs     []string
+	failed   bool
+	skipped  bool
+}
+
+func (tb *recordTB) Helper() {}
+
+func (tb *recordTB) Cleanup(f func()) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.cleanups = append(tb.cleanups, f)
+}
+
+func (tb *recordTB) Logf(format string, args ...any) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.logs = append(tb.logs, fmt.Sprintf(format, args...))
+}
+
+func (tb *recordTB) Errorf(format string, args ...any) {
+	tb.Logf(format, args...)
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.failed = true
+}
+
+func (tb *recordTB) Fatalf(format string, args ...any) {
+	tb.Errorf(format, args...)
+	panic(errStop)
+}
+
+func (tb *recordTB) Skipf(format string, args ...any) {
+	tb.Logf(format, args...)
+	tb.mu.Lock()
+	tb.skipped = true
+	tb.mu.Unlock()
+	panic(errStop)
+}
+
+func (tb *recordTB) Failed() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.failed
+}
+
+func (tb *recordTB) log() string {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return strings.Join(tb.logs, "\n")
+}
+
+// run runs f and then the cleanups in the reverse order like testing.T.
+func (tb *recordTB) run(f func(tb testing.TB)) {
+	defer func() {
+		for i := len(tb.cleanups) - 1; i >= 0; i-- {
+			tb.cleanups[i]()
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil && r != errStop {
+			panic(r)
+		}
+	}()
+	f(tb)
+}
+
+// writeFile writes a fixture file to the temporary directory.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newFixture(tb testing.TB, t *testing.T) *vztest.Fixture {
+	return vztest.NewFixture(tb, writeFile(t, "Image", "kernel")).
+		Initrd(writeFile(t, "initrd.img", "initrd")).
+		CommandLine("console=hvc0")
+}
+
+func TestFixture(t *testing.T) {
+	disk := writeFile(t, "root.img", "root")
+	spec := newFixture(t, t).
+		CPUs(4).
+		Memory(machine.GiB).
+		Disk(disk).
+		ReadOnlyDisk(disk).
+		EmptyDisk(16 * machine.MiB).
+		Network().
+		Spec()
+
+	if want := "TestFixture"; spec.Name != want {
+		t.Fatalf("want %q but got %q", want, spec.Name)
+	}
+	if !spec.Vsock || spec.CPUs != 4 || spec.Memory != machine.GiB || len(spec.Networks) != 1 {
+		t.Fatalf("unexpected spec: %+v", spec)
+	}
+	if !filepath.IsAbs(spec.Kernel) || !filepath.IsAbs(spec.Initrd) || spec.CommandLine != "console=hvc0" {
+		t.Fatalf("unexpected boot loader: %+v", spec)
+	}
+	if len(spec.Disks) != 3 {
+		t.Fatalf("want 3 disks but got %+v", spec.Disks)
+	}
+	copied := spec.Disks[0]
+	if copied.Path == disk || copied.ReadOnly {
+		t.Fatalf("want a writable copy of %s but got %+v", disk, copied)
+	}
+	if b, err := os.ReadFile(copied.Path); err != nil || string(b) != "root" {
+		t.Fatalf("want the copy of the disk but got %q, %v", b, err)
+	}
+	if d := spec.Disks[1]; d.Path != disk || !d.ReadOnly {
+		t.Fatalf("want the read-only disk %s but got %+v", disk, d)
+	}
+	if d := spec.Disks[2]; d.Size != 16*machine.MiB || filepath.Base(d.Path) != "disk2.img" {
+		t.Fatalf("want a new empty disk but got %+v", d)
+	}
+	if err := spec.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("sub/test name", func(t *testing.T) {
+		spec := newFixture(t, t).Spec()
+		if want := "TestFixture-sub-test_name"; spec.Name != want {
+			t.Fatalf("want %q but got %q", want, spec.Name)
+		}
+	})
+}
+
+func TestFixtureMissingFile(t *testing.T) {
+	tb := &recordTB{TB: t}
+	tb.run(func(tb testing.TB) {
+		vztest.NewFixture(tb, filepath.Join(t.TempDir(), "Image"))
+	})
+	if !tb.failed || !strings.Contains(tb.log(), "not available") {
+		t.Fatalf("want a failure but got %v: %s", tb.failed, tb.log())
+	}
+}
+
+func TestBootSkip(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend machine.Backend
+	}{
+		{name: "no backend", backend: nil},
+		{
+			name: "unsupported",
+			backend: machine.BackendFunc(func(*machine.Spec) (machine.Machine, error) {
+				return nil, fmt.Errorf("%w: no virtualization", machine.ErrUnsupported)
+			}),
+		},
+		{
+			name: "start",
+			backend: fake.NewBackend(func(m *fake.Machine) {
+				m.FailNext(fake.OpStart, fmt.Errorf("%w: no virtualization", machine.ErrUnsupported))
+			}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := &recordTB{TB: t}
+			tb.run(func(tb testing.TB) {
+				newFixture(tb, t).Boot(vztest.WithBackend(tt.backend))
+				t.Error("want the test to be skipped")
+			})
+			if !tb.skipped || tb.failed {
+				t.Fatalf("want skipped but got failed=%v: %s", tb.failed, tb.log())
+			}
+		})
+	}
+}
+
+func TestBootFailure(t *testing.T) {
+	tb := &recordTB{TB: t}
+	tb.run(func(tb testing.TB) {
+		newFixture(tb, t).Boot(vztest.WithBackend(fake.NewBackend(func(m *fake.Machine) {
+			m.FailNext(fake.OpStart, errors.New("broken"))
+		})))
+	})
+	if tb.skipped || !tb.failed || !strings.Contains(tb.log(), "broken") {
+		t.Fatalf("want a failure but got skipped=%v: %s", tb.skipped, tb.log())
+	}
+}
+
+func TestTeardown(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		t.Run(fmt.Sprintf("failed=%v", fail), func(t *testing.T) {
+			var m *fake.Machine
+			backend := fake.NewBackend(func(fm *fake.Machine) {
+				m = fm
+				go fm.Guest().Write([]byte("Linux version 6.1\nlogin: "))
+			})
+			tb := &recordTB{TB: t}
+			tb.run(func(tb testing.TB) {
+				vm := newFixture(tb, t).Boot(vztest.WithBackend(backend))
+				if s := vm.State(); s != machine.StateRunning {
+					t.Fatalf("want running but got %s", s)
+				}
+				vm.WaitConsole("login:")
+				if log := vm.ConsoleLog(); !strings.Contains(log, "Linux version") {
+					t.Fatalf("want the console log but got %q", log)
+				}
+				if fail {
+					tb.Errorf("assertion failed")
+				}
+			})
+			if s := m.State(); s != machine.StateStopped {
+				t.Fatalf("want stopped but got %s", s)
+			}
+			if logged := strings.Contains(tb.log(), "Linux version"); logged != fail {
+				t.Fatalf("want the console logged %v but got %s", fail, tb.log())
+			}
+		})
+	}
+}
+
+func TestWaitConsoleTimeout(t *testing.T) {
+	tb := &recordTB{TB: t}
+	tb.run(func(tb testing.TB) {
+		vm := newFixture(tb, t).Boot(vztest.WithBackend(fake.NewBackend()), vztest.WithBootTimeout(100*time.Millisecond))
+		vm.WaitConsole("login:")
+	})
+	if !tb.failed || !strings.Contains(tb.log(), `does not print "login:"`) {
+		t.Fatalf("want a failure but got %s", tb.log())
+	}
+}
+
+func TestAgent(t *testing.T) {
+	backend := fake.NewBackend(func(m *fake.Machine) {
+		ln, err := m.ListenVsock(agent.DefaultPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go (&agent.Server{Exec: agent.ExecCommand}).Serve(ln)
+	})
+	vm := newFixture(t, t).Boot(vztest.WithBackend(backend))
+
+	if got := vm.Run("echo", "hello"); got != "hello\n" {
+		t.Fatalf("want %q but got %q", "hello\n", got)
+	}
+	r := vm.Exec("sh", "-c", "echo oops >&2; exit 3")
+	if r.ExitCode != 3 || r.Stderr != "oops\n" {
+		t.Fatalf("want exit 3 with oops but got %+v", r)
+	}
+
+	tb := &recordTB{TB: t}
+	tb.run(func(tb testing.TB) {
+		newFixture(tb, t).Boot(vztest.WithBackend(backend)).Run("false")
+	})
+	if !tb.failed || !strings.Contains(tb.log(), "exited with 1") {
+		t.Fatalf("want a failure but got %s", tb.log())
+	}
+}
+
+func TestAgentNotReady(t *testing.T) {
+	tb := &recordTB{TB: t}
+	tb.run(func(tb testing.TB) {
+		vm := newFixture(tb, t).Boot(vztest.WithBackend(fake.NewBackend()), vztest.WithBootTimeout(100*time.Millisecond))
+		vm.Agent()
+	})
+	if !tb.failed || !strings.Contains(tb.log(), "guest agent") {
+		t.Fatalf("want a failure but got %s", tb.log())
+	}
+}
+
+// serveSSH serves the sessions which print the commands on the port of the machine.
+// The connections are proxied to a TCP listener because both sides of SSH write
+// first, which blocks on the unbuffered connections of the fake machines.
+func serveSSH(t *testing.T, m *fake.Machine, port uint32) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() != "root" || !bytes.Equal(pass, []byte("passwd")) {
+				return nil, errors.New("access denied")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSHConn(conn, config)
+		}
+	}()
+	ln, err := m.ListenVsock(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go proxy(conn, tcp.Addr().String())
+		}
+	}()
+}
+
+// proxy copies the data between conn and a new connection to addr.
+func proxy(conn net.Conn, addr string) {
+	defer conn.Close()
+	upstream, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func serveSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range requests {
+				var exec struct{ Command string }
+				if req.Type != "exec" || ssh.Unmarshal(req.Payload, &exec) != nil {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				status := uint32(0)
+				if exec.Command == "false" {
+					status = 1
+				}
+				fmt.Fprintf(ch, "ran %s\n", exec.Command)
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				return
+			}
+		}()
+	}
+}
+
+func TestSSH(t *testing.T) {
+	const port = 2222
+	vm := newFixture(t, t).Boot(vztest.WithBackend(fake.NewBackend(func(m *fake.Machine) {
+		serveSSH(t, m, port)
+	})))
+
+	client := vm.SSH(port, vztest.PasswordConfig("root", "passwd"))
+	if got, want := vm.SSHRun(client, "uname -a"), "ran uname -a\n"; got != want {
+		t.Fatalf("want %q but got %q", want, got)
+	}
+
+	tb := &recordTB{TB: t}
+	tb.run(func(tb testing.TB) {
+		vm := newFixture(tb, t).Boot(vztest.WithBackend(fake.NewBackend(func(m *fake.Machine) {
+			serveSSH(t, m, port)
+		})), vztest.WithBootTimeout(time.Second))
+		vm.SSHRun(vm.SSH(port, vztest.PasswordConfig("root", "passwd")), "false")
+	})
+	if !tb.failed || !strings.Contains(tb.log(), `"false" failed`) {
+		t.Fatalf("want a failure but got %s", tb.log())
+	}
+
+	tb = &recordTB{TB: t}
+	tb.run(func(tb testing.TB) {
+		vm := newFixture(tb, t).Boot(vztest.WithBackend(fake.NewBackend(func(m *fake.Machine) {
+			serveSSH(t, m, port)
+		})), vztest.WithBootTimeout(200*time.Millisecond))
+		vm.SSH(port, vztest.PasswordConfig("root", "wrong"))
+	})
+	if !tb.failed || !strings.Contains(tb.log(), "failed to connect to SSH") {
+		t.Fatalf("want a failure but got %s", tb.log())
+	}
+}